@@ -1,65 +1,345 @@
 package main
 
 import (
+	"context"
 	"flag"
+	"fmt"
 	"log"
 	"os"
 	"os/signal"
+	"strings"
+	"sync"
 	"syscall"
+	"time"
 
 	"github.com/fqzz2000/QUIC-LB-SHRIMP/pkg/lb"
+	"github.com/fqzz2000/QUIC-LB-SHRIMP/pkg/metrics"
+	"github.com/fqzz2000/QUIC-LB-SHRIMP/pkg/quiclb"
+	"github.com/fqzz2000/QUIC-LB-SHRIMP/pkg/version"
 )
 
 // Configuration flags
 var (
 	configFile string
 	listenAddr string
+	listenNet  string
+	acceptPrxy bool
+	adminAddr  string
+	pprofOn    bool
+	ctrlAddr   string
+	ctrlNet    string
 	debugMode  bool
+	traceRate  float64
+	showVer    bool
+	drainTime  time.Duration
+	resolveMax time.Duration
+	hashSeed   uint64
+	backendSck string
+	srcPorts   string
+	backendSrc string
+	zeroRTT    string
+	zeroRTTCap int
+	unknownIDs string
+	catchAll   string
+	drainingNF string
+	canary     string
+	canaryPct  float64
+	flowRate   float64
+	flowBurst  int
+	healthIntv time.Duration
+	healthWait time.Duration
+	slowPacket time.Duration
+	smallInits bool
+	rotations  string
+	nonceWin   int
+	nonceRate  float64
+	idSamples  int
+	idRate     float64
+	srcFlows   int
+	shards     int
+	trailing   string
+	reorderCo  string
+	loadAge    time.Duration
+	loadTol    float64
+	verifyIDs  bool
+	listenWait time.Duration
+	listeners  string
+	malformed  string
+	minCID     int
+	duplicates string
+	metricsFmt string
 )
 
 func init() {
 	// Parse command line flags
 	flag.StringVar(&configFile, "config", "config.yaml", "Path to configuration file")
 	flag.StringVar(&listenAddr, "listen", ":8080", "Address to listen on")
+	flag.StringVar(&listenNet, "listen-net", "udp", "Network to listen on: udp, udp4, udp6, unixgram or transparent (Linux TPROXY)")
+	flag.DurationVar(&listenWait, "listen-retry", 0, "How long to keep retrying a listen address still in use, for fast restarts (fail at once if 0)")
+	flag.StringVar(&listeners, "listeners", "", "More UDP addresses the first service listens on, as addr=dcid-length,...: each reads short headers with its own DCID length (0 for the QUIC-LB config's)")
+	flag.BoolVar(&acceptPrxy, "accept-proxy-protocol", false, "Strip PROXY v2 headers from client datagrams and route by the client they name, behind another load balancer")
+	flag.StringVar(&adminAddr, "admin", "", "Address of the admin HTTP server (disabled if empty)")
+	flag.StringVar(&metricsFmt, "metrics-format", "prometheus", "Exposition served at /metrics on the admin server: prometheus or openmetrics text")
+	flag.BoolVar(&pprofOn, "pprof", false, "Serve pprof profiles under /debug/pprof/ on the admin server, which must listen on a loopback or private IP")
+	flag.StringVar(&ctrlAddr, "control", "", "Address backends send connection-closed notifications to (disabled if empty)")
+	flag.StringVar(&ctrlNet, "control-net", "udp", "Network of the control address: udp or unixgram")
+	flag.DurationVar(&loadAge, "load-report-max-age", 0, "How long a backend's load report on the control channel steers fallback flows (load reports ignored if 0)")
+	flag.BoolVar(&verifyIDs, "verify-server-ids", false, "Check the server IDs backends report on the control channel against the server ID mapping, counting mismatches")
+	flag.Float64Var(&loadTol, "load-tolerance", 0.1, "Share of capacity a backend's reported load may exceed the mean by before fallback flows skip it")
+	flag.Float64Var(&flowRate, "new-flow-rate", 0, "New flows each source IP may open per second (unlimited if 0)")
+	flag.IntVar(&srcFlows, "max-flows-per-source", 0, "Flows each source IP may hold open at once (unlimited if 0)")
+	flag.IntVar(&shards, "session-shards", 16, "Shards the session table is split into, each locked on its own")
+	flag.IntVar(&flowBurst, "new-flow-burst", 0, "New flows a source IP may open at once under -new-flow-rate (default the rate)")
+	flag.StringVar(&backendSrc, "backend-source", "", "Local IP or interface name to send backend traffic from (routing table's choice if empty)")
 	flag.BoolVar(&debugMode, "debug", false, "Enable debug mode")
+	flag.Float64Var(&traceRate, "decode-trace-rate", 0, "Fraction of packets whose decode is traced step by step in debug mode")
+	flag.BoolVar(&showVer, "version", false, "Print version information and exit")
+	flag.Uint64Var(&hashSeed, "hash-seed", 0, "Seed for consistent hashing; give load balancers sharing backends distinct seeds")
+	flag.StringVar(&backendSck, "backend-sockets", "connected", "How flows reach backends: connected (a socket per flow, reports ICMP errors) or unconnected (one shared socket)")
+	flag.StringVar(&srcPorts, "source-ports", "", "Port range, as min-max, to derive each client's backend source port from (disabled if empty)")
+	flag.StringVar(&zeroRTT, "zero-rtt", "forward", "What to do with 0-RTT packets: forward, delay (until the handshake completes) or drop")
+	flag.IntVar(&zeroRTTCap, "zero-rtt-return-limit", 0, "Bytes returned to a client that sent forwarded 0-RTT until its first 1-RTT packet (unlimited if 0)")
+	flag.StringVar(&unknownIDs, "unknown-server-ids", "fallback", "Where new flows with a CID naming no backend's server ID go: fallback, drop or pool (backends taking new flows)")
+	flag.StringVar(&catchAll, "catch-all", "", "Backend taking new flows whose CID decodes to a server ID no backend has, ahead of -unknown-server-ids (disabled if empty)")
+	flag.StringVar(&rotations, "rotation-policies", "", "What to do with CIDs by rotation codepoint, as codepoint=policy,...: decode, fallback or drop (every codepoint decodes if empty)")
+	flag.IntVar(&nonceWin, "nonce-reuse-window", 0, "Recent CID (server ID, nonce) pairs kept to detect servers reusing nonces (disabled if 0)")
+	flag.Float64Var(&nonceRate, "nonce-reuse-sample-rate", 1, "Fraction of decoded new connections checked for nonce reuse")
+	flag.IntVar(&idSamples, "server-id-samples", 0, "Recent packets' server IDs kept for the admin /server-ids distribution (disabled if 0)")
+	flag.Float64Var(&idRate, "server-id-sample-rate", 0.01, "Fraction of forwarded packets sampled for the server ID distribution")
+	flag.StringVar(&malformed, "malformed-packets", "lenient", "How datagrams that are not valid QUIC are reported: lenient (dropped quietly) or strict (also logged as warnings and counted by reason)")
+	flag.StringVar(&duplicates, "duplicate-backends", "error", "What to do with a backend listed twice in a service: error (refuse to start) or dedupe (keep its first entry with a warning)")
+	flag.IntVar(&minCID, "min-cid-length", 0, "Shortest destination connection ID routed; client packets with shorter ones are dropped and counted (any length if 0)")
+	flag.StringVar(&trailing, "trailing-bytes", "forward", "What to do with long-header datagrams carrying bytes after their packets: forward, drop or trim")
+	flag.StringVar(&reorderCo, "reordered-coalesced", "forward", "What to do with client datagrams coalescing packets out of order: forward (routed as their earliest packet), reorder or drop")
+	flag.StringVar(&drainingNF, "draining-new-flows", "fallback", "What new connections whose CID names a backend being removed get: fallback (a live backend), retry (a Retry to a live backend) or version_negotiation (refused)")
+	flag.StringVar(&canary, "canary", "", "Backend address given -canary-percent of new connections during a rollout")
+	flag.Float64Var(&canaryPct, "canary-percent", 0, "Percentage of new connections routed to -canary")
+	flag.DurationVar(&resolveMax, "resolve-timeout", 10*time.Second, "How long startup waits for backend host names to resolve; the rest start unhealthy and are retried")
+	flag.DurationVar(&healthIntv, "health-check-interval", 0, "How often each backend is probed with a QUIC Initial and marked by whether it answers (disabled if 0)")
+	flag.DurationVar(&healthWait, "health-check-timeout", time.Second, "How long a QUIC health probe waits for a reply")
+	flag.BoolVar(&smallInits, "drop-small-initials", false, "Drop client datagrams carrying an Initial smaller than 1200 bytes")
+	flag.DurationVar(&slowPacket, "slow-packet-threshold", 0, "Log packets whose parsing, decoding and backend selection take longer than this (disabled if 0)")
+	flag.DurationVar(&drainTime, "drain-timeout", 30*time.Second, "How long SIGTERM waits for existing flows to finish before shutting down")
+}
+
+// serviceFlags collects repeated -service flags
+type serviceFlags []string
+
+func (s *serviceFlags) String() string { return strings.Join(*s, " ") }
+
+func (s *serviceFlags) Set(v string) error {
+	*s = append(*s, v)
+	return nil
+}
+
+var services serviceFlags
+
+func init() {
+	flag.Var(&services, "service", "A service to front, name@listen=backend,backend; repeat for several, each an independent load balancer (the admin server and control socket belong to the first)")
+}
+
+// service is one load balancer fronting one QUIC service
+type service struct {
+	name     string
+	listen   string
+	backends []string
+}
+
+// parseService parses a -service value of the form name@listen=backend,backend
+func parseService(v string) (service, error) {
+	name, rest, ok := strings.Cut(v, "@")
+	if !ok || name == "" {
+		return service{}, fmt.Errorf("service %q: want name@listen=backend,backend", v)
+	}
+	listen, backends, ok := strings.Cut(rest, "=")
+	if !ok || backends == "" {
+		return service{}, fmt.Errorf("service %q: want name@listen=backend,backend", v)
+	}
+	return service{name: name, listen: listen, backends: strings.Split(backends, ",")}, nil
+}
+
+// parseListeners parses a -listeners value of the form addr=length,addr=length
+func parseListeners(v string) ([]lb.ListenerConfig, error) {
+	if v == "" {
+		return nil, nil
+	}
+	var lns []lb.ListenerConfig
+	for _, kv := range strings.Split(v, ",") {
+		var length uint8
+		addr, n, ok := strings.Cut(kv, "=")
+		if _, err := fmt.Sscanf(n, "%d", &length); !ok || err != nil {
+			return nil, fmt.Errorf("listener %q: want addr=dcid-length", kv)
+		}
+		lns = append(lns, lb.ListenerConfig{Address: addr, DCIDLength: length})
+	}
+	return lns, nil
+}
+
+// parseRotationPolicies parses a -rotation-policies value of the form
+// codepoint=policy,codepoint=policy
+func parseRotationPolicies(v string) (policies [quiclb.NumConfigs]string, err error) {
+	if v == "" {
+		return policies, nil
+	}
+	for _, kv := range strings.Split(v, ",") {
+		var rotation int
+		cp, policy, ok := strings.Cut(kv, "=")
+		if _, err := fmt.Sscanf(cp, "%d", &rotation); !ok || err != nil || rotation < 0 || rotation >= quiclb.NumConfigs {
+			return policies, fmt.Errorf("rotation policy %q: want codepoint=policy with a codepoint from 0 to %d", kv, quiclb.NumConfigs-1)
+		}
+		policies[rotation] = policy
+	}
+	return policies, nil
 }
 
 func main() {
 	// Parse flags
 	flag.Parse()
 
+	if showVer {
+		fmt.Println(version.Get())
+		return
+	}
+
 	// Initialize logger
 	log.SetFlags(log.Ldate | log.Ltime | log.Lshortfile)
 
 	// Load configuration
 	// TODO: Implement configuration loading
-	backends := []string{"backend1", "backend2", "backend3"} // TODO: Implement configuration loading
+	svcs := []service{{listen: listenAddr, backends: []string{"backend1", "backend2", "backend3"}}} // TODO: Implement configuration loading
+	if len(services) > 0 {
+		svcs = svcs[:0]
+		for _, v := range services {
+			svc, err := parseService(v)
+			if err != nil {
+				log.Fatalf("Invalid -service: %v", err)
+			}
+			svcs = append(svcs, svc)
+		}
+	}
 
-	// Initialize load balancer
-	lb, err := lb.InitLoadBalancer(listenAddr, backends)
+	var portMin, portMax int
+	if srcPorts != "" {
+		if _, err := fmt.Sscanf(srcPorts, "%d-%d", &portMin, &portMax); err != nil {
+			log.Fatalf("Invalid -source-ports %q: want min-max", srcPorts)
+		}
+	}
+
+	rotationPolicies, err := parseRotationPolicies(rotations)
+	if err != nil {
+		log.Fatalf("Invalid -rotation-policies: %v", err)
+	}
+	extraLns, err := parseListeners(listeners)
 	if err != nil {
-		log.Fatalf("Failed to initialize load balancer: %v", err)
+		log.Fatalf("Invalid -listeners: %v", err)
+	}
+
+	// Initialize one load balancer per service, sharing a metrics registry
+	registry := metrics.NewRegistry()
+	var lbs []*lb.LoadBalancer
+	for i, svc := range svcs {
+		cfg := lb.Config{
+			Name:                svc.name,
+			Metrics:             registry,
+			ListenAddr:          svc.listen,
+			ListenNetwork:       listenNet,
+			ListenRetryTimeout:  listenWait,
+			AcceptProxyProtocol: acceptPrxy,
+			Backends:            lb.StaticBackends(svc.backends...),
+			Debug:               debugMode,
+			DecodeTraceRate:     traceRate,
+			RecoverPanics:       true,
+			HashSeed:            hashSeed,
+			BackendSockets:      backendSck,
+			SourcePortMin:       portMin,
+			SourcePortMax:       portMax,
+			BackendSource:       backendSrc,
+			ZeroRTT:             zeroRTT,
+			ZeroRTTReturnLimit:  zeroRTTCap,
+			UnknownServerIDs:    unknownIDs,
+			CatchAll:            lb.BackendConfig{Address: catchAll},
+			DrainingNewFlows:    drainingNF,
+			Canary:              canary,
+			CanaryPercent:       canaryPct,
+			NewFlowRate:         flowRate,
+			NewFlowBurst:        flowBurst,
+			MaxFlowsPerSource:   srcFlows,
+			SessionShards:       shards,
+			ResolveTimeout:      resolveMax,
+			HealthCheckInterval: healthIntv,
+			HealthCheckTimeout:  healthWait,
+			SlowPacketThreshold: slowPacket,
+			DropSmallInitials:   smallInits,
+			RotationPolicies:    rotationPolicies,
+			NonceReuseWindow:    nonceWin,
+			NonceSampleRate:     nonceRate,
+			ServerIDSamples:     idSamples,
+			ServerIDSampleRate:  idRate,
+			TrailingBytes:       trailing,
+			ReorderedCoalesced:  reorderCo,
+			MalformedPackets:    malformed,
+			MinCIDLength:        minCID,
+			DuplicateBackends:   duplicates,
+			MetricsFormat:       metricsFmt,
+		}
+		if i == 0 {
+			cfg.AdminAddr, cfg.Pprof = adminAddr, pprofOn
+			cfg.Listeners = extraLns
+			cfg.ControlAddr, cfg.ControlNetwork = ctrlAddr, ctrlNet
+			cfg.VerifyServerIDs = verifyIDs
+			if loadAge > 0 {
+				cfg.LoadReportMaxAge, cfg.LoadTolerance = loadAge, loadTol
+			}
+		}
+		l, err := lb.NewLoadBalancer(cfg)
+		if err != nil {
+			log.Fatalf("Failed to initialize load balancer %q: %v", svc.name, err)
+		}
+		lbs = append(lbs, l)
 	}
 
 	// Setup signal handling for graceful shutdown
 	sigChan := make(chan os.Signal, 1)
 	signal.Notify(sigChan, syscall.SIGINT, syscall.SIGTERM)
 
-	// Start the load balancer
-	go func() {
-		if err := lb.Start(); err != nil {
+	// Start the load balancers
+	for i, l := range lbs {
+		if err := l.Start(); err != nil {
 			log.Fatalf("Load balancer error: %v", err)
 		}
-	}()
-
-	log.Printf("QUIC Load Balancer started on %s", listenAddr)
+		log.Printf("QUIC Load Balancer %s started on %s", version.Get(), svcs[i].listen)
+	}
 
 	// Wait for shutdown signal
-	<-sigChan
+	if sig := <-sigChan; sig == syscall.SIGTERM {
+		// orchestrators send SIGTERM ahead of SIGKILL: stop taking new flows
+		// and give existing ones until the deadline, or until another signal
+		log.Printf("Draining for up to %v...", drainTime)
+		ctx, cancel := context.WithTimeout(context.Background(), drainTime)
+		go func() {
+			<-sigChan
+			cancel()
+		}()
+		var wg sync.WaitGroup
+		for _, l := range lbs {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				if err := l.DrainAndShutdown(ctx); err != nil {
+					log.Printf("Drain ended with flows still active: %v", err)
+				}
+			}()
+		}
+		wg.Wait()
+		cancel()
+		return
+	}
 	log.Println("Shutting down...")
 
 	// Perform cleanup
-	if err := lb.Shutdown(); err != nil {
-		log.Printf("Error during shutdown: %v", err)
+	for _, l := range lbs {
+		if err := l.Shutdown(); err != nil {
+			log.Printf("Error during shutdown: %v", err)
+		}
 	}
 }
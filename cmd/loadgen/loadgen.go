@@ -0,0 +1,223 @@
+// Command loadgen sends synthetic short-header QUIC packets at a running load
+// balancer, with CIDs encoding a spread of server IDs, and reports the rate
+// it achieved and, given the admin address, the share the LB dropped.
+package main
+
+import (
+	"bufio"
+	"flag"
+	"fmt"
+	"log"
+	"math/rand"
+	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/fqzz2000/QUIC-LB-SHRIMP/pkg/quiclb"
+)
+
+// Configuration flags
+var (
+	target    string
+	adminURL  string
+	rate      int
+	duration  time.Duration
+	senders   int
+	size      int
+	serverIDs int
+	sidLength int
+	nonceLen  int
+	rotation  uint
+	dist      string
+	zipfS     float64
+)
+
+func init() {
+	flag.StringVar(&target, "target", "127.0.0.1:8080", "Address of the load balancer to send to")
+	flag.StringVar(&adminURL, "admin", "", "Admin server URL of the load balancer, e.g. http://127.0.0.1:9090, to report its drop rate")
+	flag.IntVar(&rate, "rate", 10000, "Packets per second to send across all senders")
+	flag.DurationVar(&duration, "duration", 10*time.Second, "How long to send for")
+	flag.IntVar(&senders, "senders", 4, "Concurrent senders, each a client socket of its own")
+	flag.IntVar(&size, "size", 1200, "Datagram size in bytes")
+	flag.IntVar(&serverIDs, "server-ids", 8, "Number of server IDs to spread CIDs over, from 0")
+	flag.IntVar(&sidLength, "sid-length", 1, "Server ID length of the plaintext QUIC-LB config")
+	flag.IntVar(&nonceLen, "nonce-length", 6, "Nonce length of the plaintext QUIC-LB config")
+	flag.UintVar(&rotation, "rotation", 0, "Config rotation codepoint of the generated CIDs")
+	flag.StringVar(&dist, "dist", "uniform", "Server ID distribution: uniform or zipf")
+	flag.Float64Var(&zipfS, "zipf-s", 1.1, "Skew of the zipf distribution, greater than 1")
+}
+
+// tick is how often senders release a batch of packets
+const tick = 10 * time.Millisecond
+
+func main() {
+	flag.Parse()
+	if rate <= 0 || senders <= 0 || serverIDs <= 0 || size <= 0 {
+		log.Fatalf("-rate, -senders, -server-ids and -size must be positive")
+	}
+	if sidLength < 8 && serverIDs > 1<<(8*sidLength) {
+		log.Fatalf("%d server IDs do not fit in %d bytes", serverIDs, sidLength)
+	}
+
+	var entries [quiclb.NumConfigs]quiclb.ConfigEntry
+	if rotation >= quiclb.NumConfigs {
+		log.Fatalf("-rotation must be below %d", quiclb.NumConfigs)
+	}
+	entries[rotation] = quiclb.ConfigEntry{Algorithm: quiclb.Plaintext, ServerIDLength: sidLength, NonceLength: nonceLen}
+	codec, err := quiclb.NewCodec(entries)
+	if err != nil {
+		log.Fatalf("Invalid QUIC-LB config: %v", err)
+	}
+	if size < entries[rotation].CIDLength()+1 {
+		log.Fatalf("-size %d cannot hold a %d byte CID", size, entries[rotation].CIDLength())
+	}
+
+	before, err := scrape(adminURL)
+	if err != nil {
+		log.Fatalf("Failed to read LB metrics: %v", err)
+	}
+
+	stop := make(chan struct{})
+	sigChan := make(chan os.Signal, 1)
+	signal.Notify(sigChan, os.Interrupt)
+	go func() {
+		select {
+		case <-sigChan:
+		case <-time.After(duration):
+		}
+		close(stop)
+	}()
+
+	var sent, failed atomic.Uint64
+	var wg sync.WaitGroup
+	start := time.Now()
+	for i := 0; i < senders; i++ {
+		conn, err := net.Dial("udp", target)
+		if err != nil {
+			log.Fatalf("Failed to dial %s: %v", target, err)
+		}
+		pick := picker(rand.New(rand.NewSource(int64(i) + time.Now().UnixNano())))
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			defer conn.Close()
+			send(conn, codec, uint8(rotation), pick, float64(rate)/float64(senders), stop, &sent, &failed)
+		}()
+	}
+	wg.Wait()
+	elapsed := time.Since(start)
+
+	fmt.Printf("sent %d packets in %v: %.0f pps (target %d), %d send errors\n",
+		sent.Load(), elapsed.Round(time.Millisecond), float64(sent.Load())/elapsed.Seconds(), rate, failed.Load())
+	if adminURL == "" {
+		return
+	}
+	// let the LB's queues drain before reading its counters
+	time.Sleep(200 * time.Millisecond)
+	after, err := scrape(adminURL)
+	if err != nil {
+		log.Fatalf("Failed to read LB metrics: %v", err)
+	}
+	received := after.received - before.received
+	dropped := after.dropped - before.dropped
+	lost := int64(sent.Load()) - int64(received)
+	fmt.Printf("LB received %d, dropped %d (%.2f%%); %d never reached it\n",
+		received, dropped, 100*float64(dropped)/float64(max(received, 1)), max(lost, 0))
+}
+
+// picker returns a function choosing the server ID of the next packet
+func picker(r *rand.Rand) func() uint64 {
+	if dist == "zipf" {
+		if zipfS <= 1 {
+			log.Fatalf("-zipf-s must be greater than 1")
+		}
+		z := rand.NewZipf(r, zipfS, 1, uint64(serverIDs-1))
+		return z.Uint64
+	}
+	if dist != "uniform" {
+		log.Fatalf("Unknown -dist %q", dist)
+	}
+	return func() uint64 { return uint64(r.Intn(serverIDs)) }
+}
+
+// send emits short-header packets at pps until stop is closed, releasing
+// them in batches every tick
+func send(conn net.Conn, codec *quiclb.Codec, rotation uint8, pick func() uint64, pps float64, stop <-chan struct{}, sent, failed *atomic.Uint64) {
+	pkt := make([]byte, size)
+	serverID := make([]byte, sidLength)
+	ticker := time.NewTicker(tick)
+	defer ticker.Stop()
+	budget := 0.0
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+		}
+		for budget += pps * tick.Seconds(); budget >= 1; budget-- {
+			id := pick()
+			for i := range serverID {
+				serverID[len(serverID)-1-i] = byte(id >> (8 * i))
+			}
+			cid, err := codec.Encode(rotation, serverID, nil)
+			if err != nil {
+				log.Fatalf("Failed to encode CID: %v", err)
+			}
+			pkt[0] = 0x40 // short header, fixed bit set
+			copy(pkt[1:], cid)
+			if _, err := conn.Write(pkt); err != nil {
+				failed.Add(1)
+				continue
+			}
+			sent.Add(1)
+		}
+	}
+}
+
+// lbCounters are the LB counters the drop rate is computed from
+type lbCounters struct {
+	received, dropped uint64
+}
+
+// scrape reads the LB's received and dropped counters from its /metrics,
+// summed over any labels; it returns zeros when url is empty
+func scrape(url string) (lbCounters, error) {
+	var c lbCounters
+	if url == "" {
+		return c, nil
+	}
+	resp, err := http.Get(strings.TrimSuffix(url, "/") + "/metrics")
+	if err != nil {
+		return c, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return c, fmt.Errorf("GET /metrics: %s", resp.Status)
+	}
+	scanner := bufio.NewScanner(resp.Body)
+	for scanner.Scan() {
+		line := scanner.Text()
+		name, rest, _ := strings.Cut(line, " ")
+		if i := strings.IndexByte(line, '{'); i >= 0 && i < len(name) {
+			name = line[:i]
+			_, rest, _ = strings.Cut(line[strings.IndexByte(line, '}'):], " ")
+		}
+		v, err := strconv.ParseFloat(strings.TrimSpace(rest), 64)
+		if err != nil {
+			continue
+		}
+		switch name {
+		case "shrimp_packets_received_total":
+			c.received += uint64(v)
+		case "shrimp_packets_dropped_total":
+			c.dropped += uint64(v)
+		}
+	}
+	return c, scanner.Err()
+}
@@ -0,0 +1,81 @@
+// Command plan prints the server ID each backend should advertise for its
+// CIDs to route back to it through a load balancer with the given QUIC-LB
+// config and backend list, with an example CID encoding each, so backend
+// configs can be derived from the LB's.
+package main
+
+import (
+	"encoding/hex"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/fqzz2000/QUIC-LB-SHRIMP/pkg/lb"
+	"github.com/fqzz2000/QUIC-LB-SHRIMP/pkg/quiclb"
+)
+
+// Configuration flags
+var (
+	backends  string
+	algorithm string
+	sidLength int
+	nonceLen  int
+	tagLength int
+	keyHex    string
+	rotation  uint
+)
+
+func init() {
+	flag.StringVar(&backends, "backends", "", "Backend addresses in load balancer order, comma separated")
+	flag.StringVar(&algorithm, "algorithm", "plaintext", "QUIC-LB algorithm: plaintext, stream-cipher, block-cipher or aead")
+	flag.IntVar(&sidLength, "sid-length", 1, "Server ID length in bytes")
+	flag.IntVar(&nonceLen, "nonce-length", 6, "Nonce length in bytes")
+	flag.IntVar(&tagLength, "tag-length", 0, "Authentication tag length in bytes of the aead algorithm")
+	flag.StringVar(&keyHex, "key", "", "AES-128 key in hex, for the encrypted algorithms")
+	flag.UintVar(&rotation, "rotation", 0, "Config rotation codepoint")
+}
+
+// parseAlgorithm returns the algorithm of an -algorithm name
+func parseAlgorithm(name string) (quiclb.Algorithm, error) {
+	for _, a := range []quiclb.Algorithm{quiclb.Plaintext, quiclb.StreamCipher, quiclb.BlockCipher, quiclb.AEAD} {
+		if a.String() == name {
+			return a, nil
+		}
+	}
+	return 0, fmt.Errorf("unknown algorithm %q", name)
+}
+
+func main() {
+	flag.Parse()
+	if backends == "" {
+		log.Fatalf("-backends is required")
+	}
+	if rotation >= quiclb.NumConfigs {
+		log.Fatalf("-rotation must be below %d", quiclb.NumConfigs)
+	}
+	alg, err := parseAlgorithm(algorithm)
+	if err != nil {
+		log.Fatalf("Invalid -algorithm: %v", err)
+	}
+	key, err := hex.DecodeString(keyHex)
+	if err != nil {
+		log.Fatalf("Invalid -key: %v", err)
+	}
+
+	cfg := lb.Config{Backends: lb.StaticBackends(strings.Split(backends, ",")...)}
+	cfg.QUICLB[rotation] = quiclb.ConfigEntry{Algorithm: alg, ServerIDLength: sidLength, NonceLength: nonceLen, TagLength: tagLength, Key: key}
+	plans, err := lb.PlanServerIDs(cfg)
+	if err != nil {
+		log.Fatalf("No plan: %v", err)
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "ROTATION\tBACKEND\tSERVER ID\tEXAMPLE CID")
+	for _, p := range plans {
+		fmt.Fprintf(w, "%d\t%s\t%x\t%x\n", p.Rotation, p.Backend, p.ServerID, p.CID)
+	}
+	w.Flush()
+}
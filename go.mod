@@ -1,3 +1,5 @@
 module github.com/fqzz2000/QUIC-LB-SHRIMP
 
 go 1.23.2
+
+require go.uber.org/goleak v1.3.0
@@ -0,0 +1,224 @@
+package lb
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"net"
+	"net/http"
+
+	"github.com/fqzz2000/QUIC-LB-SHRIMP/pkg/version"
+)
+
+// decodeRequest is the body accepted by POST /decode: a connection ID, or a
+// whole packet to route as from Source
+type decodeRequest struct {
+	CID    string `json:"cid"`
+	Packet string `json:"packet,omitempty"`
+	Source string `json:"source,omitempty"`
+}
+
+// decodeResponse reports the routing fields of a decoded connection ID and,
+// for a packet, its header and what chose its backend
+type decodeResponse struct {
+	Header         string `json:"header,omitempty"`
+	PacketType     string `json:"packet_type,omitempty"`
+	Version        uint32 `json:"version,omitempty"`
+	CID            string `json:"cid,omitempty"`
+	ConfigRotation uint8  `json:"config_rotation"`
+	ServerID       string `json:"server_id"`
+	Nonce          string `json:"nonce"`
+	Backend        string `json:"backend,omitempty"`
+	Route          Route  `json:"route,omitempty"`
+	Error          string `json:"error,omitempty"`
+}
+
+// newDecodeResponse reports a decode result
+func newDecodeResponse(res *DecodeResult) decodeResponse {
+	return decodeResponse{
+		ConfigRotation: res.Rotation,
+		ServerID:       hex.EncodeToString(res.ServerID),
+		Nonce:          hex.EncodeToString(res.Nonce),
+		Backend:        res.Backend,
+	}
+}
+
+// startAdmin binds the admin listener and serves the admin API in the background.
+// Callers must hold lb.mu.
+func (lb *LoadBalancer) startAdmin() error {
+	ln, err := net.Listen("tcp", lb.adminAddr)
+	if err != nil {
+		return err
+	}
+	srv := &http.Server{Handler: lb.adminHandler()}
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		srv.Serve(ln)
+	}()
+	lb.admin, lb.adminLn, lb.adminDone = srv, ln, done
+	return nil
+}
+
+// stopAdmin closes the admin server and waits for its goroutine. Callers must hold lb.mu.
+func (lb *LoadBalancer) stopAdmin() error {
+	if lb.admin == nil {
+		return nil
+	}
+	err := lb.admin.Close()
+	<-lb.adminDone
+	lb.admin, lb.adminLn, lb.adminDone = nil, nil, nil
+	return err
+}
+
+// AdminAddr returns the bound address of the admin server, or nil if it is not running
+func (lb *LoadBalancer) AdminAddr() net.Addr {
+	lb.mu.RLock()
+	defer lb.mu.RUnlock()
+	if lb.adminLn == nil {
+		return nil
+	}
+	return lb.adminLn.Addr()
+}
+
+// adminHandler returns the routes of the admin API
+func (lb *LoadBalancer) adminHandler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("POST /decode", lb.handleDecode)
+	mux.HandleFunc("GET /ring", lb.handleRing)
+	mux.HandleFunc("GET /metrics", lb.handleMetrics)
+	mux.HandleFunc("GET /overrides", lb.handleListOverrides)
+	mux.HandleFunc("POST /overrides", lb.handleAddOverride)
+	mux.HandleFunc("GET /healthz", lb.handleHealthz)
+	mux.HandleFunc("GET /readyz", lb.handleReadyz)
+	mux.HandleFunc("GET /version", handleVersion)
+	mux.HandleFunc("GET /backends", lb.handleListBackends)
+	mux.HandleFunc("POST /backends", lb.handleAddBackend)
+	mux.HandleFunc("DELETE /backends/{id}", lb.handleRemoveBackend)
+	mux.HandleFunc("GET /backends/{id}/drain", lb.handleBackendDrain)
+	mux.HandleFunc("GET /flows", lb.handleListFlows)
+	mux.HandleFunc("GET /events", lb.handleListEvents)
+	mux.HandleFunc("GET /server-ids", lb.handleServerIDLoad)
+	mux.HandleFunc("GET /rotations", lb.handleListRotations)
+	mux.HandleFunc("POST /rotations/{rotation}/retire", lb.handleRetireRotation)
+	mux.HandleFunc("DELETE /rotations/{rotation}/retire", lb.handleUnretireRotation)
+	if lb.pprof {
+		registerPprof(mux)
+	}
+	return mux
+}
+
+// handleDecode decodes a hex connection ID with the same path used for live routing
+func (lb *LoadBalancer) handleDecode(w http.ResponseWriter, r *http.Request) {
+	var req decodeRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeJSONError(w, http.StatusBadRequest, "invalid JSON body: "+err.Error())
+		return
+	}
+	if req.Packet != "" {
+		lb.decodePacketRequest(w, req)
+		return
+	}
+	cid, err := hex.DecodeString(req.CID)
+	if err != nil || len(cid) == 0 {
+		writeJSONError(w, http.StatusBadRequest, "cid must be a non-empty hex string")
+		return
+	}
+
+	decoded, backend, err := lb.decodeCID(cid)
+	if decoded == nil {
+		writeJSONError(w, http.StatusUnprocessableEntity, err.Error())
+		return
+	}
+	res := DecodeResult{CID: cid, Backend: backend.Address}
+	res.setDecoded(decoded)
+
+	// a CID that decodes but routes to no backend, its server ID unknown or
+	// its backend removed, reports its fields beside the error
+	resp := newDecodeResponse(&res)
+	if err != nil {
+		resp.Error = err.Error()
+	}
+	writeJSON(w, http.StatusOK, resp)
+}
+
+// decodePacketRequest routes a hex packet with DecodePacket, reporting its
+// header and the decision without forwarding it
+func (lb *LoadBalancer) decodePacketRequest(w http.ResponseWriter, req decodeRequest) {
+	pkt, err := hex.DecodeString(req.Packet)
+	if err != nil {
+		writeJSONError(w, http.StatusBadRequest, "packet must be a hex string")
+		return
+	}
+	src := net.Addr(&net.UDPAddr{IP: net.IPv4zero})
+	if req.Source != "" {
+		addr, err := net.ResolveUDPAddr("udp", req.Source)
+		if err != nil {
+			writeJSONError(w, http.StatusBadRequest, "source must be an IP and port")
+			return
+		}
+		src = addr
+	}
+	res, err := lb.DecodePacket(pkt, src)
+	if res == nil {
+		writeJSONError(w, http.StatusUnprocessableEntity, err.Error())
+		return
+	}
+	resp := newDecodeResponse(res)
+	resp.Header, resp.PacketType, resp.Version = "long", res.PacketType.String(), res.Version
+	if res.HeaderForm == 0 {
+		resp.Header = "short"
+	}
+	resp.CID, resp.Route = hex.EncodeToString(res.CID), res.Route
+	if err != nil {
+		resp.Error = err.Error()
+	}
+	writeJSON(w, http.StatusOK, resp)
+}
+
+// ringNodeView is one virtual node in the /ring dump
+type ringNodeView struct {
+	Position uint64 `json:"position"`
+	Backend  string `json:"backend"`
+}
+
+// ringView is the /ring response: seed, weights and the ordered virtual nodes
+type ringView struct {
+	Seed    uint64         `json:"seed"`
+	Weights map[string]int `json:"weights"`
+	Nodes   []ringNodeView `json:"nodes"`
+}
+
+// handleRing dumps the consistent-hash ring used for fallback routing
+func (lb *LoadBalancer) handleRing(w http.ResponseWriter, r *http.Request) {
+	// the ring is immutable once published, so no lock is needed to walk it
+	ring := lb.routes().ring
+	view := ringView{
+		Seed:    ring.seed,
+		Weights: make(map[string]int, len(ring.backends)),
+		Nodes:   make([]ringNodeView, len(ring.nodes)),
+	}
+	for _, b := range ring.backends {
+		view.Weights[b.Address] = b.weight()
+	}
+	for i, n := range ring.nodes {
+		view.Nodes[i] = ringNodeView{Position: n.pos, Backend: ring.backends[n.backend].Address}
+	}
+	writeJSON(w, http.StatusOK, view)
+}
+
+// handleVersion reports the running build
+func handleVersion(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, version.Get())
+}
+
+// writeJSON writes v as a JSON response with the given status code
+func writeJSON(w http.ResponseWriter, status int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
+
+// writeJSONError writes an {"error": msg} response
+func writeJSONError(w http.ResponseWriter, status int, msg string) {
+	writeJSON(w, status, map[string]string{"error": msg})
+}
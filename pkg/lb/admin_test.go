@@ -0,0 +1,165 @@
+package lb
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestHandleDecode(t *testing.T) {
+	lb, err := InitLoadBalancer("127.0.0.1:0", []string{"backend0", "backend1", "backend2"})
+	if err != nil {
+		t.Fatalf("InitLoadBalancer() error = %v", err)
+	}
+	cid, err := lb.routes().codec.Encode(0, []byte{0x02}, []byte{0x10, 0x11, 0x12, 0x13, 0x14, 0x15})
+	if err != nil {
+		t.Fatalf("Encode() error = %v", err)
+	}
+
+	// live routing must agree with the admin endpoint
+	routed, err := lb.SelectBackend(append([]byte{0x40}, cid...), &net.UDPAddr{IP: net.IPv4(192, 0, 2, 1), Port: 4433})
+	if err != nil {
+		t.Fatalf("SelectBackend() error = %v", err)
+	}
+
+	body := `{"cid":"` + hex.EncodeToString(cid) + `"}`
+	rec := httptest.NewRecorder()
+	lb.adminHandler().ServeHTTP(rec, httptest.NewRequest(http.MethodPost, "/decode", strings.NewReader(body)))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("status = %d, want %d: %s", rec.Code, http.StatusOK, rec.Body)
+	}
+
+	var resp decodeResponse
+	if err := json.NewDecoder(rec.Body).Decode(&resp); err != nil {
+		t.Fatalf("decoding response: %v", err)
+	}
+	if resp.ConfigRotation != 0 {
+		t.Errorf("ConfigRotation = %d, want 0", resp.ConfigRotation)
+	}
+	if resp.ServerID != "02" {
+		t.Errorf("ServerID = %q, want %q", resp.ServerID, "02")
+	}
+	if resp.Nonce != "101112131415" {
+		t.Errorf("Nonce = %q, want %q", resp.Nonce, "101112131415")
+	}
+	if resp.Backend != "backend2" || resp.Backend != routed {
+		t.Errorf("Backend = %q, want %q (routed to %q)", resp.Backend, "backend2", routed)
+	}
+}
+
+func TestHandleDecodeErrors(t *testing.T) {
+	lb, err := NewLoadBalancer(Config{
+		Backends:             StaticBackends("10.0.0.1:443", "10.0.0.2:443"),
+		DropRemovedServerIDs: true,
+	})
+	if err != nil {
+		t.Fatalf("NewLoadBalancer() error = %v", err)
+	}
+	if err := lb.RemoveBackend("10.0.0.2:443"); err != nil {
+		t.Fatalf("RemoveBackend() error = %v", err)
+	}
+	// with no flows to drain the removal completes at the next sweep
+	lb.reap(lb.clock.Now())
+
+	tests := []struct {
+		name     string
+		serverID byte
+		wantErr  error
+	}{
+		{name: "Removed Server", serverID: 0x01, wantErr: errServerRemoved},
+		{name: "Unknown Server", serverID: 0x05, wantErr: ErrUnknownServerID},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cid, err := lb.routes().codec.Encode(0, []byte{tt.serverID}, nil)
+			if err != nil {
+				t.Fatalf("Encode() error = %v", err)
+			}
+			body := `{"cid":"` + hex.EncodeToString(cid) + `"}`
+			rec := httptest.NewRecorder()
+			lb.adminHandler().ServeHTTP(rec, httptest.NewRequest(http.MethodPost, "/decode", strings.NewReader(body)))
+			if rec.Code != http.StatusOK {
+				t.Fatalf("status = %d, want %d: %s", rec.Code, http.StatusOK, rec.Body)
+			}
+			var resp decodeResponse
+			if err := json.NewDecoder(rec.Body).Decode(&resp); err != nil {
+				t.Fatalf("decoding response: %v", err)
+			}
+			// the CID decodes, but routing it fails, which the response says
+			if resp.ServerID != hex.EncodeToString([]byte{tt.serverID}) || resp.Backend != "" {
+				t.Errorf("ServerID = %q, Backend = %q, want %02x and no backend", resp.ServerID, resp.Backend, tt.serverID)
+			}
+			if _, _, err := lb.decodeCID(cid); resp.Error == "" || resp.Error != err.Error() || !errors.Is(err, tt.wantErr) {
+				t.Errorf("Error = %q, want %v", resp.Error, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestHandleDecodeBadInput(t *testing.T) {
+	lb, err := InitLoadBalancer("127.0.0.1:0", []string{"backend0"})
+	if err != nil {
+		t.Fatalf("InitLoadBalancer() error = %v", err)
+	}
+
+	tests := []struct {
+		name   string
+		body   string
+		status int
+	}{
+		{name: "Bad Hex", body: `{"cid":"zz"}`, status: http.StatusBadRequest},
+		{name: "Empty CID", body: `{"cid":""}`, status: http.StatusBadRequest},
+		{name: "Bad JSON", body: `{"cid":`, status: http.StatusBadRequest},
+		{name: "Undecodable", body: `{"cid":"4001"}`, status: http.StatusUnprocessableEntity},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rec := httptest.NewRecorder()
+			lb.adminHandler().ServeHTTP(rec, httptest.NewRequest(http.MethodPost, "/decode", strings.NewReader(tt.body)))
+			if rec.Code != tt.status {
+				t.Errorf("status = %d, want %d", rec.Code, tt.status)
+			}
+		})
+	}
+}
+
+func TestHandleRing(t *testing.T) {
+	lb, err := NewLoadBalancer(Config{Backends: []BackendConfig{
+		{Address: "10.0.0.1:443", Weight: 1},
+		{Address: "10.0.0.2:443", Weight: 3},
+	}})
+	if err != nil {
+		t.Fatalf("NewLoadBalancer() error = %v", err)
+	}
+
+	rec := httptest.NewRecorder()
+	lb.adminHandler().ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/ring", nil))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("status = %d, want %d", rec.Code, http.StatusOK)
+	}
+
+	var view ringView
+	if err := json.NewDecoder(rec.Body).Decode(&view); err != nil {
+		t.Fatalf("decoding response: %v", err)
+	}
+	if view.Weights["10.0.0.1:443"] != 1 || view.Weights["10.0.0.2:443"] != 3 {
+		t.Errorf("Weights = %v, want 1 and 3", view.Weights)
+	}
+
+	owned := map[string]int{}
+	for i, n := range view.Nodes {
+		if i > 0 && n.Position < view.Nodes[i-1].Position {
+			t.Fatalf("nodes not ordered at %d", i)
+		}
+		owned[n.Backend]++
+	}
+	if owned["10.0.0.1:443"] != vnodesPerWeight || owned["10.0.0.2:443"] != 3*vnodesPerWeight {
+		t.Errorf("virtual nodes per backend = %v, want %d and %d", owned, vnodesPerWeight, 3*vnodesPerWeight)
+	}
+}
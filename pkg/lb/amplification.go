@@ -0,0 +1,42 @@
+package lb
+
+import "github.com/fqzz2000/QUIC-LB-SHRIMP/pkg/packet"
+
+// defaultAmplificationFactor is the RFC 9000 section 8 limit: before a client's
+// address is validated a server may send it at most three times what it received
+const defaultAmplificationFactor = 3
+
+// validatesAddress reports whether a client packet of type t proves the client
+// can receive at its address. A Handshake packet can only be built from keys
+// in the server's Initial, and 1-RTT follows the handshake.
+func validatesAddress(t packet.PacketType) bool {
+	return t == packet.HandShake || t == packet.OneRTT
+}
+
+// received counts a client datagram toward the flow's traffic and
+// amplification budget
+func (f *Flow) received(n int, validates bool) {
+	f.traffic.clientPackets.Add(1)
+	f.traffic.clientBytes.Add(uint64(n))
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.rxBytes += uint64(n)
+	if validates {
+		f.validated = true
+	}
+}
+
+// allowSend reports whether n more bytes may be sent to an unvalidated client
+// under factor, reserving them if so. A factor of zero or less disables the limit.
+func (f *Flow) allowSend(n int, factor int) bool {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.validated || factor <= 0 {
+		return true
+	}
+	if f.txBytes+uint64(n) > uint64(factor)*f.rxBytes {
+		return false
+	}
+	f.txBytes += uint64(n)
+	return true
+}
@@ -0,0 +1,87 @@
+package lb
+
+import (
+	"bytes"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/fqzz2000/QUIC-LB-SHRIMP/pkg/packet"
+)
+
+// longHeaderPacket builds a QUIC v1 long-header packet of the given type padded to size
+func longHeaderPacket(ptype packet.PacketType, dcid []byte, size int) []byte {
+	pkt := []byte{0xc0 | byte(ptype)<<4, 0x00, 0x00, 0x00, 0x01, byte(len(dcid))}
+	pkt = append(pkt, dcid...)
+	pkt = append(pkt, 0x00) // empty SCID
+	if len(pkt) < size {
+		pkt = append(pkt, make([]byte, size-len(pkt))...)
+	}
+	return pkt
+}
+
+// startAmplifyingBackend answers every datagram with copies of itself
+func startAmplifyingBackend(t *testing.T, copies int) string {
+	t.Helper()
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("ListenPacket() error = %v", err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	go func() {
+		buf := make([]byte, maxPacketSize)
+		for {
+			n, addr, err := conn.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			for i := 0; i < copies; i++ {
+				conn.WriteTo(buf[:n], addr)
+			}
+		}
+	}()
+	return conn.LocalAddr().String()
+}
+
+// countResponses reads datagrams until none arrives within the timeout
+func countResponses(t *testing.T, conn net.PacketConn, timeout time.Duration) int {
+	t.Helper()
+	n := 0
+	for readWithin(t, conn, timeout) != nil {
+		n++
+	}
+	return n
+}
+
+func TestAmplificationLimitForUnvalidatedFlow(t *testing.T) {
+	backend := startAmplifyingBackend(t, 5)
+	lb := startTestLB(t, Config{Backends: StaticBackends(backend)})
+	client := newTestClient(t)
+	dcid := bytes.Repeat([]byte{0xee}, 8)
+
+	// 5x the Initial's size comes back; only 3x may reach the unvalidated client
+	client.WriteTo(longHeaderPacket(packet.Initial, dcid, 1200), lb.Addr())
+	if got := countResponses(t, client, 200*time.Millisecond); got != 3 {
+		t.Errorf("responses before validation = %d, want 3", got)
+	}
+	if got := lb.Stats().AmplificationDrops; got != 2 {
+		t.Errorf("AmplificationDrops = %d, want 2", got)
+	}
+
+	// a Handshake packet validates the address and lifts the limit
+	client.WriteTo(longHeaderPacket(packet.HandShake, dcid, 1200), lb.Addr())
+	if got := countResponses(t, client, 200*time.Millisecond); got != 5 {
+		t.Errorf("responses after validation = %d, want 5", got)
+	}
+}
+
+func TestAmplificationLimitDisabled(t *testing.T) {
+	backend := startAmplifyingBackend(t, 5)
+	lb := startTestLB(t, Config{Backends: StaticBackends(backend), AmplificationFactor: -1})
+	client := newTestClient(t)
+
+	client.WriteTo(longHeaderPacket(packet.Initial, bytes.Repeat([]byte{0xee}, 8), 1200), lb.Addr())
+	if got := countResponses(t, client, 200*time.Millisecond); got != 5 {
+		t.Errorf("responses = %d, want 5", got)
+	}
+}
@@ -0,0 +1,386 @@
+package lb
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"slices"
+	"time"
+
+	"github.com/fqzz2000/QUIC-LB-SHRIMP/pkg/quiclb"
+)
+
+// defaultBackendDrainTimeout bounds how long a removed backend keeps its
+// flows before they are closed
+const defaultBackendDrainTimeout = 5 * time.Minute
+
+var (
+	// errBadBackend is returned for a backend that cannot be added
+	errBadBackend = errors.New("invalid backend")
+	// errUnknownBackend is returned when removing a backend that is not configured
+	errUnknownBackend = errors.New("unknown backend")
+	// errLastBackend is returned when removing the only backend left
+	errLastBackend = errors.New("cannot remove the last backend")
+	// errServerRemoved is returned when a server ID names a removed backend
+	errServerRemoved = fmt.Errorf("%w: backend removed", ErrUnknownServerID)
+)
+
+// Backends are added and removed at runtime without disturbing the server
+// IDs of the others. Removal happens in two steps: the backend first drains,
+// leaving the ring so it takes no new fallback flows while its existing
+// flows and CID-decoded packets of established connections still reach it
+// (new connections are turned away, see drainredirect.go); once its flows
+// are gone, or the drain timeout passes, the reaper closes what is left and
+// replaces it with a tombstone. The tombstone keeps its slot, so in index
+// mode later server IDs do not shift, and lets decodes to it be recognised:
+// such packets are rerouted as a decode failure, or dropped with
+// Config.DropRemovedServerIDs.
+
+// removed reports whether the config is the tombstone of a removed backend
+func (b BackendConfig) removed() bool {
+	return b.Address == ""
+}
+
+// AddBackend adds a backend at runtime and returns the server ID its CIDs
+// carry: the next index in index mode, the first of its ServerIDs with
+// explicit IDs, or none when server IDs are truncated
+func (lb *LoadBalancer) AddBackend(b BackendConfig) ([]byte, error) {
+	lb.mu.Lock()
+	defer lb.mu.Unlock()
+
+	if b.Address == "" {
+		return nil, fmt.Errorf("%w: address is required", errBadBackend)
+	}
+	if err := b.checkVersions(); err != nil {
+		return nil, err
+	}
+	rt := lb.routes()
+	for _, existing := range rt.backends {
+		if existing.Address == b.Address {
+			return nil, fmt.Errorf("%w: %s is already configured", errBadBackend, b.Address)
+		}
+	}
+	backends := append(append([]BackendConfig(nil), rt.backends...), b)
+	delete(lb.drained, b.Address)
+
+	serverIDs := rt.serverIDs
+	var serverID []byte
+	if rt.truncated != nil {
+		if len(b.ServerIDs) > 0 {
+			return nil, fmt.Errorf("%w: server IDs are truncated, ServerIDs cannot be set", errBadBackend)
+		}
+	} else if serverIDs == nil {
+		if len(b.ServerIDs) > 0 {
+			return nil, fmt.Errorf("%w: backends are mapped by index, ServerIDs cannot be set", errBadBackend)
+		}
+		if rt.pools.pooled() {
+			return nil, fmt.Errorf("%w: backends are pooled by rotation, none can be added", errBadBackend)
+		}
+		cfg, _ := rt.codec.Config(rt.issueRotation)
+		id, ok := indexServerID(len(rt.backends), cfg.ServerIDLength)
+		if !ok {
+			return nil, fmt.Errorf("%w: server ID space of %d bytes is exhausted", errBadBackend, cfg.ServerIDLength)
+		}
+		serverID = id
+	} else {
+		m, err := buildServerIDMap(backends, rt.defaultBackend, serverIDLengths(rt.codecEntries()), false)
+		if err != nil {
+			return nil, err
+		}
+		serverIDs = m
+		if len(b.ServerIDs) > 0 {
+			serverID = b.ServerIDs[0]
+		}
+	}
+	lb.updateRoutes(func(rt *routingTable) {
+		rt.backends, rt.serverIDs = backends, serverIDs
+		rt.ring = lb.liveRing(backends)
+	})
+	return serverID, nil
+}
+
+// RemoveBackend starts draining the backend at addr; the reaper removes it
+// once its flows have finished or the drain timeout has passed
+func (lb *LoadBalancer) RemoveBackend(addr string) error {
+	lb.mu.Lock()
+	defer lb.mu.Unlock()
+
+	live, found := 0, false
+	for _, b := range lb.routes().backends {
+		if b.removed() {
+			continue
+		}
+		if _, draining := lb.removing[b.Address]; !draining {
+			live++
+		}
+		found = found || b.Address == addr
+	}
+	if !found || addr == "" {
+		return fmt.Errorf("%w: %s", errUnknownBackend, addr)
+	}
+	if _, draining := lb.removing[addr]; draining {
+		return nil
+	}
+	if live == 1 {
+		return errLastBackend
+	}
+	lb.removing[addr] = lb.clock.Now().Add(lb.backendDrain)
+	lb.updateRoutes(func(rt *routingTable) {
+		rt.ring = lb.liveRing(rt.backends)
+	})
+	return nil
+}
+
+// backendRemoving reports whether the backend at addr is draining for removal
+func (lb *LoadBalancer) backendRemoving(addr string) bool {
+	lb.mu.RLock()
+	defer lb.mu.RUnlock()
+	_, ok := lb.removing[addr]
+	return ok
+}
+
+// finishRemovals tombstones draining backends whose flows are gone or whose
+// drain timeout has passed, closing any flows they still have
+func (lb *LoadBalancer) finishRemovals(now time.Time) {
+	lb.mu.RLock()
+	var done []string
+	for addr, deadline := range lb.removing {
+		if lb.sessions.backendFlowCount(addr) == 0 || !now.Before(deadline) {
+			done = append(done, addr)
+		}
+	}
+	lb.mu.RUnlock()
+	if len(done) == 0 {
+		return
+	}
+
+	for _, flow := range lb.sessions.flows() {
+		for _, addr := range done {
+			if flow.Backend == addr {
+				lb.closeFlow(flow)
+			}
+		}
+	}
+
+	lb.mu.Lock()
+	defer lb.mu.Unlock()
+	rt := lb.routes()
+	backends := append([]BackendConfig(nil), rt.backends...)
+	for _, addr := range done {
+		delete(lb.removing, addr)
+		delete(lb.unhealthy, addr)
+		lb.drained[addr] = true
+		if lb.loads != nil {
+			lb.loads.forget(addr)
+		}
+		if lb.idChecks != nil {
+			lb.idChecks.forget(addr)
+		}
+		for i, b := range backends {
+			if b.Address == addr {
+				backends[i] = BackendConfig{ServerIDs: b.ServerIDs}
+			}
+		}
+	}
+	serverIDs := rt.serverIDs
+	if serverIDs != nil {
+		// only dropping claims, so the mapping stays valid
+		serverIDs, _ = buildServerIDMap(backends, rt.defaultBackend, serverIDLengths(rt.codecEntries()), false)
+	}
+	lb.updateRoutes(func(rt *routingTable) {
+		rt.backends, rt.serverIDs = backends, serverIDs
+	})
+}
+
+// liveRing returns a ring over the backends that take new fallback flows.
+// Callers must hold lb.mu.
+func (lb *LoadBalancer) liveRing(backends []BackendConfig) *hashRing {
+	live := make([]BackendConfig, 0, len(backends))
+	for _, b := range backends {
+		if _, draining := lb.removing[b.Address]; !b.removed() && !draining {
+			live = append(live, b)
+		}
+	}
+	return newHashRing(live, lb.hashSeed)
+}
+
+// codecEntries returns the codec's configs by rotation codepoint
+func (rt *routingTable) codecEntries() [quiclb.NumConfigs]quiclb.ConfigEntry {
+	var entries [quiclb.NumConfigs]quiclb.ConfigEntry
+	for i := range entries {
+		entries[i], _ = rt.codec.Config(uint8(i))
+	}
+	return entries
+}
+
+// indexServerID encodes a backend index as a big-endian server ID of n bytes
+func indexServerID(idx, n int) ([]byte, bool) {
+	serverID := make([]byte, n)
+	v := uint64(idx)
+	for j := n - 1; j >= 0; j-- {
+		serverID[j] = byte(v)
+		v >>= 8
+	}
+	return serverID, v == 0
+}
+
+// backendView is one backend in the /backends API
+type backendView struct {
+	Address       string   `json:"address"`
+	Weight        int      `json:"weight,omitempty"`
+	ServerIDs     []string `json:"server_ids,omitempty"`
+	ProxyProtocol bool     `json:"proxy_protocol,omitempty"`
+	MaxFlows      int      `json:"max_flows,omitempty"`
+	NewFlows      bool     `json:"new_flows,omitempty"`
+	MaxPacketRate float64  `json:"max_packet_rate,omitempty"`
+	MaxByteRate   float64  `json:"max_byte_rate,omitempty"`
+	Versions      []uint32 `json:"versions,omitempty"`
+	ServerID      string   `json:"server_id,omitempty"`
+	State         string   `json:"state,omitempty"`
+	Flows         int      `json:"flows"`
+}
+
+// handleListBackends lists the configured backends and their state
+func (lb *LoadBalancer) handleListBackends(w http.ResponseWriter, r *http.Request) {
+	_, perBackend := lb.sessions.flowCounts()
+	rt := lb.routes()
+	backends := rt.backends
+	cfg, _ := rt.codec.Config(rt.issueRotation)
+
+	views := []backendView{}
+	for _, b := range backends {
+		if b.removed() {
+			continue
+		}
+		v := backendView{Address: b.Address, Weight: b.weight(), ProxyProtocol: b.ProxyProtocol, MaxFlows: b.MaxFlows, NewFlows: b.NewFlows,
+			MaxPacketRate: b.MaxPacketRate, MaxByteRate: b.MaxByteRate, Versions: b.Versions, Flows: perBackend[b.Address]}
+		for _, id := range b.ServerIDs {
+			v.ServerIDs = append(v.ServerIDs, hex.EncodeToString(id))
+		}
+		if id, ok := rt.serverIDFor(b.Address, cfg.ServerIDLength); ok && len(b.ServerIDs) == 0 {
+			v.ServerID = hex.EncodeToString(id)
+		}
+		switch {
+		case lb.backendRemoving(b.Address):
+			v.State = "draining"
+		case lb.unhealthyBackend(b.Address):
+			v.State = "unhealthy"
+		default:
+			v.State = "healthy"
+		}
+		views = append(views, v)
+	}
+	writeJSON(w, http.StatusOK, views)
+}
+
+// handleAddBackend adds a backend from a POST /backends body
+func (lb *LoadBalancer) handleAddBackend(w http.ResponseWriter, r *http.Request) {
+	var req backendView
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeJSONError(w, http.StatusBadRequest, "invalid JSON body: "+err.Error())
+		return
+	}
+	b := BackendConfig{Address: req.Address, Weight: req.Weight, ProxyProtocol: req.ProxyProtocol, MaxFlows: req.MaxFlows, NewFlows: req.NewFlows,
+		MaxPacketRate: req.MaxPacketRate, MaxByteRate: req.MaxByteRate, Versions: req.Versions}
+	for _, s := range req.ServerIDs {
+		id, err := hex.DecodeString(s)
+		if err != nil || len(id) == 0 {
+			writeJSONError(w, http.StatusBadRequest, "server_ids must be non-empty hex strings")
+			return
+		}
+		b.ServerIDs = append(b.ServerIDs, id)
+	}
+	serverID, err := lb.AddBackend(b)
+	if err != nil {
+		writeJSONError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	req.ServerID = hex.EncodeToString(serverID)
+	req.State = "healthy"
+	writeJSON(w, http.StatusCreated, req)
+}
+
+// handleRemoveBackend starts draining the backend named by the path
+func (lb *LoadBalancer) handleRemoveBackend(w http.ResponseWriter, r *http.Request) {
+	err := lb.RemoveBackend(r.PathValue("id"))
+	switch {
+	case errors.Is(err, errUnknownBackend):
+		writeJSONError(w, http.StatusNotFound, err.Error())
+	case err != nil:
+		writeJSONError(w, http.StatusConflict, err.Error())
+	default:
+		writeJSON(w, http.StatusAccepted, map[string]string{"status": "draining"})
+	}
+}
+
+// drainView is a backend's drain progress in the /backends/{id}/drain API
+type drainView struct {
+	Address      string `json:"address"`
+	State        string `json:"state"`
+	Flows        int    `json:"flows"`
+	SafeToRemove bool   `json:"safe_to_remove"`
+}
+
+// drainStatus reports the drain progress of the backend at addr: safe to
+// remove once it is draining or removed and has no flows left. It reports
+// false for an address that is neither configured nor removed.
+func (lb *LoadBalancer) drainStatus(addr string) (drainView, bool) {
+	v := drainView{Address: addr, Flows: lb.sessions.backendFlowCount(addr)}
+	lb.mu.RLock()
+	_, removing := lb.removing[addr]
+	drained := lb.drained[addr]
+	lb.mu.RUnlock()
+	switch {
+	case removing:
+		v.State = "draining"
+	case drained:
+		v.State = "removed"
+	case addr != "" && slices.ContainsFunc(lb.routes().backends, func(b BackendConfig) bool { return b.Address == addr }):
+		v.State = "active"
+	default:
+		return v, false
+	}
+	v.SafeToRemove = v.State != "active" && v.Flows == 0
+	return v, true
+}
+
+// handleBackendDrain reports the drain progress of the backend named by the
+// path. With ?wait=<duration> it holds the request until the backend is safe
+// to remove or the wait is over, and reports the state then.
+func (lb *LoadBalancer) handleBackendDrain(w http.ResponseWriter, r *http.Request) {
+	addr := r.PathValue("id")
+	var wait time.Duration
+	if s := r.URL.Query().Get("wait"); s != "" {
+		d, err := time.ParseDuration(s)
+		if err != nil || d < 0 {
+			writeJSONError(w, http.StatusBadRequest, "wait must be a non-negative duration")
+			return
+		}
+		wait = d
+	}
+	v, ok := lb.drainStatus(addr)
+	if !ok {
+		writeJSONError(w, http.StatusNotFound, fmt.Errorf("%w: %s", errUnknownBackend, addr).Error())
+		return
+	}
+	if wait > 0 && !v.SafeToRemove {
+		timer := time.NewTimer(wait)
+		defer timer.Stop()
+		ticker := time.NewTicker(drainPollInterval)
+		defer ticker.Stop()
+	poll:
+		for !v.SafeToRemove {
+			select {
+			case <-r.Context().Done():
+				return
+			case <-timer.C:
+				break poll
+			case <-ticker.C:
+				v, _ = lb.drainStatus(addr)
+			}
+		}
+	}
+	writeJSON(w, http.StatusOK, v)
+}
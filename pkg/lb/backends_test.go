@@ -0,0 +1,348 @@
+package lb
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/fqzz2000/QUIC-LB-SHRIMP/pkg/packet"
+)
+
+// ringAddrs returns the distinct backends on the current ring
+func ringAddrs(lb *LoadBalancer) map[string]bool {
+	addrs := map[string]bool{}
+	for _, b := range lb.routes().ring.backends {
+		addrs[b.Address] = true
+	}
+	return addrs
+}
+
+func TestAddBackend(t *testing.T) {
+	lb, err := NewLoadBalancer(Config{Backends: StaticBackends("10.0.0.1:443", "10.0.0.2:443")})
+	if err != nil {
+		t.Fatalf("NewLoadBalancer() error = %v", err)
+	}
+
+	serverID, err := lb.AddBackend(BackendConfig{Address: "10.0.0.3:443"})
+	if err != nil {
+		t.Fatalf("AddBackend() error = %v", err)
+	}
+	if len(serverID) != 1 || serverID[0] != 2 {
+		t.Errorf("AddBackend() server ID = %x, want 02", serverID)
+	}
+	if !ringAddrs(lb)["10.0.0.3:443"] {
+		t.Errorf("ring %v does not hold the added backend", ringAddrs(lb))
+	}
+	cid, err := lb.routes().codec.Encode(lb.routes().issueRotation, serverID, nil)
+	if err != nil {
+		t.Fatalf("Encode() error = %v", err)
+	}
+	if backend, err := lb.selectBackend(cid, testAddr(1)); err != nil || backend.Address != "10.0.0.3:443" {
+		t.Errorf("selectBackend() = %q, %v, want 10.0.0.3:443", backend.Address, err)
+	}
+
+	if _, err := lb.AddBackend(BackendConfig{Address: "10.0.0.3:443"}); !errors.Is(err, errBadBackend) {
+		t.Errorf("AddBackend(duplicate) error = %v, want %v", err, errBadBackend)
+	}
+	if _, err := lb.AddBackend(BackendConfig{Address: "10.0.0.4:443", ServerIDs: [][]byte{{9}}}); !errors.Is(err, errBadBackend) {
+		t.Errorf("AddBackend(ServerIDs in index mode) error = %v, want %v", err, errBadBackend)
+	}
+}
+
+func TestRemoveBackend(t *testing.T) {
+	tests := []struct {
+		name        string
+		dropRemoved bool
+	}{
+		{name: "reroute"},
+		{name: "drop", dropRemoved: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			clock := newFakeClock()
+			lb, err := NewLoadBalancer(Config{
+				Backends:             StaticBackends("10.0.0.1:443", "10.0.0.2:443", "10.0.0.3:443"),
+				BackendDrainTimeout:  time.Minute,
+				DropRemovedServerIDs: tt.dropRemoved,
+				Clock:                clock,
+			})
+			if err != nil {
+				t.Fatalf("NewLoadBalancer() error = %v", err)
+			}
+			flow := &Flow{Backend: "10.0.0.2:443", Created: clock.Now(), lastSeen: clock.Now(), conn: nopConn{}}
+			lb.sessions.remember(flow, []byte{0x01}, testAddr(1))
+			cid, err := lb.routes().codec.Encode(lb.routes().issueRotation, []byte{1}, nil)
+			if err != nil {
+				t.Fatalf("Encode() error = %v", err)
+			}
+
+			if err := lb.RemoveBackend("10.0.0.2:443"); err != nil {
+				t.Fatalf("RemoveBackend() error = %v", err)
+			}
+			// draining: off the ring at once, decoded CIDs and the flow still reach it
+			if ringAddrs(lb)["10.0.0.2:443"] {
+				t.Errorf("ring %v still holds the draining backend", ringAddrs(lb))
+			}
+			for i := 0; i < 64; i++ {
+				if backend, _ := lb.selectBackend([]byte{0xc0, 0x00}, testAddr(i)); backend.Address == "10.0.0.2:443" {
+					t.Fatalf("new fallback flow routed to the draining backend")
+				}
+			}
+			if backend, err := lb.selectBackend(cid, testAddr(1)); err != nil || backend.Address != "10.0.0.2:443" {
+				t.Errorf("selectBackend(decoded) while draining = %q, %v, want 10.0.0.2:443", backend.Address, err)
+			}
+			lb.reap(clock.Now())
+			if n := len(lb.sessions.flows()); n != 1 {
+				t.Fatalf("flows after reap while draining = %d, want 1", n)
+			}
+
+			// the drain timeout closes the flow and removes the backend
+			clock.Advance(time.Minute)
+			lb.reap(clock.Now())
+			if n := len(lb.sessions.flows()); n != 0 {
+				t.Errorf("flows after drain timeout = %d, want 0", n)
+			}
+			if lb.backendRemoving("10.0.0.2:443") {
+				t.Errorf("backend still draining after its timeout")
+			}
+
+			backend, err := lb.selectBackend(cid, testAddr(1))
+			if tt.dropRemoved {
+				if !errors.Is(err, errServerRemoved) {
+					t.Errorf("selectBackend(removed) error = %v, want %v", err, errServerRemoved)
+				}
+			} else if err != nil || backend.Address == "10.0.0.2:443" || backend.Address == "" {
+				t.Errorf("selectBackend(removed) = %q, %v, want a rerouted live backend", backend.Address, err)
+			}
+			if got := lb.Stats().RemovedServerIDs; got != 1 {
+				t.Errorf("RemovedServerIDs = %d, want 1", got)
+			}
+			// later server IDs keep their backend
+			cid3, _ := lb.routes().codec.Encode(lb.routes().issueRotation, []byte{2}, nil)
+			if backend, err := lb.selectBackend(cid3, testAddr(1)); err != nil || backend.Address != "10.0.0.3:443" {
+				t.Errorf("selectBackend(02) = %q, %v, want 10.0.0.3:443", backend.Address, err)
+			}
+		})
+	}
+}
+
+func TestRemoveBackendErrors(t *testing.T) {
+	lb, err := NewLoadBalancer(Config{Backends: StaticBackends("10.0.0.1:443", "10.0.0.2:443")})
+	if err != nil {
+		t.Fatalf("NewLoadBalancer() error = %v", err)
+	}
+	if err := lb.RemoveBackend("10.0.0.9:443"); !errors.Is(err, errUnknownBackend) {
+		t.Errorf("RemoveBackend(unknown) error = %v, want %v", err, errUnknownBackend)
+	}
+	if err := lb.RemoveBackend("10.0.0.1:443"); err != nil {
+		t.Fatalf("RemoveBackend() error = %v", err)
+	}
+	if err := lb.RemoveBackend("10.0.0.2:443"); !errors.Is(err, errLastBackend) {
+		t.Errorf("RemoveBackend(last) error = %v, want %v", err, errLastBackend)
+	}
+}
+
+func TestRemoveMappedBackend(t *testing.T) {
+	lb, err := NewLoadBalancer(Config{
+		Backends: []BackendConfig{
+			{Address: "10.0.0.1:443", ServerIDs: [][]byte{{0x01}}},
+			{Address: "10.0.0.2:443", ServerIDs: [][]byte{{0x02}}},
+		},
+		DefaultBackend: "10.0.0.1:443",
+	})
+	if err != nil {
+		t.Fatalf("NewLoadBalancer() error = %v", err)
+	}
+	if err := lb.RemoveBackend("10.0.0.2:443"); err != nil {
+		t.Fatalf("RemoveBackend() error = %v", err)
+	}
+	// nothing left to drain, so the first reap completes the removal
+	lb.reap(lb.clock.Now())
+
+	cid, _ := lb.routes().codec.Encode(lb.routes().issueRotation, []byte{0x02}, nil)
+	if _, err := lb.routeCID(cid); !errors.Is(err, errServerRemoved) {
+		t.Errorf("routeCID(removed) error = %v, want %v", err, errServerRemoved)
+	}
+	// a new backend may take over the removed backend's server ID
+	if _, err := lb.AddBackend(BackendConfig{Address: "10.0.0.3:443", ServerIDs: [][]byte{{0x02}}}); err != nil {
+		t.Fatalf("AddBackend() error = %v", err)
+	}
+	if backend, err := lb.routeCID(cid); err != nil || backend.Address != "10.0.0.3:443" {
+		t.Errorf("routeCID(re-homed) = %q, %v, want 10.0.0.3:443", backend.Address, err)
+	}
+	if _, err := lb.AddBackend(BackendConfig{Address: "10.0.0.4:443", ServerIDs: [][]byte{{0x01}}}); !errors.Is(err, errBadServerIDs) {
+		t.Errorf("AddBackend(claimed ID) error = %v, want %v", err, errBadServerIDs)
+	}
+}
+
+func TestHandleBackends(t *testing.T) {
+	lb, err := NewLoadBalancer(Config{Backends: StaticBackends("10.0.0.1:443")})
+	if err != nil {
+		t.Fatalf("NewLoadBalancer() error = %v", err)
+	}
+	tests := []struct {
+		method   string
+		path     string
+		body     string
+		wantCode int
+	}{
+		{method: http.MethodPost, path: "/backends", body: `{"address":"10.0.0.2:443","weight":2}`, wantCode: http.StatusCreated},
+		{method: http.MethodPost, path: "/backends", body: `{"address":"10.0.0.2:443"}`, wantCode: http.StatusBadRequest},
+		{method: http.MethodPost, path: "/backends", body: `{`, wantCode: http.StatusBadRequest},
+		{method: http.MethodDelete, path: "/backends/10.0.0.9:443", wantCode: http.StatusNotFound},
+		{method: http.MethodDelete, path: "/backends/10.0.0.1:443", wantCode: http.StatusAccepted},
+		{method: http.MethodDelete, path: "/backends/10.0.0.2:443", wantCode: http.StatusConflict},
+	}
+	for _, tt := range tests {
+		rec := httptest.NewRecorder()
+		lb.adminHandler().ServeHTTP(rec, httptest.NewRequest(tt.method, tt.path, strings.NewReader(tt.body)))
+		if rec.Code != tt.wantCode {
+			t.Errorf("%s %s status = %d, want %d: %s", tt.method, tt.path, rec.Code, tt.wantCode, rec.Body)
+		}
+	}
+
+	rec := httptest.NewRecorder()
+	lb.adminHandler().ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/backends", nil))
+	var views []backendView
+	if err := json.Unmarshal(rec.Body.Bytes(), &views); err != nil {
+		t.Fatalf("decoding /backends: %v", err)
+	}
+	want := []backendView{
+		{Address: "10.0.0.1:443", Weight: 1, ServerID: "00", State: "draining"},
+		{Address: "10.0.0.2:443", Weight: 2, ServerID: "01", State: "healthy"},
+	}
+	if len(views) != len(want) {
+		t.Fatalf("/backends = %+v, want %+v", views, want)
+	}
+	for i := range want {
+		if views[i].Address != want[i].Address || views[i].Weight != want[i].Weight || views[i].ServerID != want[i].ServerID || views[i].State != want[i].State {
+			t.Errorf("/backends[%d] = %+v, want %+v", i, views[i], want[i])
+		}
+	}
+}
+
+func TestHandleBackendDrain(t *testing.T) {
+	clock := newFakeClock()
+	lb, err := NewLoadBalancer(Config{
+		Backends:            StaticBackends("10.0.0.1:443", "10.0.0.2:443"),
+		BackendDrainTimeout: time.Minute,
+		Clock:               clock,
+	})
+	if err != nil {
+		t.Fatalf("NewLoadBalancer() error = %v", err)
+	}
+	flow := &Flow{Backend: "10.0.0.2:443", Created: clock.Now(), lastSeen: clock.Now(), conn: nopConn{}}
+	lb.sessions.remember(flow, []byte{0x01}, testAddr(1))
+
+	get := func(path string) (int, drainView) {
+		t.Helper()
+		rec := httptest.NewRecorder()
+		lb.adminHandler().ServeHTTP(rec, httptest.NewRequest(http.MethodGet, path, nil))
+		var v drainView
+		if rec.Code == http.StatusOK {
+			if err := json.Unmarshal(rec.Body.Bytes(), &v); err != nil {
+				t.Errorf("decoding %s: %v", path, err)
+			}
+		}
+		return rec.Code, v
+	}
+
+	tests := []struct {
+		path     string
+		wantCode int
+		want     drainView
+	}{
+		{path: "/backends/10.0.0.2:443/drain", wantCode: http.StatusOK, want: drainView{Address: "10.0.0.2:443", State: "active", Flows: 1}},
+		{path: "/backends/10.0.0.9:443/drain", wantCode: http.StatusNotFound},
+		{path: "/backends/10.0.0.2:443/drain?wait=soon", wantCode: http.StatusBadRequest},
+	}
+	for _, tt := range tests {
+		if code, v := get(tt.path); code != tt.wantCode || v != tt.want {
+			t.Errorf("GET %s = %d %+v, want %d %+v", tt.path, code, v, tt.wantCode, tt.want)
+		}
+	}
+
+	if err := lb.RemoveBackend("10.0.0.2:443"); err != nil {
+		t.Fatalf("RemoveBackend() error = %v", err)
+	}
+	// a wait that runs out reports the flow still there
+	want := drainView{Address: "10.0.0.2:443", State: "draining", Flows: 1}
+	if code, v := get("/backends/10.0.0.2:443/drain?wait=10ms"); code != http.StatusOK || v != want {
+		t.Errorf("drain while the flow is open = %d %+v, want %+v", code, v, want)
+	}
+
+	// a waiting request returns once the flow is evicted and the backend removed
+	done := make(chan drainView)
+	go func() {
+		_, v := get("/backends/10.0.0.2:443/drain?wait=10s")
+		done <- v
+	}()
+	lb.closeFlow(flow)
+	lb.reap(clock.Now())
+	want = drainView{Address: "10.0.0.2:443", State: "removed", SafeToRemove: true}
+	select {
+	case v := <-done:
+		if v != want {
+			t.Errorf("drain after eviction = %+v, want %+v", v, want)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("waiting drain request did not return after the flow was evicted")
+	}
+	if code, v := get("/backends/10.0.0.2:443/drain"); code != http.StatusOK || v != want {
+		t.Errorf("drain of the removed backend = %d %+v, want %+v", code, v, want)
+	}
+}
+
+func TestFlowKeepsBackendAcrossRingChange(t *testing.T) {
+	fwd := memForwarder{opened: make(chan *memConn, 64)}
+	lb, _ := newMemLB(t, Config{Backends: []BackendConfig{{Address: "10.0.0.1:443", Forwarder: fwd}, {Address: "10.0.0.2:443", Forwarder: fwd}}})
+
+	type open struct {
+		dcid    []byte
+		backend string
+		conn    *memConn
+	}
+	var flows []open
+	for i := range 32 {
+		// client-chosen DCIDs decode to no server ID, so the ring places them
+		dcid := []byte{0xc0, byte(i), 2, 3, 4, 5, 6, 7}
+		if err := lb.handlePacket(longHeaderPacket(packet.Initial, dcid, 1200), testAddr(i)); err != nil {
+			t.Fatalf("handlePacket(Initial) error = %v", err)
+		}
+		conn := expect(t, fwd.opened)
+		expect(t, conn.sent)
+		flows = append(flows, open{dcid: dcid, backend: lb.sessions.lookupCID(dcid).Backend, conn: conn})
+	}
+
+	for i := 3; i <= 8; i++ {
+		if _, err := lb.AddBackend(BackendConfig{Address: fmt.Sprintf("10.0.0.%d:443", i), Forwarder: fwd}); err != nil {
+			t.Fatalf("AddBackend() error = %v", err)
+		}
+	}
+	remapped := 0
+	for i, f := range flows {
+		if backend, _ := lb.selectBackend(f.dcid, testAddr(i)); backend.Address != f.backend {
+			remapped++
+		}
+		if err := lb.handlePacket(longHeaderPacket(packet.HandShake, f.dcid, 64), testAddr(i)); err != nil {
+			t.Fatalf("handlePacket(Handshake) error = %v", err)
+		}
+		expect(t, f.conn.sent)
+		if got := lb.sessions.lookupCID(f.dcid).Backend; got != f.backend {
+			t.Errorf("flow %d backend = %s after the ring changed, want %s", i, got, f.backend)
+		}
+	}
+	if remapped == 0 {
+		t.Fatalf("no flow's key moved on the new ring; the test proves nothing")
+	}
+	select {
+	case <-fwd.opened:
+		t.Errorf("a packet of an existing flow opened a new one")
+	default:
+	}
+}
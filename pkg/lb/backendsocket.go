@@ -0,0 +1,255 @@
+package lb
+
+import (
+	"errors"
+	"net"
+	"slices"
+	"sync"
+	"time"
+)
+
+// Backend sockets ("connected", the default, or "unconnected" as
+// Config.BackendSockets) decide how flows without a Forwarder reach their
+// backend. Connected mode gives each flow its own connected UDP socket: the
+// kernel demultiplexes replies and reports ICMP errors on it, which mark the
+// backend unhealthy. Unconnected mode sends every flow's datagrams with
+// WriteTo on one shared socket, so the LB holds a single descriptor however
+// many flows are open, at the cost of ICMP reports.
+//
+// Replies on the shared socket are matched to their flow by the backend they
+// come from and their DCID, which is the connection ID the client chose for
+// itself in the SCID of its long headers. Replies matching no such CID, as
+// for clients using zero-length CIDs, go to the newest flow to that backend
+// that did not give one.
+
+const (
+	backendSocketsConnected   = "connected"
+	backendSocketsUnconnected = "unconnected"
+)
+
+var (
+	// errBackendSockets is returned for an unknown Config.BackendSockets mode
+	errBackendSockets = errors.New("unknown backend socket mode")
+	// errSharedDeadline is returned when setting a deadline on a shared socket flow
+	errSharedDeadline = errors.New("deadlines are not supported on unconnected backend sockets")
+)
+
+// sharedQueueSize is how many replies a flow on the shared socket buffers
+// before further ones are dropped
+const sharedQueueSize = 64
+
+// sharedKey identifies a flow on the shared socket
+type sharedKey struct {
+	backend string
+	cid     string
+}
+
+// sharedSocket is the unconnected socket flows share in unconnected mode
+type sharedSocket struct {
+	conn net.PacketConn
+
+	mu    sync.Mutex
+	flows map[sharedKey]*sharedConn
+	// lengths counts the client CID lengths in use per backend, so a short
+	// header reply is only tried at lengths that can match
+	lengths map[string]map[int]int
+}
+
+func newSharedSocket(conn net.PacketConn) *sharedSocket {
+	return &sharedSocket{
+		conn:    conn,
+		flows:   make(map[sharedKey]*sharedConn),
+		lengths: make(map[string]map[int]int),
+	}
+}
+
+// open returns a flow's connection to the backend at address over the
+// shared socket, receiving replies addressed to clientCID
+func (s *sharedSocket) open(address string, clientCID []byte) (net.Conn, error) {
+	addr, err := net.ResolveUDPAddr("udp", address)
+	if err != nil {
+		return nil, err
+	}
+	c := &sharedConn{
+		s:      s,
+		remote: addr,
+		key:    sharedKey{backend: addr.String(), cid: string(clientCID)},
+		in:     make(chan []byte, sharedQueueSize),
+		closed: make(chan struct{}),
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.flows[c.key] = c
+	if s.lengths[c.key.backend] == nil {
+		s.lengths[c.key.backend] = make(map[int]int)
+	}
+	s.lengths[c.key.backend][len(clientCID)]++
+	return c, nil
+}
+
+// release forgets a closed connection
+func (s *sharedSocket) release(c *sharedConn) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.flows[c.key] == c {
+		delete(s.flows, c.key)
+	}
+	lengths := s.lengths[c.key.backend]
+	if lengths[len(c.key.cid)]--; lengths[len(c.key.cid)] == 0 {
+		delete(lengths, len(c.key.cid))
+	}
+	if len(lengths) == 0 {
+		delete(s.lengths, c.key.backend)
+	}
+}
+
+// match finds the flow a reply from backend is addressed to
+func (s *sharedSocket) match(backend string, pkt []byte) *sharedConn {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if len(pkt) == 0 {
+		return nil
+	}
+	if pkt[0]&0x80 != 0 {
+		// a long header states its DCID length
+		if len(pkt) >= 6 && len(pkt) >= 6+int(pkt[5]) {
+			if c, ok := s.flows[sharedKey{backend, string(pkt[6 : 6+pkt[5]])}]; ok {
+				return c
+			}
+		}
+		return s.flows[sharedKey{backend: backend}]
+	}
+	lengths := make([]int, 0, len(s.lengths[backend]))
+	for n := range s.lengths[backend] {
+		lengths = append(lengths, n)
+	}
+	// longest first, so the zero-length fallback is tried last
+	slices.Sort(lengths)
+	for _, n := range slices.Backward(lengths) {
+		if len(pkt) >= 1+n {
+			if c, ok := s.flows[sharedKey{backend, string(pkt[1 : 1+n])}]; ok {
+				return c
+			}
+		}
+	}
+	return nil
+}
+
+// readLoop hands every reply on the shared socket to its flow until the
+// socket is closed; onDrop is called for replies no flow can take
+func (s *sharedSocket) readLoop(onDrop func()) {
+	buf := make([]byte, maxPacketSize)
+	for {
+		n, addr, err := s.conn.ReadFrom(buf)
+		if err != nil {
+			if isUnreachable(err) {
+				continue
+			}
+			return
+		}
+		c := s.match(addr.String(), buf[:n])
+		if c == nil {
+			onDrop()
+			continue
+		}
+		select {
+		case c.in <- append([]byte(nil), buf[:n]...):
+		default:
+			onDrop()
+		}
+	}
+}
+
+// sharedConn is one flow's view of the shared socket: writes go to its
+// backend and reads return the replies matched to it
+type sharedConn struct {
+	s      *sharedSocket
+	remote *net.UDPAddr
+	key    sharedKey
+	in     chan []byte
+
+	closeOnce sync.Once
+	closed    chan struct{}
+}
+
+func (c *sharedConn) Write(p []byte) (int, error) {
+	select {
+	case <-c.closed:
+		return 0, net.ErrClosed
+	default:
+	}
+	return c.s.conn.WriteTo(p, c.remote)
+}
+
+func (c *sharedConn) Read(p []byte) (int, error) {
+	select {
+	case pkt := <-c.in:
+		return copy(p, pkt), nil
+	case <-c.closed:
+		return 0, net.ErrClosed
+	}
+}
+
+func (c *sharedConn) Close() error {
+	c.closeOnce.Do(func() {
+		close(c.closed)
+		c.s.release(c)
+	})
+	return nil
+}
+
+func (c *sharedConn) LocalAddr() net.Addr  { return c.s.conn.LocalAddr() }
+func (c *sharedConn) RemoteAddr() net.Addr { return c.remote }
+
+// deadlines are not supported; the return loop blocks until Close
+func (c *sharedConn) SetDeadline(time.Time) error      { return errSharedDeadline }
+func (c *sharedConn) SetReadDeadline(time.Time) error  { return errSharedDeadline }
+func (c *sharedConn) SetWriteDeadline(time.Time) error { return errSharedDeadline }
+
+// dialBackend opens a new flow's connection to its backend: over the shared
+// socket in unconnected mode, from the client's derived source port with
+// source port affinity or from the backend source, otherwise through the
+// backend's forwarder
+func (lb *LoadBalancer) dialBackend(backend BackendConfig, client net.Addr, clientCID []byte) (net.Conn, error) {
+	if backend.Forwarder != nil {
+		return backend.Forwarder.Open(backend.Address)
+	}
+	address := lb.warm.resolved(backend.Address)
+	if lb.shared != nil {
+		return lb.shared.open(address, clientCID)
+	}
+	if lb.sourcePorts.enabled() {
+		return lb.dialFromSourcePort(address, client)
+	}
+	if conn := lb.warm.take(backend.Address); conn != nil {
+		return conn, nil
+	}
+	if lb.backendSource != nil {
+		return lb.dialUDP(address, 0)
+	}
+	return PlainForwarder{}.Open(address)
+}
+
+// openShared opens the shared backend socket in unconnected mode and starts
+// routing its replies. Callers must hold lb.mu.
+func (lb *LoadBalancer) openShared() error {
+	if lb.backendSockets != backendSocketsUnconnected {
+		return nil
+	}
+	local := ":0"
+	if lb.backendSource != nil {
+		local = net.JoinHostPort(lb.backendSource.String(), "0")
+	}
+	conn, err := net.ListenPacket("udp", local)
+	if err != nil {
+		return err
+	}
+	lb.shared = newSharedSocket(conn)
+	lb.flowWG.Add(1)
+	go func(s *sharedSocket) {
+		defer lb.flowWG.Done()
+		s.readLoop(func() { lb.stats.unmatchedReplies.Add(1) })
+	}(lb.shared)
+	return nil
+}
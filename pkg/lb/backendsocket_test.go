@@ -0,0 +1,240 @@
+package lb
+
+import (
+	"bytes"
+	"errors"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/fqzz2000/QUIC-LB-SHRIMP/pkg/packet"
+)
+
+// datagram is one packet and its peer address
+type datagram struct {
+	data []byte
+	addr net.Addr
+}
+
+// memPacketConn is an in-memory PacketConn: writes are reported on sent and
+// datagrams pushed to recv are read
+type memPacketConn struct {
+	net.PacketConn
+	sent      chan datagram
+	recv      chan datagram
+	closeOnce sync.Once
+	closed    chan struct{}
+}
+
+func newMemPacketConn() *memPacketConn {
+	return &memPacketConn{sent: make(chan datagram, 16), recv: make(chan datagram, 16), closed: make(chan struct{})}
+}
+
+func (c *memPacketConn) WriteTo(p []byte, addr net.Addr) (int, error) {
+	c.sent <- datagram{append([]byte(nil), p...), addr}
+	return len(p), nil
+}
+
+func (c *memPacketConn) ReadFrom(p []byte) (int, net.Addr, error) {
+	select {
+	case d := <-c.recv:
+		return copy(p, d.data), d.addr, nil
+	case <-c.closed:
+		return 0, nil, net.ErrClosed
+	}
+}
+
+func (c *memPacketConn) Close() error {
+	c.closeOnce.Do(func() { close(c.closed) })
+	return nil
+}
+
+func (c *memPacketConn) LocalAddr() net.Addr {
+	return &net.UDPAddr{IP: net.IPv4(198, 51, 100, 1), Port: 443}
+}
+
+// memConn is an in-memory connected backend socket
+type memConn struct {
+	net.Conn
+	sent      chan []byte
+	recv      chan []byte
+	closeOnce sync.Once
+	closed    chan struct{}
+}
+
+func (c *memConn) Write(p []byte) (int, error) {
+	c.sent <- append([]byte(nil), p...)
+	return len(p), nil
+}
+
+func (c *memConn) Read(p []byte) (int, error) {
+	select {
+	case d := <-c.recv:
+		return copy(p, d), nil
+	case <-c.closed:
+		return 0, net.ErrClosed
+	}
+}
+
+func (c *memConn) Close() error {
+	c.closeOnce.Do(func() { close(c.closed) })
+	return nil
+}
+
+// memForwarder opens a memConn per flow and reports it on opened
+type memForwarder struct{ opened chan *memConn }
+
+func (f memForwarder) Open(string) (net.Conn, error) {
+	c := &memConn{sent: make(chan []byte, 16), recv: make(chan []byte, 16), closed: make(chan struct{})}
+	f.opened <- c
+	return c, nil
+}
+
+// expect receives one item from ch or fails the test
+func expect[T any](t *testing.T, ch <-chan T) T {
+	t.Helper()
+	select {
+	case v := <-ch:
+		return v
+	case <-time.After(time.Second):
+		t.Fatalf("nothing received")
+		panic("unreachable")
+	}
+}
+
+// newMemLB returns a load balancer whose listener is in memory, closing its
+// flows with the test
+func newMemLB(t *testing.T, cfg Config) (*LoadBalancer, *memPacketConn) {
+	t.Helper()
+	lb, err := NewLoadBalancer(cfg)
+	if err != nil {
+		t.Fatalf("NewLoadBalancer() error = %v", err)
+	}
+	listener := newMemPacketConn()
+	lb.listener = listener
+	t.Cleanup(func() {
+		lb.closeFlows()
+		lb.flowWG.Wait()
+	})
+	return lb, listener
+}
+
+func TestConnectedBackendSockets(t *testing.T) {
+	fwd := memForwarder{opened: make(chan *memConn, 2)}
+	lb, listener := newMemLB(t, Config{Backends: []BackendConfig{{Address: "192.0.2.100:443", Forwarder: fwd}}})
+
+	first := quicLongHeader(packet.Initial, []byte{0xc0, 1, 1, 1, 1, 1, 1, 1}, []byte{0xa1, 0xa1}, []byte("one"))
+	second := quicLongHeader(packet.Initial, []byte{0xc0, 2, 2, 2, 2, 2, 2, 2}, []byte{0xb2, 0xb2}, []byte("two"))
+	if err := lb.handlePacket(first, testAddr(1)); err != nil {
+		t.Fatalf("handlePacket() error = %v", err)
+	}
+	if err := lb.handlePacket(second, testAddr(2)); err != nil {
+		t.Fatalf("handlePacket() error = %v", err)
+	}
+
+	// a socket per flow
+	conn1, conn2 := expect(t, fwd.opened), expect(t, fwd.opened)
+	if got := expect(t, conn1.sent); !bytes.Equal(got, first) {
+		t.Errorf("first flow sent %x, want %x", got, first)
+	}
+	if got := expect(t, conn2.sent); !bytes.Equal(got, second) {
+		t.Errorf("second flow sent %x, want %x", got, second)
+	}
+
+	reply := quicLongHeader(packet.HandShake, []byte{0xb2, 0xb2}, []byte{9}, []byte("reply"))
+	conn2.recv <- reply
+	if got := expect(t, listener.sent); !bytes.Equal(got.data, reply) || got.addr.String() != testAddr(2).String() {
+		t.Errorf("reply %x to %v, want %x to %v", got.data, got.addr, reply, testAddr(2))
+	}
+}
+
+func TestUnconnectedBackendSockets(t *testing.T) {
+	lb, listener := newMemLB(t, Config{
+		Backends:       StaticBackends("192.0.2.100:443"),
+		BackendSockets: "unconnected",
+	})
+	shared := newMemPacketConn()
+	lb.shared = newSharedSocket(shared)
+	lb.flowWG.Add(1)
+	go func() {
+		defer lb.flowWG.Done()
+		lb.shared.readLoop(func() { lb.stats.unmatchedReplies.Add(1) })
+	}()
+	t.Cleanup(func() { shared.Close() })
+
+	first := quicLongHeader(packet.Initial, []byte{0xc0, 1, 1, 1, 1, 1, 1, 1}, []byte{0xa1, 0xa1}, []byte("one"))
+	second := quicLongHeader(packet.Initial, []byte{0xc0, 2, 2, 2, 2, 2, 2, 2}, []byte{0xb2, 0xb2, 0xb2}, []byte("two"))
+	if err := lb.handlePacket(first, testAddr(1)); err != nil {
+		t.Fatalf("handlePacket() error = %v", err)
+	}
+	if err := lb.handlePacket(second, testAddr(2)); err != nil {
+		t.Fatalf("handlePacket() error = %v", err)
+	}
+
+	// both flows write to the backend on the one socket
+	for _, want := range [][]byte{first, second} {
+		got := expect(t, shared.sent)
+		if !bytes.Equal(got.data, want) || got.addr.String() != "192.0.2.100:443" {
+			t.Errorf("shared socket sent %x to %v, want %x to 192.0.2.100:443", got.data, got.addr, want)
+		}
+	}
+
+	backend := &net.UDPAddr{IP: net.IPv4(192, 0, 2, 100), Port: 443}
+	tests := []struct {
+		name   string
+		reply  []byte
+		client net.Addr
+	}{
+		{name: "Long Header", reply: quicLongHeader(packet.HandShake, []byte{0xb2, 0xb2, 0xb2}, []byte{9}, []byte("reply")), client: testAddr(2)},
+		{name: "Short Header", reply: []byte{0x40, 0xa1, 0xa1, 0x01, 0x02}, client: testAddr(1)},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			shared.recv <- datagram{tt.reply, backend}
+			got := expect(t, listener.sent)
+			if !bytes.Equal(got.data, tt.reply) || got.addr.String() != tt.client.String() {
+				t.Errorf("reply %x to %v, want %x to %v", got.data, got.addr, tt.reply, tt.client)
+			}
+		})
+	}
+
+	// a reply to no known client CID is dropped and counted
+	shared.recv <- datagram{[]byte{0x40, 0xee, 0xee, 0xee}, backend}
+	deadline := time.Now().Add(time.Second)
+	for lb.Stats().UnmatchedReplies != 1 && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond)
+	}
+	if got := lb.Stats().UnmatchedReplies; got != 1 {
+		t.Errorf("UnmatchedReplies = %d, want 1", got)
+	}
+
+	// closed flows release their entries
+	lb.closeFlows()
+	if n := len(lb.shared.flows) + len(lb.shared.lengths); n != 0 {
+		t.Errorf("shared socket holds %d entries after the flows closed, want 0", n)
+	}
+}
+
+func TestBackendSocketsMode(t *testing.T) {
+	_, err := NewLoadBalancer(Config{Backends: StaticBackends("10.0.0.1:443"), BackendSockets: "sendmmsg"})
+	if !errors.Is(err, errBackendSockets) {
+		t.Errorf("NewLoadBalancer() error = %v, want %v", err, errBackendSockets)
+	}
+}
+
+func TestUnconnectedBackendSocketsEndToEnd(t *testing.T) {
+	backend := startEchoBackend(t)
+	lb := startTestLB(t, Config{Backends: StaticBackends(backend), BackendSockets: "unconnected"})
+
+	// the echo reply carries the client's own DCID, so the flow's SCID matches
+	scid := []byte{0xc0, 0x11, 0x22, 0x33}
+	pkt := quicLongHeader(packet.Initial, scid, scid, []byte("hello"))
+	client := newTestClient(t)
+	if _, err := client.WriteTo(pkt, lb.Addr()); err != nil {
+		t.Fatalf("WriteTo() error = %v", err)
+	}
+	if got := readWithin(t, client, time.Second); !bytes.Equal(got, pkt) {
+		t.Errorf("response = %x, want %x", got, pkt)
+	}
+}
@@ -0,0 +1,79 @@
+package lb
+
+import (
+	"errors"
+	"fmt"
+	"net"
+)
+
+// A backend source (Config.BackendSource) pins the local address backend
+// sockets send from, so on a multi-homed host forwarded traffic leaves on
+// the interface the operator picked rather than whichever the routing table
+// prefers. It applies to flows without a Forwarder, connected or over the
+// shared socket, and combines with source port affinity.
+
+// errBackendSource is returned for a backend source that is not an address
+// or interface of this host
+var errBackendSource = errors.New("invalid backend source")
+
+// backendSource resolves Config.BackendSource to the IP backend sockets bind.
+// An interface name yields its first IPv4 address, or its first address
+// when it has none. The IP must be bindable, so it belongs to this host.
+func (c *Config) backendSource() (net.IP, error) {
+	if c.BackendSource == "" {
+		return nil, nil
+	}
+	ip := net.ParseIP(c.BackendSource)
+	if ip == nil {
+		var err error
+		if ip, err = interfaceIP(c.BackendSource); err != nil {
+			return nil, fmt.Errorf("%w: %q: %v", errBackendSource, c.BackendSource, err)
+		}
+	}
+	conn, err := net.ListenPacket("udp", net.JoinHostPort(ip.String(), "0"))
+	if err != nil {
+		return nil, fmt.Errorf("%w: %s is not an address of this host: %v", errBackendSource, ip, err)
+	}
+	conn.Close()
+	return ip, nil
+}
+
+// interfaceIP returns the address of the named interface backends are
+// reached from
+func interfaceIP(name string) (net.IP, error) {
+	ifi, err := net.InterfaceByName(name)
+	if err != nil {
+		return nil, err
+	}
+	addrs, err := ifi.Addrs()
+	if err != nil {
+		return nil, err
+	}
+	var first net.IP
+	for _, a := range addrs {
+		ipnet, ok := a.(*net.IPNet)
+		if !ok {
+			continue
+		}
+		if ipnet.IP.To4() != nil {
+			return ipnet.IP, nil
+		}
+		if first == nil {
+			first = ipnet.IP
+		}
+	}
+	if first == nil {
+		return nil, errors.New("interface has no addresses")
+	}
+	return first, nil
+}
+
+// dialUDP dials a backend over UDP from the backend source, on port or an
+// ephemeral one when port is zero
+func (lb *LoadBalancer) dialUDP(address string, port int) (net.Conn, error) {
+	if lb.backendSource == nil && port == 0 {
+		return net.Dial("udp", address)
+	}
+	d := net.Dialer{LocalAddr: &net.UDPAddr{IP: lb.backendSource, Port: port}}
+	return d.Dial("udp", address)
+}
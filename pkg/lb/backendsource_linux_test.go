@@ -0,0 +1,68 @@
+//go:build linux
+
+package lb
+
+import (
+	"errors"
+	"net"
+	"testing"
+)
+
+func TestBackendSource(t *testing.T) {
+	backend, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("ListenPacket() error = %v", err)
+	}
+	defer backend.Close()
+
+	// Linux answers for all of 127.0.0.0/8 on lo, so 127.0.0.2 is local
+	// without being the address the route to 127.0.0.1 would pick
+	tests := []struct {
+		name    string
+		source  string
+		sockets string
+		wantIP  string
+		wantErr error
+	}{
+		{name: "Connected", source: "127.0.0.2", wantIP: "127.0.0.2"},
+		{name: "Unconnected", source: "127.0.0.2", sockets: backendSocketsUnconnected, wantIP: "127.0.0.2"},
+		{name: "Interface", source: "lo", wantIP: "127.0.0.1"},
+		{name: "Not Local", source: "192.0.2.1", wantErr: errBackendSource},
+		{name: "No Such Interface", source: "shrimp-none0", wantErr: errBackendSource},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			lb, err := NewLoadBalancer(Config{
+				Backends:       StaticBackends(backend.LocalAddr().String()),
+				BackendSource:  tt.source,
+				BackendSockets: tt.sockets,
+			})
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("NewLoadBalancer() error = %v, want %v", err, tt.wantErr)
+			}
+			if err != nil {
+				return
+			}
+			lb.mu.Lock()
+			err = lb.openShared()
+			lb.mu.Unlock()
+			if err != nil {
+				t.Fatalf("openShared() error = %v", err)
+			}
+			if lb.shared != nil {
+				defer func() {
+					lb.shared.conn.Close()
+					lb.flowWG.Wait()
+				}()
+			}
+			conn, err := lb.dialBackend(lb.routes().backends[0], testAddr(1), nil)
+			if err != nil {
+				t.Fatalf("dialBackend() error = %v", err)
+			}
+			defer conn.Close()
+			if got := conn.LocalAddr().(*net.UDPAddr).IP.String(); got != tt.wantIP {
+				t.Errorf("backend socket bound %s, want %s", got, tt.wantIP)
+			}
+		})
+	}
+}
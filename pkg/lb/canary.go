@@ -0,0 +1,52 @@
+package lb
+
+import (
+	"errors"
+
+	"github.com/fqzz2000/QUIC-LB-SHRIMP/pkg/packet"
+)
+
+// Canary routing (Config.Canary and CanaryPercent) sends a share of new
+// connections to one backend during a rollout. CID routing is deterministic,
+// so the split happens ahead of decoding, for Initials without a token only:
+// a token means a Retry or an earlier connection already placed the client.
+// The share is taken by hashing the client's DCID, so retransmitted Initials
+// agree. The connection then stays on the canary through its flow and the
+// CIDs naming it, those its server issues or, with RewriteCIDs, the one the
+// LB issues in place of the client's, so established flows follow their CIDs
+// whatever the percentage becomes. The split is the only way a new
+// connection reaches the canary: fallback and strategy routing skip it.
+
+// errCanary is returned for an invalid canary configuration
+var errCanary = errors.New("invalid canary")
+
+// canaryScale is the resolution of the canary share: hundredths of a percent
+const canaryScale = 10000
+
+// canaryBackend picks the canary for a new connection's Initial when its
+// DCID hashes into the canary share and the canary can take it
+func (lb *LoadBalancer) canaryBackend(header packet.QuicHeader, pkt []byte) (BackendConfig, bool) {
+	lh, ok := header.(*packet.LongHeader)
+	if !ok || lb.canaryShare == 0 || lh.LongPacketType != packet.Initial {
+		return BackendConfig{}, false
+	}
+	if token, err := lh.Token(pkt); err != nil || len(token) > 0 {
+		return BackendConfig{}, false
+	}
+	if hashKey(lb.hashSeed, lh.DCID)%canaryScale >= lb.canaryShare {
+		return BackendConfig{}, false
+	}
+	backend, ok := lb.backendByAddress(lb.canary)
+	if !ok || lb.unavailable(backend.Address) {
+		return BackendConfig{}, false
+	}
+	lb.stats.canaryRouted.Add(1)
+	return backend, true
+}
+
+// avoidNew reports whether new connections routed without a decoded CID
+// skip the backend at addr: it is unavailable, or it is the canary and only
+// takes connections through the split
+func (lb *LoadBalancer) avoidNew(addr string) bool {
+	return lb.unavailable(addr) || (lb.canaryShare > 0 && addr == lb.canary)
+}
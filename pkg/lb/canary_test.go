@@ -0,0 +1,128 @@
+package lb
+
+import (
+	"errors"
+	"math/rand/v2"
+	"net"
+	"testing"
+
+	"github.com/fqzz2000/QUIC-LB-SHRIMP/pkg/packet"
+)
+
+func TestCanarySplit(t *testing.T) {
+	const initials = 1000
+	canary := "192.0.2.102:443"
+	fwd := memForwarder{opened: make(chan *memConn, initials+2)}
+	lb, _ := newMemLB(t, Config{
+		Backends: []BackendConfig{
+			{Address: "192.0.2.100:443", Forwarder: fwd},
+			{Address: "192.0.2.101:443", Forwarder: fwd},
+			{Address: canary, Forwarder: fwd},
+		},
+		Canary:        canary,
+		CanaryPercent: 20,
+		RewriteCIDs:   true,
+	})
+
+	r := rand.New(rand.NewPCG(1, 2))
+	toCanary := 0
+	for i := 0; i < initials; i++ {
+		dcid := make([]byte, 8)
+		for j := range dcid {
+			dcid[j] = byte(r.Uint32())
+		}
+		src := testAddr(1)
+		src.(*net.UDPAddr).Port = 10000 + i
+		if err := lb.handlePacket(quicLongHeader(packet.Initial, dcid, []byte{0xcc}, make([]byte, 40)), src); err != nil {
+			t.Fatalf("handlePacket(Initial) error = %v", err)
+		}
+		conn := expect(t, fwd.opened)
+		forwarded := expect(t, conn.sent)
+		flow := lb.sessions.lookup(dcid, src)
+		if flow == nil {
+			t.Fatalf("Initial %d opened no flow", i)
+		}
+		if flow.Backend != canary {
+			continue
+		}
+		toCanary++
+		// the issued CID the canary sees routes its later packets back to it
+		backend, err := lb.routeCID(forwarded[6 : 6+forwarded[5]])
+		if err != nil || backend.Address != canary {
+			t.Fatalf("routeCID(issued CID) = %q, %v, want the canary", backend.Address, err)
+		}
+	}
+	if toCanary < initials*15/100 || toCanary > initials*25/100 {
+		t.Errorf("%d of %d new connections went to the canary, want about 20%%", toCanary, initials)
+	}
+	if got := lb.Stats().CanaryRouted; got != uint64(toCanary) {
+		t.Errorf("CanaryRouted = %d, want %d", got, toCanary)
+	}
+
+	// an established flow follows its CID: short headers naming backend 0
+	// from new addresses never move to the canary
+	established := []byte{0x00, 0x00, 1, 1, 1, 1, 1, 1}
+	before := lb.Stats().CanaryRouted
+	var conn *memConn
+	for i := 0; i < 50; i++ {
+		src := testAddr(2)
+		src.(*net.UDPAddr).Port = 20000 + i
+		short := append(append([]byte{0x40}, established...), make([]byte, 30)...)
+		if err := lb.handlePacket(short, src); err != nil {
+			t.Fatalf("handlePacket(short header) error = %v", err)
+		}
+		if conn == nil {
+			conn = expect(t, fwd.opened)
+		}
+		expect(t, conn.sent)
+		if flow := lb.sessions.lookup(established, src); flow == nil || flow.Backend != "192.0.2.100:443" {
+			t.Fatalf("established flow moved off its backend")
+		}
+	}
+
+	// nor does an Initial with a token, even for a DCID in the canary share
+	canaryDCID := []byte{0xdd, 0, 0, 0, 0, 0, 0, 0}
+	for hashKey(lb.hashSeed, canaryDCID)%canaryScale >= lb.canaryShare {
+		canaryDCID[7]++
+	}
+	withToken := quicLongHeader(packet.Initial, canaryDCID, []byte{0xcc}, make([]byte, 40))
+	tokenAt := 6 + len(canaryDCID) + 2
+	withToken = append(append(append([]byte(nil), withToken[:tokenAt]...), 0x02, 0xee, 0xee), withToken[tokenAt+1:]...)
+	if err := lb.handlePacket(withToken, testAddr(3)); err != nil {
+		t.Fatalf("handlePacket(Initial with token) error = %v", err)
+	}
+	expect(t, expect(t, fwd.opened).sent)
+	if flow := lb.sessions.lookup(canaryDCID, testAddr(3)); flow == nil || flow.Backend == canary {
+		t.Errorf("Initial with a token went to the canary, want the usual route")
+	}
+	if got := lb.Stats().CanaryRouted; got != before {
+		t.Errorf("CanaryRouted grew by %d outside new connections, want 0", got-before)
+	}
+}
+
+func TestCanaryConfig(t *testing.T) {
+	tests := []struct {
+		name    string
+		canary  string
+		percent float64
+		wantErr error
+	}{
+		{name: "Unset"},
+		{name: "Valid", canary: "192.0.2.101:443", percent: 5},
+		{name: "Not A Backend", canary: "192.0.2.200:443", percent: 5, wantErr: errCanary},
+		{name: "Over 100", canary: "192.0.2.101:443", percent: 101, wantErr: errCanary},
+		{name: "Percent Without Canary", percent: 5, wantErr: errCanary},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := NewLoadBalancer(Config{
+				Backends:      StaticBackends("192.0.2.100:443", "192.0.2.101:443"),
+				Canary:        tt.canary,
+				CanaryPercent: tt.percent,
+			})
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("NewLoadBalancer() error = %v, want %v", err, tt.wantErr)
+			}
+		})
+	}
+}
@@ -0,0 +1,19 @@
+package lb
+
+// The catch-all backend (Config.CatchAll) takes new flows whose CID decodes
+// cleanly to a server ID with no backend, as when a backend was removed with
+// connections still in flight or a server encodes an ID the LB does not map.
+// Any real server can at least close such a connection gracefully, where a
+// drop leaves the client waiting out its timeout. It is not the fallback:
+// CIDs that do not decode still take the fallback route, and the catch-all
+// is not on the ring, so it sees only this traffic. When set it comes ahead
+// of DropRemovedServerIDs and the UnknownServerIDs policy.
+
+// catchAllBackend returns the catch-all backend, if one is configured and
+// healthy
+func (lb *LoadBalancer) catchAllBackend() (BackendConfig, bool) {
+	if lb.catchAll.Address == "" || lb.unhealthyBackend(lb.catchAll.Address) {
+		return BackendConfig{}, false
+	}
+	return lb.catchAll, true
+}
@@ -0,0 +1,58 @@
+package lb
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/fqzz2000/QUIC-LB-SHRIMP/pkg/packet"
+)
+
+func TestCatchAll(t *testing.T) {
+	fwd := memForwarder{opened: make(chan *memConn, 4)}
+	catch := memForwarder{opened: make(chan *memConn, 4)}
+	lb, _ := newMemLB(t, Config{
+		Backends: []BackendConfig{
+			{Address: "192.0.2.100:443", Forwarder: fwd},
+			{Address: "192.0.2.101:443", Forwarder: fwd},
+			{Address: "192.0.2.102:443", Forwarder: fwd},
+		},
+		CatchAll: BackendConfig{Address: "192.0.2.200:443", Forwarder: catch},
+		// the catch-all comes first; removed server IDs would be dropped
+		DropRemovedServerIDs: true,
+	})
+	cid, err := lb.routes().codec.Encode(0, []byte{0x01}, []byte{0x10, 0x11, 0x12, 0x13, 0x14, 0x15})
+	if err != nil {
+		t.Fatalf("Encode() error = %v", err)
+	}
+	if err := lb.RemoveBackend("192.0.2.101:443"); err != nil {
+		t.Fatalf("RemoveBackend() error = %v", err)
+	}
+	// with no flows left to drain the removal completes at the next sweep
+	lb.reap(lb.clock.Now())
+
+	// a connection of the removed server reaches the catch-all
+	if err := lb.handlePacket(append([]byte{0x40}, cid...), testAddr(1)); err != nil {
+		t.Fatalf("handlePacket(removed server's CID) error = %v", err)
+	}
+	expect(t, catch.opened)
+	if flow := lb.sessions.lookupCID(cid); flow == nil || flow.Backend != "192.0.2.200:443" {
+		t.Errorf("removed server's flow = %+v, want one on the catch-all", flow)
+	}
+	if got := lb.Stats().CatchAllRouted; got != 1 {
+		t.Errorf("CatchAllRouted = %d, want 1", got)
+	}
+
+	// a CID that does not decode takes the fallback, not the catch-all
+	dcid := []byte{0xc0, 0x01, 0x02, 0x03, 0x04, 0x05, 0x06, 0x07}
+	res, err := lb.DecodePacket(longHeaderPacket(packet.Initial, dcid, 1200), testAddr(2))
+	if err != nil || res.Route != RouteFallback || res.Backend == "192.0.2.200:443" {
+		t.Errorf("DecodePacket(undecodable) = %s by %s, %v, want a fallback backend", res.Backend, res.Route, err)
+	}
+
+	// an unhealthy catch-all leaves the server ID to the configured policy
+	lb.SetBackendHealth("192.0.2.200:443", false)
+	other, _ := lb.routes().codec.Encode(0, []byte{0x01}, []byte{0x20, 0x21, 0x22, 0x23, 0x24, 0x25})
+	if _, err := lb.DecodePacket(append([]byte{0x40}, other...), testAddr(3)); !errors.Is(err, errServerRemoved) {
+		t.Errorf("DecodePacket(removed server's CID) error = %v, want %v", err, errServerRemoved)
+	}
+}
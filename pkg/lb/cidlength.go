@@ -0,0 +1,38 @@
+package lb
+
+import (
+	"errors"
+	"fmt"
+)
+
+// The minimum CID length (Config.MinCIDLength) drops client packets whose
+// DCID is too short to carry the routing entropy the operator requires, as
+// CID-guessing attacks exploit. A long header is measured by the DCID length
+// it describes; a short header, which carries none, by the length parsing
+// took for it: the configured DCID length or the one self-encoded in its
+// first octet. This is separate from the maximum length parsing enforces
+// (Config.MaxCIDLengths): a CID over the cap does not parse at all.
+
+var (
+	// errMinCIDLength is returned for an invalid Config.MinCIDLength
+	errMinCIDLength = errors.New("invalid minimum CID length")
+	// errCIDTooShort is returned for a packet dropped for its short DCID
+	errCIDTooShort = errors.New("connection ID below the minimum length")
+)
+
+// minCIDLength returns the minimum DCID length, zero for any
+func (c *Config) minCIDLength() (int, error) {
+	if c.MinCIDLength < 0 || c.MinCIDLength > 255 {
+		return 0, fmt.Errorf("%w: %d", errMinCIDLength, c.MinCIDLength)
+	}
+	return c.MinCIDLength, nil
+}
+
+// checkMinCID drops a packet whose DCID is shorter than the minimum
+func (lb *LoadBalancer) checkMinCID(cid []byte) error {
+	if len(cid) >= lb.minCID {
+		return nil
+	}
+	lb.stats.cidTooShort.Add(1)
+	return fmt.Errorf("%w: %d bytes, want at least %d", errCIDTooShort, len(cid), lb.minCID)
+}
@@ -0,0 +1,77 @@
+package lb
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/fqzz2000/QUIC-LB-SHRIMP/pkg/packet"
+)
+
+func TestMinCIDLength(t *testing.T) {
+	fwd := memForwarder{opened: make(chan *memConn, 4)}
+	lb, _ := newMemLB(t, Config{
+		Backends:     []BackendConfig{{Address: "192.0.2.100:443", Forwarder: fwd}},
+		MinCIDLength: 8,
+	})
+	cid, err := lb.routes().codec.Encode(0, []byte{0x00}, []byte{1, 2, 3, 4, 5, 6})
+	if err != nil {
+		t.Fatalf("Encode() error = %v", err)
+	}
+	tests := []struct {
+		name    string
+		pkt     []byte
+		wantErr error
+	}{
+		{name: "Long Below Minimum", pkt: longHeaderPacket(packet.Initial, []byte{0xc0, 1, 2, 3, 4, 5, 6}, 1200), wantErr: errCIDTooShort},
+		{name: "Long At Minimum", pkt: longHeaderPacket(packet.Initial, []byte{0xc0, 1, 2, 3, 4, 5, 6, 7}, 1200)},
+		{name: "Short At Minimum", pkt: append([]byte{0x40}, append(cid, make([]byte, 32)...)...)},
+	}
+	drops := 0
+	for i, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := lb.handlePacket(tt.pkt, testAddr(i))
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("handlePacket() error = %v, want %v", err, tt.wantErr)
+			}
+			if err != nil {
+				drops++
+				if reason := dropReasonFor(err); reason != dropCIDTooShort {
+					t.Errorf("drop reason = %s, want cid_too_short", dropReasonNames[reason])
+				}
+			}
+			if got := lb.Stats().CIDTooShort; got != uint64(drops) {
+				t.Errorf("CIDTooShort = %d, want %d", got, drops)
+			}
+		})
+	}
+
+	// short headers are measured by the configured DCID length
+	strict, _ := newMemLB(t, Config{
+		Backends:     []BackendConfig{{Address: "192.0.2.100:443", Forwarder: fwd}},
+		MinCIDLength: 9,
+	})
+	if err := strict.handlePacket(append([]byte{0x40}, append(cid, make([]byte, 32)...)...), testAddr(9)); !errors.Is(err, errCIDTooShort) {
+		t.Errorf("handlePacket(short header below minimum) error = %v, want %v", err, errCIDTooShort)
+	}
+}
+
+func TestMinCIDLengthConfig(t *testing.T) {
+	tests := []struct {
+		name    string
+		min     int
+		wantErr error
+	}{
+		{name: "Disabled"},
+		{name: "Set", min: 8},
+		{name: "Negative", min: -1, wantErr: errMinCIDLength},
+		{name: "Too Long", min: 256, wantErr: errMinCIDLength},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := Config{MinCIDLength: tt.min}
+			if _, err := cfg.minCIDLength(); !errors.Is(err, tt.wantErr) {
+				t.Errorf("minCIDLength() error = %v, want %v", err, tt.wantErr)
+			}
+		})
+	}
+}
@@ -0,0 +1,15 @@
+package lb
+
+import "time"
+
+// Clock abstracts the time source so expiry logic can be tested deterministically
+type Clock interface {
+	Now() time.Time
+}
+
+// systemClock reads the wall clock
+type systemClock struct{}
+
+func (systemClock) Now() time.Time {
+	return time.Now()
+}
@@ -0,0 +1,84 @@
+package lb
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/fqzz2000/QUIC-LB-SHRIMP/pkg/packet"
+)
+
+// checkCoalesced counts a client datagram whose coalesced packets are
+// addressed to different DCIDs, or one with a Length running past its end,
+// likely truncated or tampered with. It is still routed on its first packet
+// and forwarded whole: RFC 9000 section 12.2 has the backend ignore packets
+// for another connection, and bytes after a short Length, padding included,
+// read as such packets (see trailing.go for those that cannot be). Only
+// CheckLengths drops datagrams for their lengths. Only long headers
+// coalesce, so short-header datagrams are never split.
+//
+// A datagram whose packets split cleanly but out of the order senders
+// coalesce them in (packet.CoalescedInOrder), such as a Handshake ahead of
+// an Initial, is counted and handled by the reordered coalesced policy
+// (Config.ReorderedCoalesced). Its packets share one DCID, so the CID it
+// routes on is the same whichever packet is first, but the first packet's
+// type is not the datagram's: "forward", the default, passes the datagram
+// on as it came, routed as its earliest packet, so a new connection is
+// recognised wherever its Initial sits; "reorder" puts the packets in order
+// before routing and forwarding, which is safe since each is protected on
+// its own; "drop" discards the datagram. checkCoalesced returns the
+// datagram reordered, nil when it is not, and the type to route it as.
+func (lb *LoadBalancer) checkCoalesced(processor *packet.PacketProcessor, datagram []byte, ptype packet.PacketType) ([]byte, packet.PacketType, error) {
+	if datagram[0]&0x80 == 0 {
+		return nil, ptype, nil
+	}
+	packets, err := processor.SplitCoalesced(datagram)
+	switch {
+	case errors.Is(err, packet.ErrMismatchedDCID):
+		lb.stats.mismatchedDCIDs.Add(1)
+	case errors.Is(err, packet.ErrLengthPastDatagram):
+		lb.stats.lengthOverruns.Add(1)
+	}
+	if err != nil || processor.CoalescedInOrder(packets) {
+		return nil, ptype, nil
+	}
+	lb.stats.reorderedCoalesced.Add(1)
+	ordered := processor.OrderCoalesced(packets)
+	earliest, _ := processor.ClassifyPacket(ordered[0])
+	switch lb.reordered {
+	case reorderedDrop:
+		return nil, ptype, fmt.Errorf("%w: %s first", errReorderedCoalesced, ptype)
+	case reorderedReorder:
+		out := make([]byte, 0, len(datagram))
+		for _, p := range ordered {
+			out = append(out, p...)
+		}
+		return out, earliest, nil
+	}
+	return nil, earliest, nil
+}
+
+// Reordered coalesced policies (Config.ReorderedCoalesced); see checkCoalesced
+const (
+	reorderedForward = "forward"
+	reorderedReorder = "reorder"
+	reorderedDrop    = "drop"
+)
+
+var (
+	// errReorderedPolicy is returned for an unknown Config.ReorderedCoalesced
+	errReorderedPolicy = errors.New("invalid reordered coalesced policy")
+	// errReorderedCoalesced is returned for a datagram dropped for the
+	// order of its packets
+	errReorderedCoalesced = errors.New("coalesced packets out of order")
+)
+
+// reorderedCoalesced returns the reordered coalesced policy
+func (c *Config) reorderedCoalesced() (string, error) {
+	switch c.ReorderedCoalesced {
+	case "":
+		return reorderedForward, nil
+	case reorderedForward, reorderedReorder, reorderedDrop:
+		return c.ReorderedCoalesced, nil
+	}
+	return "", fmt.Errorf("%w: %q", errReorderedPolicy, c.ReorderedCoalesced)
+}
@@ -0,0 +1,163 @@
+package lb
+
+import (
+	"bytes"
+	"errors"
+	"testing"
+
+	"github.com/fqzz2000/QUIC-LB-SHRIMP/pkg/packet"
+)
+
+func TestCoalescedDCIDMismatch(t *testing.T) {
+	fwd := memForwarder{opened: make(chan *memConn, 1)}
+	lb, _ := newMemLB(t, Config{
+		Backends: []BackendConfig{{Address: "192.0.2.100:443", Forwarder: fwd}},
+	})
+	dcid := []byte{0x00, 0x00, 1, 2, 3, 4, 5, 6}
+	initial := quicLongHeader(packet.Initial, dcid, []byte{0xcc}, make([]byte, 24))
+	other := quicLongHeader(packet.HandShake, []byte{0x00, 0x01, 9, 9, 9, 9, 9, 9}, []byte{0xcc}, make([]byte, 24))
+
+	datagram := append(append([]byte(nil), initial...), other...)
+	if err := lb.handlePacket(datagram, testAddr(1)); err != nil {
+		t.Fatalf("handlePacket() error = %v", err)
+	}
+	// routed on the Initial and forwarded whole for the backend to sort out
+	if got := expect(t, expect(t, fwd.opened).sent); !bytes.Equal(got, datagram) {
+		t.Errorf("forwarded %x, want %x", got, datagram)
+	}
+	if lb.sessions.lookup(dcid, testAddr(1)) == nil {
+		t.Errorf("no flow for the first packet's DCID")
+	}
+	if got := lb.Stats().MismatchedDCIDs; got != 1 {
+		t.Errorf("MismatchedDCIDs = %d, want 1", got)
+	}
+}
+
+func TestLengthPastDatagram(t *testing.T) {
+	dcid := []byte{0x00, 0x00, 1, 2, 3, 4, 5, 6}
+	initial := quicLongHeader(packet.Initial, dcid, []byte{0xcc}, make([]byte, 24))
+	truncated := initial[:len(initial)-1]
+	tests := []struct {
+		name         string
+		checkLengths bool
+		wantErr      error
+		wantCorrupt  uint64
+		wantOverruns uint64
+	}{
+		// counted and forwarded for the backend to discard
+		{name: "Counted", wantOverruns: 1},
+		{name: "Dropped With CheckLengths", checkLengths: true, wantErr: packet.ErrInconsistentLengths, wantCorrupt: 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fwd := memForwarder{opened: make(chan *memConn, 1)}
+			lb, _ := newMemLB(t, Config{
+				Backends:     []BackendConfig{{Address: "192.0.2.100:443", Forwarder: fwd}},
+				CheckLengths: tt.checkLengths,
+			})
+			err := lb.handlePacket(truncated, testAddr(1))
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("handlePacket() error = %v, want %v", err, tt.wantErr)
+			}
+			if err == nil {
+				if got := expect(t, expect(t, fwd.opened).sent); !bytes.Equal(got, truncated) {
+					t.Errorf("forwarded %x, want %x", got, truncated)
+				}
+			}
+			if s := lb.Stats(); s.LengthOverruns != tt.wantOverruns || s.CorruptPackets != tt.wantCorrupt {
+				t.Errorf("LengthOverruns, CorruptPackets = %d, %d, want %d, %d", s.LengthOverruns, s.CorruptPackets, tt.wantOverruns, tt.wantCorrupt)
+			}
+
+			// a datagram whose Length ends it exactly is neither
+			if err := lb.handlePacket(initial, testAddr(2)); err != nil {
+				t.Fatalf("handlePacket(intact) error = %v", err)
+			}
+			if got := lb.Stats().LengthOverruns; got != tt.wantOverruns {
+				t.Errorf("LengthOverruns = %d after an intact datagram, want %d", got, tt.wantOverruns)
+			}
+		})
+	}
+}
+
+func TestReorderedCoalesced(t *testing.T) {
+	tests := []struct {
+		name    string
+		policy  string
+		wantErr error
+		ordered bool // whether the backend gets the packets in order
+	}{
+		{name: "Default"},
+		{name: "Forward", policy: reorderedForward},
+		{name: "Reorder", policy: reorderedReorder, ordered: true},
+		{name: "Drop", policy: reorderedDrop, wantErr: errReorderedCoalesced},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fwd := memForwarder{opened: make(chan *memConn, 8)}
+			lb, _ := newMemLB(t, Config{
+				Backends: []BackendConfig{
+					{Address: "192.0.2.100:443", Forwarder: fwd, NewFlows: true},
+					{Address: "192.0.2.101:443", Forwarder: fwd},
+					{Address: "192.0.2.102:443", Forwarder: fwd},
+				},
+				ReorderedCoalesced: tt.policy,
+			})
+			decoded, err := lb.routes().codec.Encode(0, []byte{0x02}, []byte{0x10, 0x11, 0x12, 0x13, 0x14, 0x15})
+			if err != nil {
+				t.Fatalf("Encode() error = %v", err)
+			}
+			// a DCID of the client's own routes to the new-flow pool when the
+			// datagram carries an Initial, wherever the Initial sits
+			for i, tc := range []struct {
+				dcid []byte
+				want string
+			}{
+				{dcid: decoded, want: "192.0.2.102:443"},
+				{dcid: []byte{0xc0, 1, 1, 1, 1, 1, 1, 1}, want: "192.0.2.100:443"},
+				{dcid: []byte{0xc0, 2, 2, 2, 2, 2, 2, 2}, want: "192.0.2.100:443"},
+				{dcid: []byte{0xc0, 3, 3, 3, 3, 3, 3, 3}, want: "192.0.2.100:443"},
+			} {
+				initial := quicLongHeader(packet.Initial, tc.dcid, []byte{0xcc}, make([]byte, 40))
+				handshake := quicLongHeader(packet.HandShake, tc.dcid, []byte{0xcc}, make([]byte, 24))
+				datagram := append(append([]byte(nil), handshake...), initial...)
+
+				err := lb.handlePacket(append([]byte(nil), datagram...), testAddr(i+1))
+				if !errors.Is(err, tt.wantErr) {
+					t.Fatalf("handlePacket(Handshake, Initial) error = %v, want %v", err, tt.wantErr)
+				}
+				if err != nil {
+					continue
+				}
+				want := datagram
+				if tt.ordered {
+					want = append(append([]byte(nil), initial...), handshake...)
+				}
+				if got := expect(t, expect(t, fwd.opened).sent); !bytes.Equal(got, want) {
+					t.Errorf("forwarded %x, want %x", got, want)
+				}
+				if flow := lb.sessions.lookupCID(tc.dcid); flow == nil || flow.Backend != tc.want {
+					t.Errorf("flow for DCID %x = %+v, want one to %s", tc.dcid, flow, tc.want)
+				}
+			}
+			if got := lb.Stats().ReorderedCoalesced; got != 4 {
+				t.Errorf("ReorderedCoalesced = %d, want 4", got)
+			}
+
+			// packets in order are not counted
+			initial := quicLongHeader(packet.Initial, decoded, []byte{0xcc}, make([]byte, 40))
+			handshake := quicLongHeader(packet.HandShake, decoded, []byte{0xcc}, make([]byte, 24))
+			if err := lb.handlePacket(append(initial, handshake...), testAddr(9)); err != nil {
+				t.Fatalf("handlePacket(Initial, Handshake) error = %v", err)
+			}
+			if got := lb.Stats().ReorderedCoalesced; got != 4 {
+				t.Errorf("ReorderedCoalesced = %d after an ordered datagram, want 4", got)
+			}
+		})
+	}
+}
+
+func TestReorderedCoalescedConfig(t *testing.T) {
+	if _, err := (&Config{ReorderedCoalesced: "sort"}).reorderedCoalesced(); !errors.Is(err, errReorderedPolicy) {
+		t.Errorf("reorderedCoalesced(sort) error = %v, want %v", err, errReorderedPolicy)
+	}
+}
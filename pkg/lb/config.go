@@ -0,0 +1,611 @@
+package lb
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"runtime"
+	"time"
+
+	"github.com/fqzz2000/QUIC-LB-SHRIMP/pkg/metrics"
+	"github.com/fqzz2000/QUIC-LB-SHRIMP/pkg/packet"
+	"github.com/fqzz2000/QUIC-LB-SHRIMP/pkg/quiclb"
+)
+
+// Config holds the settings used to construct a LoadBalancer
+type Config struct {
+	// ListenAddr is the address clients send QUIC packets to
+	ListenAddr string
+	// ListenNetwork is the network of ListenAddr: "udp" (the default),
+	// "udp4", "udp6", or "unixgram" to sit behind a sidecar proxy on a Unix
+	// datagram socket, in which case ListenAddr is the socket path, or
+	// "transparent" to receive UDP diverted from other addresses on Linux
+	// (see transparent.go). Backends are always reached over UDP.
+	ListenNetwork string
+	// ListenRetryTimeout keeps retrying, with backoff, a listener bind that
+	// fails because the address is in use, for up to this long; zero fails
+	// at once. For fast restarts while the previous instance lets go of the
+	// address. See listen.go.
+	ListenRetryTimeout time.Duration
+	// Listeners are more client-facing UDP listeners in front of the same
+	// backends, each parsing short headers with its own DCID length. See
+	// listeners.go.
+	Listeners []ListenerConfig
+	// AcceptProxyProtocol strips the PROXY v2 header an outer load balancer
+	// prepends for backends with ProxyProtocol, and routes new flows by the
+	// client it names, to chain load balancers. Any sender can claim a
+	// client this way, so enable it only behind load balancers. See
+	// proxyproto.go.
+	AcceptProxyProtocol bool
+	// AdminAddr is the TCP address of the admin HTTP server, empty to disable it
+	AdminAddr string
+	// Pprof serves net/http/pprof profiles under /debug/pprof/ on the admin
+	// server, which must then be bound to a loopback or private IP. See
+	// pprof.go.
+	Pprof bool
+	// ControlAddr is the address backends send connection-closed
+	// notifications to, empty to disable the control channel, and
+	// ControlNetwork its network, "udp" (the default) or "unixgram" with
+	// ControlAddr the socket path. See control.go.
+	ControlAddr    string
+	ControlNetwork string
+	// EvictionNotices tells backends with a BackendConfig.ControlAddr, over
+	// the control socket, of each of their flows the reaper evicts; off by
+	// default. See evictnotice.go.
+	EvictionNotices bool
+	// VerifyServerIDs checks the server IDs backends report over the
+	// control channel against the server ID mapping, counting and logging
+	// mismatches. See serveridverify.go.
+	VerifyServerIDs bool
+	// LoadReportMaxAge enables load reports over the control channel and is
+	// how long a report stays fresh; the fallback steers new flows away from
+	// backends whose fresh load is more than LoadTolerance, a share of
+	// capacity defaulting to 0.1, above the mean. See loadreport.go.
+	LoadReportMaxAge time.Duration
+	LoadTolerance    float64
+	// Backends are the servers, indexed by decoded server ID unless they list
+	// their BackendConfig.ServerIDs
+	Backends []BackendConfig
+	// DuplicateBackends is the policy for a backend address listed more
+	// than once: "error" (the default) or "dedupe" to keep its first entry
+	// with a warning. See duplicates.go.
+	DuplicateBackends string
+	// DefaultBackend is the address of the backend taking server IDs no
+	// backend lists in ServerIDs. Without it the listed IDs must cover every
+	// server ID the active configs encode.
+	DefaultBackend string
+	// TruncatedServerIDs maps hex truncated server IDs, all of one length,
+	// to backend addresses, for CIDs carrying a truncated hash of a server
+	// ID too wide for the field. Decoded server IDs are looked up by their
+	// first bytes; values not in the map are unknown server IDs. Exclusive
+	// with ServerIDs. See truncatedids.go.
+	TruncatedServerIDs map[string]string
+	// ServerIDResolver, when set, maps decoded server IDs to backend
+	// addresses in place of the index and ServerIDs lookups. It excludes
+	// TruncatedServerIDs and RotationBackends. See serveridresolver.go.
+	ServerIDResolver ServerIDResolver
+	// QUICLB holds the connection ID configs, indexed by config rotation codepoint
+	QUICLB [quiclb.NumConfigs]quiclb.ConfigEntry
+	// Workers is the number of packet-processing goroutines, defaulting to GOMAXPROCS
+	Workers int
+	// QueueSize is the per-worker packet queue depth; packets beyond it are dropped
+	QueueSize int
+	// Shadow, when its Address is set, receives a copy of the client traffic
+	// of sampled flows; its responses are discarded
+	Shadow BackendConfig
+	// ShadowSampleRate is the fraction of new flows mirrored to Shadow, in
+	// (0, 1]; zero mirrors every flow
+	ShadowSampleRate float64
+	// AmplificationFactor caps what is returned to a client before its address
+	// is validated at this multiple of what it sent; zero uses the RFC 9000
+	// factor of 3 and a negative value disables the limit
+	AmplificationFactor int
+	// SessionShards is how many shards the session table and the issued CID
+	// filter are split into, each with its own locks, so flows in different
+	// shards do not contend; zero uses 16. See session.go.
+	SessionShards int
+	// IdleTimeout reaps established flows with no traffic for this long,
+	// defaulting to 5 minutes
+	IdleTimeout time.Duration
+	// RotationIdleTimeouts, by rotation codepoint, set the idle timeout of
+	// flows whose CID decodes with that codepoint's config, zero for
+	// IdleTimeout. A backend's BackendConfig.IdleTimeout takes precedence.
+	RotationIdleTimeouts [quiclb.NumConfigs]time.Duration
+	// UnestablishedTimeout reaps flows that are not established this long
+	// after their first packet, defaulting to 10 seconds. A flow is
+	// established once its backend has responded and it has exchanged
+	// EstablishedPackets packets in total (default 2).
+	UnestablishedTimeout time.Duration
+	EstablishedPackets   int
+	// Strategy, when set, picks backends for new flows instead of QUIC-LB
+	// server ID decoding
+	Strategy Strategy
+	// HashSeed seeds the consistent-hash ring. Load balancers sharing
+	// backends with the same seed hash every key identically, so skew
+	// lands on the same backend everywhere; distinct seeds decorrelate them.
+	// Zero is a fixed default, so mappings are reproducible across restarts.
+	HashSeed uint64
+	// Fallback, when set, routes packets whose CID does not decode instead of
+	// the consistent-hash ring over client addresses
+	Fallback Strategy
+	// TokenDecoder, when set, reads the server ID out of the tokens servers
+	// issue, and new connections returning one in their Initial are routed
+	// by it before their CID. See tokenroute.go.
+	TokenDecoder TokenDecoder
+	// BackendSockets is how flows reach backends without a Forwarder:
+	// "connected" (the default), a connected UDP socket per flow that
+	// surfaces ICMP errors, or "unconnected", one shared socket sending
+	// with WriteTo. See backendsocket.go.
+	BackendSockets string
+	// SourcePortMin and SourcePortMax, when set, bind each connected backend
+	// socket to a source port in the inclusive range derived from the
+	// client's four-tuple, so backends see a stable LB source port per
+	// client. See sourceport.go.
+	SourcePortMin int
+	SourcePortMax int
+	// BackendSource is the local IP address, or the name of the interface
+	// whose address, backend sockets bind to, so forwarded traffic leaves by
+	// that path on a multi-homed host. Empty lets the routing table choose.
+	// See backendsource.go.
+	BackendSource string
+	// LogSuccessRate is the fraction of successfully routed packets logged
+	// outside debug mode, and LogFailuresPerSecond caps how many failures
+	// (drops and fallbacks after a decode error) are logged each second,
+	// all of them up to the cap. Both zero disables sampled logging.
+	LogSuccessRate       float64
+	LogFailuresPerSecond int
+	// MalformedPackets is how datagrams that are not valid QUIC are
+	// reported: "lenient" (the default) drops them quietly, "strict" also
+	// logs each as a warning, rate capped, and counts it by detailed
+	// reason. See malformed.go.
+	MalformedPackets string
+	// SlowPacketThreshold logs, with its type and CID, any packet whose
+	// parse, decode and backend selection take longer, at most 10 a second.
+	// Zero disables it. See slowpacket.go.
+	SlowPacketThreshold time.Duration
+	// NonceReuseWindow is how many recently decoded (server ID, nonce)
+	// pairs are kept to spot servers reusing CID nonces, a NonceSampleRate
+	// fraction (default all) of decoded new flows being checked. Zero
+	// disables detection. See noncereuse.go.
+	NonceReuseWindow int
+	NonceSampleRate  float64
+	// ServerIDSamples is how many recently forwarded packets' server IDs
+	// are kept for GET /server-ids, a ServerIDSampleRate fraction (default
+	// 0.01) of packets being sampled. Zero disables sampling. See
+	// serveridload.go.
+	ServerIDSamples    int
+	ServerIDSampleRate float64
+	// EventLogSize is how many recent routing events the admin /events
+	// endpoint keeps, defaulting to 1024; negative disables the log. See
+	// eventlog.go.
+	EventLogSize int
+	// DecisionSink, when set, is sent every routing decision asynchronously,
+	// through a queue of DecisionQueueSize decisions (default 4096) that
+	// drops the oldest when the sink falls behind. See decisionsink.go.
+	DecisionSink      DecisionSink
+	DecisionQueueSize int
+	// StatelessResetKey, when set, answers short-header packets that match
+	// no flow and do not decode with a stateless reset keyed by it instead of
+	// routing them; backends must derive their reset tokens with
+	// StatelessResetToken and the same key
+	StatelessResetKey []byte
+	// RepairDecodes retries a CID that does not decode with the config its
+	// rotation bits select against every other active config before falling
+	// back, for clients reflecting stale rotation bits. It costs a decode per
+	// extra config on every failing CID.
+	RepairDecodes bool
+	// CheckLengths drops client datagrams whose length fields contradict
+	// each other or the datagram as likely corrupt, before they are routed on
+	// header bits a corrupted datagram may have flipped (see
+	// packet.PacketProcessor.CheckLengths). It parses every coalesced packet.
+	CheckLengths bool
+	// DropSmallInitials drops client datagrams carrying an Initial that are
+	// shorter than MinInitialSize, defaulting to RFC 9000's 1200 bytes; the
+	// whole datagram is measured, coalesced packets and padding included.
+	// See initialsize.go.
+	DropSmallInitials bool
+	MinInitialSize    int
+	// MaxCIDLengths caps connection ID lengths per QUIC version, for
+	// private versions whose CIDs may be longer (or must be shorter) than
+	// QUICv1's 20 bytes; long headers are checked against their version's
+	// cap and short headers, which carry none, against ShortHeaderVersion's.
+	// Packets over the cap are dropped. See packet.PacketProcessor.
+	MaxCIDLengths      map[uint32]uint8
+	ShortHeaderVersion uint32
+	// MinCIDLength drops client packets whose DCID is shorter, by the
+	// length a long header describes or a short header's configured one,
+	// and counts them; zero allows any. See cidlength.go.
+	MinCIDLength int
+	// ZeroRTT is the policy for 0-RTT packets: "forward" (the default),
+	// "delay" until the flow's first 1-RTT packet, or "drop". See zerortt.go.
+	ZeroRTT string
+	// ZeroRTTReturnLimit caps the bytes returned to a client whose flow
+	// forwarded 0-RTT until it sends a 1-RTT packet; zero leaves them
+	// unlimited. See zerorttlimit.go.
+	ZeroRTTReturnLimit int
+	// NewFlowRate caps the flows one source IP may open per second, however
+	// few packets it sends, with bursts of up to NewFlowBurst (default the
+	// rate rounded up). Zero leaves new flows unlimited. See newflowrate.go.
+	NewFlowRate  float64
+	NewFlowBurst int
+	// MaxFlowsPerSource caps the flows one source IP may hold open at once;
+	// packets that would open more are dropped. Zero leaves it unlimited.
+	// See sourceflows.go.
+	MaxFlowsPerSource int
+	// ForwardTypes lists the client packet types forwarded; packets of other
+	// types are dropped. Empty forwards every type. See packettypes.go.
+	ForwardTypes []packet.PacketType
+	// Canary is the address of a backend given CanaryPercent of new
+	// connections, from 0 to 100, ahead of CID routing. See canary.go.
+	Canary        string
+	CanaryPercent float64
+	// BackendDrainTimeout is how long a backend removed at runtime keeps its
+	// flows before they are closed, defaulting to 5 minutes
+	BackendDrainTimeout time.Duration
+	// DrainingNewFlows is the policy for new connections whose CID decodes
+	// to a backend draining for removal: "fallback" (the default) to a live
+	// backend, "retry" to one by a Retry, or "version_negotiation" to refuse
+	// them. Established connections keep the draining backend. See
+	// drainredirect.go.
+	DrainingNewFlows string
+	// RetryTokenLifetime is how long a Retry token sent by the "retry"
+	// draining policy is accepted, defaulting to 10 seconds, and
+	// RetryReplayCache how many recent tokens are remembered to refuse
+	// replays, defaulting to 4096. RetryTokenKey authenticates the tokens
+	// and must be shared by load balancers in front of the same backends;
+	// unset, a random key is used. See retrytoken.go.
+	RetryTokenLifetime time.Duration
+	RetryReplayCache   int
+	RetryTokenKey      []byte
+	// DropRemovedServerIDs drops new flows whose CID decodes to a backend
+	// removed at runtime instead of rerouting them
+	DropRemovedServerIDs bool
+	// UnknownServerIDs is the policy for new flows whose CID decodes to a
+	// server ID no backend has: "fallback" (the default), "drop", or "pool"
+	// for the new-flow pool. See serverids.go.
+	UnknownServerIDs string
+	// CatchAll, when its Address is set, takes new flows whose CID decodes
+	// to a server ID no backend has, removed backends included, ahead of
+	// DropRemovedServerIDs and UnknownServerIDs. It is kept off the ring and
+	// apart from Fallback. See catchall.go.
+	CatchAll BackendConfig
+	// RotationPolicies says what to do with a CID by the config rotation
+	// codepoint its first two bits pick: "decode" (the default), "fallback"
+	// to route it as a CID that does not decode, or "drop". Codepoints with
+	// an active config must decode. See rotationpolicy.go.
+	RotationPolicies [quiclb.NumConfigs]string
+	// RotationBackends lists, by rotation codepoint, the addresses of the
+	// backends server IDs decoded with that codepoint's config index, in
+	// order; a codepoint without a list indexes all the backends. For
+	// migrations between fleets, in index mode only. See rotationpools.go.
+	RotationBackends [quiclb.NumConfigs][]string
+	// TrailingBytes is the policy for long-header datagrams with bytes after
+	// their packets that cannot be a packet: "forward" (the default), "drop"
+	// or "trim" them off. See trailing.go.
+	TrailingBytes string
+	// ReorderedCoalesced is the policy for client datagrams coalescing
+	// packets out of the order senders use, such as a Handshake before an
+	// Initial: "forward" (the default) routed as their earliest packet,
+	// "reorder" them, or "drop". See coalesced.go.
+	ReorderedCoalesced string
+	// RewriteCIDs replaces the DCIDs clients choose with LB-issued CIDs
+	// naming their backend before forwarding, and restores them in backend
+	// responses (see rewrite.go). Off by default: packets go out verbatim.
+	RewriteCIDs bool
+	// RewriteCIDLength is the length of the CIDs issued in RewriteCIDs mode,
+	// for backends that need one; zero keeps each client DCID's length
+	RewriteCIDLength int
+	// DropOverCapacity drops new flows whose CID decodes to a backend at its
+	// MaxFlows limit instead of admitting them over it; both are counted
+	DropOverCapacity bool
+	// Overrides are routing overrides installed at startup
+	Overrides []Override
+	// OverrideTTL is the lifetime of overrides that set none, defaulting to 10 minutes
+	OverrideTTL time.Duration
+	// IssuedCIDTTL is how long CIDs issued by the LB are remembered without traffic
+	IssuedCIDTTL time.Duration
+	// IssuedCIDCapacity is how many issued CIDs are remembered at most,
+	// defaulting to 65536; past it the oldest may be forgotten, after which
+	// their packets decode with the config their rotation bits select
+	IssuedCIDCapacity int
+	// Debug logs every dropped packet
+	Debug bool
+	// DecodeTraceRate is the fraction of packets whose decode is logged step
+	// by step in debug mode, from the first byte to the routing decision.
+	// Ignored without Debug; zero disables tracing.
+	DecodeTraceRate float64
+	// RecoverPanics drops a packet whose processing panics, logging it and
+	// keeping the worker alive. Leave it off in tests so panics surface.
+	RecoverPanics bool
+	// Clock overrides the time source, mainly for tests
+	Clock Clock
+	// Resolver looks up backend host names at startup, defaulting to
+	// net.DefaultResolver. ResolveTimeout caps how long Start waits for them
+	// to resolve, defaulting to 10 seconds, and ResolveRetryInterval is the
+	// longest backoff between lookups and how often backends that did not
+	// resolve are retried, defaulting to 5 seconds. See resolve.go.
+	Resolver             Resolver
+	ResolveTimeout       time.Duration
+	ResolveRetryInterval time.Duration
+	// HealthCheckInterval enables the QUIC health check: every interval each
+	// backend is sent a client Initial of HealthCheckVersion (default v1) and
+	// marked healthy if any datagram comes back within HealthCheckTimeout
+	// (default 1 second). Zero disables it. See healthcheck.go.
+	HealthCheckInterval time.Duration
+	HealthCheckTimeout  time.Duration
+	HealthCheckVersion  uint32
+	// Name labels the instance's metrics with instance=Name, so several load
+	// balancers in one process can share Metrics
+	Name string
+	// Metrics is the registry the instance registers into, nil for its own.
+	// Instances sharing one need distinct Names.
+	Metrics *metrics.Registry
+	// MetricsFormat is the exposition /metrics serves: "prometheus" text
+	// (the default) or "openmetrics" text
+	MetricsFormat string
+}
+
+// BackendConfig describes one backend server
+type BackendConfig struct {
+	// Address is the UDP address packets are forwarded to
+	Address string
+	// ProxyProtocol prepends a PROXY v2 header carrying the client address to
+	// the first datagram of each flow (see proxyproto.go for the framing)
+	ProxyProtocol bool
+	// Weight scales the backend's share of fallback-routed flows, defaulting to 1
+	Weight int
+	// Forwarder carries flows to the backend; nil forwards plain UDP
+	Forwarder Forwarder
+	// ServerIDs are the server IDs that route to this backend, letting one
+	// backend answer for several. When any backend sets them, server IDs are
+	// looked up here rather than used as an index into Config.Backends.
+	ServerIDs [][]byte
+	// MaxFlows caps the backend's active flows, zero for no limit. New flows
+	// routed without affinity spill to the next backend once it is reached;
+	// see Config.DropOverCapacity for flows whose CID names this backend.
+	MaxFlows int
+	// NewFlows puts the backend in the new-flow pool: Initial and 0-RTT
+	// packets whose CID does not decode, the first flight of a new
+	// connection, are routed to the pool instead of the fallback, which is
+	// left to traffic of connections already established (see newflows.go)
+	NewFlows bool
+	// MaxPacketRate and MaxByteRate cap the datagrams and bytes per second
+	// the LB sends the backend, zero for no limit (see egress.go)
+	MaxPacketRate float64
+	MaxByteRate   float64
+	// Versions are the QUIC versions the backend speaks, nil for any. New
+	// connections routed to it in another version are answered with Version
+	// Negotiation listing these (see versions.go).
+	Versions []uint32
+	// IdleTimeout overrides Config.IdleTimeout for flows opened to the
+	// backend, zero to keep it
+	IdleTimeout time.Duration
+	// ControlAddr is where the backend takes eviction notices, on the
+	// control network; empty for none (see evictnotice.go)
+	ControlAddr string
+}
+
+// weight returns the configured weight, treating unset as 1
+func (b BackendConfig) weight() int {
+	if b.Weight > 0 {
+		return b.Weight
+	}
+	return 1
+}
+
+// StaticBackends builds backend configs with default options for each address
+func StaticBackends(addrs ...string) []BackendConfig {
+	backends := make([]BackendConfig, len(addrs))
+	for i, addr := range addrs {
+		backends[i] = BackendConfig{Address: addr}
+	}
+	return backends
+}
+
+// defaultQUICLBConfig is used when no QUIC-LB config is active: a plaintext
+// one-byte server ID that yields connection IDs of defaultDCIDLength
+var defaultQUICLBConfig = quiclb.ConfigEntry{
+	Algorithm:      quiclb.Plaintext,
+	ServerIDLength: 1,
+	NonceLength:    defaultDCIDLength - 2,
+}
+
+// dcidLength returns the short-header DCID length implied by the first active config
+func (c *Config) dcidLength() (uint8, error) {
+	for _, e := range c.QUICLB {
+		if e.Active() {
+			return uint8(e.CIDLength()), nil
+		}
+	}
+	return 0, errors.New("no active QUIC-LB config")
+}
+
+// selfEncodedLength reports whether the active configs self-encode their CID
+// lengths, which short-header parsing relies on for all of them or none
+func (c *Config) selfEncodedLength() (bool, error) {
+	var self, fixed bool
+	for _, e := range c.QUICLB {
+		if e.Active() {
+			self = self || e.SelfEncodedLength
+			fixed = fixed || !e.SelfEncodedLength
+		}
+	}
+	if self && fixed {
+		return false, fmt.Errorf("%w: a self-encoded CID length must be set on every active config or none", quiclb.ErrInvalidConfig)
+	}
+	return self, nil
+}
+
+// issueRotation returns the codepoint of the first active config, used for CIDs the LB issues
+func (c *Config) issueRotation() uint8 {
+	for i, e := range c.QUICLB {
+		if e.Active() {
+			return uint8(i)
+		}
+	}
+	return 0
+}
+
+// defaultQueueSize is the per-worker queue depth used when QueueSize is unset
+const defaultQueueSize = 1024
+
+// shadowRate returns the mirroring sample rate, treating unset as every flow
+func (c *Config) shadowRate() float64 {
+	if c.ShadowSampleRate <= 0 {
+		return 1
+	}
+	return c.ShadowSampleRate
+}
+
+func (c *Config) amplificationFactor() int {
+	if c.AmplificationFactor == 0 {
+		return defaultAmplificationFactor
+	}
+	return c.AmplificationFactor
+}
+
+func (c *Config) resolver() Resolver {
+	if c.Resolver == nil {
+		return net.DefaultResolver
+	}
+	return c.Resolver
+}
+
+func (c *Config) resolveTimeout() time.Duration {
+	if c.ResolveTimeout > 0 {
+		return c.ResolveTimeout
+	}
+	return defaultResolveTimeout
+}
+
+func (c *Config) resolveRetryInterval() time.Duration {
+	if c.ResolveRetryInterval > 0 {
+		return c.ResolveRetryInterval
+	}
+	return defaultResolveRetryInterval
+}
+
+func (c *Config) backendDrainTimeout() time.Duration {
+	if c.BackendDrainTimeout > 0 {
+		return c.BackendDrainTimeout
+	}
+	return defaultBackendDrainTimeout
+}
+
+func (c *Config) backendSockets() (string, error) {
+	switch c.BackendSockets {
+	case "", backendSocketsConnected:
+		return backendSocketsConnected, nil
+	case backendSocketsUnconnected:
+		return c.BackendSockets, nil
+	}
+	return "", fmt.Errorf("%w: %q", errBackendSockets, c.BackendSockets)
+}
+
+func (c *Config) sourcePorts() (portRange, error) {
+	if c.SourcePortMin == 0 && c.SourcePortMax == 0 {
+		return portRange{}, nil
+	}
+	if c.SourcePortMin < 1 || c.SourcePortMin > c.SourcePortMax || c.SourcePortMax > 65535 {
+		return portRange{}, fmt.Errorf("%w: %d-%d", errSourcePorts, c.SourcePortMin, c.SourcePortMax)
+	}
+	if c.BackendSockets == backendSocketsUnconnected {
+		return portRange{}, fmt.Errorf("%w: needs connected backend sockets", errSourcePorts)
+	}
+	return portRange{min: c.SourcePortMin, max: c.SourcePortMax}, nil
+}
+
+// canaryShare returns the canary's share of new connections in canaryScale units
+func (c *Config) canaryShare() (uint64, error) {
+	if c.CanaryPercent < 0 || c.CanaryPercent > 100 {
+		return 0, fmt.Errorf("%w: percentage %v outside [0, 100]", errCanary, c.CanaryPercent)
+	}
+	if c.Canary == "" {
+		if c.CanaryPercent != 0 {
+			return 0, fmt.Errorf("%w: percentage without a canary backend", errCanary)
+		}
+		return 0, nil
+	}
+	for _, b := range c.Backends {
+		if b.Address == c.Canary {
+			return uint64(c.CanaryPercent * canaryScale / 100), nil
+		}
+	}
+	return 0, fmt.Errorf("%w: %s is not a backend", errCanary, c.Canary)
+}
+
+func (c *Config) zeroRTT() (string, error) {
+	switch c.ZeroRTT {
+	case "":
+		return zeroRTTForward, nil
+	case zeroRTTForward, zeroRTTDelay, zeroRTTDrop:
+		return c.ZeroRTT, nil
+	}
+	return "", fmt.Errorf("%w: %q", errZeroRTTPolicy, c.ZeroRTT)
+}
+
+func (c *Config) unknownServerIDs() (string, error) {
+	switch c.UnknownServerIDs {
+	case "":
+		return unknownServerIDFallback, nil
+	case unknownServerIDFallback, unknownServerIDDrop, unknownServerIDPool:
+		return c.UnknownServerIDs, nil
+	}
+	return "", fmt.Errorf("%w: %q", errUnknownServerIDPolicy, c.UnknownServerIDs)
+}
+
+func (c *Config) listenNetwork() string {
+	if c.ListenNetwork == "" {
+		return "udp"
+	}
+	return c.ListenNetwork
+}
+
+func (c *Config) controlNetwork() string {
+	if c.ControlNetwork == "" {
+		return "udp"
+	}
+	return c.ControlNetwork
+}
+
+func (c *Config) timeouts() timeouts {
+	t := timeouts{
+		idle:               c.IdleTimeout,
+		unestablished:      c.UnestablishedTimeout,
+		establishedPackets: uint64(c.EstablishedPackets),
+	}
+	if t.idle <= 0 {
+		t.idle = defaultIdleTimeout
+	}
+	t.longestIdle = t.idle
+	for rotation, idle := range c.RotationIdleTimeouts {
+		if idle > 0 {
+			t.rotationIdle[rotation] = idle
+		}
+		t.longestIdle = max(t.longestIdle, idle)
+	}
+	for _, b := range c.Backends {
+		t.longestIdle = max(t.longestIdle, b.IdleTimeout)
+	}
+	if t.unestablished <= 0 {
+		t.unestablished = defaultUnestablishedTimeout
+	}
+	if c.EstablishedPackets <= 0 {
+		t.establishedPackets = defaultEstablishedPackets
+	}
+	return t
+}
+
+func (c *Config) workers() int {
+	if c.Workers > 0 {
+		return c.Workers
+	}
+	return runtime.GOMAXPROCS(0)
+}
+
+func (c *Config) queueSize() int {
+	if c.QueueSize > 0 {
+		return c.QueueSize
+	}
+	return defaultQueueSize
+}
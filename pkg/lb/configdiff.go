@@ -0,0 +1,182 @@
+package lb
+
+import (
+	"bytes"
+	"fmt"
+	"maps"
+	"slices"
+	"strings"
+
+	"github.com/fqzz2000/QUIC-LB-SHRIMP/pkg/quiclb"
+)
+
+// ConfigDiff is what ApplyConfig would change in a running load balancer's
+// routing, so a reload can be reviewed before it is applied. Rotation
+// changes that alter how a codepoint's CIDs decode break the connections
+// in flight under it.
+type ConfigDiff struct {
+	AddedBackends   []string
+	RemovedBackends []string
+	Rotations       []RotationDiff
+	// Old and new short-header DCID lengths, equal unless the first active
+	// config's CID length changes
+	OldDCIDLength, NewDCIDLength uint8
+}
+
+// RotationDiff is the change to the QUIC-LB config of one codepoint
+type RotationDiff struct {
+	Rotation uint8
+	Old, New quiclb.ConfigEntry // inactive when the config is added or removed
+	// Changes describes each setting that differs; keys are never shown
+	Changes []string
+	// Breaking reports whether CIDs of the old config stop decoding as
+	// they did: its config is removed, re-keyed or laid out differently
+	Breaking bool
+}
+
+// Empty reports whether the diff changes nothing
+func (d ConfigDiff) Empty() bool {
+	return len(d.AddedBackends) == 0 && len(d.RemovedBackends) == 0 && len(d.Rotations) == 0 &&
+		d.OldDCIDLength == d.NewDCIDLength
+}
+
+// String renders the diff a line per change: + added, - removed, ~ changed
+func (d ConfigDiff) String() string {
+	if d.Empty() {
+		return "no changes\n"
+	}
+	var b strings.Builder
+	for _, addr := range d.AddedBackends {
+		fmt.Fprintf(&b, "+ backend %s\n", addr)
+	}
+	for _, addr := range d.RemovedBackends {
+		fmt.Fprintf(&b, "- backend %s\n", addr)
+	}
+	for _, r := range d.Rotations {
+		mark := "~"
+		switch {
+		case !r.Old.Active():
+			mark = "+"
+		case !r.New.Active():
+			mark = "-"
+		}
+		fmt.Fprintf(&b, "%s rotation %d: %s", mark, r.Rotation, strings.Join(r.Changes, ", "))
+		if r.Breaking {
+			b.WriteString(" (breaks connections in flight)")
+		}
+		b.WriteString("\n")
+	}
+	if d.OldDCIDLength != d.NewDCIDLength {
+		fmt.Fprintf(&b, "~ short-header DCID length %d -> %d (breaks connections in flight)\n", d.OldDCIDLength, d.NewDCIDLength)
+	}
+	return b.String()
+}
+
+// DiffConfig reports what ApplyConfig(cfg) would change, without applying
+// it. It fails, as ApplyConfig would, when cfg is invalid.
+func (lb *LoadBalancer) DiffConfig(cfg Config) (ConfigDiff, error) {
+	next, err := newRoutingTable(&cfg)
+	if err != nil {
+		return ConfigDiff{}, err
+	}
+	cur := lb.routes()
+	d := ConfigDiff{
+		OldDCIDLength: cur.packetProcessor.DCIDLength,
+		NewDCIDLength: next.packetProcessor.DCIDLength,
+	}
+	if cur.packetProcessor.SelfEncodedCIDLength && next.packetProcessor.SelfEncodedCIDLength {
+		d.OldDCIDLength, d.NewDCIDLength = 0, 0
+	}
+	curAddrs, nextAddrs := backendAddrs(cur.backends), backendAddrs(next.backends)
+	for _, addr := range nextAddrs {
+		if !slices.Contains(curAddrs, addr) {
+			d.AddedBackends = append(d.AddedBackends, addr)
+		}
+	}
+	for _, addr := range curAddrs {
+		if !slices.Contains(nextAddrs, addr) {
+			d.RemovedBackends = append(d.RemovedBackends, addr)
+		}
+	}
+	curEntries, nextEntries := cur.codecEntries(), next.codecEntries()
+	for i := range curEntries {
+		if r := diffRotation(uint8(i), curEntries[i], nextEntries[i]); len(r.Changes) > 0 {
+			d.Rotations = append(d.Rotations, r)
+		}
+	}
+	return d, nil
+}
+
+// backendAddrs returns the addresses of the backends not removed
+func backendAddrs(backends []BackendConfig) []string {
+	var addrs []string
+	for _, b := range backends {
+		if !b.removed() {
+			addrs = append(addrs, b.Address)
+		}
+	}
+	return addrs
+}
+
+// diffRotation compares the old and new configs of one codepoint
+func diffRotation(rotation uint8, old, next quiclb.ConfigEntry) RotationDiff {
+	r := RotationDiff{Rotation: rotation, Old: old, New: next}
+	switch {
+	case !old.Active() && !next.Active():
+		return r
+	case !old.Active():
+		r.Changes = append(r.Changes, fmt.Sprintf("%s, server ID length %d, nonce length %d, CID length %d",
+			next.Algorithm, next.ServerIDLength, next.NonceLength, next.CIDLength()))
+		return r
+	case !next.Active():
+		r.Changes = append(r.Changes, "config removed")
+		r.Breaking = true
+		return r
+	}
+	change := func(breaking bool, format string, args ...any) {
+		r.Changes = append(r.Changes, fmt.Sprintf(format, args...))
+		r.Breaking = r.Breaking || breaking
+	}
+	if old.Algorithm != next.Algorithm {
+		change(true, "algorithm %s -> %s", old.Algorithm, next.Algorithm)
+	}
+	if !bytes.Equal(old.Key, next.Key) {
+		change(true, "key changed")
+	}
+	// a keyed config's CIDs decode while their key ID keeps its key
+	for _, id := range slices.Sorted(maps.Keys(old.Keys)) {
+		if key, ok := next.Keys[id]; !ok {
+			change(true, "key ID %d removed", id)
+		} else if !bytes.Equal(key, old.Keys[id]) {
+			change(true, "key ID %d changed", id)
+		}
+	}
+	for _, id := range slices.Sorted(maps.Keys(next.Keys)) {
+		if _, ok := old.Keys[id]; !ok {
+			change(false, "key ID %d added", id)
+		}
+	}
+	if old.ServerIDLength != next.ServerIDLength {
+		change(true, "server ID length %d -> %d", old.ServerIDLength, next.ServerIDLength)
+	}
+	if old.NonceLength != next.NonceLength {
+		change(true, "nonce length %d -> %d", old.NonceLength, next.NonceLength)
+	}
+	if old.TagLength != next.TagLength {
+		change(true, "tag length %d -> %d", old.TagLength, next.TagLength)
+	}
+	if old.CIDLength() != next.CIDLength() {
+		change(true, "CID length %d -> %d", old.CIDLength(), next.CIDLength())
+	}
+	if old.ServerIDLengthBits != next.ServerIDLengthBits || old.SelfEncodedLength != next.SelfEncodedLength ||
+		old.KeyIDBits != next.KeyIDBits || old.KeyIDShift != next.KeyIDShift {
+		change(true, "first-octet layout changed")
+	}
+	if old.EncodeKeyID != next.EncodeKeyID {
+		change(false, "encode key ID %d -> %d", old.EncodeKeyID, next.EncodeKeyID)
+	}
+	if old.AllowGreasedFixedBit != next.AllowGreasedFixedBit {
+		change(false, "greased fixed bit allowed %v -> %v", old.AllowGreasedFixedBit, next.AllowGreasedFixedBit)
+	}
+	return r
+}
@@ -0,0 +1,73 @@
+package lb
+
+import (
+	"testing"
+
+	"github.com/fqzz2000/QUIC-LB-SHRIMP/pkg/quiclb"
+)
+
+func TestDiffConfig(t *testing.T) {
+	key := make([]byte, quiclb.KeyLength)
+	stream := quiclb.ConfigEntry{Algorithm: quiclb.StreamCipher, ServerIDLength: 1, NonceLength: 8, Key: key}
+	running := Config{
+		Backends: StaticBackends("192.0.2.1:443", "192.0.2.2:443", "192.0.2.3:443"),
+		QUICLB:   [quiclb.NumConfigs]quiclb.ConfigEntry{{Algorithm: quiclb.Plaintext, ServerIDLength: 1, NonceLength: 8}, stream},
+	}
+	lb, err := NewLoadBalancer(running)
+	if err != nil {
+		t.Fatalf("NewLoadBalancer() error = %v", err)
+	}
+	rekeyed := append([]byte(nil), key...)
+	rekeyed[0] = 1
+
+	tests := []struct {
+		name string
+		cfg  func(cfg *Config)
+		want string
+	}{
+		{name: "Unchanged", cfg: func(*Config) {}, want: "no changes\n"},
+		{
+			name: "Representative",
+			cfg: func(cfg *Config) {
+				cfg.Backends = StaticBackends("192.0.2.2:443", "192.0.2.3:443", "192.0.2.4:443")
+				cfg.QUICLB[0].ServerIDLength = 2
+				cfg.QUICLB[1].Key = rekeyed
+				cfg.QUICLB[2] = quiclb.ConfigEntry{Algorithm: quiclb.BlockCipher, ServerIDLength: 2, NonceLength: 14, Key: key}
+			},
+			want: "+ backend 192.0.2.4:443\n" +
+				"- backend 192.0.2.1:443\n" +
+				"~ rotation 0: server ID length 1 -> 2, CID length 10 -> 11 (breaks connections in flight)\n" +
+				"~ rotation 1: key changed (breaks connections in flight)\n" +
+				"+ rotation 2: block-cipher, server ID length 2, nonce length 14, CID length 17\n" +
+				"~ short-header DCID length 10 -> 11 (breaks connections in flight)\n",
+		},
+		{
+			name: "Config Removed",
+			cfg: func(cfg *Config) {
+				cfg.QUICLB[0] = quiclb.ConfigEntry{}
+			},
+			want: "- rotation 0: config removed (breaks connections in flight)\n",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := running
+			tt.cfg(&cfg)
+			before := lb.routes()
+			d, err := lb.DiffConfig(cfg)
+			if err != nil {
+				t.Fatalf("DiffConfig() error = %v", err)
+			}
+			if got := d.String(); got != tt.want {
+				t.Errorf("DiffConfig() =\n%s\nwant\n%s", got, tt.want)
+			}
+			if lb.routes() != before {
+				t.Errorf("DiffConfig() replaced the routing table")
+			}
+		})
+	}
+
+	if _, err := lb.DiffConfig(Config{}); err == nil {
+		t.Errorf("DiffConfig(no backends) error = nil, want an error")
+	}
+}
@@ -0,0 +1,129 @@
+package lb
+
+import (
+	"errors"
+	"log"
+	"net"
+	"os"
+)
+
+// The control channel (Config.ControlAddr) lets backends tell the LB that a
+// connection has closed, so its flow is evicted at once instead of lingering
+// for the idle timeout: the LB cannot read the encrypted CONNECTION_CLOSE
+// itself. Each control datagram is one message, an opcode byte followed by
+// its operand:
+//
+//	0x01 CID	connection closed; CID is any connection ID of it, the
+//		remainder of the datagram
+//	0x02 load address	the backend's load; see loadreport.go
+//	0x04 rotation length serverID address	the server ID the backend
+//		encodes; see serveridverify.go
+//
+// The LB sends backends 0x03 for flows it evicts; see evictnotice.go.
+// Unknown opcodes and CIDs matching no flow are counted and ignored; no
+// message is answered. Over UDP a close notification is only honored from the IP
+// of the backend the flow is routed to, so a client cannot close another's
+// flow by spoofing; a Unix datagram socket is guarded by its file mode.
+
+// controlClosed is the opcode of a connection-closed notification
+const controlClosed = 0x01
+
+// errControlMessage is returned for a control datagram that cannot be acted on
+var errControlMessage = errors.New("invalid control message")
+
+// openControl binds the control socket, if configured. Callers must hold lb.mu.
+func (lb *LoadBalancer) openControl() error {
+	if lb.controlAddr == "" {
+		return nil
+	}
+	conn, err := net.ListenPacket(lb.controlNet, lb.controlAddr)
+	if err != nil {
+		return err
+	}
+	lb.control = conn
+	return nil
+}
+
+// closeControl closes the control socket, removing a Unix socket's file.
+// Callers must hold lb.mu.
+func (lb *LoadBalancer) closeControl() {
+	if lb.control == nil {
+		return
+	}
+	lb.control.Close()
+	if lb.controlNet == "unixgram" {
+		os.Remove(lb.controlAddr)
+	}
+	lb.control = nil
+}
+
+// ControlAddr returns the bound address of the control socket, or nil if it
+// is not open
+func (lb *LoadBalancer) ControlAddr() net.Addr {
+	lb.mu.RLock()
+	defer lb.mu.RUnlock()
+	if lb.control == nil {
+		return nil
+	}
+	return lb.control.LocalAddr()
+}
+
+// controlLoop reads control messages until conn is closed
+func (lb *LoadBalancer) controlLoop(conn net.PacketConn) {
+	buf := make([]byte, maxPacketSize)
+	for {
+		n, src, err := conn.ReadFrom(buf)
+		if err != nil {
+			return
+		}
+		if err := lb.handleControl(buf[:n], src); err != nil {
+			lb.stats.controlIgnored.Add(1)
+			if lb.debug {
+				log.Printf("Control message from %v ignored: %v", src, err)
+			}
+		}
+	}
+}
+
+// handleControl acts on one control message from src
+func (lb *LoadBalancer) handleControl(msg []byte, src net.Addr) error {
+	if len(msg) < 2 {
+		return errControlMessage
+	}
+	switch msg[0] {
+	case controlClosed:
+		return lb.controlClose(msg[1:], src)
+	case controlLoad:
+		return lb.controlLoadReport(msg[1:], src)
+	case controlServerID:
+		return lb.controlServerIDReport(msg[1:], src)
+	}
+	return errControlMessage
+}
+
+// controlClose evicts the flow of a connection-closed notification, the
+// operand of a controlClosed message from src
+func (lb *LoadBalancer) controlClose(cid []byte, src net.Addr) error {
+	flow := lb.sessions.lookupCID(cid)
+	if flow == nil {
+		return errUnknownCID
+	}
+	if !fromBackend(flow, src) {
+		return errControlMessage
+	}
+	lb.closeFlow(flow)
+	lb.stats.closeNotified.Add(1)
+	return nil
+}
+
+// fromBackend reports whether a UDP control message from src comes from the
+// host of the flow's backend; one for a flow not reached over UDP is not.
+// Messages over other networks are not checked.
+func fromBackend(flow *Flow, src net.Addr) bool {
+	from, ok := src.(*net.UDPAddr)
+	if !ok {
+		return true
+	}
+	backend, ok := flow.conn.RemoteAddr().(*net.UDPAddr)
+	return ok && backend.IP.Equal(from.IP)
+}
@@ -0,0 +1,82 @@
+package lb
+
+import (
+	"bytes"
+	"errors"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/fqzz2000/QUIC-LB-SHRIMP/pkg/packet"
+)
+
+func TestCloseNotificationEvictsFlow(t *testing.T) {
+	lb := startTestLB(t, Config{
+		Backends:    StaticBackends(startEchoBackend(t)),
+		ControlAddr: "127.0.0.1:0",
+	})
+	client := newTestClient(t)
+	dcid := []byte{0x01, 0x02, 0x03, 0x04, 0x05, 0x06, 0x07, 0x08}
+	pkt := longHeaderPacket(packet.Initial, dcid, 1200)
+	client.WriteTo(pkt, lb.Addr())
+	if got := readWithin(t, client, time.Second); !bytes.Equal(got, pkt) {
+		t.Fatalf("echo = %d bytes, want %d", len(got), len(pkt))
+	}
+
+	// the backend, on loopback like the control socket, reports the close
+	notifier := newTestClient(t)
+	notifier.WriteTo(append([]byte{controlClosed}, dcid...), lb.ControlAddr())
+	deadline := time.Now().Add(time.Second)
+	for lb.sessions.lookupCID(dcid) != nil {
+		if time.Now().After(deadline) {
+			t.Fatalf("flow still tracked after a close notification")
+		}
+		time.Sleep(time.Millisecond)
+	}
+	if got := lb.Stats().CloseNotified; got != 1 {
+		t.Errorf("CloseNotified = %d, want 1", got)
+	}
+}
+
+func TestHandleControl(t *testing.T) {
+	backend := &net.UDPAddr{IP: net.IPv4(192, 0, 2, 100), Port: 443}
+	cid := []byte{0x01, 0x02, 0x03, 0x04}
+	tests := []struct {
+		name    string
+		msg     []byte
+		src     net.Addr
+		wantErr error
+	}{
+		{name: "From Backend", msg: append([]byte{controlClosed}, cid...), src: &net.UDPAddr{IP: backend.IP, Port: 9999}},
+		{name: "From Elsewhere", msg: append([]byte{controlClosed}, cid...), src: testAddr(1), wantErr: errControlMessage},
+		{name: "Unknown CID", msg: []byte{controlClosed, 0xee}, src: backend, wantErr: errUnknownCID},
+		{name: "Unknown Opcode", msg: append([]byte{0x7f}, cid...), src: backend, wantErr: errControlMessage},
+		{name: "No CID", msg: []byte{controlClosed}, src: backend, wantErr: errControlMessage},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			lb, err := NewLoadBalancer(Config{Backends: StaticBackends(backend.String())})
+			if err != nil {
+				t.Fatalf("NewLoadBalancer() error = %v", err)
+			}
+			flow := &Flow{Backend: backend.String(), conn: remoteConn{remote: backend}}
+			lb.sessions.remember(flow, cid, testAddr(1))
+
+			if err := lb.handleControl(tt.msg, tt.src); !errors.Is(err, tt.wantErr) {
+				t.Fatalf("handleControl() error = %v, want %v", err, tt.wantErr)
+			}
+			if evicted := lb.sessions.lookupCID(cid) == nil; evicted != (tt.wantErr == nil) {
+				t.Errorf("flow evicted = %v, want %v", evicted, tt.wantErr == nil)
+			}
+		})
+	}
+}
+
+// remoteConn is a backend connection reporting a remote address and
+// otherwise doing nothing
+type remoteConn struct {
+	nopConn
+	remote net.Addr
+}
+
+func (c remoteConn) RemoteAddr() net.Addr { return c.remote }
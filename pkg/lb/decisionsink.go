@@ -0,0 +1,114 @@
+package lb
+
+import (
+	"time"
+)
+
+// defaultDecisionQueueSize is how many decisions wait for a slow sink
+// unless configured
+const defaultDecisionQueueSize = 4096
+
+// A DecisionSink (Config.DecisionSink) mirrors every routing decision to an
+// external consumer, a message stream feeding real-time analytics say. The
+// sink is fed off the packet path: workers put each decision on a bounded
+// queue without blocking and one goroutine per run hands them to the sink in
+// order. When the sink falls behind and the queue fills, the oldest queued
+// decision is dropped and counted so forwarding never waits on it. CIDs are
+// passed as their unseeded ring hash, as in the event log, never raw.
+
+// Decision is one packet's routing decision as a DecisionSink sees it
+type Decision struct {
+	Time    time.Time
+	CIDHash uint64 // zero when the packet had no CID
+	Backend string // empty when no backend was chosen
+	Route   Route
+	// Outcome is "forwarded" or the reason the packet was dropped, as in
+	// the drop metrics
+	Outcome string
+}
+
+// DecisionSink receives routing decisions. Record is called from a single
+// goroutine, never from the packet path; a sink that blocks only costs the
+// decisions dropped while it does.
+type DecisionSink interface {
+	Record(Decision)
+}
+
+// NopDecisionSink discards every decision
+type NopDecisionSink struct{}
+
+// Record implements DecisionSink
+func (NopDecisionSink) Record(Decision) {}
+
+// sinkQueue carries decisions from the workers to the sink, nil when no
+// sink is configured
+type sinkQueue struct {
+	sink    DecisionSink
+	pending chan Decision
+}
+
+// newSinkQueue returns a queue of size decisions, defaulting for zero or
+// less, or nil for no sink
+func newSinkQueue(sink DecisionSink, size int) *sinkQueue {
+	if sink == nil || sink == (NopDecisionSink{}) {
+		return nil
+	}
+	if size <= 0 {
+		size = defaultDecisionQueueSize
+	}
+	return &sinkQueue{sink: sink, pending: make(chan Decision, size)}
+}
+
+// push queues d for the sink, dropping the oldest queued decisions to make
+// room, and reports how many were dropped
+func (q *sinkQueue) push(d Decision) (dropped int) {
+	for {
+		select {
+		case q.pending <- d:
+			return dropped
+		default:
+		}
+		select {
+		case <-q.pending:
+			dropped++
+		default:
+		}
+	}
+}
+
+// deliver hands queued decisions to the sink until stop is closed, then
+// delivers whatever is still queued
+func (q *sinkQueue) deliver(stop <-chan struct{}) {
+	for {
+		select {
+		case d := <-q.pending:
+			q.sink.Record(d)
+		case <-stop:
+			for {
+				select {
+				case d := <-q.pending:
+					q.sink.Record(d)
+				default:
+					return
+				}
+			}
+		}
+	}
+}
+
+// recordDecision queues the routing of one packet for the decision sink
+func (lb *LoadBalancer) recordDecision(now time.Time, res *DecodeResult, err error) {
+	if lb.decisions == nil {
+		return
+	}
+	d := Decision{Time: now, Backend: res.Backend, Route: res.Route, Outcome: "forwarded"}
+	if len(res.CID) > 0 {
+		d.CIDHash = hashKey(0, res.CID)
+	}
+	if err != nil {
+		d.Outcome = dropReasonNames[dropReasonFor(err)]
+	}
+	if n := lb.decisions.push(d); n > 0 {
+		lb.stats.decisionDrops.Add(uint64(n))
+	}
+}
@@ -0,0 +1,121 @@
+//go:build nats
+
+package lb
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// NATSDecisionSink publishes each decision as a JSON message on a NATS
+// subject, speaking the plain-text NATS client protocol over TCP so no
+// client library is needed. It is built with the nats build tag. Messages
+// are published at most once: a decision that fails to send is logged and
+// lost, and the sink does not reconnect.
+type NATSDecisionSink struct {
+	subject string
+	conn    net.Conn
+
+	mu     sync.Mutex // guards w, shared with the PONGs answering server PINGs
+	w      *bufio.Writer
+	failed bool // a publish failed, which was logged
+}
+
+// natsDialTimeout bounds connecting and reading the server's INFO
+const natsDialTimeout = 5 * time.Second
+
+// DialNATSDecisionSink connects to the NATS server at addr and returns a
+// sink publishing to subject
+func DialNATSDecisionSink(addr, subject string) (*NATSDecisionSink, error) {
+	if subject == "" || strings.ContainsAny(subject, " \t\r\n") {
+		return nil, fmt.Errorf("invalid NATS subject %q", subject)
+	}
+	conn, err := net.DialTimeout("tcp", addr, natsDialTimeout)
+	if err != nil {
+		return nil, err
+	}
+	r := bufio.NewReader(conn)
+	conn.SetReadDeadline(time.Now().Add(natsDialTimeout))
+	info, err := r.ReadString('\n')
+	if err != nil || !strings.HasPrefix(info, "INFO ") {
+		conn.Close()
+		return nil, fmt.Errorf("NATS server %s: no INFO: %q, %v", addr, info, err)
+	}
+	conn.SetReadDeadline(time.Time{})
+	s := &NATSDecisionSink{subject: subject, conn: conn, w: bufio.NewWriter(conn)}
+	if err := s.write("CONNECT {\"verbose\":false,\"pedantic\":false}\r\n"); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	go s.readLoop(r)
+	return s, nil
+}
+
+// readLoop answers the server's keepalive PINGs until the connection closes
+func (s *NATSDecisionSink) readLoop(r *bufio.Reader) {
+	for {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			return
+		}
+		switch {
+		case strings.HasPrefix(line, "PING"):
+			s.write("PONG\r\n")
+		case strings.HasPrefix(line, "-ERR"):
+			log.Printf("NATS decision sink: server error: %s", strings.TrimSpace(line))
+		}
+	}
+}
+
+// write sends one protocol line
+func (s *NATSDecisionSink) write(line string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.w.WriteString(line)
+	return s.w.Flush()
+}
+
+// natsDecision is a decision's message body
+type natsDecision struct {
+	Time    time.Time `json:"time"`
+	CIDHash string    `json:"cid_hash,omitempty"`
+	Backend string    `json:"backend,omitempty"`
+	Route   Route     `json:"route"`
+	Outcome string    `json:"outcome"`
+}
+
+// Record implements DecisionSink
+func (s *NATSDecisionSink) Record(d Decision) {
+	msg := natsDecision{Time: d.Time.UTC(), Backend: d.Backend, Route: d.Route, Outcome: d.Outcome}
+	if d.CIDHash != 0 {
+		msg.CIDHash = fmt.Sprintf("%016x", d.CIDHash)
+	}
+	body, err := json.Marshal(msg)
+	if err != nil {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.failed {
+		return
+	}
+	s.w.WriteString("PUB " + s.subject + " " + strconv.Itoa(len(body)) + "\r\n")
+	s.w.Write(body)
+	s.w.WriteString("\r\n")
+	if err := s.w.Flush(); err != nil && !s.failed {
+		s.failed = true
+		log.Printf("NATS decision sink: publishing: %v; dropping decisions", err)
+	}
+}
+
+// Close closes the connection to the server
+func (s *NATSDecisionSink) Close() error {
+	return s.conn.Close()
+}
@@ -0,0 +1,73 @@
+package lb
+
+import (
+	"testing"
+	"time"
+
+	"github.com/fqzz2000/QUIC-LB-SHRIMP/pkg/packet"
+)
+
+// chanSink delivers decisions on a channel, blocking while it is full
+type chanSink chan Decision
+
+func (s chanSink) Record(d Decision) { s <- d }
+
+func TestDecisionSinkDelivers(t *testing.T) {
+	sink := make(chanSink, 2)
+	fwd := memForwarder{opened: make(chan *memConn, 1)}
+	lb, _ := newMemLB(t, Config{
+		Backends:     []BackendConfig{{Address: "192.0.2.100:443", Forwarder: fwd}},
+		DecisionSink: sink,
+	})
+	stop := make(chan struct{})
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		lb.decisions.deliver(stop)
+	}()
+	t.Cleanup(func() {
+		close(stop)
+		<-done
+	})
+
+	dcid := []byte{0x00, 0x00, 0xa1, 0xa2, 0xa3, 0xa4, 0xa5, 0xa6}
+	lb.process(inbound{pkt: longHeaderPacket(packet.Initial, dcid, 1200), src: testAddr(1)})
+	expect(t, fwd.opened)
+	lb.process(inbound{pkt: []byte{0xc0, 0x00}, src: testAddr(2)})
+
+	want := []Decision{
+		{CIDHash: hashKey(0, dcid), Backend: "192.0.2.100:443", Route: RouteCID, Outcome: "forwarded"},
+		{Route: RouteNone, Outcome: "parse_error"},
+	}
+	for i, w := range want {
+		d := expect(t, sink)
+		if d.Time.IsZero() {
+			t.Errorf("decision %d has no time", i)
+		}
+		d.Time = time.Time{}
+		if d != w {
+			t.Errorf("decision %d = %+v, want %+v", i, d, w)
+		}
+	}
+}
+
+func TestDecisionSinkDropsOldest(t *testing.T) {
+	sink := make(chanSink)
+	lb, _ := newMemLB(t, Config{Backends: StaticBackends("192.0.2.100:443"), DecisionSink: sink, DecisionQueueSize: 2})
+	// with nothing delivering, recording never blocks and keeps the newest
+	for _, backend := range []string{"a", "b", "c", "d"} {
+		lb.recordDecision(time.Time{}, &DecodeResult{Backend: backend}, nil)
+	}
+	if got := lb.Stats().DecisionDrops; got != 2 {
+		t.Errorf("DecisionDrops = %d, want 2", got)
+	}
+	for _, want := range []string{"c", "d"} {
+		if d := <-lb.decisions.pending; d.Backend != want {
+			t.Errorf("queued decision for %q, want %q", d.Backend, want)
+		}
+	}
+
+	if newSinkQueue(NopDecisionSink{}, 0) != nil || newSinkQueue(nil, 0) != nil {
+		t.Error("newSinkQueue() queued for a no-op sink")
+	}
+}
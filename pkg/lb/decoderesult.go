@@ -0,0 +1,130 @@
+package lb
+
+import (
+	"net"
+
+	"github.com/fqzz2000/QUIC-LB-SHRIMP/pkg/packet"
+	"github.com/fqzz2000/QUIC-LB-SHRIMP/pkg/quiclb"
+)
+
+// Route names what chose a packet's backend
+type Route uint8
+
+const (
+	// RouteNone means no backend was chosen
+	RouteNone Route = iota
+	// RouteFlow is an existing flow's backend
+	RouteFlow
+	// RouteOverride is a routing override
+	RouteOverride
+	// RouteCanary is the canary's share of new connections
+	RouteCanary
+	// RouteStrategy is the configured Strategy
+	RouteStrategy
+	// RouteCID is the server ID the CID decoded to
+	RouteCID
+	// RouteNewFlowPool is the pool of backends taking new flows
+	RouteNewFlowPool
+	// RouteFallback is the fallback for CIDs that do not route
+	RouteFallback
+	// RouteToken is the server ID in an Initial's token
+	RouteToken
+	// RouteCatchAll is the catch-all for server IDs with no backend
+	RouteCatchAll
+)
+
+// routeNames are the labels routes are logged and reported with
+var routeNames = [...]string{
+	RouteNone:        "none",
+	RouteFlow:        "flow",
+	RouteOverride:    "override",
+	RouteCanary:      "canary",
+	RouteStrategy:    "strategy",
+	RouteCID:         "cid",
+	RouteNewFlowPool: "new_flow_pool",
+	RouteFallback:    "fallback",
+	RouteToken:       "token",
+	RouteCatchAll:    "catch_all",
+}
+
+func (r Route) String() string {
+	if int(r) < len(routeNames) {
+		return routeNames[r]
+	}
+	return "unknown"
+}
+
+// MarshalText reports the route by name in JSON
+func (r Route) MarshalText() ([]byte, error) {
+	return []byte(r.String()), nil
+}
+
+// DecodeResult is what routing learned about one packet: its header, what
+// its CID decoded to, and the backend chosen with what chose it. The
+// pipeline fills it once per packet, and logging, metrics and the admin API
+// read it rather than parsing or decoding again. Byte slices may alias the
+// packet.
+type DecodeResult struct {
+	HeaderForm uint8 // 1 for a long header, 0 for a short one
+	PacketType packet.PacketType
+	Version    uint32 // zero for short headers
+	CID        []byte // the DCID routing uses
+	// Decoded reports whether the CID decoded with a QUIC-LB config;
+	// Rotation, ServerID and Nonce are set only then. The single-plaintext
+	// fast path reads no nonce.
+	Decoded  bool
+	Rotation uint8
+	ServerID []byte
+	Nonce    []byte
+	Backend  string
+	Route    Route
+
+	// token is the Initial's token when a TokenDecoder routes on it
+	token []byte
+}
+
+// newDecodeResult starts the result of a parsed packet
+func newDecodeResult(header packet.QuicHeader) DecodeResult {
+	var res DecodeResult
+	res.HeaderForm, _ = header.GetHeaderForm()
+	res.PacketType, _ = header.GetPacketType()
+	if lh, ok := header.(*packet.LongHeader); ok {
+		res.Version = lh.Version
+	}
+	res.CID, _ = packet.RoutingCID(header, packet.ClientToServer)
+	return res
+}
+
+// setDecoded records what the CID decoded to
+func (res *DecodeResult) setDecoded(d *quiclb.DecodedCID) {
+	res.Decoded = true
+	res.Rotation, res.ServerID, res.Nonce = d.Rotation, d.ServerID, d.Nonce
+}
+
+// chose records the backend picked and what picked it
+func (res *DecodeResult) chose(backend BackendConfig, route Route) {
+	res.Backend, res.Route = backend.Address, route
+}
+
+// DecodePacket runs a packet through the routing handlePacket does, without
+// forwarding it or opening a flow, and reports everything it decided. A
+// packet of an existing flow reports its flow's backend. Routing counters
+// move as for a forwarded packet.
+func (lb *LoadBalancer) DecodePacket(pkt []byte, src net.Addr) (*DecodeResult, error) {
+	header, err := lb.parseHeader(pkt, lb.routes().packetProcessor)
+	if err != nil {
+		return nil, err
+	}
+	res := newDecodeResult(header)
+	if flow := lb.sessions.lookup(res.CID, src); flow != nil {
+		res.Backend, res.Route = flow.Backend, RouteFlow
+		return &res, nil
+	}
+	if backend, ok := lb.canaryBackend(header, pkt); ok {
+		res.chose(backend, RouteCanary)
+		return &res, nil
+	}
+	res.token = lb.initialToken(header, pkt)
+	_, err = lb.selectRoute(&res, src, lb.routeMissFor(res.HeaderForm, res.PacketType))
+	return &res, err
+}
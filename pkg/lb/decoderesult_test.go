@@ -0,0 +1,99 @@
+package lb
+
+import (
+	"bytes"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/fqzz2000/QUIC-LB-SHRIMP/pkg/packet"
+)
+
+func TestDecodePacket(t *testing.T) {
+	lb, err := InitLoadBalancer("127.0.0.1:0", []string{"backend0", "backend1", "backend2"})
+	if err != nil {
+		t.Fatalf("InitLoadBalancer() error = %v", err)
+	}
+	nonce := []byte{0x10, 0x11, 0x12, 0x13, 0x14, 0x15}
+	cid, err := lb.routes().codec.Encode(0, []byte{0x02}, nonce)
+	if err != nil {
+		t.Fatalf("Encode() error = %v", err)
+	}
+	short := append([]byte{0x40}, cid...)
+
+	res, err := lb.DecodePacket(short, testAddr(1))
+	if err != nil {
+		t.Fatalf("DecodePacket() error = %v", err)
+	}
+	want := DecodeResult{
+		HeaderForm: 0,
+		PacketType: packet.OneRTT,
+		CID:        cid,
+		Decoded:    true,
+		Rotation:   0,
+		ServerID:   []byte{0x02},
+		Backend:    "backend2",
+		Route:      RouteCID,
+	}
+	// the single plaintext config takes the fast path, which reads no nonce
+	if res.HeaderForm != want.HeaderForm || res.PacketType != want.PacketType || res.Version != 0 ||
+		!bytes.Equal(res.CID, want.CID) || res.Decoded != want.Decoded || res.Rotation != want.Rotation ||
+		!bytes.Equal(res.ServerID, want.ServerID) || res.Backend != want.Backend || res.Route != want.Route {
+		t.Errorf("DecodePacket(short header) = %+v, want %+v", res, want)
+	}
+
+	// an Initial whose client-chosen DCID does not route falls back
+	dcid := []byte{0xc0, 0x01, 0x02, 0x03, 0x04, 0x05, 0x06, 0x07}
+	initial := longHeaderPacket(packet.Initial, dcid, 1200)
+	res, err = lb.DecodePacket(initial, testAddr(1))
+	if err != nil {
+		t.Fatalf("DecodePacket(Initial) error = %v", err)
+	}
+	if res.HeaderForm != 1 || res.PacketType != packet.Initial || res.Version != packet.Version1 ||
+		!bytes.Equal(res.CID, dcid) || res.Decoded || res.Route != RouteFallback || res.Backend == "" {
+		t.Errorf("DecodePacket(Initial) = %+v, want an undecoded v1 Initial routed by fallback", res)
+	}
+
+	// a packet of an open flow reports the flow's backend
+	lb.sessions.remember(&Flow{Backend: "backend1", conn: nopConn{}}, cid, testAddr(1))
+	res, err = lb.DecodePacket(short, testAddr(1))
+	if err != nil || res.Backend != "backend1" || res.Route != RouteFlow {
+		t.Errorf("DecodePacket(open flow) = %s by %s, %v, want backend1 by flow", res.Backend, res.Route, err)
+	}
+}
+
+func TestHandleDecodePacket(t *testing.T) {
+	lb, err := InitLoadBalancer("127.0.0.1:0", []string{"backend0", "backend1", "backend2"})
+	if err != nil {
+		t.Fatalf("InitLoadBalancer() error = %v", err)
+	}
+	cid, _ := lb.routes().codec.Encode(0, []byte{0x01}, nil)
+	pkt := longHeaderPacket(packet.HandShake, cid, 64)
+
+	body := `{"packet":"` + hex.EncodeToString(pkt) + `","source":"192.0.2.1:4433"}`
+	rec := httptest.NewRecorder()
+	lb.adminHandler().ServeHTTP(rec, httptest.NewRequest(http.MethodPost, "/decode", strings.NewReader(body)))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("status = %d, want %d: %s", rec.Code, http.StatusOK, rec.Body)
+	}
+	var resp map[string]any
+	if err := json.NewDecoder(rec.Body).Decode(&resp); err != nil {
+		t.Fatalf("decoding response: %v", err)
+	}
+	for field, want := range map[string]any{
+		"header":      "long",
+		"packet_type": "handshake",
+		"version":     float64(packet.Version1),
+		"cid":         hex.EncodeToString(cid),
+		"server_id":   "01",
+		"backend":     "backend1",
+		"route":       "cid",
+	} {
+		if resp[field] != want {
+			t.Errorf("%s = %v, want %v", field, resp[field], want)
+		}
+	}
+}
@@ -0,0 +1,7 @@
+//go:build !nodecodetiming
+
+package lb
+
+// decodeTiming enables the per-algorithm decode latency histogram; build with
+// -tags nodecodetiming to compile the clock reads out of the routing path
+const decodeTiming = true
@@ -0,0 +1,5 @@
+//go:build nodecodetiming
+
+package lb
+
+const decodeTiming = false
@@ -0,0 +1,114 @@
+package lb
+
+import (
+	"fmt"
+	"log"
+	"math/rand/v2"
+	"net"
+	"strings"
+
+	"github.com/fqzz2000/QUIC-LB-SHRIMP/pkg/packet"
+)
+
+// decodeTracer logs how a sample of packets decode, step by step, for
+// working out why a CID misroutes. It exists only in debug mode with
+// Config.DecodeTraceRate set; otherwise it is nil and costs one check per
+// packet.
+type decodeTracer struct {
+	rate float64
+	logf func(format string, args ...any)
+}
+
+// newDecodeTracer returns a tracer, or nil unless debug and rate are set
+func newDecodeTracer(debug bool, rate float64) *decodeTracer {
+	if !debug || rate <= 0 {
+		return nil
+	}
+	return &decodeTracer{rate: rate, logf: log.Printf}
+}
+
+// sampled reports whether the next packet is traced
+func (t *decodeTracer) sampled() bool {
+	return t != nil && rand.Float64() < t.rate
+}
+
+// decodeTrace collects the steps of one traced packet
+type decodeTrace struct {
+	src   net.Addr
+	cid   []byte
+	flow  *Flow
+	steps []string
+}
+
+func (d *decodeTrace) step(format string, args ...any) {
+	d.steps = append(d.steps, fmt.Sprintf(format, args...))
+}
+
+// traceDecode redoes the decode of pkt's DCID, as it arrived on ln,
+// recording each step. It runs before handlePacket, which may rewrite pkt,
+// and changes no state.
+func (lb *LoadBalancer) traceDecode(pkt []byte, src net.Addr, ln *clientListener) *decodeTrace {
+	d := &decodeTrace{src: src}
+	if len(pkt) == 0 {
+		d.step("empty datagram")
+		return d
+	}
+	d.step("first byte %08b", pkt[0])
+	if pkt[0]&0x80 != 0 {
+		d.step("long header")
+	} else {
+		d.step("short header")
+	}
+	rt := lb.routes()
+	header, err := lb.processor(ln).ParsePacket(pkt)
+	if err != nil {
+		d.step("parse failed: %v", err)
+		return d
+	}
+	cid, _ := packet.RoutingCID(header, packet.ClientToServer)
+	d.cid = append([]byte(nil), cid...)
+	d.flow = lb.sessions.lookup(cid, src)
+	d.step("DCID %x", cid)
+	if len(cid) == 0 {
+		return d
+	}
+	rotation := cid[0] >> 6
+	cfg, active := rt.codec.Config(rotation)
+	if !active {
+		d.step("config rotation %d not active", rotation)
+		return d
+	}
+	d.step("config rotation %d, %s", rotation, cfg.Algorithm)
+	if end := 1 + cfg.ServerIDLength; len(cid) >= end {
+		d.step("raw server ID bytes %x", cid[1:end])
+	}
+	decoded, err := rt.codec.DecodeWith(rotation, cid)
+	if err != nil {
+		d.step("decode failed: %v", err)
+		return d
+	}
+	d.step("server ID %x, nonce %x", decoded.ServerID, decoded.Nonce)
+	backend, err := rt.backendForServerID(decoded.Rotation, decoded.ServerID)
+	if err != nil {
+		d.step("no backend: %v", err)
+		return d
+	}
+	d.step("resolved backend %s", backend.Address)
+	return d
+}
+
+// finishTrace records what handlePacket decided, err being its result, and logs
+// the trace
+func (lb *LoadBalancer) finishTrace(d *decodeTrace, err error) {
+	switch flow := lb.sessions.lookup(d.cid, d.src); {
+	case err != nil:
+		d.step("dropped: %v", err)
+	case flow == nil:
+		d.step("forwarded, flow not indexed")
+	case flow == d.flow:
+		d.step("forwarded to %s on its existing flow", flow.Backend)
+	default:
+		d.step("forwarded to %s on a new flow", flow.Backend)
+	}
+	lb.trace.logf("Decode trace for packet from %s: %s", d.src, strings.Join(d.steps, "; "))
+}
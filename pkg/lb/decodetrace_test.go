@@ -0,0 +1,53 @@
+package lb
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/fqzz2000/QUIC-LB-SHRIMP/pkg/packet"
+)
+
+func TestDecodeTrace(t *testing.T) {
+	fwd := memForwarder{opened: make(chan *memConn, 1)}
+	lb, _ := newMemLB(t, Config{
+		Backends:        []BackendConfig{{Address: "192.0.2.100:443", Forwarder: fwd}, {Address: "192.0.2.101:443", Forwarder: fwd}},
+		Debug:           true,
+		DecodeTraceRate: 1,
+	})
+	var lines []string
+	lb.trace.logf = func(format string, args ...any) {
+		lines = append(lines, fmt.Sprintf(format, args...))
+	}
+
+	dcid := []byte{0x00, 0x01, 0xa1, 0xa2, 0xa3, 0xa4, 0xa5, 0xa6}
+	lb.process(inbound{pkt: quicLongHeader(packet.Initial, dcid, []byte{0xcc}, make([]byte, 40)), src: testAddr(1)})
+	expect(t, fwd.opened)
+
+	if len(lines) != 1 {
+		t.Fatalf("logged %d traces, want 1", len(lines))
+	}
+	for _, want := range []string{
+		"first byte 11000000",
+		"long header",
+		"DCID 0001a1a2a3a4a5a6",
+		"config rotation 0, plaintext",
+		"raw server ID bytes 01",
+		"server ID 01, nonce a1a2a3a4a5a6",
+		"resolved backend 192.0.2.101:443",
+		"forwarded to 192.0.2.101:443 on a new flow",
+	} {
+		if !strings.Contains(lines[0], want) {
+			t.Errorf("trace %q missing %q", lines[0], want)
+		}
+	}
+
+	// tracing is for debug mode only
+	lb, err := NewLoadBalancer(Config{Backends: StaticBackends("192.0.2.100:443"), DecodeTraceRate: 1})
+	if err != nil {
+		t.Fatalf("NewLoadBalancer() error = %v", err)
+	}
+	if lb.trace.sampled() {
+		t.Errorf("sampled() = true without Debug, want false")
+	}
+}
@@ -0,0 +1,46 @@
+package lb
+
+import (
+	"context"
+	"errors"
+	"time"
+)
+
+// errDraining is returned for the first packet of a new flow while draining
+var errDraining = errors.New("draining: not accepting new flows")
+
+// drainPollInterval is how often DrainAndShutdown checks for remaining flows,
+// and a waiting /backends/{id}/drain request for the backend's
+const drainPollInterval = 50 * time.Millisecond
+
+// Drain stops reporting readiness so orchestrators steer new clients away and
+// refuses packets that would open a new flow, while existing flows keep being
+// forwarded until Shutdown
+func (lb *LoadBalancer) Drain() {
+	lb.draining.Store(true)
+}
+
+// Draining reports whether Drain has been called
+func (lb *LoadBalancer) Draining() bool {
+	return lb.draining.Load()
+}
+
+// DrainAndShutdown drains the load balancer, waits for its flows to finish
+// (closed by the reaper as they go idle) or for ctx to be done, and then shuts
+// down. It returns ctx's error when flows were still active at shutdown.
+func (lb *LoadBalancer) DrainAndShutdown(ctx context.Context) error {
+	lb.Drain()
+	ticker := time.NewTicker(drainPollInterval)
+	defer ticker.Stop()
+	for {
+		if active, _ := lb.sessions.flowCounts(); active == 0 {
+			return lb.Shutdown()
+		}
+		select {
+		case <-ctx.Done():
+			lb.Shutdown()
+			return ctx.Err()
+		case <-ticker.C:
+		}
+	}
+}
@@ -0,0 +1,85 @@
+package lb
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/fqzz2000/QUIC-LB-SHRIMP/pkg/packet"
+)
+
+func TestDrainAndShutdownWaitsForFlows(t *testing.T) {
+	clock := newFakeClock()
+	lb := startTestLB(t, Config{
+		Backends:    StaticBackends(startEchoBackend(t)),
+		IdleTimeout: time.Minute,
+		Clock:       clock,
+	})
+	existing := newTestClient(t)
+	pkt := longHeaderPacket(packet.Initial, []byte{0x01, 0x02, 0x03, 0x04, 0x05, 0x06, 0x07, 0x08}, 1200)
+	existing.WriteTo(pkt, lb.Addr())
+	if got := readWithin(t, existing, time.Second); !bytes.Equal(got, pkt) {
+		t.Fatalf("echo before drain = %d bytes, want %d", len(got), len(pkt))
+	}
+
+	done := make(chan error, 1)
+	go func() { done <- lb.DrainAndShutdown(context.Background()) }()
+	for !lb.Draining() {
+		time.Sleep(time.Millisecond)
+	}
+
+	// a new client is refused while the existing flow is still served
+	newcomer := newTestClient(t)
+	newcomer.WriteTo(longHeaderPacket(packet.Initial, []byte{0x11, 0x12, 0x13, 0x14, 0x15, 0x16, 0x17, 0x18}, 1200), lb.Addr())
+	if got := readWithin(t, newcomer, 100*time.Millisecond); got != nil {
+		t.Errorf("new client got a %d byte response while draining", len(got))
+	}
+	existing.WriteTo(pkt, lb.Addr())
+	if got := readWithin(t, existing, time.Second); !bytes.Equal(got, pkt) {
+		t.Errorf("existing flow echo while draining = %d bytes, want %d", len(got), len(pkt))
+	}
+	if got := lb.Stats().DrainRefused; got != 1 {
+		t.Errorf("DrainRefused = %d, want 1", got)
+	}
+	select {
+	case err := <-done:
+		t.Fatalf("DrainAndShutdown() returned %v with a flow still active", err)
+	default:
+	}
+
+	// the last flow going idle completes the drain
+	clock.Advance(2 * time.Minute)
+	lb.reap(clock.Now())
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Errorf("DrainAndShutdown() error = %v, want nil", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("DrainAndShutdown() did not return after the last flow closed")
+	}
+	if lb.Addr() != nil {
+		t.Errorf("listener still bound after DrainAndShutdown()")
+	}
+}
+
+func TestDrainAndShutdownDeadline(t *testing.T) {
+	lb := startTestLB(t, Config{Backends: StaticBackends(startEchoBackend(t))})
+	client := newTestClient(t)
+	client.WriteTo(longHeaderPacket(packet.Initial, []byte{0x01, 0x02, 0x03, 0x04, 0x05, 0x06, 0x07, 0x08}, 1200), lb.Addr())
+	readWithin(t, client, time.Second)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	if err := lb.DrainAndShutdown(ctx); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("DrainAndShutdown() error = %v, want %v", err, context.DeadlineExceeded)
+	}
+	if lb.Addr() != nil {
+		t.Errorf("listener still bound after the drain deadline")
+	}
+	if n := len(lb.sessions.flows()); n != 0 {
+		t.Errorf("session table holds %d flows after shutdown, want 0", n)
+	}
+}
@@ -0,0 +1,114 @@
+package lb
+
+import (
+	"errors"
+	"fmt"
+	"net"
+
+	"github.com/fqzz2000/QUIC-LB-SHRIMP/pkg/packet"
+)
+
+// A backend draining for removal keeps its flows and the packets whose CIDs
+// decode to it, since those belong to established connections. A new
+// connection's Initial or 0-RTT whose CID decodes to it instead, as after a
+// Retry the backend issued, is turned away by Config.DrainingNewFlows:
+//
+//   - "fallback" (the default) routes it as a CID that does not decode, to
+//     a live backend on the fallback ring
+//   - "retry" answers an Initial with a Retry whose SCID, the DCID the
+//     client uses next, names a live backend chosen as the fallback would.
+//     The token starts with the original DCID behind a length byte, which
+//     that backend must accept in place of one of its own, as behind a
+//     QUIC-LB Retry offload, and report as
+//     original_destination_connection_id. Tokens expire and are good for
+//     one connection (retrytoken.go).
+//   - "version_negotiation" answers with a Version Negotiation packet
+//     listing only a reserved version, which refuses the connection at once
+//     rather than letting it time out (RFC 9000 section 6.2)
+//
+// As for Version Negotiation of unsupported versions, a datagram too small
+// to carry an Initial gets no answer, and neither does 0-RTT: either is
+// dropped.
+const (
+	drainingFallback           = "fallback"
+	drainingRetry              = "retry"
+	drainingVersionNegotiation = "version_negotiation"
+)
+
+// drainingRefusalVersion is the reserved version (RFC 9000 section 15) a
+// Version Negotiation refusing a connection lists, which no client speaks
+const drainingRefusalVersion = 0x1a2a3a4a
+
+var (
+	// errDrainingNewFlows is returned for an unknown Config.DrainingNewFlows
+	errDrainingNewFlows = errors.New("invalid draining new-flow policy")
+	// errDrainingBackend is returned for a new connection whose CID decodes
+	// to a draining backend, to be answered by redirectDraining
+	errDrainingBackend = errors.New("new connection decoded to a draining backend")
+)
+
+// drainingNewFlows returns the policy for new connections decoding to a
+// draining backend
+func (c *Config) drainingNewFlows() (string, error) {
+	switch c.DrainingNewFlows {
+	case "":
+		return drainingFallback, nil
+	case drainingFallback, drainingRetry, drainingVersionNegotiation:
+		return c.DrainingNewFlows, nil
+	}
+	return "", fmt.Errorf("%w: %q", errDrainingNewFlows, c.DrainingNewFlows)
+}
+
+// redirectDraining answers the first long header of a new connection, in a
+// datagram of size bytes from src on listener ln, whose CID decoded to a
+// draining backend. client is whom the live backend of a Retry is chosen for.
+func (lb *LoadBalancer) redirectDraining(header packet.QuicHeader, size int, src, client net.Addr, ln *clientListener, cause error) error {
+	lh, ok := header.(*packet.LongHeader)
+	if !ok || size < packet.MinInitialSize || lh.LongPacketType != packet.Initial {
+		return cause
+	}
+	var reply []byte
+	switch lb.drainPolicy {
+	case drainingRetry:
+		scid, err := lb.retryCID(lh.DCID, client)
+		if err != nil {
+			return fmt.Errorf("%w: %w", cause, err)
+		}
+		token, err := lb.retryTokens.issue(lh.DCID, lb.clock.Now())
+		if err != nil {
+			return fmt.Errorf("%w: %w", cause, err)
+		}
+		if reply, err = packet.RetryPacket(lh.Version, lh.SCID, scid, lh.DCID, token); err != nil {
+			return fmt.Errorf("%w: %w", cause, err)
+		}
+	case drainingVersionNegotiation:
+		var err error
+		if reply, err = lb.versionNegotiation(lh, []uint32{drainingRefusalVersion}, size); err != nil {
+			return fmt.Errorf("%w: %w", cause, err)
+		}
+	default:
+		return cause
+	}
+	n, err := lb.clientConn(ln).WriteTo(reply, src)
+	if err := lb.checkWrite(n, len(reply), err); err != nil {
+		return err
+	}
+	lb.stats.drainingRedirects.Add(1)
+	return fmt.Errorf("%w: answered with %s", cause, lb.drainPolicy)
+}
+
+// retryCID issues a CID naming the live backend the fallback picks for a
+// connection to cid from client
+func (lb *LoadBalancer) retryCID(cid []byte, client net.Addr) ([]byte, error) {
+	rt := lb.routes()
+	backend, err := lb.fallbackBackend(rt, cid, client)
+	if err != nil {
+		return nil, err
+	}
+	cfg, _ := rt.codec.Config(rt.issueRotation)
+	serverID, ok := rt.serverIDFor(backend.Address, cfg.ServerIDLength)
+	if !ok {
+		return nil, fmt.Errorf("%w: no server ID names %s", ErrUnknownServerID, backend.Address)
+	}
+	return lb.IssueCID(serverID)
+}
@@ -0,0 +1,149 @@
+package lb
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/fqzz2000/QUIC-LB-SHRIMP/pkg/packet"
+)
+
+func TestDrainingBackendNewFlows(t *testing.T) {
+	tests := []struct {
+		name      string
+		policy    string
+		wantReply packet.PacketType // the answer to the Initial, but under fallback
+	}{
+		{name: "Fallback"},
+		{name: "Retry", policy: drainingRetry, wantReply: packet.Retry},
+		{name: "Version Negotiation", policy: drainingVersionNegotiation, wantReply: packet.VersionNegotiation},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			addrs := []string{"192.0.2.1:443", "192.0.2.2:443", "192.0.2.3:443"}
+			fwds := make([]memForwarder, len(addrs))
+			var backends []BackendConfig
+			for i, addr := range addrs {
+				fwds[i] = memForwarder{opened: make(chan *memConn, 4)}
+				backends = append(backends, BackendConfig{Address: addr, Forwarder: fwds[i]})
+			}
+			lb, listener := newMemLB(t, Config{Backends: backends, BackendDrainTimeout: time.Minute, DrainingNewFlows: tt.policy})
+			rt := lb.routes()
+			encode := func(nonce byte) []byte {
+				cid, err := rt.codec.Encode(rt.issueRotation, []byte{0x01}, []byte{nonce, nonce, nonce, nonce, nonce, nonce})
+				if err != nil {
+					t.Fatalf("Encode() error = %v", err)
+				}
+				return cid
+			}
+
+			// a flow open before the drain, and a decoded short header of
+			// an established connection the LB holds no flow for
+			open := append([]byte{0x40}, encode(1)...)
+			if err := lb.handlePacket(open, testAddr(1)); err != nil {
+				t.Fatalf("handlePacket(open flow) error = %v", err)
+			}
+			openConn := expect(t, fwds[1].opened)
+			expect(t, openConn.sent)
+			if err := lb.RemoveBackend(addrs[1]); err != nil {
+				t.Fatalf("RemoveBackend() error = %v", err)
+			}
+			if err := lb.handlePacket(open, testAddr(1)); err != nil {
+				t.Fatalf("handlePacket(open flow, draining) error = %v", err)
+			}
+			if got := expect(t, openConn.sent); !bytes.Equal(got, open) {
+				t.Errorf("open flow's packet while draining = %x, want %x", got, open)
+			}
+			established := append([]byte{0x40}, encode(2)...)
+			if err := lb.handlePacket(established, testAddr(2)); err != nil {
+				t.Fatalf("handlePacket(established) error = %v", err)
+			}
+			if got := expect(t, expect(t, fwds[1].opened).sent); !bytes.Equal(got, established) {
+				t.Errorf("established connection's packet while draining = %x, want %x", got, established)
+			}
+
+			// a new connection's Initial decoding to the draining backend
+			odcid, scid := encode(3), []byte{0xa1, 0xa2, 0xa3, 0xa4}
+			initial := quicLongHeader(packet.Initial, odcid, scid, make([]byte, 1200))
+			err := lb.handlePacket(initial, testAddr(3))
+			if tt.policy == "" {
+				if err != nil {
+					t.Fatalf("handlePacket(Initial) error = %v", err)
+				}
+				if len(fwds[1].opened) != 0 {
+					t.Fatal("new connection routed to the draining backend")
+				}
+				if len(fwds[0].opened)+len(fwds[2].opened) != 1 {
+					t.Errorf("new connection opened %d flows on live backends, want 1", len(fwds[0].opened)+len(fwds[2].opened))
+				}
+			} else {
+				if !errors.Is(err, errDrainingBackend) || dropReasonFor(err) != dropDraining {
+					t.Fatalf("handlePacket(Initial) error = %v, want %v", err, errDrainingBackend)
+				}
+				if n := len(fwds[0].opened) + len(fwds[1].opened) + len(fwds[2].opened); n != 0 {
+					t.Errorf("answered Initial opened %d flows, want none", n)
+				}
+				reply := expect(t, listener.sent)
+				if reply.addr.String() != testAddr(3).String() {
+					t.Errorf("reply sent to %v, want %v", reply.addr, testAddr(3))
+				}
+				checkDrainingReply(t, lb, reply.data, tt.wantReply, odcid, scid)
+			}
+			if got := lb.Stats().DrainingRedirects; got != 1 {
+				t.Errorf("DrainingRedirects = %d, want 1", got)
+			}
+		})
+	}
+}
+
+// checkDrainingReply checks the answer to a client Initial from scid to
+// odcid: a Retry to a CID naming a live backend, or a Version Negotiation
+// refusing the connection
+func checkDrainingReply(t *testing.T, lb *LoadBalancer, reply []byte, want packet.PacketType, odcid, scid []byte) {
+	t.Helper()
+	p := &packet.PacketProcessor{}
+	if ptype, _ := p.ClassifyPacket(reply); ptype != want {
+		t.Fatalf("reply %x is of type %d, want %d", reply, ptype, want)
+	}
+	if want == packet.VersionNegotiation {
+		if len(reply) != 7+len(odcid)+len(scid)+4 || binary.BigEndian.Uint32(reply[len(reply)-4:]) != drainingRefusalVersion {
+			t.Errorf("Version Negotiation %x, want one listing only %#x", reply, drainingRefusalVersion)
+		}
+		return
+	}
+	header, err := p.ParsePacket(reply)
+	if err != nil {
+		t.Fatalf("ParsePacket(Retry) error = %v", err)
+	}
+	lh := header.(*packet.LongHeader)
+	if err := lh.VerifyRetryIntegrity(reply, odcid); err != nil {
+		t.Errorf("VerifyRetryIntegrity() error = %v", err)
+	}
+	if !bytes.Equal(lh.DCID, scid) {
+		t.Errorf("Retry DCID = %x, want the client's SCID %x", lh.DCID, scid)
+	}
+	token := reply[7+len(lh.DCID)+len(lh.SCID) : len(reply)-packet.RetryIntegrityTagLength]
+	if !bytes.HasPrefix(token, append([]byte{byte(len(odcid))}, odcid...)) {
+		t.Errorf("Retry token = %x, want the original DCID %x behind its length first", token, odcid)
+	}
+	if got, err := lb.DecodeRetryToken(token); err != nil || !bytes.Equal(got, odcid) {
+		t.Errorf("DecodeRetryToken() = %x, %v, want %x", got, err, odcid)
+	}
+	backend, err := lb.selectBackend(lh.SCID, testAddr(3))
+	if err != nil || backend.Address == "192.0.2.2:443" {
+		t.Errorf("Retry SCID %x routes to %q, %v, want a live backend", lh.SCID, backend.Address, err)
+	}
+}
+
+func TestDrainingNewFlowsConfig(t *testing.T) {
+	for _, policy := range []string{"", drainingFallback, drainingRetry, drainingVersionNegotiation} {
+		if _, err := (&Config{DrainingNewFlows: policy}).drainingNewFlows(); err != nil {
+			t.Errorf("drainingNewFlows(%q) error = %v", policy, err)
+		}
+	}
+	if _, err := (&Config{DrainingNewFlows: "drop"}).drainingNewFlows(); !errors.Is(err, errDrainingNewFlows) {
+		t.Errorf("drainingNewFlows(drop) error = %v, want %v", err, errDrainingNewFlows)
+	}
+}
@@ -0,0 +1,119 @@
+package lb
+
+import (
+	"errors"
+
+	"github.com/fqzz2000/QUIC-LB-SHRIMP/pkg/packet"
+)
+
+// dropReason labels a dropped datagram in shrimp_packets_dropped_total
+type dropReason uint8
+
+const (
+	dropParseError dropReason = iota
+	dropInvalid
+	dropCorrupt
+	dropNoBackend
+	dropOverCapacity
+	dropDraining
+	dropQueueFull
+	dropNoAddress
+	dropPanic
+	dropZeroRTT
+	dropStatelessReset
+	dropBackendError
+	dropPacketType
+	dropRateLimit
+	dropEgressRate
+	dropSmallInitial
+	dropVersion
+	dropRotationPolicy
+	dropSourceFlows
+	dropRetryToken
+	dropTrailingBytes
+	dropCIDTooShort
+	dropReordered
+	numDropReasons
+)
+
+// dropReasonNames are the reason label values, indexed by dropReason
+var dropReasonNames = [numDropReasons]string{
+	dropParseError:     "parse_error",
+	dropInvalid:        "invalid_header",
+	dropCorrupt:        "corrupt",
+	dropNoBackend:      "no_backend",
+	dropOverCapacity:   "over_capacity",
+	dropDraining:       "draining",
+	dropQueueFull:      "queue_full",
+	dropNoAddress:      "no_address",
+	dropPanic:          "panic",
+	dropZeroRTT:        "zero_rtt",
+	dropStatelessReset: "stateless_reset",
+	dropBackendError:   "backend_error",
+	dropPacketType:     "packet_type",
+	dropRateLimit:      "rate_limit",
+	dropEgressRate:     "egress_rate",
+	dropSmallInitial:   "small_initial",
+	dropVersion:        "unsupported_version",
+	dropRotationPolicy: "rotation_policy",
+	dropSourceFlows:    "source_flows",
+	dropRetryToken:     "retry_token",
+	dropTrailingBytes:  "trailing_bytes",
+	dropCIDTooShort:    "cid_too_short",
+	dropReordered:      "reordered_coalesced",
+}
+
+// dropReasonFor classifies the error handlePacket dropped a datagram with.
+// Errors matching no routing or parsing sentinel come from the backend
+// socket: a failed dial or write.
+func dropReasonFor(err error) dropReason {
+	switch {
+	case errors.Is(err, packet.ErrInconsistentLengths):
+		return dropCorrupt
+	case errors.Is(err, packet.ErrFixedBitUnset), errors.Is(err, packet.ErrReservedBitsSet):
+		return dropInvalid
+	case errors.Is(err, packet.ErrPacketTooShort), errors.Is(err, packet.ErrInvalidCIDLength),
+		errors.Is(err, packet.ErrTooManyCoalesced), errors.Is(err, packet.ErrNoPacketNumber),
+		errors.Is(err, errProxyHeader):
+		return dropParseError
+	case errors.Is(err, ErrNoBackends), errors.Is(err, ErrUnknownServerID), errors.Is(err, errUnknownCID):
+		return dropNoBackend
+	case errors.Is(err, errBackendFull):
+		return dropOverCapacity
+	case errors.Is(err, errDraining), errors.Is(err, errDrainingBackend):
+		return dropDraining
+	case errors.Is(err, errZeroRTTDropped):
+		return dropZeroRTT
+	case errors.Is(err, errStatelessReset):
+		return dropStatelessReset
+	case errors.Is(err, errPacketTypeFiltered):
+		return dropPacketType
+	case errors.Is(err, errNewFlowRateLimited):
+		return dropRateLimit
+	case errors.Is(err, errEgressRate):
+		return dropEgressRate
+	case errors.Is(err, errSmallInitial):
+		return dropSmallInitial
+	case errors.Is(err, errUnsupportedVersion), errors.Is(err, errVersionNegotiation):
+		return dropVersion
+	case errors.Is(err, errRotationDropped):
+		return dropRotationPolicy
+	case errors.Is(err, errSourceFlowLimit):
+		return dropSourceFlows
+	case errors.Is(err, ErrRetryTokenExpired), errors.Is(err, ErrRetryTokenReplayed):
+		return dropRetryToken
+	case errors.Is(err, errTrailingBytes):
+		return dropTrailingBytes
+	case errors.Is(err, errCIDTooShort):
+		return dropCIDTooShort
+	case errors.Is(err, errReorderedCoalesced):
+		return dropReordered
+	}
+	return dropBackendError
+}
+
+// drop counts a dropped datagram under its reason
+func (lb *LoadBalancer) drop(reason dropReason) {
+	lb.stats.dropped.Add(1)
+	lb.metrics.drops[reason].Inc()
+}
@@ -0,0 +1,51 @@
+package lb
+
+import (
+	"errors"
+	"fmt"
+	"log"
+)
+
+// A backend address listed twice, by typo or by a generated config, would
+// weigh double on the ring and leave its server IDs ambiguous. The
+// duplicate backend policy (Config.DuplicateBackends) decides what happens
+// to such a list: "error", the default, refuses the config; "dedupe" keeps
+// the first entry of each address with a warning. Deduplicating shifts the
+// index of every backend after a dropped entry, so in index mode their
+// server IDs change.
+const (
+	duplicatesError  = "error"
+	duplicatesDedupe = "dedupe"
+)
+
+var (
+	// errDuplicateBackendsPolicy is returned for an unknown Config.DuplicateBackends
+	errDuplicateBackendsPolicy = errors.New("invalid duplicate backend policy")
+	// errDuplicateBackend is returned for a backend list naming an address twice
+	errDuplicateBackend = errors.New("duplicate backend")
+)
+
+// dedupeBackends applies the duplicate backend policy to the backend list,
+// replacing it with one naming each address once
+func (c *Config) dedupeBackends() error {
+	switch c.DuplicateBackends {
+	case "", duplicatesError, duplicatesDedupe:
+	default:
+		return fmt.Errorf("%w: %q", errDuplicateBackendsPolicy, c.DuplicateBackends)
+	}
+	seen := make(map[string]bool, len(c.Backends))
+	backends := make([]BackendConfig, 0, len(c.Backends))
+	for i, b := range c.Backends {
+		if !seen[b.Address] {
+			seen[b.Address] = true
+			backends = append(backends, b)
+			continue
+		}
+		if c.DuplicateBackends != duplicatesDedupe {
+			return fmt.Errorf("%w: %s is listed again at index %d", errDuplicateBackend, b.Address, i)
+		}
+		log.Printf("WARNING: backend %s is listed again at index %d; keeping the first entry", b.Address, i)
+	}
+	c.Backends = backends
+	return nil
+}
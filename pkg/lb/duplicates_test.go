@@ -0,0 +1,50 @@
+package lb
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestDuplicateBackends(t *testing.T) {
+	tests := []struct {
+		name    string
+		policy  string
+		wantErr error
+	}{
+		{name: "Default Errors", wantErr: errDuplicateBackend},
+		{name: "Error", policy: duplicatesError, wantErr: errDuplicateBackend},
+		{name: "Dedupe", policy: duplicatesDedupe},
+		{name: "Unknown Policy", policy: "merge", wantErr: errDuplicateBackendsPolicy},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			lb, err := NewLoadBalancer(Config{
+				Backends:          StaticBackends("10.0.0.1:443", "10.0.0.2:443", "10.0.0.1:443", "10.0.0.3:443"),
+				DuplicateBackends: tt.policy,
+			})
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("NewLoadBalancer() error = %v, want %v", err, tt.wantErr)
+			}
+			if err != nil {
+				return
+			}
+			// the first entry is kept, so the ring weighs it once and the
+			// backends after the duplicate move up an index
+			if n := len(lb.routes().backends); n != 3 {
+				t.Errorf("backends = %d, want 3", n)
+			}
+			ring := lb.routes().ring
+			nodes := map[string]int{}
+			for _, n := range ring.nodes {
+				nodes[ring.backends[n.backend].Address]++
+			}
+			if nodes["10.0.0.1:443"] != vnodesPerWeight {
+				t.Errorf("ring nodes = %v, want %d for the duplicated backend", nodes, vnodesPerWeight)
+			}
+			cid, _ := lb.routes().codec.Encode(0, []byte{0x02}, nil)
+			if backend, err := lb.routeCID(cid); err != nil || backend.Address != "10.0.0.3:443" {
+				t.Errorf("routeCID(server ID 02) = %s, %v, want 10.0.0.3:443", backend.Address, err)
+			}
+		})
+	}
+}
@@ -0,0 +1,127 @@
+package lb
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"sync"
+	"time"
+)
+
+// An egress rate (BackendConfig.MaxPacketRate and MaxByteRate) protects a
+// backend from the LB itself: datagrams over it are not sent. A token bucket
+// per backend refills at the rate up to one second's worth. While a backend
+// is out of tokens it is unavailable to new flows routed without affinity,
+// which spill to the next backend as over MaxFlows; a new flow whose CID
+// names it cannot move and is dropped, counted apart from the datagrams of
+// open flows dropped over the rate.
+
+var (
+	// errEgressRate is returned for a datagram over its backend's egress rate
+	errEgressRate = errors.New("backend over egress rate")
+	// errEgressDecoded is returned for a new flow whose CID decoded to a
+	// backend over its egress rate
+	errEgressDecoded = fmt.Errorf("%w: new flow decoded to it", errEgressRate)
+)
+
+// egressBucket is one backend's egress allowance; a zero rate is unlimited
+type egressBucket struct {
+	mu         sync.Mutex
+	packetRate float64
+	byteRate   float64
+	packets    float64
+	bytes      float64
+	last       time.Time
+}
+
+// egressLimits holds the buckets of rate-limited backends by address
+type egressLimits struct {
+	mu      sync.Mutex
+	buckets map[string]*egressBucket
+}
+
+// limited reports whether b sets an egress rate
+func (b BackendConfig) limited() bool {
+	return b.MaxPacketRate > 0 || b.MaxByteRate > 0
+}
+
+// bucket returns the bucket of backend, nil when it sets no egress rate.
+// A bucket is kept across flows, taking the backend's current rates.
+func (l *egressLimits) bucket(backend BackendConfig, now time.Time) *egressBucket {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if !backend.limited() {
+		delete(l.buckets, backend.Address)
+		return nil
+	}
+	b, ok := l.buckets[backend.Address]
+	if !ok {
+		if l.buckets == nil {
+			l.buckets = make(map[string]*egressBucket)
+		}
+		b = &egressBucket{last: now}
+		l.buckets[backend.Address] = b
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.packetRate, b.byteRate = math.Max(0, backend.MaxPacketRate), math.Max(0, backend.MaxByteRate)
+	if !ok {
+		// a new bucket starts full
+		b.packets, b.bytes = b.packetBurst(), b.byteBurst()
+	}
+	return b
+}
+
+// throttled reports whether the backend at addr is out of egress allowance
+// for another full-size datagram
+func (l *egressLimits) throttled(addr string, now time.Time) bool {
+	l.mu.Lock()
+	b := l.buckets[addr]
+	l.mu.Unlock()
+	if b == nil {
+		return false
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.refill(now)
+	return (b.packetRate > 0 && b.packets < 1) || (b.byteRate > 0 && b.bytes < maxPacketSize)
+}
+
+func (b *egressBucket) packetBurst() float64 { return math.Max(1, b.packetRate) }
+
+// byteBurst lets through at least one full-size datagram
+func (b *egressBucket) byteBurst() float64 { return math.Max(maxPacketSize, b.byteRate) }
+
+// refill adds the allowance accrued since the last update. Callers must hold b.mu.
+func (b *egressBucket) refill(now time.Time) {
+	elapsed := now.Sub(b.last).Seconds()
+	if elapsed <= 0 {
+		return
+	}
+	b.packets = math.Min(b.packetBurst(), b.packets+elapsed*b.packetRate)
+	b.bytes = math.Min(b.byteBurst(), b.bytes+elapsed*b.byteRate)
+	b.last = now
+}
+
+// allow takes one datagram of n bytes from the bucket, reporting whether it
+// had the allowance
+func (b *egressBucket) allow(n int, now time.Time) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.refill(now)
+	if (b.packetRate > 0 && b.packets < 1) || (b.byteRate > 0 && b.bytes < float64(n)) {
+		return false
+	}
+	b.packets--
+	b.bytes -= float64(n)
+	return true
+}
+
+// admitEgress applies the flow's backend egress rate to a datagram of n bytes
+func (lb *LoadBalancer) admitEgress(flow *Flow, n int, now time.Time) error {
+	if flow.egress == nil || flow.egress.allow(n, now) {
+		return nil
+	}
+	lb.stats.egressDrops.Add(1)
+	return fmt.Errorf("%w: %s", errEgressRate, flow.Backend)
+}
@@ -0,0 +1,105 @@
+package lb
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/fqzz2000/QUIC-LB-SHRIMP/pkg/packet"
+)
+
+func TestEgressRateCapped(t *testing.T) {
+	clock := newFakeClock()
+	fwd := memForwarder{opened: make(chan *memConn, 1)}
+	lb, _ := newMemLB(t, Config{
+		Backends: []BackendConfig{{Address: "192.0.2.100:443", Forwarder: fwd, MaxPacketRate: 10}},
+		Clock:    clock,
+	})
+	pkt := longHeaderPacket(packet.Initial, []byte{0x01, 0x02, 0x03, 0x04, 0x05, 0x06, 0x07, 0x08}, 1200)
+
+	var conn *memConn
+	// send a burst at one instant and count the datagrams the backend got
+	burst := func(n int) (sent int) {
+		for i := 0; i < n; i++ {
+			if err := lb.handlePacket(pkt, testAddr(1)); err != nil && !errors.Is(err, errEgressRate) {
+				t.Fatalf("handlePacket() error = %v", err)
+			}
+		}
+		if conn == nil {
+			conn = expect(t, fwd.opened)
+		}
+		for len(conn.sent) > 0 {
+			<-conn.sent
+			sent++
+		}
+		return sent
+	}
+
+	if sent := burst(30); sent != 10 {
+		t.Errorf("burst of 30 at 10 packets/s sent %d, want 10", sent)
+	}
+	if got := lb.Stats().EgressDrops; got != 20 {
+		t.Errorf("EgressDrops = %d, want 20", got)
+	}
+
+	// half a second refills half the allowance
+	clock.Advance(500 * time.Millisecond)
+	if sent := burst(10); sent != 5 {
+		t.Errorf("burst after 500ms sent %d, want 5", sent)
+	}
+	// the bucket holds no more than one second's worth
+	clock.Advance(time.Hour)
+	if sent := burst(30); sent != 10 {
+		t.Errorf("burst after an hour sent %d, want 10", sent)
+	}
+}
+
+func TestEgressRateNewFlows(t *testing.T) {
+	clock := newFakeClock()
+	lb, err := NewLoadBalancer(Config{
+		Backends: []BackendConfig{
+			{Address: "10.0.0.1:443", MaxPacketRate: 1},
+			{Address: "10.0.0.2:443"},
+		},
+		Clock: clock,
+	})
+	if err != nil {
+		t.Fatalf("NewLoadBalancer() error = %v", err)
+	}
+	limited := lb.routes().backends[0]
+
+	// spend the limited backend's allowance
+	if b := lb.egress.bucket(limited, clock.Now()); !b.allow(1200, clock.Now()) {
+		t.Fatal("allow() on a full bucket = false, want true")
+	}
+
+	// new flows without a decodable CID go to the other backend
+	undecodable := []byte{0xc0, 0x00}
+	for i := 0; i < 32; i++ {
+		backend, err := lb.selectBackend(undecodable, testAddr(i))
+		if err != nil {
+			t.Fatalf("selectBackend() error = %v", err)
+		}
+		if backend.Address != "10.0.0.2:443" {
+			t.Errorf("selectBackend() with 10.0.0.1:443 throttled = %s, want 10.0.0.2:443", backend.Address)
+		}
+	}
+
+	// a CID naming the throttled backend cannot move and is dropped
+	cid, err := lb.routes().codec.Encode(lb.routes().issueRotation, []byte{0}, nil)
+	if err != nil {
+		t.Fatalf("Encode() error = %v", err)
+	}
+	if _, err := lb.selectBackend(cid, testAddr(1)); !errors.Is(err, errEgressDecoded) {
+		t.Errorf("selectBackend(decoded) error = %v, want %v", err, errEgressDecoded)
+	}
+	if got := lb.Stats().EgressDecoded; got != 1 {
+		t.Errorf("EgressDecoded = %d, want 1", got)
+	}
+
+	// once refilled the backend takes flows again
+	clock.Advance(time.Second)
+	if backend, err := lb.selectBackend(cid, testAddr(1)); err != nil || backend.Address != "10.0.0.1:443" {
+		t.Errorf("selectBackend(decoded) after refill = %q, %v, want 10.0.0.1:443", backend.Address, err)
+	}
+}
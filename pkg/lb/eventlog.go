@@ -0,0 +1,128 @@
+package lb
+
+import (
+	"cmp"
+	"fmt"
+	"net/http"
+	"slices"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// defaultEventLogSize is how many routing events are kept unless configured
+const defaultEventLogSize = 1024
+
+// The event log keeps the last routing decisions in a fixed ring, for
+// working out what just happened after an incident without verbose logging
+// having been on; GET /events returns them oldest first. It is always on
+// unless Config.EventLogSize is negative: recording claims a slot with one
+// atomic add and copies a few words under that slot's own lock, so workers
+// only contend when the ring laps them, and nothing is allocated. CIDs are
+// kept as their unseeded ring hash (hashKey), never raw.
+
+// routingEvent is one packet's routing decision and outcome
+type routingEvent struct {
+	seq     uint64 // position in the log from 1, zero for an empty slot
+	at      int64  // unix nanoseconds
+	cidHash uint64
+	route   Route
+	backend string
+	dropped bool
+	reason  dropReason // why, when dropped
+}
+
+// eventSlot is one ring slot; its lock is only ever contended by a writer
+// lapping another or a reader copying it
+type eventSlot struct {
+	mu    sync.Mutex
+	event routingEvent
+}
+
+// eventLog is the ring of recent routing events, nil when disabled
+type eventLog struct {
+	next  atomic.Uint64 // events recorded so far
+	slots []eventSlot
+}
+
+// newEventLog returns a log of size events, defaulting for zero, or nil when
+// size is negative
+func newEventLog(size int) *eventLog {
+	if size < 0 {
+		return nil
+	}
+	if size == 0 {
+		size = defaultEventLogSize
+	}
+	return &eventLog{slots: make([]eventSlot, size)}
+}
+
+// record logs the routing of one packet, overwriting the oldest event
+func (l *eventLog) record(now time.Time, res *DecodeResult, err error) {
+	if l == nil {
+		return
+	}
+	seq := l.next.Add(1)
+	e := routingEvent{seq: seq, at: now.UnixNano(), route: res.Route, backend: res.Backend}
+	if len(res.CID) > 0 {
+		e.cidHash = hashKey(0, res.CID)
+	}
+	if err != nil {
+		e.dropped, e.reason = true, dropReasonFor(err)
+	}
+	s := &l.slots[(seq-1)%uint64(len(l.slots))]
+	s.mu.Lock()
+	// a writer that lapped this one may already have filled the slot
+	if s.event.seq < seq {
+		s.event = e
+	}
+	s.mu.Unlock()
+}
+
+// recent returns the events in the ring, oldest first
+func (l *eventLog) recent() []routingEvent {
+	if l == nil {
+		return nil
+	}
+	events := make([]routingEvent, 0, len(l.slots))
+	for i := range l.slots {
+		s := &l.slots[i]
+		s.mu.Lock()
+		e := s.event
+		s.mu.Unlock()
+		if e.seq != 0 {
+			events = append(events, e)
+		}
+	}
+	slices.SortFunc(events, func(a, b routingEvent) int {
+		return cmp.Compare(a.seq, b.seq)
+	})
+	return events
+}
+
+// eventView is one routing event in the /events API
+type eventView struct {
+	Seq     uint64    `json:"seq"`
+	Time    time.Time `json:"time"`
+	CIDHash string    `json:"cid_hash,omitempty"`
+	Route   Route     `json:"route"`
+	Backend string    `json:"backend,omitempty"`
+	Outcome string    `json:"outcome"`
+}
+
+// handleListEvents lists the recent routing events, oldest first
+func (lb *LoadBalancer) handleListEvents(w http.ResponseWriter, r *http.Request) {
+	events := lb.events.recent()
+	views := make([]eventView, len(events))
+	for i, e := range events {
+		v := eventView{Seq: e.seq, Time: time.Unix(0, e.at).UTC(), Route: e.route, Backend: e.backend, Outcome: "forwarded"}
+		if e.cidHash != 0 {
+			v.CIDHash = fmt.Sprintf("%016x", e.cidHash)
+		}
+		if e.dropped {
+			v.Outcome = dropReasonNames[e.reason]
+		}
+		views[i] = v
+	}
+	writeJSON(w, http.StatusOK, views)
+}
@@ -0,0 +1,107 @@
+package lb
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/fqzz2000/QUIC-LB-SHRIMP/pkg/packet"
+)
+
+func TestEventLogWraps(t *testing.T) {
+	l := newEventLog(4)
+	start := time.Unix(1700000000, 0)
+	for i := 0; i < 10; i++ {
+		var err error
+		if i%2 == 1 {
+			err = errDraining
+		}
+		res := DecodeResult{CID: []byte{byte(i)}, Backend: fmt.Sprintf("backend%d", i), Route: RouteCID}
+		l.record(start.Add(time.Duration(i)*time.Second), &res, err)
+	}
+	events := l.recent()
+	if len(events) != 4 {
+		t.Fatalf("recent() = %d events, want the last 4", len(events))
+	}
+	for i, e := range events {
+		n := 6 + i
+		want := routingEvent{seq: uint64(n + 1), at: start.Add(time.Duration(n) * time.Second).UnixNano(),
+			cidHash: hashKey(0, []byte{byte(n)}), route: RouteCID, backend: fmt.Sprintf("backend%d", n)}
+		if n%2 == 1 {
+			want.dropped, want.reason = true, dropDraining
+		}
+		if e != want {
+			t.Errorf("recent()[%d] = %+v, want %+v", i, e, want)
+		}
+	}
+
+	// workers racing around the ring still leave exactly the latest events
+	var wg sync.WaitGroup
+	for w := 0; w < 8; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := 0; i < 1000; i++ {
+				l.record(start, &DecodeResult{}, nil)
+			}
+		}()
+	}
+	wg.Wait()
+	events = l.recent()
+	if len(events) != 4 {
+		t.Fatalf("after concurrent records recent() = %d events, want 4", len(events))
+	}
+	for i, e := range events {
+		if want := uint64(10 + 8000 - 3 + i); e.seq != want {
+			t.Errorf("after concurrent records recent()[%d].seq = %d, want %d", i, e.seq, want)
+		}
+	}
+
+	if newEventLog(-1).recent() != nil {
+		t.Error("a disabled event log returned events")
+	}
+}
+
+func TestHandleListEvents(t *testing.T) {
+	fwd := memForwarder{opened: make(chan *memConn, 1)}
+	lb, _ := newMemLB(t, Config{
+		Backends:     []BackendConfig{{Address: "192.0.2.100:443", Forwarder: fwd}},
+		EventLogSize: 2,
+	})
+	dcid := []byte{0x00, 0x00, 0xa1, 0xa2, 0xa3, 0xa4, 0xa5, 0xa6}
+	lb.process(inbound{pkt: []byte{0x40}, src: testAddr(1)}) // overwritten by the next two
+	lb.process(inbound{pkt: longHeaderPacket(packet.Initial, dcid, 1200), src: testAddr(1)})
+	expect(t, fwd.opened)
+	lb.process(inbound{pkt: []byte{0xc0, 0x00}, src: testAddr(2)})
+
+	rec := httptest.NewRecorder()
+	lb.adminHandler().ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/events", nil))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("status = %d, want %d", rec.Code, http.StatusOK)
+	}
+	var events []map[string]any
+	if err := json.NewDecoder(rec.Body).Decode(&events); err != nil {
+		t.Fatalf("decoding response: %v", err)
+	}
+	if len(events) != 2 {
+		t.Fatalf("got %d events, want 2", len(events))
+	}
+	for field, want := range map[string]any{
+		"seq":      float64(2),
+		"cid_hash": fmt.Sprintf("%016x", hashKey(0, dcid)),
+		"route":    "cid",
+		"backend":  "192.0.2.100:443",
+		"outcome":  "forwarded",
+	} {
+		if events[0][field] != want {
+			t.Errorf("events[0] %s = %v, want %v", field, events[0][field], want)
+		}
+	}
+	if events[1]["outcome"] != "parse_error" || events[1]["route"] != "none" {
+		t.Errorf("events[1] = %v, want a parse error routed nowhere", events[1])
+	}
+}
@@ -0,0 +1,83 @@
+package lb
+
+import (
+	"errors"
+	"net"
+	"time"
+)
+
+// Eviction notices (Config.EvictionNotices) are the reverse of close
+// notifications: when the reaper evicts a flow, the LB tells its backend,
+// so a server still holding the connection can drop it rather than wait
+// out its own idle timeout. A notice is sent from the control socket to the
+// backend's BackendConfig.ControlAddr, one datagram per connection ID the
+// flow was known by, framed as control messages are:
+//
+//	0x03 CID	flow evicted; CID is the remainder of the datagram
+//
+// Notices are best-effort: nothing acknowledges them, and one that cannot
+// be sent is counted and dropped. Backends without a ControlAddr get none.
+
+const (
+	// controlEvicted is the opcode of a flow-evicted notice
+	controlEvicted = 0x03
+	// evictNoticeTimeout bounds each notice write, so a backend not
+	// reading its Unix socket cannot stall the reaper
+	evictNoticeTimeout = 100 * time.Millisecond
+)
+
+// errEvictionNotices is returned for eviction notices without a control socket
+var errEvictionNotices = errors.New("eviction notices need a control address")
+
+// evictionNotices reports whether eviction notices are enabled
+func (c *Config) evictionNotices() (bool, error) {
+	if c.EvictionNotices && c.ControlAddr == "" {
+		return false, errEvictionNotices
+	}
+	return c.EvictionNotices, nil
+}
+
+// notifyEvicted sends the backend of an evicted flow a notice for each of
+// cids, when notices are enabled and the backend takes them
+func (lb *LoadBalancer) notifyEvicted(flow *Flow, cids []string) {
+	if !lb.evictNotices || len(cids) == 0 {
+		return
+	}
+	var target string
+	for _, b := range lb.routes().backends {
+		if b.Address == flow.Backend {
+			target = b.ControlAddr
+		}
+	}
+	if target == "" {
+		return
+	}
+	lb.mu.RLock()
+	conn := lb.control
+	lb.mu.RUnlock()
+	if conn == nil {
+		return
+	}
+	to, err := lb.controlTarget(target)
+	if err != nil {
+		lb.stats.evictNoticeErrors.Add(uint64(len(cids)))
+		return
+	}
+	conn.SetWriteDeadline(time.Now().Add(evictNoticeTimeout))
+	for _, cid := range cids {
+		msg := append([]byte{controlEvicted}, cid...)
+		if _, err := conn.WriteTo(msg, to); err != nil {
+			lb.stats.evictNoticeErrors.Add(1)
+			continue
+		}
+		lb.stats.evictionNotices.Add(1)
+	}
+}
+
+// controlTarget resolves a backend's control address on the control network
+func (lb *LoadBalancer) controlTarget(addr string) (net.Addr, error) {
+	if lb.controlNet == "unixgram" {
+		return &net.UnixAddr{Name: addr, Net: "unixgram"}, nil
+	}
+	return net.ResolveUDPAddr(lb.controlNet, addr)
+}
@@ -0,0 +1,52 @@
+package lb
+
+import (
+	"bytes"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/fqzz2000/QUIC-LB-SHRIMP/pkg/packet"
+)
+
+func TestEvictionNotice(t *testing.T) {
+	for _, enabled := range []bool{true, false} {
+		clock := newFakeClock()
+		notices := newTestClient(t)
+		lb := startTestLB(t, Config{
+			Backends:        []BackendConfig{{Address: startEchoBackend(t), ControlAddr: notices.LocalAddr().String()}},
+			ControlAddr:     "127.0.0.1:0",
+			EvictionNotices: enabled,
+			IdleTimeout:     time.Minute,
+			Clock:           clock,
+		})
+		client := newTestClient(t)
+		dcid := []byte{0x01, 0x02, 0x03, 0x04, 0x05, 0x06, 0x07, 0x08}
+		pkt := longHeaderPacket(packet.Initial, dcid, 1200)
+		client.WriteTo(pkt, lb.Addr())
+		readWithin(t, client, time.Second)
+
+		// the flow idles out and the reaper evicts it
+		clock.Advance(2 * time.Minute)
+		lb.reap(clock.Now())
+		if lb.sessions.lookupCID(dcid) != nil {
+			t.Fatalf("flow still tracked after its idle timeout")
+		}
+		if !enabled {
+			if got := lb.Stats().EvictionNotices; got != 0 {
+				t.Errorf("EvictionNotices = %d with notices off, want 0", got)
+			}
+			continue
+		}
+		if got, want := readWithin(t, notices, time.Second), append([]byte{controlEvicted}, dcid...); !bytes.Equal(got, want) {
+			t.Errorf("notice = %x, want %x", got, want)
+		}
+		if got := lb.Stats().EvictionNotices; got != 1 {
+			t.Errorf("EvictionNotices = %d, want 1", got)
+		}
+	}
+
+	if _, err := NewLoadBalancer(Config{Backends: StaticBackends("192.0.2.1:443"), EvictionNotices: true}); !errors.Is(err, errEvictionNotices) {
+		t.Errorf("NewLoadBalancer(no control address) error = %v, want %v", err, errEvictionNotices)
+	}
+}
@@ -0,0 +1,209 @@
+package lb
+
+import (
+	"encoding/gob"
+	"encoding/hex"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"time"
+)
+
+// errNotRunning is returned by operations that need a bound listener
+var errNotRunning = errors.New("load balancer not running")
+
+// FlowRecord is the portable form of one session table entry, used to hand
+// flows to a standby load balancer
+type FlowRecord struct {
+	CIDs       [][]byte // connection IDs indexed for the flow
+	Addrs      []string // client addresses indexed for the flow
+	ClientAddr string   // where responses are currently returned
+	Backend    string
+	Created    time.Time
+	LastSeen   time.Time
+
+	Validated      bool
+	ClientPackets  uint64
+	ClientBytes    uint64
+	BackendPackets uint64 // from the backend, whether or not they reached the client
+	BackendBytes   uint64
+	Initials       uint64 // client datagrams carrying an Initial
+
+	IdleTimeout time.Duration // zero for the importer's own for the backend
+}
+
+// ExportFlows snapshots the session table
+func (lb *LoadBalancer) ExportFlows() []FlowRecord {
+	return lb.sessions.export()
+}
+
+// export returns a record for every flow with the index keys still pointing
+// at it. The flows and keys are a snapshot of one instant; each flow's
+// traffic and client address are read after it, without the table locked.
+func (t *sessionTable) export() []FlowRecord {
+	snap := t.snapshot()
+	records := make([]FlowRecord, 0, len(snap))
+	for _, s := range snap {
+		f := s.flow
+		rec := FlowRecord{Backend: f.Backend, Created: f.Created, IdleTimeout: f.idle, Addrs: s.addrs}
+		for _, cid := range s.cids {
+			rec.CIDs = append(rec.CIDs, []byte(cid))
+		}
+		f.mu.Lock()
+		rec.ClientAddr = f.client.String()
+		rec.LastSeen = f.lastSeen
+		rec.Validated = f.validated
+		f.mu.Unlock()
+		rec.ClientPackets, rec.ClientBytes = f.traffic.clientPackets.Load(), f.traffic.clientBytes.Load()
+		rec.BackendPackets, rec.BackendBytes = f.traffic.backendPackets.Load(), f.traffic.backendBytes.Load()
+		rec.Initials = f.traffic.initials.Load()
+		records = append(records, rec)
+	}
+	return records
+}
+
+// ImportFlows merges exported flows into the session table, opening a
+// backend connection for each. A key already held by a live flow seen more
+// recently than the record stays with that flow; records left with no keys
+// are skipped, as are records for backends this load balancer does not have.
+// It returns how many flows were imported.
+func (lb *LoadBalancer) ImportFlows(records []FlowRecord) (int, error) {
+	if lb.Addr() == nil {
+		return 0, errNotRunning
+	}
+	imported := 0
+	for _, rec := range records {
+		backend, ok := lb.backendByAddress(rec.Backend)
+		if !ok {
+			continue
+		}
+		client, err := lb.parseClientAddr(rec.ClientAddr)
+		if err != nil {
+			continue
+		}
+		flow, err := lb.openFlow(backend, nil, client, nil, nil, rec.Created)
+		if err != nil {
+			return imported, err
+		}
+		if rec.IdleTimeout > 0 {
+			flow.idle = rec.IdleTimeout
+			lb.noteFlowIdle(flow.idle)
+		}
+		// the return goroutine is already running, so fill in under the lock
+		flow.mu.Lock()
+		flow.lastSeen = rec.LastSeen
+		flow.validated = rec.Validated
+		flow.mu.Unlock()
+		flow.traffic.clientPackets.Store(rec.ClientPackets)
+		flow.traffic.clientBytes.Store(rec.ClientBytes)
+		flow.traffic.backendPackets.Store(rec.BackendPackets)
+		flow.traffic.backendBytes.Store(rec.BackendBytes)
+		flow.traffic.initials.Store(rec.Initials)
+		if !lb.sessions.merge(flow, rec) {
+			flow.conn.Close()
+			continue
+		}
+		imported++
+	}
+	return imported, nil
+}
+
+// merge indexes an imported flow under every key of rec not held by a flow
+// seen at or after rec.LastSeen, reporting whether it claimed any
+func (t *sessionTable) merge(f *Flow, rec FlowRecord) bool {
+	home := t.home(f)
+	home.flowsMu.Lock()
+	defer home.flowsMu.Unlock()
+	newer := func(existing *Flow) bool {
+		if existing == nil {
+			return false
+		}
+		existing.mu.Lock()
+		defer existing.mu.Unlock()
+		return !existing.lastSeen.Before(rec.LastSeen)
+	}
+
+	keys := &flowKeys{}
+	for _, cid := range rec.CIDs {
+		if len(cid) > 0 && !newer(t.lookupCID(cid)) {
+			keys.cids = append(keys.cids, string(cid))
+		}
+	}
+	for _, a := range rec.Addrs {
+		if !newer(t.shardOf(a).addrOwner(a)) {
+			keys.addrs = append(keys.addrs, a)
+		}
+	}
+	if len(keys.cids) == 0 && len(keys.addrs) == 0 {
+		return false
+	}
+	for _, cid := range keys.cids {
+		t.setCID(cid, f)
+	}
+	for _, a := range keys.addrs {
+		t.setAddr(a, f)
+	}
+	home.keys[f] = keys
+	home.backendFlows[f.Backend]++
+	return true
+}
+
+// parseClientAddr parses a client address in the listener's network
+func (lb *LoadBalancer) parseClientAddr(s string) (net.Addr, error) {
+	if lb.listenNet == "unixgram" {
+		return &net.UnixAddr{Name: s, Net: "unixgram"}, nil
+	}
+	return net.ResolveUDPAddr("udp", s)
+}
+
+// WriteFlowRecords writes records to w in a gob stream
+func WriteFlowRecords(w io.Writer, records []FlowRecord) error {
+	return gob.NewEncoder(w).Encode(records)
+}
+
+// ReadFlowRecords reads records written by WriteFlowRecords
+func ReadFlowRecords(r io.Reader) ([]FlowRecord, error) {
+	var records []FlowRecord
+	err := gob.NewDecoder(r).Decode(&records)
+	return records, err
+}
+
+// flowView is one flow in the /flows API
+type flowView struct {
+	CIDs           []string `json:"cids,omitempty"`
+	ClientAddr     string   `json:"client_addr"`
+	Backend        string   `json:"backend"`
+	Created        string   `json:"created"`
+	LastSeen       string   `json:"last_seen"`
+	Validated      bool     `json:"validated"`
+	ClientPackets  uint64   `json:"client_packets"`
+	ClientBytes    uint64   `json:"client_bytes"`
+	BackendPackets uint64   `json:"backend_packets"`
+	BackendBytes   uint64   `json:"backend_bytes"`
+	Initials       uint64   `json:"initials"`
+}
+
+// handleListFlows lists the session table with each flow's traffic
+func (lb *LoadBalancer) handleListFlows(w http.ResponseWriter, r *http.Request) {
+	views := []flowView{}
+	for _, rec := range lb.ExportFlows() {
+		v := flowView{
+			ClientAddr:     rec.ClientAddr,
+			Backend:        rec.Backend,
+			Created:        rec.Created.UTC().Format(time.RFC3339),
+			LastSeen:       rec.LastSeen.UTC().Format(time.RFC3339),
+			Validated:      rec.Validated,
+			ClientPackets:  rec.ClientPackets,
+			ClientBytes:    rec.ClientBytes,
+			BackendPackets: rec.BackendPackets,
+			BackendBytes:   rec.BackendBytes,
+			Initials:       rec.Initials,
+		}
+		for _, cid := range rec.CIDs {
+			v.CIDs = append(v.CIDs, hex.EncodeToString(cid))
+		}
+		views = append(views, v)
+	}
+	writeJSON(w, http.StatusOK, views)
+}
@@ -0,0 +1,140 @@
+package lb
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestExportImportFlowsRoundTrip(t *testing.T) {
+	backend := startEchoBackend(t)
+	primary := startTestLB(t, Config{Backends: StaticBackends(backend)})
+
+	client := newTestClient(t)
+	cid, _ := primary.routes().codec.Encode(0, []byte{0x00}, nil)
+	client.WriteTo(append([]byte{0x40}, cid...), primary.Addr())
+	if readWithin(t, client, time.Second) == nil {
+		t.Fatalf("no response from primary")
+	}
+
+	var wire bytes.Buffer
+	if err := WriteFlowRecords(&wire, primary.ExportFlows()); err != nil {
+		t.Fatalf("WriteFlowRecords() error = %v", err)
+	}
+	records, err := ReadFlowRecords(&wire)
+	if err != nil {
+		t.Fatalf("ReadFlowRecords() error = %v", err)
+	}
+	if len(records) != 1 {
+		t.Fatalf("exported %d records, want 1", len(records))
+	}
+	rec := records[0]
+	if rec.Backend != backend || rec.ClientAddr != client.LocalAddr().String() || len(rec.CIDs) != 1 || !bytes.Equal(rec.CIDs[0], cid) {
+		t.Fatalf("record = %+v", rec)
+	}
+	if !rec.Validated || rec.BackendPackets != 1 {
+		t.Errorf("record lost flow state: validated %v, backend packets %d", rec.Validated, rec.BackendPackets)
+	}
+
+	standby := startTestLB(t, Config{Backends: StaticBackends(backend)})
+	if n, err := standby.ImportFlows(records); err != nil || n != 1 {
+		t.Fatalf("ImportFlows() = (%d, %v), want 1", n, err)
+	}
+	flow := standby.sessions.lookup(cid, testAddr(99))
+	if flow == nil || flow.Backend != backend || !flow.Created.Equal(rec.Created) {
+		t.Fatalf("imported flow = %+v", flow)
+	}
+	// the imported flow returns responses to the client it was exported with
+	flow.conn.Write([]byte("after failover"))
+	if got := readWithin(t, client, time.Second); string(got) != "after failover" {
+		t.Errorf("client received %q through the standby", got)
+	}
+}
+
+func TestImportFlowsKeepsNewerLiveEntries(t *testing.T) {
+	backend := startEchoBackend(t)
+	lb := startTestLB(t, Config{Backends: StaticBackends(backend)})
+	now := time.Now()
+
+	live := &Flow{Backend: backend, Created: now, client: testAddr(1), lastSeen: now, conn: nopConn{}}
+	lb.sessions.remember(live, []byte{0x01}, testAddr(1))
+
+	records := []FlowRecord{
+		// stale on the shared CID, but its own address is free
+		{CIDs: [][]byte{{0x01}}, Addrs: []string{testAddr(2).String()}, ClientAddr: testAddr(2).String(), Backend: backend, LastSeen: now.Add(-time.Minute)},
+		// nothing left to claim
+		{CIDs: [][]byte{{0x01}}, ClientAddr: testAddr(3).String(), Backend: backend, LastSeen: now.Add(-time.Minute)},
+		// unknown backend
+		{CIDs: [][]byte{{0x02}}, ClientAddr: testAddr(4).String(), Backend: "elsewhere:443", LastSeen: now},
+		// newer than the live flow, so it takes the CID
+		{CIDs: [][]byte{{0x03}}, ClientAddr: testAddr(5).String(), Backend: backend, LastSeen: now.Add(time.Minute)},
+	}
+	lb.sessions.remember(live, []byte{0x03}, testAddr(1))
+
+	n, err := lb.ImportFlows(records)
+	if err != nil || n != 2 {
+		t.Fatalf("ImportFlows() = (%d, %v), want 2", n, err)
+	}
+	if got := lb.sessions.lookup([]byte{0x01}, testAddr(99)); got != live {
+		t.Errorf("CID 01 moved off the newer live flow")
+	}
+	if got := lb.sessions.lookup(nil, testAddr(2)); got == nil || got == live {
+		t.Errorf("address of the stale record was not imported")
+	}
+	if got := lb.sessions.lookup([]byte{0x03}, testAddr(99)); got == nil || got == live {
+		t.Errorf("CID 03 stayed with the older live flow")
+	}
+}
+
+func TestImportFlowsRequiresRunning(t *testing.T) {
+	lb, _ := NewLoadBalancer(Config{Backends: StaticBackends("backend0")})
+	if _, err := lb.ImportFlows(nil); !errors.Is(err, errNotRunning) {
+		t.Errorf("ImportFlows() error = %v, want %v", err, errNotRunning)
+	}
+}
+
+func TestFlowTrafficAccounting(t *testing.T) {
+	fwd := memForwarder{opened: make(chan *memConn, 1)}
+	lb, listener := newMemLB(t, Config{Backends: []BackendConfig{{Address: "192.0.2.100:443", Forwarder: fwd}}})
+	cid, _ := lb.routes().codec.Encode(0, []byte{0x00}, nil)
+
+	// three client datagrams of 100 bytes, two backend ones of 300
+	for i := 0; i < 3; i++ {
+		pkt := append(append([]byte{0x40}, cid...), make([]byte, 100-1-len(cid))...)
+		if err := lb.handlePacket(pkt, testAddr(1)); err != nil {
+			t.Fatalf("handlePacket() error = %v", err)
+		}
+	}
+	conn := expect(t, fwd.opened)
+	for i := 0; i < 3; i++ {
+		expect(t, conn.sent)
+	}
+	for i := 0; i < 2; i++ {
+		conn.recv <- append([]byte{0x40, 0xcc}, make([]byte, 298)...)
+		expect(t, listener.sent)
+	}
+
+	records := lb.ExportFlows()
+	if len(records) != 1 {
+		t.Fatalf("exported %d records, want 1", len(records))
+	}
+	rec := records[0]
+	if rec.ClientPackets != 3 || rec.ClientBytes != 300 || rec.BackendPackets != 2 || rec.BackendBytes != 600 {
+		t.Errorf("client %d packets %d bytes, backend %d packets %d bytes; want 3, 300, 2, 600",
+			rec.ClientPackets, rec.ClientBytes, rec.BackendPackets, rec.BackendBytes)
+	}
+
+	rw := httptest.NewRecorder()
+	lb.adminHandler().ServeHTTP(rw, httptest.NewRequest(http.MethodGet, "/flows", nil))
+	var views []flowView
+	if err := json.NewDecoder(rw.Body).Decode(&views); err != nil {
+		t.Fatalf("GET /flows body did not decode: %v", err)
+	}
+	if len(views) != 1 || views[0].ClientBytes != 300 || views[0].BackendBytes != 600 || views[0].Backend != "192.0.2.100:443" {
+		t.Errorf("GET /flows = %+v, want the flow with 300 client and 600 backend bytes", views)
+	}
+}
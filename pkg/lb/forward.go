@@ -0,0 +1,379 @@
+package lb
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"syscall"
+	"time"
+
+	"github.com/fqzz2000/QUIC-LB-SHRIMP/pkg/packet"
+)
+
+// maxPacketSize is the read buffer size for QUIC datagrams (typical MTU size)
+const maxPacketSize = 1500
+
+// handlePacket routes one client datagram to its backend, creating a flow on first sight
+func (lb *LoadBalancer) handlePacket(pkt []byte, src net.Addr) error {
+	var res DecodeResult
+	return lb.handleDatagram(pkt, src, nil, &res, nil)
+}
+
+// handleDatagram is handlePacket for a datagram that arrived on ln, nil for
+// the main listener, recording in res what routing decided. With a non-nil
+// held, a write the batch can send is left there rather than made.
+func (lb *LoadBalancer) handleDatagram(pkt []byte, src net.Addr, ln *clientListener, res *DecodeResult, held *heldWrite) error {
+	start := lb.slow.start()
+	// client is whom the datagram is routed for: src, or the client an outer
+	// load balancer names
+	pkt, client, clientDst, err := lb.proxiedClient(pkt, src)
+	if err != nil {
+		return err
+	}
+	// every step parses with the DCID length of the listener pkt arrived on
+	processor := lb.processor(ln)
+	header, err := lb.parseHeader(pkt, processor)
+	if err != nil {
+		return err
+	}
+	if ptype, err := header.GetPacketType(); err == nil {
+		lb.metrics.countPacketType(ptype)
+	}
+	if lb.checkLengths {
+		if err := processor.CheckLengths(pkt); err != nil {
+			lb.stats.corruptPackets.Add(1)
+			return err
+		}
+	}
+	// measured before anything is filtered or split off the datagram
+	if err := lb.checkInitialSize(processor, pkt); err != nil {
+		return err
+	}
+	*res = newDecodeResult(header)
+	cid, form, ptype := res.CID, res.HeaderForm, res.PacketType
+	if err := lb.checkMinCID(cid); err != nil {
+		return err
+	}
+	now := lb.clock.Now()
+	size := len(pkt)
+	reordered, routeType, err := lb.checkCoalesced(processor, pkt, ptype)
+	if err != nil {
+		return err
+	}
+	if reordered != nil {
+		// routed and forwarded as if the client had sent them in order
+		pkt = reordered
+		if header, err = lb.parseHeader(pkt, processor); err != nil {
+			return err
+		}
+		*res = newDecodeResult(header)
+		cid = res.CID
+	}
+	ptype = routeType
+	if pkt, err = lb.checkTrailing(processor, pkt); err != nil {
+		return err
+	}
+
+	if lb.forwardTypes != 0 {
+		if pkt = lb.filterTypes(processor, pkt); len(pkt) == 0 {
+			return errPacketTypeFiltered
+		}
+		// the first packet may have been filtered out
+		ptype, _ = processor.ClassifyPacket(pkt)
+		res.PacketType = ptype
+	}
+
+	if form == 0 || (ptype != packet.Initial && ptype != packet.ZeroRTT) {
+		lb.countRetiring(cid, now)
+	}
+
+	// 0-RTT is set aside before routing; the datagram still opens the flow
+	var early [][]byte
+	if lb.zeroRTT != zeroRTTForward {
+		pkt, early = lb.splitZeroRTT(processor, pkt)
+		if early != nil && lb.zeroRTT == zeroRTTDrop {
+			lb.stats.zeroRTTDropped.Add(uint64(len(early)))
+			if len(pkt) == 0 {
+				return errZeroRTTDropped
+			}
+			early = nil
+		}
+	}
+
+	var proxy []byte
+	var flow *Flow
+	if form == 0 && !processor.SelfEncodedCIDLength {
+		var matched []byte
+		flow, matched = lb.sessions.lookupShort(pkt, cid, src)
+		if len(matched) != len(cid) {
+			lb.stats.learnedCIDLengths.Add(1)
+		}
+		cid, res.CID = matched, matched
+	} else {
+		flow = lb.sessions.lookup(cid, src)
+	}
+	first := flow == nil
+	if !first {
+		// an open flow's packet is routed by the lookup
+		lb.slow.check(start, src, res)
+	}
+	switch {
+	case first && lb.Draining():
+		lb.stats.drainRefused.Add(1)
+		return errDraining
+	case first:
+		if err := lb.admitSourceFlow(addrIP(client)); err != nil {
+			return err
+		}
+		if err := lb.admitNewFlow(addrIP(client), now); err != nil {
+			return err
+		}
+		if err := lb.checkRetryToken(header, pkt); err != nil {
+			return err
+		}
+		backend, canary := lb.canaryBackend(header, pkt)
+		if canary {
+			res.chose(backend, RouteCanary)
+		} else {
+			res.token = lb.initialToken(header, pkt)
+			backend, err = lb.selectRoute(res, client, lb.routeMissFor(form, ptype))
+		}
+		lb.slow.check(start, src, res)
+		if errors.Is(err, errUnknownCID) {
+			return lb.sendStatelessReset(pkt, cid, src, ln)
+		}
+		if errors.Is(err, errDrainingBackend) {
+			return lb.redirectDraining(header, size, src, client, ln, err)
+		}
+		if err != nil {
+			return err
+		}
+		lb.checkNonce(res, client)
+		if err := lb.negotiateVersion(backend, header, size, src, ln); err != nil {
+			return err
+		}
+		if flow, err = lb.openFlow(backend, res, src, ln, clientCID(header), now); err != nil {
+			return err
+		}
+		if lb.sourceFlowCap > 0 {
+			flow.source = addrIP(client)
+		}
+		if lb.mirrorSampled() {
+			lb.openShadow(flow)
+		}
+		if backend.ProxyProtocol {
+			if clientDst == nil {
+				clientDst = lb.destAddr(src, ln)
+			}
+			proxy = proxyHeader(client, clientDst)
+		}
+	case form == 0:
+		// a short header keeps its CID across NAT rebinding, so its source
+		// is the client's current address for the return path
+		flow.touch(src, now)
+		res.Backend, res.Route = flow.Backend, RouteFlow
+	default:
+		flow.touch(nil, now)
+		res.Backend, res.Route = flow.Backend, RouteFlow
+	}
+	lb.sessions.remember(flow, cid, src)
+	if first {
+		lb.sessions.learnClientCID(flow, clientCID(header))
+	}
+	flow.received(size, validatesAddress(ptype))
+	if ptype == packet.Initial && flow.countInitial(now) {
+		lb.stats.initialRetransmits.Add(1)
+	}
+
+	if form == 0 && lb.zeroRTT == zeroRTTDelay {
+		// 1-RTT means the handshake is done; held 0-RTT goes first
+		lb.writeZeroRTT(flow, flow.releaseZeroRTT())
+	}
+	if lb.zeroRTTLimit > 0 && lb.zeroRTT == zeroRTTForward {
+		if form == 0 {
+			flow.sawOneRTT()
+		} else if lb.carriesZeroRTT(processor, pkt) {
+			flow.sentZeroRTT()
+		}
+	}
+	if early != nil {
+		if len(pkt) > 0 {
+			lb.delayZeroRTT(flow, early, nil)
+		} else {
+			lb.delayZeroRTT(flow, early, proxy)
+			return nil
+		}
+	}
+
+	// cid aliases pkt, so rewriting waits until the flow is indexed
+	if lb.rewriteCIDs {
+		pkt = lb.rewriteOutbound(flow, pkt)
+	}
+	out := pkt
+	if proxy != nil {
+		out = append(proxy, pkt...)
+	}
+	if err := lb.admitEgress(flow, len(out), now); err != nil {
+		return err
+	}
+	if held != nil && held.hold(flow.conn, out, client) {
+		lb.mirror(flow, pkt, first, client)
+		return nil
+	}
+	n, err := flow.conn.Write(out)
+	if err = lb.checkWrite(n, len(out), err); err == nil {
+		lb.logs.routed(client, res)
+	}
+	lb.mirror(flow, pkt, first, client)
+	return err
+}
+
+// checkWrite turns a datagram write that reports fewer bytes than the
+// datagram into an io.ErrShortWrite failure. Whatever went out was a
+// truncated datagram its receiver discards; it is counted rather than
+// retried, since a count that was itself wrong would make the retry a
+// duplicate on the wire.
+func (lb *LoadBalancer) checkWrite(n, want int, err error) error {
+	if err != nil || n >= want {
+		return err
+	}
+	lb.stats.shortWrites.Add(1)
+	return fmt.Errorf("%w: wrote %d of %d bytes", io.ErrShortWrite, n, want)
+}
+
+// openFlow connects a new flow to its backend and starts relaying its
+// responses to the client through ln, nil for the main listener. clientCID,
+// the CID the client chose for itself if known, lets responses on a shared
+// backend socket find the flow.
+func (lb *LoadBalancer) openFlow(backend BackendConfig, res *DecodeResult, client net.Addr, ln *clientListener, clientCID []byte, now time.Time) (*Flow, error) {
+	conn, err := lb.dialBackend(backend, client, clientCID)
+	if err != nil {
+		return nil, err
+	}
+	flow := &Flow{
+		Backend:  backend.Address,
+		Created:  now,
+		idle:     lb.timeouts.idleFor(backend, res),
+		client:   client,
+		lastSeen: now,
+		conn:     conn,
+		egress:   lb.egress.bucket(backend, now),
+		ln:       ln,
+	}
+	lb.noteFlowIdle(flow.idle)
+	lb.flowWG.Add(1)
+	go lb.returnLoop(flow)
+	return flow, nil
+}
+
+// returnLoop relays backend responses for a flow to the client's latest address
+func (lb *LoadBalancer) returnLoop(flow *Flow) {
+	defer lb.flowWG.Done()
+	buf := make([]byte, maxPacketSize)
+	refused := false
+	for {
+		n, err := flow.conn.Read(buf)
+		if err != nil {
+			if !isUnreachable(err) {
+				return
+			}
+			// the kernel reports ICMP unreachable on the connected socket as a
+			// read error; the socket stays usable, so mark the backend down
+			// and keep reading in case it comes back
+			lb.stats.backendUnreachable.Add(1)
+			if !refused {
+				refused = true
+				lb.SetBackendHealth(flow.Backend, false)
+				if lb.debug {
+					log.Printf("Backend %s unreachable: %v", flow.Backend, err)
+				}
+			}
+			continue
+		}
+		if refused {
+			refused = false
+			lb.SetBackendHealth(flow.Backend, true)
+		}
+		to := lb.replyFlow(flow, buf[:n])
+		to.responded(n, lb.clock.Now())
+		resp := buf[:n]
+		if lb.rewriteCIDs {
+			resp = lb.rewriteInbound(to, resp)
+		}
+		if !to.allowSend(len(resp), lb.ampFactor) {
+			lb.stats.amplificationDrops.Add(1)
+			continue
+		}
+		if !to.allowEarlyReturn(len(resp), lb.zeroRTTLimit) {
+			lb.stats.zeroRTTReturnDrops.Add(1)
+			continue
+		}
+		written, err := lb.clientConn(to.ln).WriteTo(resp, to.ClientAddr())
+		if err = lb.checkWrite(written, len(resp), err); err != nil && lb.debug {
+			log.Printf("Return write to %s failed: %v", to.ClientAddr(), err)
+		}
+	}
+}
+
+// clientCID returns the connection ID a client chose for itself, the SCID of
+// its long headers, or nil for a short header
+func clientCID(header packet.QuicHeader) []byte {
+	if lh, ok := header.(*packet.LongHeader); ok {
+		return lh.SCID
+	}
+	return nil
+}
+
+// isUnreachable reports whether a backend socket error is an ICMP
+// unreachable report rather than the socket being closed
+func isUnreachable(err error) bool {
+	return errors.Is(err, syscall.ECONNREFUSED) || errors.Is(err, syscall.EHOSTUNREACH) || errors.Is(err, syscall.ENETUNREACH)
+}
+
+// replyFlow returns the flow a backend reply read on flow's socket belongs
+// to. A long header names its client by DCID, the CID the client chose for
+// itself, so it goes to the flow that client opened to the same backend
+// even when another flow's socket carried it; short headers, whose DCID
+// length is unknown here, and unmatched DCIDs stay with the socket's flow.
+// The CID the backend chose, a long header's SCID, is indexed for the flow
+// so client packets addressed to it find the flow even when that CID does
+// not decode or the client's address has changed.
+func (lb *LoadBalancer) replyFlow(flow *Flow, pkt []byte) *Flow {
+	if len(pkt) == 0 || pkt[0]&0x80 == 0 {
+		return flow
+	}
+	header, err := lb.processor(flow.ln).ParsePacket(pkt)
+	if err != nil {
+		return flow
+	}
+	to := flow
+	if lh, ok := header.(*packet.LongHeader); ok && len(lh.DCID) > 0 {
+		if f := lb.sessions.lookupClientCID(flow.Backend, lh.DCID); f != nil && f != flow {
+			lb.stats.repliesByDCID.Add(1)
+			to = f
+		}
+	}
+	if cid, ok := packet.RoutingCID(header, packet.ServerToClient); ok {
+		lb.sessions.learnCID(to, cid)
+	}
+	return to
+}
+
+// closeFlow removes a flow from the session table and closes its sockets,
+// which ends its return goroutine
+func (lb *LoadBalancer) closeFlow(flow *Flow) {
+	lb.sessions.remove(flow)
+	flow.conn.Close()
+	if flow.shadow != nil {
+		flow.shadow.Close()
+	}
+}
+
+// closeFlows closes every flow and empties the session table
+func (lb *LoadBalancer) closeFlows() {
+	for _, flow := range lb.sessions.flows() {
+		lb.closeFlow(flow)
+	}
+}
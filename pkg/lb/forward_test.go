@@ -0,0 +1,406 @@
+package lb
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"net"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/fqzz2000/QUIC-LB-SHRIMP/pkg/packet"
+)
+
+// startEchoBackend runs a UDP server that echoes every datagram back to its sender
+func startEchoBackend(t *testing.T) string {
+	t.Helper()
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("ListenPacket() error = %v", err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	go func() {
+		buf := make([]byte, maxPacketSize)
+		for {
+			n, addr, err := conn.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			conn.WriteTo(buf[:n], addr)
+		}
+	}()
+	return conn.LocalAddr().String()
+}
+
+// startTestLB starts a load balancer on a loopback port and shuts it down with the test
+func startTestLB(t *testing.T, cfg Config) *LoadBalancer {
+	t.Helper()
+	if cfg.ListenAddr == "" {
+		cfg.ListenAddr = "127.0.0.1:0"
+	}
+	lb, err := NewLoadBalancer(cfg)
+	if err != nil {
+		t.Fatalf("NewLoadBalancer() error = %v", err)
+	}
+	if err := lb.Start(); err != nil {
+		t.Fatalf("Start() error = %v", err)
+	}
+	t.Cleanup(func() { lb.Shutdown() })
+	return lb
+}
+
+// newTestClient opens a loopback UDP socket acting as a QUIC client
+func newTestClient(t *testing.T) net.PacketConn {
+	t.Helper()
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("ListenPacket() error = %v", err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	return conn
+}
+
+// readWithin reads one datagram, returning nil if none arrives before the timeout
+func readWithin(t *testing.T, conn net.PacketConn, timeout time.Duration) []byte {
+	t.Helper()
+	buf := make([]byte, maxPacketSize)
+	conn.SetReadDeadline(time.Now().Add(timeout))
+	n, _, err := conn.ReadFrom(buf)
+	if errors.Is(err, os.ErrDeadlineExceeded) {
+		return nil
+	}
+	if err != nil {
+		t.Fatalf("ReadFrom() error = %v", err)
+	}
+	return buf[:n]
+}
+
+// testAddr returns a distinct documentation-range client address
+func testAddr(n int) net.Addr {
+	return &net.UDPAddr{IP: net.IPv4(192, 0, 2, byte(n)), Port: 4433}
+}
+
+// nopConn is a backend connection for flows built directly in tests
+type nopConn struct{ net.Conn }
+
+func (nopConn) Write(p []byte) (int, error) { return len(p), nil }
+func (nopConn) Close() error                { return nil }
+
+func TestForwardReturnsToRebindedClient(t *testing.T) {
+	backend := startEchoBackend(t)
+	lb := startTestLB(t, Config{Backends: StaticBackends(backend)})
+
+	cid, err := lb.routes().codec.Encode(0, []byte{0x00}, nil)
+	if err != nil {
+		t.Fatalf("Encode() error = %v", err)
+	}
+	pkt := append(append([]byte{0x40}, cid...), []byte("payload")...)
+
+	oldPort := newTestClient(t)
+	if _, err := oldPort.WriteTo(pkt, lb.Addr()); err != nil {
+		t.Fatalf("WriteTo() error = %v", err)
+	}
+	if got := readWithin(t, oldPort, time.Second); !bytes.Equal(got, pkt) {
+		t.Fatalf("response on original port = %x, want %x", got, pkt)
+	}
+
+	// the NAT rebinds: same CID, new source port
+	newPort := newTestClient(t)
+	if _, err := newPort.WriteTo(pkt, lb.Addr()); err != nil {
+		t.Fatalf("WriteTo() error = %v", err)
+	}
+	if got := readWithin(t, newPort, time.Second); !bytes.Equal(got, pkt) {
+		t.Fatalf("response on rebound port = %x, want %x", got, pkt)
+	}
+	if got := readWithin(t, oldPort, 100*time.Millisecond); got != nil {
+		t.Errorf("stale port received %x after rebinding", got)
+	}
+
+	if n := len(lb.sessions.flows()); n != 1 {
+		t.Errorf("session table holds %d flows, want 1", n)
+	}
+}
+
+func TestServerSCIDFindsClientFlow(t *testing.T) {
+	// a CID under the inactive rotation 3, so only a learned mapping can route it
+	serverCID := []byte{0xc0, 0x5e, 0x5e, 0x5e, 0x5e, 0x5e, 0x5e, 0x5e}
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("ListenPacket() error = %v", err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	go func() {
+		buf := make([]byte, maxPacketSize)
+		for {
+			_, addr, err := conn.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			// the server's Initial names its chosen CID in the SCID
+			reply := []byte{0xc0, 0x00, 0x00, 0x00, 0x01, 0x00, byte(len(serverCID))}
+			conn.WriteTo(append(reply, serverCID...), addr)
+		}
+	}()
+	lb := startTestLB(t, Config{Backends: StaticBackends(conn.LocalAddr().String())})
+
+	client := newTestClient(t)
+	client.WriteTo(longHeaderPacket(packet.Initial, bytes.Repeat([]byte{0xee}, 8), 1200), lb.Addr())
+	if readWithin(t, client, time.Second) == nil {
+		t.Fatalf("no server Initial")
+	}
+
+	flows := lb.sessions.flows()
+	if len(flows) != 1 {
+		t.Fatalf("session table holds %d flows, want 1", len(flows))
+	}
+	elsewhere := &net.UDPAddr{IP: net.IPv4(198, 51, 100, 7), Port: 9}
+	if got := lb.sessions.lookup(serverCID, elsewhere); got != flows[0] {
+		t.Fatalf("lookup(server SCID) = %p, want the client's flow %p", got, flows[0])
+	}
+
+	// the client's short header addressed to the server's CID joins that flow
+	rebound := newTestClient(t)
+	rebound.WriteTo(append([]byte{0x40}, serverCID...), lb.Addr())
+	if readWithin(t, rebound, time.Second) == nil {
+		t.Fatalf("no response to short header on the learned CID")
+	}
+	if n := len(lb.sessions.flows()); n != 1 {
+		t.Errorf("session table holds %d flows, want 1", n)
+	}
+}
+
+func TestCheckLengths(t *testing.T) {
+	dcid := []byte{0x00, 0x01, 1, 1, 1, 1, 1, 1}
+	good := quicLongHeader(packet.Initial, dcid, []byte{0xcc}, make([]byte, 1200))
+	// the Length field's top bits flipped to claim far more than was sent
+	corrupt := append([]byte(nil), good...)
+	corrupt[17] ^= 0x3f
+
+	tests := []struct {
+		name    string
+		check   bool
+		pkt     []byte
+		wantErr error
+	}{
+		{name: "Consistent", check: true, pkt: good},
+		{name: "Length Past Datagram", check: true, pkt: corrupt, wantErr: packet.ErrInconsistentLengths},
+		{name: "Unchecked", pkt: corrupt},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fwd := memForwarder{opened: make(chan *memConn, 1)}
+			lb, _ := newMemLB(t, Config{
+				Backends:     []BackendConfig{{Address: "192.0.2.100:443", Forwarder: fwd}, {Address: "192.0.2.101:443", Forwarder: fwd}},
+				CheckLengths: tt.check,
+			})
+			if err := lb.handlePacket(tt.pkt, testAddr(1)); !errors.Is(err, tt.wantErr) {
+				t.Fatalf("handlePacket() error = %v, want %v", err, tt.wantErr)
+			}
+			wantCorrupt := uint64(0)
+			if tt.wantErr != nil {
+				wantCorrupt = 1
+			}
+			if got := lb.Stats().CorruptPackets; got != wantCorrupt {
+				t.Errorf("CorruptPackets = %d, want %d", got, wantCorrupt)
+			}
+			if n := len(lb.sessions.flows()); n != 1-int(wantCorrupt) {
+				t.Errorf("opened %d flows, want %d", n, 1-int(wantCorrupt))
+			}
+		})
+	}
+}
+
+// shortConn reports writing one byte less than each datagram
+type shortConn struct{ net.Conn }
+
+func (shortConn) Write(p []byte) (int, error) { return len(p) - 1, nil }
+func (shortConn) Close() error                { return nil }
+
+func TestShortWriteIsFailure(t *testing.T) {
+	lb, _ := newMemLB(t, Config{Backends: StaticBackends("192.0.2.100:443")})
+	dcid := []byte{0x00, 0x00, 1, 1, 1, 1, 1, 1}
+	lb.sessions.remember(&Flow{Backend: "192.0.2.100:443", conn: shortConn{}}, dcid, testAddr(1))
+	pkt := append(append([]byte{0x40}, dcid...), 0x01, 0x02)
+
+	if err := lb.handlePacket(pkt, testAddr(1)); !errors.Is(err, io.ErrShortWrite) {
+		t.Fatalf("handlePacket() error = %v, want %v", err, io.ErrShortWrite)
+	}
+	lb.process(inbound{pkt: pkt, src: testAddr(1)})
+	stats := lb.Stats()
+	if stats.ShortWrites != 2 {
+		t.Errorf("ShortWrites = %d, want 2", stats.ShortWrites)
+	}
+	if stats.PacketsDropped != 1 || stats.PacketsForwarded != 0 {
+		t.Errorf("dropped %d and forwarded %d, want the short write dropped", stats.PacketsDropped, stats.PacketsForwarded)
+	}
+}
+
+func TestCIDLengthRotation(t *testing.T) {
+	fwd := memForwarder{opened: make(chan *memConn, 2)}
+	lb, listener := newMemLB(t, Config{
+		Backends: []BackendConfig{{Address: "192.0.2.100:443", Forwarder: fwd}, {Address: "192.0.2.101:443", Forwarder: fwd}},
+	})
+	initial := quicLongHeader(packet.Initial, []byte{0x00, 0x01, 1, 1, 1, 1, 1, 1}, []byte{0xcc}, make([]byte, 1200))
+	if err := lb.handlePacket(initial, testAddr(1)); err != nil {
+		t.Fatalf("handlePacket(Initial) error = %v", err)
+	}
+	conn := expect(t, fwd.opened)
+	expect(t, conn.sent)
+
+	// the server moves the connection to a longer CID, then a shorter one;
+	// each short header after is found from a new client address, so only
+	// its CID can match the flow
+	for i, serverCID := range [][]byte{bytes.Repeat([]byte{0xb1}, 12), {0xb2, 0xb2, 0xb2, 0xb2, 0xb2}} {
+		conn.recv <- quicLongHeader(packet.HandShake, []byte{0xcc}, serverCID, make([]byte, 40))
+		expect(t, listener.sent)
+
+		client := testAddr(2 + i)
+		short := append(append([]byte{0x40}, serverCID...), make([]byte, 30)...)
+		if err := lb.handlePacket(short, client); err != nil {
+			t.Fatalf("handlePacket(%d byte DCID) error = %v", len(serverCID), err)
+		}
+		if got := expect(t, conn.sent); !bytes.Equal(got, short) {
+			t.Errorf("flow received %x, want the %d byte DCID short header", got, len(serverCID))
+		}
+		if n := len(fwd.opened); n != 0 {
+			t.Fatalf("%d byte DCID opened another flow, want the existing one", len(serverCID))
+		}
+		flow := lb.sessions.lookup(serverCID, testAddr(9))
+		if flow == nil || flow.ClientAddr().String() != client.String() {
+			t.Errorf("flow for %x does not return to %s", serverCID, client)
+		}
+	}
+	if got := lb.Stats().LearnedCIDLengths; got != 2 {
+		t.Errorf("LearnedCIDLengths = %d, want 2", got)
+	}
+}
+
+// captureConn records the slices flows write to it, uncopied
+type captureConn struct {
+	nopConn
+	writes [][]byte
+}
+
+func (c *captureConn) Write(p []byte) (int, error) {
+	c.writes = append(c.writes, p)
+	return len(p), nil
+}
+
+func TestForwardVerbatim(t *testing.T) {
+	// the datagram goes to the backend as the very slice it was read into
+	lb, err := InitLoadBalancer("127.0.0.1:0", []string{"backend0", "backend1"})
+	if err != nil {
+		t.Fatalf("InitLoadBalancer() error = %v", err)
+	}
+	cid, _ := lb.routes().codec.Encode(0, []byte{0x01}, nil)
+	conn := &captureConn{}
+	lb.sessions.remember(&Flow{Backend: "backend1", conn: conn}, cid, testAddr(1))
+	pkt := append(append([]byte{0x40}, cid...), bytes.Repeat([]byte{0xa5}, 1000)...)
+	want := append([]byte(nil), pkt...)
+	if err := lb.handlePacket(pkt, testAddr(1)); err != nil {
+		t.Fatalf("handlePacket() error = %v", err)
+	}
+	if len(conn.writes) != 1 || &conn.writes[0][0] != &pkt[0] || !bytes.Equal(conn.writes[0], want) {
+		t.Errorf("backend got %d writes, want the received slice itself", len(conn.writes))
+	}
+
+	// and through the listener's pooled buffers, where each read reuses one a
+	// longer datagram filled before
+	fwd := memForwarder{opened: make(chan *memConn, 1)}
+	live := startTestLB(t, Config{Backends: []BackendConfig{{Address: "192.0.2.100:443", Forwarder: fwd}}})
+	client := newTestClient(t)
+	dcid := []byte{0x01, 0x02, 0x03, 0x04, 0x05, 0x06, 0x07, 0x08}
+	sent := [][]byte{
+		longHeaderPacket(packet.Initial, dcid, 1200),
+		longHeaderPacket(packet.HandShake, dcid, 90),
+		longHeaderPacket(packet.HandShake, dcid, 1400),
+		longHeaderPacket(packet.HandShake, dcid, 41),
+	}
+	for _, p := range sent {
+		client.WriteTo(p, live.Addr())
+	}
+	backend := expect(t, fwd.opened)
+	for i, p := range sent {
+		if got := expect(t, backend.sent); !bytes.Equal(got, p) {
+			t.Errorf("datagram %d forwarded as %d bytes, want the %d received exactly", i, len(got), len(p))
+		}
+	}
+}
+
+func TestForwardAllocatesNoPacketBytes(t *testing.T) {
+	lb, err := InitLoadBalancer("127.0.0.1:0", []string{"backend0", "backend1"})
+	if err != nil {
+		t.Fatalf("InitLoadBalancer() error = %v", err)
+	}
+	cid, _ := lb.routes().codec.Encode(0, []byte{0x01}, nil)
+	lb.sessions.remember(&Flow{Backend: "backend1", conn: nopConn{}}, cid, testAddr(1))
+	pkt := append(append([]byte{0x40}, cid...), make([]byte, 1200)...)
+	result := testing.Benchmark(func(b *testing.B) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			lb.handlePacket(pkt, testAddr(1))
+		}
+	})
+	// parsing and the session lookup allocate a little; the packet is not copied
+	if got := result.AllocedBytesPerOp(); got >= int64(len(pkt))/4 {
+		t.Errorf("forwarding allocates %d bytes per %d byte packet, want no copy", got, len(pkt))
+	}
+}
+
+func BenchmarkForwardPacket(b *testing.B) {
+	lb, _ := InitLoadBalancer("127.0.0.1:0", []string{"backend0", "backend1"})
+	cid, _ := lb.routes().codec.Encode(0, []byte{0x01}, nil)
+	src := testAddr(1)
+	lb.sessions.remember(&Flow{Backend: "backend1", conn: nopConn{}}, cid, src)
+	datagram := append(append([]byte{0x40}, cid...), make([]byte, 1200)...)
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		// as readLoop and a worker do
+		buf := packetBuffers.Get().(*[]byte)
+		n := copy(*buf, datagram)
+		lb.process(inbound{pkt: (*buf)[:n], src: src, buf: buf})
+		packetBuffers.Put(buf)
+	}
+}
+
+func TestReturnRoutedByDCID(t *testing.T) {
+	fwd := memForwarder{opened: make(chan *memConn, 2)}
+	lb, listener := newMemLB(t, Config{Backends: []BackendConfig{{Address: "192.0.2.100:443", Forwarder: fwd}}})
+	scidA, scidB := []byte{0xa1, 0xa2, 0xa3, 0xa4}, []byte{0xb1, 0xb2, 0xb3, 0xb4}
+	if err := lb.handlePacket(quicLongHeader(packet.Initial, []byte{0xc0, 1, 1, 1, 1, 1, 1, 1}, scidA, make([]byte, 1200)), testAddr(1)); err != nil {
+		t.Fatalf("handlePacket(A) error = %v", err)
+	}
+	connA := expect(t, fwd.opened)
+	if err := lb.handlePacket(quicLongHeader(packet.Initial, []byte{0xc0, 2, 2, 2, 2, 2, 2, 2}, scidB, make([]byte, 1200)), testAddr(2)); err != nil {
+		t.Fatalf("handlePacket(B) error = %v", err)
+	}
+	expect(t, fwd.opened)
+
+	tests := []struct {
+		name  string
+		reply []byte
+		want  net.Addr
+	}{
+		{name: "Own Client", reply: quicLongHeader(packet.Initial, scidA, []byte{0x5a}, make([]byte, 40)), want: testAddr(1)},
+		// a server Initial for B arriving on A's socket still reaches B
+		{name: "Other Client", reply: quicLongHeader(packet.Initial, scidB, []byte{0x5b}, make([]byte, 40)), want: testAddr(2)},
+		{name: "Unknown DCID", reply: quicLongHeader(packet.HandShake, []byte{0xee, 0xee}, []byte{0x5a}, make([]byte, 40)), want: testAddr(1)},
+		{name: "Short Header", reply: append([]byte{0x40}, scidB...), want: testAddr(1)},
+	}
+	for _, tt := range tests {
+		connA.recv <- tt.reply
+		if got := expect(t, listener.sent); got.addr.String() != tt.want.String() || !bytes.Equal(got.data, tt.reply) {
+			t.Errorf("%s: reply went to %s, want %s", tt.name, got.addr, tt.want)
+		}
+	}
+	if got := lb.Stats().RepliesByDCID; got != 1 {
+		t.Errorf("RepliesByDCID = %d, want 1", got)
+	}
+
+	// the server CID B's Initial announced routes B's packets
+	flow := lb.sessions.lookupCID([]byte{0x5b})
+	if flow == nil || flow.ClientAddr().String() != testAddr(2).String() {
+		t.Errorf("server CID 5b indexed to %v, want B's flow", flow)
+	}
+}
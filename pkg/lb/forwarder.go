@@ -0,0 +1,111 @@
+package lb
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+)
+
+// Forwarder opens the per-flow connection carrying datagrams to a backend.
+// Each Write on the returned conn sends one client datagram and each Read
+// returns one backend datagram; any framing is the forwarder's business, so
+// routing never depends on how packets reach the backend.
+type Forwarder interface {
+	Open(address string) (net.Conn, error)
+}
+
+// PlainForwarder forwards datagrams verbatim over a connected UDP socket.
+// It is used for backends that configure no Forwarder.
+type PlainForwarder struct{}
+
+// Open dials the backend over UDP
+func (PlainForwarder) Open(address string) (net.Conn, error) {
+	return net.Dial("udp", address)
+}
+
+// EncapForwarder tunnels each datagram behind a two-byte big-endian length,
+// for backends reached through a tunnel endpoint rather than directly. Network
+// is "udp" (the default) or "unixgram", framing every datagram, or "unix",
+// where the length prefix delimits datagrams on the stream.
+type EncapForwarder struct {
+	Network string
+}
+
+// maxFrameSize is the largest datagram a two-byte length prefix can describe
+const maxFrameSize = 1<<16 - 1
+
+// Open dials the backend and wraps the connection in length-prefixed framing
+func (f EncapForwarder) Open(address string) (net.Conn, error) {
+	network := f.Network
+	if network == "" {
+		network = "udp"
+	}
+	conn, err := net.Dial(network, address)
+	if err != nil {
+		return nil, err
+	}
+	return &framedConn{Conn: conn, stream: network == "unix"}, nil
+}
+
+// framedConn adds and strips the EncapForwarder length prefix
+type framedConn struct {
+	net.Conn
+	stream bool
+	rbuf   []byte // datagram receive scratch, used only by the single reader
+}
+
+// Write sends p as one frame. Header and payload go out in a single write so
+// frames from concurrent writers never interleave on a stream.
+func (c *framedConn) Write(p []byte) (int, error) {
+	if len(p) > maxFrameSize {
+		return 0, fmt.Errorf("datagram of %d bytes exceeds frame limit %d", len(p), maxFrameSize)
+	}
+	frame := make([]byte, 2+len(p))
+	binary.BigEndian.PutUint16(frame, uint16(len(p)))
+	copy(frame[2:], p)
+	if _, err := c.Conn.Write(frame); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+// Read returns the payload of the next frame. A frame larger than p is an
+// error on a stream, where it cannot be skipped without losing sync.
+func (c *framedConn) Read(p []byte) (int, error) {
+	if c.stream {
+		var hdr [2]byte
+		if _, err := io.ReadFull(c.Conn, hdr[:]); err != nil {
+			return 0, err
+		}
+		n := int(binary.BigEndian.Uint16(hdr[:]))
+		if n > len(p) {
+			return 0, fmt.Errorf("frame of %d bytes exceeds buffer of %d", n, len(p))
+		}
+		return io.ReadFull(c.Conn, p[:n])
+	}
+
+	if cap(c.rbuf) < 2+len(p) {
+		c.rbuf = make([]byte, 2+len(p))
+	}
+	buf := c.rbuf[:2+len(p)]
+	for {
+		m, err := c.Conn.Read(buf)
+		if err != nil {
+			return 0, err
+		}
+		// a datagram whose prefix disagrees with its size is malformed; skip it
+		if m < 2 || int(binary.BigEndian.Uint16(buf)) != m-2 {
+			continue
+		}
+		return copy(p, buf[2:m]), nil
+	}
+}
+
+// forwarder returns the backend's forwarder, defaulting to PlainForwarder
+func (b BackendConfig) forwarder() Forwarder {
+	if b.Forwarder == nil {
+		return PlainForwarder{}
+	}
+	return b.Forwarder
+}
@@ -0,0 +1,108 @@
+package lb
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"net"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// startUnixEchoBackend echoes every byte of each stream connection back
+func startUnixEchoBackend(t *testing.T) string {
+	t.Helper()
+	ln, err := net.Listen("unix", filepath.Join(shortTempDir(t), "backend.sock"))
+	if err != nil {
+		t.Fatalf("Listen() error = %v", err)
+	}
+	t.Cleanup(func() { ln.Close() })
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				io.Copy(conn, conn)
+			}()
+		}
+	}()
+	return ln.Addr().String()
+}
+
+func TestForwardersRoundTrip(t *testing.T) {
+	udpEcho := startEchoBackend(t)
+	unixEcho := startUnixEchoBackend(t)
+
+	tests := []struct {
+		name      string
+		forwarder Forwarder
+		address   string
+	}{
+		{name: "Plain UDP", forwarder: PlainForwarder{}, address: udpEcho},
+		{name: "Encapsulated UDP", forwarder: EncapForwarder{}, address: udpEcho},
+		{name: "Encapsulated Unix Stream", forwarder: EncapForwarder{Network: "unix"}, address: unixEcho},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			conn, err := tt.forwarder.Open(tt.address)
+			if err != nil {
+				t.Fatalf("Open() error = %v", err)
+			}
+			defer conn.Close()
+
+			for _, pkt := range [][]byte{[]byte("first datagram"), []byte("second")} {
+				if _, err := conn.Write(pkt); err != nil {
+					t.Fatalf("Write() error = %v", err)
+				}
+				conn.SetReadDeadline(time.Now().Add(time.Second))
+				buf := make([]byte, maxPacketSize)
+				n, err := conn.Read(buf)
+				if err != nil {
+					t.Fatalf("Read() error = %v", err)
+				}
+				if !bytes.Equal(buf[:n], pkt) {
+					t.Errorf("Read() = %q, want %q", buf[:n], pkt)
+				}
+			}
+		})
+	}
+}
+
+func TestEncapForwarderFraming(t *testing.T) {
+	backend, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("ListenPacket() error = %v", err)
+	}
+	defer backend.Close()
+
+	lb := startTestLB(t, Config{Backends: []BackendConfig{
+		{Address: backend.LocalAddr().String(), Forwarder: EncapForwarder{}},
+	}})
+	client := newTestClient(t)
+	cid, _ := lb.routes().codec.Encode(0, []byte{0x00}, nil)
+	pkt := append([]byte{0x40}, cid...)
+	client.WriteTo(pkt, lb.Addr())
+
+	// the backend sees the datagram behind its length prefix
+	buf := make([]byte, maxPacketSize)
+	backend.SetReadDeadline(time.Now().Add(time.Second))
+	n, from, err := backend.ReadFrom(buf)
+	if err != nil {
+		t.Fatalf("backend ReadFrom() error = %v", err)
+	}
+	if got := binary.BigEndian.Uint16(buf); int(got) != len(pkt) || !bytes.Equal(buf[2:n], pkt) {
+		t.Fatalf("backend received %x, want length-prefixed %x", buf[:n], pkt)
+	}
+
+	// a malformed frame is skipped and the next one is unwrapped for the client
+	backend.WriteTo([]byte{0x00, 0x09, 0x01}, from)
+	backend.WriteTo(buf[:n], from)
+	if got := readWithin(t, client, time.Second); !bytes.Equal(got, pkt) {
+		t.Errorf("client received %x, want %x", got, pkt)
+	}
+}
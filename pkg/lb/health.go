@@ -0,0 +1,58 @@
+package lb
+
+import "net/http"
+
+// SetBackendHealth marks a backend healthy or unhealthy. Backends start
+// healthy; readiness requires at least one healthy backend.
+func (lb *LoadBalancer) SetBackendHealth(addr string, healthy bool) {
+	lb.mu.Lock()
+	defer lb.mu.Unlock()
+	if healthy {
+		delete(lb.unhealthy, addr)
+	} else {
+		lb.unhealthy[addr] = true
+	}
+}
+
+// unhealthyBackend reports whether the backend at addr is marked unhealthy
+func (lb *LoadBalancer) unhealthyBackend(addr string) bool {
+	lb.mu.RLock()
+	defer lb.mu.RUnlock()
+	return lb.unhealthy[addr]
+}
+
+// healthyBackends returns how many configured backends are not marked unhealthy
+func (lb *LoadBalancer) healthyBackends() int {
+	lb.mu.RLock()
+	defer lb.mu.RUnlock()
+	n := 0
+	for _, b := range lb.routes().backends {
+		if _, draining := lb.removing[b.Address]; !b.removed() && !draining && !lb.unhealthy[b.Address] {
+			n++
+		}
+	}
+	return n
+}
+
+// handleHealthz reports liveness: the process is up and the listener is bound
+func (lb *LoadBalancer) handleHealthz(w http.ResponseWriter, r *http.Request) {
+	if lb.Addr() == nil {
+		writeJSONError(w, http.StatusServiceUnavailable, "listener not bound")
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]string{"status": "ok"})
+}
+
+// handleReadyz reports readiness: live, not draining, and some backend healthy
+func (lb *LoadBalancer) handleReadyz(w http.ResponseWriter, r *http.Request) {
+	switch {
+	case lb.Addr() == nil:
+		writeJSONError(w, http.StatusServiceUnavailable, "listener not bound")
+	case lb.Draining():
+		writeJSONError(w, http.StatusServiceUnavailable, "draining")
+	case lb.healthyBackends() == 0:
+		writeJSONError(w, http.StatusServiceUnavailable, "no healthy backends")
+	default:
+		writeJSON(w, http.StatusOK, map[string]string{"status": "ready"})
+	}
+}
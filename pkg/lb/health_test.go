@@ -0,0 +1,46 @@
+package lb
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestHealthEndpoints(t *testing.T) {
+	lb, err := NewLoadBalancer(Config{ListenAddr: "127.0.0.1:0", Backends: StaticBackends("10.0.0.1:443", "10.0.0.2:443")})
+	if err != nil {
+		t.Fatalf("NewLoadBalancer() error = %v", err)
+	}
+	handler := lb.adminHandler()
+	check := func(stage string, wantHealthz, wantReadyz int) {
+		t.Helper()
+		for path, want := range map[string]int{"/healthz": wantHealthz, "/readyz": wantReadyz} {
+			rec := httptest.NewRecorder()
+			handler.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, path, nil))
+			if rec.Code != want {
+				t.Errorf("%s: %s status = %d, want %d", stage, path, rec.Code, want)
+			}
+		}
+	}
+
+	check("before start", http.StatusServiceUnavailable, http.StatusServiceUnavailable)
+
+	if err := lb.Start(); err != nil {
+		t.Fatalf("Start() error = %v", err)
+	}
+	defer lb.Shutdown()
+	check("steady state", http.StatusOK, http.StatusOK)
+
+	lb.SetBackendHealth("10.0.0.1:443", false)
+	check("one backend down", http.StatusOK, http.StatusOK)
+	lb.SetBackendHealth("10.0.0.2:443", false)
+	check("all backends down", http.StatusOK, http.StatusServiceUnavailable)
+	lb.SetBackendHealth("10.0.0.2:443", true)
+	check("backend recovered", http.StatusOK, http.StatusOK)
+
+	lb.Drain()
+	check("draining", http.StatusOK, http.StatusServiceUnavailable)
+
+	lb.Shutdown()
+	check("after shutdown", http.StatusServiceUnavailable, http.StatusServiceUnavailable)
+}
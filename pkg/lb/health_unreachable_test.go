@@ -0,0 +1,49 @@
+package lb
+
+import (
+	"net"
+	"runtime"
+	"testing"
+	"time"
+)
+
+func TestUnreachableBackendMarkedUnhealthy(t *testing.T) {
+	if runtime.GOOS != "linux" {
+		t.Skip("relies on Linux reporting ICMP port unreachable on connected UDP sockets")
+	}
+	// reserve a port and close it so nothing listens there
+	closed, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("ListenPacket() error = %v", err)
+	}
+	dead := closed.LocalAddr().String()
+	closed.Close()
+
+	lb := startTestLB(t, Config{Backends: StaticBackends(dead, startEchoBackend(t))})
+	cid, _ := lb.routes().codec.Encode(0, []byte{0x00}, nil)
+	pkt := append([]byte{0x40}, cid...)
+
+	first := newTestClient(t)
+	first.WriteTo(pkt, lb.Addr())
+	deadline := time.Now().Add(time.Second)
+	for !lb.unhealthyBackend(dead) && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond)
+	}
+	if !lb.unhealthyBackend(dead) {
+		t.Fatalf("backend %s not marked unhealthy after ICMP unreachable", dead)
+	}
+	if got := lb.Stats().BackendUnreachable; got == 0 {
+		t.Errorf("BackendUnreachable = 0, want > 0")
+	}
+
+	// a new flow whose CID names the dead backend is served by the live one
+	other, _ := lb.routes().codec.Encode(0, []byte{0x00}, nil)
+	second := newTestClient(t)
+	second.WriteTo(append([]byte{0x40}, other...), lb.Addr())
+	if readWithin(t, second, time.Second) == nil {
+		t.Fatalf("new flow was not rerouted to the healthy backend")
+	}
+	if got := lb.Stats().UnhealthyFallbacks; got != 1 {
+		t.Errorf("UnhealthyFallbacks = %d, want 1", got)
+	}
+}
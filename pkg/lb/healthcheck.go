@@ -0,0 +1,205 @@
+package lb
+
+import (
+	"context"
+	"crypto/ecdh"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/fqzz2000/QUIC-LB-SHRIMP/pkg/packet"
+)
+
+// The QUIC health check (Config.HealthCheckInterval) proves each backend's
+// QUIC stack is alive rather than just its host. Every interval each backend
+// is sent a real client Initial: a protected packet of the configured
+// version carrying a TLS 1.3 ClientHello, as a client opening a connection
+// would send. A live server answers it with a handshake, a Retry, a
+// CONNECTION_CLOSE or a Version Negotiation; the backend is marked healthy
+// on any datagram back within the timeout and unhealthy otherwise, so a
+// process that stopped serving QUIC on an open port is caught. The check
+// owns the health mark of every backend it probes.
+
+const (
+	// defaultHealthCheckTimeout is how long a probe waits for a reply
+	defaultHealthCheckTimeout = time.Second
+	// probeALPN is the application protocol probes offer; a server that
+	// does not speak it still answers with a CONNECTION_CLOSE
+	probeALPN = "h3"
+)
+
+// errHealthCheck is returned for an invalid health check configuration
+var errHealthCheck = errors.New("invalid health check")
+
+// healthCheck holds the QUIC health check settings
+type healthCheck struct {
+	interval time.Duration
+	timeout  time.Duration
+	version  uint32
+}
+
+// healthCheck returns the configured health check, nil when disabled
+func (c *Config) healthCheck() (*healthCheck, error) {
+	if c.HealthCheckInterval == 0 {
+		return nil, nil
+	}
+	if c.HealthCheckInterval < 0 || c.HealthCheckTimeout < 0 {
+		return nil, fmt.Errorf("%w: interval %v, timeout %v", errHealthCheck, c.HealthCheckInterval, c.HealthCheckTimeout)
+	}
+	hc := &healthCheck{interval: c.HealthCheckInterval, timeout: c.HealthCheckTimeout, version: c.HealthCheckVersion}
+	if hc.timeout == 0 {
+		hc.timeout = min(defaultHealthCheckTimeout, hc.interval)
+	}
+	if hc.version == 0 {
+		hc.version = packet.Version1
+	}
+	// the probe is built once here so an unknown version fails at startup
+	if _, err := hc.probe(); err != nil {
+		return nil, fmt.Errorf("%w: %w", errHealthCheck, err)
+	}
+	return hc, nil
+}
+
+// healthCheckLoop probes every backend at once and then each interval until
+// ctx is done
+func (lb *LoadBalancer) healthCheckLoop(ctx context.Context) {
+	ticker := time.NewTicker(lb.healthCheck.interval)
+	defer ticker.Stop()
+	for {
+		lb.checkBackends(ctx)
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// checkBackends probes the backends concurrently and marks each by its result
+func (lb *LoadBalancer) checkBackends(ctx context.Context) {
+	var wg sync.WaitGroup
+	for _, b := range lb.routes().backends {
+		if b.removed() {
+			continue
+		}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			healthy := lb.probeBackend(ctx, b)
+			if ctx.Err() != nil {
+				return
+			}
+			if !healthy {
+				lb.stats.healthProbeFailures.Add(1)
+			}
+			if healthy == lb.unhealthyBackend(b.Address) {
+				log.Printf("Backend %s health check: healthy = %v", b.Address, healthy)
+			}
+			lb.SetBackendHealth(b.Address, healthy)
+		}()
+	}
+	wg.Wait()
+}
+
+// probeBackend sends one Initial to the backend and reports whether anything
+// came back within the timeout
+func (lb *LoadBalancer) probeBackend(ctx context.Context, b BackendConfig) bool {
+	pkt, err := lb.healthCheck.probe()
+	if err != nil {
+		return false
+	}
+	var conn net.Conn
+	if b.Forwarder != nil {
+		conn, err = b.Forwarder.Open(b.Address)
+	} else {
+		conn, err = PlainForwarder{}.Open(lb.warm.resolved(b.Address))
+	}
+	if err != nil {
+		return false
+	}
+	// closing the socket ends the read, whatever the conn's deadline support
+	stop := context.AfterFunc(ctx, func() { conn.Close() })
+	defer stop()
+	timer := time.AfterFunc(lb.healthCheck.timeout, func() { conn.Close() })
+	defer timer.Stop()
+	defer conn.Close()
+
+	if _, err := conn.Write(pkt); err != nil {
+		return false
+	}
+	buf := make([]byte, maxPacketSize)
+	n, err := conn.Read(buf)
+	return err == nil && n > 0
+}
+
+// probe returns a fresh client Initial, with random connection IDs and key
+// share, padded to the minimum Initial size
+func (hc *healthCheck) probe() ([]byte, error) {
+	cids := make([]byte, 16)
+	if _, err := rand.Read(cids); err != nil {
+		return nil, err
+	}
+	dcid, scid := cids[:8], cids[8:]
+	hello, err := probeClientHello(scid)
+	if err != nil {
+		return nil, err
+	}
+	// a CRYPTO frame at offset zero with a two-byte length
+	frame := []byte{0x06, 0x00}
+	frame = binary.BigEndian.AppendUint16(frame, 0x4000|uint16(len(hello)))
+	frame = append(frame, hello...)
+	return packet.SealClientInitial(hc.version, dcid, scid, frame, packet.MinInitialSize)
+}
+
+// probeClientHello returns a minimal TLS 1.3 ClientHello handshake message
+// for QUIC: one X25519 key share, the probe ALPN and transport parameters
+// carrying the initial source connection ID
+func probeClientHello(scid []byte) ([]byte, error) {
+	key, err := ecdh.X25519().GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	random := make([]byte, 32)
+	if _, err := rand.Read(random); err != nil {
+		return nil, err
+	}
+
+	var ext []byte
+	addExt := func(typ uint16, data []byte) {
+		ext = binary.BigEndian.AppendUint16(ext, typ)
+		ext = appendU16Prefixed(ext, data)
+	}
+	addExt(0x000a, []byte{0x00, 0x02, 0x00, 0x1d}) // supported_groups: x25519
+	// signature_algorithms: ecdsa_secp256r1_sha256, rsa_pss_rsae_sha256,
+	// ed25519, rsa_pkcs1_sha256
+	addExt(0x000d, []byte{0x00, 0x08, 0x04, 0x03, 0x08, 0x04, 0x08, 0x07, 0x04, 0x01})
+	addExt(0x002b, []byte{0x02, 0x03, 0x04}) // supported_versions: TLS 1.3
+	share := binary.BigEndian.AppendUint16(nil, 0x001d)
+	share = appendU16Prefixed(share, key.PublicKey().Bytes())
+	addExt(0x0033, appendU16Prefixed(nil, share)) // key_share
+	alpn := append([]byte{byte(len(probeALPN))}, probeALPN...)
+	addExt(0x0010, appendU16Prefixed(nil, alpn))
+	// quic_transport_parameters: initial_source_connection_id
+	addExt(0x0039, append([]byte{0x0f, byte(len(scid))}, scid...))
+
+	body := []byte{0x03, 0x03} // legacy_version
+	body = append(body, random...)
+	body = append(body, 0x00)                                           // empty legacy_session_id
+	body = append(body, 0x00, 0x06, 0x13, 0x01, 0x13, 0x02, 0x13, 0x03) // TLS 1.3 suites
+	body = append(body, 0x01, 0x00)                                     // null compression
+	body = appendU16Prefixed(body, ext)
+
+	msg := []byte{0x01, byte(len(body) >> 16), byte(len(body) >> 8), byte(len(body))} // client_hello
+	return append(msg, body...), nil
+}
+
+// appendU16Prefixed appends data to b behind its two-byte length
+func appendU16Prefixed(b, data []byte) []byte {
+	b = binary.BigEndian.AppendUint16(b, uint16(len(data)))
+	return append(b, data...)
+}
@@ -0,0 +1,150 @@
+package lb
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"errors"
+	"math/big"
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/fqzz2000/QUIC-LB-SHRIMP/pkg/packet"
+)
+
+// startQUICBackend runs a backend that checks every datagram is a full-size
+// client Initial of version and answers it while respond is set
+func startQUICBackend(t *testing.T, version uint32, respond *atomic.Bool) string {
+	t.Helper()
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("ListenPacket() error = %v", err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	go func() {
+		p := &packet.PacketProcessor{}
+		buf := make([]byte, maxPacketSize)
+		for {
+			n, addr, err := conn.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			header, err := p.ParsePacket(buf[:n])
+			lh, ok := header.(*packet.LongHeader)
+			if err != nil || !ok || lh.Version != version || lh.LongPacketType != packet.Initial || n < packet.MinInitialSize {
+				t.Errorf("probe = %d bytes, %+v, %v, want a client Initial of %#x", n, header, err, version)
+				continue
+			}
+			if respond.Load() {
+				conn.WriteTo([]byte{0xc0, 0, 0, 0, 0}, addr)
+			}
+		}
+	}()
+	return conn.LocalAddr().String()
+}
+
+func TestQUICHealthCheck(t *testing.T) {
+	for _, version := range []uint32{packet.Version1, packet.Version2} {
+		var up, down atomic.Bool
+		up.Store(true)
+		live := startQUICBackend(t, version, &up)
+		dead := startQUICBackend(t, version, &down)
+		lb := startTestLB(t, Config{
+			Backends:            StaticBackends(live, dead),
+			HealthCheckInterval: 20 * time.Millisecond,
+			HealthCheckTimeout:  50 * time.Millisecond,
+			HealthCheckVersion:  version,
+		})
+
+		waitHealth := func(addr string, healthy bool) {
+			t.Helper()
+			deadline := time.Now().Add(2 * time.Second)
+			for lb.unhealthyBackend(addr) == healthy {
+				if time.Now().After(deadline) {
+					t.Fatalf("backend %s healthy = %v, want %v", addr, !healthy, healthy)
+				}
+				time.Sleep(5 * time.Millisecond)
+			}
+		}
+		waitHealth(dead, false)
+		waitHealth(live, true)
+		if lb.Stats().HealthProbeFailures == 0 {
+			t.Error("HealthProbeFailures = 0, want the silent backend's probes counted")
+		}
+
+		// a backend that stops answering is marked down, and up once it answers again
+		up.Store(false)
+		waitHealth(live, false)
+		up.Store(true)
+		waitHealth(live, true)
+	}
+}
+
+func TestHealthCheckConfig(t *testing.T) {
+	tests := []struct {
+		name    string
+		cfg     Config
+		wantErr error
+	}{
+		{name: "Disabled", cfg: Config{}},
+		{name: "Defaults", cfg: Config{HealthCheckInterval: time.Second}},
+		{name: "Negative Timeout", cfg: Config{HealthCheckInterval: time.Second, HealthCheckTimeout: -1}, wantErr: errHealthCheck},
+		{name: "Unknown Version", cfg: Config{HealthCheckInterval: time.Second, HealthCheckVersion: 0xff00001d}, wantErr: packet.ErrUnsupportedVersion},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := tt.cfg.healthCheck(); !errors.Is(err, tt.wantErr) {
+				t.Errorf("healthCheck() error = %v, want %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestProbeClientHello(t *testing.T) {
+	// a TLS 1.3 server stack accepts the probe's ClientHello and answers it
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("GenerateKey() error = %v", err)
+	}
+	template := &x509.Certificate{SerialNumber: big.NewInt(1), Subject: pkix.Name{CommonName: "backend"},
+		NotBefore: time.Now().Add(-time.Hour), NotAfter: time.Now().Add(time.Hour)}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatalf("CreateCertificate() error = %v", err)
+	}
+	server := tls.QUICServer(&tls.QUICConfig{TLSConfig: &tls.Config{
+		Certificates: []tls.Certificate{{Certificate: [][]byte{der}, PrivateKey: key}},
+		NextProtos:   []string{probeALPN},
+		MinVersion:   tls.VersionTLS13,
+	}})
+	if err := server.Start(context.Background()); err != nil {
+		t.Fatalf("Start() error = %v", err)
+	}
+	defer server.Close()
+
+	hello, err := probeClientHello([]byte{1, 2, 3, 4, 5, 6, 7, 8})
+	if err != nil {
+		t.Fatalf("probeClientHello() error = %v", err)
+	}
+	if err := server.HandleData(tls.QUICEncryptionLevelInitial, hello); err != nil {
+		t.Fatalf("HandleData() error = %v", err)
+	}
+	for {
+		switch e := server.NextEvent(); e.Kind {
+		case tls.QUICTransportParametersRequired:
+			server.SetTransportParameters(nil)
+		case tls.QUICWriteData:
+			if e.Level == tls.QUICEncryptionLevelInitial {
+				return // the ServerHello
+			}
+		case tls.QUICNoEvent:
+			t.Fatal("server did not answer the ClientHello")
+		}
+	}
+}
@@ -0,0 +1,66 @@
+package lb
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+
+	"github.com/fqzz2000/QUIC-LB-SHRIMP/pkg/packet"
+)
+
+// RFC 9000 section 14.1 has clients pad every datagram carrying an Initial
+// to at least 1200 bytes, so a server's first flight, limited to three times
+// what it received, cannot amplify a spoofed source much. With
+// Config.DropSmallInitials the LB drops undersized ones before they reach a
+// backend. The size checked is the whole datagram's: an Initial coalesced
+// with a Handshake or 0-RTT packet may itself be small, and padding may be
+// a PADDING frame or trailing bytes past the last packet. Only a datagram
+// under the minimum is split to look for an Initial, so full-size ones cost
+// a length comparison.
+
+var (
+	// errSmallInitial is returned for a client datagram carrying an Initial
+	// below the minimum size
+	errSmallInitial = errors.New("initial datagram below minimum size")
+	// errMinInitialSize is returned for an invalid MinInitialSize
+	errMinInitialSize = errors.New("invalid minimum initial size")
+)
+
+// minInitialSize returns the smallest datagram an Initial may arrive in,
+// zero when undersized ones are forwarded
+func (c *Config) minInitialSize() (int, error) {
+	if !c.DropSmallInitials {
+		return 0, nil
+	}
+	if c.MinInitialSize < 0 || c.MinInitialSize > maxPacketSize {
+		return 0, fmt.Errorf("%w: %d outside [0, %d]", errMinInitialSize, c.MinInitialSize, maxPacketSize)
+	}
+	if c.MinInitialSize == 0 {
+		return packet.MinInitialSize, nil
+	}
+	return c.MinInitialSize, nil
+}
+
+// checkInitialSize fails a client datagram under the minimum size that
+// carries a v1 or v2 Initial in any of its coalesced packets. The types of
+// other versions' packets are not known.
+func (lb *LoadBalancer) checkInitialSize(processor *packet.PacketProcessor, datagram []byte) error {
+	if len(datagram) >= lb.minInitial || datagram[0]&0x80 == 0 {
+		return nil
+	}
+	packets, _ := processor.SplitCoalesced(datagram)
+	for _, p := range packets {
+		if p[0]&0x80 == 0 {
+			break
+		}
+		version := binary.BigEndian.Uint32(p[1:5])
+		if version != packet.Version1 && version != packet.Version2 {
+			continue
+		}
+		if packet.LongPacketType(version, p[0]) == packet.Initial {
+			lb.stats.smallInitials.Add(1)
+			return fmt.Errorf("%w: %d bytes, want %d", errSmallInitial, len(datagram), lb.minInitial)
+		}
+	}
+	return nil
+}
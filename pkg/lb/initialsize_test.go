@@ -0,0 +1,91 @@
+package lb
+
+import (
+	"encoding/binary"
+	"errors"
+	"testing"
+
+	"github.com/fqzz2000/QUIC-LB-SHRIMP/pkg/packet"
+)
+
+func TestDropSmallInitials(t *testing.T) {
+	dcid := []byte{0x00, 0x01, 0xa1, 0xa2, 0xa3, 0xa4, 0xa5, 0xa6}
+	scid := []byte{0xc1, 0xc2, 0xc3, 0xc4}
+	initial := func(payload int) []byte { return quicLongHeader(packet.Initial, dcid, scid, make([]byte, payload)) }
+	handshake := func(payload int) []byte { return quicLongHeader(packet.HandShake, dcid, scid, make([]byte, payload)) }
+	v2Initial := initial(100)
+	binary.BigEndian.PutUint32(v2Initial[1:5], packet.Version2)
+	v2Initial[0] = 0xc0 | 0x01<<4 // v2's Initial type bits
+
+	tests := []struct {
+		name     string
+		datagram []byte
+		wantErr  error
+	}{
+		{name: "Undersized Initial", datagram: initial(100), wantErr: errSmallInitial},
+		{name: "Padded Initial", datagram: initial(1200)},
+		{name: "Padded Past The Packet", datagram: append(initial(100), make([]byte, 1200)...)},
+		{name: "Coalesced Under Minimum", datagram: append(initial(100), handshake(200)...), wantErr: errSmallInitial},
+		{name: "Coalesced To Full Size", datagram: append(initial(100), handshake(1100)...)},
+		{name: "Initial Coalesced Second", datagram: append(handshake(100), initial(100)...), wantErr: errSmallInitial},
+		{name: "Small Handshake", datagram: handshake(100)},
+		{name: "Version 2 Initial", datagram: v2Initial, wantErr: errSmallInitial},
+		{name: "Short Header", datagram: append([]byte{0x40}, dcid...)},
+	}
+	for i, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fwd := memForwarder{opened: make(chan *memConn, 1)}
+			lb, _ := newMemLB(t, Config{
+				Backends:          []BackendConfig{{Address: "192.0.2.100:443", Forwarder: fwd}},
+				DropSmallInitials: true,
+			})
+			err := lb.handlePacket(tt.datagram, testAddr(i))
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("handlePacket(%d bytes) error = %v, want %v", len(tt.datagram), err, tt.wantErr)
+			}
+			wantDrops := uint64(0)
+			if tt.wantErr != nil {
+				wantDrops = 1
+			}
+			if got := lb.Stats().SmallInitialDrops; got != wantDrops {
+				t.Errorf("SmallInitialDrops = %d, want %d", got, wantDrops)
+			}
+		})
+	}
+
+	// off by default, and a lower minimum admits what the default drops
+	for _, cfg := range []Config{{}, {DropSmallInitials: true, MinInitialSize: 100}} {
+		fwd := memForwarder{opened: make(chan *memConn, 1)}
+		cfg.Backends = []BackendConfig{{Address: "192.0.2.100:443", Forwarder: fwd}}
+		lb, _ := newMemLB(t, cfg)
+		if err := lb.handlePacket(initial(100), testAddr(1)); err != nil {
+			t.Errorf("handlePacket() with minimum %d error = %v, want the Initial forwarded", cfg.MinInitialSize, err)
+		}
+	}
+}
+
+func TestMinInitialSizeConfig(t *testing.T) {
+	tests := []struct {
+		name    string
+		cfg     Config
+		want    int
+		wantErr error
+	}{
+		{name: "Disabled", cfg: Config{MinInitialSize: 1300}},
+		{name: "Default", cfg: Config{DropSmallInitials: true}, want: packet.MinInitialSize},
+		{name: "Configured", cfg: Config{DropSmallInitials: true, MinInitialSize: 1250}, want: 1250},
+		{name: "Negative", cfg: Config{DropSmallInitials: true, MinInitialSize: -1}, wantErr: errMinInitialSize},
+		{name: "Past Read Buffer", cfg: Config{DropSmallInitials: true, MinInitialSize: maxPacketSize + 1}, wantErr: errMinInitialSize},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := tt.cfg.minInitialSize()
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("minInitialSize() error = %v, want %v", err, tt.wantErr)
+			}
+			if got != tt.want {
+				t.Errorf("minInitialSize() = %d, want %d", got, tt.want)
+			}
+		})
+	}
+}
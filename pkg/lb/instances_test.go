@@ -0,0 +1,83 @@
+package lb
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/fqzz2000/QUIC-LB-SHRIMP/pkg/metrics"
+	"github.com/fqzz2000/QUIC-LB-SHRIMP/pkg/packet"
+	"github.com/fqzz2000/QUIC-LB-SHRIMP/pkg/quiclb"
+)
+
+func TestIndependentInstances(t *testing.T) {
+	registry := metrics.NewRegistry()
+	backendA, seenA := startCIDManagedBackend(t)
+	backendB, seenB := startCIDManagedBackend(t)
+	lbA := startTestLB(t, Config{Name: "a", Metrics: registry, Backends: StaticBackends(backendA)})
+	lbB := startTestLB(t, Config{
+		Name:     "b",
+		Metrics:  registry,
+		Backends: StaticBackends(backendB),
+		QUICLB: [quiclb.NumConfigs]quiclb.ConfigEntry{
+			1: {Algorithm: quiclb.Plaintext, ServerIDLength: 1, NonceLength: 6},
+		},
+	})
+
+	// each instance routes with its own config to its own backend
+	instances := []struct {
+		lb   *LoadBalancer
+		seen <-chan []byte
+		dcid []byte
+	}{
+		{lbA, seenA, []byte{0x00, 0x00, 0xa1, 0xa1, 0xa1, 0xa1, 0xa1, 0xa1}},
+		{lbB, seenB, []byte{0x40, 0x00, 0xb2, 0xb2, 0xb2, 0xb2, 0xb2, 0xb2}},
+	}
+	var wg sync.WaitGroup
+	for _, in := range instances {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			client := newTestClient(t)
+			for i := 0; i < 5; i++ {
+				client.WriteTo(quicLongHeader(packet.Initial, in.dcid, []byte{0xcc}, make([]byte, 1200)), in.lb.Addr())
+			}
+		}()
+	}
+	wg.Wait()
+	for _, in := range instances {
+		for i := 0; i < 5; i++ {
+			if got := expect(t, in.seen); !bytes.Equal(got, in.dcid) {
+				t.Errorf("backend of %s received DCID %x, want %x", in.lb.Addr(), got, in.dcid)
+			}
+		}
+	}
+	if lbA.Stats().DecodeFailures != 0 || lbB.Stats().DecodeFailures != 0 {
+		t.Errorf("DecodeFailures = %d and %d, want 0: an instance saw the other's config", lbA.Stats().DecodeFailures, lbB.Stats().DecodeFailures)
+	}
+
+	// one registry, a series per instance
+	want := []string{`shrimp_packets_forwarded_total{instance="a"} 5`, `shrimp_packets_forwarded_total{instance="b"} 5`}
+	deadline := time.Now().Add(time.Second)
+	for {
+		rec := httptest.NewRecorder()
+		lbA.adminHandler().ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+		missing := ""
+		for _, w := range want {
+			if !strings.Contains(rec.Body.String(), w) {
+				missing = w
+			}
+		}
+		if missing == "" {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("/metrics missing %q", missing)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
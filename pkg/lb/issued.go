@@ -0,0 +1,188 @@
+package lb
+
+import (
+	"hash/maphash"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// issuedPrefixLen is the number of leading CID bytes kept per issued connection ID
+const issuedPrefixLen = 8
+
+// defaultIssuedCIDTTL is how long an issued CID is remembered without traffic
+const defaultIssuedCIDTTL = 5 * time.Minute
+
+// defaultIssuedCIDCapacity is how many issued CIDs are remembered at most
+// unless configured otherwise
+const defaultIssuedCIDCapacity = 1 << 16
+
+const (
+	// issuedBucketSlots is the number of entries per filter bucket
+	issuedBucketSlots = 4
+	// issuedMaxKicks bounds how many entries an insert relocates before it
+	// gives up and forgets the one it holds
+	issuedMaxKicks = 128
+)
+
+type issuedPrefix [issuedPrefixLen]byte
+
+// issuedSlot is one filter entry: the fingerprint of an issued CID and the
+// config that encoded it. A zero fingerprint marks the slot empty.
+type issuedSlot struct {
+	fp       uint32
+	rotation uint8
+	expires  int64 // unix nanoseconds, atomic under a read lock
+}
+
+// issuedCIDs remembers the connection IDs the load balancer issued itself
+// (Retry or CID allocation) so follow-up packets decode with the config that
+// produced them. It is a cuckoo filter over their prefixes: fixed memory
+// for its capacity, no CID bytes stored, each entry in one of two buckets.
+// When full it forgets entries rather than grow, and two CIDs may share a
+// fingerprint, so a hit is a hint to decode with, never proof of issuance.
+// Every decode looks a CID up, so the filter is split, like the session
+// table, into shards with their own locks, each a filter of its own over
+// the CIDs hashing to it. Lookups share their shard's read lock, refreshing
+// a hit's expiry atomically, so only adds exclude them.
+type issuedCIDs struct {
+	ttl    time.Duration
+	seed   maphash.Seed
+	shards []issuedShard
+}
+
+// issuedShard is the cuckoo filter of one shard of the issued CIDs
+type issuedShard struct {
+	mu      sync.RWMutex
+	buckets [][issuedBucketSlots]issuedSlot
+	mask    uint64 // len(buckets)-1, a power of two minus one
+	kick    int    // rotates the slot an insert displaces
+}
+
+// issuedMinShardSlots is the fewest slots a shard is given, so a small
+// filter is split into fewer shards rather than ones too small to balance
+const issuedMinShardSlots = 256
+
+// newIssuedCIDs returns a filter of at least capacity slots in up to shards
+// shards
+func newIssuedCIDs(ttl time.Duration, capacity, shards int) *issuedCIDs {
+	if ttl <= 0 {
+		ttl = defaultIssuedCIDTTL
+	}
+	if capacity <= 0 {
+		capacity = defaultIssuedCIDCapacity
+	}
+	shards = max(1, min(shards, capacity/issuedMinShardSlots))
+	n := 1
+	for n*issuedBucketSlots*shards < capacity {
+		n <<= 1
+	}
+	s := &issuedCIDs{ttl: ttl, seed: maphash.MakeSeed(), shards: make([]issuedShard, shards)}
+	for i := range s.shards {
+		s.shards[i].buckets = make([][issuedBucketSlots]issuedSlot, n)
+		s.shards[i].mask = uint64(n - 1)
+	}
+	return s
+}
+
+func prefixOf(cid []byte) issuedPrefix {
+	var p issuedPrefix
+	copy(p[:], cid)
+	return p
+}
+
+// locate returns the shard of cid, its fingerprint and the first of its two
+// buckets there. The hash's high half is the fingerprint and its low half
+// picks the shard and then the bucket.
+func (s *issuedCIDs) locate(cid []byte) (*issuedShard, uint32, uint64) {
+	p := prefixOf(cid)
+	h := maphash.Bytes(s.seed, p[:])
+	fp := uint32(h >> 32)
+	if fp == 0 {
+		fp = 1
+	}
+	low, n := h&0xffffffff, uint64(len(s.shards))
+	shard := &s.shards[low%n]
+	return shard, fp, (low / n) & shard.mask
+}
+
+// alternate returns the other bucket an entry with fingerprint fp may
+// live in, given one of them
+func (s *issuedShard) alternate(i uint64, fp uint32) uint64 {
+	// the fingerprint is mixed so similar ones spread over the buckets
+	return (i ^ uint64(fp)*0x5bd1e995) & s.mask
+}
+
+// find returns the live slot holding fp in bucket i or its alternate
+func (s *issuedShard) find(fp uint32, i uint64, now int64) *issuedSlot {
+	for _, b := range [2]uint64{i, s.alternate(i, fp)} {
+		for j := range s.buckets[b] {
+			if slot := &s.buckets[b][j]; slot.fp == fp && atomic.LoadInt64(&slot.expires) > now {
+				return slot
+			}
+		}
+	}
+	return nil
+}
+
+// free returns an empty or expired slot of bucket i, or nil
+func (s *issuedShard) free(i uint64, now int64) *issuedSlot {
+	for j := range s.buckets[i] {
+		if slot := &s.buckets[i][j]; slot.fp == 0 || slot.expires <= now {
+			return slot
+		}
+	}
+	return nil
+}
+
+// add records an issued CID. When both its buckets are full, entries are
+// moved to their alternates to make room; after issuedMaxKicks moves the
+// entry left over is forgotten, and its CID decodes by its rotation bits.
+func (s *issuedCIDs) add(cid []byte, rotation uint8, now time.Time) {
+	shard, fp, i := s.locate(cid)
+	shard.mu.Lock()
+	defer shard.mu.Unlock()
+	at := now.UnixNano()
+	entry := issuedSlot{fp: fp, rotation: rotation, expires: now.Add(s.ttl).UnixNano()}
+	if slot := shard.find(entry.fp, i, at); slot != nil {
+		*slot = entry
+		return
+	}
+	for range issuedMaxKicks {
+		for _, b := range [2]uint64{i, shard.alternate(i, entry.fp)} {
+			if slot := shard.free(b, at); slot != nil {
+				*slot = entry
+				return
+			}
+		}
+		// displace an entry of the first bucket and rehome it next round
+		shard.kick = (shard.kick + 1) % issuedBucketSlots
+		slot := &shard.buckets[i][shard.kick]
+		entry, *slot = *slot, entry
+		i = shard.alternate(i, entry.fp)
+	}
+}
+
+// issuedRefreshSlack is the fraction of the TTL a hit's expiry may run down
+// by before a lookup refreshes it, so most hits only read their slot
+const issuedRefreshSlack = 16
+
+// lookup returns the rotation an issued CID was encoded with, refreshing its
+// expiry on a hit once it has run down by issuedRefreshSlack. A CID never
+// issued may hit on another's fingerprint.
+func (s *issuedCIDs) lookup(cid []byte, now time.Time) (uint8, bool) {
+	if len(cid) == 0 {
+		return 0, false
+	}
+	shard, fp, i := s.locate(cid)
+	shard.mu.RLock()
+	defer shard.mu.RUnlock()
+	slot := shard.find(fp, i, now.UnixNano())
+	if slot == nil {
+		return 0, false
+	}
+	if expires := now.Add(s.ttl).UnixNano(); expires-atomic.LoadInt64(&slot.expires) > int64(s.ttl/issuedRefreshSlack) {
+		atomic.StoreInt64(&slot.expires, expires)
+	}
+	return slot.rotation, true
+}
@@ -0,0 +1,191 @@
+package lb
+
+import (
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/fqzz2000/QUIC-LB-SHRIMP/pkg/quiclb"
+)
+
+func TestIssuedCIDRoutesFollowUpPacket(t *testing.T) {
+	clock := newFakeClock()
+	cfg := Config{
+		ListenAddr:   "127.0.0.1:0",
+		Backends:     StaticBackends("backend0", "backend1"),
+		IssuedCIDTTL: time.Minute,
+		Clock:        clock,
+	}
+	cfg.QUICLB[2] = quiclb.ConfigEntry{Algorithm: quiclb.Plaintext, ServerIDLength: 1, NonceLength: 6}
+	lb, err := NewLoadBalancer(cfg)
+	if err != nil {
+		t.Fatalf("NewLoadBalancer() error = %v", err)
+	}
+
+	cid, err := lb.IssueCID([]byte{0x01})
+	if err != nil {
+		t.Fatalf("IssueCID() error = %v", err)
+	}
+	if rotation, ok := lb.issued.lookup(cid, clock.Now()); !ok || rotation != 2 {
+		t.Fatalf("issued lookup = (%d, %v), want (2, true)", rotation, ok)
+	}
+
+	src := &net.UDPAddr{IP: net.IPv4(192, 0, 2, 7), Port: 50000}
+	backend, err := lb.SelectBackend(append([]byte{0x40}, cid...), src)
+	if err != nil {
+		t.Fatalf("SelectBackend() error = %v", err)
+	}
+	if backend != "backend1" {
+		t.Errorf("SelectBackend() = %q, want %q", backend, "backend1")
+	}
+}
+
+func TestIssuedCIDsExpire(t *testing.T) {
+	clock := newFakeClock()
+	issued := newIssuedCIDs(time.Minute, 0, defaultSessionShards)
+	cid := []byte{0x00, 0x01, 0x02, 0x03, 0x04, 0x05, 0x06, 0x07}
+
+	issued.add(cid, 1, clock.Now())
+	clock.Advance(30 * time.Second)
+	if _, ok := issued.lookup(cid, clock.Now()); !ok {
+		t.Fatalf("lookup() before expiry returned false")
+	}
+
+	// the hit above refreshed the entry
+	clock.Advance(45 * time.Second)
+	if _, ok := issued.lookup(cid, clock.Now()); !ok {
+		t.Fatalf("lookup() after refresh returned false")
+	}
+
+	clock.Advance(2 * time.Minute)
+	if _, ok := issued.lookup(cid, clock.Now()); ok {
+		t.Errorf("lookup() after expiry returned true")
+	}
+	if _, ok := issued.lookup([]byte{0xFF}, clock.Now()); ok {
+		t.Errorf("lookup() of unknown CID returned true")
+	}
+
+	// a hit within the refresh slack of its last refresh keeps the expiry
+	issued.add(cid, 1, clock.Now())
+	clock.Advance(time.Minute / issuedRefreshSlack / 2)
+	issued.lookup(cid, clock.Now())
+	clock.Advance(time.Minute - time.Minute/issuedRefreshSlack/2)
+	if _, ok := issued.lookup(cid, clock.Now()); ok {
+		t.Errorf("lookup() a TTL after the add returned true, want the early hit not to refresh")
+	}
+}
+
+func TestIssuedCIDsBounded(t *testing.T) {
+	now := newFakeClock().Now()
+	issued := newIssuedCIDs(time.Minute, 64, defaultSessionShards)
+	cid := func(i int) []byte {
+		return []byte{0x00, byte(i >> 8), byte(i), 0x03, 0x04, 0x05, 0x06, 0x07}
+	}
+
+	for i := range 32 {
+		issued.add(cid(i), 1, now)
+	}
+	for i := range 32 {
+		if rotation, ok := issued.lookup(cid(i), now); !ok || rotation != 1 {
+			t.Fatalf("lookup(%x) = (%d, %v), want (1, true)", cid(i), rotation, ok)
+		}
+	}
+
+	for i := 32; i < 1000; i++ {
+		issued.add(cid(i), 1, now)
+	}
+	if got := len(issued.shards) * len(issued.shards[0].buckets) * issuedBucketSlots; got != 64 {
+		t.Errorf("filter holds %d slots after 1000 adds, want 64", got)
+	}
+	hits := 0
+	for i := range 1000 {
+		if _, ok := issued.lookup(cid(i), now); ok {
+			hits++
+		}
+	}
+	// a full filter still remembers most of what it can hold
+	if hits > 64 || hits < 32 {
+		t.Errorf("%d of 1000 CIDs remembered, want 32 to 64", hits)
+	}
+
+	// expired entries make room without displacing live ones
+	later := now.Add(2 * time.Minute)
+	issued.add(cid(5000), 2, later)
+	if rotation, ok := issued.lookup(cid(5000), later); !ok || rotation != 2 {
+		t.Errorf("lookup() after expiry = (%d, %v), want (2, true)", rotation, ok)
+	}
+}
+
+func TestIssuedCIDsSharded(t *testing.T) {
+	tests := []struct {
+		name       string
+		capacity   int
+		shards     int
+		wantShards int
+	}{
+		{name: "Default", shards: defaultSessionShards, wantShards: defaultSessionShards},
+		{name: "Small", capacity: 1024, shards: defaultSessionShards, wantShards: 4},
+		{name: "Unsharded", shards: 1, wantShards: 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			issued := newIssuedCIDs(time.Minute, tt.capacity, tt.shards)
+			capacity := tt.capacity
+			if capacity == 0 {
+				capacity = defaultIssuedCIDCapacity
+			}
+			if got := len(issued.shards); got != tt.wantShards {
+				t.Errorf("%d shards, want %d", got, tt.wantShards)
+			}
+			if got := len(issued.shards) * len(issued.shards[0].buckets) * issuedBucketSlots; got < capacity {
+				t.Errorf("filter holds %d slots, want at least %d", got, capacity)
+			}
+		})
+	}
+
+	// adds and lookups in parallel find every CID, whatever its shard
+	now := newFakeClock().Now()
+	issued := newIssuedCIDs(time.Minute, 0, defaultSessionShards)
+	issued.add([]byte{0xff}, 2, now)
+	var wg sync.WaitGroup
+	for w := range 4 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range 256 {
+				cid := []byte{0x00, byte(w), byte(i), 0x03, 0x04, 0x05, 0x06, 0x07}
+				issued.add(cid, 1, now)
+				// every worker also hits, and refreshes, one shared CID
+				issued.lookup([]byte{0xff}, now.Add(time.Duration(i)*time.Second))
+				if rotation, ok := issued.lookup(cid, now); !ok || rotation != 1 {
+					t.Errorf("lookup(%x) = (%d, %v), want (1, true)", cid, rotation, ok)
+				}
+			}
+		}()
+	}
+	wg.Wait()
+}
+
+func TestIssuedCIDFalsePositive(t *testing.T) {
+	lb, err := NewLoadBalancer(Config{Backends: StaticBackends("backend0", "backend1")})
+	if err != nil {
+		t.Fatalf("NewLoadBalancer() error = %v", err)
+	}
+	cid, err := lb.routes().codec.Encode(0, []byte{0x01}, nil)
+	if err != nil {
+		t.Fatalf("Encode() error = %v", err)
+	}
+	// as if the CID shared a fingerprint with one issued under an inactive rotation
+	lb.issued.add(cid, 2, lb.clock.Now())
+	if _, ok := lb.issued.lookup(cid, lb.clock.Now()); !ok {
+		t.Fatalf("lookup() returned false")
+	}
+	_, backend, err := lb.decodeCID(cid)
+	if err != nil {
+		t.Fatalf("decodeCID() error = %v", err)
+	}
+	if backend.Address != "backend1" {
+		t.Errorf("decodeCID() = %q, want %q", backend.Address, "backend1")
+	}
+}
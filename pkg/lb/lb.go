@@ -1,63 +1,458 @@
 package lb
 
 import (
+	"context"
+	"errors"
+	"log"
 	"net"
+	"net/http"
+	"os"
 	"sync"
+	"sync/atomic"
+	"time"
 
 	"github.com/fqzz2000/QUIC-LB-SHRIMP/pkg/packet"
+	"github.com/fqzz2000/QUIC-LB-SHRIMP/pkg/quiclb"
 )
 
 // LoadBalancer represents the main QUIC load balancer structure
 type LoadBalancer struct {
 	// Configuration
-	listenAddr string
-	backends   []string
+	listenNet      string
+	listenAddr     string
+	listenRetry    time.Duration
+	listeners      []*clientListener
+	acceptProxy    bool // strip PROXY v2 headers from client datagrams
+	adminAddr      string
+	pprof          bool // serve profiles on the admin server
+	metricsFormat  string
+	controlAddr    string
+	controlNet     string
+	evictNotices   bool
+	debug          bool
+	recoverPanics  bool
+	workers        int
+	queueSize      int
+	shadow         BackendConfig
+	shadowRate     float64
+	ampFactor      int
+	timeouts       timeouts
+	longestIdle    atomic.Int64 // longest idle timeout given a flow, see drainIdle
+	dropOverCap    bool
+	rewriteCIDs    bool
+	rewriteLength  int // issued CID length in rewrite mode, zero for the client's
+	hashSeed       uint64
+	backendDrain   time.Duration
+	dropRemoved    bool
+	backendSockets string
+	sourcePorts    portRange
+	backendSource  net.IP // nil binds no particular address
+	repairDecodes  bool
+	checkLengths   bool
+	minInitial     int // smallest datagram carrying an Initial, zero for any
+	minCID         int // shortest DCID routed, zero for any
+	zeroRTT        string
+	zeroRTTLimit   int // bytes returned to a 0-RTT flow before 1-RTT, zero for any
+	unknownIDs     string
+	catchAll       BackendConfig
+	drainPolicy    string
+	trailing       string
+	reordered      string
+	codepoints     [quiclb.NumConfigs]string // the rotation policy of each codepoint
+	canary         string
+	canaryShare    uint64          // in canaryScale units
+	forwardTypes   typeSet         // unset forwards every type
+	newFlowLimit   *newFlowLimiter // nil leaves new flows unlimited
+	sourceFlowCap  int             // flows a source IP may hold, zero for any
+	healthCheck    *healthCheck    // nil disables the QUIC health check
+	retryTokens    *retryTokens    // nil unless draining sends Retries
+	resetKey       []byte
+	resolver       Resolver
+	resolveTimeout time.Duration
+	resolveRetry   time.Duration
+	logs           *logSampler   // nil unless sampled logging is configured
+	malformed      *logSampler   // nil unless malformed packets are strict
+	trace          *decodeTracer // nil unless debug decode tracing is configured
+	slow           *slowPackets  // nil unless a slow-packet threshold is configured
+	events         *eventLog     // nil when disabled
+	nonces         *nonceReuse   // nil unless nonce reuse detection is configured
+	idLoad         *serverIDLoad // nil unless server ID sampling is configured
+	idChecks       *idMismatches // nil unless server ID self-reports are verified
+	decisions      *sinkQueue    // nil unless a decision sink is configured
+	loads          *backendLoads // nil unless load reports are configured
 
 	// Runtime state
-	listener net.PacketConn
-	mu       sync.RWMutex
-	running  bool
+	listener   net.PacketConn
+	admin      *http.Server
+	adminLn    net.Listener
+	adminDone  <-chan struct{}
+	shared     *sharedSocket // backend socket in unconnected mode
+	warm       warmSockets
+	egress     egressLimits   // buckets of backends with an egress rate
+	control    net.PacketConn // backend notifications, nil unless configured
+	mu         sync.RWMutex
+	running    bool
+	cancel     context.CancelFunc
+	done       chan struct{} // closed once run has torn everything down
+	flowWG     sync.WaitGroup
+	unhealthy  map[string]bool      // backend addresses marked unhealthy, guarded by mu
+	removing   map[string]time.Time // backends draining for removal and their deadlines, guarded by mu
+	drained    map[string]bool      // backends removed once drained, until added again, guarded by mu
+	unresolved []string             // backends that did not resolve at startup, guarded by mu
+	draining   atomic.Bool
 
 	// Packet processing
-	packetProcessor *packet.HeaderParser
+	routing   atomic.Pointer[routingTable] // see routes
+	issued    *issuedCIDs
+	retiring  retirements // rotations being watched drain
+	overrides *overrideTable
+
+	// Flow tracking
+	sessions *sessionTable
+	clock    Clock
+
+	// Counters
+	stats   counters
+	metrics *lbMetrics
 }
 
+// errAlreadyRunning is returned by Run when the load balancer is already started
+var errAlreadyRunning = errors.New("load balancer already running")
+
+// defaultDCIDLength is the short-header DCID length assumed until configuration is loaded
+const defaultDCIDLength = 8
+
 // InitLoadBalancer creates and initializes a new LoadBalancer instance
 func InitLoadBalancer(listenAddr string, backends []string) (*LoadBalancer, error) {
+	return NewLoadBalancer(Config{
+		ListenAddr: listenAddr,
+		Backends:   StaticBackends(backends...),
+	})
+}
+
+// NewLoadBalancer creates a LoadBalancer from a full configuration. When no
+// QUIC-LB config is active a plaintext default is installed at rotation 0.
+func NewLoadBalancer(cfg Config) (*LoadBalancer, error) {
+	routes, err := newRoutingTable(&cfg)
+	if err != nil {
+		return nil, err
+	}
+	routes.ring = newHashRing(cfg.Backends, cfg.HashSeed)
+	if cfg.Clock == nil {
+		cfg.Clock = systemClock{}
+	}
+
+	listeners, err := cfg.listeners()
+	if err != nil {
+		return nil, err
+	}
+	backendSockets, err := cfg.backendSockets()
+	if err != nil {
+		return nil, err
+	}
+	sourcePorts, err := cfg.sourcePorts()
+	if err != nil {
+		return nil, err
+	}
+	backendSource, err := cfg.backendSource()
+	if err != nil {
+		return nil, err
+	}
+	zeroRTT, err := cfg.zeroRTT()
+	if err != nil {
+		return nil, err
+	}
+	zeroRTTLimit, err := cfg.zeroRTTReturnLimit()
+	if err != nil {
+		return nil, err
+	}
+	unknownServerIDs, err := cfg.unknownServerIDs()
+	if err != nil {
+		return nil, err
+	}
+	canaryShare, err := cfg.canaryShare()
+	if err != nil {
+		return nil, err
+	}
+	forwardTypes, err := cfg.forwardTypes()
+	if err != nil {
+		return nil, err
+	}
+	newFlowLimit, err := cfg.newFlowLimiter()
+	if err != nil {
+		return nil, err
+	}
+	healthCheck, err := cfg.healthCheck()
+	if err != nil {
+		return nil, err
+	}
+	rewriteLength, err := cfg.rewriteCIDLength()
+	if err != nil {
+		return nil, err
+	}
+	minInitial, err := cfg.minInitialSize()
+	if err != nil {
+		return nil, err
+	}
+	codepoints, err := cfg.rotationPolicies()
+	if err != nil {
+		return nil, err
+	}
+	pprof, err := cfg.pprofEnabled()
+	if err != nil {
+		return nil, err
+	}
+	drainPolicy, err := cfg.drainingNewFlows()
+	if err != nil {
+		return nil, err
+	}
+	sourceFlowCap, err := cfg.maxSourceFlows()
+	if err != nil {
+		return nil, err
+	}
+	retryTokens, err := cfg.retryTokens(drainPolicy)
+	if err != nil {
+		return nil, err
+	}
+	trailing, err := cfg.trailingBytes()
+	if err != nil {
+		return nil, err
+	}
+	reordered, err := cfg.reorderedCoalesced()
+	if err != nil {
+		return nil, err
+	}
+	loads, err := cfg.loadReports()
+	if err != nil {
+		return nil, err
+	}
+	malformed, err := cfg.malformedPackets()
+	if err != nil {
+		return nil, err
+	}
+	minCID, err := cfg.minCIDLength()
+	if err != nil {
+		return nil, err
+	}
+	evictNotices, err := cfg.evictionNotices()
+	if err != nil {
+		return nil, err
+	}
+	verifyIDs, err := cfg.serverIDReports()
+	if err != nil {
+		return nil, err
+	}
+	metricsFormat, err := cfg.metricsFormat()
+	if err != nil {
+		return nil, err
+	}
+	sessionShards, err := cfg.sessionShards()
+	if err != nil {
+		return nil, err
+	}
+
 	lb := &LoadBalancer{
-		listenAddr: listenAddr,
-		backends:   backends,
-		running:    false,
+		listenNet:      cfg.listenNetwork(),
+		listenAddr:     cfg.ListenAddr,
+		listenRetry:    cfg.ListenRetryTimeout,
+		listeners:      listeners,
+		acceptProxy:    cfg.AcceptProxyProtocol,
+		adminAddr:      cfg.AdminAddr,
+		pprof:          pprof,
+		metricsFormat:  metricsFormat,
+		controlAddr:    cfg.ControlAddr,
+		controlNet:     cfg.controlNetwork(),
+		evictNotices:   evictNotices,
+		debug:          cfg.Debug,
+		recoverPanics:  cfg.RecoverPanics,
+		workers:        cfg.workers(),
+		queueSize:      cfg.queueSize(),
+		shadow:         cfg.Shadow,
+		shadowRate:     cfg.shadowRate(),
+		ampFactor:      cfg.amplificationFactor(),
+		timeouts:       cfg.timeouts(),
+		dropOverCap:    cfg.DropOverCapacity,
+		rewriteCIDs:    cfg.RewriteCIDs,
+		rewriteLength:  rewriteLength,
+		hashSeed:       cfg.HashSeed,
+		backendDrain:   cfg.backendDrainTimeout(),
+		dropRemoved:    cfg.DropRemovedServerIDs,
+		backendSockets: backendSockets,
+		sourcePorts:    sourcePorts,
+		backendSource:  backendSource,
+		repairDecodes:  cfg.RepairDecodes,
+		checkLengths:   cfg.CheckLengths,
+		minInitial:     minInitial,
+		zeroRTT:        zeroRTT,
+		zeroRTTLimit:   zeroRTTLimit,
+		unknownIDs:     unknownServerIDs,
+		catchAll:       cfg.CatchAll,
+		drainPolicy:    drainPolicy,
+		trailing:       trailing,
+		reordered:      reordered,
+		minCID:         minCID,
+		retryTokens:    retryTokens,
+		codepoints:     codepoints,
+		canary:         cfg.Canary,
+		canaryShare:    canaryShare,
+		forwardTypes:   forwardTypes,
+		newFlowLimit:   newFlowLimit,
+		sourceFlowCap:  sourceFlowCap,
+		healthCheck:    healthCheck,
+		resetKey:       cfg.StatelessResetKey,
+		resolver:       cfg.resolver(),
+		resolveTimeout: cfg.resolveTimeout(),
+		resolveRetry:   cfg.resolveRetryInterval(),
+		logs:           newLogSampler(cfg.LogSuccessRate, cfg.LogFailuresPerSecond),
+		malformed:      newMalformedLog(malformed),
+		trace:          newDecodeTracer(cfg.Debug, cfg.DecodeTraceRate),
+		slow:           newSlowPackets(cfg.SlowPacketThreshold),
+		events:         newEventLog(cfg.EventLogSize),
+		nonces:         newNonceReuse(cfg.NonceReuseWindow, cfg.NonceSampleRate),
+		idLoad:         newServerIDLoad(cfg.ServerIDSamples, cfg.ServerIDSampleRate),
+		idChecks:       newIDMismatches(verifyIDs),
+		decisions:      newSinkQueue(cfg.DecisionSink, cfg.DecisionQueueSize),
+		loads:          loads,
+		running:        false,
+		unhealthy:      make(map[string]bool),
+		removing:       make(map[string]time.Time),
+		drained:        make(map[string]bool),
+		issued:         newIssuedCIDs(cfg.IssuedCIDTTL, cfg.IssuedCIDCapacity, sessionShards),
+		overrides:      newOverrideTable(cfg.OverrideTTL),
+		sessions:       newSessionTable(sessionShards),
+		clock:          cfg.Clock,
+	}
+	lb.metrics = lb.newMetrics(cfg.Metrics, cfg.Name)
+	routes.decodeLatency = lb.metrics.decodeHistograms(routes.codec)
+	routes.sidLengths = lb.metrics.serverIDLengthCounters(routes.codecEntries())
+	lb.routing.Store(routes)
+	for _, o := range cfg.Overrides {
+		if err := lb.AddOverride(o); err != nil {
+			return nil, err
+		}
 	}
 	return lb, nil
 }
 
-// Start begins the load balancer operations
+// Start binds the listener and runs the load balancer in the background until Shutdown
 func (lb *LoadBalancer) Start() error {
+	ctx, err := lb.bind(context.Background())
+	if err != nil || ctx == nil {
+		return err
+	}
+	go func() {
+		if err := lb.run(ctx); err != nil {
+			log.Printf("Load balancer stopped: %v", err)
+		}
+	}()
+	return nil
+}
+
+// Run binds the listener and processes packets until ctx is cancelled or
+// Shutdown is called. Every reader, worker and return goroutine has exited
+// by the time it returns.
+func (lb *LoadBalancer) Run(ctx context.Context) error {
+	runCtx, err := lb.bind(ctx)
+	if err != nil {
+		return err
+	}
+	if runCtx == nil {
+		return errAlreadyRunning
+	}
+	return lb.run(runCtx)
+}
+
+// bind opens the listener, admin server and control socket and returns the context that
+// governs the run, or a nil context if the load balancer is already running
+func (lb *LoadBalancer) bind(parent context.Context) (context.Context, error) {
+	lb.mu.RLock()
+	running := lb.running
+	lb.mu.RUnlock()
+	var unresolved []string
+	if !running {
+		unresolved = lb.resolveBackends(parent)
+		unresolved = append(unresolved, lb.warmup(parent)...)
+	}
+
 	lb.mu.Lock()
 	defer lb.mu.Unlock()
 
 	if lb.running {
-		return nil
+		return nil, nil
 	}
+	lb.unresolved = unresolved
 
-	listener, err := net.ListenPacket("udp", lb.listenAddr)
+	listener, err := lb.bindListener(parent)
 	if err != nil {
-		return err
+		return nil, err
 	}
 
 	lb.listener = listener
+	if err := lb.bindListeners(parent); err != nil {
+		lb.closeListener()
+		return nil, err
+	}
+
+	if lb.adminAddr != "" {
+		if err := lb.startAdmin(); err != nil {
+			lb.closeListener()
+			return nil, err
+		}
+	}
+	if err := lb.openControl(); err != nil {
+		lb.stopAdmin()
+		lb.closeListener()
+		return nil, err
+	}
+	if err := lb.openShared(); err != nil {
+		lb.closeControl()
+		lb.stopAdmin()
+		lb.closeListener()
+		return nil, err
+	}
+
+	ctx, cancel := context.WithCancel(parent)
+	lb.cancel = cancel
+	lb.done = make(chan struct{})
 	lb.running = true
+	lb.draining.Store(false)
 
-	return nil
+	return ctx, nil
+}
+
+// closeListener closes the listeners and, for a Unix datagram socket, removes
+// the socket file it created. Callers must hold lb.mu.
+func (lb *LoadBalancer) closeListener() {
+	lb.closeListeners()
+	lb.listener.Close()
+	if lb.listenNet == "unixgram" {
+		os.Remove(lb.listenAddr)
+	}
+	lb.listener = nil
+}
+
+// Addr returns the local address of the listener, or nil before Start
+func (lb *LoadBalancer) Addr() net.Addr {
+	lb.mu.RLock()
+	defer lb.mu.RUnlock()
+	if lb.listener == nil {
+		return nil
+	}
+	return lb.listener.LocalAddr()
 }
 
 // ReadPacket reads a single QUIC packet from the UDP listener
 func (lb *LoadBalancer) ReadPacket() ([]byte, net.Addr, error) {
-	// Buffer size for QUIC packets (typical MTU size)
-	buffer := make([]byte, 1500)
+	lb.mu.RLock()
+	listener := lb.listener
+	lb.mu.RUnlock()
+	if listener == nil {
+		return nil, nil, net.ErrClosed
+	}
 
-	n, addr, err := lb.listener.ReadFrom(buffer)
+	buffer := make([]byte, maxPacketSize)
+
+	n, addr, err := listener.ReadFrom(buffer)
 	if err != nil {
 		return nil, nil, err
 	}
@@ -66,25 +461,61 @@ func (lb *LoadBalancer) ReadPacket() ([]byte, net.Addr, error) {
 	return buffer[:n], addr, nil
 }
 
+// packetBuffers recycles the buffers readLoop reads datagrams into. A
+// datagram forwarded verbatim is written to its backend straight from the
+// buffer it was read into, which goes back to the pool only once the worker
+// is done with the packet, so the forward path copies and allocates no
+// packet bytes. Nothing may keep a slice of a packet past handlePacket.
+var packetBuffers = sync.Pool{New: func() any {
+	b := make([]byte, maxPacketSize)
+	return &b
+}}
+
 // ExtractCID extracts the Connection ID from a QUIC packet
 // Returns the CID as a byte slice and an error if extraction fails
-func (lb *LoadBalancer) ExtractCID(packet []byte) ([]byte, error) {
-	return lb.packetProcessor.HeaderParser.ExtractCID(packet)
+func (lb *LoadBalancer) ExtractCID(pkt []byte) ([]byte, error) {
+	header, err := lb.parseHeader(pkt, lb.routes().packetProcessor)
+	if err != nil {
+		return nil, err
+	}
+	return header.GetCID()
+}
+
+// parseHeader parses and validates a packet header with processor, the one
+// of the listener the packet arrived on, counting truncated connection IDs
+// and fixed-bit violations
+func (lb *LoadBalancer) parseHeader(pkt []byte, processor *packet.PacketProcessor) (packet.QuicHeader, error) {
+	header, err := processor.ParsePacket(pkt)
+	if errors.Is(err, packet.ErrTruncatedCID) {
+		// counted apart from other malformed packets so clients with the wrong CID length stand out
+		lb.stats.truncatedCIDs.Add(1)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := processor.CheckFixedBit(pkt[0], header); err != nil {
+		lb.stats.fixedBitDrops.Add(1)
+		return nil, err
+	}
+	return header, nil
 }
 
-// Shutdown gracefully stops the load balancer
+// TruncatedCIDCount returns how many short-header packets carried a DCID shorter than configured
+func (lb *LoadBalancer) TruncatedCIDCount() uint64 {
+	return lb.stats.truncatedCIDs.Load()
+}
+
+// Shutdown gracefully stops the load balancer and waits for its goroutines to exit
 func (lb *LoadBalancer) Shutdown() error {
-	lb.mu.Lock()
-	defer lb.mu.Unlock()
+	lb.mu.RLock()
+	running, cancel, done := lb.running, lb.cancel, lb.done
+	lb.mu.RUnlock()
 
-	if !lb.running {
+	if !running {
 		return nil
 	}
 
-	if err := lb.listener.Close(); err != nil {
-		return err
-	}
-
-	lb.running = false
+	cancel()
+	<-done
 	return nil
 }
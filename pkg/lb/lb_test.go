@@ -0,0 +1,81 @@
+package lb
+
+import (
+	"bytes"
+	"errors"
+	"testing"
+
+	"github.com/fqzz2000/QUIC-LB-SHRIMP/pkg/packet"
+	"github.com/fqzz2000/QUIC-LB-SHRIMP/pkg/quiclb"
+)
+
+func TestExtractCIDCountsTruncatedCID(t *testing.T) {
+	lb, err := InitLoadBalancer("127.0.0.1:0", []string{"backend1"})
+	if err != nil {
+		t.Fatalf("InitLoadBalancer() error = %v", err)
+	}
+
+	short := []byte{0x40, 0x01, 0x02, 0x03, 0x04, 0x05, 0x06, 0x07}
+	if _, err := lb.ExtractCID(short); !errors.Is(err, packet.ErrPacketTooShort) {
+		t.Fatalf("ExtractCID() error = %v, want %v", err, packet.ErrPacketTooShort)
+	}
+	if _, err := lb.ExtractCID([]byte{0xC0, 0x00}); err == nil {
+		t.Fatalf("ExtractCID() on truncated long header returned no error")
+	}
+
+	if got := lb.TruncatedCIDCount(); got != 1 {
+		t.Errorf("TruncatedCIDCount() = %d, want 1", got)
+	}
+}
+
+func TestFixedBitEnforcementPerConfig(t *testing.T) {
+	newLB := func(allowGrease bool) *LoadBalancer {
+		t.Helper()
+		cfg := defaultQUICLBConfig
+		cfg.AllowGreasedFixedBit = allowGrease
+		lb, err := NewLoadBalancer(Config{
+			Backends: StaticBackends("backend0"),
+			QUICLB:   [quiclb.NumConfigs]quiclb.ConfigEntry{cfg},
+		})
+		if err != nil {
+			t.Fatalf("NewLoadBalancer() error = %v", err)
+		}
+		return lb
+	}
+
+	tests := []struct {
+		name        string
+		allowGrease bool
+		firstByte   byte
+		wantErr     error
+	}{
+		{name: "Enforcing Fixed Bit Set", firstByte: 0x40},
+		// the reserved bits are header-protected and never checked
+		{name: "Enforcing Fixed Bit Set Reserved Bits Set", firstByte: 0x58},
+		{name: "Enforcing Fixed Bit Clear", firstByte: 0x00, wantErr: packet.ErrFixedBitUnset},
+		{name: "Permissive Fixed Bit Set", allowGrease: true, firstByte: 0x40},
+		{name: "Permissive Fixed Bit Clear", allowGrease: true, firstByte: 0x00},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			lb := newLB(tt.allowGrease)
+			cid, _ := lb.routes().codec.Encode(0, []byte{0x00}, nil)
+			pkt := append([]byte{tt.firstByte}, cid...)
+
+			got, err := lb.ExtractCID(pkt)
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("ExtractCID() error = %v, want %v", err, tt.wantErr)
+			}
+			if err == nil && !bytes.Equal(got, cid) {
+				t.Errorf("ExtractCID() = %x, want %x", got, cid)
+			}
+			wantDrops := uint64(0)
+			if tt.wantErr != nil {
+				wantDrops = 1
+			}
+			if n := lb.Stats().FixedBitDrops; n != wantDrops {
+				t.Errorf("FixedBitDrops = %d, want %d", n, wantDrops)
+			}
+		})
+	}
+}
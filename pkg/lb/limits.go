@@ -0,0 +1,51 @@
+package lb
+
+import (
+	"errors"
+	"fmt"
+	"log"
+)
+
+// errBackendFull is returned for a new flow whose CID decodes to a backend at
+// its MaxFlows limit when DropOverCapacity is set
+var errBackendFull = errors.New("backend at flow limit")
+
+// atCapacity reports whether the backend at addr has as many flows as its
+// MaxFlows allows. Workers admit flows concurrently, so the limit is soft: a
+// burst of new flows can overshoot it by up to the number of workers.
+func (lb *LoadBalancer) atCapacity(addr string) bool {
+	b, ok := lb.backendByAddress(addr)
+	if !ok || b.MaxFlows <= 0 {
+		return false
+	}
+	return lb.sessions.backendFlowCount(addr) >= b.MaxFlows
+}
+
+// unavailable reports whether new flows routed without affinity should skip
+// the backend at addr: it is marked unhealthy, at its flow limit, over its
+// egress rate, or draining for removal
+func (lb *LoadBalancer) unavailable(addr string) bool {
+	return lb.unhealthyBackend(addr) || lb.atCapacity(addr) || lb.egress.throttled(addr, lb.clock.Now()) || lb.backendRemoving(addr)
+}
+
+// admitDecoded applies the flow limit to a new flow whose CID decoded to
+// backend. The client already holds a CID naming that server, so spilling
+// it elsewhere would break the connection; the flow is admitted over the
+// limit, or dropped with DropOverCapacity, and counted either way.
+func (lb *LoadBalancer) admitDecoded(backend BackendConfig) (BackendConfig, error) {
+	if lb.egress.throttled(backend.Address, lb.clock.Now()) {
+		lb.stats.egressDecoded.Add(1)
+		return BackendConfig{}, fmt.Errorf("%w: %s", errEgressDecoded, backend.Address)
+	}
+	if !lb.atCapacity(backend.Address) {
+		return backend, nil
+	}
+	lb.stats.overCapacity.Add(1)
+	if lb.dropOverCap {
+		return BackendConfig{}, fmt.Errorf("%w: %s", errBackendFull, backend.Address)
+	}
+	if lb.debug {
+		log.Printf("Backend %s over its flow limit of %d", backend.Address, backend.MaxFlows)
+	}
+	return backend, nil
+}
@@ -0,0 +1,61 @@
+package lb
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestFlowLimitSpillover(t *testing.T) {
+	lb, err := NewLoadBalancer(Config{Backends: []BackendConfig{
+		{Address: "10.0.0.1:443", MaxFlows: 2},
+		{Address: "10.0.0.2:443"},
+	}})
+	if err != nil {
+		t.Fatalf("NewLoadBalancer() error = %v", err)
+	}
+	undecodable := []byte{0xc0, 0x00}
+	routed := func() map[string]int {
+		counts := map[string]int{}
+		for i := 0; i < 64; i++ {
+			backend, err := lb.selectBackend(undecodable, testAddr(i))
+			if err != nil {
+				t.Fatalf("selectBackend() error = %v", err)
+			}
+			counts[backend.Address]++
+		}
+		return counts
+	}
+
+	if counts := routed(); counts["10.0.0.1:443"] == 0 {
+		t.Fatalf("no flows hashed to the limited backend before it filled: %v", counts)
+	}
+
+	// fill the limited backend
+	for i := 0; i < 2; i++ {
+		lb.sessions.remember(&Flow{Backend: "10.0.0.1:443", conn: nopConn{}}, nil, testAddr(200+i))
+	}
+	if counts := routed(); counts["10.0.0.1:443"] != 0 || counts["10.0.0.2:443"] != 64 {
+		t.Errorf("routed with the limited backend full = %v, want every flow on 10.0.0.2:443", counts)
+	}
+
+	// a CID naming the full backend is admitted over the limit and counted
+	cid, err := lb.routes().codec.Encode(lb.routes().issueRotation, []byte{0}, nil)
+	if err != nil {
+		t.Fatalf("Encode() error = %v", err)
+	}
+	backend, err := lb.selectBackend(cid, testAddr(1))
+	if err != nil || backend.Address != "10.0.0.1:443" {
+		t.Errorf("selectBackend(decoded) = %q, %v, want 10.0.0.1:443", backend.Address, err)
+	}
+	if got := lb.Stats().OverCapacity; got != 1 {
+		t.Errorf("OverCapacity = %d, want 1", got)
+	}
+
+	lb.dropOverCap = true
+	if _, err := lb.selectBackend(cid, testAddr(1)); !errors.Is(err, errBackendFull) {
+		t.Errorf("selectBackend(decoded) with DropOverCapacity error = %v, want %v", err, errBackendFull)
+	}
+	if got := lb.Stats().OverCapacity; got != 2 {
+		t.Errorf("OverCapacity = %d, want 2", got)
+	}
+}
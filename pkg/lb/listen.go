@@ -0,0 +1,71 @@
+package lb
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"syscall"
+	"time"
+)
+
+// A listener bind that fails because the address is taken fails Start at
+// once by default, with an error naming the address and the likely cause.
+// For fast restarts, where the previous instance may not have released the
+// port yet, Config.ListenRetryTimeout keeps retrying such a bind with
+// backoff for up to that long. Other bind errors are never retried.
+
+const (
+	// listenRetryFirst is the wait before the first retry, doubling to
+	// listenRetryMax
+	listenRetryFirst = 50 * time.Millisecond
+	listenRetryMax   = time.Second
+)
+
+// ErrAddrInUse is returned by Start and Run when the listen address is
+// already bound by another socket
+var ErrAddrInUse = errors.New("listen address already in use")
+
+// bindListener opens the client-facing listener, retrying a bind to an
+// address in use until the retry timeout or ctx is done. Callers must hold
+// lb.mu.
+func (lb *LoadBalancer) bindListener(ctx context.Context) (net.PacketConn, error) {
+	return lb.bindRetrying(ctx, lb.listenNet, lb.listenAddr, lb.listen)
+}
+
+// bindRetrying binds addr on network with listen, retrying while the address
+// is in use as bindListener does
+func (lb *LoadBalancer) bindRetrying(ctx context.Context, network, addr string, listen func() (net.PacketConn, error)) (net.PacketConn, error) {
+	deadline := time.Now().Add(lb.listenRetry)
+	wait := listenRetryFirst
+	for {
+		conn, err := listen()
+		if err == nil {
+			return conn, nil
+		}
+		if !errors.Is(err, syscall.EADDRINUSE) {
+			return nil, fmt.Errorf("binding %s listener on %s: %w", network, addr, err)
+		}
+		if lb.listenRetry <= 0 || time.Now().Add(wait).After(deadline) {
+			return nil, fmt.Errorf("%w: %s %s (%s): %w", ErrAddrInUse, network, addr, inUseCause(network), err)
+		}
+		log.Printf("Listen address %s in use, retrying in %v", addr, wait)
+		timer := time.NewTimer(wait)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return nil, fmt.Errorf("%w: %s %s: %w", ErrAddrInUse, network, addr, ctx.Err())
+		case <-timer.C:
+		}
+		wait = min(2*wait, listenRetryMax)
+	}
+}
+
+// inUseCause describes what likely holds a listen address on network
+func inUseCause(network string) string {
+	if network == "unixgram" {
+		return "another process is bound to the socket, or a previous run left its file behind"
+	}
+	return "another process, or a previous instance still shutting down, holds the port; see Config.ListenRetryTimeout"
+}
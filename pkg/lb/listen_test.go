@@ -0,0 +1,65 @@
+package lb
+
+import (
+	"errors"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestListenAddrInUse(t *testing.T) {
+	squatter, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("ListenPacket() error = %v", err)
+	}
+	defer squatter.Close()
+	addr := squatter.LocalAddr().String()
+
+	lb, err := NewLoadBalancer(Config{ListenAddr: addr, Backends: StaticBackends("127.0.0.1:9")})
+	if err != nil {
+		t.Fatalf("NewLoadBalancer() error = %v", err)
+	}
+	err = lb.Start()
+	if !errors.Is(err, ErrAddrInUse) {
+		t.Fatalf("Start() error = %v, want %v", err, ErrAddrInUse)
+	}
+	if msg := err.Error(); !strings.Contains(msg, addr) || !strings.Contains(msg, "previous instance") {
+		t.Errorf("Start() error = %q, want the address and the likely cause", msg)
+	}
+	if lb.Addr() != nil {
+		t.Errorf("listener bound after a failed Start")
+	}
+}
+
+func TestListenRetryTimeout(t *testing.T) {
+	squatter, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("ListenPacket() error = %v", err)
+	}
+	addr := squatter.LocalAddr().String()
+
+	// the address is still taken when the retries run out
+	lb, err := NewLoadBalancer(Config{ListenAddr: addr, ListenRetryTimeout: 120 * time.Millisecond, Backends: StaticBackends("127.0.0.1:9")})
+	if err != nil {
+		t.Fatalf("NewLoadBalancer() error = %v", err)
+	}
+	if err := lb.Start(); !errors.Is(err, ErrAddrInUse) {
+		t.Fatalf("Start() error = %v, want %v", err, ErrAddrInUse)
+	}
+
+	// the previous holder lets go while the bind is retried
+	lb, err = NewLoadBalancer(Config{ListenAddr: addr, ListenRetryTimeout: 5 * time.Second, Backends: StaticBackends("127.0.0.1:9")})
+	if err != nil {
+		t.Fatalf("NewLoadBalancer() error = %v", err)
+	}
+	release := time.AfterFunc(100*time.Millisecond, func() { squatter.Close() })
+	defer release.Stop()
+	if err := lb.Start(); err != nil {
+		t.Fatalf("Start() error = %v, want the bind retried until the address is free", err)
+	}
+	defer lb.Shutdown()
+	if got := lb.Addr().String(); got != addr {
+		t.Errorf("Addr() = %s, want %s", got, addr)
+	}
+}
@@ -0,0 +1,145 @@
+package lb
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"sync/atomic"
+
+	"github.com/fqzz2000/QUIC-LB-SHRIMP/pkg/packet"
+)
+
+// Extra listeners (Config.Listeners) put more client-facing UDP addresses in
+// front of the same backends and session table, for ports fronting services
+// whose connection IDs differ in length. A short header carries no DCID
+// length, so each listener parses the short headers arriving on it with its
+// own, zero taking the length of the QUIC-LB configs as the main listener
+// does; long headers carry theirs and parse alike everywhere. Every step of
+// a datagram's path, from routing through the length checks, coalesced
+// packet splitting and the 0-RTT policy to rewriting replies, parses with
+// the listener's length. A flow is
+// answered from the listener that opened it, as is whatever the LB sends a
+// client itself: stateless resets, Version Negotiation and drain redirects.
+// Extra listeners bind, retry a bind to an address in use and close with
+// the main one.
+
+// errListener is returned for an invalid Config.Listeners entry
+var errListener = errors.New("invalid listener")
+
+// ListenerConfig is a client-facing listener beside Config.ListenAddr
+type ListenerConfig struct {
+	// Address is the UDP address the listener binds
+	Address string
+	// DCIDLength is the DCID length of short headers arriving on the
+	// listener, zero for the one the QUIC-LB configs imply
+	DCIDLength uint8
+}
+
+// clientListener is a bound extra listener
+type clientListener struct {
+	ListenerConfig
+	conn   net.PacketConn
+	parser atomic.Pointer[listenerParser]
+}
+
+// listenerParser is a listener's header parsing for one routing table
+type listenerParser struct {
+	rt        *routingTable
+	processor *packet.PacketProcessor
+}
+
+// listeners returns the configured extra listeners, unbound
+func (c *Config) listeners() ([]*clientListener, error) {
+	var lns []*clientListener
+	for _, l := range c.Listeners {
+		switch {
+		case l.Address == "":
+			return nil, fmt.Errorf("%w: no address", errListener)
+		case l.DCIDLength > packet.MaxCIDLength:
+			return nil, fmt.Errorf("%w: %s DCID length %d exceeds %d", errListener, l.Address, l.DCIDLength, packet.MaxCIDLength)
+		}
+		lns = append(lns, &clientListener{ListenerConfig: l})
+	}
+	return lns, nil
+}
+
+// listenerNetwork is the network extra listeners bind on: the main
+// listener's when it names an IP family, otherwise plain UDP
+func (lb *LoadBalancer) listenerNetwork() string {
+	if lb.listenNet == "udp4" || lb.listenNet == "udp6" {
+		return lb.listenNet
+	}
+	return "udp"
+}
+
+// bindListeners binds every extra listener, closing those it bound when one
+// fails. Callers must hold lb.mu.
+func (lb *LoadBalancer) bindListeners(ctx context.Context) error {
+	network := lb.listenerNetwork()
+	for i, ln := range lb.listeners {
+		conn, err := lb.bindRetrying(ctx, network, ln.Address, func() (net.PacketConn, error) {
+			return net.ListenPacket(network, ln.Address)
+		})
+		if err != nil {
+			for _, bound := range lb.listeners[:i] {
+				bound.conn.Close()
+				bound.conn = nil
+			}
+			return err
+		}
+		ln.conn = conn
+	}
+	return nil
+}
+
+// closeListeners closes the extra listeners. Callers must hold lb.mu.
+func (lb *LoadBalancer) closeListeners() {
+	for _, ln := range lb.listeners {
+		if ln.conn != nil {
+			ln.conn.Close()
+			ln.conn = nil
+		}
+	}
+}
+
+// clientConn returns the socket that answers clients of ln, the main
+// listener for nil
+func (lb *LoadBalancer) clientConn(ln *clientListener) net.PacketConn {
+	if ln == nil {
+		return lb.listener
+	}
+	return ln.conn
+}
+
+// processor returns the packet processor for packets arriving on ln: the
+// routing table's, with ln's DCID length when it has one
+func (lb *LoadBalancer) processor(ln *clientListener) *packet.PacketProcessor {
+	rt := lb.routes()
+	if ln == nil || ln.DCIDLength == 0 {
+		return rt.packetProcessor
+	}
+	if p := ln.parser.Load(); p != nil && p.rt == rt {
+		return p.processor
+	}
+	// built once per routing table, so a config change is picked up
+	processor := *rt.packetProcessor
+	processor.DCIDLength = ln.DCIDLength
+	ln.parser.Store(&listenerParser{rt: rt, processor: &processor})
+	return &processor
+}
+
+// Addrs returns the local addresses of the main listener and then of each
+// of Config.Listeners, or nil before Start
+func (lb *LoadBalancer) Addrs() []net.Addr {
+	lb.mu.RLock()
+	defer lb.mu.RUnlock()
+	if lb.listener == nil {
+		return nil
+	}
+	addrs := []net.Addr{lb.listener.LocalAddr()}
+	for _, ln := range lb.listeners {
+		addrs = append(addrs, ln.conn.LocalAddr())
+	}
+	return addrs
+}
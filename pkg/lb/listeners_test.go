@@ -0,0 +1,135 @@
+package lb
+
+import (
+	"bytes"
+	"errors"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/fqzz2000/QUIC-LB-SHRIMP/pkg/packet"
+)
+
+// readFromWithin reads one datagram and the address it came from, failing
+// the test when none arrives before the timeout
+func readFromWithin(t *testing.T, conn net.PacketConn, timeout time.Duration) ([]byte, net.Addr) {
+	t.Helper()
+	buf := make([]byte, maxPacketSize)
+	conn.SetReadDeadline(time.Now().Add(timeout))
+	n, from, err := conn.ReadFrom(buf)
+	if err != nil {
+		t.Fatalf("ReadFrom() error = %v", err)
+	}
+	return buf[:n], from
+}
+
+func TestListenerDCIDLength(t *testing.T) {
+	lb := startTestLB(t, Config{
+		Backends:     StaticBackends(startEchoBackend(t), startEchoBackend(t)),
+		Listeners:    []ListenerConfig{{Address: "127.0.0.1:0", DCIDLength: 4}},
+		CheckLengths: true,
+		ZeroRTT:      zeroRTTDrop,
+	})
+	addrs := lb.Addrs()
+	if len(addrs) != 2 {
+		t.Fatalf("Addrs() = %v, want the main listener and one more", addrs)
+	}
+	main, extra := addrs[0], addrs[1]
+
+	// the main listener reads the QUIC-LB config's 8-byte CIDs
+	cid, err := lb.routes().codec.Encode(0, []byte{0x01}, nil)
+	if err != nil {
+		t.Fatalf("Encode() error = %v", err)
+	}
+	short := append(append([]byte{0x40}, cid...), "main"...)
+	client := newTestClient(t)
+	if _, err := client.WriteTo(short, main); err != nil {
+		t.Fatalf("WriteTo() error = %v", err)
+	}
+	if got, from := readFromWithin(t, client, time.Second); !bytes.Equal(got, short) || from.String() != main.String() {
+		t.Fatalf("response = %x from %s, want %x from %s", got, from, short, main)
+	}
+	if flow := lb.sessions.lookupCID(cid); flow == nil || flow.Backend != lb.routes().backends[1].Address {
+		t.Errorf("flow for %x = %+v, want one to backend 1", cid, flow)
+	}
+
+	// the extra listener's service uses 4-byte CIDs: an Initial opens the
+	// flow, and the echoed reply gives the flow the client's 4-byte SCID
+	scid := []byte{0xa1, 0xa2, 0xa3, 0xa4}
+	initial := quicLongHeader(packet.Initial, []byte{0xc0, 1, 2, 3, 4, 5, 6, 7}, scid, make([]byte, 1200))
+	client = newTestClient(t)
+	if _, err := client.WriteTo(initial, extra); err != nil {
+		t.Fatalf("WriteTo() error = %v", err)
+	}
+	if _, from := readFromWithin(t, client, time.Second); from.String() != extra.String() {
+		t.Fatalf("Initial answered from %s, want %s", from, extra)
+	}
+
+	// a short header too short for an 8-byte DCID routes by its 4-byte one,
+	// from a new address so only the CID finds the flow
+	short = append(append([]byte{0x40}, scid...), 0xee, 0xff)
+	rebound := newTestClient(t)
+	if _, err := rebound.WriteTo(short, extra); err != nil {
+		t.Fatalf("WriteTo() error = %v", err)
+	}
+	if got, from := readFromWithin(t, rebound, time.Second); !bytes.Equal(got, short) || from.String() != extra.String() {
+		t.Fatalf("response = %x from %s, want %x from %s", got, from, short, extra)
+	}
+	if st := lb.Stats(); st.TruncatedCIDs != 0 || st.LearnedCIDLengths != 0 {
+		t.Errorf("TruncatedCIDs = %d, LearnedCIDLengths = %d, want the listener's length parsed", st.TruncatedCIDs, st.LearnedCIDLengths)
+	}
+
+	// a short header coalesced behind a Handshake passes the length checks
+	// with the listener's DCID length, and one behind a 0-RTT packet is all
+	// that is left of its datagram once the 0-RTT is dropped
+	handshake := append(quicLongHeader(packet.HandShake, scid, nil, make([]byte, 32)), short...)
+	if _, err := rebound.WriteTo(handshake, extra); err != nil {
+		t.Fatalf("WriteTo() error = %v", err)
+	}
+	if got, _ := readFromWithin(t, rebound, time.Second); !bytes.Equal(got, handshake) {
+		t.Fatalf("coalesced response = %x, want %x", got, handshake)
+	}
+	early := append(quicLongHeader(packet.ZeroRTT, scid, nil, make([]byte, 32)), short...)
+	if _, err := rebound.WriteTo(early, extra); err != nil {
+		t.Fatalf("WriteTo() error = %v", err)
+	}
+	if got, _ := readFromWithin(t, rebound, time.Second); !bytes.Equal(got, short) {
+		t.Fatalf("0-RTT response = %x, want %x", got, short)
+	}
+	if st := lb.Stats(); st.ZeroRTTDropped != 1 || st.CorruptPackets != 0 {
+		t.Errorf("ZeroRTTDropped = %d, CorruptPackets = %d, want only the 0-RTT packet dropped", st.ZeroRTTDropped, st.CorruptPackets)
+	}
+
+	// the same datagram on the main listener is short of its DCID length
+	if _, err := rebound.WriteTo(short, main); err != nil {
+		t.Fatalf("WriteTo() error = %v", err)
+	}
+	deadline := time.Now().Add(time.Second)
+	for lb.Stats().TruncatedCIDs == 0 {
+		if time.Now().After(deadline) {
+			t.Fatal("TruncatedCIDs = 0, want the main listener to read an 8-byte DCID")
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+func TestListenersConfig(t *testing.T) {
+	tests := []struct {
+		name      string
+		listeners []ListenerConfig
+		wantErr   error
+	}{
+		{name: "None"},
+		{name: "Valid", listeners: []ListenerConfig{{Address: "127.0.0.1:0"}, {Address: "127.0.0.1:0", DCIDLength: 20}}},
+		{name: "No Address", listeners: []ListenerConfig{{DCIDLength: 4}}, wantErr: errListener},
+		{name: "Long DCID", listeners: []ListenerConfig{{Address: "127.0.0.1:0", DCIDLength: 21}}, wantErr: errListener},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := Config{Listeners: tt.listeners}
+			if _, err := cfg.listeners(); !errors.Is(err, tt.wantErr) {
+				t.Errorf("listeners() error = %v, want %v", err, tt.wantErr)
+			}
+		})
+	}
+}
@@ -0,0 +1,159 @@
+package lb
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+)
+
+// Backends may report their load over the control channel
+// (Config.LoadReportMaxAge), and the fallback then steers new flows away
+// from the busiest ones. A load report is one control message:
+//
+//	0x02 load address	load is a two-byte load in thousandths of the
+//		backend's capacity, 1000 being fully loaded; address is the
+//		backend's configured address, the remainder of the datagram
+//
+// Over UDP a report is only honored from the backend's own IP. Reports older
+// than the maximum age are stale. A backend whose fresh load is more than
+// Config.LoadTolerance above the mean of the fresh loads is overloaded: the
+// fallback walks past it on the hash ring to the next backend, so only the
+// clients it would have taken move and every other client keeps its
+// backend. Without fresh reports the fallback uses the ring alone, which
+// weighs backends by their static weights.
+
+const (
+	// controlLoad is the opcode of a load report
+	controlLoad = 0x02
+	// fullLoad is a reported load at the backend's capacity
+	fullLoad = 1000
+	// defaultLoadTolerance is how far above the mean a load may be, as a
+	// share of capacity, before the backend is overloaded
+	defaultLoadTolerance = 0.1
+)
+
+// errLoadReports is returned for an invalid load report configuration
+var errLoadReports = errors.New("invalid load reports")
+
+// backendLoads holds the last load each backend reported
+type backendLoads struct {
+	maxAge    time.Duration
+	tolerance float64 // in thousandths of capacity
+
+	mu      sync.Mutex
+	reports map[string]loadReport
+}
+
+// loadReport is one backend's reported load and when it arrived
+type loadReport struct {
+	load uint16
+	at   time.Time
+}
+
+// loadReports returns the load report settings, nil when disabled
+func (c *Config) loadReports() (*backendLoads, error) {
+	if c.LoadReportMaxAge == 0 && c.LoadTolerance == 0 {
+		return nil, nil
+	}
+	if c.LoadReportMaxAge <= 0 || c.LoadTolerance < 0 {
+		return nil, fmt.Errorf("%w: load report max age %v, tolerance %v", errLoadReports, c.LoadReportMaxAge, c.LoadTolerance)
+	}
+	tolerance := c.LoadTolerance
+	if tolerance == 0 {
+		tolerance = defaultLoadTolerance
+	}
+	return &backendLoads{maxAge: c.LoadReportMaxAge, tolerance: tolerance * fullLoad, reports: make(map[string]loadReport)}, nil
+}
+
+// report records the load of the backend at addr
+func (l *backendLoads) report(addr string, load uint16, now time.Time) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.reports[addr] = loadReport{load: load, at: now}
+}
+
+// forget drops the report of a backend that is gone
+func (l *backendLoads) forget(addr string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	delete(l.reports, addr)
+}
+
+// overloaded returns the backends whose fresh load is over the tolerance
+// above the mean of the fresh loads, nil when there are none
+func (l *backendLoads) overloaded(now time.Time) map[string]bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	var sum float64
+	fresh := 0
+	for _, r := range l.reports {
+		if now.Sub(r.at) <= l.maxAge {
+			sum += float64(r.load)
+			fresh++
+		}
+	}
+	if fresh < 2 {
+		return nil
+	}
+	limit := sum/float64(fresh) + l.tolerance
+	var over map[string]bool
+	for addr, r := range l.reports {
+		if now.Sub(r.at) <= l.maxAge && float64(r.load) > limit {
+			if over == nil {
+				over = make(map[string]bool)
+			}
+			over[addr] = true
+		}
+	}
+	return over
+}
+
+// controlLoadReport records a load report, the operand of a controlLoad
+// message from src
+func (lb *LoadBalancer) controlLoadReport(operand []byte, src net.Addr) error {
+	if lb.loads == nil || len(operand) < 3 {
+		return errControlMessage
+	}
+	load, addr := binary.BigEndian.Uint16(operand), string(operand[2:])
+	if _, ok := lb.backendByAddress(addr); !ok {
+		return fmt.Errorf("%w: no backend %q", errControlMessage, addr)
+	}
+	if !lb.fromBackendHost(addr, src) {
+		return errControlMessage
+	}
+	lb.loads.report(addr, load, lb.clock.Now())
+	lb.stats.loadReports.Add(1)
+	return nil
+}
+
+// fromBackendHost reports whether a UDP control message from src comes from
+// the host of the backend at addr. Messages over other networks are not
+// checked.
+func (lb *LoadBalancer) fromBackendHost(addr string, src net.Addr) bool {
+	from, ok := src.(*net.UDPAddr)
+	if !ok {
+		return true
+	}
+	host, _, err := net.SplitHostPort(lb.warm.resolved(addr))
+	if err != nil {
+		return false
+	}
+	ip := net.ParseIP(host)
+	return ip != nil && ip.Equal(from.IP)
+}
+
+// avoidLoaded extends avoid with the backends reporting too much load, and
+// reports whether any does
+func (lb *LoadBalancer) avoidLoaded(avoid func(string) bool) (func(string) bool, bool) {
+	if lb.loads == nil {
+		return avoid, false
+	}
+	over := lb.loads.overloaded(lb.clock.Now())
+	if over == nil {
+		return avoid, false
+	}
+	return func(addr string) bool { return over[addr] || avoid(addr) }, true
+}
@@ -0,0 +1,140 @@
+package lb
+
+import (
+	"encoding/binary"
+	"errors"
+	"net"
+	"testing"
+	"time"
+)
+
+// loadMessage is a load report of addr
+func loadMessage(addr string, load uint16) []byte {
+	msg := binary.BigEndian.AppendUint16([]byte{controlLoad}, load)
+	return append(msg, addr...)
+}
+
+func TestLoadAwareFallback(t *testing.T) {
+	clock := newFakeClock()
+	backends := []string{"192.0.2.100:443", "192.0.2.101:443", "192.0.2.102:443", "192.0.2.103:443"}
+	lb, err := NewLoadBalancer(Config{Backends: StaticBackends(backends...), LoadReportMaxAge: time.Second, Clock: clock})
+	if err != nil {
+		t.Fatalf("NewLoadBalancer() error = %v", err)
+	}
+	route := func() []string {
+		t.Helper()
+		chosen := make([]string, 1000)
+		for i := range chosen {
+			src := &net.UDPAddr{IP: net.IPv4(198, 51, 100, byte(i)), Port: 1024 + i}
+			backend, err := lb.fallbackBackend(lb.routes(), nil, src)
+			if err != nil {
+				t.Fatalf("fallbackBackend() error = %v", err)
+			}
+			chosen[i] = backend.Address
+		}
+		return chosen
+	}
+	count := func(chosen []string, addr string) int {
+		n := 0
+		for _, a := range chosen {
+			if a == addr {
+				n++
+			}
+		}
+		return n
+	}
+	static := route()
+	if n := count(static, backends[0]); n == 0 {
+		t.Fatalf("%s took no flows without load reports", backends[0])
+	}
+
+	// the first backend reports far more load than the others
+	for i, addr := range backends {
+		load := uint16(100)
+		if i == 0 {
+			load = 900
+		}
+		src := &net.UDPAddr{IP: net.ParseIP(addr[:len(addr)-4]), Port: 9999}
+		if err := lb.handleControl(loadMessage(addr, load), src); err != nil {
+			t.Fatalf("handleControl(load report of %s) error = %v", addr, err)
+		}
+	}
+	loaded := route()
+	if n := count(loaded, backends[0]); n >= count(static, backends[0]) {
+		t.Errorf("overloaded backend took %d new flows, want fewer than the %d it took without reports", n, count(static, backends[0]))
+	}
+	for i := range static {
+		if static[i] != backends[0] && loaded[i] != static[i] {
+			t.Fatalf("client %d moved from %s to %s, want it kept on a backend within tolerance", i, static[i], loaded[i])
+		}
+	}
+	if got, want := lb.Stats().LoadSpills, uint64(count(static, backends[0])); got != want {
+		t.Errorf("LoadSpills = %d, want %d", got, want)
+	}
+
+	// stale reports leave the static weights to decide
+	clock.Advance(2 * time.Second)
+	for i, addr := range route() {
+		if addr != static[i] {
+			t.Fatalf("client %d routed to %s after reports went stale, want %s", i, addr, static[i])
+		}
+	}
+}
+
+func TestLoadReport(t *testing.T) {
+	backend := &net.UDPAddr{IP: net.IPv4(192, 0, 2, 100), Port: 443}
+	tests := []struct {
+		name     string
+		disabled bool
+		msg      []byte
+		src      net.Addr
+		wantErr  error
+	}{
+		{name: "From Backend", msg: loadMessage(backend.String(), 500), src: &net.UDPAddr{IP: backend.IP, Port: 9999}},
+		{name: "Unix Socket", msg: loadMessage(backend.String(), 500), src: &net.UnixAddr{Name: "backend", Net: "unixgram"}},
+		{name: "From Elsewhere", msg: loadMessage(backend.String(), 500), src: testAddr(1), wantErr: errControlMessage},
+		{name: "Unknown Backend", msg: loadMessage("192.0.2.200:443", 500), src: backend, wantErr: errControlMessage},
+		{name: "No Address", msg: []byte{controlLoad, 0x01, 0xf4}, src: backend, wantErr: errControlMessage},
+		{name: "Disabled", disabled: true, msg: loadMessage(backend.String(), 500), src: backend, wantErr: errControlMessage},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := Config{Backends: StaticBackends(backend.String()), LoadReportMaxAge: time.Second}
+			if tt.disabled {
+				cfg.LoadReportMaxAge = 0
+			}
+			lb, err := NewLoadBalancer(cfg)
+			if err != nil {
+				t.Fatalf("NewLoadBalancer() error = %v", err)
+			}
+			if err := lb.handleControl(tt.msg, tt.src); !errors.Is(err, tt.wantErr) {
+				t.Fatalf("handleControl() error = %v, want %v", err, tt.wantErr)
+			}
+			if got, want := lb.Stats().LoadReports, uint64(0); (got == want) != (tt.wantErr != nil) {
+				t.Errorf("LoadReports = %d, want a report recorded only without an error", got)
+			}
+		})
+	}
+}
+
+func TestLoadReportConfig(t *testing.T) {
+	tests := []struct {
+		name    string
+		cfg     Config
+		wantErr error
+	}{
+		{name: "Disabled", cfg: Config{}},
+		{name: "Default Tolerance", cfg: Config{LoadReportMaxAge: time.Second}},
+		{name: "Tolerance", cfg: Config{LoadReportMaxAge: time.Second, LoadTolerance: 0.25}},
+		{name: "Tolerance Without Max Age", cfg: Config{LoadTolerance: 0.25}, wantErr: errLoadReports},
+		{name: "Negative Max Age", cfg: Config{LoadReportMaxAge: -time.Second}, wantErr: errLoadReports},
+		{name: "Negative Tolerance", cfg: Config{LoadReportMaxAge: time.Second, LoadTolerance: -0.1}, wantErr: errLoadReports},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := tt.cfg.loadReports(); !errors.Is(err, tt.wantErr) {
+				t.Errorf("loadReports() error = %v, want %v", err, tt.wantErr)
+			}
+		})
+	}
+}
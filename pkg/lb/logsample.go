@@ -0,0 +1,71 @@
+package lb
+
+import (
+	"fmt"
+	"log"
+	"math/rand/v2"
+	"net"
+	"sync"
+	"time"
+)
+
+// logSampler logs routing outside debug mode with anomalies favoured:
+// successful routing is sampled at successRate, while failures (drops and
+// fallbacks after a decode error) are all logged up to failuresPerSec, the
+// rest counted and reported with the next line that gets through
+type logSampler struct {
+	successRate    float64
+	failuresPerSec int
+	logf           func(format string, args ...any)
+
+	mu         sync.Mutex
+	window     time.Time // start of the current one-second window
+	failures   int       // failures logged in the window
+	suppressed int       // failures over the cap since the last one logged
+}
+
+// newLogSampler returns a sampler, or nil when neither rate is set
+func newLogSampler(successRate float64, failuresPerSec int) *logSampler {
+	if successRate <= 0 && failuresPerSec <= 0 {
+		return nil
+	}
+	return &logSampler{successRate: successRate, failuresPerSec: failuresPerSec, logf: log.Printf}
+}
+
+// routed logs a successfully routed packet at the success sample rate
+func (s *logSampler) routed(src net.Addr, res *DecodeResult) {
+	if s == nil || rand.Float64() >= s.successRate {
+		return
+	}
+	if res.Decoded {
+		s.logf("Routed packet from %s to %s by %s (CID %x, rotation %d, server ID %x)", src, res.Backend, res.Route, res.CID, res.Rotation, res.ServerID)
+		return
+	}
+	s.logf("Routed packet from %s to %s by %s (CID %x)", src, res.Backend, res.Route, res.CID)
+}
+
+// failure logs a routing failure unless the cap for this second is spent
+func (s *logSampler) failure(now time.Time, format string, args ...any) {
+	if s == nil || s.failuresPerSec <= 0 {
+		return
+	}
+	s.mu.Lock()
+	if now.Sub(s.window) >= time.Second {
+		s.window, s.failures = now, 0
+	}
+	if s.failures >= s.failuresPerSec {
+		s.suppressed++
+		s.mu.Unlock()
+		return
+	}
+	s.failures++
+	suppressed := s.suppressed
+	s.suppressed = 0
+	s.mu.Unlock()
+
+	msg := fmt.Sprintf(format, args...)
+	if suppressed > 0 {
+		msg += fmt.Sprintf(" (%d similar suppressed)", suppressed)
+	}
+	s.logf("%s", msg)
+}
@@ -0,0 +1,81 @@
+package lb
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestLogSamplingFavoursFailures(t *testing.T) {
+	clock := newFakeClock()
+	fwd := memForwarder{opened: make(chan *memConn, 1)}
+	lb, _ := newMemLB(t, Config{
+		Backends:             []BackendConfig{{Address: "192.0.2.100:443", Forwarder: fwd}},
+		LogSuccessRate:       0.01,
+		LogFailuresPerSecond: 5,
+		Clock:                clock,
+	})
+	var mu sync.Mutex
+	var lines []string
+	lb.logs.logf = func(format string, args ...any) {
+		mu.Lock()
+		defer mu.Unlock()
+		lines = append(lines, fmt.Sprintf(format, args...))
+	}
+	count := func(prefix string) int {
+		mu.Lock()
+		defer mu.Unlock()
+		n := 0
+		for _, l := range lines {
+			if strings.HasPrefix(l, prefix) {
+				n++
+			}
+		}
+		return n
+	}
+	go func() {
+		// drain what the flow forwards
+		conn := <-fwd.opened
+		for {
+			select {
+			case <-conn.sent:
+			case <-conn.closed:
+				return
+			}
+		}
+	}()
+
+	cid, _ := lb.routes().codec.Encode(0, []byte{0x00}, nil)
+	pkt := append([]byte{0x40}, cid...)
+	for i := 0; i < 2000; i++ {
+		lb.process(inbound{pkt: pkt, src: testAddr(1)})
+	}
+	// 20 expected; far below one line per packet
+	if n := count("Routed"); n == 0 || n > 100 {
+		t.Errorf("logged %d of 2000 routed packets, want a small sample", n)
+	}
+
+	for i := 0; i < 3; i++ {
+		lb.process(inbound{pkt: nil, src: testAddr(2)})
+	}
+	if n := count("Dropped"); n != 3 {
+		t.Errorf("logged %d of 3 drops, want all", n)
+	}
+	for i := 0; i < 10; i++ {
+		lb.process(inbound{pkt: nil, src: testAddr(2)})
+	}
+	if n := count("Dropped"); n != 5 {
+		t.Errorf("logged %d drops in one second, want the cap of 5", n)
+	}
+
+	clock.Advance(time.Second)
+	lb.process(inbound{pkt: nil, src: testAddr(2)})
+	mu.Lock()
+	last := lines[len(lines)-1]
+	mu.Unlock()
+	if !strings.HasPrefix(last, "Dropped") || !strings.HasSuffix(last, "(8 similar suppressed)") {
+		t.Errorf("first drop of the next second logged %q, want it to report 8 suppressed", last)
+	}
+}
@@ -0,0 +1,13 @@
+package lb
+
+import (
+	"testing"
+
+	"go.uber.org/goleak"
+)
+
+// TestMain fails the package if any test leaves goroutines behind, so every
+// Start/Run must be matched by a complete teardown
+func TestMain(m *testing.M) {
+	goleak.VerifyTestMain(m)
+}
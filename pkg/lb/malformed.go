@@ -0,0 +1,117 @@
+package lb
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"time"
+
+	"github.com/fqzz2000/QUIC-LB-SHRIMP/pkg/packet"
+)
+
+// Config.MalformedPackets chooses how datagrams that are not valid QUIC are
+// reported. "lenient", the default, drops them like any other failure: they
+// are counted under their drop reason and logged only by debug mode or
+// failure sampling. "strict" treats each one as a possible attack: it is
+// logged as a warning, at most 10 a second, and counted under a detailed
+// reason in shrimp_malformed_packets_total. The drop itself is the same.
+
+const (
+	malformedLenient = "lenient"
+	malformedStrict  = "strict"
+	// maxMalformedLogs caps how many malformed packets strict mode logs
+	// each second, so a flood of garbage cannot flood the log too
+	maxMalformedLogs = 10
+)
+
+// errMalformedPolicy is returned for an unknown Config.MalformedPackets
+var errMalformedPolicy = errors.New("invalid malformed packet policy")
+
+// malformedReason is the detailed label of a malformed packet
+type malformedReason uint8
+
+const (
+	malformedTooShort malformedReason = iota
+	malformedCIDLength
+	malformedCoalesced
+	malformedPacketNumber
+	malformedProxyHeader
+	malformedFixedBit
+	malformedReservedBits
+	malformedLengths
+	malformedTrailing
+	numMalformedReasons
+)
+
+// malformedReasonNames are the reason label values, indexed by malformedReason
+var malformedReasonNames = [numMalformedReasons]string{
+	malformedTooShort:     "too_short",
+	malformedCIDLength:    "invalid_cid_length",
+	malformedCoalesced:    "too_many_coalesced",
+	malformedPacketNumber: "no_packet_number",
+	malformedProxyHeader:  "proxy_header",
+	malformedFixedBit:     "fixed_bit_unset",
+	malformedReservedBits: "reserved_bits_set",
+	malformedLengths:      "inconsistent_lengths",
+	malformedTrailing:     "trailing_bytes",
+}
+
+// malformedErrors are the errors marking a packet malformed, by reason
+var malformedErrors = [numMalformedReasons]error{
+	malformedTooShort:     packet.ErrPacketTooShort,
+	malformedCIDLength:    packet.ErrInvalidCIDLength,
+	malformedCoalesced:    packet.ErrTooManyCoalesced,
+	malformedPacketNumber: packet.ErrNoPacketNumber,
+	malformedProxyHeader:  errProxyHeader,
+	malformedFixedBit:     packet.ErrFixedBitUnset,
+	malformedReservedBits: packet.ErrReservedBitsSet,
+	malformedLengths:      packet.ErrInconsistentLengths,
+	malformedTrailing:     errTrailingBytes,
+}
+
+// malformedPackets returns the configured policy, checking it is known
+func (c *Config) malformedPackets() (string, error) {
+	switch c.MalformedPackets {
+	case "":
+		return malformedLenient, nil
+	case malformedLenient, malformedStrict:
+		return c.MalformedPackets, nil
+	}
+	return "", fmt.Errorf("%w: %q", errMalformedPolicy, c.MalformedPackets)
+}
+
+// newMalformedLog returns the warning log of strict mode, nil otherwise
+func newMalformedLog(policy string) *logSampler {
+	if policy != malformedStrict {
+		return nil
+	}
+	return &logSampler{failuresPerSec: maxMalformedLogs, logf: log.Printf}
+}
+
+// malformedReasonFor reports the detailed reason a dropped datagram was
+// malformed, false when its error is not a malformation
+func malformedReasonFor(err error) (malformedReason, bool) {
+	for reason, target := range malformedErrors {
+		if errors.Is(err, target) {
+			return malformedReason(reason), true
+		}
+	}
+	return 0, false
+}
+
+// reportMalformed logs and counts a datagram from src dropped for err in
+// strict mode, reporting false when strict mode is off or the datagram was
+// not malformed
+func (lb *LoadBalancer) reportMalformed(now time.Time, src net.Addr, err error) bool {
+	if lb.malformed == nil {
+		return false
+	}
+	reason, ok := malformedReasonFor(err)
+	if !ok {
+		return false
+	}
+	lb.metrics.malformed[reason].Inc()
+	lb.malformed.failure(now, "WARNING: malformed packet from %s (%s): %v", src, malformedReasonNames[reason], err)
+	return true
+}
@@ -0,0 +1,87 @@
+package lb
+
+import (
+	"bytes"
+	"errors"
+	"log"
+	"strings"
+	"testing"
+)
+
+func TestMalformedPackets(t *testing.T) {
+	malformed := []struct {
+		pkt    []byte
+		reason string
+	}{
+		{pkt: []byte{0x40, 0x01}, reason: "too_short"},
+		{pkt: []byte{0xc0, 0x00, 0x00, 0x00, 0x01, 0x30}, reason: "invalid_cid_length"},
+	}
+	for _, policy := range []string{malformedLenient, malformedStrict} {
+		t.Run(policy, func(t *testing.T) {
+			var logged bytes.Buffer
+			out := log.Writer()
+			log.SetOutput(&logged)
+			defer log.SetOutput(out)
+
+			lb, _ := newMemLB(t, Config{Backends: StaticBackends("192.0.2.100:443"), MalformedPackets: policy})
+			for i := 0; i < 2*maxMalformedLogs; i++ {
+				for _, m := range malformed {
+					lb.process(inbound{pkt: m.pkt, src: testAddr(1)})
+				}
+			}
+			if got, want := lb.Stats().PacketsDropped, uint64(4*maxMalformedLogs); got != want {
+				t.Errorf("PacketsDropped = %d, want %d", got, want)
+			}
+
+			lines := strings.Count(logged.String(), "WARNING: malformed packet")
+			if policy == malformedLenient {
+				if logged.Len() != 0 {
+					t.Errorf("lenient mode logged %q, want nothing", logged.String())
+				}
+				return
+			}
+			if lines != maxMalformedLogs {
+				t.Errorf("strict mode logged %d warnings, want the cap of %d", lines, maxMalformedLogs)
+			}
+			for _, m := range malformed {
+				if !strings.Contains(logged.String(), "("+m.reason+")") {
+					t.Errorf("strict mode log missing reason %s:\n%s", m.reason, logged.String())
+				}
+			}
+			for reason, c := range lb.metrics.malformed {
+				want := uint64(0)
+				for _, m := range malformed {
+					if m.reason == malformedReasonNames[reason] {
+						want = 2 * maxMalformedLogs
+					}
+				}
+				if got := c.Value(); got != want {
+					t.Errorf("malformed packets counted as %s = %d, want %d", malformedReasonNames[reason], got, want)
+				}
+			}
+		})
+	}
+}
+
+func TestMalformedPacketsConfig(t *testing.T) {
+	tests := []struct {
+		name    string
+		policy  string
+		want    string
+		wantErr error
+	}{
+		{name: "Default", want: malformedLenient},
+		{name: "Lenient", policy: malformedLenient, want: malformedLenient},
+		{name: "Strict", policy: malformedStrict, want: malformedStrict},
+		{name: "Unknown", policy: "paranoid", wantErr: errMalformedPolicy},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := Config{MalformedPackets: tt.policy}
+			got, err := cfg.malformedPackets()
+			if !errors.Is(err, tt.wantErr) || got != tt.want {
+				t.Errorf("malformedPackets() = %q, %v, want %q, %v", got, err, tt.want, tt.wantErr)
+			}
+		})
+	}
+}
@@ -0,0 +1,270 @@
+package lb
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/fqzz2000/QUIC-LB-SHRIMP/pkg/metrics"
+	"github.com/fqzz2000/QUIC-LB-SHRIMP/pkg/packet"
+	"github.com/fqzz2000/QUIC-LB-SHRIMP/pkg/quiclb"
+)
+
+// lbMetrics is the registry served at /metrics and the instruments that live
+// only there; counters already kept for Stats are exported by reference
+type lbMetrics struct {
+	registry *metrics.Registry
+
+	// decodeLatency has a histogram per QUIC-LB algorithm; the routing table
+	// indexes them by rotation codepoint for the hot path
+	decodeLatency *metrics.HistogramVec
+	// rotationPackets counts decoded CIDs by rotation codepoint, every
+	// codepoint exported from zero so a key rotation can be watched to the end
+	rotationPackets [quiclb.NumConfigs]*metrics.Counter
+	// retiringPackets counts the residual traffic of retiring rotations
+	retiringPackets [quiclb.NumConfigs]*metrics.Counter
+	// rotationDrops and rotationFallbacks count the CIDs rotation policies
+	// dropped or routed without a decode, by codepoint
+	rotationDrops     [quiclb.NumConfigs]*metrics.Counter
+	rotationFallbacks [quiclb.NumConfigs]*metrics.Counter
+	// drops counts dropped datagrams by reason, indexed by dropReason; their
+	// sum is Stats().PacketsDropped
+	drops [numDropReasons]*metrics.Counter
+	// packetTypes counts parsed client datagrams by the type of their first
+	// packet, indexed by packet.PacketType; short headers are all 1-RTT
+	packetTypes [numPacketTypes]*metrics.Counter
+	// malformed counts malformed datagrams in strict mode by detailed
+	// reason, indexed by malformedReason
+	malformed [numMalformedReasons]*metrics.Counter
+	// serverIDLengths counts decoded CIDs by server ID length; the routing
+	// table holds the counters of the lengths its configs encode
+	serverIDLengths *metrics.CounterVec
+}
+
+// numPacketTypes is the number of packet types packetTypes counts
+const numPacketTypes = packet.VersionNegotiation + 1
+
+// newMetrics registers the load balancer's metrics into registry, or a
+// registry of its own when nil, labeled with the instance name if set
+func (lb *LoadBalancer) newMetrics(registry *metrics.Registry, name string) *lbMetrics {
+	if registry == nil {
+		registry = metrics.NewRegistry()
+	}
+	if name != "" {
+		registry = registry.WithLabel("instance", name)
+	}
+	m := &lbMetrics{registry: registry}
+	r := m.registry
+
+	r.NewCounterFunc("shrimp_packets_received_total", "Datagrams read from the listener.", lb.stats.received.Load)
+	r.NewCounterFunc("shrimp_packets_forwarded_total", "Datagrams forwarded to a backend.", lb.stats.forwarded.Load)
+	dropped := r.NewCounterVec("shrimp_packets_dropped_total", "Datagrams dropped, by reason.", "reason")
+	for reason := range m.drops {
+		m.drops[reason] = dropped.With(dropReasonNames[reason])
+	}
+	r.NewCounterFunc("shrimp_queue_drops_total", "Datagrams dropped because a worker queue was full.", lb.stats.queueDrops.Load)
+	r.NewCounterFunc("shrimp_packet_panics_total", "Packets whose processing panicked and was recovered.", lb.stats.panics.Load)
+	r.NewCounterFunc("shrimp_decode_failures_total", "Connection IDs that did not decode to a backend.", lb.stats.decodeFailures.Load)
+	r.NewCounterFunc("shrimp_cid_auth_failures_total", "AEAD connection IDs whose tag did not verify.", lb.stats.authFailures.Load)
+	r.NewCounterFunc("shrimp_truncated_cids_total", "Short headers whose DCID was shorter than configured.", lb.stats.truncatedCIDs.Load)
+	r.NewCounterFunc("shrimp_learned_cid_lengths_total", "Short headers matched to a flow by a CID length learned from its long headers rather than the configured one.", lb.stats.learnedCIDLengths.Load)
+	r.NewCounterFunc("shrimp_fixed_bit_drops_total", "Packets dropped for an unset fixed bit their config requires.", lb.stats.fixedBitDrops.Load)
+	r.NewCounterFunc("shrimp_mismatched_dcids_total", "Client datagrams coalescing packets for different DCIDs, routed on the first.", lb.stats.mismatchedDCIDs.Load)
+	r.NewCounterFunc("shrimp_length_overruns_total", "Client datagrams with a long-header Length running past the datagram, likely truncated or tampered with.", lb.stats.lengthOverruns.Load)
+	r.NewCounterFunc("shrimp_reordered_coalesced_total", "Client datagrams coalescing packets out of the order senders use, such as a Handshake before an Initial.", lb.stats.reorderedCoalesced.Load)
+	r.NewCounterFunc("shrimp_corrupt_packets_total", "Datagrams dropped as likely corrupt for inconsistent length fields.", lb.stats.corruptPackets.Load)
+	r.NewCounterFunc("shrimp_unhealthy_fallbacks_total", "Connection IDs decoded to an unhealthy backend and rerouted.", lb.stats.unhealthyFallbacks.Load)
+	r.NewCounterFunc("shrimp_new_flow_routed_total", "New connections whose CID did not decode routed to the new-flow pool.", lb.stats.newFlowRouted.Load)
+	r.NewCounterFunc("shrimp_canary_routed_total", "New connections split off to the canary backend.", lb.stats.canaryRouted.Load)
+	r.NewCounterFunc("shrimp_packet_type_drops_total", "Client packets dropped for a type the forwarding allowlist excludes.", lb.stats.typeDrops.Load)
+	r.NewCounterFunc("shrimp_removed_server_ids_total", "Connection IDs decoded to a backend removed at runtime.", lb.stats.removedServerIDs.Load)
+	r.NewCounterFunc("shrimp_unknown_server_ids_total", "Connection IDs that decoded to a server ID no backend has, removed backends included.", lb.stats.unknownServerIDs.Load)
+	r.NewCounterFunc("shrimp_repaired_decodes_total", "Connection IDs decoded by a config other than the one their rotation bits select.", lb.stats.repairedDecodes.Load)
+	r.NewCounterFunc("shrimp_stateless_resets_total", "Stateless resets sent for short headers matching no flow or backend.", lb.stats.statelessResets.Load)
+	r.NewCounterFunc("shrimp_over_capacity_total", "New flows whose connection ID decoded to a backend at its flow limit.", lb.stats.overCapacity.Load)
+	r.NewCounterFunc("shrimp_egress_rate_drops_total", "Datagrams of open flows dropped over their backend's egress rate.", lb.stats.egressDrops.Load)
+	r.NewCounterFunc("shrimp_egress_rate_decoded_drops_total", "New flows dropped whose CID decoded to a backend over its egress rate.", lb.stats.egressDecoded.Load)
+	r.NewCounterFunc("shrimp_small_initial_drops_total", "Client datagrams dropped for carrying an Initial below the minimum size.", lb.stats.smallInitials.Load)
+	r.NewCounterFunc("shrimp_version_negotiations_total", "New connections answered with Version Negotiation for a version their backend does not speak.", lb.stats.versionNegotiations.Load)
+	r.NewCounterFunc("shrimp_proxy_headers_total", "PROXY v2 headers an outer load balancer prepended, stripped from client datagrams.", lb.stats.proxyHeaders.Load)
+	r.NewCounterFunc("shrimp_backend_unreachable_total", "ICMP unreachable errors reported on backend sockets.", lb.stats.backendUnreachable.Load)
+	r.NewCounterFunc("shrimp_unresolved_backends_total", "Backends marked unhealthy for not resolving at startup.", lb.stats.unresolvedBackends.Load)
+	r.NewCounterFunc("shrimp_health_probe_failures_total", "QUIC health probes that got no reply within the timeout.", lb.stats.healthProbeFailures.Load)
+	r.NewCounterFunc("shrimp_unmatched_replies_total", "Replies on the shared backend socket that matched no flow.", lb.stats.unmatchedReplies.Load)
+	r.NewCounterFunc("shrimp_replies_by_dcid_total", "Backend long headers delivered by DCID to another flow than the one whose socket they arrived on.", lb.stats.repliesByDCID.Load)
+	r.NewCounterFunc("shrimp_short_writes_total", "Datagram writes to backends or clients that reported fewer bytes than the datagram.", lb.stats.shortWrites.Load)
+	r.NewCounterFunc("shrimp_source_port_collisions_total", "Flows whose derived source port was already bound and that used another.", lb.stats.sourcePortCollisions.Load)
+	r.NewCounterFunc("shrimp_amplification_drops_total", "Backend responses withheld from clients over the anti-amplification limit.", lb.stats.amplificationDrops.Load)
+	r.NewCounterFunc("shrimp_half_open_reaped_total", "Flows reaped before becoming established.", lb.stats.halfOpenReaped.Load)
+	r.NewCounterFunc("shrimp_initial_retransmits_total", "Client Initials retransmitted to a flow whose backend had sent nothing back.", lb.stats.initialRetransmits.Load)
+	r.NewCounterFunc("shrimp_idle_reaped_total", "Established flows reaped after the idle timeout.", lb.stats.idleReaped.Load)
+	r.NewCounterFunc("shrimp_close_notified_total", "Flows evicted on a backend's connection-closed notification.", lb.stats.closeNotified.Load)
+	r.NewCounterFunc("shrimp_control_ignored_total", "Control messages ignored as malformed, for no flow, or not from the flow's backend.", lb.stats.controlIgnored.Load)
+	r.NewCounterFunc("shrimp_new_flow_rate_limited_total", "New flows refused for a source over its new-flow rate.", lb.stats.newFlowRateLimited.Load)
+	r.NewGaugeFunc("shrimp_new_flow_limited_sources", "Source IPs currently out of new-flow allowance.", func() float64 {
+		if lb.newFlowLimit == nil {
+			return 0
+		}
+		return float64(lb.newFlowLimit.limited(lb.clock.Now()))
+	})
+	r.NewCounterFunc("shrimp_drain_refused_total", "New flows refused while draining.", lb.stats.drainRefused.Load)
+	r.NewCounterFunc("shrimp_draining_redirects_total", "New connections whose CID decoded to a backend draining for removal, sent to another by fallback or Retry, or refused.", lb.stats.drainingRedirects.Load)
+	r.NewCounterFunc("shrimp_zero_rtt_delayed_total", "0-RTT packets held until their flow saw 1-RTT.", lb.stats.zeroRTTDelayed.Load)
+	r.NewCounterFunc("shrimp_zero_rtt_dropped_total", "0-RTT packets dropped by policy or because their flow held the maximum.", lb.stats.zeroRTTDropped.Load)
+	r.NewCounterFunc("shrimp_zero_rtt_return_drops_total", "Responses to flows that sent 0-RTT dropped at the return limit before 1-RTT.", lb.stats.zeroRTTReturnDrops.Load)
+	r.NewCounterFunc("shrimp_mirrored_total", "Datagram copies sent to the shadow backend.", lb.stats.mirrored.Load)
+	r.NewCounterFunc("shrimp_mirror_failures_total", "Shadow backend dials or sends that failed.", lb.stats.mirrorFailures.Load)
+	r.NewCounterFunc("shrimp_batched_writes_total", "Backend datagrams sent in one syscall with an earlier datagram of the same batch, each a write syscall saved.", lb.stats.batchedWrites.Load)
+	r.NewCounterFunc("shrimp_nonce_reuse_total", "New connections whose CID repeated the server ID and nonce of a sampled CID from another client, a server reusing nonces.", lb.stats.nonceReuse.Load)
+	r.NewCounterFunc("shrimp_source_flow_limited_total", "New flows refused because their source IP held its maximum of concurrent flows.", lb.stats.sourceFlowLimited.Load)
+	r.NewCounterFunc("shrimp_read_retries_total", "Transient listener read errors retried after a backoff.", lb.stats.readRetries.Load)
+	r.NewCounterFunc("shrimp_decision_drops_total", "Routing decisions dropped because the decision sink fell behind.", lb.stats.decisionDrops.Load)
+	r.NewCounterFunc("shrimp_retry_tokens_expired_total", "Retry tokens the load balancer issued presented after their lifetime.", lb.stats.retryExpired.Load)
+	r.NewCounterFunc("shrimp_retry_tokens_replayed_total", "Retry tokens the load balancer issued presented more than once.", lb.stats.retryReplayed.Load)
+	r.NewCounterFunc("shrimp_version_lists_cut_total", "Version Negotiation packets listing fewer versions than the backend speaks to stay within the amplification limit.", lb.stats.versionListsCut.Load)
+	r.NewCounterFunc("shrimp_trailing_bytes_total", "Long-header datagrams with bytes after their packets that cannot be a packet.", lb.stats.trailingBytes.Load)
+	r.NewCounterFunc("shrimp_load_reports_total", "Backend load reports recorded from the control channel.", lb.stats.loadReports.Load)
+	r.NewCounterFunc("shrimp_load_spills_total", "New fallback flows moved off a backend reporting too much load.", lb.stats.loadSpills.Load)
+	r.NewCounterFunc("shrimp_server_id_reports_total", "Server IDs backends reported over the control channel and the load balancer verified.", lb.stats.serverIDReports.Load)
+	r.NewCounterFunc("shrimp_server_id_mismatches_total", "Backend server ID reports the server ID mapping disagrees with; alert on any.", lb.stats.serverIDMismatches.Load)
+	r.NewGaugeFunc("shrimp_server_id_mismatched_backends", "Backends whose last server ID report the server ID mapping disagrees with.", func() float64 {
+		if lb.idChecks == nil {
+			return 0
+		}
+		return float64(lb.idChecks.count())
+	})
+	r.NewCounterFunc("shrimp_token_routed_total", "New flows routed by the server ID a server encoded in their Initial's token.", lb.stats.tokenRouted.Load)
+	r.NewCounterFunc("shrimp_token_failures_total", "Initial tokens the token decoder could not read or whose server ID named no available backend.", lb.stats.tokenFailures.Load)
+	r.NewCounterFunc("shrimp_cid_too_short_total", "Client packets dropped for a destination connection ID shorter than the minimum length.", lb.stats.cidTooShort.Load)
+	r.NewCounterFunc("shrimp_eviction_notices_total", "Notices sent to backends over the control socket of their flows the reaper evicted.", lb.stats.evictionNotices.Load)
+	r.NewCounterFunc("shrimp_eviction_notice_errors_total", "Eviction notices that could not be sent to their backend.", lb.stats.evictNoticeErrors.Load)
+	r.NewCounterFunc("shrimp_catch_all_routed_total", "New connections whose CID decoded to a server ID with no backend, sent to the catch-all backend.", lb.stats.catchAllRouted.Load)
+	r.NewGaugeFunc("shrimp_active_flows", "Flows currently tracked in the session table.", func() float64 {
+		active, _ := lb.sessions.flowCounts()
+		return float64(active)
+	})
+
+	m.decodeLatency = r.NewHistogramVec("shrimp_cid_decode_duration_seconds",
+		"Time spent decoding a connection ID, by QUIC-LB algorithm.", metrics.DefBuckets, "algorithm")
+	rotations := r.NewCounterVec("shrimp_cid_rotation_packets_total",
+		"Packets whose connection ID decoded to a backend, by config rotation codepoint.", "rotation")
+	for rotation := range m.rotationPackets {
+		m.rotationPackets[rotation] = rotations.With(strconv.Itoa(rotation))
+	}
+	retiring := r.NewCounterVec("shrimp_retiring_rotation_packets_total",
+		"Client packets addressed to a connection ID of a retiring config rotation, by codepoint.", "rotation")
+	for rotation := range m.retiringPackets {
+		m.retiringPackets[rotation] = retiring.With(strconv.Itoa(rotation))
+	}
+	policies := r.NewCounterVec("shrimp_rotation_policy_packets_total",
+		"Client packets a rotation policy dropped or routed without decoding, by codepoint and action.", "rotation", "action")
+	for rotation := range m.rotationDrops {
+		m.rotationDrops[rotation] = policies.With(strconv.Itoa(rotation), rotationDrop)
+		m.rotationFallbacks[rotation] = policies.With(strconv.Itoa(rotation), rotationFallback)
+	}
+	types := r.NewCounterVec("shrimp_packet_types_total",
+		"Client datagrams parsed, by the header form and packet type of their first packet.", "header", "type")
+	for t := range m.packetTypes {
+		header := "long"
+		if packet.PacketType(t) == packet.OneRTT {
+			header = "short"
+		}
+		m.packetTypes[t] = types.With(header, packet.PacketType(t).String())
+	}
+	malformed := r.NewCounterVec("shrimp_malformed_packets_total",
+		"Malformed client datagrams dropped in strict mode, by detailed reason.", "reason")
+	for reason := range m.malformed {
+		m.malformed[reason] = malformed.With(malformedReasonNames[reason])
+	}
+	m.serverIDLengths = r.NewCounterVec("shrimp_server_id_length_decodes_total",
+		"Connection IDs decoded to a backend, by the length of their server ID.", "length")
+	return m
+}
+
+// countPacketType counts a parsed datagram against the type of its first packet
+func (m *lbMetrics) countPacketType(t packet.PacketType) {
+	if t < numPacketTypes {
+		m.packetTypes[t].Inc()
+	}
+}
+
+// countRotation counts a decoded CID against its rotation codepoint
+func (m *lbMetrics) countRotation(rotation uint8) {
+	m.rotationPackets[rotation&(quiclb.NumConfigs-1)].Inc()
+}
+
+// decodeHistograms returns the decode latency histogram of each active
+// config of codec, by rotation codepoint; nil for inactive rotations
+func (m *lbMetrics) decodeHistograms(codec *quiclb.Codec) [quiclb.NumConfigs]*metrics.Histogram {
+	var hs [quiclb.NumConfigs]*metrics.Histogram
+	for rotation := range hs {
+		if cfg, ok := codec.Config(uint8(rotation)); ok {
+			hs[rotation] = m.decodeLatency.With(cfg.Algorithm.String())
+		}
+	}
+	return hs
+}
+
+// observeDecode records the time since start against the algorithm of the
+// config at rotation. Only successful decodes are observed, so the histogram
+// measures the cost of the algorithm rather than of rejecting garbage. The
+// two clock reads dominate the cost; see decodeTiming to compile them out.
+func (rt *routingTable) observeDecode(rotation uint8, start time.Time) {
+	if h := rt.decodeLatency[rotation&(quiclb.NumConfigs-1)]; h != nil {
+		h.Observe(time.Since(start).Seconds())
+	}
+}
+
+// serverIDLengthCounters returns the decode counter of each server ID length
+// the active configs of entries encode, by length; nil for the others
+func (m *lbMetrics) serverIDLengthCounters(entries [quiclb.NumConfigs]quiclb.ConfigEntry) [packet.MaxCIDLength]*metrics.Counter {
+	var cs [packet.MaxCIDLength]*metrics.Counter
+	for n := range serverIDLengths(entries) {
+		if n < len(cs) {
+			cs[n] = m.serverIDLengths.With(strconv.Itoa(n))
+		}
+	}
+	return cs
+}
+
+// countServerIDLength counts a decoded CID against the length of its server
+// ID, through migrations between lengths
+func (rt *routingTable) countServerIDLength(serverID []byte) {
+	if n := len(serverID); n < len(rt.sidLengths) && rt.sidLengths[n] != nil {
+		rt.sidLengths[n].Inc()
+	}
+}
+
+// Metrics formats (Config.MetricsFormat) are the text expositions /metrics
+// serves, both rendered by the metrics package without a client library
+const (
+	metricsPrometheus  = "prometheus"
+	metricsOpenMetrics = "openmetrics"
+)
+
+// errMetricsFormat is returned for an unknown Config.MetricsFormat
+var errMetricsFormat = errors.New("invalid metrics format")
+
+// metricsFormat returns the format /metrics is served in
+func (c *Config) metricsFormat() (string, error) {
+	switch c.MetricsFormat {
+	case "":
+		return metricsPrometheus, nil
+	case metricsPrometheus, metricsOpenMetrics:
+		return c.MetricsFormat, nil
+	}
+	return "", fmt.Errorf("%w: %q", errMetricsFormat, c.MetricsFormat)
+}
+
+// handleMetrics serves the registry in the configured format
+func (lb *LoadBalancer) handleMetrics(w http.ResponseWriter, r *http.Request) {
+	if lb.metricsFormat == metricsOpenMetrics {
+		w.Header().Set("Content-Type", "application/openmetrics-text; version=1.0.0; charset=utf-8")
+		lb.metrics.registry.WriteOpenMetrics(w)
+		return
+	}
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	lb.metrics.registry.WriteText(w)
+}
@@ -0,0 +1,341 @@
+package lb
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/fqzz2000/QUIC-LB-SHRIMP/pkg/packet"
+	"github.com/fqzz2000/QUIC-LB-SHRIMP/pkg/quiclb"
+)
+
+func TestDecodeLatencyPerAlgorithm(t *testing.T) {
+	if !decodeTiming {
+		t.Skip("decode timing compiled out")
+	}
+	key := bytes.Repeat([]byte{0x2b}, quiclb.KeyLength)
+	lb, err := NewLoadBalancer(Config{
+		Backends: StaticBackends("backend0", "backend1"),
+		QUICLB: [quiclb.NumConfigs]quiclb.ConfigEntry{
+			{Algorithm: quiclb.Plaintext, ServerIDLength: 1, NonceLength: 6},
+			{Algorithm: quiclb.StreamCipher, ServerIDLength: 1, NonceLength: 8, Key: key},
+			{Algorithm: quiclb.BlockCipher, ServerIDLength: 1, NonceLength: 15, Key: key},
+		},
+	})
+	if err != nil {
+		t.Fatalf("NewLoadBalancer() error = %v", err)
+	}
+
+	for rotation := uint8(0); rotation < 3; rotation++ {
+		cid, err := lb.routes().codec.Encode(rotation, []byte{0x01}, nil)
+		if err != nil {
+			t.Fatalf("Encode(%d) error = %v", rotation, err)
+		}
+		if _, err := lb.routeCID(cid); err != nil {
+			t.Fatalf("routeCID(rotation %d) error = %v", rotation, err)
+		}
+	}
+	// an undecodable CID is not observed
+	lb.routeCID([]byte{0xc0, 0x01})
+
+	for rotation := uint8(0); rotation < 3; rotation++ {
+		if got := lb.routes().decodeLatency[rotation].Count(); got != 1 {
+			t.Errorf("rotation %d observations = %d, want 1", rotation, got)
+		}
+	}
+	if lb.routes().decodeLatency[3] != nil {
+		t.Errorf("inactive rotation has a histogram")
+	}
+
+	rec := httptest.NewRecorder()
+	lb.adminHandler().ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+	for _, alg := range []quiclb.Algorithm{quiclb.Plaintext, quiclb.StreamCipher, quiclb.BlockCipher} {
+		want := `shrimp_cid_decode_duration_seconds_count{algorithm="` + alg.String() + `"} 1`
+		if !strings.Contains(rec.Body.String(), want) {
+			t.Errorf("/metrics missing %q", want)
+		}
+	}
+}
+
+func TestDecodeLatencyFastPath(t *testing.T) {
+	if !decodeTiming {
+		t.Skip("decode timing compiled out")
+	}
+	lb, _ := InitLoadBalancer("127.0.0.1:0", []string{"backend0", "backend1"})
+	cid, _ := lb.routes().codec.Encode(0, []byte{0x01}, nil)
+	if _, err := lb.routeCID(cid); err != nil {
+		t.Fatalf("routeCID() error = %v", err)
+	}
+	if got := lb.routes().decodeLatency[0].Count(); got != 1 {
+		t.Errorf("observations = %d, want 1", got)
+	}
+}
+
+func TestRotationPackets(t *testing.T) {
+	key := bytes.Repeat([]byte{0x2b}, quiclb.KeyLength)
+	lb, err := NewLoadBalancer(Config{
+		Backends: StaticBackends("backend0", "backend1"),
+		QUICLB: [quiclb.NumConfigs]quiclb.ConfigEntry{
+			{Algorithm: quiclb.Plaintext, ServerIDLength: 1, NonceLength: 6},
+			{Algorithm: quiclb.StreamCipher, ServerIDLength: 1, NonceLength: 8, Key: key},
+		},
+	})
+	if err != nil {
+		t.Fatalf("NewLoadBalancer() error = %v", err)
+	}
+
+	// traffic shifting from the old config to the new one
+	packets := map[uint8]int{0: 1, 1: 3}
+	for rotation, n := range packets {
+		cid, err := lb.routes().codec.Encode(rotation, []byte{0x01}, nil)
+		if err != nil {
+			t.Fatalf("Encode(%d) error = %v", rotation, err)
+		}
+		for i := 0; i < n; i++ {
+			if _, err := lb.selectBackend(cid, testAddr(1)); err != nil {
+				t.Fatalf("selectBackend(rotation %d) error = %v", rotation, err)
+			}
+		}
+	}
+	// a CID that does not decode is not counted against its rotation bits
+	lb.selectBackend([]byte{0x40, 0x01}, testAddr(1))
+
+	rec := httptest.NewRecorder()
+	lb.adminHandler().ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+	for _, want := range []string{
+		`shrimp_cid_rotation_packets_total{rotation="0"} 1`,
+		`shrimp_cid_rotation_packets_total{rotation="1"} 3`,
+		`shrimp_cid_rotation_packets_total{rotation="2"} 0`,
+		`shrimp_cid_rotation_packets_total{rotation="3"} 0`,
+	} {
+		if !strings.Contains(rec.Body.String(), want) {
+			t.Errorf("/metrics missing %q", want)
+		}
+	}
+}
+
+func TestServerIDLengthMigration(t *testing.T) {
+	// the fleet moves from two-byte server IDs at rotation 0 to three-byte
+	// ones at rotation 1, with connections on both
+	key := bytes.Repeat([]byte{0x2b}, quiclb.KeyLength)
+	lb, err := NewLoadBalancer(Config{
+		Backends: StaticBackends("backend0", "backend1", "backend2"),
+		QUICLB: [quiclb.NumConfigs]quiclb.ConfigEntry{
+			{Algorithm: quiclb.Plaintext, ServerIDLength: 2, NonceLength: 9},
+			{Algorithm: quiclb.StreamCipher, ServerIDLength: 3, NonceLength: 8, Key: key},
+		},
+	})
+	if err != nil {
+		t.Fatalf("NewLoadBalancer() error = %v", err)
+	}
+	old, err := lb.routes().codec.Encode(0, []byte{0x00, 0x01}, nil)
+	if err != nil {
+		t.Fatalf("Encode(rotation 0) error = %v", err)
+	}
+	current, err := lb.routes().codec.Encode(1, []byte{0x00, 0x00, 0x02}, nil)
+	if err != nil {
+		t.Fatalf("Encode(rotation 1) error = %v", err)
+	}
+
+	const workers, rounds = 4, 50
+	var wg sync.WaitGroup
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := 0; i < rounds; i++ {
+				for _, c := range []struct {
+					cid  []byte
+					want string
+				}{{old, "backend1"}, {current, "backend2"}} {
+					got, err := lb.SelectBackend(append([]byte{0x40}, c.cid...), testAddr(w+1))
+					if err != nil || got != c.want {
+						t.Errorf("SelectBackend(%x) = %s, %v, want %s", c.cid, got, err, c.want)
+						return
+					}
+				}
+			}
+		}()
+	}
+	wg.Wait()
+
+	rec := httptest.NewRecorder()
+	lb.adminHandler().ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+	for _, want := range []string{
+		fmt.Sprintf(`shrimp_server_id_length_decodes_total{length="2"} %d`, workers*rounds),
+		fmt.Sprintf(`shrimp_server_id_length_decodes_total{length="3"} %d`, workers*rounds),
+	} {
+		if !strings.Contains(rec.Body.String(), want) {
+			t.Errorf("/metrics missing %q", want)
+		}
+	}
+}
+
+func TestPacketTypes(t *testing.T) {
+	fwd := memForwarder{opened: make(chan *memConn, 8)}
+	lb, _ := newMemLB(t, Config{Backends: []BackendConfig{{Address: "192.0.2.100:443", Forwarder: fwd}}})
+	dcid := []byte{0x00, 0x01, 0x02, 0x03, 0x04, 0x05, 0x06, 0x07}
+
+	// a burst of new connections and a little established traffic
+	for i := 0; i < 3; i++ {
+		lb.handlePacket(longHeaderPacket(packet.Initial, dcid, 1200), testAddr(i+1))
+	}
+	lb.handlePacket(longHeaderPacket(packet.HandShake, dcid, 64), testAddr(1))
+	for i := 0; i < 2; i++ {
+		lb.handlePacket(append([]byte{0x40}, dcid...), testAddr(1))
+	}
+	// an unparseable datagram has no type to count
+	lb.handlePacket([]byte{0x40, 0x01}, testAddr(1))
+
+	rec := httptest.NewRecorder()
+	lb.adminHandler().ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+	for _, want := range []string{
+		`shrimp_packet_types_total{header="long",type="initial"} 3`,
+		`shrimp_packet_types_total{header="long",type="0rtt"} 0`,
+		`shrimp_packet_types_total{header="long",type="handshake"} 1`,
+		`shrimp_packet_types_total{header="short",type="1rtt"} 2`,
+	} {
+		if !strings.Contains(rec.Body.String(), want) {
+			t.Errorf("/metrics missing %q", want)
+		}
+	}
+}
+
+func TestDropReasons(t *testing.T) {
+	lb, listener := newMemLB(t, Config{Backends: StaticBackends("192.0.2.100:443")})
+
+	// a short header too short for its DCID is a parse error
+	lb.process(inbound{pkt: []byte{0x40, 0x01}, src: testAddr(1)})
+
+	// a worker queue nobody drains sheds the rest
+	for i := 0; i < 2; i++ {
+		listener.recv <- datagram{data: []byte{0x40}, addr: testAddr(2)}
+	}
+	done := make(chan error)
+	go func() { done <- lb.readLoop([]chan inbound{make(chan inbound)}) }()
+	deadline := time.Now().Add(time.Second)
+	for lb.Stats().PacketsReceived < 2 && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond)
+	}
+	listener.Close()
+	if err := <-done; err != nil {
+		t.Fatalf("readLoop() error = %v", err)
+	}
+
+	rec := httptest.NewRecorder()
+	lb.adminHandler().ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+	for _, want := range []string{
+		`shrimp_packets_dropped_total{reason="parse_error"} 1`,
+		`shrimp_packets_dropped_total{reason="queue_full"} 2`,
+		`shrimp_packets_dropped_total{reason="no_backend"} 0`,
+	} {
+		if !strings.Contains(rec.Body.String(), want) {
+			t.Errorf("/metrics missing %q", want)
+		}
+	}
+	if got := lb.Stats().PacketsDropped; got != 3 {
+		t.Errorf("PacketsDropped = %d, want 3", got)
+	}
+}
+
+func TestDropReasonFor(t *testing.T) {
+	tests := []struct {
+		err  error
+		want dropReason
+	}{
+		{err: packet.ErrTruncatedCID, want: dropParseError},
+		{err: packet.ErrFixedBitUnset, want: dropInvalid},
+		{err: fmt.Errorf("%w: token past datagram", packet.ErrInconsistentLengths), want: dropCorrupt},
+		{err: errServerRemoved, want: dropNoBackend},
+		{err: errBackendFull, want: dropOverCapacity},
+		{err: errDraining, want: dropDraining},
+		{err: errZeroRTTDropped, want: dropZeroRTT},
+		{err: errStatelessReset, want: dropStatelessReset},
+		{err: net.ErrClosed, want: dropBackendError},
+	}
+	for _, tt := range tests {
+		if got := dropReasonFor(tt.err); got != tt.want {
+			t.Errorf("dropReasonFor(%v) = %s, want %s", tt.err, dropReasonNames[got], dropReasonNames[tt.want])
+		}
+	}
+}
+
+// sampleLine is a metric sample of either text format: a name, optional
+// labels and a value
+var sampleLine = regexp.MustCompile(`^([a-zA-Z_:][a-zA-Z0-9_:]*)(\{[^}]*\})? (\S+)$`)
+
+func TestMetricsFormat(t *testing.T) {
+	tests := []struct {
+		format      string
+		wantType    string
+		wantFamily  string // the TYPE line of the drop counter
+		wantErr     error
+		wantTrailer string
+	}{
+		{format: "", wantType: "text/plain", wantFamily: "# TYPE shrimp_packets_dropped_total counter"},
+		{format: metricsOpenMetrics, wantType: "application/openmetrics-text", wantFamily: "# TYPE shrimp_packets_dropped counter", wantTrailer: "# EOF"},
+		{format: "statsd", wantErr: errMetricsFormat},
+	}
+	samples := map[string][]string{}
+	for _, tt := range tests {
+		t.Run(tt.format, func(t *testing.T) {
+			lb, err := NewLoadBalancer(Config{Backends: StaticBackends("192.0.2.1:443"), MetricsFormat: tt.format})
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("NewLoadBalancer() error = %v, want %v", err, tt.wantErr)
+			}
+			if err != nil {
+				return
+			}
+			lb.handlePacket([]byte{0x40}, testAddr(1))
+			rec := httptest.NewRecorder()
+			lb.adminHandler().ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+			if ct := rec.Header().Get("Content-Type"); !strings.HasPrefix(ct, tt.wantType) {
+				t.Errorf("Content-Type = %q, want %s", ct, tt.wantType)
+			}
+			lines := strings.Split(strings.TrimSuffix(rec.Body.String(), "\n"), "\n")
+			if tt.wantTrailer != "" {
+				if last := lines[len(lines)-1]; last != tt.wantTrailer {
+					t.Errorf("last line = %q, want %q", last, tt.wantTrailer)
+				}
+				lines = lines[:len(lines)-1]
+			}
+			var names []string
+			for _, line := range lines {
+				if strings.HasPrefix(line, "# HELP ") || strings.HasPrefix(line, "# TYPE ") {
+					continue
+				}
+				m := sampleLine.FindStringSubmatch(line)
+				if m == nil {
+					t.Fatalf("line %q is neither a comment nor a sample", line)
+				}
+				if _, err := strconv.ParseFloat(m[3], 64); err != nil {
+					t.Errorf("sample %q value: %v", line, err)
+				}
+				names = append(names, m[1])
+			}
+			if !slices.Contains(lines, tt.wantFamily) {
+				t.Errorf("/metrics missing %q", tt.wantFamily)
+			}
+			for _, want := range []string{"shrimp_packets_received_total", "shrimp_packets_dropped_total", "shrimp_packets_forwarded_total"} {
+				if !slices.Contains(names, want) {
+					t.Errorf("/metrics has no %s sample", want)
+				}
+			}
+			samples[tt.format] = names
+		})
+	}
+	// both formats export the same samples
+	if !slices.Equal(samples[""], samples[metricsOpenMetrics]) {
+		t.Errorf("openmetrics samples %v, want the prometheus ones %v", samples[metricsOpenMetrics], samples[""])
+	}
+}
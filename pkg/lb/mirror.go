@@ -0,0 +1,43 @@
+package lb
+
+import (
+	"math/rand/v2"
+	"net"
+)
+
+// mirrorSampled decides whether a new flow is mirrored to the shadow backend
+func (lb *LoadBalancer) mirrorSampled() bool {
+	if lb.shadow.Address == "" {
+		return false
+	}
+	return lb.shadowRate >= 1 || rand.Float64() < lb.shadowRate
+}
+
+// openShadow dials the shadow backend for a sampled flow. Failure is counted
+// and leaves the flow unmirrored; it never fails the flow itself.
+func (lb *LoadBalancer) openShadow(flow *Flow) {
+	conn, err := lb.shadow.forwarder().Open(lb.shadow.Address)
+	if err != nil {
+		lb.stats.mirrorFailures.Add(1)
+		return
+	}
+	flow.shadow = conn
+}
+
+// mirror sends a copy of a client datagram to the flow's shadow socket. The
+// shadow's responses are never read, so they are dropped by the kernel once
+// the socket buffer fills, and send errors are only counted.
+func (lb *LoadBalancer) mirror(flow *Flow, pkt []byte, first bool, src net.Addr) {
+	if flow.shadow == nil {
+		return
+	}
+	out := pkt
+	if first && lb.shadow.ProxyProtocol {
+		out = append(proxyHeader(src, lb.Addr()), pkt...)
+	}
+	if _, err := flow.shadow.Write(out); err != nil {
+		lb.stats.mirrorFailures.Add(1)
+		return
+	}
+	lb.stats.mirrored.Add(1)
+}
@@ -0,0 +1,86 @@
+package lb
+
+import (
+	"bytes"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestMirrorCopiesToShadow(t *testing.T) {
+	backend := startEchoBackend(t)
+	// the shadow echoes too, so a leaked shadow response would reach the client
+	shadow, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("ListenPacket() error = %v", err)
+	}
+	defer shadow.Close()
+
+	lb := startTestLB(t, Config{
+		Backends: StaticBackends(backend),
+		Shadow:   BackendConfig{Address: shadow.LocalAddr().String()},
+	})
+	client := newTestClient(t)
+	cid, _ := lb.routes().codec.Encode(0, []byte{0x00}, nil)
+	pkt := append([]byte{0x40}, cid...)
+	client.WriteTo(pkt, lb.Addr())
+
+	if got := readWithin(t, client, time.Second); !bytes.Equal(got, pkt) {
+		t.Fatalf("primary response = %x, want %x", got, pkt)
+	}
+
+	buf := make([]byte, maxPacketSize)
+	shadow.SetReadDeadline(time.Now().Add(time.Second))
+	n, from, err := shadow.ReadFrom(buf)
+	if err != nil {
+		t.Fatalf("shadow ReadFrom() error = %v", err)
+	}
+	if !bytes.Equal(buf[:n], pkt) {
+		t.Errorf("shadow copy = %x, want %x", buf[:n], pkt)
+	}
+	shadow.WriteTo([]byte("shadow reply"), from)
+	if got := readWithin(t, client, 100*time.Millisecond); got != nil {
+		t.Errorf("client received shadow response %q", got)
+	}
+	if got := lb.Stats().Mirrored; got != 1 {
+		t.Errorf("Mirrored = %d, want 1", got)
+	}
+}
+
+func TestMirrorFailureKeepsPrimary(t *testing.T) {
+	backend := startEchoBackend(t)
+	lb := startTestLB(t, Config{
+		Backends: StaticBackends(backend),
+		// never resolves, so every shadow dial fails
+		Shadow: BackendConfig{Address: "shadow.invalid:443"},
+	})
+	client := newTestClient(t)
+	cid, _ := lb.routes().codec.Encode(0, []byte{0x00}, nil)
+	pkt := append([]byte{0x40}, cid...)
+	client.WriteTo(pkt, lb.Addr())
+
+	if got := readWithin(t, client, time.Second); !bytes.Equal(got, pkt) {
+		t.Fatalf("primary response = %x, want %x", got, pkt)
+	}
+	if got := lb.Stats().MirrorFailures; got != 1 {
+		t.Errorf("MirrorFailures = %d, want 1", got)
+	}
+}
+
+func TestMirrorSampleRate(t *testing.T) {
+	lb, _ := NewLoadBalancer(Config{Backends: StaticBackends("backend0"), Shadow: BackendConfig{Address: "127.0.0.1:1"}, ShadowSampleRate: 0.25})
+	sampled := 0
+	for i := 0; i < 10000; i++ {
+		if lb.mirrorSampled() {
+			sampled++
+		}
+	}
+	if sampled < 2000 || sampled > 3000 {
+		t.Errorf("sampled %d of 10000 flows at rate 0.25", sampled)
+	}
+
+	unset, _ := NewLoadBalancer(Config{Backends: StaticBackends("backend0")})
+	if unset.mirrorSampled() {
+		t.Errorf("flow sampled with no shadow configured")
+	}
+}
@@ -0,0 +1,107 @@
+package lb
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"net/netip"
+	"sync"
+	"time"
+)
+
+// A new-flow rate (Config.NewFlowRate) caps how fast one source IP may open
+// flows, whatever its packet rate: each flow costs a backend socket, a
+// goroutine and session table entries, while packets of an open flow cost
+// little. A token bucket per source refills at the rate up to the burst;
+// the first packet of a new flow takes a token or is dropped. Sources are
+// keyed by IP alone so a client cannot dodge the limit by changing ports.
+
+var (
+	// errNewFlowRate is returned for an invalid new-flow rate or burst
+	errNewFlowRate = errors.New("invalid new-flow rate")
+	// errNewFlowRateLimited is returned for a packet that would open a flow
+	// for a source over its new-flow rate
+	errNewFlowRateLimited = errors.New("source over new-flow rate")
+)
+
+// tokenBucket is one source's new-flow allowance
+type tokenBucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// newFlowLimiter holds the token buckets of recent sources
+type newFlowLimiter struct {
+	rate  float64 // tokens per second
+	burst float64
+
+	mu      sync.Mutex
+	buckets map[netip.Addr]*tokenBucket
+}
+
+// newFlowLimiter returns the configured limiter, nil when the rate is unset
+func (c *Config) newFlowLimiter() (*newFlowLimiter, error) {
+	if c.NewFlowRate == 0 && c.NewFlowBurst == 0 {
+		return nil, nil
+	}
+	if c.NewFlowRate <= 0 || math.IsInf(c.NewFlowRate, 0) || c.NewFlowBurst < 0 {
+		return nil, fmt.Errorf("%w: %v per second, burst %d", errNewFlowRate, c.NewFlowRate, c.NewFlowBurst)
+	}
+	burst := float64(c.NewFlowBurst)
+	if burst == 0 {
+		burst = math.Max(1, math.Ceil(c.NewFlowRate))
+	}
+	return &newFlowLimiter{rate: c.NewFlowRate, burst: burst, buckets: make(map[netip.Addr]*tokenBucket)}, nil
+}
+
+// allow takes a token from src's bucket, reporting whether it had one
+func (l *newFlowLimiter) allow(src netip.Addr, now time.Time) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	b := l.buckets[src]
+	if b == nil {
+		b = &tokenBucket{tokens: l.burst, last: now}
+		l.buckets[src] = b
+	}
+	b.tokens = math.Min(l.burst, b.tokens+now.Sub(b.last).Seconds()*l.rate)
+	b.last = now
+	if b.tokens < 1 {
+		return false
+	}
+	b.tokens--
+	return true
+}
+
+// prune forgets sources whose buckets have refilled, as a new one would be
+func (l *newFlowLimiter) prune(now time.Time) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	for src, b := range l.buckets {
+		if b.tokens+now.Sub(b.last).Seconds()*l.rate >= l.burst {
+			delete(l.buckets, src)
+		}
+	}
+}
+
+// limited returns how many sources are out of tokens
+func (l *newFlowLimiter) limited(now time.Time) int {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	n := 0
+	for _, b := range l.buckets {
+		if b.tokens+now.Sub(b.last).Seconds()*l.rate < 1 {
+			n++
+		}
+	}
+	return n
+}
+
+// admitNewFlow applies the new-flow rate to a packet opening a flow from
+// src. Sources without an IP, over a Unix socket, are not limited.
+func (lb *LoadBalancer) admitNewFlow(src netip.Addr, now time.Time) error {
+	if lb.newFlowLimit == nil || !src.IsValid() || lb.newFlowLimit.allow(src, now) {
+		return nil
+	}
+	lb.stats.newFlowRateLimited.Add(1)
+	return errNewFlowRateLimited
+}
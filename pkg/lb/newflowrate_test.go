@@ -0,0 +1,101 @@
+package lb
+
+import (
+	"errors"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/fqzz2000/QUIC-LB-SHRIMP/pkg/packet"
+)
+
+func TestNewFlowRate(t *testing.T) {
+	clock := newFakeClock()
+	fwd := memForwarder{opened: make(chan *memConn, 64)}
+	lb, _ := newMemLB(t, Config{
+		Backends:     []BackendConfig{{Address: "192.0.2.100:443", Forwarder: fwd}},
+		NewFlowRate:  2,
+		NewFlowBurst: 2,
+		Clock:        clock,
+	})
+	initial := func(n byte) []byte {
+		return quicLongHeader(packet.Initial, []byte{0xa0, n, 0, 0, 0, 0, 0, 0}, []byte{0xcc}, make([]byte, 24))
+	}
+	// one port per packet, as a client opening connections would use
+	from := func(ip byte, port int) net.Addr {
+		return &net.UDPAddr{IP: net.IPv4(192, 0, 2, ip), Port: port}
+	}
+
+	// a steady client sends 8 packets a second on one flow all along
+	steady := initial(0xff)
+	var steadyConn *memConn
+	sendSteady := func() {
+		if err := lb.handlePacket(steady, from(2, 4433)); err != nil {
+			t.Fatalf("handlePacket(steady client) error = %v", err)
+		}
+		if steadyConn == nil {
+			steadyConn = expect(t, fwd.opened)
+		}
+		expect(t, steadyConn.sent)
+	}
+
+	// the abusive one sends its 8 a second, each opening a new flow
+	admitted, limited := 0, 0
+	for i := 0; i < 20; i++ {
+		err := lb.handlePacket(initial(byte(i)), from(1, 10000+i))
+		switch {
+		case err == nil:
+			admitted++
+			expect(t, expect(t, fwd.opened).sent)
+		case errors.Is(err, errNewFlowRateLimited):
+			limited++
+			if got := dropReasonFor(err); got != dropRateLimit {
+				t.Errorf("dropReasonFor() = %v, want %v", got, dropRateLimit)
+			}
+		default:
+			t.Fatalf("handlePacket() error = %v", err)
+		}
+		sendSteady()
+		clock.Advance(125 * time.Millisecond)
+	}
+	// the burst of 2, then 2 a second over the 2.375 seconds after it
+	if admitted != 6 || limited != 14 {
+		t.Errorf("admitted %d and limited %d of 20 new flows, want 6 and 14", admitted, limited)
+	}
+	if got := lb.Stats().NewFlowRateLimited; got != uint64(limited) {
+		t.Errorf("NewFlowRateLimited = %d, want %d", got, limited)
+	}
+
+	// another source has an allowance of its own
+	if err := lb.handlePacket(initial(0xfe), from(3, 4433)); err != nil {
+		t.Errorf("handlePacket(other source) error = %v, want nil", err)
+	}
+}
+
+func TestNewFlowRateConfig(t *testing.T) {
+	tests := []struct {
+		name    string
+		rate    float64
+		burst   int
+		wantErr error
+	}{
+		{name: "Unset"},
+		{name: "Rate", rate: 0.5},
+		{name: "Rate And Burst", rate: 10, burst: 50},
+		{name: "Negative Rate", rate: -1, wantErr: errNewFlowRate},
+		{name: "Burst Without Rate", burst: 5, wantErr: errNewFlowRate},
+		{name: "Negative Burst", rate: 10, burst: -1, wantErr: errNewFlowRate},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := NewLoadBalancer(Config{
+				Backends:     StaticBackends("192.0.2.100:443"),
+				NewFlowRate:  tt.rate,
+				NewFlowBurst: tt.burst,
+			})
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("NewLoadBalancer() error = %v, want %v", err, tt.wantErr)
+			}
+		})
+	}
+}
@@ -0,0 +1,27 @@
+package lb
+
+import "net"
+
+// The new-flow pool is the backends with BackendConfig.NewFlows set. New
+// connections, whose first Initial carries a DCID the client chose and so
+// never decodes, go to the pool, hashed by client address so retransmitted
+// Initials land together; the fallback then only sees packets of existing
+// connections that lost their flow and whose CIDs do not decode. With no
+// pool backend available new connections take the fallback as well.
+
+// newFlowBackend picks the pool backend of rt for a new connection from
+// src, or reports false when no pool backend is accepting new flows
+func (lb *LoadBalancer) newFlowBackend(rt *routingTable, src net.Addr) (BackendConfig, bool) {
+	backends := rt.backends
+	pool := make([]BackendConfig, 0, len(backends))
+	for _, b := range backends {
+		if b.NewFlows && !b.removed() && !lb.avoidNew(b.Address) {
+			pool = append(pool, b)
+		}
+	}
+	if len(pool) == 0 {
+		return BackendConfig{}, false
+	}
+	lb.stats.newFlowRouted.Add(1)
+	return pool[hashKey(lb.hashSeed, []byte(addrKey(src)))%uint64(len(pool))], true
+}
@@ -0,0 +1,76 @@
+package lb
+
+import (
+	"net"
+	"testing"
+
+	"github.com/fqzz2000/QUIC-LB-SHRIMP/pkg/packet"
+)
+
+func TestNewFlowPool(t *testing.T) {
+	undecodable := []byte{0xc0, 9, 9, 9, 9, 9, 9, 9}
+	decodable := []byte{0x00, 0x01, 1, 1, 1, 1, 1, 1}
+	pool := "192.0.2.200:443"
+
+	tests := []struct {
+		name        string
+		pkt         []byte
+		dcid        []byte
+		wantPool    bool
+		wantBackend string
+	}{
+		{name: "Unroutable Initial", pkt: quicLongHeader(packet.Initial, undecodable, []byte{0xcc}, make([]byte, 40)), dcid: undecodable, wantPool: true},
+		{name: "Unroutable 0-RTT", pkt: quicLongHeader(packet.ZeroRTT, undecodable, []byte{0xcc}, make([]byte, 40)), dcid: undecodable, wantPool: true},
+		{name: "Unroutable Short Header", pkt: append(append([]byte{0x40}, undecodable...), make([]byte, 30)...), dcid: undecodable},
+		{name: "Routable Initial", pkt: quicLongHeader(packet.Initial, decodable, []byte{0xcc}, make([]byte, 40)), dcid: decodable, wantBackend: "192.0.2.101:443"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			lb, _ := newMemLB(t, Config{
+				Backends: []BackendConfig{{Address: "192.0.2.100:443"}, {Address: "192.0.2.101:443"}, {Address: pool, NewFlows: true}},
+			})
+			if err := lb.handlePacket(tt.pkt, testAddr(1)); err != nil {
+				t.Fatalf("handlePacket() error = %v", err)
+			}
+			flow := lb.sessions.lookup(tt.dcid, testAddr(1))
+			if flow == nil {
+				t.Fatalf("handlePacket() opened no flow")
+			}
+			if tt.wantPool && flow.Backend != pool {
+				t.Errorf("flow routed to %s, want new-flow pool %s", flow.Backend, pool)
+			}
+			if tt.wantBackend != "" && flow.Backend != tt.wantBackend {
+				t.Errorf("flow routed to %s, want %s", flow.Backend, tt.wantBackend)
+			}
+			want := uint64(0)
+			if tt.wantPool {
+				want = 1
+			}
+			if got := lb.Stats().NewFlowRouted; got != want {
+				t.Errorf("NewFlowRouted = %d, want %d", got, want)
+			}
+		})
+	}
+}
+
+func TestNewFlowPoolEmpty(t *testing.T) {
+	lb, err := NewLoadBalancer(Config{
+		Backends: []BackendConfig{{Address: "192.0.2.100:443"}, {Address: "192.0.2.200:443", NewFlows: true}},
+	})
+	if err != nil {
+		t.Fatalf("NewLoadBalancer() error = %v", err)
+	}
+	src := &net.UDPAddr{IP: net.IPv4(192, 0, 2, 1), Port: 4433}
+	if backend, ok := lb.newFlowBackend(lb.routes(), src); !ok || backend.Address != "192.0.2.200:443" {
+		t.Fatalf("newFlowBackend() = %q, %v, want 192.0.2.200:443", backend.Address, ok)
+	}
+
+	// with the pool empty new flows take the fallback
+	lb, err = NewLoadBalancer(Config{Backends: StaticBackends("192.0.2.100:443")})
+	if err != nil {
+		t.Fatalf("NewLoadBalancer() error = %v", err)
+	}
+	if backend, ok := lb.newFlowBackend(lb.routes(), src); ok {
+		t.Errorf("newFlowBackend() = %q with no pool, want none", backend.Address)
+	}
+}
@@ -0,0 +1,75 @@
+package lb
+
+import (
+	"math/rand/v2"
+	"net"
+	"sync"
+)
+
+// The nonce reuse detector (Config.NonceReuseWindow) watches for servers
+// encoding CIDs with a nonce they already used. Under the stream cipher
+// that leaks the XOR of the two plaintexts and lets an observer link the
+// connections. Encoding is deterministic, so a repeated (server ID, nonce)
+// pair is a repeated CID; the detector counts one when it opens new flows
+// from two different client addresses, since one client may rightly resend
+// its packets. A CID still open as a flow routes to that flow without being
+// decoded, so what is caught is reuse across connections that did not
+// overlap, as from a server restarting its nonces. A sample of decoded new flows is checked against the last
+// Window pairs sampled, so memory stays bounded and reuse further apart
+// goes unseen. It is observability only and routes nothing differently.
+
+// nonceReuse remembers recently sampled (server ID, nonce) pairs
+type nonceReuse struct {
+	rate float64
+
+	mu    sync.Mutex
+	seen  map[string]string // pair to the client address that presented it
+	order []string          // ring of the pairs in seen, oldest at next
+	next  int
+}
+
+// newNonceReuse returns a detector remembering window pairs and sampling
+// rate of decoded new flows, or nil when window is not positive
+func newNonceReuse(window int, rate float64) *nonceReuse {
+	if window <= 0 {
+		return nil
+	}
+	if rate <= 0 || rate > 1 {
+		rate = 1
+	}
+	return &nonceReuse{rate: rate, seen: make(map[string]string, window), order: make([]string, 0, window)}
+}
+
+// observe samples the pair and reports whether it repeats one from another
+// client address
+func (d *nonceReuse) observe(serverID, nonce []byte, client net.Addr) bool {
+	if d == nil || len(nonce) == 0 || (d.rate < 1 && rand.Float64() >= d.rate) {
+		return false
+	}
+	key := string(append(append([]byte{byte(len(serverID))}, serverID...), nonce...))
+	addr := addrKey(client)
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if prev, ok := d.seen[key]; ok {
+		return prev != addr
+	}
+	if len(d.order) < cap(d.order) {
+		d.order = append(d.order, key)
+	} else {
+		delete(d.seen, d.order[d.next])
+		d.order[d.next] = key
+		d.next = (d.next + 1) % len(d.order)
+	}
+	d.seen[key] = addr
+	return false
+}
+
+// checkNonce counts a decoded new flow whose server ID and nonce repeat
+func (lb *LoadBalancer) checkNonce(res *DecodeResult, client net.Addr) {
+	if !res.Decoded || !lb.nonces.observe(res.ServerID, res.Nonce, client) {
+		return
+	}
+	lb.stats.nonceReuse.Add(1)
+	lb.logs.failure(lb.clock.Now(), "CID %x from %s repeats the nonce of server ID %x seen from another client", res.CID, client, res.ServerID)
+}
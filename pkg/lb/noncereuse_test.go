@@ -0,0 +1,82 @@
+package lb
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/fqzz2000/QUIC-LB-SHRIMP/pkg/quiclb"
+)
+
+func TestNonceReuse(t *testing.T) {
+	fwd := memForwarder{opened: make(chan *memConn, 4)}
+	lb, _ := newMemLB(t, Config{
+		Backends: []BackendConfig{{Address: "192.0.2.100:443", Forwarder: fwd}, {Address: "192.0.2.101:443", Forwarder: fwd}},
+		QUICLB: [quiclb.NumConfigs]quiclb.ConfigEntry{
+			{Algorithm: quiclb.StreamCipher, ServerIDLength: 1, NonceLength: 8, Key: bytes.Repeat([]byte{0x2b}, quiclb.KeyLength)},
+		},
+		NonceReuseWindow: 16,
+	})
+	encode := func(nonce byte) []byte {
+		t.Helper()
+		cid, err := lb.routes().codec.Encode(0, []byte{0x01}, bytes.Repeat([]byte{nonce}, 8))
+		if err != nil {
+			t.Fatalf("Encode() error = %v", err)
+		}
+		return cid
+	}
+	// opens a flow for cid from client and closes it again, as a connection
+	// that ended would
+	connect := func(cid []byte, client int) {
+		t.Helper()
+		if err := lb.handlePacket(append([]byte{0x40}, cid...), testAddr(client)); err != nil {
+			t.Fatalf("handlePacket() error = %v", err)
+		}
+		expect(t, fwd.opened)
+		for _, flow := range lb.sessions.flows() {
+			lb.closeFlow(flow)
+		}
+	}
+
+	tests := []struct {
+		name   string
+		nonce  byte
+		client int
+		want   uint64
+	}{
+		{name: "First Use", nonce: 1, client: 1, want: 0},
+		{name: "Same Client Again", nonce: 1, client: 1, want: 0},
+		{name: "Fresh Nonce", nonce: 2, client: 2, want: 0},
+		{name: "Reused Nonce", nonce: 1, client: 2, want: 1},
+	}
+	for _, tt := range tests {
+		connect(encode(tt.nonce), tt.client)
+		if got := lb.Stats().NonceReuse; got != tt.want {
+			t.Errorf("%s: NonceReuse = %d, want %d", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestNonceReuseWindow(t *testing.T) {
+	d := newNonceReuse(2, 0)
+	sid := []byte{0x01}
+	for _, nonce := range []byte{1, 2, 3} {
+		d.observe(sid, []byte{nonce}, testAddr(1))
+	}
+	if len(d.seen) != 2 {
+		t.Errorf("detector holds %d pairs, want the window of 2", len(d.seen))
+	}
+	// the oldest pair left the window; the newer ones are still caught
+	if d.observe(sid, []byte{1}, testAddr(2)) {
+		t.Error("observe(evicted pair) = true, want false")
+	}
+	if !d.observe(sid, []byte{3}, testAddr(2)) {
+		t.Error("observe(pair in window) = false, want true")
+	}
+	// the same nonce under another server ID is no reuse
+	if d.observe([]byte{0x02}, []byte{3}, testAddr(2)) {
+		t.Error("observe(other server ID) = true, want false")
+	}
+	if newNonceReuse(0, 1) != nil {
+		t.Error("newNonceReuse(0) != nil, want detection disabled")
+	}
+}
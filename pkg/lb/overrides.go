@@ -0,0 +1,184 @@
+package lb
+
+import (
+	"bytes"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/netip"
+	"sync"
+	"time"
+)
+
+// defaultOverrideTTL is how long an override lasts when neither it nor the config sets a TTL
+const defaultOverrideTTL = 10 * time.Minute
+
+// errBadOverride is returned for an override that matches nothing or names no configured backend
+var errBadOverride = errors.New("invalid routing override")
+
+// Override pins matching packets to a backend regardless of what their CID
+// decodes to, for debugging or canarying. It matches on CIDPrefix or on
+// SourceIP, whichever is set.
+type Override struct {
+	CIDPrefix []byte
+	SourceIP  netip.Addr
+	Backend   string
+	// TTL is how long the override lasts; zero uses Config.OverrideTTL
+	TTL time.Duration
+}
+
+// installedOverride is an Override with its resolved backend and expiry
+type installedOverride struct {
+	Override
+	backend BackendConfig
+	expires time.Time
+}
+
+// overrideTable holds the routing overrides, consulted before CID decode
+type overrideTable struct {
+	mu      sync.RWMutex
+	entries []installedOverride
+	ttl     time.Duration
+}
+
+func newOverrideTable(ttl time.Duration) *overrideTable {
+	if ttl <= 0 {
+		ttl = defaultOverrideTTL
+	}
+	return &overrideTable{ttl: ttl}
+}
+
+// add installs an override, dropping expired ones and any earlier override with the same key
+func (t *overrideTable) add(o Override, backend BackendConfig, now time.Time) {
+	ttl := o.TTL
+	if ttl <= 0 {
+		ttl = t.ttl
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	kept := t.entries[:0]
+	for _, e := range t.entries {
+		if now.Before(e.expires) && !(bytes.Equal(e.CIDPrefix, o.CIDPrefix) && e.SourceIP == o.SourceIP) {
+			kept = append(kept, e)
+		}
+	}
+	t.entries = append(kept, installedOverride{Override: o, backend: backend, expires: now.Add(ttl)})
+}
+
+// lookup returns the backend of the first live override matching cid or src
+func (t *overrideTable) lookup(cid []byte, src net.Addr, now time.Time) (BackendConfig, bool) {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	if len(t.entries) == 0 {
+		return BackendConfig{}, false
+	}
+	ip := addrIP(src)
+	for _, e := range t.entries {
+		if !now.Before(e.expires) {
+			continue
+		}
+		if len(e.CIDPrefix) > 0 && bytes.HasPrefix(cid, e.CIDPrefix) {
+			return e.backend, true
+		}
+		if e.SourceIP.IsValid() && e.SourceIP == ip {
+			return e.backend, true
+		}
+	}
+	return BackendConfig{}, false
+}
+
+// live returns the overrides that have not expired
+func (t *overrideTable) live(now time.Time) []installedOverride {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	var out []installedOverride
+	for _, e := range t.entries {
+		if now.Before(e.expires) {
+			out = append(out, e)
+		}
+	}
+	return out
+}
+
+// addrIP returns the IP of a UDP address, unmapping IPv4-mapped IPv6
+func addrIP(addr net.Addr) netip.Addr {
+	if u, ok := udpAddr(addr); ok {
+		return u.AddrPort().Addr().Unmap()
+	}
+	return netip.Addr{}
+}
+
+// AddOverride pins packets matching o to one of the configured backends
+func (lb *LoadBalancer) AddOverride(o Override) error {
+	if (len(o.CIDPrefix) > 0) == o.SourceIP.IsValid() {
+		return fmt.Errorf("%w: set exactly one of CIDPrefix and SourceIP", errBadOverride)
+	}
+	o.SourceIP = o.SourceIP.Unmap()
+	backend, ok := lb.backendByAddress(o.Backend)
+	if !ok {
+		return fmt.Errorf("%w: unknown backend %q", errBadOverride, o.Backend)
+	}
+	lb.overrides.add(o, backend, lb.clock.Now())
+	return nil
+}
+
+// backendByAddress returns the configured backend with the given address
+func (lb *LoadBalancer) backendByAddress(addr string) (BackendConfig, bool) {
+	for _, b := range lb.routes().backends {
+		if b.Address == addr && !b.removed() {
+			return b, true
+		}
+	}
+	return BackendConfig{}, false
+}
+
+// overrideView is one override in the /overrides API
+type overrideView struct {
+	CIDPrefix  string `json:"cid_prefix,omitempty"`
+	SourceIP   string `json:"source_ip,omitempty"`
+	Backend    string `json:"backend"`
+	TTLSeconds int    `json:"ttl_seconds,omitempty"`
+	Expires    string `json:"expires,omitempty"`
+}
+
+// handleAddOverride installs an override from a POST /overrides body
+func (lb *LoadBalancer) handleAddOverride(w http.ResponseWriter, r *http.Request) {
+	var req overrideView
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeJSONError(w, http.StatusBadRequest, "invalid JSON body: "+err.Error())
+		return
+	}
+	o := Override{Backend: req.Backend, TTL: time.Duration(req.TTLSeconds) * time.Second}
+	var err error
+	if o.CIDPrefix, err = hex.DecodeString(req.CIDPrefix); err != nil {
+		writeJSONError(w, http.StatusBadRequest, "cid_prefix must be a hex string")
+		return
+	}
+	if req.SourceIP != "" {
+		if o.SourceIP, err = netip.ParseAddr(req.SourceIP); err != nil {
+			writeJSONError(w, http.StatusBadRequest, "source_ip: "+err.Error())
+			return
+		}
+	}
+	if err := lb.AddOverride(o); err != nil {
+		writeJSONError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	writeJSON(w, http.StatusCreated, req)
+}
+
+// handleListOverrides lists the live overrides
+func (lb *LoadBalancer) handleListOverrides(w http.ResponseWriter, r *http.Request) {
+	views := []overrideView{}
+	for _, e := range lb.overrides.live(lb.clock.Now()) {
+		v := overrideView{CIDPrefix: hex.EncodeToString(e.CIDPrefix), Backend: e.Backend, Expires: e.expires.UTC().Format(time.RFC3339)}
+		if e.SourceIP.IsValid() {
+			v.SourceIP = e.SourceIP.String()
+		}
+		views = append(views, v)
+	}
+	writeJSON(w, http.StatusOK, views)
+}
@@ -0,0 +1,111 @@
+package lb
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestOverrideTakesPrecedenceOverDecode(t *testing.T) {
+	clock := newFakeClock()
+	lb, err := NewLoadBalancer(Config{
+		Backends:    StaticBackends("backend0", "backend1", "backend2"),
+		OverrideTTL: time.Minute,
+		Clock:       clock,
+	})
+	if err != nil {
+		t.Fatalf("NewLoadBalancer() error = %v", err)
+	}
+	cid, _ := lb.routes().codec.Encode(0, []byte{0x01}, nil)
+	src := &net.UDPAddr{IP: net.IPv4(192, 0, 2, 1), Port: 4433}
+	route := func() string {
+		t.Helper()
+		backend, err := lb.selectBackend(cid, src)
+		if err != nil {
+			t.Fatalf("selectBackend() error = %v", err)
+		}
+		return backend.Address
+	}
+
+	if got := route(); got != "backend1" {
+		t.Fatalf("decoded route = %q, want backend1", got)
+	}
+	if err := lb.AddOverride(Override{CIDPrefix: cid[:2], Backend: "backend2"}); err != nil {
+		t.Fatalf("AddOverride() error = %v", err)
+	}
+	if got := route(); got != "backend2" {
+		t.Errorf("route with CID prefix override = %q, want backend2", got)
+	}
+
+	clock.Advance(time.Minute)
+	if got := route(); got != "backend1" {
+		t.Errorf("route after override expired = %q, want backend1", got)
+	}
+
+	if err := lb.AddOverride(Override{SourceIP: netip.MustParseAddr("192.0.2.1"), Backend: "backend0", TTL: time.Hour}); err != nil {
+		t.Fatalf("AddOverride() error = %v", err)
+	}
+	if got := route(); got != "backend0" {
+		t.Errorf("route with source IP override = %q, want backend0", got)
+	}
+}
+
+func TestAddOverrideRejectsInvalid(t *testing.T) {
+	lb, _ := NewLoadBalancer(Config{Backends: StaticBackends("backend0")})
+	tests := []struct {
+		name string
+		o    Override
+	}{
+		{name: "No Key", o: Override{Backend: "backend0"}},
+		{name: "Both Keys", o: Override{CIDPrefix: []byte{0x01}, SourceIP: netip.MustParseAddr("192.0.2.1"), Backend: "backend0"}},
+		{name: "Unknown Backend", o: Override{CIDPrefix: []byte{0x01}, Backend: "backend9"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := lb.AddOverride(tt.o); !errors.Is(err, errBadOverride) {
+				t.Errorf("AddOverride() error = %v, want %v", err, errBadOverride)
+			}
+		})
+	}
+}
+
+func TestOverrideAdminEndpoints(t *testing.T) {
+	lb, _ := NewLoadBalancer(Config{Backends: StaticBackends("backend0", "backend1")})
+	handler := lb.adminHandler()
+
+	rec := httptest.NewRecorder()
+	body := `{"source_ip":"::ffff:198.51.100.7","backend":"backend1","ttl_seconds":30}`
+	handler.ServeHTTP(rec, httptest.NewRequest(http.MethodPost, "/overrides", strings.NewReader(body)))
+	if rec.Code != http.StatusCreated {
+		t.Fatalf("POST status = %d, want %d: %s", rec.Code, http.StatusCreated, rec.Body)
+	}
+
+	// a mapped IPv6 override still matches the plain IPv4 client
+	src := &net.UDPAddr{IP: net.IPv4(198, 51, 100, 7), Port: 1}
+	if backend, err := lb.selectBackend(bytes.Repeat([]byte{0xff}, 8), src); err != nil || backend.Address != "backend1" {
+		t.Errorf("selectBackend() = (%v, %v), want backend1", backend, err)
+	}
+
+	rec = httptest.NewRecorder()
+	handler.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/overrides", nil))
+	var views []overrideView
+	if err := json.NewDecoder(rec.Body).Decode(&views); err != nil {
+		t.Fatalf("decoding response: %v", err)
+	}
+	if len(views) != 1 || views[0].SourceIP != "198.51.100.7" || views[0].Backend != "backend1" {
+		t.Errorf("GET /overrides = %+v", views)
+	}
+
+	rec = httptest.NewRecorder()
+	handler.ServeHTTP(rec, httptest.NewRequest(http.MethodPost, "/overrides", strings.NewReader(`{"cid_prefix":"zz","backend":"backend0"}`)))
+	if rec.Code != http.StatusBadRequest {
+		t.Errorf("POST with bad prefix status = %d, want %d", rec.Code, http.StatusBadRequest)
+	}
+}
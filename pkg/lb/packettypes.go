@@ -0,0 +1,69 @@
+package lb
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/fqzz2000/QUIC-LB-SHRIMP/pkg/packet"
+)
+
+// A packet type allowlist (Config.ForwardTypes) limits what the LB forwards
+// from clients to the listed packet types, for deployments that handle or
+// ignore the others themselves. Like the 0-RTT policy it applies to each
+// packet of a coalesced datagram, so an Initial is still forwarded without
+// the 0-RTT coalesced after it; a datagram left with nothing is dropped.
+
+var (
+	// errPacketTypes is returned for an allowlist naming an unknown type
+	errPacketTypes = errors.New("invalid packet type allowlist")
+	// errPacketTypeFiltered is returned for a datagram holding only packets
+	// of types the allowlist excludes
+	errPacketTypeFiltered = errors.New("packet type not forwarded")
+)
+
+// typeSet is a set of packet types, a bit per type; the zero value is unset
+type typeSet uint8
+
+func (s typeSet) has(t packet.PacketType) bool { return s&(1<<t) != 0 }
+
+func (c *Config) forwardTypes() (typeSet, error) {
+	var s typeSet
+	for _, t := range c.ForwardTypes {
+		if t > packet.VersionNegotiation {
+			return 0, fmt.Errorf("%w: type %d", errPacketTypes, t)
+		}
+		s |= 1 << t
+	}
+	return s, nil
+}
+
+// filterTypes removes the packets of a client datagram the allowlist
+// excludes, counting them. The datagram is returned as is when all are
+// allowed; one that cannot be split stands or falls by its first packet.
+func (lb *LoadBalancer) filterTypes(processor *packet.PacketProcessor, datagram []byte) []byte {
+	if datagram[0]&0x80 == 0 {
+		if lb.forwardTypes.has(packet.OneRTT) {
+			return datagram
+		}
+		lb.stats.typeDrops.Add(1)
+		return nil
+	}
+	packets, err := processor.SplitCoalesced(datagram)
+	if err != nil {
+		packets = [][]byte{datagram}
+	}
+	var rest []byte
+	dropped := 0
+	for _, p := range packets {
+		if ptype, err := processor.ClassifyPacket(p); err != nil || !lb.forwardTypes.has(ptype) {
+			dropped++
+			continue
+		}
+		rest = append(rest, p...)
+	}
+	if dropped == 0 {
+		return datagram
+	}
+	lb.stats.typeDrops.Add(uint64(dropped))
+	return rest
+}
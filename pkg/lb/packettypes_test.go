@@ -0,0 +1,62 @@
+package lb
+
+import (
+	"bytes"
+	"errors"
+	"testing"
+
+	"github.com/fqzz2000/QUIC-LB-SHRIMP/pkg/packet"
+)
+
+func TestForwardTypes(t *testing.T) {
+	dcid := []byte{0x00, 0x00, 1, 2, 3, 4, 5, 6}
+	initial := quicLongHeader(packet.Initial, dcid, []byte{0xcc}, make([]byte, 24))
+	zeroRTT := quicLongHeader(packet.ZeroRTT, dcid, []byte{0xcc}, make([]byte, 24))
+	oneRTT := append(append([]byte{0x40}, dcid...), make([]byte, 24)...)
+	tests := []struct {
+		name      string
+		datagram  []byte
+		wantErr   error
+		wantSent  []byte
+		wantDrops uint64
+	}{
+		{name: "Initial", datagram: initial, wantSent: initial},
+		{name: "1-RTT", datagram: oneRTT, wantSent: oneRTT},
+		{name: "Handshake", datagram: quicLongHeader(packet.HandShake, dcid, []byte{0xcc}, make([]byte, 24)), wantErr: errPacketTypeFiltered, wantDrops: 1},
+		{name: "0-RTT", datagram: zeroRTT, wantErr: errPacketTypeFiltered, wantDrops: 1},
+		{name: "Initial Coalesced With 0-RTT", datagram: append(append([]byte(nil), initial...), zeroRTT...), wantSent: initial, wantDrops: 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fwd := memForwarder{opened: make(chan *memConn, 1)}
+			lb, _ := newMemLB(t, Config{
+				Backends:     []BackendConfig{{Address: "192.0.2.100:443", Forwarder: fwd}},
+				ForwardTypes: []packet.PacketType{packet.Initial, packet.OneRTT},
+			})
+			err := lb.handlePacket(tt.datagram, testAddr(1))
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("handlePacket() error = %v, want %v", err, tt.wantErr)
+			}
+			if tt.wantErr != nil {
+				if got := dropReasonFor(err); got != dropPacketType {
+					t.Errorf("dropReasonFor() = %v, want %v", got, dropPacketType)
+				}
+			} else if got := expect(t, expect(t, fwd.opened).sent); !bytes.Equal(got, tt.wantSent) {
+				t.Errorf("forwarded %x, want %x", got, tt.wantSent)
+			}
+			if got := lb.Stats().TypeDrops; got != tt.wantDrops {
+				t.Errorf("TypeDrops = %d, want %d", got, tt.wantDrops)
+			}
+		})
+	}
+}
+
+func TestForwardTypesConfig(t *testing.T) {
+	_, err := NewLoadBalancer(Config{
+		Backends:     StaticBackends("192.0.2.100:443"),
+		ForwardTypes: []packet.PacketType{packet.Initial, packet.VersionNegotiation + 1},
+	})
+	if !errors.Is(err, errPacketTypes) {
+		t.Fatalf("NewLoadBalancer() error = %v, want %v", err, errPacketTypes)
+	}
+}
@@ -0,0 +1,58 @@
+package lb
+
+import (
+	"fmt"
+
+	"github.com/fqzz2000/QUIC-LB-SHRIMP/pkg/quiclb"
+)
+
+// ServerIDPlan is the server ID a backend must put in the CIDs it issues
+// under the config of one rotation codepoint for them to route back to it,
+// with an example CID so encoded
+type ServerIDPlan struct {
+	Rotation uint8
+	Backend  string
+	ServerID []byte
+	CID      []byte
+}
+
+// PlanServerIDs works out, for each active config of cfg and each backend
+// its server IDs can name, the server ID the backend should advertise:
+// its index in the backend list or its rotation's pool, or its own
+// ServerIDs or truncated ID when mapped explicitly. It is the inverse of
+// the routing a load balancer built from cfg does, so operators can derive
+// backend configs from the LB's. It fails when cfg is invalid, or when a
+// backend can be named at no codepoint, as when the server ID space is too
+// small for the backends.
+func PlanServerIDs(cfg Config) ([]ServerIDPlan, error) {
+	rt, err := newRoutingTable(&cfg)
+	if err != nil {
+		return nil, err
+	}
+	var plans []ServerIDPlan
+	named := make(map[string]bool)
+	for r := uint8(0); r < quiclb.NumConfigs; r++ {
+		entry, active := rt.codec.Config(r)
+		if !active {
+			continue
+		}
+		for _, b := range rt.backends {
+			id, ok := rt.serverIDAt(r, b.Address, entry.ServerIDLength)
+			if !ok {
+				continue
+			}
+			cid, err := rt.codec.Encode(r, id, nil)
+			if err != nil {
+				return nil, fmt.Errorf("encoding server ID %x of %s: %w", id, b.Address, err)
+			}
+			plans = append(plans, ServerIDPlan{Rotation: r, Backend: b.Address, ServerID: id, CID: cid})
+			named[b.Address] = true
+		}
+	}
+	for _, b := range rt.backends {
+		if !named[b.Address] {
+			return nil, fmt.Errorf("%w: no server ID names %s; the server ID space is too small or it is mapped nowhere", errBadServerIDs, b.Address)
+		}
+	}
+	return plans, nil
+}
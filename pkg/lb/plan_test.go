@@ -0,0 +1,73 @@
+package lb
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"testing"
+
+	"github.com/fqzz2000/QUIC-LB-SHRIMP/pkg/quiclb"
+)
+
+func TestPlanServerIDs(t *testing.T) {
+	key := bytes.Repeat([]byte{0x5c}, quiclb.KeyLength)
+	tests := []struct {
+		name      string
+		cfg       Config
+		wantPlans int
+	}{
+		{name: "Index", cfg: Config{Backends: StaticBackends("backend0", "backend1", "backend2")}, wantPlans: 3},
+		{name: "Stream Cipher", cfg: Config{
+			Backends: StaticBackends("backend0", "backend1"),
+			QUICLB:   [quiclb.NumConfigs]quiclb.ConfigEntry{{Algorithm: quiclb.StreamCipher, ServerIDLength: 2, NonceLength: 8, Key: key}},
+		}, wantPlans: 2},
+		{name: "Explicit", cfg: Config{
+			Backends: []BackendConfig{
+				{Address: "backend0", ServerIDs: [][]byte{{0x10}}},
+				{Address: "backend1", ServerIDs: [][]byte{{0x20}, {0x21}}},
+			},
+			DefaultBackend: "backend0",
+		}, wantPlans: 2},
+		// each fleet is planned at its own codepoint
+		{name: "Rotation Pools", cfg: twoFleetConfig(), wantPlans: 4},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			plans, err := PlanServerIDs(tt.cfg)
+			if err != nil {
+				t.Fatalf("PlanServerIDs() error = %v", err)
+			}
+			if len(plans) != tt.wantPlans {
+				t.Fatalf("PlanServerIDs() = %d plans, want %d", len(plans), tt.wantPlans)
+			}
+			lb, err := NewLoadBalancer(tt.cfg)
+			if err != nil {
+				t.Fatalf("NewLoadBalancer() error = %v", err)
+			}
+			for _, p := range plans {
+				// the example CID decodes to the planned server ID, which routes to its backend
+				decoded, err := lb.routes().codec.Decode(p.CID)
+				if err != nil || decoded.Rotation != p.Rotation || !bytes.Equal(decoded.ServerID, p.ServerID) {
+					t.Errorf("Decode(%x) = %+v, %v, want rotation %d server ID %x", p.CID, decoded, err, p.Rotation, p.ServerID)
+				}
+				if backend, err := lb.routeCID(p.CID); err != nil || backend.Address != p.Backend {
+					t.Errorf("routeCID(plan of %s) = %q, %v", p.Backend, backend.Address, err)
+				}
+			}
+		})
+	}
+}
+
+func TestPlanServerIDsSpace(t *testing.T) {
+	// one-byte server IDs name at most 256 backends by index
+	var addrs []string
+	for i := 0; i < 257; i++ {
+		addrs = append(addrs, fmt.Sprintf("10.0.%d.%d:443", i/256, i%256))
+	}
+	if _, err := PlanServerIDs(Config{Backends: StaticBackends(addrs...)}); !errors.Is(err, errBadServerIDs) {
+		t.Errorf("PlanServerIDs(257 backends) error = %v, want %v", err, errBadServerIDs)
+	}
+	if plans, err := PlanServerIDs(Config{Backends: StaticBackends(addrs[:256]...)}); err != nil || len(plans) != 256 {
+		t.Errorf("PlanServerIDs(256 backends) = %d plans, %v, want 256", len(plans), err)
+	}
+}
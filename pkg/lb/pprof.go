@@ -0,0 +1,49 @@
+package lb
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/pprof"
+)
+
+// Profiling (Config.Pprof) serves the net/http/pprof handlers under
+// /debug/pprof/ on the admin server, so CPU, heap and goroutine profiles can
+// be taken from a load balancer under load. It is off by default and never
+// touches the data path. Profiles expose the process's internals, so it
+// requires an admin address bound to a loopback or private IP. Importing
+// net/http/pprof also registers its handlers on http.DefaultServeMux, which
+// nothing here serves.
+
+// errPprof is returned for profiling without a private admin address
+var errPprof = errors.New("pprof requires a private admin address")
+
+// pprofEnabled reports whether to serve profiles, checking the admin address
+// they would be served on
+func (c *Config) pprofEnabled() (bool, error) {
+	if !c.Pprof {
+		return false, nil
+	}
+	host, _, err := net.SplitHostPort(c.AdminAddr)
+	if err != nil {
+		return false, fmt.Errorf("%w: %q", errPprof, c.AdminAddr)
+	}
+	if host == "localhost" {
+		return true, nil
+	}
+	if ip := net.ParseIP(host); ip == nil || !(ip.IsLoopback() || ip.IsPrivate()) {
+		return false, fmt.Errorf("%w: %q", errPprof, c.AdminAddr)
+	}
+	return true, nil
+}
+
+// registerPprof routes the profiling handlers on the admin mux
+func registerPprof(mux *http.ServeMux) {
+	mux.HandleFunc("GET /debug/pprof/", pprof.Index)
+	mux.HandleFunc("GET /debug/pprof/cmdline", pprof.Cmdline)
+	mux.HandleFunc("GET /debug/pprof/profile", pprof.Profile)
+	mux.HandleFunc("GET /debug/pprof/symbol", pprof.Symbol)
+	mux.HandleFunc("POST /debug/pprof/symbol", pprof.Symbol)
+	mux.HandleFunc("GET /debug/pprof/trace", pprof.Trace)
+}
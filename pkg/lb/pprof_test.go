@@ -0,0 +1,59 @@
+package lb
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestPprofRegistered(t *testing.T) {
+	tests := []struct {
+		name       string
+		pprof      bool
+		wantStatus int
+	}{
+		{name: "Disabled", wantStatus: http.StatusNotFound},
+		{name: "Enabled", pprof: true, wantStatus: http.StatusOK},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			lb, err := NewLoadBalancer(Config{Backends: StaticBackends("backend0"), AdminAddr: "127.0.0.1:0", Pprof: tt.pprof})
+			if err != nil {
+				t.Fatalf("NewLoadBalancer() error = %v", err)
+			}
+			for _, path := range []string{"/debug/pprof/", "/debug/pprof/goroutine?debug=1", "/debug/pprof/cmdline"} {
+				rec := httptest.NewRecorder()
+				lb.adminHandler().ServeHTTP(rec, httptest.NewRequest(http.MethodGet, path, nil))
+				if rec.Code != tt.wantStatus {
+					t.Errorf("GET %s status = %d, want %d", path, rec.Code, tt.wantStatus)
+				}
+			}
+		})
+	}
+}
+
+func TestPprofConfig(t *testing.T) {
+	tests := []struct {
+		name    string
+		cfg     Config
+		wantErr error
+	}{
+		{name: "Disabled Public", cfg: Config{AdminAddr: ":8081"}},
+		{name: "Loopback", cfg: Config{AdminAddr: "127.0.0.1:8081", Pprof: true}},
+		{name: "Localhost", cfg: Config{AdminAddr: "localhost:8081", Pprof: true}},
+		{name: "Private", cfg: Config{AdminAddr: "10.0.0.1:8081", Pprof: true}},
+		{name: "IPv6 Loopback", cfg: Config{AdminAddr: "[::1]:8081", Pprof: true}},
+		{name: "No Admin Server", cfg: Config{Pprof: true}, wantErr: errPprof},
+		{name: "Every Interface", cfg: Config{AdminAddr: ":8081", Pprof: true}, wantErr: errPprof},
+		{name: "Public", cfg: Config{AdminAddr: "192.0.2.1:8081", Pprof: true}, wantErr: errPprof},
+		{name: "Host Name", cfg: Config{AdminAddr: "lb.example.com:8081", Pprof: true}, wantErr: errPprof},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := tt.cfg.pprofEnabled(); !errors.Is(err, tt.wantErr) {
+				t.Errorf("pprofEnabled() error = %v, want %v", err, tt.wantErr)
+			}
+		})
+	}
+}
@@ -0,0 +1,95 @@
+package lb
+
+import (
+	"errors"
+	"fmt"
+	"net"
+)
+
+var (
+	// ErrNoRoute is returned by a Strategy with no backend for a packet, to
+	// leave it to the routing the Strategy replaced: QUIC-LB decoding for
+	// Config.Strategy, the client address ring for Config.Fallback
+	ErrNoRoute = errors.New("strategy has no route")
+	// errPrefixRoute is returned for an invalid prefix route table
+	errPrefixRoute = errors.New("invalid prefix route")
+)
+
+// PrefixRoute sends DCIDs starting with Prefix to the backend at Backend
+type PrefixRoute struct {
+	Prefix  []byte
+	Backend string
+}
+
+// PrefixRouteStrategy routes on raw DCID prefixes, for operators who assign
+// CID prefix ranges to backends by hand rather than encoding server IDs
+// with QUIC-LB. A DCID goes to the backend of the longest prefix it starts
+// with. DCIDs matching no prefix, and those whose backend is unknown,
+// unhealthy or at its flow limit, get ErrNoRoute and fall through to the
+// routing the strategy stands in for.
+type PrefixRouteStrategy struct {
+	root prefixNode
+}
+
+// prefixNode is a node of the prefix trie, one level per DCID byte
+type prefixNode struct {
+	children map[byte]*prefixNode
+	backend  string // empty unless a prefix ends here
+}
+
+// NewPrefixRouteStrategy builds the trie of routes. Prefixes must be
+// non-empty and distinct; a catch-all belongs in Config.Fallback.
+func NewPrefixRouteStrategy(routes []PrefixRoute) (*PrefixRouteStrategy, error) {
+	s := &PrefixRouteStrategy{}
+	for _, r := range routes {
+		if len(r.Prefix) == 0 || r.Backend == "" {
+			return nil, fmt.Errorf("%w: prefix %x to %q", errPrefixRoute, r.Prefix, r.Backend)
+		}
+		node := &s.root
+		for _, b := range r.Prefix {
+			next := node.children[b]
+			if next == nil {
+				if node.children == nil {
+					node.children = make(map[byte]*prefixNode)
+				}
+				next = &prefixNode{}
+				node.children[b] = next
+			}
+			node = next
+		}
+		if node.backend != "" {
+			return nil, fmt.Errorf("%w: prefix %x routed twice", errPrefixRoute, r.Prefix)
+		}
+		node.backend = r.Backend
+	}
+	return s, nil
+}
+
+// Select routes the DCID by its longest matching prefix
+func (s *PrefixRouteStrategy) Select(cid []byte, src net.Addr, backends BackendSet) (BackendConfig, error) {
+	address := s.match(cid)
+	if address == "" {
+		return BackendConfig{}, ErrNoRoute
+	}
+	for _, b := range backends.Healthy() {
+		if b.Address == address {
+			return b, nil
+		}
+	}
+	return BackendConfig{}, fmt.Errorf("%w: prefix backend %s is not taking new flows", ErrNoRoute, address)
+}
+
+// match returns the backend of the longest prefix of cid, empty if none
+func (s *PrefixRouteStrategy) match(cid []byte) string {
+	longest := ""
+	node := &s.root
+	for _, b := range cid {
+		if node = node.children[b]; node == nil {
+			break
+		}
+		if node.backend != "" {
+			longest = node.backend
+		}
+	}
+	return longest
+}
@@ -0,0 +1,101 @@
+package lb
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestPrefixRouteStrategy(t *testing.T) {
+	strategy, err := NewPrefixRouteStrategy([]PrefixRoute{
+		{Prefix: []byte{0xaa}, Backend: "10.0.0.1:443"},
+		{Prefix: []byte{0xaa, 0xbb}, Backend: "10.0.0.2:443"},
+		{Prefix: []byte{0xaa, 0xbb, 0xcc, 0xdd}, Backend: "10.0.0.3:443"},
+		{Prefix: []byte{0xee}, Backend: "10.0.0.9:443"}, // not a backend
+	})
+	if err != nil {
+		t.Fatalf("NewPrefixRouteStrategy() error = %v", err)
+	}
+	lb, err := NewLoadBalancer(Config{
+		Backends: StaticBackends("10.0.0.0:443", "10.0.0.1:443", "10.0.0.2:443", "10.0.0.3:443"),
+		Strategy: strategy,
+	})
+	if err != nil {
+		t.Fatalf("NewLoadBalancer() error = %v", err)
+	}
+	// server ID 0x03 decodes to the last backend
+	encoded, err := lb.routes().codec.Encode(0, []byte{0x03}, nil)
+	if err != nil {
+		t.Fatalf("Encode() error = %v", err)
+	}
+
+	tests := []struct {
+		name      string
+		cid       []byte
+		want      string
+		wantRoute Route
+	}{
+		{name: "Shortest Prefix", cid: []byte{0xaa, 0x01, 0x02, 0x03}, want: "10.0.0.1:443", wantRoute: RouteStrategy},
+		{name: "Longer Prefix", cid: []byte{0xaa, 0xbb, 0x02, 0x03}, want: "10.0.0.2:443", wantRoute: RouteStrategy},
+		{name: "Longest Prefix", cid: []byte{0xaa, 0xbb, 0xcc, 0xdd, 0x04}, want: "10.0.0.3:443", wantRoute: RouteStrategy},
+		// a match past the end of the CID does not count
+		{name: "Partial Longer Prefix", cid: []byte{0xaa, 0xbb, 0xcc}, want: "10.0.0.2:443", wantRoute: RouteStrategy},
+		// no prefix matches, so the CID is decoded
+		{name: "No Match", cid: encoded, want: "10.0.0.3:443", wantRoute: RouteCID},
+		{name: "Unknown Backend", cid: append([]byte{0xee}, encoded[1:]...), wantRoute: RouteFallback},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			res := DecodeResult{CID: tt.cid}
+			backend, err := lb.selectRoute(&res, testAddr(1), missFallback)
+			if err != nil {
+				t.Fatalf("selectRoute() error = %v", err)
+			}
+			if res.Route != tt.wantRoute || (tt.want != "" && backend.Address != tt.want) {
+				t.Errorf("selectRoute(%x) = %s by %s, want %s by %s", tt.cid, backend.Address, res.Route, tt.want, tt.wantRoute)
+			}
+		})
+	}
+
+	// a prefix whose backend is down falls through too
+	lb.SetBackendHealth("10.0.0.2:443", false)
+	res := DecodeResult{CID: []byte{0xaa, 0xbb, 0x02, 0x03}}
+	if backend, err := lb.selectRoute(&res, testAddr(1), missFallback); err != nil || res.Route == RouteStrategy {
+		t.Errorf("selectRoute(unhealthy prefix) = %s by %s, %v, want routing past the strategy", backend.Address, res.Route, err)
+	}
+}
+
+func TestNewPrefixRouteStrategy(t *testing.T) {
+	tests := []struct {
+		name    string
+		routes  []PrefixRoute
+		wantErr error
+	}{
+		{name: "Empty Table", routes: nil},
+		{name: "Nested Prefixes", routes: []PrefixRoute{{Prefix: []byte{1}, Backend: "a"}, {Prefix: []byte{1, 2}, Backend: "b"}}},
+		{name: "Empty Prefix", routes: []PrefixRoute{{Prefix: nil, Backend: "a"}}, wantErr: errPrefixRoute},
+		{name: "No Backend", routes: []PrefixRoute{{Prefix: []byte{1}}}, wantErr: errPrefixRoute},
+		{name: "Duplicate Prefix", routes: []PrefixRoute{{Prefix: []byte{1, 2}, Backend: "a"}, {Prefix: []byte{1, 2}, Backend: "b"}}, wantErr: errPrefixRoute},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := NewPrefixRouteStrategy(tt.routes); !errors.Is(err, tt.wantErr) {
+				t.Errorf("NewPrefixRouteStrategy() error = %v, want %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestFallbackNoRoute(t *testing.T) {
+	// a fallback strategy with no route leaves the packet to the address ring
+	strategy, _ := NewPrefixRouteStrategy([]PrefixRoute{{Prefix: []byte{0xaa}, Backend: "10.0.0.2:443"}})
+	lb, err := NewLoadBalancer(Config{Backends: StaticBackends("10.0.0.1:443", "10.0.0.2:443"), Fallback: strategy})
+	if err != nil {
+		t.Fatalf("NewLoadBalancer() error = %v", err)
+	}
+	if backend, err := lb.fallbackBackend(lb.routes(), []byte{0xaa, 0x01}, testAddr(1)); err != nil || backend.Address != "10.0.0.2:443" {
+		t.Errorf("fallbackBackend(matching) = %s, %v, want 10.0.0.2:443", backend.Address, err)
+	}
+	if _, err := lb.fallbackBackend(lb.routes(), []byte{0xbb, 0x01}, testAddr(1)); err != nil {
+		t.Errorf("fallbackBackend(no match) error = %v, want the ring's backend", err)
+	}
+}
@@ -0,0 +1,134 @@
+package lb
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"net"
+	"net/netip"
+)
+
+// PROXY protocol v2 framing for forwarded QUIC datagrams.
+//
+// When a backend has ProxyProtocol enabled, the first datagram the load
+// balancer forwards for a new flow is the PROXY v2 header immediately followed
+// by the unmodified QUIC datagram, all in a single UDP payload:
+//
+//	+--------------------+---------+---------+--------+-----------+------------+
+//	| signature (12)     | ver/cmd | fam/prt | len(2) | addresses | QUIC bytes |
+//	+--------------------+---------+---------+--------+-----------+------------+
+//
+// ver/cmd is 0x21 (version 2, PROXY). fam/prt is 0x12 for UDP over IPv4 and
+// 0x22 for UDP over IPv6; the address block is source IP, destination IP,
+// source port, destination port, in network byte order. The source is the
+// client, the destination the LB address the client sent to. When either
+// address is not an IP address the family is AF_UNSPEC (0x02, length 0) and
+// the backend must ignore the block. Later datagrams of the flow are sent
+// verbatim, so backends strip the header only from the first datagram they
+// receive from each LB source port. Since UDP can drop that first datagram,
+// backends should treat a flow without a header as having an unknown client.
+//
+// Load balancers chain the same way: an outer load balancer forwards verbatim
+// to inner ones listed as backends with ProxyProtocol, so they decode the
+// same CIDs, and an inner one with Config.AcceptProxyProtocol strips the
+// header before its own routing. It then admits and routes the new flow by
+// the client the header names rather than the outer load balancer's socket,
+// which still gets the flow's responses, and passes the client on in its own
+// header to backends with ProxyProtocol. A LOCAL header, or one of another
+// family, is stripped and the sender taken as the client.
+
+// proxySignature is the fixed 12-byte PROXY v2 preamble
+var proxySignature = []byte{0x0D, 0x0A, 0x0D, 0x0A, 0x00, 0x0D, 0x0A, 0x51, 0x55, 0x49, 0x54, 0x0A}
+
+const (
+	proxyHeaderLen  = 16   // the header before the address block
+	proxyVersionCmd = 0x21 // version 2, PROXY command
+	proxyLocalCmd   = 0x20 // version 2, LOCAL command
+	proxyUDPv4      = 0x12
+	proxyUDPv6      = 0x22
+	proxyUnspec     = 0x02
+)
+
+// proxyHeader builds the PROXY v2 header describing a datagram from src to dst
+func proxyHeader(src, dst net.Addr) []byte {
+	s, sok := udpAddr(src)
+	d, dok := udpAddr(dst)
+
+	hdr := make([]byte, 0, 16+36)
+	hdr = append(hdr, proxySignature...)
+	hdr = append(hdr, proxyVersionCmd)
+	if !sok || !dok {
+		return append(hdr, proxyUnspec, 0, 0)
+	}
+
+	sip, dip := s.IP.To4(), d.IP.To4()
+	fam := byte(proxyUDPv4)
+	if sip == nil || dip == nil {
+		sip, dip = s.IP.To16(), d.IP.To16()
+		fam = proxyUDPv6
+	}
+	hdr = append(hdr, fam)
+	hdr = binary.BigEndian.AppendUint16(hdr, uint16(2*len(sip)+4))
+	hdr = append(hdr, sip...)
+	hdr = append(hdr, dip...)
+	hdr = binary.BigEndian.AppendUint16(hdr, uint16(s.Port))
+	hdr = binary.BigEndian.AppendUint16(hdr, uint16(d.Port))
+	return hdr
+}
+
+// proxiedClient strips the PROXY v2 header an outer load balancer put on a
+// datagram from src, returning the datagram and the client and destination
+// the header names. Without a header, or with one naming no UDP client, the
+// client is src and the destination nil.
+func (lb *LoadBalancer) proxiedClient(pkt []byte, src net.Addr) ([]byte, net.Addr, net.Addr, error) {
+	if !lb.acceptProxy {
+		return pkt, src, nil, nil
+	}
+	client, dst, rest, ok, err := parseProxyHeader(pkt)
+	if !ok || err != nil {
+		return pkt, src, nil, err
+	}
+	lb.stats.proxyHeaders.Add(1)
+	if client == nil {
+		return rest, src, nil, nil
+	}
+	return rest, client, dst, nil
+}
+
+// errProxyHeader is returned for a datagram whose PROXY v2 header is malformed
+var errProxyHeader = errors.New("malformed PROXY v2 header")
+
+// parseProxyHeader splits a PROXY v2 header off the front of a datagram,
+// returning the UDP addresses it carries, nil for a LOCAL header or another
+// family, and the datagram after it. ok is false when there is no header.
+func parseProxyHeader(b []byte) (src, dst net.Addr, rest []byte, ok bool, err error) {
+	if !bytes.HasPrefix(b, proxySignature) {
+		return nil, nil, b, false, nil
+	}
+	if len(b) < proxyHeaderLen || (b[12] != proxyVersionCmd && b[12] != proxyLocalCmd) {
+		return nil, nil, b, true, errProxyHeader
+	}
+	n := proxyHeaderLen + int(binary.BigEndian.Uint16(b[14:16]))
+	if len(b) < n {
+		return nil, nil, b, true, errProxyHeader
+	}
+	block, rest := b[proxyHeaderLen:n], b[n:]
+	if b[12] == proxyLocalCmd {
+		return nil, nil, rest, true, nil
+	}
+	// the addresses are copied out, since the datagram's buffer is reused
+	switch {
+	case b[13] == proxyUDPv4 && len(block) >= 12:
+		src = udpAddrFrom(netip.AddrFrom4([4]byte(block[0:4])), block[8:10])
+		dst = udpAddrFrom(netip.AddrFrom4([4]byte(block[4:8])), block[10:12])
+	case b[13] == proxyUDPv6 && len(block) >= 36:
+		src = udpAddrFrom(netip.AddrFrom16([16]byte(block[0:16])).Unmap(), block[32:34])
+		dst = udpAddrFrom(netip.AddrFrom16([16]byte(block[16:32])).Unmap(), block[34:36])
+	}
+	return src, dst, rest, true, nil
+}
+
+// udpAddrFrom returns the UDP address of ip and a two-byte port
+func udpAddrFrom(ip netip.Addr, port []byte) *net.UDPAddr {
+	return net.UDPAddrFromAddrPort(netip.AddrPortFrom(ip, binary.BigEndian.Uint16(port)))
+}
@@ -0,0 +1,179 @@
+package lb
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestProxyHeaderOnFirstDatagram(t *testing.T) {
+	backendConn := newTestClient(t)
+	lb := startTestLB(t, Config{Backends: []BackendConfig{{
+		Address:       backendConn.LocalAddr().String(),
+		ProxyProtocol: true,
+	}}})
+
+	client := newTestClient(t)
+	cid, _ := lb.routes().codec.Encode(0, []byte{0x00}, nil)
+	pkt := append([]byte{0x40}, cid...)
+	for i := 0; i < 2; i++ {
+		if _, err := client.WriteTo(pkt, lb.Addr()); err != nil {
+			t.Fatalf("WriteTo() error = %v", err)
+		}
+	}
+
+	first := readWithin(t, backendConn, time.Second)
+	if !bytes.HasPrefix(first, proxySignature) {
+		t.Fatalf("first datagram %x does not start with the PROXY v2 signature", first)
+	}
+	if first[12] != proxyVersionCmd || first[13] != proxyUDPv4 {
+		t.Fatalf("ver/cmd, fam = %#x, %#x, want %#x, %#x", first[12], first[13], proxyVersionCmd, proxyUDPv4)
+	}
+	if n := binary.BigEndian.Uint16(first[14:16]); n != 12 {
+		t.Fatalf("address block length = %d, want 12", n)
+	}
+
+	clientAddr := client.LocalAddr().(*net.UDPAddr)
+	lbAddr := lb.Addr().(*net.UDPAddr)
+	block := first[16:28]
+	if !net.IP(block[0:4]).Equal(clientAddr.IP) {
+		t.Errorf("source IP = %v, want %v", net.IP(block[0:4]), clientAddr.IP)
+	}
+	if !net.IP(block[4:8]).Equal(lbAddr.IP) {
+		t.Errorf("destination IP = %v, want %v", net.IP(block[4:8]), lbAddr.IP)
+	}
+	if port := binary.BigEndian.Uint16(block[8:10]); int(port) != clientAddr.Port {
+		t.Errorf("source port = %d, want %d", port, clientAddr.Port)
+	}
+	if port := binary.BigEndian.Uint16(block[10:12]); int(port) != lbAddr.Port {
+		t.Errorf("destination port = %d, want %d", port, lbAddr.Port)
+	}
+	if !bytes.Equal(first[28:], pkt) {
+		t.Errorf("payload after header = %x, want %x", first[28:], pkt)
+	}
+
+	if second := readWithin(t, backendConn, time.Second); !bytes.Equal(second, pkt) {
+		t.Errorf("second datagram = %x, want verbatim %x", second, pkt)
+	}
+}
+
+func TestProxyHeaderIPv6(t *testing.T) {
+	src := &net.UDPAddr{IP: net.ParseIP("2001:db8::1"), Port: 443}
+	dst := &net.UDPAddr{IP: net.IPv4(192, 0, 2, 1), Port: 8443}
+	hdr := proxyHeader(src, dst)
+	if hdr[13] != proxyUDPv6 {
+		t.Fatalf("family = %#x, want %#x", hdr[13], proxyUDPv6)
+	}
+	if n := binary.BigEndian.Uint16(hdr[14:16]); n != 36 || len(hdr) != 16+36 {
+		t.Fatalf("address block length = %d (header %d bytes), want 36", n, len(hdr))
+	}
+	if !net.IP(hdr[16:32]).Equal(src.IP) {
+		t.Errorf("source IP = %v, want %v", net.IP(hdr[16:32]), src.IP)
+	}
+}
+
+func TestParseProxyHeader(t *testing.T) {
+	v4 := &net.UDPAddr{IP: net.IPv4(192, 0, 2, 1), Port: 4433}
+	v6 := &net.UDPAddr{IP: net.ParseIP("2001:db8::1"), Port: 443}
+	lbAddr := &net.UDPAddr{IP: net.IPv4(198, 51, 100, 1), Port: 8443}
+	pkt := []byte{0x40, 1, 2, 3, 4}
+	local := append(append([]byte(nil), proxySignature...), proxyLocalCmd, proxyUnspec, 0, 0)
+	tests := []struct {
+		name     string
+		datagram []byte
+		wantSrc  net.Addr
+		wantDst  net.Addr
+		wantOK   bool
+		wantErr  error
+	}{
+		{name: "No Header", datagram: pkt},
+		{name: "IPv4", datagram: append(proxyHeader(v4, lbAddr), pkt...), wantSrc: v4, wantDst: lbAddr, wantOK: true},
+		{name: "IPv6", datagram: append(proxyHeader(v6, lbAddr), pkt...), wantSrc: v6, wantDst: lbAddr, wantOK: true},
+		{name: "Unspecified", datagram: append(proxyHeader(testUnixAddr{}, lbAddr), pkt...), wantOK: true},
+		{name: "Local", datagram: append(local, pkt...), wantOK: true},
+		{name: "Truncated", datagram: proxyHeader(v4, lbAddr)[:20], wantOK: true, wantErr: errProxyHeader},
+		{name: "Version 1", datagram: append(append(append([]byte(nil), proxySignature...), 0x11, proxyUnspec, 0, 0), pkt...), wantOK: true, wantErr: errProxyHeader},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			src, dst, rest, ok, err := parseProxyHeader(tt.datagram)
+			if ok != tt.wantOK || !errors.Is(err, tt.wantErr) {
+				t.Fatalf("parseProxyHeader() ok = %v, error = %v, want %v, %v", ok, err, tt.wantOK, tt.wantErr)
+			}
+			if err != nil {
+				return
+			}
+			if fmt.Sprint(src) != fmt.Sprint(tt.wantSrc) || fmt.Sprint(dst) != fmt.Sprint(tt.wantDst) {
+				t.Errorf("parseProxyHeader() addresses = %v, %v, want %v, %v", src, dst, tt.wantSrc, tt.wantDst)
+			}
+			if !bytes.Equal(rest, pkt) {
+				t.Errorf("parseProxyHeader() rest = %x, want %x", rest, pkt)
+			}
+		})
+	}
+}
+
+// testUnixAddr is an address of a family PROXY v2 headers do not carry
+type testUnixAddr struct{}
+
+func (testUnixAddr) Network() string { return "unixgram" }
+func (testUnixAddr) String() string  { return "/run/shrimp.sock" }
+
+func TestLoadBalancerChain(t *testing.T) {
+	backends := []net.PacketConn{newTestClient(t), newTestClient(t), newTestClient(t)}
+	var innerBackends []BackendConfig
+	for _, b := range backends {
+		innerBackends = append(innerBackends, BackendConfig{Address: b.LocalAddr().String(), ProxyProtocol: true})
+	}
+	inner := startTestLB(t, Config{Backends: innerBackends, AcceptProxyProtocol: true})
+	outer := startTestLB(t, Config{Backends: []BackendConfig{{Address: inner.Addr().String(), ProxyProtocol: true}}})
+
+	// the outer load balancer has one backend, the inner one, which decodes
+	// the same CID to its backend 1
+	client := newTestClient(t)
+	cid, _ := inner.routes().codec.Encode(0, []byte{0x01}, nil)
+	pkt := append([]byte{0x40}, cid...)
+	for i := 0; i < 2; i++ {
+		if _, err := client.WriteTo(pkt, outer.Addr()); err != nil {
+			t.Fatalf("WriteTo() error = %v", err)
+		}
+	}
+
+	// backend 1 is told of the client and the address it sent to, not of
+	// the outer load balancer, and gets the datagram verbatim
+	backends[1].SetReadDeadline(time.Now().Add(time.Second))
+	buf := make([]byte, maxPacketSize)
+	n, innerFlow, err := backends[1].ReadFrom(buf)
+	if err != nil {
+		t.Fatalf("backend 1 ReadFrom() error = %v", err)
+	}
+	src, dst, rest, ok, err := parseProxyHeader(buf[:n])
+	if !ok || err != nil {
+		t.Fatalf("first datagram %x: PROXY header ok = %v, error = %v", buf[:n], ok, err)
+	}
+	if src.String() != client.LocalAddr().String() || dst.String() != outer.Addr().String() {
+		t.Errorf("PROXY header names %v to %v, want %v to %v", src, dst, client.LocalAddr(), outer.Addr())
+	}
+	if !bytes.Equal(rest, pkt) {
+		t.Errorf("first datagram after its header = %x, want %x", rest, pkt)
+	}
+	if second := readWithin(t, backends[1], time.Second); !bytes.Equal(second, pkt) {
+		t.Errorf("second datagram = %x, want verbatim %x", second, pkt)
+	}
+	if got := inner.Stats().ProxyHeaders; got != 1 {
+		t.Errorf("inner ProxyHeaders = %d, want 1", got)
+	}
+
+	// the response goes back through both load balancers
+	resp := []byte{0x40, 0xaa, 0xbb}
+	if _, err := backends[1].WriteTo(resp, innerFlow); err != nil {
+		t.Fatalf("backend WriteTo() error = %v", err)
+	}
+	if got := readWithin(t, client, time.Second); !bytes.Equal(got, resp) {
+		t.Errorf("client got %x, want %x", got, resp)
+	}
+}
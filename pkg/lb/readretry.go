@@ -0,0 +1,49 @@
+package lb
+
+import (
+	"errors"
+	"log"
+	"net"
+	"syscall"
+	"time"
+)
+
+// A listener read error that is transient, such as a timeout, the kernel
+// running short of buffers or an ICMP report surfacing on the socket, is
+// retried after a backoff rather than stopping the load balancer; any other
+// error ends the read loop and Run returns it. The backoff doubles from
+// minReadBackoff while reads keep failing and is capped low, since shutdown
+// waits out the sleep before the closed listener ends the loop.
+
+const (
+	minReadBackoff = 5 * time.Millisecond
+	maxReadBackoff = 100 * time.Millisecond
+)
+
+// temporaryReadError reports whether a listener read error is worth retrying
+func temporaryReadError(err error) bool {
+	var ne net.Error
+	// Temporary is deprecated, but still how syscall errors report EINTR,
+	// EAGAIN and the like
+	if errors.As(err, &ne) && (ne.Timeout() || ne.Temporary()) {
+		return true
+	}
+	return errors.Is(err, syscall.ENOBUFS) || errors.Is(err, syscall.ENOMEM) || isUnreachable(err)
+}
+
+// retryRead waits out a transient read error, reporting the backoff for the
+// next one, or false when err should end the read loop
+func (lb *LoadBalancer) retryRead(err error, backoff time.Duration) (time.Duration, bool) {
+	if !temporaryReadError(err) {
+		return 0, false
+	}
+	backoff = min(max(2*backoff, minReadBackoff), maxReadBackoff)
+	lb.stats.readRetries.Add(1)
+	if lb.debug {
+		log.Printf("Listener read error, retrying in %v: %v", backoff, err)
+	} else {
+		lb.logs.failure(lb.clock.Now(), "Listener read error, retrying in %v: %v", backoff, err)
+	}
+	time.Sleep(backoff)
+	return backoff, true
+}
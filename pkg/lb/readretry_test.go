@@ -0,0 +1,95 @@
+package lb
+
+import (
+	"bytes"
+	"errors"
+	"net"
+	"os"
+	"syscall"
+	"testing"
+	"time"
+)
+
+// temporaryError is a net.Error a listener returns for a transient failure
+type temporaryError struct{}
+
+func (temporaryError) Error() string   { return "temporary failure" }
+func (temporaryError) Timeout() bool   { return false }
+func (temporaryError) Temporary() bool { return true }
+
+// flakyPacketConn fails reads with errs, in order, before reading from the
+// in-memory listener
+type flakyPacketConn struct {
+	*memPacketConn
+	errs chan error
+}
+
+func (c *flakyPacketConn) ReadFrom(p []byte) (int, net.Addr, error) {
+	select {
+	case err := <-c.errs:
+		return 0, nil, err
+	default:
+		return c.memPacketConn.ReadFrom(p)
+	}
+}
+
+func TestReadLoopRetriesTemporaryErrors(t *testing.T) {
+	tests := []struct {
+		name      string
+		err       error
+		wantRetry bool
+	}{
+		{name: "Temporary", err: temporaryError{}, wantRetry: true},
+		{name: "Timeout", err: os.ErrDeadlineExceeded, wantRetry: true},
+		{name: "No Buffers", err: &net.OpError{Op: "read", Net: "udp", Err: os.NewSyscallError("recvfrom", syscall.ENOBUFS)}, wantRetry: true},
+		{name: "Unreachable", err: &net.OpError{Op: "read", Net: "udp", Err: os.NewSyscallError("recvfrom", syscall.ECONNREFUSED)}, wantRetry: true},
+		{name: "Permanent", err: errors.New("socket gone"), wantRetry: false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			lb, err := NewLoadBalancer(Config{Backends: StaticBackends("10.0.0.1:443")})
+			if err != nil {
+				t.Fatalf("NewLoadBalancer() error = %v", err)
+			}
+			listener := &flakyPacketConn{memPacketConn: newMemPacketConn(), errs: make(chan error, 2)}
+			lb.listener = listener
+			listener.errs <- tt.err
+			listener.errs <- tt.err
+			pkt := []byte{0x40, 1, 2, 3, 4, 5, 6, 7, 8}
+			listener.recv <- datagram{pkt, testAddr(1)}
+
+			queue := make(chan inbound, 1)
+			done := make(chan error, 1)
+			go func() { done <- lb.readLoop([]chan inbound{queue}) }()
+
+			if !tt.wantRetry {
+				select {
+				case err := <-done:
+					if !errors.Is(err, tt.err) {
+						t.Errorf("readLoop() error = %v, want %v", err, tt.err)
+					}
+				case <-time.After(time.Second):
+					t.Fatal("readLoop() kept reading after a permanent error")
+				}
+				return
+			}
+			select {
+			case in := <-queue:
+				if !bytes.Equal(in.pkt, pkt) {
+					t.Errorf("queued %x, want %x", in.pkt, pkt)
+				}
+			case err := <-done:
+				t.Fatalf("readLoop() error = %v, want the error retried", err)
+			case <-time.After(time.Second):
+				t.Fatal("readLoop() never read past the temporary errors")
+			}
+			if got := lb.Stats().ReadRetries; got != 2 {
+				t.Errorf("ReadRetries = %d, want 2", got)
+			}
+			listener.Close()
+			if err := <-done; err != nil {
+				t.Errorf("readLoop() error = %v after close, want nil", err)
+			}
+		})
+	}
+}
@@ -0,0 +1,145 @@
+package lb
+
+import (
+	"context"
+	"time"
+
+	"github.com/fqzz2000/QUIC-LB-SHRIMP/pkg/quiclb"
+)
+
+const (
+	// defaultIdleTimeout reaps established flows with no traffic in either direction
+	defaultIdleTimeout = 5 * time.Minute
+	// defaultUnestablishedTimeout reaps flows that never became established,
+	// far sooner, so a stream of lone Initials cannot fill the session table
+	defaultUnestablishedTimeout = 10 * time.Second
+	// defaultEstablishedPackets is how many packets, in total, a flow must
+	// exchange (including at least one backend response) to be established
+	defaultEstablishedPackets = 2
+)
+
+// timeouts holds the flow expiry settings
+type timeouts struct {
+	idle               time.Duration
+	rotationIdle       [quiclb.NumConfigs]time.Duration // zero for idle
+	unestablished      time.Duration
+	establishedPackets uint64
+	// longestIdle bounds the idle timeouts of the config the load balancer
+	// was created with, the global one, the rotations' and the backends';
+	// drainIdle raises it to those of flows opened since
+	longestIdle time.Duration
+}
+
+// minReapInterval is the shortest the reaper sweeps at, however short a
+// timeout, since every sweep walks the whole session table
+const minReapInterval = 10 * time.Millisecond
+
+// interval returns how often the reaper sweeps flows to backends: often
+// enough that a flow outlives its timeout by at most half of it, and no
+// more often than minReapInterval
+func (t timeouts) interval(backends []BackendConfig) time.Duration {
+	shortest := min(t.idle, t.unestablished)
+	for _, idle := range t.rotationIdle {
+		if idle > 0 {
+			shortest = min(shortest, idle)
+		}
+	}
+	for _, b := range backends {
+		if b.IdleTimeout > 0 {
+			shortest = min(shortest, b.IdleTimeout)
+		}
+	}
+	return max(shortest/2, minReapInterval)
+}
+
+// idleFor returns the idle timeout of a new flow to backend: the backend's
+// own, else that of the rotation its CID decoded with, else the global one.
+// res is nil for a flow not routed by a packet.
+func (t timeouts) idleFor(backend BackendConfig, res *DecodeResult) time.Duration {
+	if backend.IdleTimeout > 0 {
+		return backend.IdleTimeout
+	}
+	if res != nil && res.Decoded && t.rotationIdle[res.Rotation] > 0 {
+		return t.rotationIdle[res.Rotation]
+	}
+	return t.idle
+}
+
+// responded records a datagram of n bytes from the backend
+func (f *Flow) responded(n int, now time.Time) {
+	f.traffic.backendPackets.Add(1)
+	f.traffic.backendBytes.Add(uint64(n))
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.lastSeen = now
+}
+
+// established reports whether the flow has heard from its backend and
+// exchanged enough packets to be treated as a real connection. Callers must hold f.mu.
+func (f *Flow) established(minPackets uint64) bool {
+	backend := f.traffic.backendPackets.Load()
+	return backend > 0 && f.traffic.clientPackets.Load()+backend >= minPackets
+}
+
+// expired reports whether the flow has outlived the timeout that applies to
+// it: an established flow its own idle timeout, recorded when it opened
+func (f *Flow) expired(now time.Time, t timeouts) (expired, established bool) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	established = f.established(t.establishedPackets)
+	if established {
+		idle := f.idle
+		if idle == 0 {
+			idle = t.idle
+		}
+		return now.Sub(f.lastSeen) >= idle, true
+	}
+	// an unestablished flow gets no extension from repeated client packets
+	return now.Sub(f.Created) >= t.unestablished, false
+}
+
+// reap closes every expired flow, completes backend removals whose drain
+// is over, logs retiring rotations that have drained and forgets sources
+// whose new-flow allowance has refilled
+func (lb *LoadBalancer) reap(now time.Time) {
+	defer lb.finishRemovals(now)
+	defer lb.logDrainedRotations(now)
+	if lb.newFlowLimit != nil {
+		lb.newFlowLimit.prune(now)
+	}
+	for _, flow := range lb.sessions.flows() {
+		expired, established := flow.expired(now, lb.timeouts)
+		if !expired {
+			continue
+		}
+		cids := lb.sessions.cidsOf(flow)
+		lb.closeFlow(flow)
+		lb.notifyEvicted(flow, cids)
+		if established {
+			lb.stats.idleReaped.Add(1)
+		} else {
+			lb.stats.halfOpenReaped.Add(1)
+		}
+	}
+}
+
+// reapLoop sweeps the session table until ctx is done, retuning the sweep
+// interval after each sweep to the backends' idle timeouts, which routing
+// changes such as ApplyConfig replace
+func (lb *LoadBalancer) reapLoop(ctx context.Context) {
+	every := lb.timeouts.interval(lb.routes().backends)
+	ticker := time.NewTicker(every)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			lb.reap(lb.clock.Now())
+			if next := lb.timeouts.interval(lb.routes().backends); next != every {
+				every = next
+				ticker.Reset(every)
+			}
+		}
+	}
+}
@@ -0,0 +1,159 @@
+package lb
+
+import (
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/fqzz2000/QUIC-LB-SHRIMP/pkg/packet"
+)
+
+func TestHalfOpenFlowReapedBeforeEstablished(t *testing.T) {
+	clock := newFakeClock()
+	lb, err := NewLoadBalancer(Config{
+		Backends:             StaticBackends("backend0"),
+		IdleTimeout:          time.Minute,
+		UnestablishedTimeout: 5 * time.Second,
+		Clock:                clock,
+	})
+	if err != nil {
+		t.Fatalf("NewLoadBalancer() error = %v", err)
+	}
+
+	halfOpen := &Flow{Backend: "backend0", Created: clock.Now(), lastSeen: clock.Now(), conn: nopConn{}}
+	established := &Flow{Backend: "backend0", Created: clock.Now(), lastSeen: clock.Now(), conn: nopConn{}}
+	lb.sessions.remember(halfOpen, []byte{0x01}, testAddr(1))
+	lb.sessions.remember(established, []byte{0x02}, testAddr(2))
+	established.received(1200, false)
+	established.responded(1200, clock.Now())
+
+	// repeated Initials alone do not keep a flow alive
+	for i := 0; i < 5; i++ {
+		clock.Advance(time.Second)
+		halfOpen.received(1200, false)
+		lb.reap(clock.Now())
+	}
+	if got := lb.sessions.flows(); len(got) != 1 || got[0] != established {
+		t.Fatalf("flows after unestablished timeout = %v, want only the established flow", got)
+	}
+
+	clock.Advance(time.Minute)
+	lb.reap(clock.Now())
+	if n := len(lb.sessions.flows()); n != 0 {
+		t.Errorf("session table holds %d flows after idle timeout, want 0", n)
+	}
+
+	stats := lb.Stats()
+	if stats.HalfOpenReaped != 1 || stats.IdleReaped != 1 {
+		t.Errorf("HalfOpenReaped = %d, IdleReaped = %d, want 1 and 1", stats.HalfOpenReaped, stats.IdleReaped)
+	}
+}
+
+func TestReapInterval(t *testing.T) {
+	tests := []struct {
+		name       string
+		cfg        Config
+		reloadIdle time.Duration // a backend idle timeout ApplyConfig brings in
+		want       time.Duration
+	}{
+		{name: "Defaults", want: defaultUnestablishedTimeout / 2},
+		{name: "Shortest Idle", cfg: Config{IdleTimeout: 4 * time.Second}, want: 2 * time.Second},
+		{name: "Floor", cfg: Config{IdleTimeout: time.Nanosecond}, want: minReapInterval},
+		{name: "Reloaded Backend", reloadIdle: 2 * time.Second, want: time.Second},
+		{name: "Reloaded Floor", reloadIdle: time.Millisecond, want: minReapInterval},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fwd := memForwarder{opened: make(chan *memConn, 1)}
+			tt.cfg.Backends = []BackendConfig{{Address: "192.0.2.100:443", Forwarder: fwd}}
+			lb, _ := newMemLB(t, tt.cfg)
+			if tt.reloadIdle > 0 {
+				cfg := tt.cfg
+				cfg.Backends = []BackendConfig{{Address: "192.0.2.100:443", Forwarder: fwd, IdleTimeout: tt.reloadIdle}}
+				if err := lb.ApplyConfig(cfg); err != nil {
+					t.Fatalf("ApplyConfig() error = %v", err)
+				}
+			}
+			if got := lb.timeouts.interval(lb.routes().backends); got != tt.want {
+				t.Errorf("interval() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestPerFlowIdleTimeout(t *testing.T) {
+	clock := newFakeClock()
+	fwd := memForwarder{opened: make(chan *memConn, 2)}
+	cfg := Config{
+		Backends: []BackendConfig{
+			{Address: "192.0.2.100:443", Forwarder: fwd, IdleTimeout: 30 * time.Second},
+			{Address: "192.0.2.101:443", Forwarder: fwd},
+		},
+		IdleTimeout:          10 * time.Minute,
+		UnestablishedTimeout: time.Hour,
+		Clock:                clock,
+	}
+	cfg.RotationIdleTimeouts[0] = 2 * time.Minute
+	lb, _ := newMemLB(t, cfg)
+	if got, want := lb.timeouts.interval(lb.routes().backends), 15*time.Second; got != want {
+		t.Errorf("interval() = %v, want %v, half the shortest idle timeout", got, want)
+	}
+
+	// the first backend's own timeout outranks the rotation's
+	open := func(serverID byte) *Flow {
+		t.Helper()
+		cid, err := lb.routes().codec.Encode(0, []byte{serverID}, []byte{1, 2, 3, 4, 5, 6})
+		if err != nil {
+			t.Fatalf("Encode() error = %v", err)
+		}
+		if err := lb.handlePacket(longHeaderPacket(packet.HandShake, cid, 64), testAddr(int(serverID)+1)); err != nil {
+			t.Fatalf("handlePacket() error = %v", err)
+		}
+		flow := lb.sessions.lookupCID(cid)
+		if flow == nil {
+			t.Fatalf("no flow opened for server ID %d", serverID)
+		}
+		flow.responded(64, clock.Now())
+		return flow
+	}
+	short, long := open(0), open(1)
+	if short.idle != 30*time.Second || long.idle != 2*time.Minute {
+		t.Fatalf("idle timeouts = %v and %v, want 30s and 2m", short.idle, long.idle)
+	}
+
+	tests := []struct {
+		advance time.Duration
+		want    []*Flow
+	}{
+		{advance: 29 * time.Second, want: []*Flow{short, long}},
+		{advance: time.Second, want: []*Flow{long}},
+		{advance: 89 * time.Second, want: []*Flow{long}},
+		{advance: time.Second, want: nil},
+	}
+	elapsed := time.Duration(0)
+	for _, tt := range tests {
+		clock.Advance(tt.advance)
+		elapsed += tt.advance
+		lb.reap(clock.Now())
+		got := lb.sessions.flows()
+		kept := len(got) == len(tt.want)
+		for _, f := range tt.want {
+			kept = kept && slices.Contains(got, f)
+		}
+		if !kept {
+			t.Errorf("flows after %v idle = %v, want %v", elapsed, got, tt.want)
+		}
+	}
+}
+
+func TestEstablishedPacketsThreshold(t *testing.T) {
+	f := &Flow{}
+	f.received(100, false)
+	f.responded(100, time.Time{})
+	if !f.established(2) {
+		t.Errorf("one packet each way not established at threshold 2")
+	}
+	if f.established(4) {
+		t.Errorf("two packets established at threshold 4")
+	}
+}
@@ -0,0 +1,72 @@
+package lb
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"errors"
+	"net"
+)
+
+// Stateless resets (Config.StatelessResetKey) answer a short-header packet
+// that belongs to no flow and whose CID does not decode to a backend, such as
+// one for a connection whose server restarted, with a stateless reset
+// (RFC 9000 section 10.3) instead of routing it by client address. The LB
+// sends them on behalf of the backends, which must derive the tokens they
+// advertise for their CIDs with StatelessResetToken and the same key.
+
+// statelessResetTokenLength is the length of a stateless reset token
+const statelessResetTokenLength = 16
+
+// minStatelessResetSize is the smallest stateless reset RFC 9000 permits
+const minStatelessResetSize = 21
+
+var (
+	// errUnknownCID is returned for a short header that matches no flow and
+	// does not decode, when the LB answers those with stateless resets
+	errUnknownCID = errors.New("connection ID matches no flow or backend")
+	// errStatelessReset is returned for a packet answered with a stateless reset
+	errStatelessReset = errors.New("answered with a stateless reset")
+)
+
+// StatelessResetToken returns the stateless reset token for a connection ID
+// under key: the first 16 bytes of HMAC-SHA256(key, cid)
+func StatelessResetToken(key, cid []byte) [statelessResetTokenLength]byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write(cid)
+	var token [statelessResetTokenLength]byte
+	copy(token[:], mac.Sum(nil))
+	return token
+}
+
+// statelessReset builds a reset one byte shorter than the packet that
+// triggered it, so two endpoints cannot reset each other in a loop, or
+// returns nil when that would be below the minimum size
+func statelessReset(key, cid []byte, triggerSize int) []byte {
+	size := triggerSize - 1
+	if size < minStatelessResetSize {
+		return nil
+	}
+	reset := make([]byte, size)
+	rand.Read(reset[:size-statelessResetTokenLength])
+	// a short header with the fixed bit set; the rest is unpredictable
+	reset[0] = 0x40 | reset[0]&0x3f
+	token := StatelessResetToken(key, cid)
+	copy(reset[size-statelessResetTokenLength:], token[:])
+	return reset
+}
+
+// sendStatelessReset answers pkt from src, on listener ln, with a stateless
+// reset for cid
+func (lb *LoadBalancer) sendStatelessReset(pkt, cid []byte, src net.Addr, ln *clientListener) error {
+	reset := statelessReset(lb.resetKey, cid, len(pkt))
+	if reset == nil {
+		return errUnknownCID
+	}
+	n, err := lb.clientConn(ln).WriteTo(reset, src)
+	if err := lb.checkWrite(n, len(reset), err); err != nil {
+		return err
+	}
+	lb.stats.statelessResets.Add(1)
+	return errStatelessReset
+}
@@ -0,0 +1,79 @@
+package lb
+
+import (
+	"bytes"
+	"errors"
+	"testing"
+
+	"github.com/fqzz2000/QUIC-LB-SHRIMP/pkg/packet"
+)
+
+func TestStatelessReset(t *testing.T) {
+	key := []byte("shared reset secret")
+	known := []byte{0x00, 0x01, 1, 1, 1, 1, 1, 1}   // server ID 01
+	unknown := []byte{0x00, 0x09, 2, 2, 2, 2, 2, 2} // server ID 09, no backend
+	short := func(dcid []byte, size int) []byte {
+		pkt := append([]byte{0x40}, dcid...)
+		return append(pkt, make([]byte, size-len(pkt))...)
+	}
+
+	tests := []struct {
+		name      string
+		key       []byte
+		pkt       []byte
+		flow      bool // a flow already holds the CID
+		wantReset bool
+		wantErr   error
+	}{
+		{name: "Unknown CID", key: key, pkt: short(unknown, 40), wantReset: true, wantErr: errStatelessReset},
+		{name: "Decodable CID", key: key, pkt: short(known, 40)},
+		{name: "Known Flow", key: key, pkt: short(unknown, 40), flow: true},
+		{name: "Long Header", key: key, pkt: quicLongHeader(packet.Initial, unknown, []byte{0xaa}, make([]byte, 20))},
+		{name: "Trigger Too Small", key: key, pkt: short(unknown, minStatelessResetSize), wantErr: errUnknownCID},
+		{name: "Disabled", pkt: short(unknown, 40)},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fwd := memForwarder{opened: make(chan *memConn, 1)}
+			lb, listener := newMemLB(t, Config{
+				Backends:          []BackendConfig{{Address: "192.0.2.100:443", Forwarder: fwd}, {Address: "192.0.2.101:443", Forwarder: fwd}},
+				StatelessResetKey: tt.key,
+			})
+			if tt.flow {
+				lb.sessions.remember(&Flow{Backend: "192.0.2.100:443", conn: nopConn{}}, unknown, testAddr(9))
+			}
+
+			err := lb.handlePacket(tt.pkt, testAddr(1))
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("handlePacket() error = %v, want %v", err, tt.wantErr)
+			}
+			if tt.wantErr == nil && len(fwd.opened)+len(lb.sessions.flows()) == 0 {
+				t.Errorf("packet was not forwarded")
+			}
+
+			if !tt.wantReset {
+				if len(listener.sent) != 0 {
+					t.Errorf("sent %x, want no reset", (<-listener.sent).data)
+				}
+				return
+			}
+			reset := expect(t, listener.sent)
+			if reset.addr.String() != testAddr(1).String() {
+				t.Errorf("reset sent to %v, want %v", reset.addr, testAddr(1))
+			}
+			if len(reset.data) != len(tt.pkt)-1 || reset.data[0]&0xc0 != 0x40 {
+				t.Errorf("reset is %d bytes with first byte %#x, want %d bytes of short header", len(reset.data), reset.data[0], len(tt.pkt)-1)
+			}
+			token := StatelessResetToken(tt.key, unknown)
+			if got := reset.data[len(reset.data)-statelessResetTokenLength:]; !bytes.Equal(got, token[:]) {
+				t.Errorf("reset token = %x, want %x", got, token)
+			}
+			if n := len(lb.sessions.flows()); n != 0 {
+				t.Errorf("reset opened %d flows, want 0", n)
+			}
+			if got := lb.Stats().StatelessResets; got != 1 {
+				t.Errorf("StatelessResets = %d, want 1", got)
+			}
+		})
+	}
+}
@@ -0,0 +1,124 @@
+package lb
+
+import (
+	"context"
+	"log"
+	"net"
+	"slices"
+	"time"
+)
+
+// Startup resolution makes Start and Run tolerate backend DNS that is not
+// ready yet, as when the LB comes up alongside its backends. Backend host
+// names are looked up with exponential backoff for up to
+// Config.ResolveTimeout; whatever resolves is served at once and the rest are
+// marked unhealthy, then retried in the background every
+// Config.ResolveRetryInterval and marked healthy once they resolve. IP
+// literals, backends with a Forwarder and addresses without a port are not
+// looked up. Flows still dial backends by name; the lookup only decides
+// whether a backend is ready.
+
+// Resolver looks up backend host names; *net.Resolver implements it
+type Resolver interface {
+	LookupHost(ctx context.Context, host string) ([]string, error)
+}
+
+const (
+	// defaultResolveTimeout caps how long startup waits for backend DNS
+	defaultResolveTimeout = 10 * time.Second
+	// defaultResolveRetryInterval is the longest backoff between lookups,
+	// and the period of background retries
+	defaultResolveRetryInterval = 5 * time.Second
+	// resolveBackoffMin is the first backoff between lookups
+	resolveBackoffMin = 100 * time.Millisecond
+)
+
+// backendHosts returns the backend addresses whose host names need looking up
+func (lb *LoadBalancer) backendHosts() []string {
+	var addrs []string
+	for _, b := range lb.routes().backends {
+		if b.removed() || b.Forwarder != nil {
+			continue
+		}
+		if host, _, err := net.SplitHostPort(b.Address); err == nil && net.ParseIP(host) == nil {
+			addrs = append(addrs, b.Address)
+		}
+	}
+	return addrs
+}
+
+// resolves reports whether the host of the backend at addr resolves
+func (lb *LoadBalancer) resolves(ctx context.Context, addr string) bool {
+	host, _, _ := net.SplitHostPort(addr)
+	ctx, cancel := context.WithTimeout(ctx, lb.resolveRetry)
+	defer cancel()
+	ips, err := lb.resolver.LookupHost(ctx, host)
+	return err == nil && len(ips) > 0
+}
+
+// resolveBackends looks up the backend host names until all resolve, the
+// startup timeout passes or ctx is done, and marks the backends left
+// unhealthy. It returns them for retryResolve.
+func (lb *LoadBalancer) resolveBackends(ctx context.Context) []string {
+	pending := lb.backendHosts()
+	deadline := time.Now().Add(lb.resolveTimeout)
+	backoff := min(resolveBackoffMin, lb.resolveRetry)
+	for {
+		pending = lb.resolvePending(ctx, pending)
+		wait := time.Until(deadline)
+		if len(pending) == 0 || wait <= 0 || ctx.Err() != nil {
+			break
+		}
+		if !sleepCtx(ctx, min(backoff, wait)) {
+			break
+		}
+		backoff = min(2*backoff, lb.resolveRetry)
+	}
+	for _, addr := range pending {
+		log.Printf("Backend %s does not resolve yet; marked unhealthy until it does", addr)
+		lb.SetBackendHealth(addr, false)
+		lb.stats.unresolvedBackends.Add(1)
+	}
+	return pending
+}
+
+// resolvePending looks up each backend once and returns those that failed
+func (lb *LoadBalancer) resolvePending(ctx context.Context, addrs []string) []string {
+	var failed []string
+	for _, addr := range addrs {
+		if !lb.resolves(ctx, addr) {
+			failed = append(failed, addr)
+		}
+	}
+	return failed
+}
+
+// retryResolve retries backends that did not resolve at startup until each
+// does, marking it healthy, or ctx is done
+func (lb *LoadBalancer) retryResolve(ctx context.Context, pending []string) {
+	for len(pending) > 0 {
+		if !sleepCtx(ctx, lb.resolveRetry) {
+			return
+		}
+		failed := lb.resolvePending(ctx, pending)
+		for _, addr := range pending {
+			if !slices.Contains(failed, addr) {
+				log.Printf("Backend %s resolves; marked healthy", addr)
+				lb.SetBackendHealth(addr, true)
+			}
+		}
+		pending = failed
+	}
+}
+
+// sleepCtx waits for d, reporting false if ctx is done first
+func sleepCtx(ctx context.Context, d time.Duration) bool {
+	t := time.NewTimer(d)
+	defer t.Stop()
+	select {
+	case <-t.C:
+		return true
+	case <-ctx.Done():
+		return false
+	}
+}
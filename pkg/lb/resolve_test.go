@@ -0,0 +1,57 @@
+package lb
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+)
+
+// stubResolver resolves every host, failing the first failures lookups of
+// each host in late
+type stubResolver struct {
+	mu       sync.Mutex
+	late     map[string]int
+	failures int
+}
+
+func (r *stubResolver) LookupHost(ctx context.Context, host string) ([]string, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if n, ok := r.late[host]; ok && n < r.failures {
+		r.late[host]++
+		return nil, errors.New("no such host")
+	}
+	return []string{"192.0.2.1"}, nil
+}
+
+func TestStartupResolution(t *testing.T) {
+	resolver := &stubResolver{late: map[string]int{"late.test": 0}, failures: 5}
+	lb := startTestLB(t, Config{
+		Backends:             StaticBackends("ready.test:443", "late.test:443", "192.0.2.9:443"),
+		Resolver:             resolver,
+		ResolveTimeout:       30 * time.Millisecond,
+		ResolveRetryInterval: 20 * time.Millisecond,
+	})
+
+	// startup gave up on the late backend without failing
+	if lb.unhealthyBackend("ready.test:443") {
+		t.Errorf("resolved backend marked unhealthy, want healthy")
+	}
+	if !lb.unhealthyBackend("late.test:443") {
+		t.Errorf("unresolved backend healthy after startup, want unhealthy")
+	}
+	if got := lb.Stats().UnresolvedBackends; got != 1 {
+		t.Errorf("UnresolvedBackends = %d, want 1", got)
+	}
+
+	// and retries it until it resolves
+	deadline := time.Now().Add(time.Second)
+	for lb.unhealthyBackend("late.test:443") {
+		if time.Now().After(deadline) {
+			t.Fatalf("backend still unhealthy after it resolved")
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
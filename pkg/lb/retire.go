@@ -0,0 +1,214 @@
+package lb
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/fqzz2000/QUIC-LB-SHRIMP/pkg/quiclb"
+)
+
+// Retiring a config rotation codepoint lets an operator watch the old
+// QUIC-LB config drain before removing it. The slot's config keeps
+// decoding; what changes is that every client packet carrying its
+// codepoint in a server-chosen CID is counted as residual traffic. Client
+// Initial and 0-RTT packets are not, since their DCID is the client's own
+// and its top bits mean nothing. A retiring slot is drained once it has
+// seen no traffic for the longest idle timeout configured: any connection still using it has
+// by then been reaped, so removing the config strands nobody. The reaper
+// logs a slot when it drains, and GET /rotations reports it.
+//
+// This is also how a deployment changes QUIC-LB algorithm, say from
+// plaintext to stream cipher, without a restart: each codepoint has its
+// own config, so a reload brings the new one up on a free codepoint while
+// the old keeps decoding the connections its CIDs belong to. Once servers
+// issue CIDs from the new config, the old codepoint is retired, and when
+// it has drained a reload removes its config.
+
+// errRotationInactive is returned for retiring a codepoint with no config
+var errRotationInactive = errors.New("config rotation not active")
+
+// retirement is the residual traffic of one retiring rotation
+type retirement struct {
+	since    time.Time // when the rotation was marked retiring
+	lastSeen time.Time // zero until residual traffic is seen
+	packets  uint64
+	logged   bool // the drain has been logged
+}
+
+// quietSince returns when the rotation last carried traffic, or was
+// marked retiring if it has not since
+func (r *retirement) quietSince() time.Time {
+	if r.lastSeen.After(r.since) {
+		return r.lastSeen
+	}
+	return r.since
+}
+
+// retirements tracks the retiring rotations. The hot path only loads mask,
+// a bit per retiring rotation; the lock is taken for their packets alone.
+type retirements struct {
+	mask  atomic.Uint32
+	mu    sync.Mutex
+	slots [quiclb.NumConfigs]*retirement
+}
+
+// seen counts a client packet whose CID carries rotation, reporting
+// whether the rotation is retiring
+func (s *retirements) seen(rotation uint8, now time.Time) bool {
+	if s.mask.Load()&(1<<rotation) == 0 {
+		return false
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	r := s.slots[rotation]
+	if r == nil {
+		return false
+	}
+	r.packets++
+	r.lastSeen = now
+	return true
+}
+
+// countRetiring counts a client packet addressed to cid as residual traffic
+// if its rotation is retiring
+func (lb *LoadBalancer) countRetiring(cid []byte, now time.Time) {
+	if len(cid) == 0 {
+		return
+	}
+	if rotation := cid[0] >> 6; lb.retiring.seen(rotation, now) {
+		lb.metrics.retiringPackets[rotation].Inc()
+	}
+}
+
+// RetireRotation marks a config rotation codepoint as retiring and starts
+// tracking its residual traffic. Marking it again restarts the count.
+func (lb *LoadBalancer) RetireRotation(rotation uint8) error {
+	if _, active := lb.routes().codec.Config(rotation); !active {
+		return fmt.Errorf("%w: %d", errRotationInactive, rotation)
+	}
+	s := &lb.retiring
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.slots[rotation] = &retirement{since: lb.clock.Now()}
+	s.mask.Store(s.mask.Load() | 1<<rotation)
+	return nil
+}
+
+// UnretireRotation stops tracking a rotation codepoint, reporting whether
+// it was retiring
+func (lb *LoadBalancer) UnretireRotation(rotation uint8) bool {
+	if rotation >= quiclb.NumConfigs {
+		return false
+	}
+	s := &lb.retiring
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	was := s.slots[rotation] != nil
+	s.slots[rotation] = nil
+	s.mask.Store(s.mask.Load() &^ (1 << rotation))
+	return was
+}
+
+// drainIdle returns how long a retiring rotation must go without packets to
+// be drained, the longest idle timeout a flow under it may still be waiting
+// out: the longest configured at startup or given to any flow opened or
+// imported since, such as one to a backend ApplyConfig brought in
+func (lb *LoadBalancer) drainIdle() time.Duration {
+	return max(lb.timeouts.longestIdle, time.Duration(lb.longestIdle.Load()))
+}
+
+// noteFlowIdle raises the longest idle timeout given to a flow to idle
+func (lb *LoadBalancer) noteFlowIdle(idle time.Duration) {
+	for {
+		longest := lb.longestIdle.Load()
+		if int64(idle) <= longest || lb.longestIdle.CompareAndSwap(longest, int64(idle)) {
+			return
+		}
+	}
+}
+
+// logDrainedRotations logs each retiring rotation the first time it is
+// found drained
+func (lb *LoadBalancer) logDrainedRotations(now time.Time) {
+	s := &lb.retiring
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for rotation, r := range s.slots {
+		if r == nil || r.logged || now.Sub(r.quietSince()) < lb.drainIdle() {
+			continue
+		}
+		r.logged = true
+		log.Printf("Config rotation %d drained after %d residual packets; safe to remove", rotation, r.packets)
+	}
+}
+
+// rotationView is one active config rotation in the /rotations listing
+type rotationView struct {
+	Rotation  uint8  `json:"rotation"`
+	Algorithm string `json:"algorithm"`
+	Retiring  bool   `json:"retiring"`
+	// the rest describe a retiring rotation only
+	ResidualPackets uint64 `json:"residual_packets,omitempty"`
+	LastSeen        string `json:"last_seen,omitempty"`
+	Drained         bool   `json:"drained,omitempty"`
+}
+
+// rotations lists the active config rotations and the residual traffic of
+// those retiring
+func (lb *LoadBalancer) rotations(now time.Time) []rotationView {
+	s := &lb.retiring
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	views := []rotationView{}
+	for rotation := uint8(0); rotation < quiclb.NumConfigs; rotation++ {
+		cfg, active := lb.routes().codec.Config(rotation)
+		if !active {
+			continue
+		}
+		v := rotationView{Rotation: rotation, Algorithm: cfg.Algorithm.String()}
+		if r := s.slots[rotation]; r != nil {
+			v.Retiring = true
+			v.ResidualPackets = r.packets
+			if !r.lastSeen.IsZero() {
+				v.LastSeen = r.lastSeen.UTC().Format(time.RFC3339)
+			}
+			v.Drained = now.Sub(r.quietSince()) >= lb.drainIdle()
+		}
+		views = append(views, v)
+	}
+	return views
+}
+
+// handleListRotations lists the active config rotations
+func (lb *LoadBalancer) handleListRotations(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, lb.rotations(lb.clock.Now()))
+}
+
+// handleRetireRotation marks the rotation in the path as retiring
+func (lb *LoadBalancer) handleRetireRotation(w http.ResponseWriter, r *http.Request) {
+	rotation, err := strconv.ParseUint(r.PathValue("rotation"), 10, 8)
+	if err == nil {
+		err = lb.RetireRotation(uint8(rotation))
+	}
+	if err != nil {
+		writeJSONError(w, http.StatusNotFound, "rotation: "+err.Error())
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]string{"status": "retiring"})
+}
+
+// handleUnretireRotation stops tracking the rotation in the path
+func (lb *LoadBalancer) handleUnretireRotation(w http.ResponseWriter, r *http.Request) {
+	rotation, err := strconv.ParseUint(r.PathValue("rotation"), 10, 8)
+	if err != nil || !lb.UnretireRotation(uint8(rotation)) {
+		writeJSONError(w, http.StatusNotFound, "rotation is not retiring")
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]string{"status": "active"})
+}
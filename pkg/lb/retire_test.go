@@ -0,0 +1,238 @@
+package lb
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/fqzz2000/QUIC-LB-SHRIMP/pkg/quiclb"
+)
+
+func TestRetireRotation(t *testing.T) {
+	clock := newFakeClock()
+	fwd := memForwarder{opened: make(chan *memConn, 2)}
+	lb, _ := newMemLB(t, Config{
+		Backends:    []BackendConfig{{Address: "192.0.2.100:443", Forwarder: fwd}},
+		QUICLB:      [quiclb.NumConfigs]quiclb.ConfigEntry{defaultQUICLBConfig, defaultQUICLBConfig},
+		IdleTimeout: time.Minute,
+		Clock:       clock,
+	})
+	admin := lb.adminHandler()
+	serve := func(method, path string) *httptest.ResponseRecorder {
+		rec := httptest.NewRecorder()
+		admin.ServeHTTP(rec, httptest.NewRequest(method, path, nil))
+		return rec
+	}
+	rotation := func(r uint8) rotationView {
+		rec := serve(http.MethodGet, "/rotations")
+		var views []rotationView
+		if err := json.NewDecoder(rec.Body).Decode(&views); err != nil {
+			t.Fatalf("GET /rotations: %v", err)
+		}
+		for _, v := range views {
+			if v.Rotation == r {
+				return v
+			}
+		}
+		t.Fatalf("GET /rotations lists no rotation %d", r)
+		return rotationView{}
+	}
+
+	if rec := serve(http.MethodPost, "/rotations/2/retire"); rec.Code != http.StatusNotFound {
+		t.Errorf("POST /rotations/2/retire = %d for an inactive rotation, want %d", rec.Code, http.StatusNotFound)
+	}
+	if rec := serve(http.MethodPost, "/rotations/0/retire"); rec.Code != http.StatusOK {
+		t.Fatalf("POST /rotations/0/retire = %d, want %d", rec.Code, http.StatusOK)
+	}
+
+	old, err := lb.routes().codec.Encode(0, []byte{0x00}, nil)
+	if err != nil {
+		t.Fatalf("Encode() error = %v", err)
+	}
+	current, err := lb.routes().codec.Encode(1, []byte{0x00}, nil)
+	if err != nil {
+		t.Fatalf("Encode() error = %v", err)
+	}
+	var conn *memConn
+	send := func(cid []byte) {
+		if err := lb.handlePacket(append([]byte{0x40}, cid...), testAddr(1)); err != nil {
+			t.Fatalf("handlePacket() error = %v", err)
+		}
+		if conn == nil {
+			conn = expect(t, fwd.opened)
+		}
+		expect(t, conn.sent)
+	}
+
+	// the old config's traffic tails off while the current one carries on
+	want := uint64(0)
+	for _, n := range []int{8, 4, 2, 1} {
+		for i := 0; i < n; i++ {
+			send(old)
+			send(current)
+		}
+		want += uint64(n)
+		clock.Advance(30 * time.Second)
+		v := rotation(0)
+		if !v.Retiring || v.Drained || v.ResidualPackets != want {
+			t.Errorf("rotation 0 = %+v, want retiring and not drained with %d residual packets", v, want)
+		}
+	}
+	if v := rotation(1); v.Retiring || v.ResidualPackets != 0 {
+		t.Errorf("rotation 1 = %+v, want not retiring", v)
+	}
+
+	// a quiet idle timeout later nothing can still be using it
+	clock.Advance(30 * time.Second)
+	if v := rotation(0); !v.Drained || v.ResidualPackets != want {
+		t.Errorf("rotation 0 = %+v, want drained with %d residual packets", v, want)
+	}
+
+	if rec := serve(http.MethodDelete, "/rotations/0/retire"); rec.Code != http.StatusOK {
+		t.Errorf("DELETE /rotations/0/retire = %d, want %d", rec.Code, http.StatusOK)
+	}
+	send(old)
+	if v := rotation(0); v.Retiring || v.ResidualPackets != 0 {
+		t.Errorf("rotation 0 = %+v after unretiring, want its traffic untracked", v)
+	}
+}
+
+func TestAlgorithmMigration(t *testing.T) {
+	clock := newFakeClock()
+	fwd := memForwarder{opened: make(chan *memConn, 2)}
+	plaintext := quiclb.ConfigEntry{Algorithm: quiclb.Plaintext, ServerIDLength: 1, NonceLength: 8}
+	stream := quiclb.ConfigEntry{Algorithm: quiclb.StreamCipher, ServerIDLength: 1, NonceLength: 8, Key: make([]byte, quiclb.KeyLength)}
+	cfg := Config{
+		Backends:    []BackendConfig{{Address: "192.0.2.10:443", Forwarder: fwd}, {Address: "192.0.2.11:443", Forwarder: fwd}},
+		QUICLB:      [quiclb.NumConfigs]quiclb.ConfigEntry{plaintext},
+		IdleTimeout: time.Minute,
+		Clock:       clock,
+	}
+	lb, _ := newMemLB(t, cfg)
+	old, err := lb.routes().codec.Encode(0, []byte{0x01}, nil)
+	if err != nil {
+		t.Fatalf("Encode() error = %v", err)
+	}
+	if err := lb.handlePacket(append([]byte{0x40}, old...), testAddr(1)); err != nil {
+		t.Fatalf("handlePacket() error = %v", err)
+	}
+	conn := expect(t, fwd.opened)
+	expect(t, conn.sent)
+
+	// the stream cipher config comes up on codepoint 1 beside the plaintext one
+	cfg.QUICLB[1] = stream
+	if err := lb.ApplyConfig(cfg); err != nil {
+		t.Fatalf("ApplyConfig(overlap) error = %v", err)
+	}
+	current, err := lb.routes().codec.Encode(1, []byte{0x00}, nil)
+	if err != nil {
+		t.Fatalf("Encode() error = %v", err)
+	}
+	var wg sync.WaitGroup
+	errs := make(chan string, 8)
+	for range 4 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for range 500 {
+				if b, err := lb.routeCID(old); err != nil || b.Address != "192.0.2.11:443" {
+					errs <- "plaintext CID routed to " + b.Address
+					return
+				}
+				if b, err := lb.routeCID(current); err != nil || b.Address != "192.0.2.10:443" {
+					errs <- "stream cipher CID routed to " + b.Address
+					return
+				}
+			}
+		}()
+	}
+	wg.Wait()
+	close(errs)
+	for msg := range errs {
+		t.Errorf("during overlap: %s", msg)
+	}
+	views := lb.rotations(clock.Now())
+	if len(views) != 2 || views[0].Algorithm == views[1].Algorithm {
+		t.Errorf("rotations during overlap = %+v, want both algorithms active", views)
+	}
+
+	// the old codepoint drains once its flow is reaped
+	if err := lb.RetireRotation(0); err != nil {
+		t.Fatalf("RetireRotation() error = %v", err)
+	}
+	clock.Advance(2 * time.Minute)
+	lb.reap(clock.Now())
+	if v := lb.rotations(clock.Now())[0]; v.Rotation != 0 || !v.Drained {
+		t.Errorf("rotation 0 = %+v, want drained", v)
+	}
+
+	// and a reload without its config retires it for good
+	cfg.QUICLB[0] = quiclb.ConfigEntry{}
+	if err := lb.ApplyConfig(cfg); err != nil {
+		t.Fatalf("ApplyConfig(retired) error = %v", err)
+	}
+	if mask := lb.retiring.mask.Load(); mask != 0 {
+		t.Errorf("retiring mask = %b after the config was removed, want none", mask)
+	}
+	if b, err := lb.routeCID(current); err != nil || b.Address != "192.0.2.10:443" {
+		t.Errorf("routeCID(stream cipher) = %s, %v, want 192.0.2.10:443", b.Address, err)
+	}
+}
+
+func TestRetiredRotationWaitsOutLongerFlows(t *testing.T) {
+	tests := []struct {
+		name string
+		// open gives a flow a 10 minute idle timeout after startup
+		open func(t *testing.T, lb *LoadBalancer, backend string)
+	}{
+		{name: "Applied Backend", open: func(t *testing.T, lb *LoadBalancer, backend string) {
+			cfg := Config{
+				Backends: []BackendConfig{{Address: backend, IdleTimeout: 10 * time.Minute}},
+				QUICLB:   [quiclb.NumConfigs]quiclb.ConfigEntry{defaultQUICLBConfig},
+			}
+			if err := lb.ApplyConfig(cfg); err != nil {
+				t.Fatalf("ApplyConfig() error = %v", err)
+			}
+			cid, _ := lb.routes().codec.Encode(0, []byte{0x00}, nil)
+			if err := lb.handlePacket(append([]byte{0x40}, cid...), testAddr(1)); err != nil {
+				t.Fatalf("handlePacket() error = %v", err)
+			}
+		}},
+		{name: "Imported Flow", open: func(t *testing.T, lb *LoadBalancer, backend string) {
+			now := lb.clock.Now()
+			records := []FlowRecord{{CIDs: [][]byte{{0x01}}, ClientAddr: testAddr(1).String(), Backend: backend, Created: now, LastSeen: now, IdleTimeout: 10 * time.Minute}}
+			if n, err := lb.ImportFlows(records); err != nil || n != 1 {
+				t.Fatalf("ImportFlows() = (%d, %v), want 1", n, err)
+			}
+		}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			clock := newFakeClock()
+			backend := startEchoBackend(t)
+			lb := startTestLB(t, Config{
+				Backends:    StaticBackends(backend),
+				QUICLB:      [quiclb.NumConfigs]quiclb.ConfigEntry{defaultQUICLBConfig},
+				IdleTimeout: time.Minute,
+				Clock:       clock,
+			})
+			if err := lb.RetireRotation(0); err != nil {
+				t.Fatalf("RetireRotation() error = %v", err)
+			}
+			tt.open(t, lb, backend)
+
+			// the startup idle timeout is not the longest a flow may idle for
+			clock.Advance(2 * time.Minute)
+			if v := lb.rotations(clock.Now())[0]; v.Drained {
+				t.Errorf("rotation 0 = %+v with a 10 minute flow quiet for 2 minutes, want not drained", v)
+			}
+			clock.Advance(10 * time.Minute)
+			if v := lb.rotations(clock.Now())[0]; !v.Drained {
+				t.Errorf("rotation 0 = %+v past the flow's idle timeout, want drained", v)
+			}
+		})
+	}
+}
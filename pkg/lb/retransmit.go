@@ -0,0 +1,20 @@
+package lb
+
+import "time"
+
+// A client that hears nothing back retransmits its Initial once its probe
+// timeout fires, to the same DCID, so the retransmit finds the flow the
+// first opened and goes to the same backend. Each flow counts the client's
+// Initials; one is counted as a retransmit when it arrives at least
+// initialFlightGap after the flow opened and the backend has still sent
+// nothing back, which points at a backend that is not answering. The gap
+// keeps out the rest of a first flight, such as a ClientHello too large for
+// one datagram, which leaves back to back.
+const initialFlightGap = 10 * time.Millisecond
+
+// countInitial counts a client datagram carrying an Initial against the
+// flow, reporting whether it is a retransmit
+func (f *Flow) countInitial(now time.Time) bool {
+	f.traffic.initials.Add(1)
+	return now.Sub(f.Created) >= initialFlightGap && f.traffic.backendPackets.Load() == 0
+}
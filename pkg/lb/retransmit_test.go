@@ -0,0 +1,62 @@
+package lb
+
+import (
+	"bytes"
+	"testing"
+	"time"
+
+	"github.com/fqzz2000/QUIC-LB-SHRIMP/pkg/packet"
+)
+
+func TestInitialRetransmits(t *testing.T) {
+	tests := []struct {
+		name            string
+		gap             time.Duration // between the two Initials
+		reply           bool          // the backend answers the first
+		wantRetransmits uint64
+	}{
+		{name: "Retransmit", gap: 500 * time.Millisecond, wantRetransmits: 1},
+		{name: "Same Flight", gap: time.Millisecond},
+		{name: "Backend Answered", gap: 500 * time.Millisecond, reply: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			clock := newFakeClock()
+			fwd := memForwarder{opened: make(chan *memConn, 2)}
+			lb, listener := newMemLB(t, Config{Clock: clock, Backends: []BackendConfig{{Address: "192.0.2.100:443", Forwarder: fwd}}})
+
+			initial := longHeaderPacket(packet.Initial, []byte{0xc0, 1, 2, 3, 4, 5, 6, 7}, 1200)
+			if err := lb.handlePacket(initial, testAddr(1)); err != nil {
+				t.Fatalf("handlePacket() error = %v", err)
+			}
+			conn := expect(t, fwd.opened)
+			expect(t, conn.sent)
+			if tt.reply {
+				conn.recv <- []byte{0xc0, 0, 0, 0, 1}
+				expect(t, listener.sent)
+			}
+			clock.Advance(tt.gap)
+			if err := lb.handlePacket(initial, testAddr(1)); err != nil {
+				t.Fatalf("handlePacket(retransmit) error = %v", err)
+			}
+
+			// the second Initial goes to the first's flow and backend
+			if got := expect(t, conn.sent); !bytes.Equal(got, initial) {
+				t.Errorf("second Initial forwarded as %x, want it verbatim", got[:16])
+			}
+			if len(fwd.opened) != 0 {
+				t.Error("second Initial opened a flow of its own")
+			}
+			stats := lb.Stats()
+			if stats.ActiveFlows != 1 {
+				t.Errorf("ActiveFlows = %d, want 1", stats.ActiveFlows)
+			}
+			if stats.InitialRetransmits != tt.wantRetransmits {
+				t.Errorf("InitialRetransmits = %d, want %d", stats.InitialRetransmits, tt.wantRetransmits)
+			}
+			if flows := lb.ExportFlows(); len(flows) != 1 || flows[0].Initials != 2 {
+				t.Errorf("ExportFlows() = %+v, want one flow of 2 Initials", flows)
+			}
+		})
+	}
+}
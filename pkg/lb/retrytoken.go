@@ -0,0 +1,194 @@
+package lb
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/fqzz2000/QUIC-LB-SHRIMP/pkg/packet"
+)
+
+// The Retry tokens the "retry" draining policy (drainredirect.go) issues
+// expire and are good for one connection. A token is
+//
+//	length byte | original DCID | issue time | nonce | tag
+//
+// with the issue time in unix milliseconds and a random nonce, both eight
+// bytes big-endian, and a 16-byte HMAC-SHA256 tag over the rest under
+// Config.RetryTokenKey. Backends read the original DCID behind its length
+// byte as before and ignore what follows. The Initial that opens a flow with
+// one of these tokens is checked before routing: a token older than
+// Config.RetryTokenLifetime, or one already seen, is dropped, the nonces of
+// tokens seen lately being kept in a replay cache of Config.RetryReplayCache
+// entries. The cache is bounded, so a token evicted before it expires can be
+// replayed once more; it needs to hold about the Retries sent in a lifetime.
+// Tokens whose tag does not verify, as the tokens backends hand out, pass
+// through untouched.
+
+const (
+	// defaultRetryTokenLifetime is how long a Retry token is accepted unless
+	// configured
+	defaultRetryTokenLifetime = 10 * time.Second
+	// defaultRetryReplayCache is how many token nonces are kept unless
+	// configured
+	defaultRetryReplayCache = 4096
+	// retryTokenTagLength is the truncated HMAC length
+	retryTokenTagLength = 16
+	// retryTokenKeyLength is the random key generated when none is configured
+	retryTokenKeyLength = 32
+)
+
+var (
+	// ErrRetryTokenInvalid is returned for a token this load balancer did
+	// not issue
+	ErrRetryTokenInvalid = errors.New("invalid retry token")
+	// ErrRetryTokenExpired is returned for a token past its lifetime
+	ErrRetryTokenExpired = errors.New("retry token expired")
+	// ErrRetryTokenReplayed is returned for a token already used
+	ErrRetryTokenReplayed = errors.New("retry token replayed")
+	// errRetryToken is returned for an invalid Retry token configuration
+	errRetryToken = errors.New("invalid retry token configuration")
+)
+
+// retryTokens issues and checks Retry tokens, nil unless the draining policy
+// sends Retries
+type retryTokens struct {
+	key      []byte
+	lifetime time.Duration
+
+	mu     sync.Mutex
+	seen   map[uint64]struct{} // nonces of tokens decoded lately
+	order  []uint64            // ring of the nonces in seen, oldest at next
+	next   int
+	filled bool
+}
+
+// retryTokens returns the Retry token settings for the draining policy
+func (c *Config) retryTokens(drainPolicy string) (*retryTokens, error) {
+	if drainPolicy != drainingRetry {
+		return nil, nil
+	}
+	if c.RetryTokenLifetime < 0 || c.RetryReplayCache < 0 {
+		return nil, fmt.Errorf("%w: lifetime %v, replay cache %d", errRetryToken, c.RetryTokenLifetime, c.RetryReplayCache)
+	}
+	t := &retryTokens{key: c.RetryTokenKey, lifetime: c.RetryTokenLifetime}
+	if t.lifetime == 0 {
+		t.lifetime = defaultRetryTokenLifetime
+	}
+	size := c.RetryReplayCache
+	if size == 0 {
+		size = defaultRetryReplayCache
+	}
+	t.seen, t.order = make(map[uint64]struct{}, size), make([]uint64, size)
+	switch {
+	case len(t.key) == 0:
+		t.key = make([]byte, retryTokenKeyLength)
+		if _, err := rand.Read(t.key); err != nil {
+			return nil, err
+		}
+	case len(t.key) < retryTokenTagLength:
+		return nil, fmt.Errorf("%w: key of %d bytes, want at least %d", errRetryToken, len(t.key), retryTokenTagLength)
+	}
+	return t, nil
+}
+
+// tag returns the token tag over body
+func (t *retryTokens) tag(body []byte) []byte {
+	mac := hmac.New(sha256.New, t.key)
+	mac.Write(body)
+	return mac.Sum(nil)[:retryTokenTagLength]
+}
+
+// issue returns a token for a connection to odcid issued at now
+func (t *retryTokens) issue(odcid []byte, now time.Time) ([]byte, error) {
+	var nonce [8]byte
+	if _, err := rand.Read(nonce[:]); err != nil {
+		return nil, err
+	}
+	token := make([]byte, 0, 1+len(odcid)+16+retryTokenTagLength)
+	token = append(token, byte(len(odcid)))
+	token = append(token, odcid...)
+	token = binary.BigEndian.AppendUint64(token, uint64(now.UnixMilli()))
+	token = append(token, nonce[:]...)
+	return append(token, t.tag(token)...), nil
+}
+
+// decode checks a token at now, claiming its nonce, and returns its original
+// DCID
+func (t *retryTokens) decode(token []byte, now time.Time) ([]byte, error) {
+	if len(token) == 0 || len(token) != 1+int(token[0])+16+retryTokenTagLength {
+		return nil, ErrRetryTokenInvalid
+	}
+	body, tag := token[:len(token)-retryTokenTagLength], token[len(token)-retryTokenTagLength:]
+	if !hmac.Equal(tag, t.tag(body)) {
+		return nil, ErrRetryTokenInvalid
+	}
+	odcid, fields := body[1:1+token[0]], body[1+token[0]:]
+	issued := time.UnixMilli(int64(binary.BigEndian.Uint64(fields)))
+	if age := now.Sub(issued); age > t.lifetime {
+		return nil, fmt.Errorf("%w: issued %v ago", ErrRetryTokenExpired, age.Round(time.Millisecond))
+	}
+	if !t.claim(binary.BigEndian.Uint64(fields[8:])) {
+		return nil, ErrRetryTokenReplayed
+	}
+	return odcid, nil
+}
+
+// claim records a token nonce, reporting false when it was already seen
+func (t *retryTokens) claim(nonce uint64) bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if _, ok := t.seen[nonce]; ok {
+		return false
+	}
+	if t.filled {
+		delete(t.seen, t.order[t.next])
+	}
+	t.seen[nonce] = struct{}{}
+	t.order[t.next] = nonce
+	if t.next++; t.next == len(t.order) {
+		t.next, t.filled = 0, true
+	}
+	return true
+}
+
+// DecodeRetryToken checks a Retry token the load balancer issued and returns
+// the original DCID it carries. A token decodes once: it is rejected with
+// ErrRetryTokenExpired past Config.RetryTokenLifetime, with
+// ErrRetryTokenReplayed when already decoded, and with ErrRetryTokenInvalid
+// when the load balancer did not issue it or issues no tokens.
+func (lb *LoadBalancer) DecodeRetryToken(token []byte) ([]byte, error) {
+	if lb.retryTokens == nil {
+		return nil, ErrRetryTokenInvalid
+	}
+	odcid, err := lb.retryTokens.decode(token, lb.clock.Now())
+	switch {
+	case errors.Is(err, ErrRetryTokenExpired):
+		lb.stats.retryExpired.Add(1)
+	case errors.Is(err, ErrRetryTokenReplayed):
+		lb.stats.retryReplayed.Add(1)
+	}
+	return odcid, err
+}
+
+// checkRetryToken drops the Initial opening a flow when it carries a Retry
+// token the load balancer issued that expired or was already used
+func (lb *LoadBalancer) checkRetryToken(header packet.QuicHeader, pkt []byte) error {
+	lh, ok := header.(*packet.LongHeader)
+	if lb.retryTokens == nil || !ok || lh.LongPacketType != packet.Initial {
+		return nil
+	}
+	token, err := lh.Token(pkt)
+	if err != nil || len(token) == 0 {
+		return nil
+	}
+	if _, err := lb.DecodeRetryToken(token); err != nil && !errors.Is(err, ErrRetryTokenInvalid) {
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,141 @@
+package lb
+
+import (
+	"bytes"
+	"errors"
+	"testing"
+	"time"
+)
+
+// initialWithToken returns a client Initial to dcid carrying token, padded
+// with payload to at least size bytes
+func initialWithToken(dcid, token []byte, size int) []byte {
+	pkt := []byte{0xc0, 0x00, 0x00, 0x00, 0x01, byte(len(dcid))}
+	pkt = append(pkt, dcid...)
+	pkt = append(pkt, 0x00, byte(len(token))) // empty SCID, one-byte token length
+	pkt = append(pkt, token...)
+	payload := max(size-len(pkt)-2, 1)
+	pkt = append(pkt, 0x40|byte(payload>>8), byte(payload))
+	return append(pkt, make([]byte, payload)...)
+}
+
+func TestDecodeRetryToken(t *testing.T) {
+	clock := newFakeClock()
+	lb, _ := newMemLB(t, Config{
+		Backends:           StaticBackends("192.0.2.1:443"),
+		DrainingNewFlows:   drainingRetry,
+		RetryTokenLifetime: 5 * time.Second,
+		Clock:              clock,
+	})
+	odcid := []byte{0xc0, 1, 2, 3, 4, 5, 6, 7}
+	issue := func() []byte {
+		token, err := lb.retryTokens.issue(odcid, clock.Now())
+		if err != nil {
+			t.Fatalf("issue() error = %v", err)
+		}
+		return token
+	}
+
+	fresh := issue()
+	if got, err := lb.DecodeRetryToken(fresh); err != nil || !bytes.Equal(got, odcid) {
+		t.Fatalf("DecodeRetryToken(fresh) = %x, %v, want %x", got, err, odcid)
+	}
+	if _, err := lb.DecodeRetryToken(fresh); !errors.Is(err, ErrRetryTokenReplayed) {
+		t.Errorf("DecodeRetryToken(replayed) error = %v, want %v", err, ErrRetryTokenReplayed)
+	}
+
+	expired := issue()
+	clock.Advance(6 * time.Second)
+	if _, err := lb.DecodeRetryToken(expired); !errors.Is(err, ErrRetryTokenExpired) {
+		t.Errorf("DecodeRetryToken(expired) error = %v, want %v", err, ErrRetryTokenExpired)
+	}
+
+	forged := issue()
+	forged[len(forged)-1] ^= 0x01
+	for _, token := range [][]byte{forged, {0x08, 0xc0}, nil} {
+		if _, err := lb.DecodeRetryToken(token); !errors.Is(err, ErrRetryTokenInvalid) {
+			t.Errorf("DecodeRetryToken(%x) error = %v, want %v", token, err, ErrRetryTokenInvalid)
+		}
+	}
+
+	stats := lb.Stats()
+	if stats.RetryTokensExpired != 1 || stats.RetryTokensReplayed != 1 {
+		t.Errorf("RetryTokensExpired, RetryTokensReplayed = %d, %d, want 1, 1", stats.RetryTokensExpired, stats.RetryTokensReplayed)
+	}
+}
+
+func TestRetryTokenReplayDropped(t *testing.T) {
+	fwd := memForwarder{opened: make(chan *memConn, 4)}
+	lb, _ := newMemLB(t, Config{
+		Backends:         []BackendConfig{{Address: "192.0.2.1:443", Forwarder: fwd}},
+		DrainingNewFlows: drainingRetry,
+	})
+	token, err := lb.retryTokens.issue([]byte{0xc0, 1, 2, 3, 4, 5, 6, 7}, lb.clock.Now())
+	if err != nil {
+		t.Fatalf("issue() error = %v", err)
+	}
+	cid := func(n byte) []byte { return []byte{0xc0, n, n, n, n, n, n, n} }
+
+	// the connection the token was issued for opens, and its retransmitted
+	// Initial stays on its flow
+	first := initialWithToken(cid(1), token, 1200)
+	for range 2 {
+		if err := lb.handlePacket(first, testAddr(1)); err != nil {
+			t.Fatalf("handlePacket(first) error = %v", err)
+		}
+	}
+	expect(t, fwd.opened)
+
+	// the token on another connection is a replay
+	err = lb.handlePacket(initialWithToken(cid(2), token, 1200), testAddr(2))
+	if !errors.Is(err, ErrRetryTokenReplayed) || dropReasonFor(err) != dropRetryToken {
+		t.Errorf("handlePacket(replay) error = %v, want %v", err, ErrRetryTokenReplayed)
+	}
+	// a token the backend issued is not the load balancer's to check
+	if err := lb.handlePacket(initialWithToken(cid(3), []byte{0xee, 0xee}, 1200), testAddr(3)); err != nil {
+		t.Errorf("handlePacket(backend token) error = %v", err)
+	}
+	if n := len(fwd.opened); n != 1 {
+		t.Errorf("opened %d more flows, want 1", n)
+	}
+}
+
+func TestRetryTokenConfig(t *testing.T) {
+	tests := []struct {
+		name    string
+		cfg     Config
+		wantErr error
+	}{
+		{name: "Defaults", cfg: Config{}},
+		{name: "Negative Lifetime", cfg: Config{RetryTokenLifetime: -time.Second}, wantErr: errRetryToken},
+		{name: "Negative Replay Cache", cfg: Config{RetryReplayCache: -1}, wantErr: errRetryToken},
+		{name: "Short Key", cfg: Config{RetryTokenKey: []byte("short")}, wantErr: errRetryToken},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := tt.cfg.retryTokens(drainingRetry); !errors.Is(err, tt.wantErr) {
+				t.Errorf("retryTokens() error = %v, want %v", err, tt.wantErr)
+			}
+		})
+	}
+	// only the retry draining policy issues tokens
+	if tokens, err := (&Config{RetryTokenLifetime: -1}).retryTokens(drainingFallback); tokens != nil || err != nil {
+		t.Errorf("retryTokens(fallback) = %v, %v, want none", tokens, err)
+	}
+}
+
+func TestRetryReplayCacheEvicts(t *testing.T) {
+	tokens, err := (&Config{RetryReplayCache: 2}).retryTokens(drainingRetry)
+	if err != nil {
+		t.Fatalf("retryTokens() error = %v", err)
+	}
+	for _, nonce := range []uint64{1, 2, 3} {
+		if !tokens.claim(nonce) {
+			t.Fatalf("claim(%d) = false, want a first claim", nonce)
+		}
+	}
+	// the oldest nonce was evicted to make room
+	if !tokens.claim(1) || tokens.claim(3) {
+		t.Error("after eviction claim(1) failed or claim(3) succeeded, want the oldest nonce forgotten")
+	}
+}
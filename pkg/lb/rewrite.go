@@ -0,0 +1,247 @@
+package lb
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+
+	"github.com/fqzz2000/QUIC-LB-SHRIMP/pkg/packet"
+	"github.com/fqzz2000/QUIC-LB-SHRIMP/pkg/quiclb"
+)
+
+// With Config.RewriteCIDs the LB manages connection IDs for backends that
+// cooperate with it: the DCID a client chose for its Initial and 0-RTT
+// packets is replaced before forwarding by an issued CID naming the flow's
+// backend, of the same length unless Config.RewriteCIDLength sets one, and a backend long header whose SCID is such a
+// CID has the client's original restored on the way back. The client only
+// ever sees its own CID, and the backend only ever sees LB-issued ones.
+// Because QUIC derives Initial keys from the client's DCID and covers the
+// Retry SCID with an integrity tag, the backend must be built for this mode.
+// An issued CID of another length than the client's resizes the datagram, so
+// only then is it copied; otherwise CIDs are rewritten in place.
+
+// minRewriteNonceLength is the fewest random bytes an issued CID of a
+// configured length must keep after its server ID, so the CIDs issued for
+// one backend stay distinct
+const minRewriteNonceLength = 4
+
+// errRewriteCIDLength is returned for an issued CID length the issuing
+// config cannot encode
+var errRewriteCIDLength = errors.New("invalid rewrite CID length")
+
+// rewriteCIDLength returns the configured issued CID length, zero for the
+// client's. It must hold the first octet (rotation and length), the issuing
+// config's server ID and a nonce, so it is checked once the routing table
+// has installed the default config.
+func (c *Config) rewriteCIDLength() (int, error) {
+	if c.RewriteCIDLength == 0 {
+		return 0, nil
+	}
+	if !c.RewriteCIDs {
+		return 0, fmt.Errorf("%w: set without RewriteCIDs", errRewriteCIDLength)
+	}
+	sidLength := c.QUICLB[c.issueRotation()].ServerIDLength
+	minLength := 1 + sidLength + minRewriteNonceLength
+	if c.RewriteCIDLength < minLength || c.RewriteCIDLength > packet.MaxCIDLength {
+		return 0, fmt.Errorf("%w: %d outside [%d, %d] for a %d byte server ID",
+			errRewriteCIDLength, c.RewriteCIDLength, minLength, packet.MaxCIDLength, sidLength)
+	}
+	return c.RewriteCIDLength, nil
+}
+
+// rewrittenCIDs maps the DCIDs a client chose to the issued CIDs its backend
+// sees, in both directions. Guarded by the flow's mutex.
+type rewrittenCIDs struct {
+	toBackend map[string][]byte
+	toClient  map[string][]byte
+}
+
+// backendCID returns the issued CID standing in for a client DCID. When there
+// is none yet and allocate is set, issue creates it; nil means forward verbatim.
+func (f *Flow) backendCID(dcid []byte, allocate bool, issue func() []byte) []byte {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if cid, ok := f.rewritten.toBackend[string(dcid)]; ok {
+		return cid
+	}
+	if !allocate {
+		return nil
+	}
+	cid := issue()
+	if cid == nil {
+		return nil
+	}
+	if f.rewritten.toBackend == nil {
+		f.rewritten.toBackend = make(map[string][]byte)
+		f.rewritten.toClient = make(map[string][]byte)
+	}
+	f.rewritten.toBackend[string(dcid)] = cid
+	f.rewritten.toClient[string(cid)] = append([]byte(nil), dcid...)
+	return cid
+}
+
+// clientCID returns the client DCID an issued CID stands in for, or nil
+func (f *Flow) clientCID(cid []byte) []byte {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.rewritten.toClient[string(cid)]
+}
+
+// cidEdit replaces the n CID bytes at off in a datagram with cid. A long
+// header's CID follows its length byte, which changes with it.
+type cidEdit struct {
+	off, n int
+	cid    []byte
+	long   bool
+}
+
+// applyCIDEdits makes edits, ordered by offset, to a datagram: in place when
+// every CID keeps its length, and otherwise in a resized copy it returns
+func applyCIDEdits(datagram []byte, edits []cidEdit) []byte {
+	grow, resized := 0, false
+	for _, e := range edits {
+		grow += len(e.cid) - e.n
+		resized = resized || len(e.cid) != e.n
+	}
+	if !resized {
+		for _, e := range edits {
+			copy(datagram[e.off:], e.cid)
+		}
+		return datagram
+	}
+	out := make([]byte, 0, len(datagram)+grow)
+	at := 0
+	for _, e := range edits {
+		if e.long {
+			out = append(out, datagram[at:e.off-1]...)
+			out = append(out, byte(len(e.cid)))
+		} else {
+			out = append(out, datagram[at:e.off]...)
+		}
+		out = append(out, e.cid...)
+		at = e.off + e.n
+	}
+	return append(out, datagram[at:]...)
+}
+
+// rewriteOutbound replaces the DCIDs of the packets coalesced in a client
+// datagram with the issued CIDs standing in for them, returning the
+// rewritten datagram. Only Initial and 0-RTT packets, whose DCID the client
+// chose, allocate a new mapping.
+func (lb *LoadBalancer) rewriteOutbound(flow *Flow, datagram []byte) []byte {
+	processor := lb.processor(flow.ln)
+	packets, _ := processor.SplitCoalesced(datagram)
+	var edits []cidEdit
+	off := 0
+	for _, p := range packets {
+		at := off
+		off += len(p)
+		var dcid []byte
+		allocate := false
+		if p[0]&0x80 == 0 {
+			var err error
+			if dcid, err = processor.ExtractCID(p); err != nil {
+				continue
+			}
+			at++
+		} else {
+			if len(p) < 6 || binary.BigEndian.Uint32(p[1:5]) == 0 || len(p) < 6+int(p[5]) {
+				continue
+			}
+			dcid = p[6 : 6+p[5]]
+			ptype := packet.LongPacketType(binary.BigEndian.Uint32(p[1:5]), p[0])
+			allocate = ptype == packet.Initial || ptype == packet.ZeroRTT
+			at += 6
+		}
+		if len(dcid) == 0 {
+			continue
+		}
+		length := lb.rewriteLength
+		if length == 0 {
+			length = len(dcid)
+		}
+		if cid := flow.backendCID(dcid, allocate, func() []byte { return lb.issueFor(flow.Backend, length) }); cid != nil {
+			edits = append(edits, cidEdit{off: at, n: len(dcid), cid: cid, long: p[0]&0x80 != 0})
+		}
+	}
+	return applyCIDEdits(datagram, edits)
+}
+
+// rewriteInbound restores the client's CID in the SCID of backend long
+// headers that carry an issued CID standing in for it, returning the
+// rewritten datagram
+func (lb *LoadBalancer) rewriteInbound(flow *Flow, datagram []byte) []byte {
+	packets, _ := lb.processor(flow.ln).SplitCoalesced(datagram)
+	var edits []cidEdit
+	off := 0
+	for _, p := range packets {
+		at := off
+		off += len(p)
+		if p[0]&0x80 == 0 || len(p) < 7+int(p[5]) {
+			continue
+		}
+		scidAt := 7 + int(p[5])
+		if len(p) < scidAt+int(p[scidAt-1]) {
+			continue
+		}
+		scid := p[scidAt : scidAt+int(p[scidAt-1])]
+		if orig := flow.clientCID(scid); orig != nil {
+			edits = append(edits, cidEdit{off: at + scidAt, n: len(scid), cid: orig, long: true})
+		}
+	}
+	return applyCIDEdits(datagram, edits)
+}
+
+// issueFor encodes an issued CID of the given length naming the backend at
+// addr, or returns nil when that is impossible (the length cannot hold the
+// server ID, or the backend's index does not fit it)
+func (lb *LoadBalancer) issueFor(addr string, length int) []byte {
+	rt := lb.routes()
+	cfg, _ := rt.codec.Config(rt.issueRotation)
+	serverID, ok := rt.serverIDFor(addr, cfg.ServerIDLength)
+	if !ok {
+		return nil
+	}
+	format := quiclb.IssuedCIDFormat{ServerIDLength: cfg.ServerIDLength}
+	cid, err := format.Encode(rt.issueRotation, serverID, nil, length)
+	if err != nil {
+		return nil
+	}
+	return cid
+}
+
+// serverIDFor returns a server ID of n bytes naming the backend at addr in
+// CIDs the LB issues, those of the issue rotation
+func (rt *routingTable) serverIDFor(addr string, n int) ([]byte, bool) {
+	return rt.serverIDAt(rt.issueRotation, addr, n)
+}
+
+// serverIDAt returns a server ID of n bytes naming the backend at addr in
+// CIDs of the given rotation: the first of its ServerIDs with that length,
+// always so under a ServerIDResolver, or without an explicit mapping its
+// index in the rotation's pool as a big-endian number, the inverse of
+// serverIndex
+func (rt *routingTable) serverIDAt(rotation uint8, addr string, n int) ([]byte, bool) {
+	for i, b := range rt.backends {
+		if b.Address != addr {
+			continue
+		}
+		if rt.truncated != nil {
+			return rt.truncated.serverID(i, n)
+		}
+		if rt.serverIDs != nil || rt.resolver != nil {
+			for _, id := range b.ServerIDs {
+				if len(id) == n {
+					return id, true
+				}
+			}
+			return nil, false
+		}
+		j, ok := rt.pools.poolIndex(rotation, i)
+		if !ok {
+			return nil, false
+		}
+		return indexServerID(j, n)
+	}
+	return nil, false
+}
@@ -0,0 +1,212 @@
+package lb
+
+import (
+	"bytes"
+	"errors"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/fqzz2000/QUIC-LB-SHRIMP/pkg/packet"
+	"github.com/fqzz2000/QUIC-LB-SHRIMP/pkg/quiclb"
+)
+
+// quicLongHeader builds a long-header packet with a Length field covering
+// payload, so it splits cleanly out of a datagram
+func quicLongHeader(ptype packet.PacketType, dcid, scid, payload []byte) []byte {
+	pkt := []byte{0xc0 | byte(ptype)<<4, 0x00, 0x00, 0x00, 0x01, byte(len(dcid))}
+	pkt = append(pkt, dcid...)
+	pkt = append(pkt, byte(len(scid)))
+	pkt = append(pkt, scid...)
+	if ptype == packet.Initial {
+		pkt = append(pkt, 0x00) // empty token
+	}
+	pkt = append(pkt, 0x40|byte(len(payload)>>8), byte(len(payload)))
+	return append(pkt, payload...)
+}
+
+// startCIDManagedBackend answers each datagram as a backend cooperating with
+// LB CID management would: a Handshake packet whose SCID is the DCID it was
+// sent. The DCIDs it receives are reported on the returned channel.
+func startCIDManagedBackend(t *testing.T) (string, <-chan []byte) {
+	t.Helper()
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("ListenPacket() error = %v", err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	seen := make(chan []byte, 16)
+	go func() {
+		buf := make([]byte, maxPacketSize)
+		for {
+			_, addr, err := conn.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			var dcid []byte
+			if buf[0]&0x80 != 0 {
+				dcid = append(dcid, buf[6:6+buf[5]]...)
+				scid := buf[7+buf[5] : 7+int(buf[5])+int(buf[6+buf[5]])]
+				conn.WriteTo(quicLongHeader(packet.HandShake, scid, dcid, make([]byte, 32)), addr)
+			} else {
+				// issued CIDs encode their own length
+				length := quiclb.IssuedCIDFormat{}.Length(buf[1])
+				dcid = append(dcid, buf[1:1+length]...)
+			}
+			seen <- dcid
+		}
+	}()
+	return conn.LocalAddr().String(), seen
+}
+
+func TestRewriteCIDsRoundTrip(t *testing.T) {
+	backend, seen := startCIDManagedBackend(t)
+	lb := startTestLB(t, Config{
+		Backends:    StaticBackends(backend),
+		RewriteCIDs: true,
+	})
+	client := newTestClient(t)
+
+	original := []byte{0x00, 0x11, 0x22, 0x33, 0x44, 0x55, 0x66, 0x77}
+	clientSCID := []byte{0xc1, 0xc2, 0xc3, 0xc4}
+	client.WriteTo(quicLongHeader(packet.Initial, original, clientSCID, make([]byte, 1200)), lb.Addr())
+
+	var backendCID []byte
+	select {
+	case backendCID = <-seen:
+	case <-time.After(time.Second):
+		t.Fatalf("backend received nothing")
+	}
+	if bytes.Equal(backendCID, original) {
+		t.Fatalf("backend saw the client's DCID %x, want it rewritten", backendCID)
+	}
+	decoded, n, err := quiclb.IssuedCIDFormat{ServerIDLength: 1}.Decode(backendCID)
+	if err != nil || n != len(original) || !bytes.Equal(decoded.ServerID, []byte{0}) {
+		t.Errorf("backend CID %x decodes to %+v, %d, %v, want server ID 00 and length %d", backendCID, decoded, n, err, len(original))
+	}
+
+	resp := readWithin(t, client, time.Second)
+	if resp == nil {
+		t.Fatalf("client got no response")
+	}
+	scid := resp[7+resp[5] : 7+int(resp[5])+int(resp[6+resp[5]])]
+	if !bytes.Equal(scid, original) {
+		t.Errorf("response SCID = %x, want the client's original %x", scid, original)
+	}
+
+	// 1-RTT packets to the CID the client now believes is the server's
+	// reach the backend under the issued CID
+	client.WriteTo(append([]byte{0x40}, append(original, make([]byte, 32)...)...), lb.Addr())
+	select {
+	case got := <-seen:
+		if !bytes.Equal(got, backendCID) {
+			t.Errorf("short header reached the backend with DCID %x, want %x", got, backendCID)
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("short header did not reach the backend")
+	}
+}
+
+func TestRewriteCIDLength(t *testing.T) {
+	original := []byte{0x00, 0x11, 0x22, 0x33, 0x44, 0x55, 0x66, 0x77}
+	for _, length := range []int{6, 12, 20} {
+		backend, seen := startCIDManagedBackend(t)
+		lb := startTestLB(t, Config{
+			Backends:         StaticBackends(backend),
+			RewriteCIDs:      true,
+			RewriteCIDLength: length,
+		})
+		client := newTestClient(t)
+		// an Initial coalesced with a 0-RTT packet, both to the client's DCID
+		clientSCID := []byte{0xc1, 0xc2, 0xc3, 0xc4}
+		datagram := append(quicLongHeader(packet.Initial, original, clientSCID, make([]byte, 1200)),
+			quicLongHeader(packet.ZeroRTT, original, clientSCID, make([]byte, 64))...)
+		client.WriteTo(datagram, lb.Addr())
+
+		var backendCID []byte
+		select {
+		case backendCID = <-seen:
+		case <-time.After(time.Second):
+			t.Fatalf("backend received nothing")
+		}
+		decoded, n, err := quiclb.IssuedCIDFormat{ServerIDLength: 1}.Decode(backendCID)
+		if err != nil || n != length || !bytes.Equal(decoded.ServerID, []byte{0}) {
+			t.Errorf("backend CID %x decodes to %+v, %d, %v, want server ID 00 and length %d", backendCID, decoded, n, err, length)
+		}
+
+		resp := readWithin(t, client, time.Second)
+		if resp == nil {
+			t.Fatalf("client got no response")
+		}
+		header, err := (&packet.PacketProcessor{}).ParsePacket(resp)
+		if err != nil {
+			t.Fatalf("response does not parse: %v", err)
+		}
+		if lh := header.(*packet.LongHeader); !bytes.Equal(lh.SCID, original) || !bytes.Equal(lh.DCID, clientSCID) {
+			t.Errorf("response SCID, DCID = %x, %x, want the client's %x, %x", lh.SCID, lh.DCID, original, clientSCID)
+		}
+
+		client.WriteTo(append([]byte{0x40}, append(original, make([]byte, 32)...)...), lb.Addr())
+		select {
+		case got := <-seen:
+			if !bytes.Equal(got, backendCID) {
+				t.Errorf("short header reached the backend with DCID %x, want %x", got, backendCID)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("short header did not reach the backend")
+		}
+	}
+}
+
+func TestRewriteCoalescedResized(t *testing.T) {
+	// every packet of a coalesced datagram moves to the longer issued CID
+	lb, err := NewLoadBalancer(Config{Backends: StaticBackends("192.0.2.1:443"), RewriteCIDs: true, RewriteCIDLength: 12})
+	if err != nil {
+		t.Fatalf("NewLoadBalancer() error = %v", err)
+	}
+	original := []byte{0x00, 0x11, 0x22, 0x33, 0x44, 0x55, 0x66, 0x77}
+	datagram := append(quicLongHeader(packet.Initial, original, []byte{0xc1}, make([]byte, 1200)),
+		quicLongHeader(packet.ZeroRTT, original, []byte{0xc1}, make([]byte, 64))...)
+	sent := append([]byte(nil), datagram...)
+	out := lb.rewriteOutbound(&Flow{Backend: "192.0.2.1:443"}, datagram)
+	if !bytes.Equal(datagram, sent) || len(out) != len(sent)+2*4 {
+		t.Fatalf("rewritten datagram is %d bytes, want a %d byte copy", len(out), len(sent)+2*4)
+	}
+	packets, err := lb.routes().packetProcessor.SplitCoalesced(out)
+	if err != nil || len(packets) != 2 {
+		t.Fatalf("SplitCoalesced() = %d packets, %v, want 2", len(packets), err)
+	}
+	for i, p := range packets {
+		if dcid := p[6 : 6+p[5]]; len(dcid) != 12 || !bytes.Equal(dcid, packets[0][6:18]) {
+			t.Errorf("packet %d DCID = %x, want the packets' shared 12 byte issued CID", i, dcid)
+		}
+	}
+}
+
+func TestRewriteCIDLengthConfig(t *testing.T) {
+	tests := []struct {
+		name    string
+		cfg     Config
+		wantErr error
+	}{
+		{name: "Unset", cfg: Config{}},
+		{name: "Fits", cfg: Config{RewriteCIDs: true, RewriteCIDLength: 6}},
+		{name: "Maximum", cfg: Config{RewriteCIDs: true, RewriteCIDLength: packet.MaxCIDLength}},
+		{name: "Without Rewrite", cfg: Config{RewriteCIDLength: 8}, wantErr: errRewriteCIDLength},
+		{name: "No Room For Nonce", cfg: Config{RewriteCIDs: true, RewriteCIDLength: 5}, wantErr: errRewriteCIDLength},
+		{name: "Too Long", cfg: Config{RewriteCIDs: true, RewriteCIDLength: packet.MaxCIDLength + 1}, wantErr: errRewriteCIDLength},
+		{name: "Wide Server ID", cfg: Config{
+			RewriteCIDs:      true,
+			RewriteCIDLength: 8,
+			QUICLB:           [quiclb.NumConfigs]quiclb.ConfigEntry{1: {Algorithm: quiclb.Plaintext, ServerIDLength: 4, NonceLength: 4}},
+		}, wantErr: errRewriteCIDLength},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tt.cfg.Backends = StaticBackends("192.0.2.1:443")
+			if _, err := NewLoadBalancer(tt.cfg); !errors.Is(err, tt.wantErr) {
+				t.Errorf("NewLoadBalancer() error = %v, want %v", err, tt.wantErr)
+			}
+		})
+	}
+}
@@ -0,0 +1,74 @@
+package lb
+
+import (
+	"hash/fnv"
+	"sort"
+	"strconv"
+)
+
+// vnodesPerWeight is the number of ring positions given to each unit of backend weight
+const vnodesPerWeight = 100
+
+// ringNode is one virtual node on the consistent-hash ring
+type ringNode struct {
+	pos     uint64
+	backend int // index into hashRing.backends
+}
+
+// hashRing is an immutable weighted consistent-hash ring used for fallback
+// routing; updates build a new ring and swap it in
+type hashRing struct {
+	nodes    []ringNode
+	backends []BackendConfig
+	seed     uint64
+}
+
+// newHashRing places weight*vnodesPerWeight virtual nodes for every backend,
+// hashing node names and keys with seed
+func newHashRing(backends []BackendConfig, seed uint64) *hashRing {
+	r := &hashRing{backends: backends, seed: seed}
+	for i, b := range backends {
+		for v := 0; v < b.weight()*vnodesPerWeight; v++ {
+			r.nodes = append(r.nodes, ringNode{pos: hashKey(seed, []byte(b.Address+"#"+strconv.Itoa(v))), backend: i})
+		}
+	}
+	sort.Slice(r.nodes, func(i, j int) bool { return r.nodes[i].pos < r.nodes[j].pos })
+	return r
+}
+
+// hashKey hashes a routing key onto the ring. The seed enters before the
+// final mix, which is non-linear, so rings with different seeds order nodes
+// and keys independently; seed zero is the unseeded hash.
+func hashKey(seed uint64, key []byte) uint64 {
+	h := fnv.New64a()
+	h.Write(key)
+	// fnv alone clusters similar keys; a final mix spreads them over the ring
+	x := h.Sum64() ^ seed
+	x ^= x >> 33
+	x *= 0xff51afd7ed558ccd
+	x ^= x >> 33
+	return x
+}
+
+// lookup returns the backend owning the first virtual node at or after the key's hash
+func (r *hashRing) lookup(key []byte) (BackendConfig, bool) {
+	return r.lookupAvoiding(key, nil)
+}
+
+// lookupAvoiding is lookup that walks past the nodes of backends for which
+// avoid returns true, so keys owned by a down backend spread over its
+// neighbours while every other key keeps its backend
+func (r *hashRing) lookupAvoiding(key []byte, avoid func(addr string) bool) (BackendConfig, bool) {
+	if len(r.nodes) == 0 {
+		return BackendConfig{}, false
+	}
+	pos := hashKey(r.seed, key)
+	start := sort.Search(len(r.nodes), func(i int) bool { return r.nodes[i].pos >= pos })
+	for n := 0; n < len(r.nodes); n++ {
+		b := r.backends[r.nodes[(start+n)%len(r.nodes)].backend]
+		if avoid == nil || !avoid(b.Address) {
+			return b, true
+		}
+	}
+	return BackendConfig{}, false
+}
@@ -0,0 +1,88 @@
+package lb
+
+import (
+	"fmt"
+	"testing"
+)
+
+func TestHashRingWeightedSpread(t *testing.T) {
+	ring := newHashRing([]BackendConfig{
+		{Address: "10.0.0.1:443", Weight: 1},
+		{Address: "10.0.0.2:443", Weight: 3},
+	}, 0)
+
+	counts := map[string]int{}
+	for i := 0; i < 10000; i++ {
+		key := []byte(fmt.Sprintf("192.0.2.%d:%d", i%250, 1024+i))
+		b, ok := ring.lookup(key)
+		if !ok {
+			t.Fatalf("lookup() on non-empty ring returned false")
+		}
+		again, _ := ring.lookup(key)
+		if again.Address != b.Address {
+			t.Fatalf("lookup(%s) not stable: %s then %s", key, b.Address, again.Address)
+		}
+		counts[b.Address]++
+	}
+
+	share := float64(counts["10.0.0.2:443"]) / 10000
+	if share < 0.65 || share > 0.85 {
+		t.Errorf("weight-3 backend received %.2f of keys, want about 0.75", share)
+	}
+}
+
+func TestHashRingEmpty(t *testing.T) {
+	if _, ok := newHashRing(nil, 0).lookup([]byte("key")); ok {
+		t.Errorf("lookup() on empty ring returned true")
+	}
+}
+
+func TestHashRingLookupAvoiding(t *testing.T) {
+	ring := newHashRing(StaticBackends("10.0.0.1:443", "10.0.0.2:443", "10.0.0.3:443"), 0)
+	down := func(addr string) bool { return addr == "10.0.0.2:443" }
+
+	for i := 0; i < 1000; i++ {
+		key := []byte(fmt.Sprint(i))
+		before, _ := ring.lookup(key)
+		after, ok := ring.lookupAvoiding(key, down)
+		if !ok || after.Address == "10.0.0.2:443" {
+			t.Fatalf("key %d routed to %q with that backend down", i, after.Address)
+		}
+		// keys of healthy backends do not move
+		if before.Address != "10.0.0.2:443" && after.Address != before.Address {
+			t.Errorf("key %d moved from %q to %q", i, before.Address, after.Address)
+		}
+	}
+
+	if _, ok := ring.lookupAvoiding([]byte("x"), func(string) bool { return true }); ok {
+		t.Errorf("lookupAvoiding() found a backend with every backend down")
+	}
+}
+
+func TestHashRingSeed(t *testing.T) {
+	backends := StaticBackends("10.0.0.1:443", "10.0.0.2:443", "10.0.0.3:443", "10.0.0.4:443")
+	mapping := func(seed uint64) []string {
+		ring := newHashRing(backends, seed)
+		out := make([]string, 1000)
+		for i := range out {
+			b, _ := ring.lookup([]byte(fmt.Sprintf("192.0.2.%d:%d", i%250, 1024+i)))
+			out[i] = b.Address
+		}
+		return out
+	}
+
+	a, again, b := mapping(1), mapping(1), mapping(2)
+	moved := 0
+	for i := range a {
+		if a[i] != again[i] {
+			t.Fatalf("key %d maps to %q and %q under the same seed", i, a[i], again[i])
+		}
+		if a[i] != b[i] {
+			moved++
+		}
+	}
+	// independent rings over four backends agree on about a quarter of keys
+	if moved < 600 {
+		t.Errorf("%d of 1000 keys map differently under another seed, want about 750", moved)
+	}
+}
@@ -0,0 +1,77 @@
+package lb
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/fqzz2000/QUIC-LB-SHRIMP/pkg/quiclb"
+)
+
+// Rotation policies (Config.RotationPolicies) lock down which config
+// rotation codepoints are valid in a deployment, such as codepoint 3, which
+// some QUIC-LB drafts reserve for CIDs that must not be routed. A CID whose
+// first two bits pick a codepoint set to "decode", the default, is decoded
+// as usual. "fallback" skips the decode and routes the CID as one that does
+// not decode, and "drop" discards the packet. The exception is the DCID of
+// an Initial or 0-RTT packet, which the client chose at random: its bits
+// mean nothing, so under "drop" it is routed as under "fallback", and new
+// connections are never refused for it. Only codepoints without an active
+// config take a policy other than "decode". Packets of open flows are
+// found by the session lookup first and never reach a policy.
+const (
+	rotationDecode   = "decode"
+	rotationFallback = "fallback"
+	rotationDrop     = "drop"
+)
+
+var (
+	// errRotationPolicy is returned for an invalid Config.RotationPolicies
+	errRotationPolicy = errors.New("invalid rotation policy")
+	// errRotationDropped is returned for a CID whose codepoint's policy drops it
+	errRotationDropped = errors.New("rotation codepoint dropped by policy")
+	// errRotationNotDecoded stands in for the decode a fallback policy skips
+	errRotationNotDecoded = errors.New("rotation codepoint not decoded by policy")
+)
+
+// rotationPolicies returns the policy of each codepoint. It is checked once
+// the routing table has installed the default config.
+func (c *Config) rotationPolicies() ([quiclb.NumConfigs]string, error) {
+	var policies [quiclb.NumConfigs]string
+	for rotation, p := range c.RotationPolicies {
+		switch p {
+		case "", rotationDecode:
+			policies[rotation] = rotationDecode
+			continue
+		case rotationFallback, rotationDrop:
+		default:
+			return policies, fmt.Errorf("%w: %q for codepoint %d", errRotationPolicy, p, rotation)
+		}
+		if c.QUICLB[rotation].Active() {
+			return policies, fmt.Errorf("%w: codepoint %d has an active config and must decode", errRotationPolicy, rotation)
+		}
+		policies[rotation] = p
+	}
+	return policies, nil
+}
+
+// applyRotationPolicy returns the error standing in for the decode of a CID
+// whose codepoint's policy is not to decode it, counting the action, or nil
+// to decode it
+func (lb *LoadBalancer) applyRotationPolicy(cid []byte, miss routeMiss) error {
+	if len(cid) == 0 {
+		return nil
+	}
+	rotation := cid[0] >> 6
+	switch lb.codepoints[rotation] {
+	case rotationDrop:
+		if miss != missNewFlow {
+			lb.metrics.rotationDrops[rotation].Inc()
+			return fmt.Errorf("%w: %d", errRotationDropped, rotation)
+		}
+	case rotationFallback:
+	default:
+		return nil
+	}
+	lb.metrics.rotationFallbacks[rotation].Inc()
+	return fmt.Errorf("%w: %d", errRotationNotDecoded, rotation)
+}
@@ -0,0 +1,102 @@
+package lb
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/fqzz2000/QUIC-LB-SHRIMP/pkg/packet"
+	"github.com/fqzz2000/QUIC-LB-SHRIMP/pkg/quiclb"
+)
+
+func TestRotationPolicies(t *testing.T) {
+	lb, err := NewLoadBalancer(Config{
+		Backends:         StaticBackends("backend0", "backend1", "backend2"),
+		RotationPolicies: [quiclb.NumConfigs]string{2: rotationFallback, 3: rotationDrop},
+	})
+	if err != nil {
+		t.Fatalf("NewLoadBalancer() error = %v", err)
+	}
+	cid, err := lb.routes().codec.Encode(0, []byte{0x02}, []byte{0x10, 0x11, 0x12, 0x13, 0x14, 0x15})
+	if err != nil {
+		t.Fatalf("Encode() error = %v", err)
+	}
+	// atCodepoint returns the CID with its rotation bits set to rotation
+	atCodepoint := func(rotation uint8) []byte {
+		c := append([]byte(nil), cid...)
+		c[0] = rotation<<6 | c[0]&0x3f
+		return c
+	}
+
+	tests := []struct {
+		name         string
+		rotation     uint8
+		ptype        packet.PacketType
+		wantErr      error
+		wantRoute    Route
+		wantFailures uint64 // decode failures counted
+		wantDrops    uint64 // drops counted against the codepoint
+		wantFalls    uint64 // fallbacks counted against the codepoint
+	}{
+		{name: "Active Codepoint Decodes", rotation: 0, ptype: packet.OneRTT, wantRoute: RouteCID},
+		{name: "Default Policy Decodes", rotation: 1, ptype: packet.OneRTT, wantRoute: RouteFallback, wantFailures: 1},
+		{name: "Fallback", rotation: 2, ptype: packet.OneRTT, wantRoute: RouteFallback, wantFalls: 1},
+		{name: "Fallback Handshake", rotation: 2, ptype: packet.HandShake, wantRoute: RouteFallback, wantFalls: 1},
+		{name: "Drop", rotation: 3, ptype: packet.OneRTT, wantErr: errRotationDropped, wantDrops: 1},
+		{name: "Drop Handshake", rotation: 3, ptype: packet.HandShake, wantErr: errRotationDropped, wantDrops: 1},
+		// the client chose the DCID of its Initial at random, so its bits mean nothing
+		{name: "Drop Spares Initial", rotation: 3, ptype: packet.Initial, wantRoute: RouteFallback, wantFalls: 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dcid := atCodepoint(tt.rotation)
+			pkt := append([]byte{0x40}, dcid...)
+			if tt.ptype != packet.OneRTT {
+				pkt = longHeaderPacket(tt.ptype, dcid, 1200)
+			}
+			failures := lb.Stats().DecodeFailures
+			drops := lb.metrics.rotationDrops[tt.rotation].Value()
+			falls := lb.metrics.rotationFallbacks[tt.rotation].Value()
+
+			res, err := lb.DecodePacket(pkt, testAddr(1))
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("DecodePacket() error = %v, want %v", err, tt.wantErr)
+			}
+			if tt.wantErr == nil && res.Route != tt.wantRoute {
+				t.Errorf("DecodePacket() route = %s, want %s", res.Route, tt.wantRoute)
+			}
+			if got := lb.Stats().DecodeFailures - failures; got != tt.wantFailures {
+				t.Errorf("DecodeFailures = %d, want %d", got, tt.wantFailures)
+			}
+			if got := lb.metrics.rotationDrops[tt.rotation].Value() - drops; got != tt.wantDrops {
+				t.Errorf("codepoint %d drops = %d, want %d", tt.rotation, got, tt.wantDrops)
+			}
+			if got := lb.metrics.rotationFallbacks[tt.rotation].Value() - falls; got != tt.wantFalls {
+				t.Errorf("codepoint %d fallbacks = %d, want %d", tt.rotation, got, tt.wantFalls)
+			}
+		})
+	}
+	if reason := dropReasonFor(errRotationDropped); reason != dropRotationPolicy {
+		t.Errorf("dropReasonFor(errRotationDropped) = %s, want %s", dropReasonNames[reason], dropReasonNames[dropRotationPolicy])
+	}
+}
+
+func TestRotationPoliciesConfig(t *testing.T) {
+	tests := []struct {
+		name     string
+		policies [quiclb.NumConfigs]string
+		wantErr  error
+	}{
+		{name: "Defaults"},
+		{name: "Every Policy", policies: [quiclb.NumConfigs]string{rotationDecode, rotationDecode, rotationFallback, rotationDrop}},
+		{name: "Unknown Policy", policies: [quiclb.NumConfigs]string{3: "reject"}, wantErr: errRotationPolicy},
+		{name: "Active Codepoint", policies: [quiclb.NumConfigs]string{0: rotationDrop}, wantErr: errRotationPolicy},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := NewLoadBalancer(Config{Backends: StaticBackends("backend0"), RotationPolicies: tt.policies})
+			if !errors.Is(err, tt.wantErr) {
+				t.Errorf("NewLoadBalancer() error = %v, want %v", err, tt.wantErr)
+			}
+		})
+	}
+}
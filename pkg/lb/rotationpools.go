@@ -0,0 +1,90 @@
+package lb
+
+import (
+	"fmt"
+	"slices"
+
+	"github.com/fqzz2000/QUIC-LB-SHRIMP/pkg/quiclb"
+)
+
+// Rotation pools (Config.RotationBackends) let the configs at different
+// rotation codepoints front different backend fleets, as while migrating
+// from one fleet to another: a CID's rotation bits pick the pool its server
+// ID indexes into as well as the config it decodes with, so the same server
+// ID can name a different backend at each codepoint. A codepoint without a
+// pool indexes every backend. Pools work in index mode only, and each must
+// fit the server ID space of its codepoint's config. Backends added at
+// runtime belong to no pool, so they cannot be added while pools are set.
+
+// rotationPools holds each codepoint's pool as indexes into the backends,
+// nil for a codepoint indexing all of them
+type rotationPools [quiclb.NumConfigs][]int
+
+// newRotationPools resolves cfg.RotationBackends against the backends.
+// mapped reports whether server IDs are mapped explicitly or truncated,
+// which pools cannot be combined with.
+func newRotationPools(cfg *Config, mapped bool) (rotationPools, error) {
+	var pools rotationPools
+	for r, addrs := range cfg.RotationBackends {
+		if len(addrs) == 0 {
+			continue
+		}
+		if mapped {
+			return pools, fmt.Errorf("%w: RotationBackends needs backends mapped by index", errBadServerIDs)
+		}
+		entry := cfg.QUICLB[r]
+		if !entry.Active() {
+			return pools, fmt.Errorf("%w: RotationBackends for inactive codepoint %d", errBadServerIDs, r)
+		}
+		pool := make([]int, 0, len(addrs))
+		for _, addr := range addrs {
+			i := slices.IndexFunc(cfg.Backends, func(b BackendConfig) bool { return b.Address == addr })
+			if i < 0 {
+				return pools, fmt.Errorf("%w: codepoint %d pool backend %q is not configured", errBadServerIDs, r, addr)
+			}
+			if slices.Contains(pool, i) {
+				return pools, fmt.Errorf("%w: codepoint %d pool lists %s twice", errBadServerIDs, r, addr)
+			}
+			pool = append(pool, i)
+		}
+		if _, ok := indexServerID(len(pool)-1, entry.ServerIDLength); !ok {
+			return pools, fmt.Errorf("%w: codepoint %d pool of %d backends exceeds its %d byte server IDs", errBadServerIDs, r, len(pool), entry.ServerIDLength)
+		}
+		pools[r] = pool
+	}
+	return pools, nil
+}
+
+// pooled reports whether any codepoint has a pool
+func (p *rotationPools) pooled() bool {
+	for _, pool := range p {
+		if pool != nil {
+			return true
+		}
+	}
+	return false
+}
+
+// backendIndex maps a server ID's index at rotation to an index into the
+// backends, reporting false when the rotation's pool has no such entry
+func (p *rotationPools) backendIndex(rotation uint8, idx uint64) (uint64, bool) {
+	pool := p[rotation%quiclb.NumConfigs]
+	if pool == nil {
+		return idx, true
+	}
+	if idx >= uint64(len(pool)) {
+		return 0, false
+	}
+	return uint64(pool[idx]), true
+}
+
+// poolIndex returns the server ID index naming backend i at rotation,
+// reporting false when the rotation's pool lacks it
+func (p *rotationPools) poolIndex(rotation uint8, i int) (int, bool) {
+	pool := p[rotation%quiclb.NumConfigs]
+	if pool == nil {
+		return i, true
+	}
+	j := slices.Index(pool, i)
+	return j, j >= 0
+}
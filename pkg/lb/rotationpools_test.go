@@ -0,0 +1,104 @@
+package lb
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"testing"
+
+	"github.com/fqzz2000/QUIC-LB-SHRIMP/pkg/quiclb"
+)
+
+// twoFleetConfig fronts an old fleet at codepoint 0 and a new one at 1
+func twoFleetConfig() Config {
+	plaintext := quiclb.ConfigEntry{Algorithm: quiclb.Plaintext, ServerIDLength: 1, NonceLength: 6}
+	return Config{
+		Backends: StaticBackends("old0:443", "old1:443", "new0:443", "new1:443"),
+		QUICLB:   [quiclb.NumConfigs]quiclb.ConfigEntry{plaintext, plaintext},
+		RotationBackends: [quiclb.NumConfigs][]string{
+			{"old0:443", "old1:443"},
+			{"new0:443", "new1:443"},
+		},
+	}
+}
+
+func TestRotationPools(t *testing.T) {
+	lb, err := NewLoadBalancer(twoFleetConfig())
+	if err != nil {
+		t.Fatalf("NewLoadBalancer() error = %v", err)
+	}
+	tests := []struct {
+		name     string
+		rotation uint8
+		serverID byte
+		want     string
+		wantErr  error
+	}{
+		{name: "Old Fleet", rotation: 0, serverID: 0x01, want: "old1:443"},
+		{name: "New Fleet", rotation: 1, serverID: 0x01, want: "new1:443"},
+		{name: "New Fleet First", rotation: 1, serverID: 0x00, want: "new0:443"},
+		// index 2 would be new0 across all backends, but is past the old pool
+		{name: "Past Pool", rotation: 0, serverID: 0x02, wantErr: ErrUnknownServerID},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cid, err := lb.routes().codec.Encode(tt.rotation, []byte{tt.serverID}, nil)
+			if err != nil {
+				t.Fatalf("Encode() error = %v", err)
+			}
+			backend, err := lb.routeCID(cid)
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("routeCID() error = %v, want %v", err, tt.wantErr)
+			}
+			if backend.Address != tt.want {
+				t.Errorf("routeCID() = %q, want %q", backend.Address, tt.want)
+			}
+		})
+	}
+
+	// CIDs the LB issues use codepoint 0, so only the old fleet has server IDs
+	if id, ok := lb.routes().serverIDFor("old1:443", 1); !ok || !bytes.Equal(id, []byte{0x01}) {
+		t.Errorf("serverIDFor(old1) = %x, %v, want 01", id, ok)
+	}
+	if _, ok := lb.routes().serverIDFor("new0:443", 1); ok {
+		t.Error("serverIDFor(new0) ok, want none outside the issue pool")
+	}
+	if _, err := lb.AddBackend(BackendConfig{Address: "new2:443"}); !errors.Is(err, errBadBackend) {
+		t.Errorf("AddBackend() error = %v, want %v", err, errBadBackend)
+	}
+}
+
+func TestRotationPoolsConfig(t *testing.T) {
+	tests := []struct {
+		name   string
+		modify func(cfg *Config)
+	}{
+		{name: "Unknown Backend", modify: func(cfg *Config) { cfg.RotationBackends[1] = []string{"new9:443"} }},
+		{name: "Listed Twice", modify: func(cfg *Config) { cfg.RotationBackends[1] = []string{"new0:443", "new0:443"} }},
+		{name: "Inactive Codepoint", modify: func(cfg *Config) { cfg.RotationBackends[2] = []string{"new0:443"} }},
+		{name: "Explicit Server IDs", modify: func(cfg *Config) {
+			for i := range cfg.Backends {
+				cfg.Backends[i].ServerIDs = [][]byte{{byte(i)}}
+			}
+			cfg.DefaultBackend = "old0:443"
+		}},
+		{name: "Exceeds Server ID Space", modify: func(cfg *Config) {
+			// 257 backends cannot all be named by one byte
+			pool := make([]string, 257)
+			for i := range pool {
+				pool[i] = fmt.Sprintf("10.0.%d.%d:443", i/256, i%256)
+				cfg.Backends = append(cfg.Backends, BackendConfig{Address: pool[i]})
+			}
+			cfg.RotationBackends[1] = pool
+		}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := twoFleetConfig()
+			tt.modify(&cfg)
+			if _, err := NewLoadBalancer(cfg); !errors.Is(err, errBadServerIDs) {
+				t.Errorf("NewLoadBalancer() error = %v, want %v", err, errBadServerIDs)
+			}
+		})
+	}
+}
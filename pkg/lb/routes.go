@@ -0,0 +1,137 @@
+package lb
+
+import (
+	"fmt"
+
+	"github.com/fqzz2000/QUIC-LB-SHRIMP/pkg/metrics"
+	"github.com/fqzz2000/QUIC-LB-SHRIMP/pkg/packet"
+	"github.com/fqzz2000/QUIC-LB-SHRIMP/pkg/quiclb"
+)
+
+// routingTable is everything a packet is routed with: the backends, how
+// server IDs map to them, the QUIC-LB configs and the header parsing they
+// imply, the strategies and the ring. A published table is never modified;
+// changes copy it and swap the copy in whole, so a packet routed while a
+// change lands sees the old table or the new one and never a mix.
+type routingTable struct {
+	backends        []BackendConfig
+	serverIDs       *serverIDMap  // nil maps server IDs by index
+	truncated       *truncatedIDs // nil unless server IDs are truncated
+	pools           rotationPools
+	defaultBackend  string
+	codec           *quiclb.Codec
+	packetProcessor *packet.PacketProcessor
+	issueRotation   uint8        // config used for CIDs the LB issues
+	strategy        Strategy     // nil routes by QUIC-LB decode
+	fallback        Strategy     // nil hashes the client address
+	tokens          TokenDecoder // nil routes Initials by their CID alone
+	resolver        ServerIDResolver
+	ring            *hashRing
+	decodeLatency   [quiclb.NumConfigs]*metrics.Histogram // by rotation codepoint, see observeDecode
+	sidLengths      [packet.MaxCIDLength]*metrics.Counter // decodes by server ID length, see countServerIDLength
+}
+
+// newRoutingTable validates the routing settings of cfg and builds a table
+// of them without a ring. When no QUIC-LB config is active a plaintext
+// default is installed at rotation 0.
+func newRoutingTable(cfg *Config) (*routingTable, error) {
+	if len(cfg.Backends) == 0 {
+		return nil, fmt.Errorf("%w: at least one backend must be configured", ErrNoBackends)
+	}
+	if err := cfg.dedupeBackends(); err != nil {
+		return nil, err
+	}
+	for _, b := range cfg.Backends {
+		if err := b.checkVersions(); err != nil {
+			return nil, err
+		}
+	}
+	if _, err := cfg.dcidLength(); err != nil {
+		cfg.QUICLB[0] = defaultQUICLBConfig
+	}
+	dcidLength, _ := cfg.dcidLength()
+	codec, err := quiclb.NewCodec(cfg.QUICLB)
+	if err != nil {
+		return nil, err
+	}
+	selfEncoded, err := cfg.selfEncodedLength()
+	if err != nil {
+		return nil, err
+	}
+	if err := cfg.checkServerIDResolver(); err != nil {
+		return nil, err
+	}
+	serverIDs, err := newServerIDMap(*cfg)
+	if err != nil {
+		return nil, err
+	}
+	truncated, err := newTruncatedIDs(cfg)
+	if err != nil {
+		return nil, err
+	}
+	pools, err := newRotationPools(cfg, serverIDs != nil || truncated != nil)
+	if err != nil {
+		return nil, err
+	}
+	return &routingTable{
+		backends:       cfg.Backends,
+		serverIDs:      serverIDs,
+		truncated:      truncated,
+		pools:          pools,
+		defaultBackend: cfg.DefaultBackend,
+		codec:          codec,
+		packetProcessor: &packet.PacketProcessor{
+			DCIDLength:           dcidLength,
+			SelfEncodedCIDLength: selfEncoded,
+			FixedBitRequired:     codec.FixedBitRequired,
+			MaxCIDLengths:        cfg.MaxCIDLengths,
+			ShortHeaderVersion:   cfg.ShortHeaderVersion,
+		},
+		issueRotation: cfg.issueRotation(),
+		strategy:      cfg.Strategy,
+		fallback:      cfg.Fallback,
+		tokens:        cfg.TokenDecoder,
+		resolver:      cfg.ServerIDResolver,
+	}, nil
+}
+
+// routes returns the current routing table
+func (lb *LoadBalancer) routes() *routingTable {
+	return lb.routing.Load()
+}
+
+// updateRoutes publishes a copy of the routing table changed by update.
+// Callers must hold lb.mu, which serializes changes.
+func (lb *LoadBalancer) updateRoutes(update func(rt *routingTable)) {
+	rt := *lb.routes()
+	update(&rt)
+	lb.routing.Store(&rt)
+}
+
+// ApplyConfig swaps in the backends, server ID mapping, QUIC-LB configs,
+// strategies and ring of cfg at once. Flows already open keep their
+// backends, removed ones included, until they end. Nothing is applied when
+// cfg is invalid. Settings of cfg outside routing, the hash seed among
+// them, are ignored: they keep the values the load balancer was created with.
+// The reaper retunes how often it sweeps to the new backends' idle timeouts.
+// A retiring rotation that cfg leaves without a config stops retiring, so a
+// config later brought up on its codepoint starts afresh. DiffConfig
+// reports what it would change.
+func (lb *LoadBalancer) ApplyConfig(cfg Config) error {
+	rt, err := newRoutingTable(&cfg)
+	if err != nil {
+		return err
+	}
+	lb.mu.Lock()
+	defer lb.mu.Unlock()
+	rt.ring = lb.liveRing(rt.backends)
+	rt.decodeLatency = lb.metrics.decodeHistograms(rt.codec)
+	rt.sidLengths = lb.metrics.serverIDLengthCounters(rt.codecEntries())
+	lb.routing.Store(rt)
+	for rotation := range uint8(quiclb.NumConfigs) {
+		if _, active := rt.codec.Config(rotation); !active {
+			lb.UnretireRotation(rotation)
+		}
+	}
+	return nil
+}
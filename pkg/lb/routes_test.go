@@ -0,0 +1,120 @@
+package lb
+
+import (
+	"bytes"
+	"errors"
+	"sync"
+	"testing"
+
+	"github.com/fqzz2000/QUIC-LB-SHRIMP/pkg/packet"
+	"github.com/fqzz2000/QUIC-LB-SHRIMP/pkg/quiclb"
+)
+
+func TestApplyConfig(t *testing.T) {
+	fwd := memForwarder{opened: make(chan *memConn, 4)}
+	backends := func(addrs ...string) []BackendConfig {
+		var bs []BackendConfig
+		for _, addr := range addrs {
+			bs = append(bs, BackendConfig{Address: addr, Forwarder: fwd})
+		}
+		return bs
+	}
+	// the same CID reads as server ID 0x00 under a and 0x0001 under b, so
+	// a's codec with b's backends, or b's with a's, routes it elsewhere
+	a := Config{
+		Backends: backends("192.0.2.10:443", "192.0.2.11:443"),
+		QUICLB:   [quiclb.NumConfigs]quiclb.ConfigEntry{{Algorithm: quiclb.Plaintext, ServerIDLength: 1, NonceLength: 6}},
+	}
+	b := Config{
+		Backends: backends("192.0.2.20:443", "192.0.2.21:443"),
+		QUICLB:   [quiclb.NumConfigs]quiclb.ConfigEntry{{Algorithm: quiclb.Plaintext, ServerIDLength: 2, NonceLength: 5}},
+	}
+	cid := []byte{0x00, 0x00, 0x01, 0x07, 0x07, 0x07, 0x07, 0x07}
+	lb, _ := newMemLB(t, a)
+
+	initial := quicLongHeader(packet.Initial, cid, []byte{0xa1}, []byte("hello"))
+	if err := lb.handlePacket(initial, testAddr(1)); err != nil {
+		t.Fatalf("handlePacket() error = %v", err)
+	}
+	conn := expect(t, fwd.opened)
+	if got := lb.sessions.lookupCID(cid).Backend; got != "192.0.2.10:443" {
+		t.Fatalf("flow backend = %s, want 192.0.2.10:443", got)
+	}
+	expect(t, conn.sent)
+
+	var wg sync.WaitGroup
+	stop := make(chan struct{})
+	torn := make(chan string, 1)
+	for range 4 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				select {
+				case <-stop:
+					return
+				default:
+				}
+				// the whole routing path, not only the decode, sees one table
+				backend, err := lb.selectBackend(cid, testAddr(1))
+				if err != nil || (backend.Address != "192.0.2.10:443" && backend.Address != "192.0.2.21:443") {
+					select {
+					case torn <- backend.Address:
+					default:
+					}
+					return
+				}
+			}
+		}()
+	}
+	for i := range 200 {
+		cfg := a
+		if i%2 == 0 {
+			cfg = b
+		}
+		if err := lb.ApplyConfig(cfg); err != nil {
+			t.Fatalf("ApplyConfig() error = %v", err)
+		}
+	}
+	close(stop)
+	wg.Wait()
+	select {
+	case addr := <-torn:
+		t.Fatalf("selectBackend() = %q during ApplyConfig, want a backend of one config", addr)
+	default:
+	}
+
+	// the last swap applied a; an invalid config changes nothing
+	before := lb.routes()
+	if err := lb.ApplyConfig(Config{}); !errors.Is(err, ErrNoBackends) {
+		t.Errorf("ApplyConfig(no backends) error = %v, want %v", err, ErrNoBackends)
+	}
+	bad := b
+	bad.QUICLB[0].Algorithm = quiclb.StreamCipher // without a key
+	if err := lb.ApplyConfig(bad); err == nil {
+		t.Errorf("ApplyConfig(invalid QUIC-LB config) error = nil, want an error")
+	}
+	if lb.routes() != before {
+		t.Errorf("routing table replaced by an invalid config")
+	}
+
+	if err := lb.ApplyConfig(b); err != nil {
+		t.Fatalf("ApplyConfig() error = %v", err)
+	}
+	if backend, _ := lb.selectBackend(cid, testAddr(2)); backend.Address != "192.0.2.21:443" {
+		t.Errorf("selectBackend() = %s after ApplyConfig, want 192.0.2.21:443", backend.Address)
+	}
+	// the open flow keeps its backend, though no longer configured
+	short := append([]byte{0x40}, cid...)
+	if err := lb.handlePacket(short, testAddr(1)); err != nil {
+		t.Fatalf("handlePacket() error = %v", err)
+	}
+	if got := expect(t, conn.sent); !bytes.Equal(got, short) {
+		t.Errorf("flow sent %x, want %x", got, short)
+	}
+	select {
+	case <-fwd.opened:
+		t.Errorf("short header opened a new flow")
+	default:
+	}
+}
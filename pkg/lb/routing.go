@@ -0,0 +1,367 @@
+package lb
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"net"
+	"time"
+
+	"github.com/fqzz2000/QUIC-LB-SHRIMP/pkg/packet"
+	"github.com/fqzz2000/QUIC-LB-SHRIMP/pkg/quiclb"
+)
+
+var (
+	// ErrUnknownServerID is returned when a connection ID decodes to a server ID with no backend
+	ErrUnknownServerID = errors.New("server ID maps to no backend")
+	// ErrNoBackends is returned when no backend can take a packet: none is
+	// configured, or every one is unhealthy or at its flow limit
+	ErrNoBackends = errors.New("no backend available")
+)
+
+// serverIndex interprets a decoded server ID as a big-endian index into the backend list
+func serverIndex(serverID []byte) uint64 {
+	var idx uint64
+	for i, b := range serverID {
+		// anything wider than 64 bits can never index the backend list
+		if len(serverID)-i > 8 && b != 0 {
+			return math.MaxUint64
+		}
+		idx = idx<<8 | uint64(b)
+	}
+	return idx
+}
+
+// decodeCID decodes a connection ID with the current routing table, for
+// the admin decode endpoint
+func (lb *LoadBalancer) decodeCID(cid []byte) (*quiclb.DecodedCID, BackendConfig, error) {
+	return lb.decodeCIDIn(lb.routes(), cid)
+}
+
+// decodeCIDIn decodes a connection ID and resolves its server ID to a
+// backend, all with rt. Live routing and the admin decode endpoint share
+// this path so they always agree. With RepairDecodes a CID that fails with
+// the config its rotation bits select is retried with every other active
+// config.
+func (lb *LoadBalancer) decodeCIDIn(rt *routingTable, cid []byte) (*quiclb.DecodedCID, BackendConfig, error) {
+	var own uint8
+	if len(cid) > 0 {
+		own = cid[0] >> 6
+	}
+	rotation, issued := lb.issued.lookup(cid, lb.clock.Now())
+	if !issued {
+		rotation = own
+	}
+	// a CID the LB issued itself decodes with the config that produced it
+	decoded, backend, err := lb.decodeWith(rt, rotation, cid)
+	if err != nil && rotation != own && !errors.Is(err, errServerRemoved) {
+		// the issued set can hit on another CID's fingerprint; decode it as any other
+		rotation = own
+		decoded, backend, err = lb.decodeWith(rt, rotation, cid)
+	}
+	if err == nil || !lb.repairDecodes || errors.Is(err, errServerRemoved) {
+		return decoded, backend, err
+	}
+	for r := uint8(0); r < quiclb.NumConfigs; r++ {
+		if _, active := rt.codec.Config(r); !active || r == rotation {
+			continue
+		}
+		if d, b, rerr := lb.decodeWith(rt, r, cid); rerr == nil {
+			lb.stats.repairedDecodes.Add(1)
+			return d, b, nil
+		}
+	}
+	return decoded, backend, err
+}
+
+// decodeWith decodes a connection ID with the config of rt at rotation and
+// resolves its server ID to a backend of rt
+func (lb *LoadBalancer) decodeWith(rt *routingTable, rotation uint8, cid []byte) (*quiclb.DecodedCID, BackendConfig, error) {
+	var start time.Time
+	if decodeTiming {
+		start = time.Now()
+	}
+	decoded, err := rt.codec.DecodeWith(rotation, cid)
+	if err != nil {
+		return nil, BackendConfig{}, err
+	}
+	if decodeTiming {
+		rt.observeDecode(decoded.Rotation, start)
+	}
+	backend, err := rt.backendForServerID(decoded.Rotation, decoded.ServerID)
+	return decoded, backend, err
+}
+
+// routeCID resolves a connection ID to its backend for live routing
+func (lb *LoadBalancer) routeCID(cid []byte) (BackendConfig, error) {
+	return lb.routeDecoded(lb.routes(), &DecodeResult{CID: cid})
+}
+
+// routeDecoded resolves res.CID to its backend of rt for live routing,
+// recording the decode in res and counting it against its rotation. With a
+// single plaintext config it reads the server ID in place, skipping the
+// issued-CID lookup (there is only one config to decode with) and the
+// DecodedCID allocation; otherwise it is decodeCIDIn.
+func (lb *LoadBalancer) routeDecoded(rt *routingTable, res *DecodeResult) (BackendConfig, error) {
+	cid := res.CID
+	if !rt.codec.SinglePlaintext() {
+		return lb.decodeInto(rt, res)
+	}
+	var start time.Time
+	if decodeTiming {
+		start = time.Now()
+	}
+	serverID, err := rt.codec.ServerID(cid)
+	if err != nil {
+		return lb.repairCID(rt, res, err)
+	}
+	if decodeTiming {
+		rt.observeDecode(cid[0]>>6, start)
+	}
+	res.Decoded, res.Rotation, res.ServerID = true, cid[0]>>6, serverID
+	backend, err := rt.backendForServerID(res.Rotation, serverID)
+	switch {
+	case err == nil:
+		lb.metrics.countRotation(res.Rotation)
+		rt.countServerIDLength(serverID)
+	case !errors.Is(err, errServerRemoved):
+		return lb.repairCID(rt, res, err)
+	}
+	return backend, err
+}
+
+// decodeInto is decodeCIDIn recording the decode in res, counting a CID
+// that maps to a backend against its rotation and server ID length
+func (lb *LoadBalancer) decodeInto(rt *routingTable, res *DecodeResult) (BackendConfig, error) {
+	decoded, backend, err := lb.decodeCIDIn(rt, res.CID)
+	if decoded != nil {
+		res.setDecoded(decoded)
+	}
+	if err == nil {
+		lb.metrics.countRotation(res.Rotation)
+		rt.countServerIDLength(res.ServerID)
+	}
+	return backend, err
+}
+
+// repairCID retries a CID that failed the fast path through decodeCIDIn when
+// RepairDecodes is set, so stale rotation bits reach the lone config
+func (lb *LoadBalancer) repairCID(rt *routingTable, res *DecodeResult, err error) (BackendConfig, error) {
+	if !lb.repairDecodes {
+		return BackendConfig{}, err
+	}
+	return lb.decodeInto(rt, res)
+}
+
+// backendForServerID maps a server ID decoded with the config at rotation to
+// its backend through the explicit server ID mapping, or by index into the
+// rotation's pool when there is none
+func (rt *routingTable) backendForServerID(rotation uint8, serverID []byte) (BackendConfig, error) {
+	if rt.resolver != nil {
+		return rt.resolveServerID(serverID)
+	}
+	var backend BackendConfig
+	if rt.truncated != nil {
+		idx, ok := rt.truncated.lookup(serverID)
+		if !ok {
+			return BackendConfig{}, fmt.Errorf("%w: truncated %x", ErrUnknownServerID, serverID)
+		}
+		backend = rt.backends[idx]
+	} else if rt.serverIDs != nil {
+		b, ok := rt.serverIDs.lookup(serverID)
+		if !ok {
+			return BackendConfig{}, fmt.Errorf("%w: %x", ErrUnknownServerID, serverID)
+		}
+		backend = b
+	} else {
+		idx, ok := rt.pools.backendIndex(rotation, serverIndex(serverID))
+		if !ok || idx >= uint64(len(rt.backends)) {
+			return BackendConfig{}, fmt.Errorf("%w: %x", ErrUnknownServerID, serverID)
+		}
+		backend = rt.backends[idx]
+	}
+	if backend.removed() {
+		return BackendConfig{}, fmt.Errorf("%w: %x", errServerRemoved, serverID)
+	}
+	return backend, nil
+}
+
+// IssueCID encodes a connection ID for serverID with the first active config
+// and remembers it, so short headers addressed to it route to that server
+func (lb *LoadBalancer) IssueCID(serverID []byte) ([]byte, error) {
+	rt := lb.routes()
+	rotation := rt.issueRotation
+	cid, err := rt.codec.Encode(rotation, serverID, nil)
+	if err != nil {
+		return nil, err
+	}
+	lb.issued.add(cid, rotation, lb.clock.Now())
+	return cid, nil
+}
+
+// selectBackend routes a connection ID to a backend. Routing overrides win,
+// then a configured Strategy; otherwise the CID is decoded, and when it does
+// not decode (e.g. the client-chosen DCID of an Initial) the fallback picks
+// one, by default a hash of the client address so every packet of the
+// handshake lands on one backend.
+func (lb *LoadBalancer) selectBackend(cid []byte, src net.Addr) (BackendConfig, error) {
+	return lb.selectRoute(&DecodeResult{CID: cid}, src, missFallback)
+}
+
+// routeMiss is what selectRoute does with a CID that does not decode
+type routeMiss uint8
+
+const (
+	// missFallback routes it with the fallback
+	missFallback routeMiss = iota
+	// missReject returns errUnknownCID rather than routing by client address
+	missReject
+	// missNewFlow routes it to the new-flow pool, or with the fallback when
+	// no backend is in the pool
+	missNewFlow
+)
+
+// routeMissFor returns what a new flow opened by a packet of the given
+// header form and type does with a CID that does not decode
+func (lb *LoadBalancer) routeMissFor(form uint8, ptype packet.PacketType) routeMiss {
+	switch {
+	case form == 0 && lb.resetKey != nil:
+		// a short header is mid-connection; with resets enabled one nobody
+		// knows is answered rather than routed to a backend that cannot know it
+		return missReject
+	case ptype == packet.Initial || ptype == packet.ZeroRTT:
+		// the DCID is the client's own; the connection is new
+		return missNewFlow
+	}
+	return missFallback
+}
+
+// selectRoute is selectBackend for the CID of res, with miss deciding the
+// route of a CID that does not decode. It records in res what the CID
+// decoded to and the backend chosen, with what chose it. Every step routes
+// with the one routing table loaded here, so a concurrent ApplyConfig
+// cannot decode with one config and map with another.
+func (lb *LoadBalancer) selectRoute(res *DecodeResult, src net.Addr, miss routeMiss) (backend BackendConfig, err error) {
+	route := RouteNone
+	defer func() {
+		if err == nil {
+			res.chose(backend, route)
+		}
+	}()
+	cid, rt := res.CID, lb.routes()
+	if backend, ok := lb.overrides.lookup(cid, src, lb.clock.Now()); ok {
+		route = RouteOverride
+		return backend, nil
+	}
+	if rt.strategy != nil {
+		if backend, err = rt.strategy.Select(cid, src, backendSet{lb, rt}); !errors.Is(err, ErrNoRoute) {
+			route = RouteStrategy
+			return backend, err
+		}
+	}
+	if backend, ok := lb.tokenBackend(rt, res); ok {
+		route = RouteToken
+		return backend, nil
+	}
+	if err = lb.applyRotationPolicy(cid, miss); err == nil {
+		backend, err = lb.routeDecoded(rt, res)
+	} else if errors.Is(err, errRotationDropped) {
+		return BackendConfig{}, err
+	}
+	switch {
+	case err == nil && lb.unhealthyBackend(backend.Address):
+		// the CID's server is down; a new flow is better served elsewhere
+		lb.stats.unhealthyFallbacks.Add(1)
+		lb.logs.failure(lb.clock.Now(), "CID %x from %s decoded to unhealthy backend %s, rerouting", cid, src, backend.Address)
+	case err == nil && miss == missNewFlow && lb.backendRemoving(backend.Address):
+		// established connections keep the draining backend; new ones do not
+		if lb.drainPolicy != drainingFallback {
+			return BackendConfig{}, fmt.Errorf("%w: %s", errDrainingBackend, backend.Address)
+		}
+		lb.stats.drainingRedirects.Add(1)
+	case err == nil:
+		route = RouteCID
+		return lb.admitDecoded(backend)
+	default:
+		if !errors.Is(err, errRotationNotDecoded) {
+			lb.stats.decodeFailures.Add(1)
+		}
+		if errors.Is(err, quiclb.ErrCIDAuthFailed) {
+			lb.stats.authFailures.Add(1)
+		}
+		if errors.Is(err, errServerRemoved) {
+			lb.stats.removedServerIDs.Add(1)
+		}
+		if errors.Is(err, ErrUnknownServerID) {
+			if backend, ok := lb.catchAllBackend(); ok {
+				lb.stats.unknownServerIDs.Add(1)
+				lb.stats.catchAllRouted.Add(1)
+				route = RouteCatchAll
+				return backend, nil
+			}
+		}
+		if errors.Is(err, errServerRemoved) && lb.dropRemoved {
+			return BackendConfig{}, err
+		}
+		if errors.Is(err, ErrUnknownServerID) {
+			lb.stats.unknownServerIDs.Add(1)
+			switch lb.unknownIDs {
+			case unknownServerIDDrop:
+				return BackendConfig{}, err
+			case unknownServerIDPool:
+				if backend, ok := lb.newFlowBackend(rt, src); ok {
+					route = RouteNewFlowPool
+					return backend, nil
+				}
+			}
+		}
+		if miss == missReject {
+			return BackendConfig{}, errUnknownCID
+		}
+		if miss == missNewFlow {
+			if backend, ok := lb.newFlowBackend(rt, src); ok {
+				route = RouteNewFlowPool
+				return backend, nil
+			}
+		}
+		lb.logs.failure(lb.clock.Now(), "CID %x from %s did not decode, falling back: %v", cid, src, err)
+	}
+	route = RouteFallback
+	return lb.fallbackBackend(rt, cid, src)
+}
+
+// fallbackBackend routes a packet whose CID did not decode with the
+// configured fallback Strategy, or by hashing the client address onto the
+// consistent-hash ring, skipping backends marked unhealthy or at their flow
+// limit so new flows spill over to the next backend of rt's ring
+func (lb *LoadBalancer) fallbackBackend(rt *routingTable, cid []byte, src net.Addr) (BackendConfig, error) {
+	if rt.fallback != nil {
+		if backend, err := rt.fallback.Select(cid, src, backendSet{lb, rt}); !errors.Is(err, ErrNoRoute) {
+			return backend, err
+		}
+	}
+	key := []byte(addrKey(src))
+	avoid, loaded := lb.avoidLoaded(lb.avoidNew)
+	backend, ok := rt.ring.lookupAvoiding(key, avoid)
+	if !ok {
+		return BackendConfig{}, ErrNoBackends
+	}
+	if loaded {
+		if unloaded, _ := rt.ring.lookupAvoiding(key, lb.avoidNew); unloaded.Address != backend.Address {
+			lb.stats.loadSpills.Add(1)
+		}
+	}
+	return backend, nil
+}
+
+// SelectBackend picks the backend for a packet from its Destination Connection ID,
+// using the client address when the CID does not decode
+func (lb *LoadBalancer) SelectBackend(pkt []byte, src net.Addr) (string, error) {
+	header, err := lb.parseHeader(pkt, lb.routes().packetProcessor)
+	if err != nil {
+		return "", err
+	}
+	res := newDecodeResult(header)
+	backend, err := lb.selectRoute(&res, src, missFallback)
+	return backend.Address, err
+}
@@ -0,0 +1,192 @@
+package lb
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"net"
+	"testing"
+
+	"github.com/fqzz2000/QUIC-LB-SHRIMP/pkg/quiclb"
+)
+
+func TestRouteCIDMatchesDecodeCID(t *testing.T) {
+	lb, err := InitLoadBalancer("127.0.0.1:0", []string{"backend0", "backend1", "backend2"})
+	if err != nil {
+		t.Fatalf("InitLoadBalancer() error = %v", err)
+	}
+	if !lb.routes().codec.SinglePlaintext() {
+		t.Fatalf("default config does not take the fast path")
+	}
+
+	for sid := 0; sid < 5; sid++ {
+		cid, _ := lb.routes().codec.Encode(0, []byte{byte(sid)}, nil)
+		fast, fastErr := lb.routeCID(cid)
+		_, slow, slowErr := lb.decodeCID(cid)
+		if fast.Address != slow.Address || errors.Is(fastErr, ErrUnknownServerID) != errors.Is(slowErr, ErrUnknownServerID) {
+			t.Errorf("server ID %d: routeCID = (%v, %v), decodeCID = (%v, %v)", sid, fast, fastErr, slow, slowErr)
+		}
+	}
+}
+
+func TestSelectBackendCountsAuthFailures(t *testing.T) {
+	lb, err := NewLoadBalancer(Config{
+		Backends: StaticBackends("backend0", "backend1"),
+		QUICLB: [quiclb.NumConfigs]quiclb.ConfigEntry{{
+			Algorithm: quiclb.AEAD, ServerIDLength: 1, NonceLength: 8, TagLength: 6,
+			Key: bytes.Repeat([]byte{0x2b}, quiclb.KeyLength),
+		}},
+	})
+	if err != nil {
+		t.Fatalf("NewLoadBalancer() error = %v", err)
+	}
+	cid, _ := lb.routes().codec.Encode(0, []byte{0x01}, nil)
+	src := &net.UDPAddr{IP: net.IPv4(192, 0, 2, 1), Port: 4433}
+
+	if backend, err := lb.selectBackend(cid, src); err != nil || backend.Address != "backend1" {
+		t.Fatalf("selectBackend() = (%v, %v), want backend1", backend, err)
+	}
+	cid[len(cid)-1] ^= 0x01
+	if _, err := lb.selectBackend(cid, src); err != nil {
+		t.Fatalf("selectBackend() with tampered cid error = %v, want fallback", err)
+	}
+
+	stats := lb.Stats()
+	if stats.CIDAuthFailures != 1 || stats.DecodeFailures != 1 {
+		t.Errorf("CIDAuthFailures = %d, DecodeFailures = %d, want 1 and 1", stats.CIDAuthFailures, stats.DecodeFailures)
+	}
+}
+
+func BenchmarkRouteCID(b *testing.B) {
+	lb, _ := InitLoadBalancer("127.0.0.1:0", []string{"backend0", "backend1"})
+	cid, _ := lb.routes().codec.Encode(0, []byte{0x01}, nil)
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		if _, err := lb.routeCID(cid); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func TestNoBackends(t *testing.T) {
+	if _, err := NewLoadBalancer(Config{}); !errors.Is(err, ErrNoBackends) {
+		t.Errorf("NewLoadBalancer() with no backends error = %v, want %v", err, ErrNoBackends)
+	}
+	if _, err := InitLoadBalancer("127.0.0.1:0", nil); !errors.Is(err, ErrNoBackends) {
+		t.Errorf("InitLoadBalancer() with no backends error = %v, want %v", err, ErrNoBackends)
+	}
+
+	strategies := map[string]Strategy{"decode": nil, "cid hash": CIDHashStrategy{}, "weighted random": WeightedRandomStrategy{}}
+	for name, strategy := range strategies {
+		t.Run(name, func(t *testing.T) {
+			lb, err := NewLoadBalancer(Config{Backends: StaticBackends("backend0", "backend1"), Strategy: strategy})
+			if err != nil {
+				t.Fatalf("NewLoadBalancer() error = %v", err)
+			}
+			lb.SetBackendHealth("backend0", false)
+			lb.SetBackendHealth("backend1", false)
+
+			cid, _ := lb.routes().codec.Encode(0, []byte{0}, nil)
+			for _, pkt := range [][]byte{
+				append([]byte{0x40}, cid...),             // decodes to an unhealthy backend
+				append([]byte{0x40}, make([]byte, 8)...), // decodes to nothing
+			} {
+				if _, err := lb.SelectBackend(pkt, testAddr(1)); !errors.Is(err, ErrNoBackends) {
+					t.Errorf("SelectBackend() with every backend unhealthy error = %v, want %v", err, ErrNoBackends)
+				}
+			}
+		})
+	}
+}
+
+func TestRepairDecodes(t *testing.T) {
+	aead := func(key byte) quiclb.ConfigEntry {
+		return quiclb.ConfigEntry{
+			Algorithm: quiclb.AEAD, ServerIDLength: 1, NonceLength: 8, TagLength: 6,
+			Key: bytes.Repeat([]byte{key}, quiclb.KeyLength),
+		}
+	}
+	tests := []struct {
+		name    string
+		configs [quiclb.NumConfigs]quiclb.ConfigEntry
+		encode  uint8 // config that encodes the CID
+		bits    uint8 // rotation bits it carries
+	}{
+		{name: "sibling config", configs: [quiclb.NumConfigs]quiclb.ConfigEntry{aead(0x2b), aead(0x3c)}, encode: 1, bits: 0},
+		{name: "stale rotation", configs: [quiclb.NumConfigs]quiclb.ConfigEntry{2: defaultQUICLBConfig}, encode: 2, bits: 3},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			for _, repair := range []bool{false, true} {
+				lb, err := NewLoadBalancer(Config{
+					Backends:      StaticBackends("backend0", "backend1"),
+					QUICLB:        tt.configs,
+					RepairDecodes: repair,
+				})
+				if err != nil {
+					t.Fatalf("NewLoadBalancer() error = %v", err)
+				}
+				cid, err := lb.routes().codec.Encode(tt.encode, []byte{0x01}, nil)
+				if err != nil {
+					t.Fatalf("Encode() error = %v", err)
+				}
+				cid[0] = cid[0]&0x3f | tt.bits<<6
+
+				backend, err := lb.routeCID(cid)
+				if !repair {
+					if err == nil {
+						t.Errorf("routeCID() without repair = %q, want an error", backend.Address)
+					}
+					continue
+				}
+				if err != nil || backend.Address != "backend1" {
+					t.Errorf("routeCID() with repair = %q, %v, want backend1", backend.Address, err)
+				}
+				if got := lb.Stats().RepairedDecodes; got != 1 {
+					t.Errorf("RepairedDecodes = %d, want 1", got)
+				}
+			}
+		})
+	}
+}
+
+func TestSelfEncodedCIDLengths(t *testing.T) {
+	lb, err := NewLoadBalancer(Config{
+		Backends: StaticBackends("backend0", "backend1", "backend2"),
+		QUICLB: [quiclb.NumConfigs]quiclb.ConfigEntry{
+			{Algorithm: quiclb.Plaintext, ServerIDLength: 1, NonceLength: 4, SelfEncodedLength: true},
+			{Algorithm: quiclb.Plaintext, ServerIDLength: 1, NonceLength: 12, SelfEncodedLength: true},
+		},
+	})
+	if err != nil {
+		t.Fatalf("NewLoadBalancer() error = %v", err)
+	}
+
+	// configs of different lengths route short headers with no global length
+	for rotation, serverID := range []byte{0x01, 0x02} {
+		cid, err := lb.routes().codec.Encode(uint8(rotation), []byte{serverID}, nil)
+		if err != nil {
+			t.Fatalf("Encode() error = %v", err)
+		}
+		pkt := append(append([]byte{0x40}, cid...), 0xee, 0xee, 0xee)
+		dcid, err := lb.routes().packetProcessor.ExtractCID(pkt)
+		if err != nil || !bytes.Equal(dcid, cid) {
+			t.Fatalf("ExtractCID() = %x, %v, want %x", dcid, err, cid)
+		}
+		backend, err := lb.routeCID(dcid)
+		if want := fmt.Sprintf("backend%d", serverID); err != nil || backend.Address != want {
+			t.Errorf("routeCID(%d byte CID) = %q, %v, want %s", len(cid), backend.Address, err, want)
+		}
+	}
+
+	_, err = NewLoadBalancer(Config{
+		Backends: StaticBackends("backend0"),
+		QUICLB: [quiclb.NumConfigs]quiclb.ConfigEntry{
+			{Algorithm: quiclb.Plaintext, ServerIDLength: 1, NonceLength: 4, SelfEncodedLength: true},
+			{Algorithm: quiclb.Plaintext, ServerIDLength: 1, NonceLength: 4},
+		},
+	})
+	if !errors.Is(err, quiclb.ErrInvalidConfig) {
+		t.Errorf("NewLoadBalancer(mixed self-encoding) error = %v, want %v", err, quiclb.ErrInvalidConfig)
+	}
+}
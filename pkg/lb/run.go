@@ -0,0 +1,266 @@
+package lb
+
+import (
+	"context"
+	"errors"
+	"hash/fnv"
+	"log"
+	"net"
+	"runtime/debug"
+	"sync"
+	"time"
+)
+
+// inbound is a datagram read from the listener awaiting a worker
+type inbound struct {
+	pkt []byte
+	src net.Addr
+	ln  *clientListener // the extra listener it arrived on, nil for the main one
+	buf *[]byte         // the pooled buffer pkt was read into
+}
+
+// run drives the reader and workers until ctx is done or the listener fails,
+// then drains the worker queues, closes every flow and waits for all goroutines
+func (lb *LoadBalancer) run(ctx context.Context) error {
+	lb.mu.RLock()
+	listener, listeners, control := lb.listener, lb.listeners, lb.control
+	lb.mu.RUnlock()
+
+	var wg sync.WaitGroup
+	queues := make([]chan inbound, lb.workers)
+	for i := range queues {
+		queues[i] = make(chan inbound, lb.queueSize)
+		wg.Add(1)
+		go func(queue <-chan inbound) {
+			defer wg.Done()
+			lb.work(queue)
+		}(queues[i])
+	}
+
+	bgCtx, stopBackground := context.WithCancel(ctx)
+	defer stopBackground()
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		lb.reapLoop(bgCtx)
+	}()
+	lb.mu.RLock()
+	unresolved := lb.unresolved
+	lb.mu.RUnlock()
+	if len(unresolved) > 0 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			lb.retryResolve(bgCtx, unresolved)
+		}()
+	}
+
+	if lb.healthCheck != nil {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			lb.healthCheckLoop(bgCtx)
+		}()
+	}
+
+	if control != nil {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			lb.controlLoop(control)
+		}()
+	}
+
+	// the sink outlives the workers so it gets their last decisions
+	var sinkWG sync.WaitGroup
+	stopSink := make(chan struct{})
+	if lb.decisions != nil {
+		sinkWG.Add(1)
+		go func() {
+			defer sinkWG.Done()
+			lb.decisions.deliver(stopSink)
+		}()
+	}
+
+	readErr := make(chan error, 1)
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		readErr <- lb.readLoop(queues)
+	}()
+
+	var err error
+	select {
+	case <-ctx.Done():
+	case err = <-readErr:
+	}
+
+	// closing the listener unblocks the reader, which closes the queues;
+	// workers finish whatever is queued before exiting
+	stopBackground()
+	listener.Close()
+	for _, ln := range listeners {
+		ln.conn.Close()
+	}
+	if control != nil {
+		control.Close()
+	}
+	wg.Wait()
+	close(stopSink)
+	sinkWG.Wait()
+	lb.closeFlows()
+	lb.warm.close()
+	if lb.shared != nil {
+		lb.shared.conn.Close()
+	}
+	lb.flowWG.Wait()
+
+	lb.mu.Lock()
+	defer lb.mu.Unlock()
+	if cerr := lb.stopAdmin(); cerr != nil {
+		log.Printf("Error closing admin server: %v", cerr)
+	}
+	lb.closeListener()
+	lb.closeControl()
+	lb.running = false
+	lb.cancel()
+	close(lb.done)
+	return err
+}
+
+// readLoop reads datagrams from every listener and hands them to workers
+// until the listeners close or one fails, retrying transient errors (see
+// readretry.go). Packets from one client address always go to the same
+// worker so their order is preserved.
+func (lb *LoadBalancer) readLoop(queues []chan inbound) error {
+	defer func() {
+		for _, q := range queues {
+			close(q)
+		}
+	}()
+	lb.mu.RLock()
+	listener, listeners := lb.listener, lb.listeners
+	lb.mu.RUnlock()
+	if len(listeners) == 0 {
+		return lb.readFrom(listener, nil, queues)
+	}
+	errs := make(chan error, len(listeners))
+	for _, ln := range listeners {
+		go func() { errs <- lb.readFrom(ln.conn, ln, queues) }()
+	}
+	err := lb.readFrom(listener, nil, queues)
+	// whichever listener stopped, the rest are closed with it so the
+	// queues are closed only once no reader is left
+	for _, ln := range listeners {
+		ln.conn.Close()
+	}
+	for range listeners {
+		if lerr := <-errs; err == nil {
+			err = lerr
+		}
+	}
+	return err
+}
+
+// readFrom reads datagrams from conn, the socket of listener ln, until it
+// closes or fails
+func (lb *LoadBalancer) readFrom(conn net.PacketConn, ln *clientListener, queues []chan inbound) error {
+	var backoff time.Duration
+	for {
+		buf := packetBuffers.Get().(*[]byte)
+		n, addr, err := conn.ReadFrom(*buf)
+		if err != nil {
+			packetBuffers.Put(buf)
+			if errors.Is(err, net.ErrClosed) {
+				return nil
+			}
+			var retry bool
+			if backoff, retry = lb.retryRead(err, backoff); !retry {
+				return err
+			}
+			continue
+		}
+		backoff = 0
+		lb.stats.received.Add(1)
+		if addr == nil {
+			// an unbound unixgram peer has no address to return responses to
+			packetBuffers.Put(buf)
+			lb.drop(dropNoAddress)
+			continue
+		}
+		h := fnv.New32a()
+		h.Write([]byte(addrKey(addr)))
+		select {
+		case queues[h.Sum32()%uint32(len(queues))] <- inbound{pkt: (*buf)[:n], src: addr, ln: ln, buf: buf}:
+		default:
+			packetBuffers.Put(buf)
+			lb.stats.queueDrops.Add(1)
+			lb.drop(dropQueueFull)
+		}
+	}
+}
+
+// panicLogBytes is how much of a packet that panicked is logged
+const panicLogBytes = 64
+
+// process handles one queued datagram, writing it as soon as it is routed
+func (lb *LoadBalancer) process(in inbound) {
+	it := batchItem{in: in}
+	lb.route(&it, nil)
+	if it.routed {
+		lb.account(&it)
+	}
+}
+
+// route routes one datagram, leaving its backend write in held when held is
+// non-nil and the write can be batched
+func (lb *LoadBalancer) route(it *batchItem, held *heldWrite) {
+	if lb.recoverPanics {
+		defer lb.recoverPacket(it.in)
+	}
+	if lb.trace.sampled() {
+		it.trace = lb.traceDecode(it.in.pkt, it.in.src, it.in.ln)
+	}
+	it.err = lb.handleDatagram(it.in.pkt, it.in.src, it.in.ln, &it.res, held)
+	it.routed = true
+}
+
+// account records a routed datagram's outcome once its write is done
+func (lb *LoadBalancer) account(it *batchItem) {
+	err := it.err
+	now := lb.clock.Now()
+	lb.events.record(now, &it.res, err)
+	lb.recordDecision(now, &it.res, err)
+	if it.trace != nil {
+		lb.finishTrace(it.trace, err)
+	}
+	if err != nil {
+		lb.drop(dropReasonFor(err))
+		switch {
+		case lb.debug:
+			log.Printf("Dropped packet from %s: %v", it.in.src, err)
+		case lb.reportMalformed(now, it.in.src, err):
+		default:
+			lb.logs.failure(now, "Dropped packet from %s: %v", it.in.src, err)
+		}
+		return
+	}
+	lb.stats.forwarded.Add(1)
+	lb.sampleServerID(&it.res)
+}
+
+// recoverPacket turns a panic while processing one packet into a drop so a
+// latent bug costs that packet rather than the worker
+func (lb *LoadBalancer) recoverPacket(in inbound) {
+	r := recover()
+	if r == nil {
+		return
+	}
+	lb.stats.panics.Add(1)
+	lb.drop(dropPanic)
+	pkt := in.pkt
+	if len(pkt) > panicLogBytes {
+		pkt = pkt[:panicLogBytes]
+	}
+	log.Printf("Recovered panic processing %d byte packet from %s: %v\npacket: %x\n%s", len(in.pkt), in.src, r, pkt, debug.Stack())
+}
@@ -0,0 +1,129 @@
+package lb
+
+import (
+	"bytes"
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	"go.uber.org/goleak"
+)
+
+func TestRunStopsOnContextCancel(t *testing.T) {
+	backend := startEchoBackend(t)
+	defer goleak.VerifyNone(t, goleak.IgnoreCurrent())
+
+	lb, err := NewLoadBalancer(Config{
+		ListenAddr: "127.0.0.1:0",
+		Backends:   StaticBackends(backend),
+		Workers:    4,
+	})
+	if err != nil {
+		t.Fatalf("NewLoadBalancer() error = %v", err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	runErr := make(chan error, 1)
+	go func() { runErr <- lb.Run(ctx) }()
+
+	// wait for the listener, then open a flow so a return goroutine exists
+	deadline := time.Now().Add(time.Second)
+	for lb.Addr() == nil && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond)
+	}
+	if lb.Addr() == nil {
+		t.Fatalf("Run() never bound the listener")
+	}
+	client := newTestClient(t)
+	cid, _ := lb.routes().codec.Encode(0, []byte{0x00}, nil)
+	client.WriteTo(append([]byte{0x40}, cid...), lb.Addr())
+	if readWithin(t, client, time.Second) == nil {
+		t.Fatalf("no response before cancel")
+	}
+	client.Close()
+
+	cancel()
+	select {
+	case err := <-runErr:
+		if err != nil {
+			t.Errorf("Run() error = %v, want nil", err)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatalf("Run() did not return after cancel")
+	}
+
+	if lb.Addr() != nil {
+		t.Errorf("load balancer still running after Run returned")
+	}
+	if len(lb.sessions.flows()) != 0 {
+		t.Errorf("flows left open after Run returned")
+	}
+}
+
+func TestRunRejectsSecondStart(t *testing.T) {
+	lb := startTestLB(t, Config{Backends: StaticBackends("127.0.0.1:9")})
+	if err := lb.Run(context.Background()); err != errAlreadyRunning {
+		t.Errorf("Run() error = %v, want %v", err, errAlreadyRunning)
+	}
+}
+
+func TestStartShutdownLeavesNoGoroutines(t *testing.T) {
+	defer goleak.VerifyNone(t, goleak.IgnoreCurrent())
+
+	lb, err := NewLoadBalancer(Config{
+		ListenAddr: "127.0.0.1:0",
+		AdminAddr:  "127.0.0.1:0",
+		Backends:   StaticBackends("127.0.0.1:9"),
+	})
+	if err != nil {
+		t.Fatalf("NewLoadBalancer() error = %v", err)
+	}
+	for i := 0; i < 2; i++ {
+		if err := lb.Start(); err != nil {
+			t.Fatalf("Start() error = %v", err)
+		}
+		if lb.AdminAddr() == nil {
+			t.Fatalf("admin server not started")
+		}
+		if err := lb.Shutdown(); err != nil {
+			t.Fatalf("Shutdown() error = %v", err)
+		}
+	}
+	if lb.AdminAddr() != nil {
+		t.Errorf("admin server still bound after Shutdown")
+	}
+}
+
+// panickingStrategy panics on DCIDs starting 0xde and hashes the rest
+type panickingStrategy struct{}
+
+func (panickingStrategy) Select(cid []byte, src net.Addr, backends BackendSet) (BackendConfig, error) {
+	if len(cid) > 0 && cid[0] == 0xde {
+		panic("injected strategy bug")
+	}
+	return CIDHashStrategy{}.Select(cid, src, backends)
+}
+
+func TestWorkerSurvivesPanic(t *testing.T) {
+	lb := startTestLB(t, Config{
+		Backends:      StaticBackends(startEchoBackend(t)),
+		Strategy:      panickingStrategy{},
+		Workers:       1,
+		RecoverPanics: true,
+	})
+	client := newTestClient(t)
+
+	client.WriteTo([]byte{0x40, 0xde, 0xad, 0xbe, 0xef, 0x00, 0x00, 0x00, 0x00}, lb.Addr())
+	good := []byte{0x40, 0x01, 0x02, 0x03, 0x04, 0x05, 0x06, 0x07, 0x08}
+	client.WriteTo(good, lb.Addr())
+
+	// the lone worker recovered and went on to forward the next packet
+	if got := readWithin(t, client, time.Second); !bytes.Equal(got, good) {
+		t.Fatalf("response after panic = %x, want %x", got, good)
+	}
+	stats := lb.Stats()
+	if stats.Panics != 1 || stats.PacketsDropped != 1 {
+		t.Errorf("Panics = %d, PacketsDropped = %d, want 1 and 1", stats.Panics, stats.PacketsDropped)
+	}
+}
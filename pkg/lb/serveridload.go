@@ -0,0 +1,137 @@
+package lb
+
+import (
+	"cmp"
+	"encoding/hex"
+	"math/rand/v2"
+	"net/http"
+	"slices"
+	"sync"
+)
+
+// The server ID load sample (Config.ServerIDSamples) shows how traffic
+// spreads over the server IDs its CIDs encode, for capacity planning: one
+// server ID taking a disproportionate share points at a hot backend or an
+// uneven server ID assignment. A ServerIDSampleRate fraction (default
+// defaultServerIDSampleRate) of forwarded packets is sampled, and the last
+// ServerIDSamples samples are kept, so memory stays bounded and the
+// distribution follows recent traffic. Packets of open flows route without
+// a decode, so a sampled one has its CID decoded here; packets whose CID
+// does not decode are not counted. GET /server-ids reports the
+// distribution, largest share first.
+
+// defaultServerIDSampleRate is the fraction of packets sampled unless configured
+const defaultServerIDSampleRate = 0.01
+
+// serverIDSample is one sampled packet's server ID and the backend it reached
+type serverIDSample struct {
+	serverID string
+	backend  string
+}
+
+// serverIDLoad keeps the most recent server ID samples
+type serverIDLoad struct {
+	rate float64
+
+	mu     sync.Mutex
+	counts map[serverIDSample]int
+	order  []serverIDSample // ring of the samples in counts, oldest at next
+	next   int
+}
+
+// newServerIDLoad returns a sample of the last window packets taken at rate,
+// or nil when window is not positive
+func newServerIDLoad(window int, rate float64) *serverIDLoad {
+	if window <= 0 {
+		return nil
+	}
+	if rate <= 0 || rate > 1 {
+		rate = defaultServerIDSampleRate
+	}
+	return &serverIDLoad{rate: rate, counts: make(map[serverIDSample]int), order: make([]serverIDSample, 0, window)}
+}
+
+// sampled reports whether the next packet is sampled
+func (s *serverIDLoad) sampled() bool {
+	return s != nil && rand.Float64() < s.rate
+}
+
+// observe records a sample, evicting the oldest once the window is full
+func (s *serverIDLoad) observe(serverID []byte, backend string) {
+	sample := serverIDSample{serverID: string(serverID), backend: backend}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if len(s.order) < cap(s.order) {
+		s.order = append(s.order, sample)
+	} else {
+		old := s.order[s.next]
+		if s.counts[old]--; s.counts[old] == 0 {
+			delete(s.counts, old)
+		}
+		s.order[s.next] = sample
+		s.next = (s.next + 1) % len(s.order)
+	}
+	s.counts[sample]++
+}
+
+// serverIDShare is one server ID's part of the sampled traffic
+type serverIDShare struct {
+	ServerID string  `json:"server_id"` // hex
+	Backend  string  `json:"backend"`
+	Samples  int     `json:"samples"`
+	Share    float64 `json:"share"` // of all samples held, in [0, 1]
+}
+
+// serverIDLoadView is the distribution GET /server-ids reports
+type serverIDLoadView struct {
+	Samples   int             `json:"samples"`
+	ServerIDs []serverIDShare `json:"server_ids"`
+}
+
+// distribution returns the samples held by server ID, largest share first
+func (s *serverIDLoad) distribution() serverIDLoadView {
+	view := serverIDLoadView{ServerIDs: []serverIDShare{}}
+	if s == nil {
+		return view
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	view.Samples = len(s.order)
+	for sample, n := range s.counts {
+		view.ServerIDs = append(view.ServerIDs, serverIDShare{
+			ServerID: hex.EncodeToString([]byte(sample.serverID)),
+			Backend:  sample.backend,
+			Samples:  n,
+			Share:    float64(n) / float64(view.Samples),
+		})
+	}
+	slices.SortFunc(view.ServerIDs, func(a, b serverIDShare) int {
+		return cmp.Or(cmp.Compare(b.Samples, a.Samples), cmp.Compare(a.ServerID, b.ServerID), cmp.Compare(a.Backend, b.Backend))
+	})
+	return view
+}
+
+// sampleServerID samples a forwarded packet's server ID, decoding its CID
+// when routing did not
+func (lb *LoadBalancer) sampleServerID(res *DecodeResult) {
+	if !lb.idLoad.sampled() {
+		return
+	}
+	serverID := res.ServerID
+	if !res.Decoded {
+		if len(res.CID) == 0 {
+			return
+		}
+		decoded, err := lb.routes().codec.DecodeWith(res.CID[0]>>6, res.CID)
+		if err != nil {
+			return
+		}
+		serverID = decoded.ServerID
+	}
+	lb.idLoad.observe(serverID, res.Backend)
+}
+
+// handleServerIDLoad reports the sampled server ID distribution
+func (lb *LoadBalancer) handleServerIDLoad(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, lb.idLoad.distribution())
+}
@@ -0,0 +1,73 @@
+package lb
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+)
+
+func TestServerIDLoad(t *testing.T) {
+	fwd := memForwarder{opened: make(chan *memConn, 3)}
+	lb, _ := newMemLB(t, Config{
+		Backends: []BackendConfig{
+			{Address: "192.0.2.100:443", Forwarder: fwd},
+			{Address: "192.0.2.101:443", Forwarder: fwd},
+			{Address: "192.0.2.102:443", Forwarder: fwd},
+		},
+		ServerIDSamples:    100,
+		ServerIDSampleRate: 1,
+	})
+	// server ID 2 carries six packets, 1 three and 0 one; all but each
+	// flow's first route by the flow without a decode
+	for client, load := range map[byte]int{0x02: 6, 0x01: 3, 0x00: 1} {
+		cid, err := lb.routes().codec.Encode(0, []byte{client}, []byte{0x10, 0x11, 0x12, 0x13, 0x14, 0x15})
+		if err != nil {
+			t.Fatalf("Encode() error = %v", err)
+		}
+		for range load {
+			lb.process(inbound{pkt: append([]byte{0x40}, cid...), src: testAddr(int(client) + 1)})
+		}
+	}
+
+	rec := httptest.NewRecorder()
+	lb.adminHandler().ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/server-ids", nil))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("status = %d, want %d: %s", rec.Code, http.StatusOK, rec.Body)
+	}
+	var got serverIDLoadView
+	if err := json.NewDecoder(rec.Body).Decode(&got); err != nil {
+		t.Fatalf("decoding response: %v", err)
+	}
+	want := serverIDLoadView{Samples: 10, ServerIDs: []serverIDShare{
+		{ServerID: "02", Backend: "192.0.2.102:443", Samples: 6, Share: 0.6},
+		{ServerID: "01", Backend: "192.0.2.101:443", Samples: 3, Share: 0.3},
+		{ServerID: "00", Backend: "192.0.2.100:443", Samples: 1, Share: 0.1},
+	}}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("GET /server-ids = %+v, want %+v", got, want)
+	}
+}
+
+func TestServerIDLoadWindow(t *testing.T) {
+	s := newServerIDLoad(2, 1)
+	for _, id := range []byte{1, 2, 2} {
+		s.observe([]byte{id}, "backend")
+	}
+	// the oldest sample left the window
+	got := s.distribution()
+	want := serverIDLoadView{Samples: 2, ServerIDs: []serverIDShare{{ServerID: "02", Backend: "backend", Samples: 2, Share: 1}}}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("distribution() = %+v, want %+v", got, want)
+	}
+	if len(s.counts) != 1 {
+		t.Errorf("sample holds %d entries, want 1", len(s.counts))
+	}
+
+	// disabled sampling reports an empty distribution
+	var off *serverIDLoad
+	if got := off.distribution(); got.Samples != 0 || len(got.ServerIDs) != 0 || off.sampled() {
+		t.Errorf("disabled distribution() = %+v, want none", got)
+	}
+}
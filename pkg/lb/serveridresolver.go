@@ -0,0 +1,63 @@
+package lb
+
+import (
+	"fmt"
+)
+
+// By default a decoded server ID names its backend by the configured
+// mapping: an index into Config.Backends, the backends' ServerIDs, or the
+// truncated map. A ServerIDResolver (Config.ServerIDResolver) replaces that
+// lookup, so server IDs can mean whatever a service-discovery system says
+// they mean. The backend it returns must be one of the configured backends.
+// The resolver only answers for decoded CIDs: CIDs the load balancer issues
+// itself, in rewrite mode or through IssueCID, still take their server ID
+// from the backend's ServerIDs, and a backend without any has none.
+
+// ServerIDResolver maps a decoded server ID to the address of its backend.
+// It is called from packet-processing goroutines concurrently and must not
+// retain serverID.
+type ServerIDResolver interface {
+	Resolve(serverID []byte) (backend string, ok bool)
+}
+
+// IndexResolver is the default mapping as a ServerIDResolver: a server ID is
+// a big-endian index into the addresses
+type IndexResolver []string
+
+func (r IndexResolver) Resolve(serverID []byte) (string, bool) {
+	idx := serverIndex(serverID)
+	if idx >= uint64(len(r)) {
+		return "", false
+	}
+	return r[idx], true
+}
+
+// checkServerIDResolver rejects mappings a configured resolver replaces
+func (c *Config) checkServerIDResolver() error {
+	if c.ServerIDResolver == nil {
+		return nil
+	}
+	if len(c.TruncatedServerIDs) > 0 {
+		return fmt.Errorf("%w: ServerIDResolver and TruncatedServerIDs are exclusive", errBadServerIDs)
+	}
+	for _, addrs := range c.RotationBackends {
+		if addrs != nil {
+			return fmt.Errorf("%w: ServerIDResolver and RotationBackends are exclusive", errBadServerIDs)
+		}
+	}
+	return nil
+}
+
+// resolveServerID looks a server ID up with the configured resolver
+func (rt *routingTable) resolveServerID(serverID []byte) (BackendConfig, error) {
+	addr, ok := rt.resolver.Resolve(serverID)
+	if !ok {
+		return BackendConfig{}, fmt.Errorf("%w: %x", ErrUnknownServerID, serverID)
+	}
+	for _, b := range rt.backends {
+		if b.Address == addr && !b.removed() {
+			return b, nil
+		}
+	}
+	return BackendConfig{}, fmt.Errorf("%w: %x resolved to %q", ErrUnknownServerID, serverID, addr)
+}
@@ -0,0 +1,102 @@
+package lb
+
+import (
+	"encoding/hex"
+	"errors"
+	"testing"
+
+	"github.com/fqzz2000/QUIC-LB-SHRIMP/pkg/quiclb"
+)
+
+// mapResolver resolves hex server IDs through a map, as a service-discovery
+// lookup would
+type mapResolver map[string]string
+
+func (m mapResolver) Resolve(serverID []byte) (string, bool) {
+	addr, ok := m[hex.EncodeToString(serverID)]
+	return addr, ok
+}
+
+func TestIndexResolver(t *testing.T) {
+	r := IndexResolver{"backend0", "backend1", "backend2"}
+	tests := []struct {
+		serverID []byte
+		want     string
+		wantOK   bool
+	}{
+		{serverID: []byte{0x00}, want: "backend0", wantOK: true},
+		{serverID: []byte{0x00, 0x02}, want: "backend2", wantOK: true},
+		{serverID: []byte{0x03}},
+		{serverID: []byte{0x01, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00}},
+	}
+	for _, tt := range tests {
+		if got, ok := r.Resolve(tt.serverID); got != tt.want || ok != tt.wantOK {
+			t.Errorf("Resolve(%x) = %q, %v, want %q, %v", tt.serverID, got, ok, tt.want, tt.wantOK)
+		}
+	}
+}
+
+func TestServerIDResolver(t *testing.T) {
+	backends := []string{"192.0.2.100:443", "192.0.2.101:443", "192.0.2.102:443"}
+	tests := []struct {
+		name     string
+		resolver ServerIDResolver
+		serverID byte
+		want     string
+		route    Route
+	}{
+		{name: "Default", serverID: 0x01, want: backends[1], route: RouteCID},
+		{name: "Index", resolver: IndexResolver(backends), serverID: 0x02, want: backends[2], route: RouteCID},
+		{name: "Map", resolver: mapResolver{"2a": backends[0], "07": backends[2]}, serverID: 0x2a, want: backends[0], route: RouteCID},
+		{name: "Map Unknown ID", resolver: mapResolver{"2a": backends[0]}, serverID: 0x01, route: RouteFallback},
+		{name: "Map Unknown Backend", resolver: mapResolver{"2a": "192.0.2.200:443"}, serverID: 0x2a, route: RouteFallback},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			lb, err := NewLoadBalancer(Config{Backends: StaticBackends(backends...), ServerIDResolver: tt.resolver})
+			if err != nil {
+				t.Fatalf("NewLoadBalancer() error = %v", err)
+			}
+			cid, err := lb.routes().codec.Encode(0, []byte{tt.serverID}, []byte{1, 2, 3, 4, 5, 6})
+			if err != nil {
+				t.Fatalf("Encode() error = %v", err)
+			}
+			short := append([]byte{0x40}, cid...)
+			got, err := lb.SelectBackend(short, testAddr(1))
+			if err != nil {
+				t.Fatalf("SelectBackend() error = %v", err)
+			}
+			if tt.want != "" && got != tt.want {
+				t.Errorf("SelectBackend() = %s, want %s", got, tt.want)
+			}
+			res, err := lb.DecodePacket(short, testAddr(1))
+			if err != nil || res.Route != tt.route {
+				t.Errorf("DecodePacket() routed by %s, %v, want %s", res.Route, err, tt.route)
+			}
+		})
+	}
+}
+
+func TestServerIDResolverConfig(t *testing.T) {
+	backends := StaticBackends("192.0.2.100:443", "192.0.2.101:443")
+	resolver := IndexResolver{"192.0.2.100:443", "192.0.2.101:443"}
+	tests := []struct {
+		name    string
+		cfg     Config
+		wantErr error
+	}{
+		{name: "Resolver", cfg: Config{Backends: backends, ServerIDResolver: resolver}},
+		{name: "With Truncated", cfg: Config{Backends: backends, ServerIDResolver: resolver,
+			TruncatedServerIDs: map[string]string{"00": "192.0.2.100:443"}}, wantErr: errBadServerIDs},
+		{name: "With Rotation Backends", cfg: Config{Backends: backends, ServerIDResolver: resolver,
+			QUICLB:           [quiclb.NumConfigs]quiclb.ConfigEntry{{Algorithm: quiclb.Plaintext, ServerIDLength: 1, NonceLength: 6}},
+			RotationBackends: [quiclb.NumConfigs][]string{{"192.0.2.101:443"}}}, wantErr: errBadServerIDs},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := NewLoadBalancer(tt.cfg); !errors.Is(err, tt.wantErr) {
+				t.Errorf("NewLoadBalancer() error = %v, want %v", err, tt.wantErr)
+			}
+		})
+	}
+}
@@ -0,0 +1,138 @@
+package lb
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/fqzz2000/QUIC-LB-SHRIMP/pkg/quiclb"
+)
+
+// errBadServerIDs is returned for an inconsistent explicit server ID mapping
+var errBadServerIDs = errors.New("invalid server ID mapping")
+
+// maxTotalServerIDLength is the widest server ID a mapping without a
+// DefaultBackend may cover exhaustively: 65536 entries
+const maxTotalServerIDLength = 2
+
+// serverIDMap resolves decoded server IDs through the explicit ServerIDs of
+// the backends, so several IDs can name one replica set. Without it a server
+// ID is an index into the backend list. Immutable once built.
+type serverIDMap struct {
+	ids        map[string]BackendConfig
+	defaultB   BackendConfig
+	hasDefault bool
+}
+
+// newServerIDMap builds the mapping from the backends' ServerIDs, or returns
+// nil when none sets any. Each ID must be claimed once and be a length some
+// active config decodes; IDs nobody claims go to DefaultBackend, and without
+// one the claims must cover every server ID the configs can produce.
+func newServerIDMap(cfg Config) (*serverIDMap, error) {
+	explicit := false
+	for _, b := range cfg.Backends {
+		explicit = explicit || len(b.ServerIDs) > 0
+	}
+	if !explicit {
+		if cfg.DefaultBackend != "" {
+			return nil, fmt.Errorf("%w: DefaultBackend needs backends with ServerIDs", errBadServerIDs)
+		}
+		return nil, nil
+	}
+	return buildServerIDMap(cfg.Backends, cfg.DefaultBackend, serverIDLengths(cfg.QUICLB), true)
+}
+
+// buildServerIDMap maps every claimed server ID, checking totality when
+// requireTotal is set and there is no default. Removed backends keep their
+// IDs mapped to a tombstone so decodes to them can be told from garbage.
+func buildServerIDMap(backends []BackendConfig, defaultBackend string, lengths map[int]bool, requireTotal bool) (*serverIDMap, error) {
+	m := &serverIDMap{ids: make(map[string]BackendConfig)}
+	for _, b := range backends {
+		for _, id := range b.ServerIDs {
+			if !lengths[len(id)] {
+				return nil, fmt.Errorf("%w: server ID %x of %s has a length no config decodes", errBadServerIDs, id, b.Address)
+			}
+			prev, dup := m.ids[string(id)]
+			switch {
+			case !dup || prev.removed():
+				// a live backend may re-home the ID of a removed one
+				m.ids[string(id)] = b
+			case b.removed():
+			default:
+				return nil, fmt.Errorf("%w: server ID %x claimed by %s and %s", errBadServerIDs, id, prev.Address, b.Address)
+			}
+		}
+	}
+
+	if defaultBackend != "" {
+		for _, b := range backends {
+			if b.Address == defaultBackend {
+				m.defaultB, m.hasDefault = b, true
+			}
+		}
+		if !m.hasDefault && requireTotal {
+			return nil, fmt.Errorf("%w: DefaultBackend %q is not a configured backend", errBadServerIDs, defaultBackend)
+		}
+		// a removed default leaves a tombstone
+		m.hasDefault = true
+		return m, nil
+	}
+	if !requireTotal {
+		return m, nil
+	}
+	for n := range lengths {
+		if n > maxTotalServerIDLength {
+			return nil, fmt.Errorf("%w: %d byte server IDs cannot all be mapped; set DefaultBackend", errBadServerIDs, n)
+		}
+		covered := 0
+		for id := range m.ids {
+			if len(id) == n {
+				covered++
+			}
+		}
+		if space := 1 << (8 * n); covered != space {
+			return nil, fmt.Errorf("%w: %d of %d %d byte server IDs mapped; map them all or set DefaultBackend", errBadServerIDs, covered, space, n)
+		}
+	}
+	return m, nil
+}
+
+// serverIDLengths returns the server ID lengths the active configs decode
+func serverIDLengths(entries [quiclb.NumConfigs]quiclb.ConfigEntry) map[int]bool {
+	lengths := make(map[int]bool)
+	for _, e := range entries {
+		if !e.Active() {
+			continue
+		}
+		if e.ServerIDLengthBits == 0 {
+			lengths[e.ServerIDLength] = true
+			continue
+		}
+		for n := 1; n <= e.ServerIDLength; n++ {
+			lengths[n] = true
+		}
+	}
+	return lengths
+}
+
+// lookup returns the backend a server ID maps to
+func (m *serverIDMap) lookup(serverID []byte) (BackendConfig, bool) {
+	if b, ok := m.ids[string(serverID)]; ok {
+		return b, true
+	}
+	return m.defaultB, m.hasDefault
+}
+
+// Unknown server ID policies (Config.UnknownServerIDs) decide where a new
+// flow goes when its CID decodes fine but names a server ID with no backend,
+// which points to a stale CID, a config mismatch between LB and servers, or
+// forged CIDs rather than a CID the LB cannot read. "fallback", the default,
+// routes it like a CID that does not decode; "drop" discards it; "pool"
+// sends it to the new-flow pool (see newflows.go), then the fallback.
+const (
+	unknownServerIDFallback = "fallback"
+	unknownServerIDDrop     = "drop"
+	unknownServerIDPool     = "pool"
+)
+
+// errUnknownServerIDPolicy is returned for an unknown Config.UnknownServerIDs
+var errUnknownServerIDPolicy = errors.New("unknown server ID policy")
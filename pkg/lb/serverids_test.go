@@ -0,0 +1,143 @@
+package lb
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestReplicaSetServerIDs(t *testing.T) {
+	lb, err := NewLoadBalancer(Config{
+		Backends: []BackendConfig{
+			{Address: "10.0.0.1:443", ServerIDs: [][]byte{{0x07}, {0x2a}}},
+			{Address: "10.0.0.2:443", ServerIDs: [][]byte{{0x01}}},
+		},
+		DefaultBackend: "10.0.0.2:443",
+	})
+	if err != nil {
+		t.Fatalf("NewLoadBalancer() error = %v", err)
+	}
+
+	tests := []struct {
+		serverID byte
+		want     string
+	}{
+		{serverID: 0x07, want: "10.0.0.1:443"},
+		{serverID: 0x2a, want: "10.0.0.1:443"},
+		{serverID: 0x01, want: "10.0.0.2:443"},
+		// unclaimed, not an index: goes to the default
+		{serverID: 0x00, want: "10.0.0.2:443"},
+	}
+	for _, tt := range tests {
+		cid, err := lb.routes().codec.Encode(0, []byte{tt.serverID}, nil)
+		if err != nil {
+			t.Fatalf("Encode() error = %v", err)
+		}
+		pkt := append([]byte{0x40}, cid...)
+		got, err := lb.SelectBackend(pkt, testAddr(1))
+		if err != nil || got != tt.want {
+			t.Errorf("SelectBackend(server ID %02x) = %q, %v, want %q", tt.serverID, got, err, tt.want)
+		}
+	}
+	if got := lb.Stats().DecodeFailures; got != 0 {
+		t.Errorf("DecodeFailures = %d, want 0", got)
+	}
+}
+
+func TestServerIDMapValidation(t *testing.T) {
+	full := make([][]byte, 256)
+	for i := range full {
+		full[i] = []byte{byte(i)}
+	}
+	tests := []struct {
+		name    string
+		cfg     Config
+		wantErr bool
+	}{
+		{
+			name: "total without default",
+			cfg:  Config{Backends: []BackendConfig{{Address: "a:1", ServerIDs: full[:128]}, {Address: "b:1", ServerIDs: full[128:]}}},
+		},
+		{
+			name:    "partial without default",
+			cfg:     Config{Backends: []BackendConfig{{Address: "a:1", ServerIDs: full[:255]}}},
+			wantErr: true,
+		},
+		{
+			name:    "duplicate claim",
+			cfg:     Config{Backends: []BackendConfig{{Address: "a:1", ServerIDs: [][]byte{{1}}}, {Address: "b:1", ServerIDs: [][]byte{{1}}}}, DefaultBackend: "a:1"},
+			wantErr: true,
+		},
+		{
+			name:    "wrong length",
+			cfg:     Config{Backends: []BackendConfig{{Address: "a:1", ServerIDs: [][]byte{{1, 2}}}}, DefaultBackend: "a:1"},
+			wantErr: true,
+		},
+		{
+			name:    "unknown default",
+			cfg:     Config{Backends: []BackendConfig{{Address: "a:1", ServerIDs: [][]byte{{1}}}}, DefaultBackend: "c:1"},
+			wantErr: true,
+		},
+		{
+			name:    "default without mapping",
+			cfg:     Config{Backends: StaticBackends("a:1"), DefaultBackend: "a:1"},
+			wantErr: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := NewLoadBalancer(tt.cfg)
+			if tt.wantErr != (err != nil) || (err != nil && !errors.Is(err, errBadServerIDs)) {
+				t.Errorf("NewLoadBalancer() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestUnknownServerIDPolicy(t *testing.T) {
+	// server ID 5 decodes but is beyond the three backends
+	cid := []byte{0x00, 0x05, 1, 1, 1, 1, 1, 1}
+	backends := []BackendConfig{{Address: "10.0.0.1:443"}, {Address: "10.0.0.2:443"}, {Address: "10.0.0.3:443", NewFlows: true}}
+
+	tests := []struct {
+		name    string
+		policy  string
+		want    string // backend address, or any backend when empty
+		wantErr error
+	}{
+		{name: "Default", policy: ""},
+		{name: "Fallback", policy: unknownServerIDFallback},
+		{name: "Drop", policy: unknownServerIDDrop, wantErr: ErrUnknownServerID},
+		{name: "Pool", policy: unknownServerIDPool, want: "10.0.0.3:443"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			lb, err := NewLoadBalancer(Config{Backends: backends, UnknownServerIDs: tt.policy})
+			if err != nil {
+				t.Fatalf("NewLoadBalancer() error = %v", err)
+			}
+			if _, err := lb.routeCID(cid); !errors.Is(err, ErrUnknownServerID) {
+				t.Fatalf("routeCID() error = %v, want %v", err, ErrUnknownServerID)
+			}
+			backend, err := lb.selectBackend(cid, testAddr(1))
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("selectBackend() error = %v, want %v", err, tt.wantErr)
+			}
+			if tt.want != "" && (backend.Address != tt.want || lb.Stats().NewFlowRouted != 1) {
+				t.Errorf("selectBackend() = %q, want new-flow pool %q", backend.Address, tt.want)
+			}
+			if tt.wantErr == nil && backend.Address == "" {
+				t.Errorf("selectBackend() routed nowhere, want a backend")
+			}
+			// counted when routing, not by routeCID itself
+			if got := lb.Stats().UnknownServerIDs; got != 1 {
+				t.Errorf("UnknownServerIDs = %d, want 1", got)
+			}
+		})
+	}
+
+	_, err := NewLoadBalancer(Config{Backends: backends, UnknownServerIDs: "reroute"})
+	if !errors.Is(err, errUnknownServerIDPolicy) {
+		t.Errorf("NewLoadBalancer(unknown policy) error = %v, want %v", err, errUnknownServerIDPolicy)
+	}
+}
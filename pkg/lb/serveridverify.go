@@ -0,0 +1,137 @@
+package lb
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"sync"
+)
+
+// Server ID verification (Config.VerifyServerIDs) catches drift between the
+// LB's server ID mapping and what backends put in the CIDs they issue,
+// which otherwise misroutes a backend's connections without a trace. Each
+// backend reports the server ID it encodes over the control channel, at
+// startup and then periodically, as one message:
+//
+//	0x04 rotation length serverID address	rotation is the config
+//		codepoint the backend issues CIDs with, length the server ID's
+//		length in bytes, serverID the server ID and address the
+//		backend's configured address, the remainder of the datagram
+//
+// The LB maps the server ID as it would one decoded from a CID. A server ID
+// of the wrong length for the rotation's config, of a rotation with no
+// config, or that maps to no backend or another backend is a mismatch:
+// counted, as an alert to fire on, and logged when the backend goes from
+// matching to mismatched. A matching report clears the mismatch. Over UDP a
+// report is only honored from the backend's own IP.
+
+// controlServerID is the opcode of a server ID self-report
+const controlServerID = 0x04
+
+// errServerIDReports is returned for server ID verification without a
+// control socket
+var errServerIDReports = errors.New("server ID verification needs a control address")
+
+// errServerIDMismatch is returned for a self-report the mapping disagrees with
+var errServerIDMismatch = errors.New("reported server ID does not match the mapping")
+
+// serverIDReports reports whether server ID self-reports are verified
+func (c *Config) serverIDReports() (bool, error) {
+	if c.VerifyServerIDs && c.ControlAddr == "" {
+		return false, errServerIDReports
+	}
+	return c.VerifyServerIDs, nil
+}
+
+// idMismatches holds the backends whose last self-report mismatched
+type idMismatches struct {
+	mu         sync.Mutex
+	mismatched map[string]bool
+}
+
+// newIDMismatches returns the verification state, nil when disabled
+func newIDMismatches(enabled bool) *idMismatches {
+	if !enabled {
+		return nil
+	}
+	return &idMismatches{mismatched: make(map[string]bool)}
+}
+
+// record notes the verdict on a backend's report, reporting whether it
+// changed from the last one
+func (m *idMismatches) record(addr string, match bool) bool {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	changed := m.mismatched[addr] == match
+	if match {
+		delete(m.mismatched, addr)
+	} else {
+		m.mismatched[addr] = true
+	}
+	return changed
+}
+
+// forget drops the verdict of a backend that is gone
+func (m *idMismatches) forget(addr string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	delete(m.mismatched, addr)
+}
+
+// count returns how many backends are mismatched
+func (m *idMismatches) count() int {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return len(m.mismatched)
+}
+
+// controlServerIDReport verifies a server ID self-report, the operand of a
+// controlServerID message from src
+func (lb *LoadBalancer) controlServerIDReport(operand []byte, src net.Addr) error {
+	if lb.idChecks == nil || len(operand) < 3 || len(operand) < 2+int(operand[1])+1 {
+		return errControlMessage
+	}
+	rotation, n := operand[0], int(operand[1])
+	serverID, addr := operand[2:2+n], string(operand[2+n:])
+	if _, ok := lb.backendByAddress(addr); !ok {
+		return fmt.Errorf("%w: no backend %q", errControlMessage, addr)
+	}
+	if !lb.fromBackendHost(addr, src) {
+		return errControlMessage
+	}
+	lb.stats.serverIDReports.Add(1)
+	err := lb.routes().verifyServerID(rotation, serverID, addr)
+	changed := lb.idChecks.record(addr, err == nil)
+	switch {
+	case err != nil:
+		// the report was acted on, so it is not an ignored control message
+		lb.stats.serverIDMismatches.Add(1)
+		if changed {
+			log.Printf("Backend %s server ID mismatch: %v", addr, err)
+		}
+	case changed:
+		log.Printf("Backend %s server ID %x matches the mapping again", addr, serverID)
+	}
+	return nil
+}
+
+// verifyServerID checks that serverID, in CIDs of the given rotation, maps
+// to the backend at addr
+func (rt *routingTable) verifyServerID(rotation uint8, serverID []byte, addr string) error {
+	cfg, active := rt.codec.Config(rotation)
+	if !active {
+		return fmt.Errorf("%w: %x at rotation %d, which has no config", errServerIDMismatch, serverID, rotation)
+	}
+	if len(serverID) != int(cfg.ServerIDLength) {
+		return fmt.Errorf("%w: %x is %d bytes, rotation %d uses %d", errServerIDMismatch, serverID, len(serverID), rotation, cfg.ServerIDLength)
+	}
+	backend, err := rt.backendForServerID(rotation, serverID)
+	if err != nil {
+		return fmt.Errorf("%w: %x: %w", errServerIDMismatch, serverID, err)
+	}
+	if backend.Address != addr {
+		return fmt.Errorf("%w: %x maps to %s", errServerIDMismatch, serverID, backend.Address)
+	}
+	return nil
+}
@@ -0,0 +1,105 @@
+package lb
+
+import (
+	"errors"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// serverIDMessage is a server ID self-report of addr
+func serverIDMessage(addr string, rotation uint8, serverID ...byte) []byte {
+	msg := append([]byte{controlServerID, rotation, byte(len(serverID))}, serverID...)
+	return append(msg, addr...)
+}
+
+func TestServerIDReport(t *testing.T) {
+	backend := &net.UDPAddr{IP: net.IPv4(192, 0, 2, 100), Port: 443}
+	other := "192.0.2.101:443"
+	tests := []struct {
+		name         string
+		disabled     bool
+		msg          []byte
+		src          net.Addr
+		wantErr      error
+		wantMismatch bool
+	}{
+		{name: "Match", msg: serverIDMessage(backend.String(), 0, 0x00), src: backend},
+		{name: "Unix Socket", msg: serverIDMessage(backend.String(), 0, 0x00), src: &net.UnixAddr{Name: "backend", Net: "unixgram"}},
+		{name: "Another Backend's ID", msg: serverIDMessage(backend.String(), 0, 0x01), src: backend, wantMismatch: true},
+		{name: "Unmapped ID", msg: serverIDMessage(backend.String(), 0, 0x05), src: backend, wantMismatch: true},
+		{name: "Wrong Length", msg: serverIDMessage(backend.String(), 0, 0x00, 0x00), src: backend, wantMismatch: true},
+		{name: "Rotation Without Config", msg: serverIDMessage(backend.String(), 1, 0x00), src: backend, wantMismatch: true},
+		{name: "From Elsewhere", msg: serverIDMessage(backend.String(), 0, 0x01), src: testAddr(1), wantErr: errControlMessage},
+		{name: "Unknown Backend", msg: serverIDMessage("192.0.2.200:443", 0, 0x00), src: backend, wantErr: errControlMessage},
+		{name: "Truncated", msg: []byte{controlServerID, 0, 4, 0x00}, src: backend, wantErr: errControlMessage},
+		{name: "Disabled", disabled: true, msg: serverIDMessage(backend.String(), 0, 0x01), src: backend, wantErr: errControlMessage},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := Config{Backends: StaticBackends(backend.String(), other), ControlAddr: "127.0.0.1:0", VerifyServerIDs: !tt.disabled}
+			lb, err := NewLoadBalancer(cfg)
+			if err != nil {
+				t.Fatalf("NewLoadBalancer() error = %v", err)
+			}
+			if err := lb.handleControl(tt.msg, tt.src); !errors.Is(err, tt.wantErr) {
+				t.Fatalf("handleControl() error = %v, want %v", err, tt.wantErr)
+			}
+			st := lb.Stats()
+			if got, want := st.ServerIDReports, uint64(0); (got == want) != (tt.wantErr != nil) {
+				t.Errorf("ServerIDReports = %d, want a report verified only without an error", got)
+			}
+			if got := st.ServerIDMismatches; (got == 1) != tt.wantMismatch {
+				t.Errorf("ServerIDMismatches = %d, want mismatch %v", got, tt.wantMismatch)
+			}
+		})
+	}
+}
+
+func TestServerIDMismatchAlert(t *testing.T) {
+	backend := &net.UDPAddr{IP: net.IPv4(192, 0, 2, 100), Port: 443}
+	lb, err := NewLoadBalancer(Config{
+		Backends:        StaticBackends(backend.String(), "192.0.2.101:443"),
+		ControlAddr:     "127.0.0.1:0",
+		VerifyServerIDs: true,
+	})
+	if err != nil {
+		t.Fatalf("NewLoadBalancer() error = %v", err)
+	}
+	scrape := func() string {
+		t.Helper()
+		rec := httptest.NewRecorder()
+		lb.adminHandler().ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+		return rec.Body.String()
+	}
+
+	// the backend believes it is server 0x01, which the LB maps elsewhere
+	if err := lb.handleControl(serverIDMessage(backend.String(), 0, 0x01), backend); err != nil {
+		t.Fatalf("handleControl() error = %v", err)
+	}
+	body := scrape()
+	for _, want := range []string{"shrimp_server_id_mismatches_total 1", "shrimp_server_id_mismatched_backends 1"} {
+		if !strings.Contains(body, want) {
+			t.Errorf("/metrics missing %q after a mismatched report", want)
+		}
+	}
+
+	// a report matching the mapping clears the backend, not the count
+	if err := lb.handleControl(serverIDMessage(backend.String(), 0, 0x00), backend); err != nil {
+		t.Fatalf("handleControl() error = %v", err)
+	}
+	body = scrape()
+	for _, want := range []string{"shrimp_server_id_mismatches_total 1", "shrimp_server_id_mismatched_backends 0", "shrimp_server_id_reports_total 2"} {
+		if !strings.Contains(body, want) {
+			t.Errorf("/metrics missing %q after a matching report", want)
+		}
+	}
+}
+
+func TestServerIDReportsConfig(t *testing.T) {
+	if _, err := (&Config{VerifyServerIDs: true}).serverIDReports(); !errors.Is(err, errServerIDReports) {
+		t.Errorf("serverIDReports() error = %v, want %v", err, errServerIDReports)
+	}
+}
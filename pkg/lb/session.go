@@ -0,0 +1,552 @@
+package lb
+
+import (
+	"errors"
+	"fmt"
+	"hash/maphash"
+	"net"
+	"net/netip"
+	"slices"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/fqzz2000/QUIC-LB-SHRIMP/pkg/packet"
+)
+
+// Flow is the load balancer's state for one client connection
+type Flow struct {
+	// Backend is the backend chosen when the flow opened. Every later
+	// packet of the flow goes to it, whatever ring or config changes come
+	// in between; only new flows see those.
+	Backend string
+	Created time.Time
+
+	// source is the IP counted against the per-source flow cap, unset
+	// without one
+	source netip.Addr
+	// home is one more than the session table shard the flow is homed in,
+	// zero until it is first indexed
+	home atomic.Uint32
+	// removed is set, under the home shard's flowsMu, once the flow has left
+	// the table, which it never rejoins
+	removed bool
+
+	// idle is the idle timeout that reaps the flow once established,
+	// chosen when it opened; zero for the global one
+	idle time.Duration
+
+	// ln is the extra listener the flow opened on, which answers its
+	// client; nil for the main listener
+	ln *clientListener
+
+	mu       sync.Mutex
+	client   net.Addr
+	lastSeen time.Time
+
+	// traffic in each direction, whose packets decide when the flow is
+	// established
+	traffic flowTraffic
+
+	// anti-amplification accounting until the client address is validated
+	validated bool
+	rxBytes   uint64
+	txBytes   uint64
+
+	// rewritten holds the flow's CID mappings when the LB rewrites CIDs
+	rewritten rewrittenCIDs
+
+	// early holds 0-RTT packets under the delay policy until oneRTT is set
+	// by the first 1-RTT packet
+	early  [][]byte
+	oneRTT bool
+
+	// earlyData is set once the flow forwards 0-RTT before 1-RTT, and
+	// earlyTxBytes counts what has been returned under the 0-RTT limit since
+	earlyData    bool
+	earlyTxBytes uint64
+
+	// egress is the backend's egress rate bucket, nil when it sets none
+	egress *egressBucket
+
+	// conn is the connected socket carrying this flow to and from the backend
+	conn net.Conn
+	// shadow, when the flow is sampled for mirroring, carries copies of its
+	// client datagrams to the shadow backend; it is never read
+	shadow net.Conn
+}
+
+// flowTraffic counts a flow's packets and bytes in each direction: from the
+// client, and from the backend whether or not they reached the client, and
+// the client's datagrams carrying an Initial. Atomics, so forwarding updates
+// them without the flow's mutex.
+type flowTraffic struct {
+	clientPackets  atomic.Uint64
+	clientBytes    atomic.Uint64
+	backendPackets atomic.Uint64
+	backendBytes   atomic.Uint64
+	initials       atomic.Uint64
+}
+
+// ClientAddr returns the address responses for the flow are sent to
+func (f *Flow) ClientAddr() net.Addr {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.client
+}
+
+// touch records activity and, when addr is non-nil, updates the client address
+func (f *Flow) touch(addr net.Addr, now time.Time) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if addr != nil {
+		f.client = addr
+	}
+	f.lastSeen = now
+}
+
+// addrKey returns the string a client address is keyed and hashed by. An
+// IPv4-mapped IPv6 address is unmapped, so a client a dual-stack listener
+// reports in either form is one client.
+func addrKey(addr net.Addr) string {
+	if u, ok := udpAddr(addr); ok {
+		return netip.AddrPortFrom(u.AddrPort().Addr().Unmap(), uint16(u.Port)).String()
+	}
+	return addr.String()
+}
+
+// The session table is split into shards to keep flows from contending on
+// one lock. Each index key, a CID, client address or client-chosen CID, lives
+// in the shard its hash picks, under that shard's keysMu, so lookups and the
+// per-packet remember of a known flow lock only the shards of their keys.
+// Each flow is homed in one shard, picked round robin when it is first
+// indexed, whose flowsMu guards its membership, its list of keys and the
+// per-backend counts; adding and removing flows locks only their home.
+// Writes to a key shard hold the writing flow's home flowsMu as well, and
+// locks are taken in that order, with at most one of each held, so there is
+// no deadlock; only snapshot holds every flowsMu, taken in index order. The per-source counts sit under their own leaf lock.
+
+// defaultSessionShards is how many shards the session table has unless configured
+const defaultSessionShards = 16
+
+// errSessionShards is returned for a negative Config.SessionShards
+var errSessionShards = errors.New("invalid session shard count")
+
+// sessionShards returns the configured shard count
+func (c *Config) sessionShards() (int, error) {
+	switch {
+	case c.SessionShards < 0:
+		return 0, fmt.Errorf("%w: %d", errSessionShards, c.SessionShards)
+	case c.SessionShards == 0:
+		return defaultSessionShards, nil
+	}
+	return c.SessionShards, nil
+}
+
+// sessionTable indexes flows by the connection IDs and client addresses seen for them
+type sessionTable struct {
+	seed   maphash.Seed
+	shards []sessionShard
+	homes  atomic.Uint32 // flows homed so far, for round robin
+
+	// lengths counts indexed CIDs by length, the lengths besides the
+	// configured one a short header's DCID is looked up at
+	lengths [packet.MaxCIDLength + 1]atomic.Int64
+
+	// sources counts the flows of each source IP under a per-source cap
+	srcMu   sync.Mutex
+	sources map[netip.Addr]*sourceFlows
+}
+
+// sessionShard is one shard of the session table's keys and of its flows
+type sessionShard struct {
+	keysMu sync.Mutex
+	byCID  map[string]*Flow
+	byAddr map[string]*Flow
+	// byClientCID indexes flows by the CID their client chose for itself,
+	// which backend long headers carry as DCID, per backend since clients
+	// choose theirs independently
+	byClientCID map[clientCIDKey]*Flow
+
+	flowsMu sync.Mutex
+	keys    map[*Flow]*flowKeys // the flows homed here
+	// backendFlows counts the active flows homed here per backend address
+	backendFlows map[string]int
+}
+
+// clientCIDKey identifies a client-chosen CID at one backend
+type clientCIDKey struct {
+	backend string
+	cid     string
+}
+
+// flowKeys are the index entries owned by a flow, kept so removal is cheap
+type flowKeys struct {
+	cids       []string
+	addrs      []string
+	clientCIDs []clientCIDKey
+}
+
+// newSessionTable returns a table of n shards, at least one
+func newSessionTable(n int) *sessionTable {
+	t := &sessionTable{seed: maphash.MakeSeed(), shards: make([]sessionShard, max(n, 1)), sources: make(map[netip.Addr]*sourceFlows)}
+	for i := range t.shards {
+		s := &t.shards[i]
+		s.byCID = make(map[string]*Flow)
+		s.byAddr = make(map[string]*Flow)
+		s.byClientCID = make(map[clientCIDKey]*Flow)
+		s.keys = make(map[*Flow]*flowKeys)
+		s.backendFlows = make(map[string]int)
+	}
+	return t
+}
+
+// shardOf returns the shard holding a key
+func (t *sessionTable) shardOf(key string) *sessionShard {
+	if len(t.shards) == 1 {
+		return &t.shards[0]
+	}
+	return &t.shards[maphash.String(t.seed, key)%uint64(len(t.shards))]
+}
+
+// clientCIDShard returns the shard holding a client-chosen CID
+func (t *sessionTable) clientCIDShard(k clientCIDKey) *sessionShard {
+	return t.shardOf(k.cid)
+}
+
+// home returns the shard a flow is homed in, homing it on first use
+func (t *sessionTable) home(f *Flow) *sessionShard {
+	h := f.home.Load()
+	if h == 0 {
+		f.home.CompareAndSwap(0, t.homes.Add(1))
+		h = f.home.Load()
+	}
+	return &t.shards[(h-1)%uint32(len(t.shards))]
+}
+
+// cidOwner, addrOwner and clientCIDOwner return the flow a key of the
+// shard points at
+func (s *sessionShard) cidOwner(cid string) *Flow {
+	s.keysMu.Lock()
+	defer s.keysMu.Unlock()
+	return s.byCID[cid]
+}
+
+func (s *sessionShard) addrOwner(a string) *Flow {
+	s.keysMu.Lock()
+	defer s.keysMu.Unlock()
+	return s.byAddr[a]
+}
+
+func (s *sessionShard) clientCIDOwner(k clientCIDKey) *Flow {
+	s.keysMu.Lock()
+	defer s.keysMu.Unlock()
+	return s.byClientCID[k]
+}
+
+// lookup finds the flow for a connection ID, falling back to the client address
+func (t *sessionTable) lookup(cid []byte, addr net.Addr) *Flow {
+	if len(cid) > 0 {
+		if f := t.shardOf(string(cid)).cidOwner(string(cid)); f != nil {
+			return f
+		}
+	}
+	a := addrKey(addr)
+	return t.shardOf(a).addrOwner(a)
+}
+
+// lookupCID finds the flow for a connection ID alone
+func (t *sessionTable) lookupCID(cid []byte) *Flow {
+	return t.shardOf(string(cid)).cidOwner(string(cid))
+}
+
+// remember associates a connection ID and client address with a flow,
+// adding it to the table on its first packet. A flow already indexed under
+// both, as for most packets, only has its keys checked in their shards. A
+// flow removed since it was looked up, by the reaper or a backend's
+// removal, is not added back: its backend socket is closed.
+func (t *sessionTable) remember(f *Flow, cid []byte, addr net.Addr) {
+	a := addrKey(addr)
+	if (len(cid) == 0 || t.shardOf(string(cid)).cidOwner(string(cid)) == f) && t.shardOf(a).addrOwner(a) == f {
+		return
+	}
+	home := t.home(f)
+	home.flowsMu.Lock()
+	defer home.flowsMu.Unlock()
+	if f.removed {
+		return
+	}
+	keys := home.keys[f]
+	if keys == nil {
+		keys = &flowKeys{}
+		home.keys[f] = keys
+		home.backendFlows[f.Backend]++
+		if f.source.IsValid() {
+			t.srcMu.Lock()
+			if t.sources[f.source] == nil {
+				t.sources[f.source] = &sourceFlows{}
+			}
+			t.sources[f.source].flows++
+			t.srcMu.Unlock()
+		}
+	}
+	if len(cid) > 0 && t.setCID(string(cid), f) {
+		keys.cids = append(keys.cids, string(cid))
+	}
+	if t.setAddr(a, f) {
+		keys.addrs = append(keys.addrs, a)
+	}
+}
+
+// learnCID indexes a connection ID for a flow already in the table. Unlike
+// remember it never adds the flow, so a CID learned while the flow is being
+// removed cannot resurrect it.
+func (t *sessionTable) learnCID(f *Flow, cid []byte) {
+	home := t.home(f)
+	home.flowsMu.Lock()
+	defer home.flowsMu.Unlock()
+	keys := home.keys[f]
+	if keys == nil || len(cid) == 0 {
+		return
+	}
+	if t.setCID(string(cid), f) {
+		keys.cids = append(keys.cids, string(cid))
+	}
+}
+
+// learnClientCID indexes the CID a flow's client chose for itself, for a
+// flow already in the table
+func (t *sessionTable) learnClientCID(f *Flow, cid []byte) {
+	home := t.home(f)
+	home.flowsMu.Lock()
+	defer home.flowsMu.Unlock()
+	keys := home.keys[f]
+	if keys == nil || len(cid) == 0 {
+		return
+	}
+	key := clientCIDKey{backend: f.Backend, cid: string(cid)}
+	s := t.clientCIDShard(key)
+	s.keysMu.Lock()
+	defer s.keysMu.Unlock()
+	if s.byClientCID[key] == f {
+		return
+	}
+	s.byClientCID[key] = f
+	keys.clientCIDs = append(keys.clientCIDs, key)
+}
+
+// lookupClientCID finds the flow to a backend whose client chose cid
+func (t *sessionTable) lookupClientCID(backend string, cid []byte) *Flow {
+	key := clientCIDKey{backend: backend, cid: string(cid)}
+	return t.clientCIDShard(key).clientCIDOwner(key)
+}
+
+// setCID points cid at f, reporting false when it already did. Its length is
+// counted when it is new to the index; a CID moving between flows keeps its
+// count until it leaves. The caller holds f's home flowsMu.
+func (t *sessionTable) setCID(cid string, f *Flow) bool {
+	s := t.shardOf(cid)
+	s.keysMu.Lock()
+	defer s.keysMu.Unlock()
+	prev, ok := s.byCID[cid]
+	if prev == f {
+		return false
+	}
+	if !ok && len(cid) <= packet.MaxCIDLength {
+		t.lengths[len(cid)].Add(1)
+	}
+	s.byCID[cid] = f
+	return true
+}
+
+// setAddr points a client address at f, reporting false when it already
+// did. The caller holds f's home flowsMu.
+func (t *sessionTable) setAddr(a string, f *Flow) bool {
+	s := t.shardOf(a)
+	s.keysMu.Lock()
+	defer s.keysMu.Unlock()
+	if s.byAddr[a] == f {
+		return false
+	}
+	s.byAddr[a] = f
+	return true
+}
+
+// lookupShort finds the flow for a short header, whose DCID length is not on
+// the wire. The configured length, giving cid, is tried first, then every
+// other length a flow has a CID of, longest first: a server that moved a
+// connection to CIDs of another length announced them in long headers, which
+// carry their length, so its short headers are still found. It returns the
+// flow and the DCID it matched, or cid with the address fallback.
+func (t *sessionTable) lookupShort(pkt, cid []byte, addr net.Addr) (*Flow, []byte) {
+	if len(cid) > 0 {
+		if f := t.lookupCID(cid); f != nil {
+			return f, cid
+		}
+	}
+	for n := min(len(pkt)-1, packet.MaxCIDLength); n > 0; n-- {
+		if n == len(cid) || t.lengths[n].Load() == 0 {
+			continue
+		}
+		if f := t.lookupCID(pkt[1 : 1+n]); f != nil {
+			return f, pkt[1 : 1+n]
+		}
+	}
+	a := addrKey(addr)
+	return t.shardOf(a).addrOwner(a), cid
+}
+
+// remove drops a flow and every index entry still pointing at it
+func (t *sessionTable) remove(f *Flow) {
+	home := t.home(f)
+	home.flowsMu.Lock()
+	defer home.flowsMu.Unlock()
+	f.removed = true
+	keys := home.keys[f]
+	if keys == nil {
+		return
+	}
+	for _, cid := range keys.cids {
+		s := t.shardOf(cid)
+		s.keysMu.Lock()
+		if s.byCID[cid] == f {
+			delete(s.byCID, cid)
+			if len(cid) <= packet.MaxCIDLength {
+				t.lengths[len(cid)].Add(-1)
+			}
+		}
+		s.keysMu.Unlock()
+	}
+	for _, a := range keys.addrs {
+		s := t.shardOf(a)
+		s.keysMu.Lock()
+		if s.byAddr[a] == f {
+			delete(s.byAddr, a)
+		}
+		s.keysMu.Unlock()
+	}
+	for _, k := range keys.clientCIDs {
+		s := t.clientCIDShard(k)
+		s.keysMu.Lock()
+		if s.byClientCID[k] == f {
+			delete(s.byClientCID, k)
+		}
+		s.keysMu.Unlock()
+	}
+	delete(home.keys, f)
+	if home.backendFlows[f.Backend]--; home.backendFlows[f.Backend] <= 0 {
+		delete(home.backendFlows, f.Backend)
+	}
+	t.srcMu.Lock()
+	if s := t.sources[f.source]; s != nil {
+		if s.flows--; s.flows <= 0 {
+			delete(t.sources, f.source)
+		}
+	}
+	t.srcMu.Unlock()
+}
+
+// cidsOf returns the connection IDs the flow is known by
+func (t *sessionTable) cidsOf(f *Flow) []string {
+	home := t.home(f)
+	home.flowsMu.Lock()
+	defer home.flowsMu.Unlock()
+	if keys := home.keys[f]; keys != nil {
+		return append([]string(nil), keys.cids...)
+	}
+	return nil
+}
+
+// backendFlowCount returns the number of flows routed to the backend at addr
+func (t *sessionTable) backendFlowCount(addr string) int {
+	n := 0
+	for i := range t.shards {
+		s := &t.shards[i]
+		s.flowsMu.Lock()
+		n += s.backendFlows[addr]
+		s.flowsMu.Unlock()
+	}
+	return n
+}
+
+// flowCounts returns the number of flows in total and per backend address
+func (t *sessionTable) flowCounts() (int, map[string]int) {
+	total, perBackend := 0, make(map[string]int)
+	for i := range t.shards {
+		s := &t.shards[i]
+		s.flowsMu.Lock()
+		total += len(s.keys)
+		for b, n := range s.backendFlows {
+			perBackend[b] += n
+		}
+		s.flowsMu.Unlock()
+	}
+	return total, perBackend
+}
+
+// flows returns every flow in the table, walking each shard in turn
+func (t *sessionTable) flows() []*Flow {
+	var out []*Flow
+	for i := range t.shards {
+		s := &t.shards[i]
+		s.flowsMu.Lock()
+		out = slices.Grow(out, len(s.keys))
+		for f := range s.keys {
+			out = append(out, f)
+		}
+		s.flowsMu.Unlock()
+	}
+	return out
+}
+
+// flowSnapshot is a flow and the index keys pointing at it when the table
+// was snapshotted
+type flowSnapshot struct {
+	flow  *Flow
+	cids  []string
+	addrs []string
+}
+
+// snapshot copies every flow with its live keys, so admin reads do their
+// slower work on the copy without holding up forwarding longer than the
+// copy takes. It holds every shard's flowsMu, which every change to flow
+// membership and keys takes, for the whole copy, so the snapshot is of one
+// point in time: each flow appears once, with all the keys it held then.
+// Keys are strings shared with the index.
+func (t *sessionTable) snapshot() []flowSnapshot {
+	// in index order, the only place more than one flowsMu is held
+	for i := range t.shards {
+		t.shards[i].flowsMu.Lock()
+	}
+	defer func() {
+		for i := range t.shards {
+			t.shards[i].flowsMu.Unlock()
+		}
+	}()
+	var out []flowSnapshot
+	for i := range t.shards {
+		out = t.shards[i].snapshot(t, out)
+	}
+	return out
+}
+
+// snapshot appends the shard's flows with their live keys to out. The
+// caller holds s.flowsMu.
+func (s *sessionShard) snapshot(t *sessionTable, out []flowSnapshot) []flowSnapshot {
+	out = slices.Grow(out, len(s.keys))
+	for f, k := range s.keys {
+		snap := flowSnapshot{flow: f}
+		for _, cid := range k.cids {
+			if t.shardOf(cid).cidOwner(cid) == f {
+				snap.cids = append(snap.cids, cid)
+			}
+		}
+		for _, a := range k.addrs {
+			if t.shardOf(a).addrOwner(a) == f {
+				snap.addrs = append(snap.addrs, a)
+			}
+		}
+		out = append(out, snap)
+	}
+	return out
+}
@@ -0,0 +1,357 @@
+package lb
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"net/netip"
+	"sync"
+	"sync/atomic"
+	"testing"
+)
+
+func TestMappedAddressesKeyAsIPv4(t *testing.T) {
+	v4 := &net.UDPAddr{IP: net.IPv4(192, 0, 2, 7).To4(), Port: 50000}
+	mapped := &net.UDPAddr{IP: net.ParseIP("::ffff:192.0.2.7"), Port: 50000}
+	if len(mapped.IP) == len(v4.IP) {
+		t.Fatalf("test addresses do not differ in form")
+	}
+	if a, b := addrKey(v4), addrKey(mapped); a != b {
+		t.Errorf("addrKey() = %q and %q, want equal", a, b)
+	}
+	if a, b := addrKey(v4), addrKey(&net.UDPAddr{IP: net.ParseIP("2001:db8::7"), Port: 50000}); a == b {
+		t.Errorf("addrKey() of distinct clients both %q", a)
+	}
+
+	table := newSessionTable(defaultSessionShards)
+	flow := &Flow{Backend: "192.0.2.100:443"}
+	table.remember(flow, nil, mapped)
+	if got := table.lookup(nil, v4); got != flow {
+		t.Errorf("lookup(%s) after remember(%s) = %v, want the flow", v4, mapped, got)
+	}
+	table.remove(flow)
+	if got := table.lookup(nil, v4); got != nil {
+		t.Errorf("lookup() after remove = %v, want nil", got)
+	}
+
+	lb, err := NewLoadBalancer(Config{
+		Backends:      StaticBackends("192.0.2.100:443", "192.0.2.101:443", "192.0.2.102:443"),
+		SourcePortMin: 40000,
+		SourcePortMax: 49999,
+	})
+	if err != nil {
+		t.Fatalf("NewLoadBalancer() error = %v", err)
+	}
+	local := &net.UDPAddr{IP: net.IPv4(198, 51, 100, 1), Port: 443}
+	localMapped := &net.UDPAddr{IP: net.ParseIP("::ffff:198.51.100.1"), Port: 443}
+	if a, b := lb.sourcePort(v4, local), lb.sourcePort(mapped, localMapped); a != b {
+		t.Errorf("sourcePort() = %d and %d, want equal", a, b)
+	}
+	for i := range 16 {
+		v4.Port, mapped.Port = 50000+i, 50000+i
+		a, _ := lb.fallbackBackend(lb.routes(), nil, v4)
+		b, _ := lb.fallbackBackend(lb.routes(), nil, mapped)
+		if a.Address != b.Address {
+			t.Errorf("fallbackBackend(%s) = %s, fallbackBackend(%s) = %s, want equal", v4, a.Address, mapped, b.Address)
+		}
+	}
+}
+
+func TestSessionSnapshot(t *testing.T) {
+	table := newSessionTable(defaultSessionShards)
+	permanent := make(map[*Flow]int)
+	for i := range 64 {
+		f := &Flow{Backend: "192.0.2.100:443"}
+		table.remember(f, []byte(fmt.Sprintf("p%d", i)), testAddr(i))
+		permanent[f] = i
+	}
+
+	// a snapshot is unchanged by what the table does after it
+	snap := table.snapshot()
+	for f, i := range permanent {
+		// a removed flow stays gone, so another takes over its keys
+		table.learnCID(f, []byte("later"))
+		table.remove(f)
+		next := &Flow{Backend: f.Backend}
+		table.remember(next, []byte(fmt.Sprintf("p%d", i)), testAddr(i))
+		delete(permanent, f)
+		permanent[next] = i
+		break
+	}
+	if len(snap) != 64 {
+		t.Fatalf("snapshot() = %d flows, want 64", len(snap))
+	}
+	for _, s := range snap {
+		if len(s.cids) != 1 || len(s.addrs) != 1 {
+			t.Errorf("snapshot() flow keys = %q, %q, want one CID and one address", s.cids, s.addrs)
+		}
+	}
+
+	// under concurrent inserts and removals every snapshot holds each flow
+	// once, with all the keys one remember gave it, and is of one point in
+	// time across shards: a flow handed off to the next, which is inserted
+	// before it is removed, always leaves one of the two in the table
+	var stop atomic.Bool
+	var wg sync.WaitGroup
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		for j := 0; !stop.Load(); j++ {
+			f := &Flow{Backend: "192.0.2.101:443"}
+			table.remember(f, []byte(fmt.Sprintf("c%d", j)), &net.UDPAddr{IP: net.IPv4(198, 51, 100, 1), Port: j % 65536})
+			table.remove(f)
+		}
+	}()
+	const handoff = "192.0.2.102:443"
+	prev := &Flow{Backend: handoff}
+	table.remember(prev, []byte("h"), &net.UDPAddr{IP: net.IPv4(198, 51, 100, 2), Port: 1})
+	go func() {
+		defer wg.Done()
+		for j := 0; !stop.Load(); j++ {
+			next := &Flow{Backend: handoff}
+			table.remember(next, []byte(fmt.Sprintf("h%d", j)), &net.UDPAddr{IP: net.IPv4(198, 51, 100, 2), Port: 2 + j%65534})
+			table.remove(prev)
+			prev = next
+		}
+	}()
+	for range 200 {
+		seen := make(map[*Flow]bool)
+		handoffs := 0
+		for _, s := range table.snapshot() {
+			if s.flow.Backend == handoff {
+				handoffs++
+			}
+			if seen[s.flow] {
+				t.Fatalf("snapshot() holds a flow twice")
+			}
+			seen[s.flow] = true
+			if len(s.cids) != 1 || len(s.addrs) != 1 {
+				t.Fatalf("snapshot() flow keys = %q, %q, want one CID and one address", s.cids, s.addrs)
+			}
+			if i, ok := permanent[s.flow]; ok && s.cids[0] != fmt.Sprintf("p%d", i) {
+				t.Fatalf("snapshot() flow CID = %q, want p%d", s.cids[0], i)
+			}
+		}
+		for f := range permanent {
+			if !seen[f] {
+				t.Fatalf("snapshot() is missing a flow that was never removed")
+			}
+		}
+		if handoffs == 0 {
+			t.Fatalf("snapshot() holds neither flow of a handoff")
+		}
+	}
+	stop.Store(true)
+	wg.Wait()
+}
+
+// BenchmarkLookupDuringSnapshot measures session lookups from parallel
+// workers against a large table, alone and with an admin reader exporting
+// it in a loop
+func BenchmarkLookupDuringSnapshot(b *testing.B) {
+	table := newSessionTable(defaultSessionShards)
+	cids := make([][]byte, 10000)
+	for i := range cids {
+		cids[i] = []byte(fmt.Sprintf("cid-%05d", i))
+		addr := &net.UDPAddr{IP: net.IPv4(198, 51, 100, byte(i)), Port: 4433 + i/256}
+		table.remember(&Flow{Backend: "192.0.2.100:443", client: addr}, cids[i], addr)
+	}
+	lookups := func(b *testing.B) {
+		b.RunParallel(func(pb *testing.PB) {
+			i := 0
+			for pb.Next() {
+				table.lookup(cids[i%len(cids)], testAddr(1))
+				i++
+			}
+		})
+	}
+	b.Run("Alone", lookups)
+	b.Run("Exporting", func(b *testing.B) {
+		var stop atomic.Bool
+		done := make(chan struct{})
+		go func() {
+			defer close(done)
+			for !stop.Load() {
+				table.export()
+			}
+		}()
+		lookups(b)
+		stop.Store(true)
+		<-done
+	})
+}
+
+func TestSessionShards(t *testing.T) {
+	table := newSessionTable(8)
+	flows := make([]*Flow, 64)
+	for i := range flows {
+		flows[i] = &Flow{Backend: fmt.Sprintf("192.0.2.%d:443", 100+i%2)}
+		addr := &net.UDPAddr{IP: net.IPv4(198, 51, 100, byte(i)), Port: 4433}
+		table.remember(flows[i], []byte(fmt.Sprintf("cid-%02d", i)), addr)
+		table.learnCID(flows[i], []byte(fmt.Sprintf("alt-%02d-long", i)))
+		table.learnClientCID(flows[i], []byte(fmt.Sprintf("client-%02d", i)))
+	}
+	homes := make(map[*sessionShard]bool)
+	for _, f := range flows {
+		homes[table.home(f)] = true
+	}
+	if len(homes) != 8 {
+		t.Fatalf("flows are homed in %d shards, want all 8", len(homes))
+	}
+
+	for i, f := range flows {
+		addr := &net.UDPAddr{IP: net.IPv4(198, 51, 100, byte(i)), Port: 4433}
+		if got := table.lookup([]byte(fmt.Sprintf("cid-%02d", i)), testAddr(250)); got != f {
+			t.Errorf("lookup(cid-%02d) = %p, want %p", i, got, f)
+		}
+		if got := table.lookup(nil, addr); got != f {
+			t.Errorf("lookup(%s) = %p, want %p", addr, got, f)
+		}
+		if got := table.lookupClientCID(f.Backend, []byte(fmt.Sprintf("client-%02d", i))); got != f {
+			t.Errorf("lookupClientCID(client-%02d) = %p, want %p", i, got, f)
+		}
+		// a short header carrying the longer CID is found at its length
+		pkt := append([]byte{0x40}, fmt.Sprintf("alt-%02d-long", i)...)
+		if got, matched := table.lookupShort(pkt, pkt[1:7], testAddr(250)); got != f || string(matched) != fmt.Sprintf("alt-%02d-long", i) {
+			t.Errorf("lookupShort(alt-%02d-long) = %p, %q, want %p", i, got, matched, f)
+		}
+	}
+	if total, perBackend := table.flowCounts(); total != 64 || perBackend["192.0.2.100:443"] != 32 || perBackend["192.0.2.101:443"] != 32 {
+		t.Errorf("flowCounts() = %d, %v, want 64 split evenly", total, perBackend)
+	}
+	if got := table.backendFlowCount("192.0.2.101:443"); got != 32 {
+		t.Errorf("backendFlowCount() = %d, want 32", got)
+	}
+	if got := len(table.flows()); got != 64 {
+		t.Errorf("flows() = %d flows, want every shard's 64", got)
+	}
+
+	for _, f := range flows {
+		table.remove(f)
+	}
+	for i := range table.shards {
+		s := &table.shards[i]
+		if len(s.byCID)+len(s.byAddr)+len(s.byClientCID)+len(s.keys)+len(s.backendFlows) != 0 {
+			t.Errorf("shard %d holds entries after every flow was removed", i)
+		}
+	}
+	for n := range table.lengths {
+		if got := table.lengths[n].Load(); got != 0 {
+			t.Errorf("lengths[%d] = %d after every flow was removed, want 0", n, got)
+		}
+	}
+}
+
+func TestRemovedFlowStaysGone(t *testing.T) {
+	table := newSessionTable(defaultSessionShards)
+	f := &Flow{Backend: "192.0.2.100:443", source: netip.MustParseAddr("198.51.100.1")}
+	addr := &net.UDPAddr{IP: net.IPv4(198, 51, 100, 1), Port: 4433}
+	table.remember(f, []byte("cid"), addr)
+
+	// the flow is reaped between a packet's lookup and its remember, which
+	// also brings a key the flow was not indexed under yet
+	if got := table.lookup([]byte("cid"), addr); got != f {
+		t.Fatalf("lookup() = %p, want %p", got, f)
+	}
+	table.remove(f)
+	table.remember(f, []byte("new-cid"), testAddr(2))
+
+	if got := table.lookup([]byte("cid"), addr); got != nil {
+		t.Errorf("lookup(cid) = %p after remove, want nil", got)
+	}
+	if got := table.lookup([]byte("new-cid"), testAddr(2)); got != nil {
+		t.Errorf("lookup(new-cid) = %p after remove, want nil", got)
+	}
+	if total, perBackend := table.flowCounts(); total != 0 || len(perBackend) != 0 {
+		t.Errorf("flowCounts() = %d, %v, want the removed flow uncounted", total, perBackend)
+	}
+	if len(table.sources) != 0 {
+		t.Errorf("sources = %v, want the removed flow's source uncounted", table.sources)
+	}
+}
+
+func TestSessionShardsConcurrent(t *testing.T) {
+	table := newSessionTable(4)
+	var wg sync.WaitGroup
+	for w := range 8 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := range 500 {
+				f := &Flow{Backend: "192.0.2.100:443"}
+				cid := []byte(fmt.Sprintf("w%d-%d", w, j))
+				addr := &net.UDPAddr{IP: net.IPv4(198, 51, 100, byte(w)), Port: j}
+				table.remember(f, cid, addr)
+				if got := table.lookup(cid, addr); got != f {
+					t.Errorf("lookup(%s) = %p, want the flow just remembered %p", cid, got, f)
+					return
+				}
+				table.remember(f, cid, addr)
+				table.remove(f)
+			}
+		}()
+	}
+	wg.Wait()
+	if total, _ := table.flowCounts(); total != 0 {
+		t.Errorf("flowCounts() = %d after every flow was removed, want 0", total)
+	}
+}
+
+func TestSessionShardsConfig(t *testing.T) {
+	tests := []struct {
+		name    string
+		shards  int
+		want    int
+		wantErr error
+	}{
+		{name: "Default", want: defaultSessionShards},
+		{name: "One", shards: 1, want: 1},
+		{name: "Many", shards: 64, want: 64},
+		{name: "Negative", shards: -1, wantErr: errSessionShards},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := Config{SessionShards: tt.shards}
+			got, err := cfg.sessionShards()
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("sessionShards() error = %v, want %v", err, tt.wantErr)
+			}
+			if got != tt.want {
+				t.Errorf("sessionShards() = %d, want %d", got, tt.want)
+			}
+		})
+	}
+}
+
+// BenchmarkSessionChurn measures parallel workers looking flows up while
+// others open and close flows, on one shard, the single-map design, and on
+// the default count
+func BenchmarkSessionChurn(b *testing.B) {
+	for _, shards := range []int{1, defaultSessionShards} {
+		b.Run(fmt.Sprintf("Shards%d", shards), func(b *testing.B) {
+			table := newSessionTable(shards)
+			cids := make([][]byte, 10000)
+			for i := range cids {
+				cids[i] = []byte(fmt.Sprintf("cid-%05d", i))
+				table.remember(&Flow{Backend: "192.0.2.100:443"}, cids[i], &net.UDPAddr{IP: net.IPv4(198, 51, 100, byte(i)), Port: 4433 + i/256})
+			}
+			var workers atomic.Int32
+			b.RunParallel(func(pb *testing.PB) {
+				w := int(workers.Add(1))
+				i := 0
+				for pb.Next() {
+					if i%8 == 0 {
+						// one operation in eight opens and closes a flow
+						f := &Flow{Backend: "192.0.2.101:443"}
+						addr := &net.UDPAddr{IP: net.IPv4(203, 0, 113, byte(w)), Port: i % 65536}
+						table.remember(f, []byte(fmt.Sprintf("new-%d-%d", w, i)), addr)
+						table.remove(f)
+					} else {
+						table.lookup(cids[i%len(cids)], testAddr(1))
+					}
+					i++
+				}
+			})
+		})
+	}
+}
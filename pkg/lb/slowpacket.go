@@ -0,0 +1,49 @@
+package lb
+
+import (
+	"log"
+	"net"
+	"time"
+)
+
+// maxSlowPacketLogs caps how many slow packets are logged each second, so an
+// input that is slow on purpose cannot flood the log
+const maxSlowPacketLogs = 10
+
+// slowPackets logs packets whose parse, decode and backend selection took
+// longer than Config.SlowPacketThreshold, with their type and CID, to find
+// inputs that hit slow paths such as repair decoding. It reads the clock
+// only when configured, and is compiled out with the decode histograms by
+// -tags nodecodetiming. Nil when disabled.
+type slowPackets struct {
+	threshold time.Duration
+	logs      *logSampler
+}
+
+// newSlowPackets returns the slow-packet log, or nil for a zero threshold
+func newSlowPackets(threshold time.Duration) *slowPackets {
+	if !decodeTiming || threshold <= 0 {
+		return nil
+	}
+	return &slowPackets{threshold: threshold, logs: &logSampler{failuresPerSec: maxSlowPacketLogs, logf: log.Printf}}
+}
+
+// start returns when a packet's routing began, or the zero time when disabled
+func (s *slowPackets) start() time.Time {
+	if s == nil {
+		return time.Time{}
+	}
+	return time.Now()
+}
+
+// check logs the packet of res if routing it since start took too long
+func (s *slowPackets) check(start time.Time, src net.Addr, res *DecodeResult) {
+	if s == nil {
+		return
+	}
+	now := time.Now()
+	if took := now.Sub(start); took > s.threshold {
+		s.logs.failure(now, "Slow packet from %s: %s, CID %x, routed by %s in %v (threshold %v)",
+			src, res.PacketType, res.CID, res.Route, took, s.threshold)
+	}
+}
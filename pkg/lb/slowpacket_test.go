@@ -0,0 +1,67 @@
+//go:build !nodecodetiming
+
+package lb
+
+import (
+	"fmt"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/fqzz2000/QUIC-LB-SHRIMP/pkg/packet"
+)
+
+// sleepyStrategy takes delay to pick the first backend
+type sleepyStrategy struct{ delay time.Duration }
+
+func (s sleepyStrategy) Select(cid []byte, src net.Addr, backends BackendSet) (BackendConfig, error) {
+	time.Sleep(s.delay)
+	return backends.Healthy()[0], nil
+}
+
+func TestSlowPacketLog(t *testing.T) {
+	tests := []struct {
+		name      string
+		threshold time.Duration
+		wantLog   bool
+	}{
+		{name: "Above Threshold", threshold: time.Millisecond, wantLog: true},
+		{name: "Below Threshold", threshold: time.Minute},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fwd := memForwarder{opened: make(chan *memConn, 1)}
+			lb, _ := newMemLB(t, Config{
+				Backends:            []BackendConfig{{Address: "192.0.2.100:443", Forwarder: fwd}},
+				Strategy:            sleepyStrategy{delay: 10 * time.Millisecond},
+				SlowPacketThreshold: tt.threshold,
+			})
+			var lines []string
+			lb.slow.logs.logf = func(format string, args ...any) {
+				lines = append(lines, fmt.Sprintf(format, args...))
+			}
+
+			dcid := []byte{0x00, 0x01, 0xa1, 0xa2, 0xa3, 0xa4, 0xa5, 0xa6}
+			lb.process(inbound{pkt: longHeaderPacket(packet.Initial, dcid, 1200), src: testAddr(1)})
+			expect(t, fwd.opened)
+			// the flow's next packet skips the strategy
+			lb.process(inbound{pkt: longHeaderPacket(packet.HandShake, dcid, 100), src: testAddr(1)})
+
+			if !tt.wantLog {
+				if len(lines) != 0 {
+					t.Errorf("logged %q, want nothing under the threshold", lines)
+				}
+				return
+			}
+			if len(lines) != 1 {
+				t.Fatalf("logged %d slow packets, want 1", len(lines))
+			}
+			for _, want := range []string{"initial", "CID 0001a1a2a3a4a5a6", "by strategy"} {
+				if !strings.Contains(lines[0], want) {
+					t.Errorf("slow packet log %q missing %q", lines[0], want)
+				}
+			}
+		})
+	}
+}
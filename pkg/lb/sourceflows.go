@@ -0,0 +1,74 @@
+package lb
+
+import (
+	"errors"
+	"fmt"
+	"net/netip"
+)
+
+// A per-source flow cap (Config.MaxFlowsPerSource) bounds how many flows one
+// source IP holds in the session table at once, where the new-flow rate
+// only bounds how fast it opens them: a client under the rate can still
+// pile up flows until the idle timeout. A packet that would open a flow
+// for a source at its cap is dropped and counted against that source. As
+// with the rate, sources are keyed by IP alone, the client an outer load
+// balancer names when chained. Existing flows are never evicted, so a
+// source below its cap is never affected by one above it.
+
+var (
+	// errSourceFlows is returned for a negative Config.MaxFlowsPerSource
+	errSourceFlows = errors.New("invalid per-source flow cap")
+	// errSourceFlowLimit is returned for a packet that would open a flow
+	// for a source already holding its cap
+	errSourceFlowLimit = errors.New("source at its flow cap")
+)
+
+// sourceFlows is one source's share of the session table
+type sourceFlows struct {
+	flows    int
+	rejected uint64 // new flows refused at the cap
+}
+
+// maxSourceFlows returns the per-source flow cap, zero for none
+func (c *Config) maxSourceFlows() (int, error) {
+	if c.MaxFlowsPerSource < 0 {
+		return 0, fmt.Errorf("%w: %d", errSourceFlows, c.MaxFlowsPerSource)
+	}
+	return c.MaxFlowsPerSource, nil
+}
+
+// admitSource reports whether src holds fewer than limit flows, counting a
+// rejection against it otherwise
+func (t *sessionTable) admitSource(src netip.Addr, limit int) bool {
+	t.srcMu.Lock()
+	defer t.srcMu.Unlock()
+	s := t.sources[src]
+	if s == nil || s.flows < limit {
+		return true
+	}
+	s.rejected++
+	return false
+}
+
+// sourceRejections returns the rejections of sources still holding flows
+func (t *sessionTable) sourceRejections() map[string]uint64 {
+	t.srcMu.Lock()
+	defer t.srcMu.Unlock()
+	out := make(map[string]uint64)
+	for src, s := range t.sources {
+		if s.rejected > 0 {
+			out[src.String()] = s.rejected
+		}
+	}
+	return out
+}
+
+// admitSourceFlow applies the per-source flow cap to a packet opening a flow
+// from src. Sources without an IP, over a Unix socket, are not capped.
+func (lb *LoadBalancer) admitSourceFlow(src netip.Addr) error {
+	if lb.sourceFlowCap == 0 || !src.IsValid() || lb.sessions.admitSource(src, lb.sourceFlowCap) {
+		return nil
+	}
+	lb.stats.sourceFlowLimited.Add(1)
+	return fmt.Errorf("%w: %s", errSourceFlowLimit, src)
+}
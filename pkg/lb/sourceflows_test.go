@@ -0,0 +1,71 @@
+package lb
+
+import (
+	"errors"
+	"net"
+	"testing"
+
+	"github.com/fqzz2000/QUIC-LB-SHRIMP/pkg/packet"
+)
+
+func TestMaxFlowsPerSource(t *testing.T) {
+	fwd := memForwarder{opened: make(chan *memConn, 8)}
+	lb, _ := newMemLB(t, Config{
+		Backends:          []BackendConfig{{Address: "192.0.2.100:443", Forwarder: fwd}},
+		MaxFlowsPerSource: 2,
+	})
+	// clients on one IP are one source whatever their port
+	open := func(ip byte, port int) error {
+		dcid := []byte{0xc0, ip, byte(port >> 8), byte(port), 4, 5, 6, 7}
+		pkt := quicLongHeader(packet.Initial, dcid, []byte{ip}, make([]byte, 1200))
+		return lb.handlePacket(pkt, &net.UDPAddr{IP: net.IPv4(192, 0, 2, ip), Port: port})
+	}
+
+	tests := []struct {
+		name    string
+		ip      byte
+		port    int
+		wantErr error
+	}{
+		{name: "First Flow", ip: 1, port: 5001},
+		{name: "Second Flow", ip: 1, port: 5002},
+		{name: "Over Cap", ip: 1, port: 5003, wantErr: errSourceFlowLimit},
+		{name: "Over Cap Again", ip: 1, port: 5004, wantErr: errSourceFlowLimit},
+		{name: "Other Source", ip: 2, port: 5001},
+		{name: "Other Source Second Flow", ip: 2, port: 5002},
+	}
+	for _, tt := range tests {
+		if err := open(tt.ip, tt.port); !errors.Is(err, tt.wantErr) {
+			t.Errorf("%s: handlePacket() error = %v, want %v", tt.name, err, tt.wantErr)
+		}
+	}
+
+	stats := lb.Stats()
+	if stats.SourceFlowLimited != 2 || stats.ActiveFlows != 4 {
+		t.Errorf("SourceFlowLimited = %d with %d flows, want 2 with 4", stats.SourceFlowLimited, stats.ActiveFlows)
+	}
+	if got := stats.SourceRejections; len(got) != 1 || got["192.0.2.1"] != 2 {
+		t.Errorf("SourceRejections = %v, want 2 for 192.0.2.1 alone", got)
+	}
+	if got := dropReasonFor(open(1, 5005)); got != dropSourceFlows {
+		t.Errorf("drop reason = %s, want %s", dropReasonNames[got], dropReasonNames[dropSourceFlows])
+	}
+
+	// a flow closing frees its place under the cap
+	for _, flow := range lb.sessions.flows() {
+		if addrIP(flow.ClientAddr()).String() == "192.0.2.1" {
+			lb.closeFlow(flow)
+			break
+		}
+	}
+	if err := open(1, 5006); err != nil {
+		t.Errorf("handlePacket(after a flow closed) error = %v", err)
+	}
+}
+
+func TestMaxFlowsPerSourceConfig(t *testing.T) {
+	_, err := NewLoadBalancer(Config{Backends: StaticBackends("10.0.0.1:443"), MaxFlowsPerSource: -1})
+	if !errors.Is(err, errSourceFlows) {
+		t.Errorf("NewLoadBalancer() error = %v, want %v", err, errSourceFlows)
+	}
+}
@@ -0,0 +1,61 @@
+package lb
+
+import (
+	"errors"
+	"net"
+	"syscall"
+)
+
+// Source port affinity (Config.SourcePortMin and SourcePortMax) binds each
+// flow's connected backend socket to a local port derived from the client's
+// four-tuple, so backends keying on the LB's source port see the same port
+// for a client every time its flow is opened, including after the flow
+// expires. A derived port already bound by another flow is a collision: the
+// next ports in the range are tried in turn, and only when the whole range is
+// taken does the flow fall back to an ephemeral port.
+
+// errSourcePorts is returned for an invalid source port range
+var errSourcePorts = errors.New("invalid source port range")
+
+// portRange is an inclusive range of local ports; the zero value is unset
+type portRange struct {
+	min, max int
+}
+
+func (r portRange) enabled() bool { return r.max != 0 }
+
+func (r portRange) size() int { return r.max - r.min + 1 }
+
+// sourcePort derives the preferred source port for a client of the listener
+// at local; the same four-tuple always yields the same port
+func (lb *LoadBalancer) sourcePort(client, local net.Addr) int {
+	key := addrKey(client) + "|" + addrKey(local)
+	return lb.sourcePorts.min + int(hashKey(lb.hashSeed, []byte(key))%uint64(lb.sourcePorts.size()))
+}
+
+// dialFromSourcePort dials address over UDP from the port derived for client,
+// probing the rest of the range on collisions
+func (lb *LoadBalancer) dialFromSourcePort(address string, client net.Addr) (net.Conn, error) {
+	var local net.Addr = &net.UDPAddr{}
+	if lb.listener != nil {
+		local = lb.listener.LocalAddr()
+	}
+	port := lb.sourcePort(client, local)
+	for i := 0; i < lb.sourcePorts.size(); i++ {
+		conn, err := lb.dialUDP(address, port)
+		if err == nil {
+			if i > 0 {
+				lb.stats.sourcePortCollisions.Add(1)
+			}
+			return conn, nil
+		}
+		if !errors.Is(err, syscall.EADDRINUSE) {
+			return nil, err
+		}
+		if port++; port > lb.sourcePorts.max {
+			port = lb.sourcePorts.min
+		}
+	}
+	lb.stats.sourcePortCollisions.Add(1)
+	return lb.dialUDP(address, 0)
+}
@@ -0,0 +1,103 @@
+package lb
+
+import (
+	"errors"
+	"net"
+	"testing"
+)
+
+func TestSourcePortAffinity(t *testing.T) {
+	lb, err := NewLoadBalancer(Config{
+		Backends:      StaticBackends("127.0.0.1:9"),
+		SourcePortMin: 40000,
+		SourcePortMax: 49999,
+	})
+	if err != nil {
+		t.Fatalf("NewLoadBalancer() error = %v, want nil", err)
+	}
+	local := &net.UDPAddr{IP: net.IPv4(192, 0, 2, 200), Port: 443}
+
+	first := lb.sourcePort(testAddr(1), local)
+	if got := lb.sourcePort(testAddr(1), local); got != first {
+		t.Errorf("sourcePort() = %d then %d for the same client, want stable", first, got)
+	}
+	if first < 40000 || first > 49999 {
+		t.Errorf("sourcePort() = %d, want within 40000-49999", first)
+	}
+	other := &net.UDPAddr{IP: net.IPv4(192, 0, 2, 1), Port: 4434}
+	if got := lb.sourcePort(other, local); got == first {
+		t.Errorf("sourcePort() = %d for two clients, want them to differ", got)
+	}
+}
+
+func TestSourcePortCollision(t *testing.T) {
+	lb, err := NewLoadBalancer(Config{
+		Backends:      StaticBackends("127.0.0.1:9"),
+		SourcePortMin: 40000,
+		SourcePortMax: 49999,
+	})
+	if err != nil {
+		t.Fatalf("NewLoadBalancer() error = %v, want nil", err)
+	}
+	want := lb.sourcePort(testAddr(1), &net.UDPAddr{})
+
+	conn, err := lb.dialFromSourcePort("127.0.0.1:9", testAddr(1))
+	if err != nil {
+		t.Fatalf("dialFromSourcePort() error = %v, want nil", err)
+	}
+	if got := conn.LocalAddr().(*net.UDPAddr).Port; got != want {
+		t.Errorf("flow bound port %d, want derived port %d", got, want)
+	}
+
+	// a second flow for the same client finds the port taken and moves on
+	again, err := lb.dialFromSourcePort("127.0.0.1:9", testAddr(1))
+	if err != nil {
+		t.Fatalf("dialFromSourcePort() error = %v, want nil", err)
+	}
+	defer again.Close()
+	if got := again.LocalAddr().(*net.UDPAddr).Port; got == want {
+		t.Errorf("colliding flow bound port %d, want another", got)
+	}
+	if got := lb.Stats().SourcePortCollisions; got != 1 {
+		t.Errorf("SourcePortCollisions = %d, want 1", got)
+	}
+
+	// the port is the client's again once its flow is gone
+	conn.Close()
+	conn, err = lb.dialFromSourcePort("127.0.0.1:9", testAddr(1))
+	if err != nil {
+		t.Fatalf("dialFromSourcePort() error = %v, want nil", err)
+	}
+	defer conn.Close()
+	if got := conn.LocalAddr().(*net.UDPAddr).Port; got != want {
+		t.Errorf("reopened flow bound port %d, want derived port %d", got, want)
+	}
+}
+
+func TestSourcePortRange(t *testing.T) {
+	tests := []struct {
+		name     string
+		min, max int
+		sockets  string
+		wantErr  error
+	}{
+		{name: "Unset"},
+		{name: "Single Port", min: 40000, max: 40000},
+		{name: "Inverted", min: 40001, max: 40000, wantErr: errSourcePorts},
+		{name: "Too High", min: 40000, max: 70000, wantErr: errSourcePorts},
+		{name: "Unconnected Sockets", min: 40000, max: 40010, sockets: backendSocketsUnconnected, wantErr: errSourcePorts},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := NewLoadBalancer(Config{
+				Backends:       StaticBackends("127.0.0.1:9"),
+				SourcePortMin:  tt.min,
+				SourcePortMax:  tt.max,
+				BackendSockets: tt.sockets,
+			})
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("NewLoadBalancer() error = %v, want %v", err, tt.wantErr)
+			}
+		})
+	}
+}
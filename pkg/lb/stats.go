@@ -0,0 +1,231 @@
+package lb
+
+import "sync/atomic"
+
+// counters are the load balancer's hot-path counters, updated atomically
+type counters struct {
+	received             atomic.Uint64
+	forwarded            atomic.Uint64
+	dropped              atomic.Uint64
+	queueDrops           atomic.Uint64 // subset of dropped: worker queue was full
+	panics               atomic.Uint64 // subset of dropped: processing panicked and was recovered
+	decodeFailures       atomic.Uint64 // CIDs that did not decode to a backend
+	authFailures         atomic.Uint64 // subset of decodeFailures: AEAD tag did not verify
+	truncatedCIDs        atomic.Uint64 // short headers whose DCID was shorter than DCIDLength
+	learnedCIDLengths    atomic.Uint64 // short headers matched to a flow by a CID length other than DCIDLength
+	fixedBitDrops        atomic.Uint64 // packets with the fixed bit unset where the config requires it
+	mismatchedDCIDs      atomic.Uint64 // datagrams coalescing packets for different DCIDs
+	lengthOverruns       atomic.Uint64 // datagrams with a long-header Length past their end
+	reorderedCoalesced   atomic.Uint64 // datagrams coalescing packets out of order
+	corruptPackets       atomic.Uint64 // datagrams with inconsistent length fields
+	unhealthyFallbacks   atomic.Uint64 // CIDs decoded to an unhealthy backend and rerouted
+	newFlowRouted        atomic.Uint64 // new connections routed to the new-flow pool
+	canaryRouted         atomic.Uint64 // new connections split off to the canary
+	typeDrops            atomic.Uint64 // client packets of types the allowlist excludes
+	removedServerIDs     atomic.Uint64 // subset of decodeFailures: server ID of a removed backend
+	unknownServerIDs     atomic.Uint64 // subset of decodeFailures: decoded server ID with no backend, removed included
+	repairedDecodes      atomic.Uint64 // CIDs decoded by a config other than their rotation's
+	statelessResets      atomic.Uint64 // stateless resets sent for unknown short-header CIDs
+	overCapacity         atomic.Uint64 // new flows decoded to a backend at its flow limit
+	egressDrops          atomic.Uint64 // datagrams of open flows over their backend's egress rate
+	egressDecoded        atomic.Uint64 // new flows decoded to a backend over its egress rate
+	smallInitials        atomic.Uint64 // datagrams carrying an Initial below the minimum size
+	versionNegotiations  atomic.Uint64 // new connections answered with Version Negotiation
+	proxyHeaders         atomic.Uint64 // PROXY v2 headers stripped from client datagrams
+	unresolvedBackends   atomic.Uint64 // backends marked unhealthy for not resolving at startup
+	healthProbeFailures  atomic.Uint64 // QUIC health probes that got no reply
+	backendUnreachable   atomic.Uint64 // ICMP unreachable errors read from backend sockets
+	unmatchedReplies     atomic.Uint64 // replies on the shared backend socket no flow took
+	repliesByDCID        atomic.Uint64 // backend long headers sent to another flow than their socket's by DCID
+	shortWrites          atomic.Uint64 // datagram writes that reported fewer bytes than the datagram
+	sourcePortCollisions atomic.Uint64 // flows whose derived source port was already bound
+	amplificationDrops   atomic.Uint64 // responses withheld from unvalidated clients
+	halfOpenReaped       atomic.Uint64 // flows reaped by the unestablished timeout
+	initialRetransmits   atomic.Uint64 // client Initials repeated to a flow whose backend sent nothing back
+	closeNotified        atomic.Uint64 // flows evicted on a backend's close notification
+	controlIgnored       atomic.Uint64 // control messages malformed, unknown or not from the flow's backend
+	idleReaped           atomic.Uint64 // established flows reaped by the idle timeout
+	newFlowRateLimited   atomic.Uint64 // new flows refused for a source over its new-flow rate
+	drainRefused         atomic.Uint64 // new flows refused while draining
+	drainingRedirects    atomic.Uint64 // new connections decoded to a draining backend and sent elsewhere
+	zeroRTTDelayed       atomic.Uint64 // 0-RTT packets held until the flow saw 1-RTT
+	zeroRTTDropped       atomic.Uint64 // 0-RTT packets dropped by policy or a full hold
+	zeroRTTReturnDrops   atomic.Uint64 // responses to 0-RTT flows dropped at the return limit
+	mirrored             atomic.Uint64 // datagram copies sent to the shadow backend
+	mirrorFailures       atomic.Uint64 // shadow dials or sends that failed
+	batchedWrites        atomic.Uint64 // backend datagrams sent in a syscall shared with an earlier one
+	nonceReuse           atomic.Uint64 // decoded new flows repeating a sampled server ID and nonce
+	sourceFlowLimited    atomic.Uint64 // new flows refused for a source at its flow cap
+	readRetries          atomic.Uint64 // transient listener read errors retried
+	decisionDrops        atomic.Uint64 // routing decisions dropped for a decision sink behind
+	retryExpired         atomic.Uint64 // issued Retry tokens presented past their lifetime
+	retryReplayed        atomic.Uint64 // issued Retry tokens presented again
+	versionListsCut      atomic.Uint64 // Version Negotiation lists cut to the amplification limit
+	trailingBytes        atomic.Uint64 // long-header datagrams with bytes after their packets
+	loadReports          atomic.Uint64 // backend load reports recorded
+	loadSpills           atomic.Uint64 // new fallback flows moved off an overloaded backend
+	serverIDReports      atomic.Uint64 // backend server ID self-reports verified
+	serverIDMismatches   atomic.Uint64 // self-reports whose server ID the mapping disagrees with
+	tokenRouted          atomic.Uint64 // new flows routed by the server ID in their token
+	tokenFailures        atomic.Uint64 // Initial tokens not decoded or naming no available backend
+	cidTooShort          atomic.Uint64 // packets dropped for a DCID below the minimum length
+	evictionNotices      atomic.Uint64 // eviction notices sent to backends
+	evictNoticeErrors    atomic.Uint64 // eviction notices that could not be sent
+	catchAllRouted       atomic.Uint64 // new flows with an unmapped server ID sent to the catch-all
+}
+
+// LBStats is a snapshot of load balancer activity for in-process consumers
+type LBStats struct {
+	PacketsReceived      uint64
+	PacketsForwarded     uint64
+	PacketsDropped       uint64
+	QueueDrops           uint64
+	Panics               uint64
+	DecodeFailures       uint64
+	CIDAuthFailures      uint64
+	TruncatedCIDs        uint64
+	LearnedCIDLengths    uint64
+	FixedBitDrops        uint64
+	MismatchedDCIDs      uint64
+	LengthOverruns       uint64
+	ReorderedCoalesced   uint64
+	CorruptPackets       uint64
+	UnhealthyFallbacks   uint64
+	NewFlowRouted        uint64
+	CanaryRouted         uint64
+	TypeDrops            uint64
+	RemovedServerIDs     uint64
+	UnknownServerIDs     uint64
+	RepairedDecodes      uint64
+	StatelessResets      uint64
+	OverCapacity         uint64
+	EgressDrops          uint64
+	EgressDecoded        uint64
+	SmallInitialDrops    uint64
+	VersionNegotiations  uint64
+	ProxyHeaders         uint64
+	BackendUnreachable   uint64
+	UnresolvedBackends   uint64
+	HealthProbeFailures  uint64
+	UnmatchedReplies     uint64
+	RepliesByDCID        uint64
+	ShortWrites          uint64
+	SourcePortCollisions uint64
+	AmplificationDrops   uint64
+	HalfOpenReaped       uint64
+	InitialRetransmits   uint64
+	CloseNotified        uint64
+	ControlIgnored       uint64
+	IdleReaped           uint64
+	NewFlowRateLimited   uint64
+	DrainRefused         uint64
+	DrainingRedirects    uint64
+	ZeroRTTDelayed       uint64
+	ZeroRTTDropped       uint64
+	ZeroRTTReturnDrops   uint64
+	Mirrored             uint64
+	MirrorFailures       uint64
+	BatchedWrites        uint64
+	NonceReuse           uint64
+	SourceFlowLimited    uint64
+	ReadRetries          uint64
+	DecisionDrops        uint64
+	RetryTokensExpired   uint64
+	RetryTokensReplayed  uint64
+	VersionListsCut      uint64
+	TrailingBytes        uint64
+	LoadReports          uint64
+	LoadSpills           uint64
+	ServerIDReports      uint64
+	ServerIDMismatches   uint64
+	TokenRouted          uint64
+	TokenFailures        uint64
+	CIDTooShort          uint64
+	EvictionNotices      uint64
+	EvictNoticeErrors    uint64
+	CatchAllRouted       uint64
+	ActiveFlows          int
+	BackendFlows         map[string]int // active flows per backend address
+	// SourceRejections counts new flows refused at the per-source cap by
+	// source IP, for sources still holding flows
+	SourceRejections map[string]uint64
+}
+
+// Stats returns a snapshot of the load balancer's counters. Each counter is
+// read atomically; the flow counts are read together under the session lock.
+func (lb *LoadBalancer) Stats() LBStats {
+	active, perBackend := lb.sessions.flowCounts()
+	return LBStats{
+		PacketsReceived:      lb.stats.received.Load(),
+		PacketsForwarded:     lb.stats.forwarded.Load(),
+		PacketsDropped:       lb.stats.dropped.Load(),
+		QueueDrops:           lb.stats.queueDrops.Load(),
+		Panics:               lb.stats.panics.Load(),
+		DecodeFailures:       lb.stats.decodeFailures.Load(),
+		CIDAuthFailures:      lb.stats.authFailures.Load(),
+		TruncatedCIDs:        lb.stats.truncatedCIDs.Load(),
+		LearnedCIDLengths:    lb.stats.learnedCIDLengths.Load(),
+		FixedBitDrops:        lb.stats.fixedBitDrops.Load(),
+		MismatchedDCIDs:      lb.stats.mismatchedDCIDs.Load(),
+		LengthOverruns:       lb.stats.lengthOverruns.Load(),
+		ReorderedCoalesced:   lb.stats.reorderedCoalesced.Load(),
+		CorruptPackets:       lb.stats.corruptPackets.Load(),
+		UnhealthyFallbacks:   lb.stats.unhealthyFallbacks.Load(),
+		NewFlowRouted:        lb.stats.newFlowRouted.Load(),
+		CanaryRouted:         lb.stats.canaryRouted.Load(),
+		TypeDrops:            lb.stats.typeDrops.Load(),
+		RemovedServerIDs:     lb.stats.removedServerIDs.Load(),
+		UnknownServerIDs:     lb.stats.unknownServerIDs.Load(),
+		RepairedDecodes:      lb.stats.repairedDecodes.Load(),
+		StatelessResets:      lb.stats.statelessResets.Load(),
+		OverCapacity:         lb.stats.overCapacity.Load(),
+		EgressDrops:          lb.stats.egressDrops.Load(),
+		EgressDecoded:        lb.stats.egressDecoded.Load(),
+		SmallInitialDrops:    lb.stats.smallInitials.Load(),
+		VersionNegotiations:  lb.stats.versionNegotiations.Load(),
+		ProxyHeaders:         lb.stats.proxyHeaders.Load(),
+		BackendUnreachable:   lb.stats.backendUnreachable.Load(),
+		UnresolvedBackends:   lb.stats.unresolvedBackends.Load(),
+		HealthProbeFailures:  lb.stats.healthProbeFailures.Load(),
+		UnmatchedReplies:     lb.stats.unmatchedReplies.Load(),
+		RepliesByDCID:        lb.stats.repliesByDCID.Load(),
+		ShortWrites:          lb.stats.shortWrites.Load(),
+		SourcePortCollisions: lb.stats.sourcePortCollisions.Load(),
+		AmplificationDrops:   lb.stats.amplificationDrops.Load(),
+		HalfOpenReaped:       lb.stats.halfOpenReaped.Load(),
+		InitialRetransmits:   lb.stats.initialRetransmits.Load(),
+		CloseNotified:        lb.stats.closeNotified.Load(),
+		ControlIgnored:       lb.stats.controlIgnored.Load(),
+		IdleReaped:           lb.stats.idleReaped.Load(),
+		NewFlowRateLimited:   lb.stats.newFlowRateLimited.Load(),
+		DrainRefused:         lb.stats.drainRefused.Load(),
+		DrainingRedirects:    lb.stats.drainingRedirects.Load(),
+		ZeroRTTDelayed:       lb.stats.zeroRTTDelayed.Load(),
+		ZeroRTTDropped:       lb.stats.zeroRTTDropped.Load(),
+		ZeroRTTReturnDrops:   lb.stats.zeroRTTReturnDrops.Load(),
+		Mirrored:             lb.stats.mirrored.Load(),
+		MirrorFailures:       lb.stats.mirrorFailures.Load(),
+		BatchedWrites:        lb.stats.batchedWrites.Load(),
+		NonceReuse:           lb.stats.nonceReuse.Load(),
+		SourceFlowLimited:    lb.stats.sourceFlowLimited.Load(),
+		ReadRetries:          lb.stats.readRetries.Load(),
+		DecisionDrops:        lb.stats.decisionDrops.Load(),
+		RetryTokensExpired:   lb.stats.retryExpired.Load(),
+		RetryTokensReplayed:  lb.stats.retryReplayed.Load(),
+		VersionListsCut:      lb.stats.versionListsCut.Load(),
+		TrailingBytes:        lb.stats.trailingBytes.Load(),
+		LoadReports:          lb.stats.loadReports.Load(),
+		LoadSpills:           lb.stats.loadSpills.Load(),
+		ServerIDReports:      lb.stats.serverIDReports.Load(),
+		ServerIDMismatches:   lb.stats.serverIDMismatches.Load(),
+		TokenRouted:          lb.stats.tokenRouted.Load(),
+		TokenFailures:        lb.stats.tokenFailures.Load(),
+		CIDTooShort:          lb.stats.cidTooShort.Load(),
+		EvictionNotices:      lb.stats.evictionNotices.Load(),
+		EvictNoticeErrors:    lb.stats.evictNoticeErrors.Load(),
+		CatchAllRouted:       lb.stats.catchAllRouted.Load(),
+		ActiveFlows:          active,
+		BackendFlows:         perBackend,
+		SourceRejections:     lb.sessions.sourceRejections(),
+	}
+}
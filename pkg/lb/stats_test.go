@@ -0,0 +1,53 @@
+package lb
+
+import (
+	"testing"
+	"time"
+)
+
+func TestStatsTrackInjectedPackets(t *testing.T) {
+	backend := startEchoBackend(t)
+	lb := startTestLB(t, Config{Backends: StaticBackends(backend)})
+
+	client := newTestClient(t)
+	cid, _ := lb.routes().codec.Encode(0, []byte{0x00}, nil)
+	pkt := append([]byte{0x40}, cid...)
+	for i := 0; i < 3; i++ {
+		client.WriteTo(pkt, lb.Addr())
+		if readWithin(t, client, time.Second) == nil {
+			t.Fatalf("no response to packet %d", i)
+		}
+	}
+	// a DCID two bytes short of the configured length is dropped
+	client.WriteTo(pkt[:len(pkt)-2], lb.Addr())
+
+	deadline := time.Now().Add(time.Second)
+	for lb.Stats().PacketsDropped == 0 && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond)
+	}
+
+	stats := lb.Stats()
+	if stats.PacketsReceived != 4 {
+		t.Errorf("PacketsReceived = %d, want 4", stats.PacketsReceived)
+	}
+	if stats.PacketsForwarded != 3 {
+		t.Errorf("PacketsForwarded = %d, want 3", stats.PacketsForwarded)
+	}
+	if stats.PacketsDropped != 1 {
+		t.Errorf("PacketsDropped = %d, want 1", stats.PacketsDropped)
+	}
+	if stats.TruncatedCIDs != 1 {
+		t.Errorf("TruncatedCIDs = %d, want 1", stats.TruncatedCIDs)
+	}
+	if stats.ActiveFlows != 1 {
+		t.Errorf("ActiveFlows = %d, want 1", stats.ActiveFlows)
+	}
+	if stats.BackendFlows[backend] != 1 {
+		t.Errorf("BackendFlows[%s] = %d, want 1", backend, stats.BackendFlows[backend])
+	}
+
+	lb.Shutdown()
+	if stats := lb.Stats(); stats.ActiveFlows != 0 || len(stats.BackendFlows) != 0 {
+		t.Errorf("after Shutdown ActiveFlows = %d, BackendFlows = %v, want none", stats.ActiveFlows, stats.BackendFlows)
+	}
+}
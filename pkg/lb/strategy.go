@@ -0,0 +1,127 @@
+package lb
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"math/rand/v2"
+	"net"
+
+	"github.com/fqzz2000/QUIC-LB-SHRIMP/pkg/quiclb"
+)
+
+// Strategy picks the backend for a packet that opens a new flow. A configured
+// Strategy replaces QUIC-LB server ID decoding; routing overrides still win,
+// and packets of existing flows never reach it. A Strategy returning
+// ErrNoRoute leaves the packet to the routing it replaced.
+type Strategy interface {
+	Select(cid []byte, src net.Addr, backends BackendSet) (BackendConfig, error)
+}
+
+// BackendSet is the view of the current backends a Strategy routes over
+type BackendSet interface {
+	// Healthy returns the backends accepting new flows, in configured order:
+	// those not marked unhealthy and below their flow limit
+	Healthy() []BackendConfig
+	// Hash maps a key onto the weighted consistent-hash ring, skipping
+	// backends Healthy leaves out
+	Hash(key []byte) (BackendConfig, bool)
+}
+
+// backendSet is the LoadBalancer's BackendSet over the routing table the
+// packet is being routed with
+type backendSet struct {
+	lb *LoadBalancer
+	rt *routingTable
+}
+
+func (s backendSet) Healthy() []BackendConfig {
+	backends := s.rt.backends
+	healthy := make([]BackendConfig, 0, len(backends))
+	for _, b := range backends {
+		if !b.removed() && !s.lb.avoidNew(b.Address) {
+			healthy = append(healthy, b)
+		}
+	}
+	return healthy
+}
+
+func (s backendSet) Hash(key []byte) (BackendConfig, bool) {
+	return s.rt.ring.lookupAvoiding(key, s.lb.avoidNew)
+}
+
+// CIDHashStrategy gives per-connection affinity without QUIC-LB encoding by
+// hashing the whole DCID onto the ring, for backends that do not encode a
+// server ID in their CIDs. It keeps a connection on one backend only while
+// its DCID is unchanged, so it suits deployments where backends keep the
+// client's chosen CID or the session table carries the flow across CIDs.
+//
+// Unsalted, the hash is public, so clients can pick DCIDs that all land on
+// one backend. Salts key it with a secret per config rotation codepoint, the
+// top two bits of a CID as in QUIC-LB: a CID hashes with the salt of its own
+// codepoint, or with Current's when its codepoint has none, as for Initial
+// DCIDs a client made up. Rotating salts mirrors rotating QUIC-LB configs:
+// add the new salt at a free codepoint and make it Current while backends
+// move to CIDs with its bits; CIDs with the old bits keep their mapping
+// until the old salt is removed.
+type CIDHashStrategy struct {
+	// Salts are the secret salts by codepoint, which should be random and
+	// at least 16 bytes; none set hashes CIDs unsalted
+	Salts [quiclb.NumConfigs][]byte
+	// Current is the codepoint whose salt hashes CIDs of unsalted codepoints
+	Current uint8
+}
+
+// Select hashes the DCID, or the client address when the DCID is empty
+func (s CIDHashStrategy) Select(cid []byte, src net.Addr, backends BackendSet) (BackendConfig, error) {
+	key := cid
+	if len(key) == 0 {
+		key = []byte(addrKey(src))
+	} else {
+		key = s.saltedKey(cid)
+	}
+	backend, ok := backends.Hash(key)
+	if !ok {
+		return BackendConfig{}, ErrNoBackends
+	}
+	return backend, nil
+}
+
+// saltedKey returns the ring key of a CID: an HMAC under its salt, so keys
+// collide only as often as the MAC does, or the CID itself with no salts
+func (s CIDHashStrategy) saltedKey(cid []byte) []byte {
+	salt := s.Salts[cid[0]>>6]
+	if salt == nil {
+		salt = s.Salts[s.Current%quiclb.NumConfigs]
+	}
+	if salt == nil {
+		return cid
+	}
+	mac := hmac.New(sha256.New, salt)
+	mac.Write(cid)
+	return mac.Sum(nil)[:8]
+}
+
+// WeightedRandomStrategy picks a healthy backend at random in proportion to
+// its weight, with no affinity. As a fallback it spreads new flows more evenly
+// than hashing client addresses when backends are stateless; the session
+// table still keeps every later packet of a flow on the backend it got.
+type WeightedRandomStrategy struct{}
+
+// Select draws a backend weighted by BackendConfig.Weight
+func (WeightedRandomStrategy) Select(cid []byte, src net.Addr, backends BackendSet) (BackendConfig, error) {
+	healthy := backends.Healthy()
+	total := 0
+	for _, b := range healthy {
+		total += b.weight()
+	}
+	if total == 0 {
+		return BackendConfig{}, ErrNoBackends
+	}
+	n := rand.IntN(total)
+	for _, b := range healthy {
+		if n -= b.weight(); n < 0 {
+			return b, nil
+		}
+	}
+	panic("unreachable")
+}
@@ -0,0 +1,140 @@
+package lb
+
+import (
+	"fmt"
+	"math"
+	"testing"
+
+	"github.com/fqzz2000/QUIC-LB-SHRIMP/pkg/quiclb"
+)
+
+func TestCIDHashStrategy(t *testing.T) {
+	lb, err := NewLoadBalancer(Config{
+		Backends: StaticBackends("10.0.0.1:443", "10.0.0.2:443", "10.0.0.3:443"),
+		Strategy: CIDHashStrategy{},
+	})
+	if err != nil {
+		t.Fatalf("NewLoadBalancer() error = %v", err)
+	}
+
+	// the same DCID from different addresses lands on one backend
+	dcid := []byte{0xc5, 0x11, 0x22, 0x33, 0x44, 0x55, 0x66, 0x77}
+	first, err := lb.selectBackend(dcid, testAddr(1))
+	if err != nil {
+		t.Fatalf("selectBackend() error = %v", err)
+	}
+	if again, _ := lb.selectBackend(dcid, testAddr(2)); again.Address != first.Address {
+		t.Errorf("same DCID routed to %q then %q", first.Address, again.Address)
+	}
+
+	counts := map[string]int{}
+	for i := 0; i < 3000; i++ {
+		backend, err := lb.selectBackend([]byte(fmt.Sprintf("dcid-%04d", i)), testAddr(1))
+		if err != nil {
+			t.Fatalf("selectBackend() error = %v", err)
+		}
+		counts[backend.Address]++
+	}
+	for addr, n := range counts {
+		if n < 700 || n > 1300 {
+			t.Errorf("backend %s got %d of 3000 DCIDs", addr, n)
+		}
+	}
+	if len(counts) != 3 {
+		t.Errorf("DCIDs spread over %d backends, want 3", len(counts))
+	}
+	// the decode path was never consulted
+	if got := lb.Stats().DecodeFailures; got != 0 {
+		t.Errorf("DecodeFailures = %d, want 0", got)
+	}
+}
+
+func TestCIDHashStrategySalts(t *testing.T) {
+	backends := StaticBackends("10.0.0.1:443", "10.0.0.2:443", "10.0.0.3:443", "10.0.0.4:443")
+	oldSalt := []byte("old salt, sixteen bytes or more")
+	newSalt := []byte("new salt, sixteen bytes or more")
+	router := func(s CIDHashStrategy) func(cid []byte) string {
+		lb, err := NewLoadBalancer(Config{Backends: backends, Strategy: s})
+		if err != nil {
+			t.Fatalf("NewLoadBalancer() error = %v", err)
+		}
+		return func(cid []byte) string {
+			backend, err := lb.selectBackend(cid, testAddr(1))
+			if err != nil {
+				t.Fatalf("selectBackend() error = %v", err)
+			}
+			return backend.Address
+		}
+	}
+	unsalted := router(CIDHashStrategy{})
+	before := router(CIDHashStrategy{Salts: [quiclb.NumConfigs][]byte{0: oldSalt}})
+	overlap := router(CIDHashStrategy{Salts: [quiclb.NumConfigs][]byte{0: oldSalt, 1: newSalt}, Current: 1})
+	after := router(CIDHashStrategy{Salts: [quiclb.NumConfigs][]byte{1: newSalt}, Current: 1})
+
+	const cids = 200
+	moved := 0
+	for i := 0; i < cids; i++ {
+		cid := []byte(fmt.Sprintf("\x00cid-%04d", i)) // codepoint 0
+		if before(cid) != unsalted(cid) {
+			moved++
+		}
+		// during the overlap a CID of the old codepoint keeps its backend
+		if got, want := overlap(cid), before(cid); got != want {
+			t.Errorf("CID %x routed to %s during overlap, want %s under the old salt", cid, got, want)
+		}
+		// and one of the new codepoint, or none salted, gets the new mapping
+		for _, bits := range []byte{0x40, 0x80} {
+			cid[0] = bits
+			if got, want := overlap(cid), after(cid); got != want {
+				t.Errorf("CID %x routed to %s during overlap, want %s under the new salt", cid, got, want)
+			}
+		}
+	}
+	// with four backends a salt that changed nothing would move about none,
+	// one that reshuffles moves about three in four
+	if moved < cids/2 {
+		t.Errorf("salting moved %d of %d CIDs, want most", moved, cids)
+	}
+}
+
+func TestWeightedRandomFallbackDistribution(t *testing.T) {
+	lb, err := NewLoadBalancer(Config{
+		Backends: []BackendConfig{
+			{Address: "10.0.0.1:443", Weight: 1},
+			{Address: "10.0.0.2:443", Weight: 3},
+			{Address: "10.0.0.3:443", Weight: 6},
+		},
+		Fallback: WeightedRandomStrategy{},
+	})
+	if err != nil {
+		t.Fatalf("NewLoadBalancer() error = %v", err)
+	}
+
+	const draws = 100000
+	counts := map[string]int{}
+	undecodable := []byte{0xc0, 0x00}
+	for i := 0; i < draws; i++ {
+		// one client address throughout: no affinity means it still spreads
+		backend, err := lb.selectBackend(undecodable, testAddr(1))
+		if err != nil {
+			t.Fatalf("selectBackend() error = %v", err)
+		}
+		counts[backend.Address]++
+	}
+
+	want := map[string]float64{"10.0.0.1:443": 0.1, "10.0.0.2:443": 0.3, "10.0.0.3:443": 0.6}
+	for addr, p := range want {
+		got := float64(counts[addr]) / draws
+		// about six standard deviations at these sizes
+		if math.Abs(got-p) > 0.01 {
+			t.Errorf("backend %s share = %.4f, want %.2f", addr, got, p)
+		}
+	}
+
+	lb.SetBackendHealth("10.0.0.3:443", false)
+	for i := 0; i < 1000; i++ {
+		if backend, _ := lb.selectBackend(undecodable, testAddr(1)); backend.Address == "10.0.0.3:443" {
+			t.Fatalf("unhealthy backend drawn")
+		}
+	}
+}
@@ -0,0 +1,59 @@
+package lb
+
+import (
+	"github.com/fqzz2000/QUIC-LB-SHRIMP/pkg/packet"
+)
+
+// Some servers encode their own identity in the Retry and NEW_TOKEN tokens
+// they issue. A client returning such a token in an Initial has already
+// been told which server to come back to, but its DCID is either one that
+// server chose without QUIC-LB encoding or one the client made up, so the
+// CID alone would send it anywhere. A configured TokenDecoder
+// (Config.TokenDecoder), holding the servers' token key, reads the server
+// ID out of the token and the Initial is routed by it as a decoded CID
+// would be. Token formats are server-specific, hence the hook. A token the
+// decoder cannot read, or a server ID that names no available backend,
+// leaves the Initial to the CID.
+
+// TokenDecoder extracts the server ID a server encoded in a token it issued.
+// It is called from packet-processing goroutines concurrently and must not
+// retain token.
+type TokenDecoder interface {
+	ServerID(token []byte) ([]byte, error)
+}
+
+// initialToken returns the token of a client Initial for the configured
+// TokenDecoder, nil without one, for a packet of another type or without a
+// token
+func (lb *LoadBalancer) initialToken(header packet.QuicHeader, pkt []byte) []byte {
+	lh, ok := header.(*packet.LongHeader)
+	if lb.routes().tokens == nil || !ok || lh.LongPacketType != packet.Initial {
+		return nil
+	}
+	token, err := lh.Token(pkt)
+	if err != nil || len(token) == 0 {
+		return nil
+	}
+	return token
+}
+
+// tokenBackend routes a new flow by the server ID in its Initial's token,
+// reporting false when it has none or the server ID does not route to an
+// available backend of rt
+func (lb *LoadBalancer) tokenBackend(rt *routingTable, res *DecodeResult) (BackendConfig, bool) {
+	if rt.tokens == nil || len(res.token) == 0 {
+		return BackendConfig{}, false
+	}
+	serverID, err := rt.tokens.ServerID(res.token)
+	if err != nil {
+		lb.stats.tokenFailures.Add(1)
+		return BackendConfig{}, false
+	}
+	backend, err := rt.backendForServerID(rt.issueRotation, serverID)
+	if err != nil || lb.unavailable(backend.Address) {
+		lb.stats.tokenFailures.Add(1)
+		return BackendConfig{}, false
+	}
+	lb.stats.tokenRouted.Add(1)
+	return backend, true
+}
@@ -0,0 +1,72 @@
+package lb
+
+import (
+	"bytes"
+	"errors"
+	"testing"
+)
+
+// prefixTokens is a TokenDecoder for tokens of the form "srv" serverID
+type prefixTokens struct{}
+
+func (prefixTokens) ServerID(token []byte) ([]byte, error) {
+	if !bytes.HasPrefix(token, []byte("srv")) || len(token) != 4 {
+		return nil, errors.New("not a server token")
+	}
+	return token[3:], nil
+}
+
+func TestTokenRouting(t *testing.T) {
+	fwd := memForwarder{opened: make(chan *memConn, 8)}
+	lb, _ := newMemLB(t, Config{
+		Backends: []BackendConfig{
+			{Address: "192.0.2.100:443", Forwarder: fwd},
+			{Address: "192.0.2.101:443", Forwarder: fwd},
+			{Address: "192.0.2.102:443", Forwarder: fwd},
+		},
+		TokenDecoder: prefixTokens{},
+	})
+	lb.SetBackendHealth("192.0.2.101:443", false)
+	// the DCID's codepoint has no config, so it never decodes
+	dcid := []byte{0xc0, 0x01, 0x02, 0x03, 0x04, 0x05, 0x06, 0x07}
+
+	tests := []struct {
+		name         string
+		token        []byte
+		wantRoute    Route
+		wantBackend  string
+		wantFailures uint64
+	}{
+		{name: "Server Token", token: []byte("srv\x02"), wantRoute: RouteToken, wantBackend: "192.0.2.102:443"},
+		{name: "No Token", wantRoute: RouteFallback},
+		{name: "Unreadable Token", token: []byte("opaque"), wantRoute: RouteFallback, wantFailures: 1},
+		{name: "Unknown Server ID", token: []byte("srv\x09"), wantRoute: RouteFallback, wantFailures: 1},
+		{name: "Unhealthy Server", token: []byte("srv\x01"), wantRoute: RouteFallback, wantFailures: 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			before := lb.Stats().TokenFailures
+			res, err := lb.DecodePacket(initialWithToken(dcid, tt.token, 1200), testAddr(1))
+			if err != nil {
+				t.Fatalf("DecodePacket() error = %v", err)
+			}
+			if res.Route != tt.wantRoute || (tt.wantBackend != "" && res.Backend != tt.wantBackend) {
+				t.Errorf("DecodePacket() = %s by %s, want %q by %s", res.Backend, res.Route, tt.wantBackend, tt.wantRoute)
+			}
+			if got := lb.Stats().TokenFailures - before; got != tt.wantFailures {
+				t.Errorf("TokenFailures grew by %d, want %d", got, tt.wantFailures)
+			}
+		})
+	}
+
+	// a forwarded Initial opens its flow to the token's server
+	if err := lb.handlePacket(initialWithToken(dcid, []byte("srv\x00"), 1200), testAddr(2)); err != nil {
+		t.Fatalf("handlePacket() error = %v", err)
+	}
+	if flow := lb.sessions.lookupCID(dcid); flow == nil || flow.Backend != "192.0.2.100:443" {
+		t.Errorf("flow after token Initial = %+v, want one to 192.0.2.100:443", flow)
+	}
+	if got := lb.Stats().TokenRouted; got != 2 {
+		t.Errorf("TokenRouted = %d, want 2", got)
+	}
+}
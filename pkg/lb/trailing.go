@@ -0,0 +1,61 @@
+package lb
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/fqzz2000/QUIC-LB-SHRIMP/pkg/packet"
+)
+
+// Trailing byte policies (Config.TrailingBytes) decide what happens to a
+// long-header datagram with bytes left after its coalesced packets that
+// cannot be a packet (packet.TrailingBytes), such as zeros appended to pad
+// it or garbage from a broken or hostile client. Such datagrams are counted
+// whatever the policy. "forward", the default, passes them on untouched, so
+// the LB stays transparent and the backend decides; "drop" discards them;
+// "trim" cuts the trailing bytes off and forwards the packets. The
+// datagram size the anti-amplification budget and the Initial size checks
+// see is the client's, trailing bytes included.
+const (
+	trailingForward = "forward"
+	trailingDrop    = "drop"
+	trailingTrim    = "trim"
+)
+
+var (
+	// errTrailingBytesPolicy is returned for an unknown Config.TrailingBytes
+	errTrailingBytesPolicy = errors.New("invalid trailing byte policy")
+	// errTrailingBytes is returned for a datagram dropped for its trailing bytes
+	errTrailingBytes = errors.New("datagram has trailing bytes")
+)
+
+// trailingBytes returns the trailing byte policy
+func (c *Config) trailingBytes() (string, error) {
+	switch c.TrailingBytes {
+	case "":
+		return trailingForward, nil
+	case trailingForward, trailingDrop, trailingTrim:
+		return c.TrailingBytes, nil
+	}
+	return "", fmt.Errorf("%w: %q", errTrailingBytesPolicy, c.TrailingBytes)
+}
+
+// checkTrailing applies the trailing byte policy to a client datagram,
+// returning the datagram to route
+func (lb *LoadBalancer) checkTrailing(processor *packet.PacketProcessor, datagram []byte) ([]byte, error) {
+	if datagram[0]&0x80 == 0 {
+		return datagram, nil
+	}
+	n := processor.TrailingBytes(datagram)
+	if n == 0 {
+		return datagram, nil
+	}
+	lb.stats.trailingBytes.Add(1)
+	switch lb.trailing {
+	case trailingDrop:
+		return nil, fmt.Errorf("%w: %d of %d bytes", errTrailingBytes, n, len(datagram))
+	case trailingTrim:
+		return datagram[:len(datagram)-n], nil
+	}
+	return datagram, nil
+}
@@ -0,0 +1,60 @@
+package lb
+
+import (
+	"bytes"
+	"errors"
+	"testing"
+
+	"github.com/fqzz2000/QUIC-LB-SHRIMP/pkg/packet"
+)
+
+func TestTrailingBytes(t *testing.T) {
+	initial := quicLongHeader(packet.Initial, []byte{0xc0, 1, 2, 3, 4, 5, 6, 7}, []byte{0xa1}, make([]byte, 1200))
+	padded := append(append([]byte(nil), initial...), make([]byte, 16)...)
+	tests := []struct {
+		name    string
+		policy  string
+		want    []byte // forwarded, nil when dropped
+		wantErr error
+	}{
+		{name: "Default Forwards", want: padded},
+		{name: "Forward", policy: trailingForward, want: padded},
+		{name: "Drop", policy: trailingDrop, wantErr: errTrailingBytes},
+		{name: "Trim", policy: trailingTrim, want: initial},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fwd := memForwarder{opened: make(chan *memConn, 1)}
+			lb, _ := newMemLB(t, Config{
+				Backends:      []BackendConfig{{Address: "192.0.2.100:443", Forwarder: fwd}},
+				TrailingBytes: tt.policy,
+			})
+			err := lb.handlePacket(padded, testAddr(1))
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("handlePacket() error = %v, want %v", err, tt.wantErr)
+			}
+			if err != nil {
+				if dropReasonFor(err) != dropTrailingBytes || len(fwd.opened) != 0 {
+					t.Errorf("dropped datagram classed %s with %d flows opened, want trailing_bytes and none", dropReasonNames[dropReasonFor(err)], len(fwd.opened))
+				}
+			} else if got := expect(t, expect(t, fwd.opened).sent); !bytes.Equal(got, tt.want) {
+				t.Errorf("forwarded %d bytes, want %d", len(got), len(tt.want))
+			}
+			if got := lb.Stats().TrailingBytes; got != 1 {
+				t.Errorf("TrailingBytes = %d, want 1", got)
+			}
+
+			// a datagram ending in its packet is left alone
+			if err := lb.handlePacket(initial, testAddr(2)); err != nil {
+				t.Fatalf("handlePacket(no trailing bytes) error = %v", err)
+			}
+			if got := lb.Stats().TrailingBytes; got != 1 {
+				t.Errorf("after a clean datagram TrailingBytes = %d, want 1", got)
+			}
+		})
+	}
+
+	if _, err := (&Config{TrailingBytes: "pad"}).trailingBytes(); !errors.Is(err, errTrailingBytesPolicy) {
+		t.Errorf("trailingBytes(pad) error = %v, want %v", err, errTrailingBytesPolicy)
+	}
+}
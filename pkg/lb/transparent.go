@@ -0,0 +1,72 @@
+package lb
+
+import (
+	"errors"
+	"log"
+	"net"
+	"net/netip"
+)
+
+// Transparent mode ("transparent" as Config.ListenNetwork) receives QUIC
+// datagrams addressed to other hosts, typically virtual IPs diverted to the
+// listener by an iptables/nftables TPROXY rule, without the LB owning those
+// addresses. Routing is unchanged; the listener records each datagram's
+// original destination and sources replies from it, so clients see answers
+// from the address they dialled.
+//
+// It is Linux-only and needs CAP_NET_ADMIN (or CAP_NET_RAW) for
+// IP_TRANSPARENT, plus policy routing that delivers the diverted traffic
+// locally, e.g.:
+//
+//	iptables -t mangle -A PREROUTING -p udp --dport 443 -j TPROXY --on-port 8443 --tproxy-mark 0x1
+//	ip rule add fwmark 0x1 lookup 100
+//	ip route add local 0.0.0.0/0 dev lo table 100
+//
+// When the socket options cannot be set the listener falls back to plain UDP.
+
+// errTransparentUnsupported is returned by listenTransparent off Linux
+var errTransparentUnsupported = errors.New("transparent mode requires Linux")
+
+// transparentAddr is a client address read by the transparent listener. It
+// carries the original destination of the client's datagram so the return
+// path can send from it; everywhere else it behaves as the UDP address.
+type transparentAddr struct {
+	net.UDPAddr
+	dst netip.AddrPort
+}
+
+// udpAddr returns the UDP address behind addr, unwrapping transparentAddr
+func udpAddr(addr net.Addr) (*net.UDPAddr, bool) {
+	switch a := addr.(type) {
+	case *net.UDPAddr:
+		return a, true
+	case *transparentAddr:
+		return &a.UDPAddr, true
+	}
+	return nil, false
+}
+
+// destAddr returns the address a client sent to: its original destination in
+// transparent mode, otherwise the address of ln, the listener it arrived on
+func (lb *LoadBalancer) destAddr(client net.Addr, ln *clientListener) net.Addr {
+	if t, ok := client.(*transparentAddr); ok {
+		return net.UDPAddrFromAddrPort(t.dst)
+	}
+	if ln != nil {
+		return ln.conn.LocalAddr()
+	}
+	return lb.Addr()
+}
+
+// listen opens the client-facing listener for the configured network
+func (lb *LoadBalancer) listen() (net.PacketConn, error) {
+	if lb.listenNet != "transparent" {
+		return net.ListenPacket(lb.listenNet, lb.listenAddr)
+	}
+	conn, err := listenTransparent(lb.listenAddr)
+	if err == nil {
+		return conn, nil
+	}
+	log.Printf("Transparent listener unavailable, falling back to plain UDP: %v", err)
+	return net.ListenPacket("udp", lb.listenAddr)
+}
@@ -0,0 +1,157 @@
+//go:build linux
+
+package lb
+
+import (
+	"context"
+	"encoding/binary"
+	"net"
+	"net/netip"
+	"syscall"
+)
+
+// socket options missing from package syscall
+const (
+	ipTransparent       = 0x13
+	ipRecvOrigDstAddr   = 0x14 // also the cmsg type carrying the address
+	ipv6Transparent     = 0x4b
+	ipv6RecvOrigDstAddr = 0x4a // also the cmsg type carrying the address
+)
+
+// oobSize fits one sockaddr_in6 control message
+const oobSize = 64
+
+// transparentConn is a UDP socket with IP_TRANSPARENT set. Reads report the
+// original destination inside a transparentAddr; writes to such an address
+// are sourced from that destination with IP_PKTINFO, which the kernel allows
+// for non-local addresses on transparent sockets.
+type transparentConn struct {
+	*net.UDPConn
+	// oob receives the control messages of a read; readLoop is a conn's
+	// only reader, so one buffer serves every datagram
+	oob [oobSize]byte
+}
+
+func listenTransparent(addr string) (net.PacketConn, error) {
+	lc := net.ListenConfig{Control: func(network, address string, c syscall.RawConn) error {
+		var serr error
+		err := c.Control(func(fd uintptr) {
+			serr = setTransparent(int(fd), network == "udp6")
+		})
+		if err != nil {
+			return err
+		}
+		return serr
+	}}
+	conn, err := lc.ListenPacket(context.Background(), "udp", addr)
+	if err != nil {
+		return nil, err
+	}
+	return &transparentConn{UDPConn: conn.(*net.UDPConn)}, nil
+}
+
+// setTransparent enables transparent receive and original-destination
+// reporting. An IPv6 socket also needs the IPv4 options for mapped clients,
+// which are best effort there.
+func setTransparent(fd int, ipv6 bool) error {
+	v4 := func() error {
+		if err := syscall.SetsockoptInt(fd, syscall.SOL_IP, ipTransparent, 1); err != nil {
+			return err
+		}
+		return syscall.SetsockoptInt(fd, syscall.SOL_IP, ipRecvOrigDstAddr, 1)
+	}
+	if !ipv6 {
+		return v4()
+	}
+	if err := syscall.SetsockoptInt(fd, syscall.SOL_IPV6, ipv6Transparent, 1); err != nil {
+		return err
+	}
+	if err := syscall.SetsockoptInt(fd, syscall.SOL_IPV6, ipv6RecvOrigDstAddr, 1); err != nil {
+		return err
+	}
+	v4()
+	return nil
+}
+
+func (c *transparentConn) ReadFrom(b []byte) (int, net.Addr, error) {
+	oob := c.oob[:]
+	n, oobn, _, src, err := c.ReadMsgUDPAddrPort(b, oob)
+	if err != nil {
+		return n, nil, err
+	}
+	addr := net.UDPAddrFromAddrPort(src)
+	if dst, ok := parseOrigDst(oob[:oobn]); ok {
+		return n, &transparentAddr{UDPAddr: *addr, dst: dst}, nil
+	}
+	return n, addr, nil
+}
+
+func (c *transparentConn) WriteTo(b []byte, addr net.Addr) (int, error) {
+	t, ok := addr.(*transparentAddr)
+	if !ok {
+		return c.UDPConn.WriteTo(b, addr)
+	}
+	n, _, err := c.WriteMsgUDPAddrPort(b, pktinfo(t.dst.Addr()), t.AddrPort())
+	return n, err
+}
+
+// parseOrigDst finds the IP_ORIGDSTADDR or IPV6_ORIGDSTADDR control message
+// and decodes its sockaddr
+func parseOrigDst(oob []byte) (netip.AddrPort, bool) {
+	msgs, err := syscall.ParseSocketControlMessage(oob)
+	if err != nil {
+		return netip.AddrPort{}, false
+	}
+	for _, m := range msgs {
+		switch {
+		case m.Header.Level == syscall.SOL_IP && m.Header.Type == ipRecvOrigDstAddr:
+			// sockaddr_in: family, big-endian port, address
+			if len(m.Data) < 8 {
+				continue
+			}
+			ip := netip.AddrFrom4([4]byte(m.Data[4:8]))
+			return netip.AddrPortFrom(ip, binary.BigEndian.Uint16(m.Data[2:4])), true
+		case m.Header.Level == syscall.SOL_IPV6 && m.Header.Type == ipv6RecvOrigDstAddr:
+			// sockaddr_in6: family, big-endian port, flow info, address
+			if len(m.Data) < 24 {
+				continue
+			}
+			ip := netip.AddrFrom16([16]byte(m.Data[8:24]))
+			return netip.AddrPortFrom(ip, binary.BigEndian.Uint16(m.Data[2:4])), true
+		}
+	}
+	return netip.AddrPort{}, false
+}
+
+// pktinfo builds the control message that sources a datagram from src
+func pktinfo(src netip.Addr) []byte {
+	if src.Is4() || src.Is4In6() {
+		// in_pktinfo: interface index, spec_dst (the source), addr
+		var info [12]byte
+		a := src.Unmap().As4()
+		copy(info[4:8], a[:])
+		return appendCmsg(nil, syscall.SOL_IP, syscall.IP_PKTINFO, info[:])
+	}
+	// in6_pktinfo: address, interface index
+	var info [20]byte
+	a := src.As16()
+	copy(info[:16], a[:])
+	return appendCmsg(nil, syscall.SOL_IPV6, syscall.IPV6_PKTINFO, info[:])
+}
+
+// appendCmsg appends one control message. The length field of cmsghdr is
+// pointer-sized, the rest of the header two ints.
+func appendCmsg(b []byte, level, typ int, data []byte) []byte {
+	msg := make([]byte, syscall.CmsgSpace(len(data)))
+	length := uint64(syscall.CmsgLen(len(data)))
+	if syscall.SizeofCmsghdr == 16 {
+		binary.NativeEndian.PutUint64(msg[0:], length)
+	} else {
+		binary.NativeEndian.PutUint32(msg[0:], uint32(length))
+	}
+	lenSize := syscall.SizeofCmsghdr - 8
+	binary.NativeEndian.PutUint32(msg[lenSize:], uint32(int32(level)))
+	binary.NativeEndian.PutUint32(msg[lenSize+4:], uint32(int32(typ)))
+	copy(msg[syscall.CmsgLen(0):], data)
+	return append(b, msg...)
+}
@@ -0,0 +1,100 @@
+//go:build linux
+
+package lb
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"net"
+	"net/netip"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func TestParseOrigDst(t *testing.T) {
+	sin := make([]byte, 16)
+	binary.NativeEndian.PutUint16(sin, syscall.AF_INET)
+	binary.BigEndian.PutUint16(sin[2:], 443)
+	copy(sin[4:], []byte{203, 0, 113, 7})
+
+	sin6 := make([]byte, 28)
+	binary.NativeEndian.PutUint16(sin6, syscall.AF_INET6)
+	binary.BigEndian.PutUint16(sin6[2:], 8443)
+	v6 := netip.MustParseAddr("2001:db8::7").As16()
+	copy(sin6[8:], v6[:])
+
+	tests := []struct {
+		name   string
+		oob    []byte
+		want   netip.AddrPort
+		wantOK bool
+	}{
+		{name: "IPv4", oob: appendCmsg(nil, syscall.SOL_IP, ipRecvOrigDstAddr, sin), want: netip.MustParseAddrPort("203.0.113.7:443"), wantOK: true},
+		{name: "IPv6", oob: appendCmsg(nil, syscall.SOL_IPV6, ipv6RecvOrigDstAddr, sin6), want: netip.MustParseAddrPort("[2001:db8::7]:8443"), wantOK: true},
+		{
+			name:   "after another message",
+			oob:    appendCmsg(appendCmsg(nil, syscall.SOL_IP, syscall.IP_TTL, []byte{64, 0, 0, 0}), syscall.SOL_IP, ipRecvOrigDstAddr, sin),
+			want:   netip.MustParseAddrPort("203.0.113.7:443"),
+			wantOK: true,
+		},
+		{name: "truncated sockaddr", oob: appendCmsg(nil, syscall.SOL_IP, ipRecvOrigDstAddr, sin[:6])},
+		{name: "no control messages"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, ok := parseOrigDst(tt.oob)
+			if ok != tt.wantOK || got != tt.want {
+				t.Errorf("parseOrigDst() = %v, %v, want %v, %v", got, ok, tt.want, tt.wantOK)
+			}
+		})
+	}
+}
+
+func TestTransparentListenerRoundTrip(t *testing.T) {
+	conn, err := listenTransparent("127.0.0.1:0")
+	if errors.Is(err, syscall.EPERM) {
+		t.Skip("IP_TRANSPARENT needs CAP_NET_ADMIN")
+	}
+	if err != nil {
+		t.Fatalf("listenTransparent() error = %v", err)
+	}
+	defer conn.Close()
+
+	client := newTestClient(t)
+	client.WriteTo([]byte("hello"), conn.LocalAddr())
+
+	buf := make([]byte, maxPacketSize)
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+	n, src, err := conn.ReadFrom(buf)
+	if err != nil {
+		t.Fatalf("ReadFrom() error = %v", err)
+	}
+	if !bytes.Equal(buf[:n], []byte("hello")) {
+		t.Errorf("ReadFrom() payload = %q, want %q", buf[:n], "hello")
+	}
+	ta, ok := src.(*transparentAddr)
+	if !ok {
+		t.Fatalf("ReadFrom() address is %T, want *transparentAddr", src)
+	}
+	if want := conn.LocalAddr().(*net.UDPAddr).AddrPort(); ta.dst != want {
+		t.Errorf("original destination = %v, want %v", ta.dst, want)
+	}
+	if ta.String() != client.LocalAddr().String() {
+		t.Errorf("source = %v, want %v", ta, client.LocalAddr())
+	}
+
+	if _, err := conn.WriteTo([]byte("world"), src); err != nil {
+		t.Fatalf("WriteTo() error = %v", err)
+	}
+	client.SetReadDeadline(time.Now().Add(time.Second))
+	n, from, err := client.ReadFrom(buf)
+	if err != nil {
+		t.Fatalf("client ReadFrom() error = %v", err)
+	}
+	if string(buf[:n]) != "world" || from.String() != conn.LocalAddr().String() {
+		t.Errorf("reply = %q from %v, want %q from %v", buf[:n], from, "world", conn.LocalAddr())
+	}
+}
@@ -0,0 +1,9 @@
+//go:build !linux
+
+package lb
+
+import "net"
+
+func listenTransparent(addr string) (net.PacketConn, error) {
+	return nil, errTransparentUnsupported
+}
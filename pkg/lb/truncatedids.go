@@ -0,0 +1,84 @@
+package lb
+
+import (
+	"encoding/hex"
+	"fmt"
+	"slices"
+)
+
+// Truncated server IDs (Config.TruncatedServerIDs) serve fleets with more
+// servers than a CID's server ID field can number: each server's real ID
+// is hashed and truncated to the field, and an operator-kept map takes the
+// truncated value to the backend. Only the first bytes of a decoded server
+// ID, as many as the map's keys have, are looked up; a value missing from
+// the map is ErrUnknownServerID, handled as for any such decode. Backends
+// added at runtime are not in the map and take only fallback flows until a
+// config mapping them is applied.
+
+// truncatedIDs maps truncated server IDs to backend indexes. Indexes stay
+// valid as backends are added and removed, since removal leaves a
+// tombstone in place. Immutable once built.
+type truncatedIDs struct {
+	length int
+	ids    map[string]int
+}
+
+// newTruncatedIDs builds the map of cfg, or returns nil when it sets none.
+// Keys are hex and all of one length, no longer than any server ID the
+// active configs decode; values must be configured backends.
+func newTruncatedIDs(cfg *Config) (*truncatedIDs, error) {
+	if len(cfg.TruncatedServerIDs) == 0 {
+		return nil, nil
+	}
+	for _, b := range cfg.Backends {
+		if len(b.ServerIDs) > 0 {
+			return nil, fmt.Errorf("%w: TruncatedServerIDs and the ServerIDs of %s are exclusive", errBadServerIDs, b.Address)
+		}
+	}
+	t := &truncatedIDs{ids: make(map[string]int, len(cfg.TruncatedServerIDs))}
+	for key, addr := range cfg.TruncatedServerIDs {
+		id, err := hex.DecodeString(key)
+		if err != nil || len(id) == 0 {
+			return nil, fmt.Errorf("%w: truncated server ID %q is not hex", errBadServerIDs, key)
+		}
+		if t.length == 0 {
+			t.length = len(id)
+		} else if len(id) != t.length {
+			return nil, fmt.Errorf("%w: truncated server IDs of %d and %d bytes", errBadServerIDs, t.length, len(id))
+		}
+		idx := slices.IndexFunc(cfg.Backends, func(b BackendConfig) bool { return b.Address == addr })
+		if idx < 0 {
+			return nil, fmt.Errorf("%w: truncated server ID %s maps to %q, not a configured backend", errBadServerIDs, key, addr)
+		}
+		t.ids[string(id)] = idx
+	}
+	for n := range serverIDLengths(cfg.QUICLB) {
+		if n < t.length {
+			return nil, fmt.Errorf("%w: %d byte truncated server IDs do not fit %d byte server IDs", errBadServerIDs, t.length, n)
+		}
+	}
+	return t, nil
+}
+
+// lookup returns the index of the backend serverID's truncation maps to
+func (t *truncatedIDs) lookup(serverID []byte) (int, bool) {
+	if len(serverID) < t.length {
+		return 0, false
+	}
+	idx, ok := t.ids[string(serverID[:t.length])]
+	return idx, ok
+}
+
+// serverID returns an n-byte server ID whose truncation maps to the
+// backend at idx, padded with zeros
+func (t *truncatedIDs) serverID(idx, n int) ([]byte, bool) {
+	if n < t.length {
+		return nil, false
+	}
+	for id, i := range t.ids {
+		if i == idx {
+			return append([]byte(id), make([]byte, n-t.length)...), true
+		}
+	}
+	return nil, false
+}
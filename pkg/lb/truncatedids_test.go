@@ -0,0 +1,86 @@
+package lb
+
+import (
+	"bytes"
+	"errors"
+	"testing"
+
+	"github.com/fqzz2000/QUIC-LB-SHRIMP/pkg/quiclb"
+)
+
+func TestTruncatedServerIDs(t *testing.T) {
+	lb, err := NewLoadBalancer(Config{
+		Backends: StaticBackends("10.0.0.1:443", "10.0.0.2:443", "10.0.0.3:443"),
+		QUICLB: [quiclb.NumConfigs]quiclb.ConfigEntry{
+			{Algorithm: quiclb.StreamCipher, ServerIDLength: 3, NonceLength: 8, Key: bytes.Repeat([]byte{0x2b}, quiclb.KeyLength)},
+		},
+		TruncatedServerIDs: map[string]string{"a1b2": "10.0.0.3:443", "0001": "10.0.0.1:443"},
+	})
+	if err != nil {
+		t.Fatalf("NewLoadBalancer() error = %v", err)
+	}
+	tests := []struct {
+		name     string
+		serverID []byte
+		want     string
+		wantErr  error
+	}{
+		// the byte past the truncated ID is not looked at
+		{name: "Hit", serverID: []byte{0xa1, 0xb2, 0x00}, want: "10.0.0.3:443"},
+		{name: "Hit Other Suffix", serverID: []byte{0xa1, 0xb2, 0xff}, want: "10.0.0.3:443"},
+		// index mode would take server ID 1 to the second backend
+		{name: "Not By Index", serverID: []byte{0x00, 0x01, 0x00}, want: "10.0.0.1:443"},
+		{name: "Miss", serverID: []byte{0x00, 0x02, 0x00}, wantErr: ErrUnknownServerID},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cid, err := lb.routes().codec.Encode(0, tt.serverID, nil)
+			if err != nil {
+				t.Fatalf("Encode() error = %v", err)
+			}
+			backend, err := lb.routeCID(cid)
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("routeCID() error = %v, want %v", err, tt.wantErr)
+			}
+			if backend.Address != tt.want {
+				t.Errorf("routeCID() = %q, want %q", backend.Address, tt.want)
+			}
+		})
+	}
+
+	// the LB's own server IDs for a backend truncate back to it
+	id, ok := lb.routes().serverIDFor("10.0.0.3:443", 3)
+	if !ok || !bytes.Equal(id, []byte{0xa1, 0xb2, 0x00}) {
+		t.Errorf("serverIDFor() = %x, %v, want a1b200", id, ok)
+	}
+	if _, ok := lb.routes().serverIDFor("10.0.0.2:443", 3); ok {
+		t.Error("serverIDFor(unmapped backend) ok, want none")
+	}
+}
+
+func TestTruncatedServerIDsConfig(t *testing.T) {
+	tests := []struct {
+		name    string
+		ids     map[string]string
+		backend BackendConfig
+	}{
+		{name: "Not Hex", ids: map[string]string{"zz": "10.0.0.1:443"}},
+		{name: "Mixed Lengths", ids: map[string]string{"01": "10.0.0.1:443", "0203": "10.0.0.1:443"}},
+		{name: "Unknown Backend", ids: map[string]string{"01": "10.0.0.9:443"}},
+		// the default config has one-byte server IDs
+		{name: "Too Long", ids: map[string]string{"0102": "10.0.0.1:443"}},
+		{name: "With ServerIDs", ids: map[string]string{"01": "10.0.0.1:443"}, backend: BackendConfig{Address: "10.0.0.2:443", ServerIDs: [][]byte{{0x02}}}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			backends := StaticBackends("10.0.0.1:443")
+			if tt.backend.Address != "" {
+				backends = append(backends, tt.backend)
+			}
+			_, err := NewLoadBalancer(Config{Backends: backends, TruncatedServerIDs: tt.ids})
+			if !errors.Is(err, errBadServerIDs) {
+				t.Errorf("NewLoadBalancer() error = %v, want %v", err, errBadServerIDs)
+			}
+		})
+	}
+}
@@ -0,0 +1,77 @@
+package lb
+
+import (
+	"bytes"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// shortTempDir returns a directory short enough for Unix socket paths
+func shortTempDir(t *testing.T) string {
+	t.Helper()
+	dir, err := os.MkdirTemp("", "shrimp")
+	if err != nil {
+		t.Fatalf("MkdirTemp() error = %v", err)
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+	return dir
+}
+
+func TestUnixgramListener(t *testing.T) {
+	dir := shortTempDir(t)
+	backend := startEchoBackend(t)
+	lbPath := filepath.Join(dir, "lb.sock")
+	lb := startTestLB(t, Config{
+		ListenNetwork: "unixgram",
+		ListenAddr:    lbPath,
+		Backends:      StaticBackends(backend),
+	})
+
+	// the sidecar end binds its own path so responses can be returned to it
+	client, err := net.ListenUnixgram("unixgram", &net.UnixAddr{Name: filepath.Join(dir, "client.sock"), Net: "unixgram"})
+	if err != nil {
+		t.Fatalf("ListenUnixgram() error = %v", err)
+	}
+	defer client.Close()
+
+	cid, _ := lb.routes().codec.Encode(0, []byte{0x00}, nil)
+	pkt := append(append([]byte{0x40}, cid...), []byte("payload")...)
+	if _, err := client.WriteTo(pkt, lb.Addr()); err != nil {
+		t.Fatalf("WriteTo() error = %v", err)
+	}
+	if got := readWithin(t, client, time.Second); !bytes.Equal(got, pkt) {
+		t.Fatalf("response = %x, want %x", got, pkt)
+	}
+
+	lb.Shutdown()
+	if _, err := os.Stat(lbPath); !os.IsNotExist(err) {
+		t.Errorf("socket file left behind after Shutdown: %v", err)
+	}
+}
+
+func TestUnixgramUnboundPeerDropped(t *testing.T) {
+	dir := shortTempDir(t)
+	lb := startTestLB(t, Config{
+		ListenNetwork: "unixgram",
+		ListenAddr:    filepath.Join(dir, "lb.sock"),
+		Backends:      StaticBackends(startEchoBackend(t)),
+	})
+
+	conn, err := net.Dial("unixgram", lb.Addr().String())
+	if err != nil {
+		t.Fatalf("Dial() error = %v", err)
+	}
+	defer conn.Close()
+	conn.Write([]byte{0x40, 0x00, 0x01, 0x02, 0x03, 0x04, 0x05, 0x06})
+
+	deadline := time.Now().Add(time.Second)
+	for lb.Stats().PacketsDropped == 0 && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond)
+	}
+	if got := lb.Stats().PacketsDropped; got != 1 {
+		t.Errorf("PacketsDropped = %d, want 1", got)
+	}
+}
@@ -0,0 +1,87 @@
+package lb
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"slices"
+
+	"github.com/fqzz2000/QUIC-LB-SHRIMP/pkg/packet"
+)
+
+// A backend may speak only some QUIC versions (BackendConfig.Versions), and
+// backends listing the same ones form a version group. The first long header
+// of a new connection routed to a backend whose list lacks its version is
+// not forwarded: the LB answers it with a Version Negotiation packet listing
+// the backend's versions, as the backend itself would (RFC 9000 section
+// 6.1), and the client retries in one of them. As RFC 9000 section 5.2.2
+// requires, a datagram too small to carry an Initial gets no answer. The
+// answer is also held to the anti-amplification limit of
+// Config.AmplificationFactor times the datagram: a version list too long for
+// it is cut to the versions that fit, the first listed kept, and counted.
+// Packets of open flows pass whatever their version.
+
+var (
+	// errUnsupportedVersion is returned for a new connection in a version its
+	// backend does not speak
+	errUnsupportedVersion = errors.New("backend does not support the QUIC version")
+	// errVersionNegotiation is returned for a packet answered with a Version
+	// Negotiation packet
+	errVersionNegotiation = errors.New("answered with version negotiation")
+)
+
+// checkVersions rejects a version list naming version 0, which is reserved
+// for Version Negotiation
+func (b BackendConfig) checkVersions() error {
+	if slices.Contains(b.Versions, 0) {
+		return fmt.Errorf("%w: %s lists version 0", errBadBackend, b.Address)
+	}
+	return nil
+}
+
+// supportsVersion reports whether the backend speaks a version; one with no
+// list speaks all of them
+func (b BackendConfig) supportsVersion(version uint32) bool {
+	return len(b.Versions) == 0 || slices.Contains(b.Versions, version)
+}
+
+// negotiateVersion answers the first long header of a new connection, in a
+// datagram of size bytes, with Version Negotiation when its backend does not
+// speak its version, sent to src through ln. It returns nil when the packet
+// may be forwarded.
+func (lb *LoadBalancer) negotiateVersion(backend BackendConfig, header packet.QuicHeader, size int, src net.Addr, ln *clientListener) error {
+	lh, ok := header.(*packet.LongHeader)
+	if !ok || lh.Version == 0 || backend.supportsVersion(lh.Version) {
+		return nil
+	}
+	if size < packet.MinInitialSize {
+		return fmt.Errorf("%w: %#08x to %s", errUnsupportedVersion, lh.Version, backend.Address)
+	}
+	vn, err := lb.versionNegotiation(lh, backend.Versions, size)
+	if err != nil {
+		return fmt.Errorf("%w: %#08x to %s: %w", errUnsupportedVersion, lh.Version, backend.Address, err)
+	}
+	n, err := lb.clientConn(ln).WriteTo(vn, src)
+	if err := lb.checkWrite(n, len(vn), err); err != nil {
+		return err
+	}
+	lb.stats.versionNegotiations.Add(1)
+	return fmt.Errorf("%w: %#08x to %s", errVersionNegotiation, lh.Version, backend.Address)
+}
+
+// versionNegotiation builds the Version Negotiation answering lh, from a
+// datagram of size bytes, listing as many of versions as the amplification
+// limit leaves room for
+func (lb *LoadBalancer) versionNegotiation(lh *packet.LongHeader, versions []uint32, size int) ([]byte, error) {
+	if lb.ampFactor < 0 {
+		return packet.VersionNegotiationPacket(lh.DCID, lh.SCID, versions), nil
+	}
+	vn, err := packet.VersionNegotiationPacketWithin(lh.DCID, lh.SCID, versions, lb.ampFactor*size)
+	if err != nil {
+		return nil, err
+	}
+	if listed := (len(vn) - 7 - len(lh.DCID) - len(lh.SCID)) / 4; listed < len(versions) {
+		lb.stats.versionListsCut.Add(1)
+	}
+	return vn, nil
+}
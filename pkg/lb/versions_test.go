@@ -0,0 +1,111 @@
+package lb
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"testing"
+
+	"github.com/fqzz2000/QUIC-LB-SHRIMP/pkg/packet"
+)
+
+// v2Initial builds a QUIC v2 Initial from cid to dcid of payload bytes
+func v2Initial(dcid, scid []byte, payload int) []byte {
+	pkt := quicLongHeader(packet.Initial, dcid, scid, make([]byte, payload))
+	binary.BigEndian.PutUint32(pkt[1:5], packet.Version2)
+	pkt[0] = 0xc0 | 0x01<<4 // v2's Initial type bits
+	return pkt
+}
+
+func TestVersionNegotiation(t *testing.T) {
+	fwd := memForwarder{opened: make(chan *memConn, 2)}
+	fwdBoth := memForwarder{opened: make(chan *memConn, 1)}
+	lb, listener := newMemLB(t, Config{Backends: []BackendConfig{
+		{Address: "192.0.2.100:443", Forwarder: fwd, Versions: []uint32{packet.Version1}},
+		{Address: "192.0.2.101:443", Forwarder: fwdBoth, Versions: []uint32{packet.Version1, packet.Version2}},
+	}})
+	v1Only, _ := lb.routes().codec.Encode(0, []byte{0x00}, nil)
+	both, _ := lb.routes().codec.Encode(0, []byte{0x01}, nil)
+	scid := []byte{0xc1, 0xc2, 0xc3, 0xc4}
+
+	// a v2 Initial whose CID names the v1-only backend is answered, not forwarded
+	err := lb.handlePacket(v2Initial(v1Only, scid, 1200), testAddr(1))
+	if !errors.Is(err, errVersionNegotiation) {
+		t.Fatalf("handlePacket(v2 Initial) error = %v, want %v", err, errVersionNegotiation)
+	}
+	if len(fwd.opened) != 0 {
+		t.Errorf("a flow was opened for a version the backend does not speak")
+	}
+	vn := expect(t, listener.sent)
+	header, err := (&packet.PacketProcessor{}).ParsePacket(vn.data)
+	if err != nil {
+		t.Fatalf("Version Negotiation does not parse: %v", err)
+	}
+	lh := header.(*packet.LongHeader)
+	list := vn.data[7+len(lh.DCID)+len(lh.SCID):]
+	if lh.Version != 0 || !bytes.Equal(lh.DCID, scid) || !bytes.Equal(lh.SCID, v1Only) || !bytes.Equal(list, []byte{0, 0, 0, 1}) {
+		t.Errorf("Version Negotiation = %x, want version 0 from %x to %x listing v1", vn.data, v1Only, scid)
+	}
+	if vn.addr.String() != testAddr(1).String() {
+		t.Errorf("Version Negotiation sent to %s, want %s", vn.addr, testAddr(1))
+	}
+	if got := lb.Stats().VersionNegotiations; got != 1 {
+		t.Errorf("VersionNegotiations = %d, want 1", got)
+	}
+
+	// the client retrying in v1 reaches the backend
+	if err := lb.handlePacket(quicLongHeader(packet.Initial, v1Only, scid, make([]byte, 1200)), testAddr(1)); err != nil {
+		t.Fatalf("handlePacket(v1 Initial) error = %v", err)
+	}
+	expect(t, fwd.opened)
+
+	// a backend listing v2 takes it
+	if err := lb.handlePacket(v2Initial(both, scid, 1200), testAddr(2)); err != nil {
+		t.Fatalf("handlePacket(v2 Initial to v1 and v2) error = %v", err)
+	}
+	expect(t, fwdBoth.opened)
+
+	// a datagram too small to be an Initial gets no answer
+	another, _ := lb.routes().codec.Encode(0, []byte{0x00}, nil)
+	if err := lb.handlePacket(v2Initial(another, scid, 100), testAddr(3)); !errors.Is(err, errUnsupportedVersion) {
+		t.Errorf("handlePacket(small v2 Initial) error = %v, want %v", err, errUnsupportedVersion)
+	}
+	if len(listener.sent) != 0 {
+		t.Errorf("answered a datagram smaller than an Initial")
+	}
+}
+
+func TestBackendVersionsConfig(t *testing.T) {
+	_, err := NewLoadBalancer(Config{Backends: []BackendConfig{{Address: "192.0.2.100:443", Versions: []uint32{packet.Version1, 0}}}})
+	if !errors.Is(err, errBadBackend) {
+		t.Errorf("NewLoadBalancer() error = %v, want %v", err, errBadBackend)
+	}
+}
+
+func TestVersionNegotiationAmplification(t *testing.T) {
+	// more versions than three times a minimum-size Initial has room for
+	versions := make([]uint32, 1000)
+	for i := range versions {
+		versions[i] = 0xff000001 + uint32(i)
+	}
+	lb, listener := newMemLB(t, Config{Backends: []BackendConfig{
+		{Address: "192.0.2.100:443", Forwarder: memForwarder{opened: make(chan *memConn, 1)}, Versions: versions},
+	}})
+	cid, _ := lb.routes().codec.Encode(0, []byte{0x00}, nil)
+	initial := v2Initial(cid, []byte{0xc1, 0xc2, 0xc3, 0xc4}, 1200)
+
+	if err := lb.handlePacket(initial, testAddr(1)); !errors.Is(err, errVersionNegotiation) {
+		t.Fatalf("handlePacket(v2 Initial) error = %v, want %v", err, errVersionNegotiation)
+	}
+	vn := expect(t, listener.sent).data
+	if len(vn) > 3*len(initial) {
+		t.Errorf("Version Negotiation of %d bytes for a %d byte datagram, want at most 3x", len(vn), len(initial))
+	}
+	list := vn[7+len(cid)+4:]
+	if len(list) < 4 || len(list)%4 != 0 || binary.BigEndian.Uint32(list) != versions[0] {
+		t.Errorf("supported versions start %x, want a whole list from %#x", list[:min(len(list), 8)], versions[0])
+	}
+	if got := lb.Stats().VersionListsCut; got != 1 {
+		t.Errorf("VersionListsCut = %d, want 1", got)
+	}
+}
@@ -0,0 +1,129 @@
+package lb
+
+import (
+	"context"
+	"log"
+	"net"
+	"sync"
+)
+
+// Warming up takes backend setup off the data path. Each backend the LB dials
+// itself has its address resolved once, before the first packet, and in
+// connected mode a socket to it opened ahead of time for the first flow to
+// take; later flows dial the resolved address, so no packet waits on DNS.
+// Backends with a Forwarder open their own connections and addresses
+// without a port cannot be dialed; both are left alone.
+// Resolution is fixed from then on: a backend whose DNS changes takes
+// effect on restart, while backends that did not resolve at startup are
+// retried with the others startup resolution left (see resolve.go) and
+// dialed by name once they resolve.
+
+// warmSockets holds the resolved backend addresses and pre-opened sockets
+type warmSockets struct {
+	mu    sync.Mutex
+	addrs map[string]string   // backend address to resolved IP and port
+	conns map[string]net.Conn // backend address to an unused socket
+}
+
+// warmup resolves every backend the load balancer dials itself and, with
+// connected backend sockets, opens one socket to each. Backends already
+// marked unhealthy are skipped; one that does not resolve is marked so and
+// returned for retryResolve.
+func (lb *LoadBalancer) warmup(ctx context.Context) []string {
+	var failed []string
+	preopen := lb.backendSockets == backendSocketsConnected && !lb.sourcePorts.enabled()
+	for _, b := range lb.routes().backends {
+		if b.removed() || b.Forwarder != nil || lb.unhealthyBackend(b.Address) {
+			continue
+		}
+		if _, _, err := net.SplitHostPort(b.Address); err != nil {
+			continue
+		}
+		resolved, ok := lb.resolveBackend(ctx, b.Address)
+		if !ok {
+			log.Printf("Backend %s does not resolve; marked unhealthy until it does", b.Address)
+			lb.SetBackendHealth(b.Address, false)
+			lb.stats.unresolvedBackends.Add(1)
+			failed = append(failed, b.Address)
+			continue
+		}
+		var conn net.Conn
+		if preopen && !lb.warm.has(b.Address) {
+			c, err := lb.dialUDP(resolved, 0)
+			if err != nil {
+				log.Printf("Error opening a socket to backend %s: %v", b.Address, err)
+			} else {
+				conn = c
+			}
+		}
+		lb.warm.store(b.Address, resolved, conn)
+	}
+	return failed
+}
+
+// resolveBackend returns the IP and port the backend at addr is dialed at
+func (lb *LoadBalancer) resolveBackend(ctx context.Context, addr string) (string, bool) {
+	host, port, _ := net.SplitHostPort(addr)
+	if net.ParseIP(host) != nil {
+		return addr, true
+	}
+	ctx, cancel := context.WithTimeout(ctx, lb.resolveRetry)
+	defer cancel()
+	ips, err := lb.resolver.LookupHost(ctx, host)
+	if err != nil || len(ips) == 0 {
+		return "", false
+	}
+	return net.JoinHostPort(ips[0], port), true
+}
+
+// store records the resolved address of a backend and, if not nil, a
+// pre-opened socket to it
+func (w *warmSockets) store(addr, resolved string, conn net.Conn) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.addrs == nil {
+		w.addrs = make(map[string]string)
+		w.conns = make(map[string]net.Conn)
+	}
+	w.addrs[addr] = resolved
+	if conn != nil {
+		w.conns[addr] = conn
+	}
+}
+
+// has reports whether an unused socket to the backend at addr is held
+func (w *warmSockets) has(addr string) bool {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.conns[addr] != nil
+}
+
+// resolved returns the address to dial the backend at addr with: its
+// resolved IP and port if warmed up, addr itself otherwise
+func (w *warmSockets) resolved(addr string) string {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if r, ok := w.addrs[addr]; ok {
+		return r
+	}
+	return addr
+}
+
+// take hands out the pre-opened socket to the backend at addr, or nil
+func (w *warmSockets) take(addr string) net.Conn {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	conn := w.conns[addr]
+	delete(w.conns, addr)
+	return conn
+}
+
+// close closes the sockets no flow took
+func (w *warmSockets) close() {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	for addr, conn := range w.conns {
+		conn.Close()
+		delete(w.conns, addr)
+	}
+}
@@ -0,0 +1,85 @@
+package lb
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"net"
+	"slices"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/fqzz2000/QUIC-LB-SHRIMP/pkg/packet"
+)
+
+// loopbackResolver resolves every host but gone.test to loopback, counting lookups
+type loopbackResolver struct {
+	lookups atomic.Int32
+}
+
+func (r *loopbackResolver) LookupHost(ctx context.Context, host string) ([]string, error) {
+	r.lookups.Add(1)
+	if host == "gone.test" {
+		return nil, errors.New("no such host")
+	}
+	return []string{"127.0.0.1"}, nil
+}
+
+func TestWarmup(t *testing.T) {
+	echo := startEchoBackend(t)
+	_, port, _ := net.SplitHostPort(echo)
+	backend := net.JoinHostPort("echo.test", port)
+	resolver := &loopbackResolver{}
+	lb := startTestLB(t, Config{Backends: StaticBackends(backend), Resolver: resolver})
+
+	if got := lb.warm.resolved(backend); got != echo {
+		t.Errorf("resolved(%s) = %s, want %s", backend, got, echo)
+	}
+	if !lb.warm.has(backend) {
+		t.Fatalf("no socket to %s after warmup", backend)
+	}
+	lookups := resolver.lookups.Load()
+
+	client := newTestClient(t)
+	pkt := longHeaderPacket(packet.Initial, []byte{0x01, 0x02, 0x03, 0x04, 0x05, 0x06, 0x07, 0x08}, 1200)
+	client.WriteTo(pkt, lb.Addr())
+	if got := readWithin(t, client, time.Second); !bytes.Equal(got, pkt) {
+		t.Fatalf("echo = %d bytes, want %d", len(got), len(pkt))
+	}
+	// the first flow took the pre-opened socket and nothing was looked up
+	if lb.warm.has(backend) {
+		t.Errorf("pre-opened socket still unused after the first flow")
+	}
+	if got := resolver.lookups.Load(); got != lookups {
+		t.Errorf("lookups after the first packet = %d, want %d", got, lookups)
+	}
+}
+
+func TestWarmupSkipsUnresolved(t *testing.T) {
+	lb, err := NewLoadBalancer(Config{
+		Backends: append(StaticBackends("ready.test:443", "gone.test:443", "192.0.2.9:443"),
+			BackendConfig{Address: "relay:443", Forwarder: memForwarder{}}),
+		Resolver: &loopbackResolver{},
+	})
+	if err != nil {
+		t.Fatalf("NewLoadBalancer() error = %v", err)
+	}
+	defer lb.warm.close()
+
+	failed := lb.warmup(context.Background())
+	if !slices.Equal(failed, []string{"gone.test:443"}) {
+		t.Errorf("warmup() = %v, want [gone.test:443]", failed)
+	}
+	if !lb.unhealthyBackend("gone.test:443") {
+		t.Errorf("unresolved backend healthy after warmup")
+	}
+	for _, tt := range []struct {
+		addr string
+		want bool
+	}{{"ready.test:443", true}, {"192.0.2.9:443", true}, {"gone.test:443", false}, {"relay:443", false}} {
+		if got := lb.warm.has(tt.addr); got != tt.want {
+			t.Errorf("socket to %s after warmup = %v, want %v", tt.addr, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,169 @@
+package lb
+
+import (
+	"net"
+)
+
+// Workers batch their backend writes. A worker takes whatever datagrams are
+// already queued behind the one it woke for, up to writeBatchSize, routes
+// them all and then sends the writes, grouped by the socket they leave on:
+// the flow's own socket in connected mode, or the shared one in unconnected
+// mode, where a group carries datagrams for any backend. On Linux a group
+// goes out in one sendmmsg call; elsewhere each datagram is written on its
+// own. Grouping keeps the order of the datagrams on each socket, so a flow's
+// packets reach its backend in the order they arrived. A datagram's drop or
+// forward is counted once its write is done.
+//
+// Only plain UDP sockets are batched. A flow through a Forwarder writes as
+// soon as it is routed, as do all flows while 0-RTT is delayed, since held
+// 0-RTT is written directly and must not overtake the datagrams before it.
+
+// writeBatchSize is the most datagrams a worker routes before writing
+const writeBatchSize = 32
+
+// batchItem is one queued datagram of a worker's batch
+type batchItem struct {
+	in     inbound
+	res    DecodeResult
+	trace  *decodeTrace
+	err    error
+	routed bool // false when routing panicked, which counted the drop
+	held   heldWrite
+}
+
+// heldWrite is a backend write routing left for the batch to send
+type heldWrite struct {
+	conn   *net.UDPConn // the socket the datagram leaves on, nil if not held
+	to     *net.UDPAddr // its destination on an unconnected socket
+	out    []byte
+	client net.Addr
+	n      int
+	err    error
+	sent   bool
+}
+
+// hold takes the datagram for a batched write to conn, reporting false when
+// conn is not a socket the batch can write to
+func (h *heldWrite) hold(conn net.Conn, out []byte, client net.Addr) bool {
+	switch c := conn.(type) {
+	case *net.UDPConn:
+		h.conn = c
+	case *sharedConn:
+		udp, ok := c.s.conn.(*net.UDPConn)
+		if !ok {
+			return false
+		}
+		select {
+		case <-c.closed:
+			// the flow's own Write reports the close
+			return false
+		default:
+		}
+		h.conn, h.to = udp, c.remote
+	default:
+		return false
+	}
+	h.out, h.client = out, client
+	return true
+}
+
+// writeOne sends the held datagram on its own
+func (h *heldWrite) writeOne() {
+	if h.to != nil {
+		h.n, h.err = h.conn.WriteTo(h.out, h.to)
+	} else {
+		h.n, h.err = h.conn.Write(h.out)
+	}
+}
+
+// writeEach sends the writes one syscall each
+func writeEach(writes []*heldWrite) int {
+	for _, w := range writes {
+		w.writeOne()
+	}
+	return len(writes)
+}
+
+// writeBatch is a worker's batch and the scratch it reuses
+type writeBatch struct {
+	items []batchItem
+	group []*heldWrite
+}
+
+// work processes a worker's queue until it is closed
+func (lb *LoadBalancer) work(queue <-chan inbound) {
+	if lb.zeroRTT == zeroRTTDelay {
+		for in := range queue {
+			lb.process(in)
+			packetBuffers.Put(in.buf)
+		}
+		return
+	}
+	b := &writeBatch{items: make([]batchItem, 0, writeBatchSize)}
+	for in := range queue {
+		b.items = append(b.items, batchItem{in: in})
+	gather:
+		for len(b.items) < writeBatchSize {
+			select {
+			case in, ok := <-queue:
+				if !ok {
+					break gather
+				}
+				b.items = append(b.items, batchItem{in: in})
+			default:
+				break gather
+			}
+		}
+		lb.processBatch(b)
+	}
+}
+
+// processBatch routes every datagram of the batch, sends the writes held and
+// then counts each datagram's outcome
+func (lb *LoadBalancer) processBatch(b *writeBatch) {
+	for i := range b.items {
+		lb.route(&b.items[i], &b.items[i].held)
+	}
+	lb.flushWrites(b)
+	for i := range b.items {
+		if b.items[i].routed {
+			lb.account(&b.items[i])
+		}
+		packetBuffers.Put(b.items[i].in.buf)
+	}
+	clear(b.items)
+	b.items = b.items[:0]
+}
+
+// flushWrites sends the batch's held writes, one group per socket with the
+// datagrams in batch order
+func (lb *LoadBalancer) flushWrites(b *writeBatch) {
+	for i := range b.items {
+		first := &b.items[i].held
+		if first.conn == nil || first.sent {
+			continue
+		}
+		group := b.group[:0]
+		for j := i; j < len(b.items); j++ {
+			if h := &b.items[j].held; h.conn == first.conn {
+				h.sent = true
+				group = append(group, h)
+			}
+		}
+		if len(group) == 1 {
+			first.writeOne()
+		} else if calls := sendBatch(first.conn, group); calls < len(group) {
+			lb.stats.batchedWrites.Add(uint64(len(group) - calls))
+		}
+		clear(group)
+		b.group = group[:0]
+	}
+	for i := range b.items {
+		it := &b.items[i]
+		if h := &it.held; h.conn != nil {
+			if it.err = lb.checkWrite(h.n, len(h.out), h.err); it.err == nil {
+				lb.logs.routed(h.client, &it.res)
+			}
+		}
+	}
+}
@@ -0,0 +1,114 @@
+//go:build linux && (amd64 || arm64)
+
+package lb
+
+import (
+	"net"
+	"os"
+	"syscall"
+	"unsafe"
+)
+
+// mmsghdr is struct mmsghdr: one message and how many bytes were sent of it
+type mmsghdr struct {
+	hdr syscall.Msghdr
+	n   uint32
+}
+
+// sendBatch sends the writes on conn with sendmmsg, in order, and reports
+// how many syscalls it took. The syscall number is per architecture
+// (sysSendmmsg, in writebatch_linux_$GOARCH.go). A message the kernel refuses fails alone and
+// the rest are still sent.
+func sendBatch(conn *net.UDPConn, writes []*heldWrite) int {
+	raw, err := conn.SyscallConn()
+	if err != nil {
+		return writeEach(writes)
+	}
+	msgs := make([]mmsghdr, len(writes))
+	iovs := make([]syscall.Iovec, len(writes))
+	var names []syscall.RawSockaddrInet6
+	if writes[0].to != nil {
+		names = make([]syscall.RawSockaddrInet6, len(writes))
+	}
+	inet6 := false
+	if local, ok := conn.LocalAddr().(*net.UDPAddr); ok {
+		inet6 = local.IP.To4() == nil
+	}
+	for i, w := range writes {
+		if len(w.out) > 0 {
+			iovs[i].Base = &w.out[0]
+		}
+		iovs[i].SetLen(len(w.out))
+		msgs[i].hdr.Iov = &iovs[i]
+		msgs[i].hdr.Iovlen = 1
+		if names != nil {
+			n, ok := putSockaddr(&names[i], w.to, inet6)
+			if !ok {
+				// leave addresses sendmmsg cannot take to WriteTo
+				return writeEach(writes)
+			}
+			msgs[i].hdr.Name = (*byte)(unsafe.Pointer(&names[i]))
+			msgs[i].hdr.Namelen = n
+		}
+	}
+
+	calls, sent := 0, 0
+	err = raw.Write(func(fd uintptr) bool {
+		for sent < len(msgs) {
+			n, _, errno := syscall.Syscall6(sysSendmmsg, fd, uintptr(unsafe.Pointer(&msgs[sent])), uintptr(len(msgs)-sent), 0, 0, 0)
+			calls++
+			switch errno {
+			case 0:
+				for i := sent; i < sent+int(n); i++ {
+					writes[i].n = int(msgs[i].n)
+				}
+				sent += int(n)
+			case syscall.EAGAIN:
+				return false
+			case syscall.EINTR:
+			default:
+				// only the first message failed; go on after it
+				writes[sent].err = writeError(conn, writes[sent], os.NewSyscallError("sendmmsg", errno))
+				sent++
+			}
+		}
+		return true
+	})
+	for _, w := range writes[sent:] {
+		w.err = writeError(conn, w, err)
+	}
+	return calls
+}
+
+// writeError reports a failed write as conn's own Write or WriteTo would
+func writeError(conn *net.UDPConn, w *heldWrite, err error) error {
+	var addr net.Addr = w.to
+	if w.to == nil {
+		addr = conn.RemoteAddr()
+	}
+	return &net.OpError{Op: "write", Net: "udp", Source: conn.LocalAddr(), Addr: addr, Err: err}
+}
+
+// putSockaddr writes to into sa as the socket's family expects, reporting
+// its length and false for an address the family cannot carry
+func putSockaddr(sa *syscall.RawSockaddrInet6, to *net.UDPAddr, inet6 bool) (uint32, bool) {
+	port := (*[2]byte)(unsafe.Pointer(&sa.Port))
+	port[0], port[1] = byte(to.Port>>8), byte(to.Port)
+	if !inet6 {
+		ip := to.IP.To4()
+		if ip == nil {
+			return 0, false
+		}
+		sa4 := (*syscall.RawSockaddrInet4)(unsafe.Pointer(sa))
+		sa4.Family = syscall.AF_INET
+		copy(sa4.Addr[:], ip)
+		return syscall.SizeofSockaddrInet4, true
+	}
+	ip := to.IP.To16()
+	if ip == nil || to.Zone != "" {
+		return 0, false
+	}
+	sa.Family = syscall.AF_INET6
+	copy(sa.Addr[:], ip)
+	return syscall.SizeofSockaddrInet6, true
+}
@@ -0,0 +1,5 @@
+package lb
+
+// sysSendmmsg is sendmmsg's number on amd64 (arch/x86/entry/syscalls/
+// syscall_64.tbl), which package syscall does not export there
+const sysSendmmsg = 307
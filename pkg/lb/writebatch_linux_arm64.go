@@ -0,0 +1,6 @@
+package lb
+
+import "syscall"
+
+// sysSendmmsg is sendmmsg's number on arm64, which differs from amd64's
+const sysSendmmsg = syscall.SYS_SENDMMSG
@@ -0,0 +1,75 @@
+//go:build linux && (amd64 || arm64)
+
+package lb
+
+import (
+	"bytes"
+	"net"
+	"runtime"
+	"testing"
+	"time"
+)
+
+func TestSendmmsgNumber(t *testing.T) {
+	want := map[string]uintptr{"amd64": 307, "arm64": 269}[runtime.GOARCH]
+	if sysSendmmsg != want {
+		t.Errorf("sysSendmmsg = %d on %s, want %d", sysSendmmsg, runtime.GOARCH, want)
+	}
+}
+
+func TestSendBatch(t *testing.T) {
+	tests := []struct {
+		name      string
+		connected bool
+	}{
+		{name: "Connected", connected: true},
+		{name: "Unconnected"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			backend, err := net.ListenPacket("udp", "127.0.0.1:0")
+			if err != nil {
+				t.Fatalf("ListenPacket() error = %v", err)
+			}
+			defer backend.Close()
+			to := backend.LocalAddr().(*net.UDPAddr)
+			var conn *net.UDPConn
+			if tt.connected {
+				conn, err = net.DialUDP("udp", nil, to)
+			} else {
+				conn, err = net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+			}
+			if err != nil {
+				t.Fatalf("socket error = %v", err)
+			}
+			defer conn.Close()
+
+			var writes []*heldWrite
+			for i := range 4 {
+				w := &heldWrite{conn: conn, out: bytes.Repeat([]byte{byte(i)}, 100+i)}
+				if !tt.connected {
+					w.to = to
+				}
+				writes = append(writes, w)
+			}
+			// one syscall for all four shows sendmmsg, not another syscall, ran
+			if calls := sendBatch(conn, writes); calls != 1 {
+				t.Errorf("sendBatch() = %d syscalls, want 1", calls)
+			}
+			buf := make([]byte, maxPacketSize)
+			backend.SetReadDeadline(time.Now().Add(time.Second))
+			for i, w := range writes {
+				if w.err != nil || w.n != len(w.out) {
+					t.Errorf("write %d: n = %d, error = %v, want %d bytes sent", i, w.n, w.err, len(w.out))
+				}
+				n, _, err := backend.ReadFrom(buf)
+				if err != nil {
+					t.Fatalf("ReadFrom() error = %v", err)
+				}
+				if !bytes.Equal(buf[:n], w.out) {
+					t.Errorf("datagram %d = %x..., want %x...", i, buf[:4], w.out[:4])
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,10 @@
+//go:build !linux || !(amd64 || arm64)
+
+package lb
+
+import "net"
+
+// sendBatch writes each datagram on its own where sendmmsg is unavailable
+func sendBatch(conn *net.UDPConn, writes []*heldWrite) int {
+	return writeEach(writes)
+}
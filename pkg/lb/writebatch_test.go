@@ -0,0 +1,194 @@
+package lb
+
+import (
+	"bytes"
+	"net"
+	"runtime"
+	"testing"
+	"time"
+
+	"github.com/fqzz2000/QUIC-LB-SHRIMP/pkg/packet"
+)
+
+// queuedBatch copies the datagrams from their sources into pooled buffers as
+// readLoop would, for processBatch
+func queuedBatch(b *writeBatch, pkts [][]byte, srcs []net.Addr) {
+	for i, pkt := range pkts {
+		buf := packetBuffers.Get().(*[]byte)
+		n := copy(*buf, pkt)
+		b.items = append(b.items, batchItem{in: inbound{pkt: (*buf)[:n], src: srcs[i], buf: buf}})
+	}
+}
+
+// sendmmsgWrites reports whether sendBatch shares syscalls on this platform
+func sendmmsgWrites() bool {
+	return runtime.GOOS == "linux" && (runtime.GOARCH == "amd64" || runtime.GOARCH == "arm64")
+}
+
+func TestBatchedWritesKeepOrder(t *testing.T) {
+	tests := []struct {
+		name      string
+		sockets   string
+		wantSaved uint64 // write syscalls saved where sendmmsg is used
+	}{
+		// a socket per flow, so each flow's four datagrams share a syscall
+		{name: "Connected", sockets: backendSocketsConnected, wantSaved: 6},
+		// one socket carries all eight
+		{name: "Unconnected", sockets: backendSocketsUnconnected, wantSaved: 7},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			backend, err := net.ListenPacket("udp", "127.0.0.1:0")
+			if err != nil {
+				t.Fatalf("ListenPacket() error = %v", err)
+			}
+			defer backend.Close()
+			lb, _ := newMemLB(t, Config{Backends: StaticBackends(backend.LocalAddr().String()), BackendSockets: tt.sockets})
+			lb.mu.Lock()
+			err = lb.openShared()
+			lb.mu.Unlock()
+			if err != nil {
+				t.Fatalf("openShared() error = %v", err)
+			}
+			if lb.shared != nil {
+				t.Cleanup(func() { lb.shared.conn.Close() })
+			}
+
+			// two clients' packets interleaved, each opening its flow first
+			var pkts [][]byte
+			var srcs []net.Addr
+			for i := range 8 {
+				client := i % 2
+				ptype := packet.HandShake
+				if i < 2 {
+					ptype = packet.Initial
+				}
+				dcid := []byte{0xc0, byte(client), 1, 2, 3, 4, 5, 6}
+				payload := append([]byte{byte(i)}, make([]byte, 1200)...)
+				pkts = append(pkts, quicLongHeader(ptype, dcid, []byte{byte(client)}, payload))
+				srcs = append(srcs, testAddr(client+1))
+			}
+			b := &writeBatch{}
+			queuedBatch(b, pkts, srcs)
+			lb.processBatch(b)
+
+			last := map[byte]int{0: -1, 1: -1}
+			buf := make([]byte, maxPacketSize)
+			backend.SetReadDeadline(time.Now().Add(time.Second))
+			for range pkts {
+				n, _, err := backend.ReadFrom(buf)
+				if err != nil {
+					t.Fatalf("ReadFrom() error = %v", err)
+				}
+				i := -1
+				for j, pkt := range pkts {
+					if bytes.Equal(buf[:n], pkt) {
+						i = j
+					}
+				}
+				if i < 0 {
+					t.Fatalf("backend got %x..., want one of the client packets", buf[:16])
+				}
+				if client := byte(i % 2); i < last[client] {
+					t.Errorf("client %d packet %d arrived after packet %d", client, i, last[client])
+				} else {
+					last[client] = i
+				}
+			}
+
+			stats := lb.Stats()
+			if stats.PacketsForwarded != uint64(len(pkts)) || stats.ActiveFlows != 2 {
+				t.Errorf("PacketsForwarded = %d with %d flows, want %d with 2", stats.PacketsForwarded, stats.ActiveFlows, len(pkts))
+			}
+			want := uint64(0)
+			if sendmmsgWrites() {
+				want = tt.wantSaved
+			}
+			if stats.BatchedWrites != want {
+				t.Errorf("BatchedWrites = %d, want %d", stats.BatchedWrites, want)
+			}
+		})
+	}
+}
+
+func TestForwarderWritesUnbatched(t *testing.T) {
+	fwd := memForwarder{opened: make(chan *memConn, 1)}
+	lb, _ := newMemLB(t, Config{Backends: []BackendConfig{{Address: "192.0.2.100:443", Forwarder: fwd}}})
+	pkt := quicLongHeader(packet.Initial, []byte{0xc0, 1, 2, 3, 4, 5, 6, 7}, []byte{1}, make([]byte, 1200))
+	b := &writeBatch{}
+	queuedBatch(b, [][]byte{pkt, pkt}, []net.Addr{testAddr(1), testAddr(1)})
+	lb.processBatch(b)
+	conn := expect(t, fwd.opened)
+	// a Forwarder's conn is written as soon as the packet is routed
+	for range 2 {
+		if got := expect(t, conn.sent); !bytes.Equal(got, pkt) {
+			t.Errorf("forwarder got %x..., want the client packet", got[:16])
+		}
+	}
+	if got := lb.Stats().PacketsForwarded; got != 2 {
+		t.Errorf("PacketsForwarded = %d, want 2", got)
+	}
+}
+
+// BenchmarkBatchedWrites forwards batches of datagrams for one flow to one
+// backend, through batched writes and one write each. Besides time it
+// reports write syscalls per batch.
+func BenchmarkBatchedWrites(b *testing.B) {
+	backend, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		b.Fatalf("ListenPacket() error = %v", err)
+	}
+	defer backend.Close()
+	go func() {
+		buf := make([]byte, maxPacketSize)
+		for {
+			if _, _, err := backend.ReadFrom(buf); err != nil {
+				return
+			}
+		}
+	}()
+	lb, err := NewLoadBalancer(Config{Backends: StaticBackends(backend.LocalAddr().String())})
+	if err != nil {
+		b.Fatalf("NewLoadBalancer() error = %v", err)
+	}
+	lb.listener = newMemPacketConn()
+	defer func() {
+		lb.closeFlows()
+		lb.flowWG.Wait()
+	}()
+	cid, _ := lb.routes().codec.Encode(0, []byte{0x00}, []byte{1, 2, 3, 4, 5, 6})
+	datagram := append(append([]byte{0x40}, cid...), make([]byte, 1200)...)
+	src := testAddr(1)
+	if err := lb.handlePacket(datagram, src); err != nil {
+		b.Fatalf("handlePacket() error = %v", err)
+	}
+	pkts, srcs := make([][]byte, writeBatchSize), make([]net.Addr, writeBatchSize)
+	for i := range pkts {
+		pkts[i], srcs[i] = datagram, src
+	}
+
+	for _, bb := range []struct {
+		name    string
+		batched bool
+	}{{"Individual", false}, {"Batched", true}} {
+		b.Run(bb.name, func(b *testing.B) {
+			saved := lb.stats.batchedWrites.Load()
+			batch := &writeBatch{}
+			b.SetBytes(int64(len(datagram) * writeBatchSize))
+			for i := 0; i < b.N; i++ {
+				queuedBatch(batch, pkts, srcs)
+				if bb.batched {
+					lb.processBatch(batch)
+					continue
+				}
+				for _, it := range batch.items {
+					lb.process(it.in)
+					packetBuffers.Put(it.in.buf)
+				}
+				batch.items = batch.items[:0]
+			}
+			saved = lb.stats.batchedWrites.Load() - saved
+			b.ReportMetric(float64(uint64(b.N*writeBatchSize)-saved)/float64(b.N), "syscalls/batch")
+		})
+	}
+}
@@ -0,0 +1,114 @@
+package lb
+
+import (
+	"errors"
+
+	"github.com/fqzz2000/QUIC-LB-SHRIMP/pkg/packet"
+)
+
+// 0-RTT policies (Config.ZeroRTT) decide what happens to the 0-RTT packets
+// clients resuming a session send before the handshake completes. "forward",
+// the default, sends them on like any other packet; "drop" discards them;
+// "delay" holds up to maxDelayedZeroRTT of them per flow until the client's
+// first 1-RTT packet shows the handshake is done, then sends them ahead of
+// it. Policies apply to each packet of a coalesced datagram, so an Initial
+// carrying 0-RTT still goes through, without it.
+
+const (
+	zeroRTTForward = "forward"
+	zeroRTTDelay   = "delay"
+	zeroRTTDrop    = "drop"
+)
+
+// maxDelayedZeroRTT is how many 0-RTT packets a flow holds under the delay
+// policy; further ones are dropped
+const maxDelayedZeroRTT = 8
+
+var (
+	// errZeroRTTPolicy is returned for an unknown Config.ZeroRTT policy
+	errZeroRTTPolicy = errors.New("unknown 0-RTT policy")
+	// errZeroRTTDropped is returned for a datagram of only 0-RTT packets
+	// under the drop policy
+	errZeroRTTDropped = errors.New("0-RTT dropped by policy")
+)
+
+// splitZeroRTT separates the 0-RTT packets coalesced in a client datagram
+// from the rest. The datagram is returned as is when it holds none.
+func (lb *LoadBalancer) splitZeroRTT(processor *packet.PacketProcessor, datagram []byte) (rest []byte, early [][]byte) {
+	if datagram[0]&0x80 == 0 {
+		return datagram, nil
+	}
+	packets, err := processor.SplitCoalesced(datagram)
+	if err != nil {
+		// leave what cannot be split to the backend
+		return datagram, nil
+	}
+	for _, p := range packets {
+		if ptype, _ := processor.ClassifyPacket(p); ptype == packet.ZeroRTT {
+			early = append(early, append([]byte(nil), p...))
+			continue
+		}
+		rest = append(rest, p...)
+	}
+	if early == nil {
+		return datagram, nil
+	}
+	return rest, early
+}
+
+// holdZeroRTT keeps copies of 0-RTT packets until the flow sees 1-RTT,
+// returning how many did not fit; the packets themselves live in a read
+// buffer reused once handlePacket returns. Once it has, nothing is held and
+// all are returned to be sent at once.
+func (f *Flow) holdZeroRTT(early [][]byte) (send [][]byte, overflow int) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.oneRTT {
+		return early, 0
+	}
+	for _, p := range early {
+		if len(f.early) == maxDelayedZeroRTT {
+			overflow++
+			continue
+		}
+		f.early = append(f.early, append([]byte(nil), p...))
+	}
+	return nil, overflow
+}
+
+// delayZeroRTT holds a datagram's 0-RTT packets on the flow under the delay
+// policy, sending them at once if the handshake is already done. proxy, the
+// PROXY header of a flow's first datagram, goes in front of the first of
+// them when nothing else in the datagram could carry it.
+func (lb *LoadBalancer) delayZeroRTT(flow *Flow, early [][]byte, proxy []byte) {
+	if lb.rewriteCIDs {
+		for i, p := range early {
+			early[i] = lb.rewriteOutbound(flow, p)
+		}
+	}
+	if proxy != nil {
+		early[0] = append(proxy, early[0]...)
+	}
+	send, overflow := flow.holdZeroRTT(early)
+	lb.stats.zeroRTTDelayed.Add(uint64(len(early) - overflow - len(send)))
+	lb.stats.zeroRTTDropped.Add(uint64(overflow))
+	lb.writeZeroRTT(flow, send)
+}
+
+// writeZeroRTT sends 0-RTT packets released from a flow to its backend
+func (lb *LoadBalancer) writeZeroRTT(flow *Flow, early [][]byte) {
+	for _, p := range early {
+		n, err := flow.conn.Write(p)
+		lb.checkWrite(n, len(p), err)
+	}
+}
+
+// releaseZeroRTT marks the handshake complete and returns the held packets
+func (f *Flow) releaseZeroRTT() [][]byte {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.oneRTT = true
+	early := f.early
+	f.early = nil
+	return early
+}
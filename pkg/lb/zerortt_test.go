@@ -0,0 +1,108 @@
+package lb
+
+import (
+	"bytes"
+	"errors"
+	"testing"
+
+	"github.com/fqzz2000/QUIC-LB-SHRIMP/pkg/packet"
+)
+
+func TestZeroRTTPolicy(t *testing.T) {
+	dcid := []byte{0x00, 0x01, 1, 1, 1, 1, 1, 1}
+	initial := quicLongHeader(packet.Initial, dcid, []byte{0xcc}, bytes.Repeat([]byte{0x01}, 40))
+	early1 := quicLongHeader(packet.ZeroRTT, dcid, []byte{0xcc}, bytes.Repeat([]byte{0x02}, 30))
+	early2 := quicLongHeader(packet.ZeroRTT, dcid, []byte{0xcc}, bytes.Repeat([]byte{0x03}, 30))
+	oneRTT := append(append([]byte{0x40}, dcid...), bytes.Repeat([]byte{0x04}, 30)...)
+	coalesced := append(append([]byte(nil), initial...), early1...)
+
+	tests := []struct {
+		name        string
+		policy      string
+		wantErr     error    // for the lone 0-RTT datagram
+		wantSent    [][]byte // everything the backend receives, in order
+		wantDelayed uint64
+		wantDropped uint64
+	}{
+		{name: "Forward", policy: zeroRTTForward, wantSent: [][]byte{coalesced, early2, oneRTT}},
+		{name: "Default", wantSent: [][]byte{coalesced, early2, oneRTT}},
+		{name: "Drop", policy: zeroRTTDrop, wantErr: errZeroRTTDropped, wantSent: [][]byte{initial, oneRTT}, wantDropped: 2},
+		{name: "Delay", policy: zeroRTTDelay, wantSent: [][]byte{initial, early1, early2, oneRTT}, wantDelayed: 2},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fwd := memForwarder{opened: make(chan *memConn, 1)}
+			lb, _ := newMemLB(t, Config{
+				Backends: []BackendConfig{{Address: "192.0.2.100:443", Forwarder: fwd}, {Address: "192.0.2.101:443", Forwarder: fwd}},
+				ZeroRTT:  tt.policy,
+			})
+
+			if err := lb.handlePacket(append([]byte(nil), coalesced...), testAddr(1)); err != nil {
+				t.Fatalf("handlePacket(Initial with 0-RTT) error = %v", err)
+			}
+			conn := expect(t, fwd.opened)
+			if err := lb.handlePacket(append([]byte(nil), early2...), testAddr(1)); !errors.Is(err, tt.wantErr) {
+				t.Fatalf("handlePacket(0-RTT) error = %v, want %v", err, tt.wantErr)
+			}
+			if err := lb.handlePacket(append([]byte(nil), oneRTT...), testAddr(1)); err != nil {
+				t.Fatalf("handlePacket(1-RTT) error = %v", err)
+			}
+
+			for i, want := range tt.wantSent {
+				if got := expect(t, conn.sent); !bytes.Equal(got, want) {
+					t.Errorf("backend datagram %d = %x, want %x", i, got, want)
+				}
+			}
+			if n := len(conn.sent); n != 0 {
+				t.Errorf("backend received %d more datagrams, want none", n)
+			}
+			if got := lb.Stats().ZeroRTTDelayed; got != tt.wantDelayed {
+				t.Errorf("ZeroRTTDelayed = %d, want %d", got, tt.wantDelayed)
+			}
+			if got := lb.Stats().ZeroRTTDropped; got != tt.wantDropped {
+				t.Errorf("ZeroRTTDropped = %d, want %d", got, tt.wantDropped)
+			}
+		})
+	}
+}
+
+func TestZeroRTTDelayLimit(t *testing.T) {
+	dcid := []byte{0x00, 0x01, 1, 1, 1, 1, 1, 1}
+	fwd := memForwarder{opened: make(chan *memConn, 1)}
+	lb, _ := newMemLB(t, Config{
+		Backends: []BackendConfig{{Address: "192.0.2.100:443", Forwarder: fwd}, {Address: "192.0.2.101:443", Forwarder: fwd}},
+		ZeroRTT:  zeroRTTDelay,
+	})
+
+	// a flow opened by 0-RTT alone holds it too, up to the limit
+	for i := 0; i < maxDelayedZeroRTT+2; i++ {
+		early := quicLongHeader(packet.ZeroRTT, dcid, []byte{0xcc}, []byte{byte(i)})
+		if err := lb.handlePacket(early, testAddr(1)); err != nil {
+			t.Fatalf("handlePacket(0-RTT %d) error = %v", i, err)
+		}
+	}
+	conn := expect(t, fwd.opened)
+	if n := len(conn.sent); n != 0 {
+		t.Fatalf("backend received %d datagrams before 1-RTT, want none", n)
+	}
+	if got := lb.Stats().ZeroRTTDropped; got != 2 {
+		t.Errorf("ZeroRTTDropped = %d, want 2", got)
+	}
+
+	lb.handlePacket(append(append([]byte{0x40}, dcid...), 0x04), testAddr(1))
+	for i := 0; i < maxDelayedZeroRTT; i++ {
+		if got := expect(t, conn.sent); got[len(got)-1] != byte(i) {
+			t.Errorf("released 0-RTT %d ends in %#x, want %#x", i, got[len(got)-1], i)
+		}
+	}
+	if got := expect(t, conn.sent); got[0] != 0x40 {
+		t.Errorf("after released 0-RTT got %x, want the 1-RTT packet", got)
+	}
+
+	// the handshake is done, so later 0-RTT is not held
+	late := quicLongHeader(packet.ZeroRTT, dcid, []byte{0xcc}, []byte{0xff})
+	lb.handlePacket(late, testAddr(1))
+	if got := expect(t, conn.sent); !bytes.Equal(got, late) {
+		t.Errorf("late 0-RTT sent %x, want %x", got, late)
+	}
+}
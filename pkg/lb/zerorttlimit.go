@@ -0,0 +1,83 @@
+package lb
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/fqzz2000/QUIC-LB-SHRIMP/pkg/packet"
+)
+
+// The 0-RTT return limit (Config.ZeroRTTReturnLimit) bounds what a backend
+// answering forwarded 0-RTT can send a client before the handshake is known
+// to have progressed. 0-RTT carries application data from an address the
+// server has not validated, and a large response to it would let a spoofing
+// client aim that response at a victim. A flow that forwards a 0-RTT packet
+// before its first 1-RTT packet may return at most the limit in bytes to the
+// client; the rest is dropped and counted until the client sends 1-RTT. The
+// Initial anti-amplification limit still applies on top of it. Only the
+// forward policy needs it: under delay the backend sees no 0-RTT before
+// 1-RTT, and under drop none at all.
+
+// errZeroRTTReturnLimit is returned for a negative Config.ZeroRTTReturnLimit
+var errZeroRTTReturnLimit = errors.New("invalid 0-RTT return limit")
+
+// zeroRTTReturnLimit returns the byte limit on 0-RTT flows, zero for none
+func (c *Config) zeroRTTReturnLimit() (int, error) {
+	if c.ZeroRTTReturnLimit < 0 {
+		return 0, fmt.Errorf("%w: %d", errZeroRTTReturnLimit, c.ZeroRTTReturnLimit)
+	}
+	return c.ZeroRTTReturnLimit, nil
+}
+
+// carriesZeroRTT reports whether a client datagram holds a 0-RTT packet
+func (lb *LoadBalancer) carriesZeroRTT(processor *packet.PacketProcessor, datagram []byte) bool {
+	if len(datagram) == 0 || datagram[0]&0x80 == 0 {
+		return false
+	}
+	packets, err := processor.SplitCoalesced(datagram)
+	if err != nil {
+		ptype, _ := processor.ClassifyPacket(datagram)
+		return ptype == packet.ZeroRTT
+	}
+	for _, p := range packets {
+		if ptype, _ := processor.ClassifyPacket(p); ptype == packet.ZeroRTT {
+			return true
+		}
+	}
+	return false
+}
+
+// sentZeroRTT marks the flow as carrying 0-RTT, unless 1-RTT came first
+func (f *Flow) sentZeroRTT() {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if !f.oneRTT {
+		f.earlyData = true
+	}
+}
+
+// sawOneRTT marks the handshake as having progressed past 0-RTT
+func (f *Flow) sawOneRTT() {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.oneRTT = true
+}
+
+// allowEarlyReturn reports whether n more bytes may be returned to a flow
+// that sent 0-RTT under limit, reserving them if so. Flows without 0-RTT,
+// flows past 1-RTT and a limit of zero are not limited.
+func (f *Flow) allowEarlyReturn(n int, limit int) bool {
+	if limit <= 0 {
+		return true
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if !f.earlyData || f.oneRTT {
+		return true
+	}
+	if f.earlyTxBytes+uint64(n) > uint64(limit) {
+		return false
+	}
+	f.earlyTxBytes += uint64(n)
+	return true
+}
@@ -0,0 +1,70 @@
+package lb
+
+import (
+	"bytes"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/fqzz2000/QUIC-LB-SHRIMP/pkg/packet"
+)
+
+func TestZeroRTTReturnLimit(t *testing.T) {
+	backend := startAmplifyingBackend(t, 5)
+	// the Initial limit is lifted so only the 0-RTT one applies
+	lb := startTestLB(t, Config{Backends: StaticBackends(backend), AmplificationFactor: -1, ZeroRTTReturnLimit: 2500})
+	client := newTestClient(t)
+	dcid := bytes.Repeat([]byte{0xee}, 8)
+
+	// five echoes of a 1018-byte 0-RTT packet come back; two fit in 2500 bytes
+	early := quicLongHeader(packet.ZeroRTT, dcid, []byte{0xcc}, bytes.Repeat([]byte{0x01}, 1000))
+	client.WriteTo(early, lb.Addr())
+	if got := countResponses(t, client, 200*time.Millisecond); got != 2 {
+		t.Errorf("responses before 1-RTT = %d, want 2", got)
+	}
+	if got := lb.Stats().ZeroRTTReturnDrops; got != 3 {
+		t.Errorf("ZeroRTTReturnDrops = %d, want 3", got)
+	}
+
+	// the first 1-RTT packet lifts the limit
+	oneRTT := append(append([]byte{0x40}, dcid...), bytes.Repeat([]byte{0x02}, 1000)...)
+	client.WriteTo(oneRTT, lb.Addr())
+	if got := countResponses(t, client, 200*time.Millisecond); got != 5 {
+		t.Errorf("responses after 1-RTT = %d, want 5", got)
+	}
+	if got := lb.Stats().ZeroRTTReturnDrops; got != 3 {
+		t.Errorf("ZeroRTTReturnDrops after 1-RTT = %d, want 3", got)
+	}
+}
+
+func TestZeroRTTReturnLimitSparesFlowsWithout0RTT(t *testing.T) {
+	f := &Flow{}
+	if !f.allowEarlyReturn(5000, 1000) {
+		t.Error("allowEarlyReturn() on a flow without 0-RTT = false, want true")
+	}
+	f.sawOneRTT()
+	f.sentZeroRTT()
+	if !f.allowEarlyReturn(5000, 1000) {
+		t.Error("allowEarlyReturn() on a flow with 0-RTT after 1-RTT = false, want true")
+	}
+}
+
+func TestZeroRTTReturnLimitConfig(t *testing.T) {
+	tests := []struct {
+		name    string
+		limit   int
+		wantErr error
+	}{
+		{name: "Unlimited"},
+		{name: "Limit", limit: 3600},
+		{name: "Negative", limit: -1, wantErr: errZeroRTTReturnLimit},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := Config{ZeroRTTReturnLimit: tt.limit}
+			if _, err := cfg.zeroRTTReturnLimit(); !errors.Is(err, tt.wantErr) {
+				t.Errorf("zeroRTTReturnLimit() error = %v, want %v", err, tt.wantErr)
+			}
+		})
+	}
+}
@@ -0,0 +1,321 @@
+// Package metrics is a small dependency-free metrics registry that renders
+// the Prometheus text exposition format, or OpenMetrics text.
+package metrics
+
+import (
+	"fmt"
+	"io"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+// Counter is a monotonically increasing value
+type Counter struct {
+	v atomic.Uint64
+}
+
+// Inc adds one to the counter
+func (c *Counter) Inc() {
+	c.v.Add(1)
+}
+
+// Add adds n to the counter
+func (c *Counter) Add(n uint64) {
+	c.v.Add(n)
+}
+
+// Value returns the current count
+func (c *Counter) Value() uint64 {
+	return c.v.Load()
+}
+
+// CounterVec is a family of counters partitioned by label values
+type CounterVec struct {
+	labels []string
+	mu     sync.RWMutex
+	m      map[string]*Counter
+}
+
+// With returns the counter for the label values, creating it on first use
+func (v *CounterVec) With(values ...string) *Counter {
+	key := labelKey(values)
+	v.mu.RLock()
+	c, ok := v.m[key]
+	v.mu.RUnlock()
+	if ok {
+		return c
+	}
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	if c, ok = v.m[key]; !ok {
+		c = &Counter{}
+		v.m[key] = c
+	}
+	return c
+}
+
+// Histogram counts observations into cumulative buckets
+type Histogram struct {
+	upper  []float64
+	counts []atomic.Uint64 // one per bucket plus +Inf
+	count  atomic.Uint64
+	sum    atomic.Uint64 // float64 bits
+}
+
+func newHistogram(buckets []float64) *Histogram {
+	return &Histogram{upper: buckets, counts: make([]atomic.Uint64, len(buckets)+1)}
+}
+
+// Observe records one value
+func (h *Histogram) Observe(v float64) {
+	i := sort.SearchFloat64s(h.upper, v)
+	h.counts[i].Add(1)
+	h.count.Add(1)
+	for {
+		old := h.sum.Load()
+		if h.sum.CompareAndSwap(old, math.Float64bits(math.Float64frombits(old)+v)) {
+			return
+		}
+	}
+}
+
+// Count returns the number of observations
+func (h *Histogram) Count() uint64 {
+	return h.count.Load()
+}
+
+// HistogramVec is a family of histograms partitioned by label values
+type HistogramVec struct {
+	labels  []string
+	buckets []float64
+	mu      sync.RWMutex
+	m       map[string]*Histogram
+}
+
+// With returns the histogram for the label values, creating it on first use
+func (v *HistogramVec) With(values ...string) *Histogram {
+	key := labelKey(values)
+	v.mu.RLock()
+	h, ok := v.m[key]
+	v.mu.RUnlock()
+	if ok {
+		return h
+	}
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	if h, ok = v.m[key]; !ok {
+		h = newHistogram(v.buckets)
+		v.m[key] = h
+	}
+	return h
+}
+
+// DefBuckets are latency buckets from 100ns to about 100µs, suited to
+// per-packet work measured in seconds
+var DefBuckets = []float64{1e-7, 2.5e-7, 5e-7, 1e-6, 2.5e-6, 5e-6, 1e-5, 2.5e-5, 5e-5, 1e-4}
+
+// metric is one registered family. Registrations of the same name through
+// differently labeled views of a registry add series to one family.
+type metric struct {
+	name, help, kind string
+	series           []series
+}
+
+// series is one view's share of a family: its constant labels, rendered as
+// name="value" pairs, and the function writing its samples
+type series struct {
+	labels []string
+	write  func(w io.Writer, name string, constLabels []string)
+}
+
+// families is the state shared by a registry and its labeled views
+type families struct {
+	mu      sync.Mutex
+	metrics []*metric
+	byName  map[string]*metric
+}
+
+// Registry holds metric families and renders them in registration order.
+// WithLabel returns views of it that share its families.
+type Registry struct {
+	fam    *families
+	labels []string
+}
+
+// NewRegistry returns an empty registry
+func NewRegistry() *Registry {
+	return &Registry{fam: &families{byName: make(map[string]*metric)}}
+}
+
+// WithLabel returns a view of the registry adding the label to every metric
+// registered through it, so several instances of a component can register
+// the same metrics into one registry and be told apart
+func (r *Registry) WithLabel(name, value string) *Registry {
+	labels := append(append([]string(nil), r.labels...), name+"="+strconv.Quote(value))
+	return &Registry{fam: r.fam, labels: labels}
+}
+
+func (r *Registry) register(name, help, kind string, write func(w io.Writer, name string, constLabels []string)) {
+	r.fam.mu.Lock()
+	defer r.fam.mu.Unlock()
+	m, ok := r.fam.byName[name]
+	if !ok {
+		m = &metric{name: name, help: help, kind: kind}
+		r.fam.byName[name] = m
+		r.fam.metrics = append(r.fam.metrics, m)
+	}
+	if m.kind != kind {
+		panic("metrics: " + name + " registered as both " + m.kind + " and " + kind)
+	}
+	key := strings.Join(r.labels, ",")
+	for _, s := range m.series {
+		if strings.Join(s.labels, ",") == key {
+			panic("metrics: duplicate metric " + name)
+		}
+	}
+	m.series = append(m.series, series{labels: r.labels, write: write})
+}
+
+// NewCounter registers an unlabeled counter
+func (r *Registry) NewCounter(name, help string) *Counter {
+	c := &Counter{}
+	r.NewCounterFunc(name, help, c.Value)
+	return c
+}
+
+// NewCounterFunc registers a counter whose value is read from f at scrape time
+func (r *Registry) NewCounterFunc(name, help string, f func() uint64) {
+	r.register(name, help, "counter", func(w io.Writer, name string, constLabels []string) {
+		fmt.Fprintf(w, "%s%s %d\n", name, formatLabels(constLabels, nil, "", "", ""), f())
+	})
+}
+
+// NewGaugeFunc registers a gauge whose value is read from f at scrape time
+func (r *Registry) NewGaugeFunc(name, help string, f func() float64) {
+	r.register(name, help, "gauge", func(w io.Writer, name string, constLabels []string) {
+		fmt.Fprintf(w, "%s%s %s\n", name, formatLabels(constLabels, nil, "", "", ""), formatFloat(f()))
+	})
+}
+
+// NewCounterVec registers a labeled counter family
+func (r *Registry) NewCounterVec(name, help string, labels ...string) *CounterVec {
+	v := &CounterVec{labels: labels, m: make(map[string]*Counter)}
+	r.register(name, help, "counter", func(w io.Writer, name string, constLabels []string) {
+		v.mu.RLock()
+		defer v.mu.RUnlock()
+		for _, key := range sortedKeys(v.m) {
+			fmt.Fprintf(w, "%s%s %d\n", name, formatLabels(constLabels, v.labels, key, "", ""), v.m[key].Value())
+		}
+	})
+	return v
+}
+
+// NewHistogramVec registers a labeled histogram family with the given bucket upper bounds
+func (r *Registry) NewHistogramVec(name, help string, buckets []float64, labels ...string) *HistogramVec {
+	v := &HistogramVec{labels: labels, buckets: buckets, m: make(map[string]*Histogram)}
+	r.register(name, help, "histogram", func(w io.Writer, name string, constLabels []string) {
+		v.mu.RLock()
+		defer v.mu.RUnlock()
+		for _, key := range sortedKeys(v.m) {
+			h := v.m[key]
+			var cumulative uint64
+			for i, upper := range h.upper {
+				cumulative += h.counts[i].Load()
+				fmt.Fprintf(w, "%s_bucket%s %d\n", name, formatLabels(constLabels, v.labels, key, "le", formatFloat(upper)), cumulative)
+			}
+			cumulative += h.counts[len(h.upper)].Load()
+			fmt.Fprintf(w, "%s_bucket%s %d\n", name, formatLabels(constLabels, v.labels, key, "le", "+Inf"), cumulative)
+			fmt.Fprintf(w, "%s_sum%s %s\n", name, formatLabels(constLabels, v.labels, key, "", ""), formatFloat(math.Float64frombits(h.sum.Load())))
+			fmt.Fprintf(w, "%s_count%s %d\n", name, formatLabels(constLabels, v.labels, key, "", ""), h.count.Load())
+		}
+	})
+	return v
+}
+
+// WriteText renders every registered family in the Prometheus text format,
+// including those registered through other views of the registry
+func (r *Registry) WriteText(w io.Writer) error {
+	return r.write(w, false)
+}
+
+// WriteOpenMetrics renders every registered family as OpenMetrics text,
+// including those registered through other views of the registry. The
+// samples are those of WriteText; a counter family is named without the
+// _total suffix its samples carry, and the exposition ends in # EOF.
+func (r *Registry) WriteOpenMetrics(w io.Writer) error {
+	if err := r.write(w, true); err != nil {
+		return err
+	}
+	_, err := io.WriteString(w, "# EOF\n")
+	return err
+}
+
+// write renders the families in the Prometheus text format, or with the
+// OpenMetrics family names
+func (r *Registry) write(w io.Writer, openMetrics bool) error {
+	r.fam.mu.Lock()
+	var metrics []metric
+	for _, m := range r.fam.metrics {
+		metrics = append(metrics, metric{name: m.name, help: m.help, kind: m.kind, series: append([]series(nil), m.series...)})
+	}
+	r.fam.mu.Unlock()
+
+	for _, m := range metrics {
+		family, sample := m.name, m.name
+		if openMetrics && m.kind == "counter" {
+			family = strings.TrimSuffix(m.name, "_total")
+			sample = family + "_total"
+		}
+		if _, err := fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", family, m.help, family, m.kind); err != nil {
+			return err
+		}
+		for _, s := range m.series {
+			s.write(w, sample, s.labels)
+		}
+	}
+	return nil
+}
+
+// labelSep joins label values into a map key; it cannot appear in valid UTF-8 text
+const labelSep = "\xff"
+
+func labelKey(values []string) string {
+	return strings.Join(values, labelSep)
+}
+
+func sortedKeys[V any](m map[string]V) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// formatLabels renders {a="x",b="y"} from constant pairs and a label key,
+// with an optional extra pair
+func formatLabels(constLabels, names []string, key, extraName, extraValue string) string {
+	var values []string
+	if len(names) > 0 {
+		values = strings.Split(key, labelSep)
+	}
+	pairs := append([]string(nil), constLabels...)
+	for i, n := range names {
+		pairs = append(pairs, n+"="+strconv.Quote(values[i]))
+	}
+	if extraName != "" {
+		pairs = append(pairs, extraName+"="+strconv.Quote(extraValue))
+	}
+	if len(pairs) == 0 {
+		return ""
+	}
+	return "{" + strings.Join(pairs, ",") + "}"
+}
+
+func formatFloat(f float64) string {
+	return strconv.FormatFloat(f, 'g', -1, 64)
+}
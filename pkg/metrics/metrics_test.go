@@ -0,0 +1,121 @@
+package metrics
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestWriteText(t *testing.T) {
+	r := NewRegistry()
+	c := r.NewCounter("requests_total", "Requests served.")
+	c.Add(3)
+	v := r.NewCounterVec("errors_total", "Errors by kind.", "kind")
+	v.With("timeout").Inc()
+	v.With("refused").Add(2)
+	r.NewGaugeFunc("temperature", "Current temperature.", func() float64 { return 1.5 })
+	h := r.NewHistogramVec("latency_seconds", "Latency.", []float64{0.1, 1}, "op")
+	h.With("read").Observe(0.05)
+	h.With("read").Observe(0.5)
+	h.With("read").Observe(5)
+
+	var b strings.Builder
+	if err := r.WriteText(&b); err != nil {
+		t.Fatalf("WriteText() error = %v", err)
+	}
+	want := `# HELP requests_total Requests served.
+# TYPE requests_total counter
+requests_total 3
+# HELP errors_total Errors by kind.
+# TYPE errors_total counter
+errors_total{kind="refused"} 2
+errors_total{kind="timeout"} 1
+# HELP temperature Current temperature.
+# TYPE temperature gauge
+temperature 1.5
+# HELP latency_seconds Latency.
+# TYPE latency_seconds histogram
+latency_seconds_bucket{op="read",le="0.1"} 1
+latency_seconds_bucket{op="read",le="1"} 2
+latency_seconds_bucket{op="read",le="+Inf"} 3
+latency_seconds_sum{op="read"} 5.55
+latency_seconds_count{op="read"} 3
+`
+	if b.String() != want {
+		t.Errorf("WriteText() =\n%s\nwant\n%s", b.String(), want)
+	}
+}
+
+func TestWriteOpenMetrics(t *testing.T) {
+	r := NewRegistry()
+	r.NewCounter("requests_total", "Requests served.").Add(3)
+	r.NewCounter("retries", "Retries.").Inc()
+	r.NewGaugeFunc("temperature", "Current temperature.", func() float64 { return 1.5 })
+	r.NewHistogramVec("latency_seconds", "Latency.", []float64{1}, "op").With("read").Observe(0.5)
+
+	var b strings.Builder
+	if err := r.WriteOpenMetrics(&b); err != nil {
+		t.Fatalf("WriteOpenMetrics() error = %v", err)
+	}
+	want := `# HELP requests Requests served.
+# TYPE requests counter
+requests_total 3
+# HELP retries Retries.
+# TYPE retries counter
+retries_total 1
+# HELP temperature Current temperature.
+# TYPE temperature gauge
+temperature 1.5
+# HELP latency_seconds Latency.
+# TYPE latency_seconds histogram
+latency_seconds_bucket{op="read",le="1"} 1
+latency_seconds_bucket{op="read",le="+Inf"} 1
+latency_seconds_sum{op="read"} 0.5
+latency_seconds_count{op="read"} 1
+# EOF
+`
+	if b.String() != want {
+		t.Errorf("WriteOpenMetrics() =\n%s\nwant\n%s", b.String(), want)
+	}
+}
+
+func TestDuplicateNamePanics(t *testing.T) {
+	r := NewRegistry()
+	r.NewCounter("x_total", "x")
+	defer func() {
+		if recover() == nil {
+			t.Errorf("registering x_total twice did not panic")
+		}
+	}()
+	r.NewCounter("x_total", "x")
+}
+
+func TestWithLabel(t *testing.T) {
+	r := NewRegistry()
+	a, b := r.WithLabel("instance", "a"), r.WithLabel("instance", "b")
+	a.NewCounter("packets_total", "Packets.").Add(2)
+	b.NewCounter("packets_total", "Packets.").Add(5)
+	a.NewCounterVec("drops_total", "Drops by reason.", "reason").With("full").Inc()
+
+	var buf strings.Builder
+	if err := b.WriteText(&buf); err != nil {
+		t.Fatalf("WriteText() error = %v", err)
+	}
+	want := `# HELP packets_total Packets.
+# TYPE packets_total counter
+packets_total{instance="a"} 2
+packets_total{instance="b"} 5
+# HELP drops_total Drops by reason.
+# TYPE drops_total counter
+drops_total{instance="a",reason="full"} 1
+`
+	if buf.String() != want {
+		t.Errorf("WriteText() =\n%s\nwant\n%s", buf.String(), want)
+	}
+
+	defer func() {
+		if recover() == nil {
+			t.Errorf("registering packets_total twice under one label did not panic")
+		}
+	}()
+	r.WithLabel("instance", "a").NewCounter("packets_total", "Packets.")
+}
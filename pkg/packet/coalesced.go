@@ -0,0 +1,204 @@
+package packet
+
+import (
+	"bytes"
+	"errors"
+	"slices"
+)
+
+// DefaultMaxCoalesced is how many packets SplitCoalesced parses per datagram
+// when PacketProcessor.MaxCoalesced is zero. A handshake coalesces at most
+// Initial, 0-RTT/Handshake and 1-RTT, so legitimate datagrams stay well below it.
+const DefaultMaxCoalesced = 8
+
+// ErrTooManyCoalesced is returned when a datagram holds more coalesced packets than allowed
+var ErrTooManyCoalesced = errors.New("too many coalesced packets in datagram")
+
+// ErrMismatchedDCID is returned when a coalesced packet is addressed to a
+// different connection ID than the first packet of its datagram. Coalesced
+// packets belong to one connection, so the datagram is malformed or crafted.
+var ErrMismatchedDCID = errors.New("coalesced packets carry different DCIDs")
+
+// maxCoalesced returns the configured coalesced packet cap
+func (p *PacketProcessor) maxCoalesced() int {
+	if p.MaxCoalesced <= 0 {
+		return DefaultMaxCoalesced
+	}
+	return p.MaxCoalesced
+}
+
+// SplitCoalesced splits a UDP datagram into the QUIC packets coalesced in it
+// (RFC 9000 section 12.2). Long headers up to and including Handshake carry a
+// Length field delimiting them; a short header, Retry or Version Negotiation
+// packet extends to the end of the datagram.
+//
+// Parsing stops once the cap is reached: if bytes remain, the packets split so
+// far are returned together with ErrTooManyCoalesced, so a datagram of many
+// tiny packets costs at most the cap's worth of header parsing. Likewise a
+// packet whose DCID differs from the first packet's ends the split with
+// ErrMismatchedDCID, the packets before it returned as the datagram's
+// connection; a trailing short header is compared over the first DCID's
+// length, as the only length its receiver could use. The packets may come in
+// any order, each being delimited by its own header; CoalescedInOrder tells
+// whether they come in the order senders use.
+func (p *PacketProcessor) SplitCoalesced(datagram []byte) ([][]byte, error) {
+	var packets [][]byte
+	var first []byte
+	for len(datagram) > 0 {
+		if len(packets) == p.maxCoalesced() {
+			return packets, ErrTooManyCoalesced
+		}
+		n, err := p.coalescedLength(datagram)
+		if err != nil {
+			return packets, err
+		}
+		dcid := coalescedDCID(datagram[:n], len(first))
+		if packets == nil {
+			first = dcid
+		} else if !bytes.Equal(dcid, first) {
+			return packets, ErrMismatchedDCID
+		}
+		packets = append(packets, datagram[:n])
+		datagram = datagram[n:]
+	}
+	return packets, nil
+}
+
+// coalescedRank returns where a packet type goes among coalesced packets:
+// RFC 9000 section 12.2 has senders coalesce them by rising encryption
+// level. Retry and Version Negotiation are never coalesced and have none.
+func coalescedRank(t PacketType) (int, bool) {
+	switch t {
+	case Initial:
+		return 0, true
+	case ZeroRTT:
+		return 1, true
+	case HandShake:
+		return 2, true
+	case OneRTT:
+		return 3, true
+	}
+	return 0, false
+}
+
+// CoalescedInOrder reports whether packets split from one datagram come in
+// the order senders coalesce them: Initial, 0-RTT, Handshake, then 1-RTT.
+// A datagram holding a packet of another type is left as in order.
+func (p *PacketProcessor) CoalescedInOrder(packets [][]byte) bool {
+	last := 0
+	for _, pkt := range packets {
+		t, err := p.ClassifyPacket(pkt)
+		if err != nil {
+			return true
+		}
+		rank, ok := coalescedRank(t)
+		if !ok {
+			return true
+		}
+		if rank < last {
+			return false
+		}
+		last = rank
+	}
+	return true
+}
+
+// OrderCoalesced returns packets split from one datagram in the order
+// senders coalesce them, packets of one level keeping their order. Each
+// packet is protected on its own, so the reordered datagram is as valid as
+// the original. Packets CoalescedInOrder leaves alone are returned as given.
+func (p *PacketProcessor) OrderCoalesced(packets [][]byte) [][]byte {
+	if p.CoalescedInOrder(packets) {
+		return packets
+	}
+	ordered := slices.Clone(packets)
+	slices.SortStableFunc(ordered, func(a, b []byte) int {
+		ta, _ := p.ClassifyPacket(a)
+		tb, _ := p.ClassifyPacket(b)
+		ra, _ := coalescedRank(ta)
+		rb, _ := coalescedRank(tb)
+		return ra - rb
+	})
+	return ordered
+}
+
+// TrailingBytes returns how many bytes at the end of a datagram follow its
+// Length-delimited long headers without being a packet: a remainder that is
+// all zeros, as padding appended to the datagram is, or whose first byte has
+// the fixed bit clear where the first packet's DCID requires the bit. A
+// datagram that ends in a packet, or does not split, has none.
+func (p *PacketProcessor) TrailingBytes(datagram []byte) int {
+	var first []byte
+	for i := 0; len(datagram) > 0 && i < p.maxCoalesced(); i++ {
+		if datagram[0]&0x80 == 0 {
+			if i > 0 && p.notPacket(datagram, first) {
+				return len(datagram)
+			}
+			return 0
+		}
+		n, err := p.coalescedLength(datagram)
+		if err != nil {
+			return 0
+		}
+		if i == 0 {
+			first = coalescedDCID(datagram[:n], 0)
+		}
+		datagram = datagram[n:]
+	}
+	return 0
+}
+
+// notPacket reports whether bytes following a long header of a connection
+// to dcid cannot be a short header
+func (p *PacketProcessor) notPacket(rest, dcid []byte) bool {
+	if len(bytes.TrimLeft(rest, "\x00")) == 0 {
+		return true
+	}
+	return rest[0]&fixedBit == 0 && (p.FixedBitRequired == nil || p.FixedBitRequired(dcid))
+}
+
+// coalescedDCID returns the DCID of a packet split by coalescedLength, which
+// has parsed a long header's; a short header's is taken to be shortLength
+func coalescedDCID(pkt []byte, shortLength int) []byte {
+	if pkt[0]&0x80 == 0 {
+		return pkt[1:min(1+shortLength, len(pkt))]
+	}
+	return pkt[6 : 6+int(pkt[5])]
+}
+
+// coalescedLength returns the length of the first packet in a datagram
+func (p *PacketProcessor) coalescedLength(datagram []byte) (int, error) {
+	if datagram[0]&0x80 == 0 {
+		return len(datagram), nil
+	}
+	header, err := p.parseLongHeader(datagram)
+	if err != nil {
+		return 0, err
+	}
+	if header.Version == 0 || header.LongPacketType == Retry {
+		return len(datagram), nil
+	}
+
+	offset, length, err := header.lengthField(datagram)
+	if err != nil {
+		return 0, err
+	}
+	return offset + int(length), nil
+}
+
+// readVarint decodes a QUIC variable-length integer (RFC 9000 section 16),
+// returning the value and the number of bytes it occupied
+func readVarint(b []byte) (uint64, int, error) {
+	if len(b) == 0 {
+		return 0, 0, ErrPacketTooShort
+	}
+	n := 1 << (b[0] >> 6)
+	if len(b) < n {
+		return 0, 0, ErrPacketTooShort
+	}
+	v := uint64(b[0] & 0x3f)
+	for _, c := range b[1:n] {
+		v = v<<8 | uint64(c)
+	}
+	return v, n, nil
+}
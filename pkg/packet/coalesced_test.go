@@ -0,0 +1,211 @@
+package packet
+
+import (
+	"bytes"
+	"errors"
+	"testing"
+)
+
+// coalescable builds a v1 long-header packet with a one-byte Length field
+// covering payload; Initials get an empty token
+func coalescable(ptype PacketType, payload []byte) []byte {
+	pkt := []byte{0xc0 | byte(ptype)<<4, 0x00, 0x00, 0x00, 0x01, 0x02, 0xaa, 0xbb, 0x00}
+	if ptype == Initial {
+		pkt = append(pkt, 0x00)
+	}
+	pkt = append(pkt, byte(len(payload)))
+	return append(pkt, payload...)
+}
+
+func TestSplitCoalesced(t *testing.T) {
+	initial := coalescable(Initial, bytes.Repeat([]byte{0x01}, 20))
+	handshake := coalescable(HandShake, bytes.Repeat([]byte{0x02}, 10))
+	short := append([]byte{0x40, 0xaa, 0xbb}, bytes.Repeat([]byte{0x03}, 5)...)
+	datagram := append(append(append([]byte(nil), initial...), handshake...), short...)
+
+	p := &PacketProcessor{DCIDLength: 2}
+	packets, err := p.SplitCoalesced(datagram)
+	if err != nil {
+		t.Fatalf("SplitCoalesced() error = %v", err)
+	}
+	want := [][]byte{initial, handshake, short}
+	if len(packets) != len(want) {
+		t.Fatalf("SplitCoalesced() returned %d packets, want %d", len(packets), len(want))
+	}
+	for i := range want {
+		if !bytes.Equal(packets[i], want[i]) {
+			t.Errorf("packet %d = %x, want %x", i, packets[i], want[i])
+		}
+	}
+}
+
+func TestOrderCoalesced(t *testing.T) {
+	initial := coalescable(Initial, bytes.Repeat([]byte{0x01}, 20))
+	early := coalescable(ZeroRTT, bytes.Repeat([]byte{0x02}, 10))
+	handshake := coalescable(HandShake, bytes.Repeat([]byte{0x03}, 10))
+	initial2 := coalescable(Initial, bytes.Repeat([]byte{0x04}, 10))
+	short := append([]byte{0x40, 0xaa, 0xbb}, bytes.Repeat([]byte{0x05}, 5)...)
+
+	tests := []struct {
+		name        string
+		packets     [][]byte
+		wantInOrder bool
+		want        [][]byte
+	}{
+		{name: "In Order", packets: [][]byte{initial, early, handshake, short}, wantInOrder: true, want: [][]byte{initial, early, handshake, short}},
+		{name: "Handshake First", packets: [][]byte{handshake, initial}, want: [][]byte{initial, handshake}},
+		{name: "0-RTT After Handshake", packets: [][]byte{initial, handshake, early}, want: [][]byte{initial, early, handshake}},
+		// packets of one level keep their order
+		{name: "Two Initials", packets: [][]byte{initial, handshake, initial2, short}, want: [][]byte{initial, initial2, handshake, short}},
+	}
+	p := &PacketProcessor{DCIDLength: 2}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			datagram := bytes.Join(tt.packets, nil)
+			packets, err := p.SplitCoalesced(datagram)
+			if err != nil {
+				t.Fatalf("SplitCoalesced() error = %v", err)
+			}
+			if got := p.CoalescedInOrder(packets); got != tt.wantInOrder {
+				t.Errorf("CoalescedInOrder() = %v, want %v", got, tt.wantInOrder)
+			}
+			if got := p.OrderCoalesced(packets); !bytes.Equal(bytes.Join(got, nil), bytes.Join(tt.want, nil)) {
+				t.Errorf("OrderCoalesced() = %x, want %x", got, tt.want)
+			}
+			// ordering works on a copy
+			if !bytes.Equal(bytes.Join(packets, nil), datagram) {
+				t.Errorf("OrderCoalesced() changed the packets it was given")
+			}
+		})
+	}
+}
+
+func TestSplitCoalescedDCIDMismatch(t *testing.T) {
+	initial := coalescable(Initial, bytes.Repeat([]byte{0x01}, 20))
+	handshake := coalescable(HandShake, bytes.Repeat([]byte{0x02}, 10))
+	otherLong := append([]byte(nil), handshake...)
+	otherLong[7] = 0xcc
+	otherShort := append([]byte{0x40, 0xaa, 0xcc}, bytes.Repeat([]byte{0x03}, 5)...)
+	join := func(pkts ...[]byte) []byte { return bytes.Join(pkts, nil) }
+
+	tests := []struct {
+		name     string
+		datagram []byte
+		want     int // packets returned, those addressed like the first
+	}{
+		{name: "Second Long Header", datagram: join(initial, otherLong), want: 1},
+		{name: "Third Long Header", datagram: join(initial, handshake, otherLong), want: 2},
+		{name: "Trailing Short Header", datagram: join(initial, handshake, otherShort), want: 2},
+	}
+	p := &PacketProcessor{DCIDLength: 2}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			packets, err := p.SplitCoalesced(tt.datagram)
+			if !errors.Is(err, ErrMismatchedDCID) {
+				t.Fatalf("SplitCoalesced() error = %v, want %v", err, ErrMismatchedDCID)
+			}
+			if len(packets) != tt.want {
+				t.Errorf("SplitCoalesced() returned %d packets, want %d", len(packets), tt.want)
+			}
+		})
+	}
+}
+
+func TestSplitCoalescedLengthOverrun(t *testing.T) {
+	pkt := coalescable(HandShake, bytes.Repeat([]byte{0x02}, 10))
+	p := &PacketProcessor{}
+	_, err := p.SplitCoalesced(pkt[:len(pkt)-1])
+	if !errors.Is(err, ErrLengthPastDatagram) || !errors.Is(err, ErrPacketTooShort) {
+		t.Errorf("SplitCoalesced() error = %v, want %v", err, ErrLengthPastDatagram)
+	}
+}
+
+func TestSplitCoalescedCap(t *testing.T) {
+	// a datagram of 1000 empty Handshake packets
+	tiny := coalescable(HandShake, nil)
+	datagram := bytes.Repeat(tiny, 1000)
+
+	tests := []struct {
+		name string
+		max  int
+		want int
+	}{
+		{name: "Default Cap", max: 0, want: DefaultMaxCoalesced},
+		{name: "Configured Cap", max: 3, want: 3},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p := &PacketProcessor{MaxCoalesced: tt.max}
+			packets, err := p.SplitCoalesced(datagram)
+			if !errors.Is(err, ErrTooManyCoalesced) {
+				t.Fatalf("SplitCoalesced() error = %v, want %v", err, ErrTooManyCoalesced)
+			}
+			// parsing stopped at the cap rather than walking the whole datagram
+			if len(packets) != tt.want {
+				t.Errorf("SplitCoalesced() returned %d packets, want %d", len(packets), tt.want)
+			}
+		})
+	}
+
+	// exactly the cap is fine
+	p := &PacketProcessor{MaxCoalesced: 3}
+	if _, err := p.SplitCoalesced(bytes.Repeat(tiny, 3)); err != nil {
+		t.Errorf("SplitCoalesced() at the cap error = %v", err)
+	}
+}
+
+func TestReadVarint(t *testing.T) {
+	tests := []struct {
+		in   []byte
+		want uint64
+		n    int
+	}{
+		{in: []byte{0x25}, want: 37, n: 1},
+		{in: []byte{0x7b, 0xbd}, want: 15293, n: 2},
+		{in: []byte{0x9d, 0x7f, 0x3e, 0x7d}, want: 494878333, n: 4},
+		{in: []byte{0xc2, 0x19, 0x7c, 0x5e, 0xff, 0x14, 0xe8, 0x8c}, want: 151288809941952652, n: 8},
+	}
+	for _, tt := range tests {
+		got, n, err := readVarint(tt.in)
+		if err != nil || got != tt.want || n != tt.n {
+			t.Errorf("readVarint(%x) = (%d, %d, %v), want (%d, %d)", tt.in, got, n, err, tt.want, tt.n)
+		}
+	}
+	if _, _, err := readVarint([]byte{0x7b}); !errors.Is(err, ErrPacketTooShort) {
+		t.Errorf("readVarint() of truncated input error = %v, want %v", err, ErrPacketTooShort)
+	}
+}
+
+func TestTrailingBytes(t *testing.T) {
+	initial := coalescable(Initial, bytes.Repeat([]byte{0x01}, 20))
+	short := []byte{0x40, 0xaa, 0xbb, 0x03, 0x03}
+	join := func(parts ...[]byte) []byte { return bytes.Join(parts, nil) }
+	tests := []struct {
+		name     string
+		datagram []byte
+		greased  bool // the fixed bit is not required
+		want     int
+	}{
+		{name: "Single Packet", datagram: initial},
+		{name: "Coalesced Short Header", datagram: join(initial, short)},
+		{name: "Zero Padding", datagram: join(initial, make([]byte, 7)), want: 7},
+		{name: "Zero Padding Greased", datagram: join(initial, make([]byte, 7)), greased: true, want: 7},
+		{name: "Fixed Bit Clear", datagram: join(initial, []byte{0x1f, 0xaa}), want: 2},
+		// with the bit greased those bytes may be a short header
+		{name: "Fixed Bit Clear Greased", datagram: join(initial, []byte{0x1f, 0xaa}), greased: true},
+		{name: "Short Header Alone", datagram: make([]byte, 8)},
+		{name: "Truncated Long Header", datagram: initial[:len(initial)-1]},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p := &PacketProcessor{DCIDLength: 2}
+			if tt.greased {
+				p.FixedBitRequired = func([]byte) bool { return false }
+			}
+			if got := p.TrailingBytes(tt.datagram); got != tt.want {
+				t.Errorf("TrailingBytes() = %d, want %d", got, tt.want)
+			}
+		})
+	}
+}
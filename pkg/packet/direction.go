@@ -0,0 +1,37 @@
+package packet
+
+// Direction is which way a packet travels through the load balancer
+type Direction uint8
+
+const (
+	// ClientToServer packets arrive on the listener from clients
+	ClientToServer Direction = iota
+	// ServerToClient packets arrive from backends on their way back to clients
+	ServerToClient
+)
+
+func (d Direction) String() string {
+	if d == ServerToClient {
+		return "server-to-client"
+	}
+	return "client-to-server"
+}
+
+// RoutingCID returns the connection ID that later client packets for the
+// connection will carry as their DCID, which is what the load balancer routes on.
+//
+// For client packets that is the DCID itself. In server packets the DCID is the
+// client's own CID, so the server's chosen CID is the long-header SCID. Short
+// headers from the server carry no SCID and their DCID length is the client's
+// choice, so ok is false for them.
+func RoutingCID(h QuicHeader, d Direction) (cid []byte, ok bool) {
+	if d == ClientToServer {
+		cid, _ = h.GetCID()
+		return cid, true
+	}
+	lh, isLong := h.(*LongHeader)
+	if !isLong {
+		return nil, false
+	}
+	return lh.SCID, true
+}
@@ -0,0 +1,33 @@
+package packet
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestRoutingCID(t *testing.T) {
+	long := &LongHeader{HeaderForm: 1, DCID: []byte{0x01, 0x02}, SCID: []byte{0x0a, 0x0b, 0x0c}}
+	short := &ShortHeader{DCID: []byte{0x01, 0x02}}
+
+	tests := []struct {
+		name   string
+		header QuicHeader
+		dir    Direction
+		want   []byte
+		ok     bool
+	}{
+		{name: "Client Long Header", header: long, dir: ClientToServer, want: long.DCID, ok: true},
+		{name: "Client Short Header", header: short, dir: ClientToServer, want: short.DCID, ok: true},
+		{name: "Server Long Header", header: long, dir: ServerToClient, want: long.SCID, ok: true},
+		{name: "Server Short Header", header: short, dir: ServerToClient},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, ok := RoutingCID(tt.header, tt.dir)
+			if ok != tt.ok || !bytes.Equal(got, tt.want) {
+				t.Errorf("RoutingCID() = (%x, %v), want (%x, %v)", got, ok, tt.want, tt.ok)
+			}
+		})
+	}
+}
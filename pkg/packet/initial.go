@@ -0,0 +1,137 @@
+package packet
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/binary"
+	"fmt"
+)
+
+// MinInitialSize is the smallest datagram a client may carry an Initial in
+// (RFC 9000 section 14.1)
+const MinInitialSize = 1200
+
+// initialPNLength is the packet number length SealClientInitial encodes
+const initialPNLength = 4
+
+// initialSuite holds a version's Initial salt and key derivation labels
+type initialSuite struct {
+	salt           []byte
+	key, iv, hpKey string
+}
+
+// initialSuites holds the Initial constants of RFC 9001 section 5.2 and
+// RFC 9369 section 3.3
+var initialSuites = map[uint32]initialSuite{
+	Version1: {
+		salt: []byte{0x38, 0x76, 0x2c, 0xf7, 0xf5, 0x59, 0x34, 0xb3, 0x4d, 0x17, 0x9a, 0xe6, 0xa4, 0xc8, 0x0c, 0xad, 0xcc, 0xbb, 0x7f, 0x0a},
+		key:  "quic key", iv: "quic iv", hpKey: "quic hp",
+	},
+	Version2: {
+		salt: []byte{0x0d, 0xed, 0xe3, 0xde, 0xf7, 0x00, 0xa6, 0xdb, 0x81, 0x93, 0x81, 0xbe, 0x6e, 0x26, 0x9d, 0xcb, 0xf9, 0xbd, 0x2e, 0xd9},
+		key:  "quicv2 key", iv: "quicv2 iv", hpKey: "quicv2 hp",
+	},
+}
+
+// initialKeys is the packet protection of one side's Initial packets
+type initialKeys struct {
+	key, iv, hp []byte
+}
+
+// clientInitialKeys derives the keys protecting a client's Initial packets
+// sent to dcid
+func clientInitialKeys(version uint32, dcid []byte) (initialKeys, error) {
+	suite, ok := initialSuites[version]
+	if !ok {
+		return initialKeys{}, fmt.Errorf("%w: %#08x", ErrUnsupportedVersion, version)
+	}
+	// HKDF-Extract
+	mac := hmac.New(sha256.New, suite.salt)
+	mac.Write(dcid)
+	secret := expandLabel(mac.Sum(nil), "client in", sha256.Size)
+	return initialKeys{
+		key: expandLabel(secret, suite.key, 16),
+		iv:  expandLabel(secret, suite.iv, 12),
+		hp:  expandLabel(secret, suite.hpKey, 16),
+	}, nil
+}
+
+// expandLabel is TLS 1.3's HKDF-Expand-Label with an empty context, for
+// lengths of at most one SHA-256 block
+func expandLabel(secret []byte, label string, length int) []byte {
+	full := "tls13 " + label
+	info := make([]byte, 0, 4+len(full))
+	info = binary.BigEndian.AppendUint16(info, uint16(length))
+	info = append(info, byte(len(full)))
+	info = append(info, full...)
+	info = append(info, 0, 1) // empty context, then the HKDF-Expand counter
+	mac := hmac.New(sha256.New, secret)
+	mac.Write(info)
+	return mac.Sum(nil)[:length]
+}
+
+// SealClientInitial builds a protected client Initial of the given version
+// carrying frames, padded to size bytes (at least MinInitialSize), as a
+// client opening a connection to dcid from scid would send it. Its packet
+// number is zero; frames must leave room for the header and AEAD tag.
+func SealClientInitial(version uint32, dcid, scid, frames []byte, size int) ([]byte, error) {
+	keys, err := clientInitialKeys(version, dcid)
+	if err != nil {
+		return nil, err
+	}
+	if len(dcid) > MaxCIDLength || len(scid) > MaxCIDLength {
+		return nil, ErrInvalidCIDLength
+	}
+	size = max(size, MinInitialSize)
+
+	typeBits := byte(Initial)
+	if version == Version2 {
+		typeBits = 0x1
+	}
+	hdr := make([]byte, 0, size)
+	hdr = append(hdr, 0xc0|typeBits<<4|(initialPNLength-1))
+	hdr = binary.BigEndian.AppendUint32(hdr, version)
+	hdr = append(hdr, byte(len(dcid)))
+	hdr = append(hdr, dcid...)
+	hdr = append(hdr, byte(len(scid)))
+	hdr = append(hdr, scid...)
+	hdr = append(hdr, 0) // no token
+	// a two-byte Length varint covers every datagram up to 16383 bytes
+	length := size - len(hdr) - 2
+	plaintext := length - initialPNLength - 16
+	if plaintext < len(frames) || length >= 1<<14 {
+		return nil, fmt.Errorf("%w: %d bytes of frames in a %d byte Initial", ErrPacketTooShort, len(frames), size)
+	}
+	hdr = binary.BigEndian.AppendUint16(hdr, 0x4000|uint16(length))
+	pnOffset := len(hdr)
+	hdr = append(hdr, 0, 0, 0, 0) // packet number zero
+
+	block, err := aes.NewCipher(keys.key)
+	if err != nil {
+		return nil, err
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+	// PADDING frames are zero bytes; with packet number zero the nonce is the IV
+	payload := make([]byte, plaintext)
+	copy(payload, frames)
+	pkt := aead.Seal(hdr, keys.iv, payload, hdr)
+
+	// header protection (RFC 9001 section 5.4), sampled past a four-byte
+	// packet number
+	hp, err := aes.NewCipher(keys.hp)
+	if err != nil {
+		return nil, err
+	}
+	mask := make([]byte, aes.BlockSize)
+	hp.Encrypt(mask, pkt[pnOffset+4:pnOffset+4+aes.BlockSize])
+	pkt[0] ^= mask[0] & 0x0f
+	for i := 0; i < initialPNLength; i++ {
+		pkt[pnOffset+i] ^= mask[1+i]
+	}
+	return pkt, nil
+}
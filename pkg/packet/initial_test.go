@@ -0,0 +1,96 @@
+package packet
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"encoding/hex"
+	"errors"
+	"testing"
+)
+
+func TestClientInitialKeys(t *testing.T) {
+	dcid, _ := hex.DecodeString("8394c8f03e515708")
+	tests := []struct {
+		name        string
+		version     uint32
+		key, iv, hp string // RFC 9001 A.1 and RFC 9369 A.1
+	}{
+		{name: "Version 1", version: Version1, key: "1f369613dd76d5467730efcbe3b1a22d", iv: "fa044b2f42a3fd3b46fb255c", hp: "9f50449e04a0e810283a1e9933adedd2"},
+		{name: "Version 2", version: Version2, key: "8b1a0bc121284290a29e0971b5cd045d", iv: "91f73e2351d8fa91660e909f", hp: "45b95e15235d6f45a6b19cbcb0294ba9"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			keys, err := clientInitialKeys(tt.version, dcid)
+			if err != nil {
+				t.Fatalf("clientInitialKeys() error = %v", err)
+			}
+			for _, k := range []struct {
+				name string
+				got  []byte
+				want string
+			}{{"key", keys.key, tt.key}, {"iv", keys.iv, tt.iv}, {"hp", keys.hp, tt.hp}} {
+				if hex.EncodeToString(k.got) != k.want {
+					t.Errorf("%s = %x, want %s", k.name, k.got, k.want)
+				}
+			}
+		})
+	}
+	if _, err := clientInitialKeys(2, dcid); !errors.Is(err, ErrUnsupportedVersion) {
+		t.Errorf("clientInitialKeys(2) error = %v, want %v", err, ErrUnsupportedVersion)
+	}
+}
+
+func TestSealClientInitial(t *testing.T) {
+	dcid := []byte{1, 2, 3, 4, 5, 6, 7, 8}
+	scid := []byte{9, 9, 9, 9}
+	frames := []byte{0x06, 0x00, 0x03, 'a', 'b', 'c'} // CRYPTO at offset 0
+	p := &PacketProcessor{}
+	for _, version := range []uint32{Version1, Version2} {
+		pkt, err := SealClientInitial(version, dcid, scid, frames, 0)
+		if err != nil {
+			t.Fatalf("SealClientInitial(%#x) error = %v", version, err)
+		}
+		if len(pkt) != MinInitialSize {
+			t.Errorf("len = %d, want %d", len(pkt), MinInitialSize)
+		}
+		header, err := p.parseLongHeader(pkt)
+		if err != nil {
+			t.Fatalf("parseLongHeader() error = %v", err)
+		}
+		if header.Version != version || header.LongPacketType != Initial || !bytes.Equal(header.DCID, dcid) || !bytes.Equal(header.SCID, scid) {
+			t.Errorf("header = %+v, want an Initial of %#x from %x to %x", header, version, scid, dcid)
+		}
+
+		// remove header protection and open the payload as a server would
+		keys, _ := clientInitialKeys(version, dcid)
+		pnOffset, err := header.PayloadOffset(pkt)
+		if err != nil {
+			t.Fatalf("PayloadOffset() error = %v", err)
+		}
+		hp, _ := aes.NewCipher(keys.hp)
+		mask := make([]byte, aes.BlockSize)
+		hp.Encrypt(mask, pkt[pnOffset+4:pnOffset+4+aes.BlockSize])
+		plain := append([]byte(nil), pkt...)
+		plain[0] ^= mask[0] & 0x0f
+		for i := 0; i < 4; i++ {
+			plain[pnOffset+i] ^= mask[1+i]
+		}
+		if plain[0]&0x03 != 3 || !bytes.Equal(plain[pnOffset:pnOffset+4], []byte{0, 0, 0, 0}) {
+			t.Fatalf("unprotected first byte %#x, packet number %x, want a 4-byte zero", plain[0], plain[pnOffset:pnOffset+4])
+		}
+		block, _ := aes.NewCipher(keys.key)
+		aead, _ := cipher.NewGCM(block)
+		payload, err := aead.Open(nil, keys.iv, plain[pnOffset+4:], plain[:pnOffset+4])
+		if err != nil {
+			t.Fatalf("Open() error = %v", err)
+		}
+		if !bytes.HasPrefix(payload, frames) || bytes.Count(payload[len(frames):], []byte{0}) != len(payload)-len(frames) {
+			t.Errorf("payload = %x..., want the frames then PADDING", payload[:16])
+		}
+	}
+
+	if _, err := SealClientInitial(Version1, dcid, scid, make([]byte, MinInitialSize), 0); !errors.Is(err, ErrPacketTooShort) {
+		t.Errorf("SealClientInitial(oversized frames) error = %v, want %v", err, ErrPacketTooShort)
+	}
+}
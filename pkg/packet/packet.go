@@ -1,19 +1,93 @@
 package packet
 
-import "encoding/binary"
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+)
+
+var (
+	// ErrPacketTooShort is returned when a packet ends before a field the parser needs
+	ErrPacketTooShort = errors.New("packet too short")
+
+	// ErrTruncatedCID is returned when a short header carries fewer DCID bytes than the
+	// configured length. It wraps ErrPacketTooShort so callers can treat both alike.
+	ErrTruncatedCID = fmt.Errorf("%w: connection ID shorter than configured length", ErrPacketTooShort)
+
+	// ErrInvalidCIDLength is returned when a connection ID length is outside what the version allows
+	ErrInvalidCIDLength = errors.New("invalid connection ID length")
+
+	// ErrReservedBitsSet is returned when unprotected reserved header bits are non-zero
+	ErrReservedBitsSet = errors.New("reserved header bits set")
+)
 
 type PacketProcessor struct {
 	DCIDLength uint8 // TODO: it suppose to be a map of connection unique id to length
+	// MaxCIDLength caps long-header DCID/SCID lengths; zero means the QUICv1 limit of 20.
+	// Raise it only for non-standard versions that allow longer connection IDs.
+	MaxCIDLength uint8
+	// MaxCIDLengths caps CID lengths per version, overriding MaxCIDLength
+	// for the versions it lists, so a private version may allow longer
+	// connection IDs than QUICv1 (or require shorter). Long headers are
+	// checked against their version's cap.
+	MaxCIDLengths map[uint32]uint8
+	// ShortHeaderVersion is the version whose cap applies to short-header
+	// DCIDs, which carry no version field; zero uses MaxCIDLength
+	ShortHeaderVersion uint32
+	// MaxCoalesced caps the packets SplitCoalesced parses per datagram; zero means DefaultMaxCoalesced.
+	MaxCoalesced int
+	// FixedBitRequired reports whether packets addressed to dcid must set the
+	// fixed bit; nil requires it for every packet. See CheckFixedBit.
+	FixedBitRequired func(dcid []byte) bool
+	// SelfEncodedCIDLength reads each short header's DCID length from the low
+	// six bits of its first octet, the CID length minus one, instead of
+	// using DCIDLength
+	SelfEncodedCIDLength bool
+}
+
+// selfEncodedLengthMask selects a self-encoded CID length in a CID's first octet
+const selfEncodedLengthMask = 0x3f
+
+// SelfEncodedCIDLength returns the CID length announced by the first octet of
+// a CID that self-encodes its length
+func SelfEncodedCIDLength(firstOctet byte) int {
+	return int(firstOctet&selfEncodedLengthMask) + 1
+}
+
+// maxCIDLength returns the configured CID length cap
+func (p *PacketProcessor) maxCIDLength() uint8 {
+	if p.MaxCIDLength == 0 {
+		return MaxCIDLength
+	}
+	return p.MaxCIDLength
+}
+
+// maxCIDLengthFor returns the CID length cap of a version
+func (p *PacketProcessor) maxCIDLengthFor(version uint32) uint8 {
+	if max, ok := p.MaxCIDLengths[version]; ok {
+		return max
+	}
+	return p.maxCIDLength()
+}
+
+// shortHeaderMaxCIDLength returns the DCID length cap of short headers
+func (p *PacketProcessor) shortHeaderMaxCIDLength() uint8 {
+	if p.ShortHeaderVersion == 0 {
+		return p.maxCIDLength()
+	}
+	return p.maxCIDLengthFor(p.ShortHeaderVersion)
 }
 
 type HeaderParser interface {
-	ParsePacket(packet []byte) (*QuicHeader, error)
+	ParsePacket(packet []byte) (QuicHeader, error)
 
 	ClassifyPacket(packet []byte) (PacketType, error)
 
 	ExtractCID(packet []byte) ([]byte, error)
 }
 
+var _ HeaderParser = (*PacketProcessor)(nil)
+
 type Validator interface {
 	ValidatePacket(packet []byte) error
 }
@@ -26,6 +100,10 @@ func assert(condition bool) {
 
 // first implement parse packet
 func (p *PacketProcessor) ParsePacket(packet []byte) (QuicHeader, error) {
+	if len(packet) == 0 {
+		return nil, ErrPacketTooShort
+	}
+
 	// get first byte of packet
 	firstByte := packet[0]
 	headerForm := firstByte >> 7
@@ -41,25 +119,95 @@ func (p *PacketProcessor) ParsePacket(packet []byte) (QuicHeader, error) {
 	}
 }
 
+// ClassifyPacket returns the type of a packet from its first byte and, for
+// long headers, its version, without parsing connection IDs
+func (p *PacketProcessor) ClassifyPacket(packet []byte) (PacketType, error) {
+	if len(packet) == 0 {
+		return 0, ErrPacketTooShort
+	}
+	if packet[0]&0x80 == 0 {
+		return OneRTT, nil
+	}
+	// the version decides whether the type bits mean anything
+	if len(packet) < 5 {
+		return 0, ErrPacketTooShort
+	}
+	if binary.BigEndian.Uint32(packet[1:5]) == 0 {
+		return VersionNegotiation, nil
+	}
+	return LongPacketType(binary.BigEndian.Uint32(packet[1:5]), packet[0]), nil
+}
+
+// ExtractCID returns the Destination Connection ID of a packet
+func (p *PacketProcessor) ExtractCID(packet []byte) ([]byte, error) {
+	header, err := p.ParsePacket(packet)
+	if err != nil {
+		return nil, err
+	}
+	return header.GetCID()
+}
+
 func (p *PacketProcessor) parseLongHeader(packet []byte) (*LongHeader, error) {
+	// first byte + version + DCID length
+	if len(packet) < 6 {
+		return nil, ErrPacketTooShort
+	}
 	header := &LongHeader{}
 	header.HeaderForm = 1
-	header.LongPacketType = PacketType((packet[0] >> 4) & 0x1)
-	header.TypeSpecific = packet[0] & 0x0F
+	header.FixedBit = (packet[0] >> 6) & 0x1
 	header.Version = binary.BigEndian.Uint32(packet[1:5])
+	header.LongPacketType = LongPacketType(header.Version, packet[0])
+	header.TypeSpecific = packet[0] & 0x0F
+	if header.HasPacketNumber() {
+		// both fields are still header-protected at this point
+		header.ReservedBits = (header.TypeSpecific >> 2) & 0x3
+		header.PacketNumberLength = header.TypeSpecific & 0x3
+	}
 	header.DCIDLength = packet[5] // DCID length report length in byte
+	maxLength := p.maxCIDLengthFor(header.Version)
+	if header.DCIDLength > maxLength {
+		return nil, fmt.Errorf("%w: DCID length %d exceeds %d for version %#08x", ErrInvalidCIDLength, header.DCIDLength, maxLength, header.Version)
+	}
+	// DCID must be followed by at least the SCID length byte
+	if len(packet) < 7+int(header.DCIDLength) {
+		return nil, ErrPacketTooShort
+	}
 	header.DCID = packet[6 : 6+header.DCIDLength]
 	header.SCIDLength = packet[6+header.DCIDLength] // SCID length report length in byte
+	if header.SCIDLength > maxLength {
+		return nil, fmt.Errorf("%w: SCID length %d exceeds %d for version %#08x", ErrInvalidCIDLength, header.SCIDLength, maxLength, header.Version)
+	}
+	if len(packet) < 7+int(header.DCIDLength)+int(header.SCIDLength) {
+		return nil, ErrPacketTooShort
+	}
 	header.SCID = packet[6+header.DCIDLength+1 : 6+header.DCIDLength+1+header.SCIDLength]
 	return header, nil
 }
 
 func (p *PacketProcessor) parseShortHeader(packet []byte) (*ShortHeader, error) {
+	if len(packet) < 1 {
+		return nil, ErrPacketTooShort
+	}
+	dcidLength := int(p.DCIDLength)
+	if p.SelfEncodedCIDLength {
+		if len(packet) < 2 {
+			return nil, ErrTruncatedCID
+		}
+		dcidLength = SelfEncodedCIDLength(packet[1])
+	}
+	if maxLength := int(p.shortHeaderMaxCIDLength()); dcidLength > maxLength {
+		return nil, fmt.Errorf("%w: DCID length %d exceeds %d", ErrInvalidCIDLength, dcidLength, maxLength)
+	}
+	// never read past the datagram when the client uses a shorter CID than configured
+	if len(packet) < 1+dcidLength {
+		return nil, ErrTruncatedCID
+	}
 	header := &ShortHeader{}
 	header.HeaderForm = 0
+	header.FixedBit = (packet[0] >> 6) & 0x1
 	header.ReservedBits = (packet[0] >> 3) & 0x3
 	header.KeyPhase = (packet[0] >> 2) & 0x1
 	header.PacketNumberLength = packet[0] & 0x3
-	header.DCID = packet[1 : 1+p.DCIDLength] // length of DCID is expected to known by LB
+	header.DCID = packet[1 : 1+dcidLength] // length of DCID is expected to known by LB
 	return header, nil
 }
@@ -8,34 +8,93 @@ const (
 	HandShake PacketType = 0x02
 	Retry     PacketType = 0x03
 	OneRTT    PacketType = 0x04
+	// VersionNegotiation is a long header with version 0; it has no type bits
+	VersionNegotiation PacketType = 0x05
 )
 
+// packetTypeNames are the names packet types are reported with
+var packetTypeNames = [...]string{
+	Initial:            "initial",
+	ZeroRTT:            "0rtt",
+	HandShake:          "handshake",
+	Retry:              "retry",
+	OneRTT:             "1rtt",
+	VersionNegotiation: "version_negotiation",
+}
+
+func (t PacketType) String() string {
+	if int(t) < len(packetTypeNames) {
+		return packetTypeNames[t]
+	}
+	return "unknown"
+}
+
+// MaxCIDLength is the longest connection ID permitted by QUIC version 1
+const MaxCIDLength = 20
+
 type QuicHeader interface {
 	GetCID() ([]byte, error)
 	GetPacketType() (PacketType, error)
 	GetHeaderForm() (uint8, error)
 }
 
+// LongHeader is a parsed long-header packet.
+//
+// The low nibble of the first byte (TypeSpecific) depends on the packet type.
+// For Initial, 0-RTT and Handshake it holds two reserved bits followed by the
+// packet number length, and all four bits are covered by header protection, so
+// ReservedBits and PacketNumberLength are the protected on-wire values until the
+// caller removes header protection. For Retry the nibble is unused and is not
+// protected; ReservedBits and PacketNumberLength are left zero.
 type LongHeader struct {
-	HeaderForm     uint8
-	LongPacketType PacketType
-	TypeSpecific   uint8
-	Version        uint32
-	DCIDLength     uint8
-	DCID           []byte
-	SCIDLength     uint8
-	SCID           []byte
+	HeaderForm         uint8
+	FixedBit           uint8
+	LongPacketType     PacketType
+	TypeSpecific       uint8
+	ReservedBits       uint8 // header-protected, Initial/0-RTT/Handshake only
+	PacketNumberLength uint8 // header-protected, encoded as length minus one
+	Version            uint32
+	DCIDLength         uint8
+	DCID               []byte
+	SCIDLength         uint8
+	SCID               []byte
 }
 
+// ShortHeader is a parsed short-header packet.
+//
+// The fixed bit is not header-protected, so FixedBit can be enforced before
+// routing (see PacketProcessor.CheckFixedBit). The five low bits are:
+// ReservedBits, KeyPhase and PacketNumberLength are the protected on-wire
+// values, meaningless and not to be validated until the caller removes
+// header protection.
 type ShortHeader struct {
 	HeaderForm         uint8
-	ReservedBits       uint8
-	KeyPhase           uint8
-	PacketNumberLength uint8
+	FixedBit           uint8
+	ReservedBits       uint8 // header-protected
+	KeyPhase           uint8 // header-protected
+	PacketNumberLength uint8 // header-protected, encoded as length minus one
 	DCID               []byte
 	PacketNumber       uint64
 }
 
+// HasPacketNumber reports whether the packet type carries a packet number
+func (lh *LongHeader) HasPacketNumber() bool {
+	return lh.LongPacketType != Retry
+}
+
+// CheckReservedBits validates the reserved bits of the first byte once header
+// protection has been removed. RFC 9000 requires them to be zero; Retry packets
+// have no reserved bits and always pass.
+func (lh *LongHeader) CheckReservedBits(unprotectedFirstByte byte) error {
+	if !lh.HasPacketNumber() {
+		return nil
+	}
+	if unprotectedFirstByte&0x0C != 0 {
+		return ErrReservedBitsSet
+	}
+	return nil
+}
+
 func (lh *LongHeader) GetCID() ([]byte, error) {
 	return lh.DCID, nil
 }
@@ -1,6 +1,9 @@
 package packet
 
 import (
+	"bytes"
+	"encoding/binary"
+	"errors"
 	"testing"
 )
 
@@ -73,12 +76,29 @@ func TestParseShortHeader(t *testing.T) {
 			},
 			expected: &ShortHeader{
 				HeaderForm:         0,
+				FixedBit:           1,
 				ReservedBits:       0,
 				KeyPhase:           0,
 				PacketNumberLength: 0,
 				DCID:               []byte{0x01, 0x02, 0x03, 0x04, 0x05, 0x06, 0x07, 0x08},
 			},
 		},
+		{
+			name: "Greased Fixed Bit",
+			packet: []byte{
+				0x1d, // Header Form (0) + Fixed Bit (0) + Reserved (11) + Key Phase (1) + Packet Number Length (01)
+				0x01, 0x02, 0x03, 0x04,
+				0x05, 0x06, 0x07, 0x08,
+			},
+			expected: &ShortHeader{
+				HeaderForm:         0,
+				FixedBit:           0,
+				ReservedBits:       3,
+				KeyPhase:           1,
+				PacketNumberLength: 1,
+				DCID:               []byte{0x01, 0x02, 0x03, 0x04, 0x05, 0x06, 0x07, 0x08},
+			},
+		},
 	}
 
 	processor := &PacketProcessor{DCIDLength: 8}
@@ -94,12 +114,319 @@ func TestParseShortHeader(t *testing.T) {
 			if header.HeaderForm != tt.expected.HeaderForm {
 				t.Errorf("HeaderForm = %v, want %v", header.HeaderForm, tt.expected.HeaderForm)
 			}
+			if header.FixedBit != tt.expected.FixedBit {
+				t.Errorf("FixedBit = %v, want %v", header.FixedBit, tt.expected.FixedBit)
+			}
 			if header.ReservedBits != tt.expected.ReservedBits {
 				t.Errorf("ReservedBits = %v, want %v", header.ReservedBits, tt.expected.ReservedBits)
 			}
 			if header.KeyPhase != tt.expected.KeyPhase {
 				t.Errorf("KeyPhase = %v, want %v", header.KeyPhase, tt.expected.KeyPhase)
 			}
+			if header.PacketNumberLength != tt.expected.PacketNumberLength {
+				t.Errorf("PacketNumberLength = %v, want %v", header.PacketNumberLength, tt.expected.PacketNumberLength)
+			}
+		})
+	}
+}
+
+func TestParseShortHeaderTruncatedCID(t *testing.T) {
+	processor := &PacketProcessor{DCIDLength: 8}
+
+	// DCID is one byte short of the configured length
+	packet := []byte{
+		0x40,
+		0x01, 0x02, 0x03, 0x04,
+		0x05, 0x06, 0x07,
+	}
+
+	if _, err := processor.parseShortHeader(packet); !errors.Is(err, ErrTruncatedCID) {
+		t.Fatalf("parseShortHeader() error = %v, want %v", err, ErrTruncatedCID)
+	}
+	if _, err := processor.ParsePacket(packet); !errors.Is(err, ErrPacketTooShort) {
+		t.Fatalf("ParsePacket() error = %v, want %v", err, ErrPacketTooShort)
+	}
+}
+
+func TestParseLongHeaderTooShort(t *testing.T) {
+	processor := &PacketProcessor{DCIDLength: 8}
+
+	tests := []struct {
+		name   string
+		packet []byte
+	}{
+		{name: "Empty", packet: []byte{}},
+		{name: "Missing DCID Length", packet: []byte{0xC0, 0x00, 0x00, 0x00, 0x01}},
+		{name: "DCID Past End", packet: []byte{0xC0, 0x00, 0x00, 0x00, 0x01, 0x08, 0x01, 0x02}},
+		{name: "SCID Past End", packet: []byte{0xC0, 0x00, 0x00, 0x00, 0x01, 0x01, 0x01, 0x04, 0x0A}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := processor.ParsePacket(tt.packet); !errors.Is(err, ErrPacketTooShort) {
+				t.Errorf("ParsePacket() error = %v, want %v", err, ErrPacketTooShort)
+			}
+		})
+	}
+}
+
+func TestParseLongHeaderTypeSpecificBits(t *testing.T) {
+	processor := &PacketProcessor{DCIDLength: 8}
+
+	tests := []struct {
+		name               string
+		firstByte          byte
+		packetType         PacketType
+		reservedBits       uint8
+		packetNumberLength uint8
+		hasPacketNumber    bool
+	}{
+		{
+			name:               "Initial",
+			firstByte:          0xC0 | 0x08 | 0x03, // reserved 10, packet number length 11
+			packetType:         Initial,
+			reservedBits:       0x2,
+			packetNumberLength: 0x3,
+			hasPacketNumber:    true,
+		},
+		{
+			name:               "Handshake",
+			firstByte:          0xE0 | 0x01,
+			packetType:         HandShake,
+			reservedBits:       0x0,
+			packetNumberLength: 0x1,
+			hasPacketNumber:    true,
+		},
+		{
+			name:            "Retry",
+			firstByte:       0xF0 | 0x0F, // unused nibble, not interpreted
+			packetType:      Retry,
+			hasPacketNumber: false,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			packet := []byte{tt.firstByte, 0x00, 0x00, 0x00, 0x01, 0x01, 0xAA, 0x00}
+			header, err := processor.parseLongHeader(packet)
+			if err != nil {
+				t.Fatalf("parseLongHeader() error = %v", err)
+			}
+			if header.FixedBit != 1 {
+				t.Errorf("FixedBit = %v, want 1", header.FixedBit)
+			}
+			if header.LongPacketType != tt.packetType {
+				t.Errorf("LongPacketType = %v, want %v", header.LongPacketType, tt.packetType)
+			}
+			if header.TypeSpecific != tt.firstByte&0x0F {
+				t.Errorf("TypeSpecific = %#x, want %#x", header.TypeSpecific, tt.firstByte&0x0F)
+			}
+			if header.ReservedBits != tt.reservedBits {
+				t.Errorf("ReservedBits = %v, want %v", header.ReservedBits, tt.reservedBits)
+			}
+			if header.PacketNumberLength != tt.packetNumberLength {
+				t.Errorf("PacketNumberLength = %v, want %v", header.PacketNumberLength, tt.packetNumberLength)
+			}
+			if header.HasPacketNumber() != tt.hasPacketNumber {
+				t.Errorf("HasPacketNumber() = %v, want %v", header.HasPacketNumber(), tt.hasPacketNumber)
+			}
+		})
+	}
+}
+
+func TestCheckReservedBits(t *testing.T) {
+	initial := &LongHeader{LongPacketType: Initial}
+	if err := initial.CheckReservedBits(0xC1); err != nil {
+		t.Errorf("CheckReservedBits(0xC1) error = %v, want nil", err)
+	}
+	if err := initial.CheckReservedBits(0xC4); !errors.Is(err, ErrReservedBitsSet) {
+		t.Errorf("CheckReservedBits(0xC4) error = %v, want %v", err, ErrReservedBitsSet)
+	}
+
+	retry := &LongHeader{LongPacketType: Retry}
+	if err := retry.CheckReservedBits(0xFF); err != nil {
+		t.Errorf("Retry CheckReservedBits(0xFF) error = %v, want nil", err)
+	}
+}
+
+// longHeaderWithCIDs builds a minimal Initial header with the given CID lengths
+func longHeaderWithCIDs(dcidLen, scidLen int) []byte {
+	packet := []byte{0xC0, 0x00, 0x00, 0x00, 0x01, byte(dcidLen)}
+	packet = append(packet, make([]byte, dcidLen)...)
+	packet = append(packet, byte(scidLen))
+	return append(packet, make([]byte, scidLen)...)
+}
+
+func TestParseLongHeaderCIDLengthLimit(t *testing.T) {
+	processor := &PacketProcessor{DCIDLength: 8}
+
+	tests := []struct {
+		name    string
+		packet  []byte
+		wantErr error
+	}{
+		{name: "20-byte DCID", packet: longHeaderWithCIDs(20, 0)},
+		{name: "20-byte SCID", packet: longHeaderWithCIDs(8, 20)},
+		{name: "21-byte DCID", packet: longHeaderWithCIDs(21, 0), wantErr: ErrInvalidCIDLength},
+		{name: "21-byte SCID", packet: longHeaderWithCIDs(8, 21), wantErr: ErrInvalidCIDLength},
+		// the claimed length is rejected before the parser looks for the bytes
+		{name: "21-byte DCID claimed only", packet: longHeaderWithCIDs(21, 0)[:7], wantErr: ErrInvalidCIDLength},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := processor.parseLongHeader(tt.packet)
+			if !errors.Is(err, tt.wantErr) {
+				t.Errorf("parseLongHeader() error = %v, want %v", err, tt.wantErr)
+			}
+		})
+	}
+
+	custom := &PacketProcessor{DCIDLength: 8, MaxCIDLength: 32}
+	if _, err := custom.parseLongHeader(longHeaderWithCIDs(21, 0)); err != nil {
+		t.Errorf("parseLongHeader() with raised limit error = %v", err)
+	}
+}
+
+func TestVersionCIDLengthLimits(t *testing.T) {
+	const private uint32 = 0xff0000aa
+	processor := &PacketProcessor{DCIDLength: 8, MaxCIDLengths: map[uint32]uint8{private: 32, Version2: 16}}
+	withVersion := func(version uint32, dcidLen, scidLen int) []byte {
+		pkt := longHeaderWithCIDs(dcidLen, scidLen)
+		binary.BigEndian.PutUint32(pkt[1:5], version)
+		return pkt
+	}
+
+	tests := []struct {
+		name    string
+		packet  []byte
+		wantErr error
+	}{
+		{name: "v1 20-byte DCID", packet: withVersion(Version1, 20, 0)},
+		{name: "v1 21-byte DCID", packet: withVersion(Version1, 21, 0), wantErr: ErrInvalidCIDLength},
+		{name: "Private 32-byte DCID", packet: withVersion(private, 32, 0)},
+		{name: "Private 32-byte SCID", packet: withVersion(private, 8, 32)},
+		{name: "Private 33-byte DCID", packet: withVersion(private, 33, 0), wantErr: ErrInvalidCIDLength},
+		{name: "v2 16-byte DCID", packet: withVersion(Version2, 16, 0)},
+		{name: "v2 17-byte DCID", packet: withVersion(Version2, 17, 0), wantErr: ErrInvalidCIDLength},
+		{name: "v2 17-byte SCID", packet: withVersion(Version2, 8, 17), wantErr: ErrInvalidCIDLength},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := processor.parseLongHeader(tt.packet); !errors.Is(err, tt.wantErr) {
+				t.Errorf("parseLongHeader() error = %v, want %v", err, tt.wantErr)
+			}
+		})
+	}
+
+	// short headers carry no version, so take the cap of ShortHeaderVersion
+	short := func(p *PacketProcessor, length int) error {
+		pkt := append([]byte{0x40, byte(length - 1)}, make([]byte, length)...)
+		_, err := p.parseShortHeader(pkt)
+		return err
+	}
+	shortTests := []struct {
+		name    string
+		version uint32
+		length  int
+		wantErr error
+	}{
+		{name: "Default 20", length: 20},
+		{name: "Default 21", length: 21, wantErr: ErrInvalidCIDLength},
+		{name: "Private 32", version: private, length: 32},
+		{name: "Private 33", version: private, length: 33, wantErr: ErrInvalidCIDLength},
+		{name: "v2 17", version: Version2, length: 17, wantErr: ErrInvalidCIDLength},
+		{name: "Unlisted Version 20", version: Version1, length: 20},
+	}
+	for _, tt := range shortTests {
+		t.Run("Short "+tt.name, func(t *testing.T) {
+			p := &PacketProcessor{SelfEncodedCIDLength: true, MaxCIDLengths: processor.MaxCIDLengths, ShortHeaderVersion: tt.version}
+			if err := short(p, tt.length); !errors.Is(err, tt.wantErr) {
+				t.Errorf("parseShortHeader(%d-byte DCID) error = %v, want %v", tt.length, err, tt.wantErr)
+			}
+		})
+	}
+	// a fixed DCID length over the cap is rejected as well
+	fixed := &PacketProcessor{DCIDLength: 24}
+	if _, err := fixed.parseShortHeader(make([]byte, 32)); !errors.Is(err, ErrInvalidCIDLength) {
+		t.Errorf("parseShortHeader() with a 24-byte DCID length error = %v, want %v", err, ErrInvalidCIDLength)
+	}
+}
+
+func TestClassifyPacket(t *testing.T) {
+	tests := []struct {
+		name    string
+		packet  []byte
+		want    PacketType
+		wantErr error
+	}{
+		{name: "Empty", packet: nil, wantErr: ErrPacketTooShort},
+		{name: "One Byte Long Header", packet: []byte{0xc0}, wantErr: ErrPacketTooShort},
+		{name: "Four Byte Long Header", packet: []byte{0xf0, 0x00, 0x00, 0x00}, wantErr: ErrPacketTooShort},
+		{name: "Five Byte Initial", packet: []byte{0xc0, 0x00, 0x00, 0x00, 0x01}, want: Initial},
+		{name: "Five Byte Retry", packet: []byte{0xf0, 0x00, 0x00, 0x00, 0x01}, want: Retry},
+		{name: "Five Byte Version Negotiation", packet: []byte{0xf0, 0x00, 0x00, 0x00, 0x00}, want: VersionNegotiation},
+		{name: "One Byte Short Header", packet: []byte{0x40}, want: OneRTT},
+	}
+
+	p := &PacketProcessor{DCIDLength: 8}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := p.ClassifyPacket(tt.packet)
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("ClassifyPacket() error = %v, want %v", err, tt.wantErr)
+			}
+			if err == nil && got != tt.want {
+				t.Errorf("ClassifyPacket() = %d, want %d", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestParseShortHeaderSelfEncodedLength(t *testing.T) {
+	processor := &PacketProcessor{DCIDLength: 8, SelfEncodedCIDLength: true}
+
+	tests := []struct {
+		name     string
+		packet   []byte
+		wantDCID []byte
+		wantErr  error
+	}{
+		{
+			name:     "Length Four",
+			packet:   []byte{0x40, 0x03, 0xaa, 0xbb, 0xcc, 0x01, 0x02},
+			wantDCID: []byte{0x03, 0xaa, 0xbb, 0xcc},
+		},
+		{
+			name:     "Rotation Bits Ignored",
+			packet:   []byte{0x40, 0xc1, 0xaa, 0x01},
+			wantDCID: []byte{0xc1, 0xaa},
+		},
+		{
+			name:    "Longer Than Datagram",
+			packet:  []byte{0x40, 0x09, 0xaa, 0xbb},
+			wantErr: ErrTruncatedCID,
+		},
+		{
+			name:    "Over Maximum",
+			packet:  append([]byte{0x40, 0x3f}, make([]byte, 80)...),
+			wantErr: ErrInvalidCIDLength,
+		},
+		{
+			name:    "No CID",
+			packet:  []byte{0x40},
+			wantErr: ErrTruncatedCID,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			header, err := processor.parseShortHeader(tt.packet)
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("parseShortHeader() error = %v, want %v", err, tt.wantErr)
+			}
+			if err == nil && !bytes.Equal(header.DCID, tt.wantDCID) {
+				t.Errorf("DCID = %x, want %x", header.DCID, tt.wantDCID)
+			}
 		})
 	}
 }
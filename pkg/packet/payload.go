@@ -0,0 +1,98 @@
+package packet
+
+import (
+	"errors"
+	"fmt"
+)
+
+var (
+	// ErrNoPacketNumber is returned when asking a Retry packet for its packet
+	// number or payload, which it does not have
+	ErrNoPacketNumber = errors.New("packet type has no packet number")
+	// ErrLengthPastDatagram is returned for a long header whose Length
+	// claims more bytes than the datagram has left, as a truncated or
+	// tampered datagram's does. It is an ErrPacketTooShort.
+	ErrLengthPastDatagram = fmt.Errorf("%w: Length runs past the datagram", ErrPacketTooShort)
+)
+
+// RetryIntegrityTagLength is the length of the tag that ends every Retry packet
+const RetryIntegrityTagLength = 16
+
+// cidsEnd returns the offset just past the SCID
+func (lh *LongHeader) cidsEnd() int {
+	return 7 + int(lh.DCIDLength) + int(lh.SCIDLength)
+}
+
+// PacketNumberLen returns the length in bytes of the packet number, which is
+// only meaningful once header protection has been removed. Retry packets have
+// no packet number.
+func (lh *LongHeader) PacketNumberLen() (int, error) {
+	if !lh.HasPacketNumber() {
+		return 0, ErrNoPacketNumber
+	}
+	return int(lh.PacketNumberLength) + 1, nil
+}
+
+// Token returns the token of an Initial or Retry packet, a subslice of packet,
+// and nil for the other types. A Retry token runs from the SCID to the
+// integrity tag.
+func (lh *LongHeader) Token(packet []byte) ([]byte, error) {
+	offset := lh.cidsEnd()
+	if len(packet) < offset {
+		return nil, ErrPacketTooShort
+	}
+	switch lh.LongPacketType {
+	case Retry:
+		if len(packet)-offset < RetryIntegrityTagLength {
+			return nil, ErrPacketTooShort
+		}
+		return packet[offset : len(packet)-RetryIntegrityTagLength], nil
+	case Initial:
+		tokenLength, n, err := readVarint(packet[offset:])
+		if err != nil {
+			return nil, err
+		}
+		offset += n
+		if tokenLength > uint64(len(packet)-offset) {
+			return nil, ErrPacketTooShort
+		}
+		return packet[offset : offset+int(tokenLength)], nil
+	}
+	return nil, nil
+}
+
+// PayloadOffset returns the offset in packet of the packet number, where the
+// region covered by the Length field begins. Retry packets have none.
+func (lh *LongHeader) PayloadOffset(packet []byte) (int, error) {
+	offset, _, err := lh.lengthField(packet)
+	return offset, err
+}
+
+// lengthField returns the offset just past the Length field and its value,
+// checked against the bytes left in packet
+func (lh *LongHeader) lengthField(packet []byte) (int, uint64, error) {
+	if !lh.HasPacketNumber() {
+		return 0, 0, ErrNoPacketNumber
+	}
+	offset := lh.cidsEnd()
+	if len(packet) < offset {
+		return 0, 0, ErrPacketTooShort
+	}
+	if lh.LongPacketType == Initial {
+		token, err := lh.Token(packet)
+		if err != nil {
+			return 0, 0, err
+		}
+		_, n, _ := readVarint(packet[offset:])
+		offset += n + len(token)
+	}
+	length, n, err := readVarint(packet[offset:])
+	if err != nil {
+		return 0, 0, err
+	}
+	offset += n
+	if length > uint64(len(packet)-offset) {
+		return 0, 0, ErrLengthPastDatagram
+	}
+	return offset, length, nil
+}
@@ -0,0 +1,162 @@
+package packet
+
+import (
+	"bytes"
+	"errors"
+	"testing"
+)
+
+func TestRetryHasNoPacketNumber(t *testing.T) {
+	tag := bytes.Repeat([]byte{0xEE}, RetryIntegrityTagLength)
+	header := []byte{
+		0xF0 | 0x0B,            // Retry, unused nibble set
+		0x00, 0x00, 0x00, 0x01, // Version
+		0x02, 0xD1, 0xD2, // DCID
+		0x03, 0x51, 0x52, 0x53, // SCID
+	}
+	tests := []struct {
+		name      string
+		token     []byte
+		truncate  int
+		wantToken []byte
+		wantErr   error
+	}{
+		{name: "Token", token: []byte("retry-token"), wantToken: []byte("retry-token")},
+		{name: "Empty Token", wantToken: []byte{}},
+		{name: "Truncated Tag", token: []byte("tok"), truncate: 4, wantErr: ErrPacketTooShort},
+	}
+
+	p := &PacketProcessor{DCIDLength: 8}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			packet := append(append(append([]byte(nil), header...), tt.token...), tag...)
+			packet = packet[:len(packet)-tt.truncate]
+			h, err := p.parseLongHeader(packet)
+			if err != nil {
+				t.Fatalf("parseLongHeader() error = %v", err)
+			}
+			if h.PacketNumberLength != 0 || h.ReservedBits != 0 {
+				t.Errorf("PacketNumberLength = %d, ReservedBits = %d, want 0 and 0", h.PacketNumberLength, h.ReservedBits)
+			}
+			if _, err := h.PacketNumberLen(); !errors.Is(err, ErrNoPacketNumber) {
+				t.Errorf("PacketNumberLen() error = %v, want %v", err, ErrNoPacketNumber)
+			}
+			if _, err := h.PayloadOffset(packet); !errors.Is(err, ErrNoPacketNumber) {
+				t.Errorf("PayloadOffset() error = %v, want %v", err, ErrNoPacketNumber)
+			}
+
+			token, err := h.Token(packet)
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("Token() error = %v, want %v", err, tt.wantErr)
+			}
+			if err == nil && !bytes.Equal(token, tt.wantToken) {
+				t.Errorf("Token() = %q, want %q", token, tt.wantToken)
+			}
+		})
+	}
+}
+
+func TestPayloadOffset(t *testing.T) {
+	tests := []struct {
+		name       string
+		packet     []byte
+		wantToken  []byte
+		wantOffset int
+		wantPNLen  int
+		wantErr    error
+	}{
+		{
+			name: "Initial",
+			packet: []byte{
+				0xC0 | 0x01, 0x00, 0x00, 0x00, 0x01, // Initial, 2 byte packet number
+				0x01, 0xAA, 0x00, // DCID, no SCID
+				0x02, 0x70, 0x71, // token
+				0x03, 0x01, 0x02, 0x03, // Length, packet number + payload
+			},
+			wantToken:  []byte{0x70, 0x71},
+			wantOffset: 12,
+			wantPNLen:  2,
+		},
+		{
+			name: "Handshake",
+			packet: []byte{
+				0xE0 | 0x03, 0x00, 0x00, 0x00, 0x01,
+				0x01, 0xAA, 0x00,
+				0x40, 0x02, 0x01, 0x02, // two byte Length
+			},
+			wantOffset: 10,
+			wantPNLen:  4,
+		},
+		{
+			name: "0-RTT",
+			packet: []byte{
+				0xD0 | 0x01, 0x00, 0x00, 0x00, 0x01, // 0-RTT, 2 byte packet number
+				0x01, 0xAA, 0x01, 0xBB, // DCID, SCID
+				0x04, 0x01, 0x02, 0x03, 0x04, // Length straight after the SCID
+			},
+			wantOffset: 10,
+			wantPNLen:  2,
+		},
+		{
+			name: "0-RTT Version 2",
+			packet: []byte{
+				0xE0, 0x6B, 0x33, 0x43, 0xCF, // v2 0-RTT type bits are 10
+				0x01, 0xAA, 0x00,
+				0x02, 0x01, 0x02,
+			},
+			wantOffset: 9,
+			wantPNLen:  1,
+		},
+		{
+			name: "Initial Length Past End",
+			packet: []byte{
+				0xC0, 0x00, 0x00, 0x00, 0x01,
+				0x01, 0xAA, 0x00,
+				0x00,
+				0x05, 0x01,
+			},
+			wantPNLen: 1,
+			wantErr:   ErrPacketTooShort,
+		},
+	}
+
+	p := &PacketProcessor{DCIDLength: 8}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			h, err := p.parseLongHeader(tt.packet)
+			if err != nil {
+				t.Fatalf("parseLongHeader() error = %v", err)
+			}
+			if n, err := h.PacketNumberLen(); err != nil || n != tt.wantPNLen {
+				t.Errorf("PacketNumberLen() = %d, %v, want %d", n, err, tt.wantPNLen)
+			}
+			if token, err := h.Token(tt.packet); err != nil || !bytes.Equal(token, tt.wantToken) {
+				t.Errorf("Token() = %x, %v, want %x", token, err, tt.wantToken)
+			}
+			offset, err := h.PayloadOffset(tt.packet)
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("PayloadOffset() error = %v, want %v", err, tt.wantErr)
+			}
+			if err == nil && offset != tt.wantOffset {
+				t.Errorf("PayloadOffset() = %d, want %d", offset, tt.wantOffset)
+			}
+		})
+	}
+}
+
+func TestSplitCoalescedZeroRTT(t *testing.T) {
+	// the byte after the SCID is the Length; read as a token length it would
+	// swallow the packet and misplace the second one
+	zeroRTT := []byte{0xD0, 0x00, 0x00, 0x00, 0x01, 0x01, 0xAA, 0x00, 0x02, 0x01, 0x02}
+	handshake := []byte{0xE0, 0x00, 0x00, 0x00, 0x01, 0x01, 0xAA, 0x00, 0x01, 0x03}
+	datagram := append(append([]byte(nil), zeroRTT...), handshake...)
+
+	p := &PacketProcessor{}
+	packets, err := p.SplitCoalesced(datagram)
+	if err != nil {
+		t.Fatalf("SplitCoalesced() error = %v", err)
+	}
+	if len(packets) != 2 || !bytes.Equal(packets[0], zeroRTT) || !bytes.Equal(packets[1], handshake) {
+		t.Errorf("SplitCoalesced() = %x, want [%x %x]", packets, zeroRTT, handshake)
+	}
+}
@@ -0,0 +1,112 @@
+package packet
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/subtle"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math/rand/v2"
+)
+
+var (
+	// ErrRetryIntegrity is returned when a Retry packet's integrity tag does
+	// not match the original DCID it answers
+	ErrRetryIntegrity = errors.New("retry integrity tag mismatch")
+	// ErrUnsupportedVersion is returned for a version whose constants the
+	// parser does not know
+	ErrUnsupportedVersion = errors.New("unsupported QUIC version")
+)
+
+// retryKey is the fixed AEAD key and nonce a version computes Retry
+// integrity tags with
+type retryKey struct {
+	key, nonce []byte
+}
+
+// retryKeys holds the Retry integrity constants of RFC 9001 section 5.8 and
+// RFC 9369 section 3.3.3
+var retryKeys = map[uint32]retryKey{
+	Version1: {
+		key:   []byte{0xbe, 0x0c, 0x69, 0x0b, 0x9f, 0x66, 0x57, 0x5a, 0x1d, 0x76, 0x6b, 0x54, 0xe3, 0x68, 0xc8, 0x4e},
+		nonce: []byte{0x46, 0x15, 0x99, 0xd3, 0x5d, 0x63, 0x2b, 0xf2, 0x23, 0x98, 0x25, 0xbb},
+	},
+	Version2: {
+		key:   []byte{0x8f, 0xb4, 0xb0, 0x1b, 0x56, 0xac, 0x48, 0xe2, 0x60, 0xfb, 0xcb, 0xce, 0xad, 0x7c, 0xcc, 0x92},
+		nonce: []byte{0xd8, 0x69, 0x69, 0xbc, 0x2d, 0x7c, 0x6d, 0x99, 0x90, 0xef, 0xb0, 0x4a},
+	},
+}
+
+// RetryIntegrityTag computes the integrity tag for a Retry packet of the
+// given version, retry being the packet up to where the tag goes and odcid
+// the DCID of the client packet it answers
+func RetryIntegrityTag(version uint32, odcid, retry []byte) ([]byte, error) {
+	k, ok := retryKeys[version]
+	if !ok {
+		return nil, fmt.Errorf("%w: %#08x", ErrUnsupportedVersion, version)
+	}
+	block, err := aes.NewCipher(k.key)
+	if err != nil {
+		return nil, err
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+	// the tag authenticates the Retry pseudo-packet with an empty plaintext
+	pseudo := make([]byte, 0, 1+len(odcid)+len(retry))
+	pseudo = append(pseudo, byte(len(odcid)))
+	pseudo = append(pseudo, odcid...)
+	pseudo = append(pseudo, retry...)
+	return aead.Seal(nil, k.nonce, nil, pseudo), nil
+}
+
+// VerifyRetryIntegrity checks the integrity tag ending a parsed Retry packet
+// against the original DCID, with the constants of the packet's version
+func (lh *LongHeader) VerifyRetryIntegrity(packet, odcid []byte) error {
+	if lh.LongPacketType != Retry {
+		return fmt.Errorf("%w: not a Retry packet", ErrRetryIntegrity)
+	}
+	if len(packet) < lh.cidsEnd()+RetryIntegrityTagLength {
+		return ErrPacketTooShort
+	}
+	body, tag := packet[:len(packet)-RetryIntegrityTagLength], packet[len(packet)-RetryIntegrityTagLength:]
+	want, err := RetryIntegrityTag(lh.Version, odcid, body)
+	if err != nil {
+		return err
+	}
+	if subtle.ConstantTimeCompare(tag, want) != 1 {
+		return ErrRetryIntegrity
+	}
+	return nil
+}
+
+// RetryPacket builds a Retry packet (RFC 9000 section 17.2.5) of the given
+// version answering a client Initial sent to odcid: dcid is the client's
+// SCID, scid the CID the client is to use next, and token what it echoes in
+// its next Initial. The unused first-byte bits are random.
+func RetryPacket(version uint32, dcid, scid, odcid, token []byte) ([]byte, error) {
+	return retryPacket(version, byte(rand.Uint32()), dcid, scid, odcid, token)
+}
+
+// retryPacket is RetryPacket with the low four bits of unused as the unused bits
+func retryPacket(version uint32, unused byte, dcid, scid, odcid, token []byte) ([]byte, error) {
+	typeBits := byte(Retry)
+	if version == Version2 {
+		typeBits = 0 // Retry in v2's reassigned type bits
+	}
+	pkt := make([]byte, 0, 7+len(dcid)+len(scid)+len(token)+RetryIntegrityTagLength)
+	pkt = append(pkt, 0xc0|typeBits<<4|unused&0x0f)
+	pkt = binary.BigEndian.AppendUint32(pkt, version)
+	pkt = append(pkt, byte(len(dcid)))
+	pkt = append(pkt, dcid...)
+	pkt = append(pkt, byte(len(scid)))
+	pkt = append(pkt, scid...)
+	pkt = append(pkt, token...)
+	tag, err := RetryIntegrityTag(version, odcid, pkt)
+	if err != nil {
+		return nil, err
+	}
+	return append(pkt, tag...), nil
+}
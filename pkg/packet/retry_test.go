@@ -0,0 +1,114 @@
+package packet
+
+import (
+	"encoding/hex"
+	"errors"
+	"testing"
+)
+
+func TestVerifyRetryIntegrity(t *testing.T) {
+	odcid, _ := hex.DecodeString("8394c8f03e515708")
+	tests := []struct {
+		name    string
+		retry   string // RFC 9001 A.4 and RFC 9369 A.4
+		odcid   []byte
+		version uint32
+		wantErr error
+	}{
+		{name: "Version 1", retry: "ff000000010008f067a5502a4262b5746f6b656e04a265ba2eff4d829058fb3f0f2496ba", odcid: odcid, version: Version1},
+		{name: "Version 2", retry: "cf6b3343cf0008f067a5502a4262b5746f6b656ec8646ce8bfe33952d955543665dcc7b6", odcid: odcid, version: Version2},
+		{name: "Wrong ODCID", retry: "ff000000010008f067a5502a4262b5746f6b656e04a265ba2eff4d829058fb3f0f2496ba", odcid: odcid[:7], version: Version1, wantErr: ErrRetryIntegrity},
+		{name: "Tampered Token", retry: "ff000000010008f067a5502a4262b5746f6b656f04a265ba2eff4d829058fb3f0f2496ba", odcid: odcid, version: Version1, wantErr: ErrRetryIntegrity},
+		{name: "Unknown Version", retry: "f0000000020008f067a5502a4262b5746f6b656e04a265ba2eff4d829058fb3f0f2496ba", odcid: odcid, version: 2, wantErr: ErrUnsupportedVersion},
+	}
+	p := &PacketProcessor{}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			pkt, _ := hex.DecodeString(tt.retry)
+			header, err := p.parseLongHeader(pkt)
+			if err != nil {
+				t.Fatalf("parseLongHeader() error = %v", err)
+			}
+			if header.Version != tt.version {
+				t.Fatalf("Version = %#x, want %#x", header.Version, tt.version)
+			}
+			if header.LongPacketType != Retry {
+				t.Fatalf("LongPacketType = %d, want Retry", header.LongPacketType)
+			}
+			if err := header.VerifyRetryIntegrity(pkt, tt.odcid); !errors.Is(err, tt.wantErr) {
+				t.Errorf("VerifyRetryIntegrity() error = %v, want %v", err, tt.wantErr)
+			}
+		})
+	}
+
+	// a v1 Retry relabeled as v2 does not verify under the v2 key
+	pkt, _ := hex.DecodeString(tests[0].retry)
+	copy(pkt[1:5], []byte{0x6b, 0x33, 0x43, 0xcf})
+	pkt[0] = 0xcf // v2 Retry type bits are 00
+	header, _ := p.parseLongHeader(pkt)
+	if err := header.VerifyRetryIntegrity(pkt, odcid); !errors.Is(err, ErrRetryIntegrity) {
+		t.Errorf("VerifyRetryIntegrity(v1 tag under v2) error = %v, want %v", err, ErrRetryIntegrity)
+	}
+}
+
+func TestLongPacketTypeByVersion(t *testing.T) {
+	tests := []struct {
+		firstByte byte
+		version   uint32
+		want      PacketType
+	}{
+		{firstByte: 0xc0, version: Version1, want: Initial},
+		{firstByte: 0xd0, version: Version1, want: ZeroRTT},
+		{firstByte: 0xe0, version: Version1, want: HandShake},
+		{firstByte: 0xf0, version: Version1, want: Retry},
+		{firstByte: 0xc0, version: Version2, want: Retry},
+		{firstByte: 0xd0, version: Version2, want: Initial},
+		{firstByte: 0xe0, version: Version2, want: ZeroRTT},
+		{firstByte: 0xf0, version: Version2, want: HandShake},
+	}
+	for _, tt := range tests {
+		if got := LongPacketType(tt.version, tt.firstByte); got != tt.want {
+			t.Errorf("LongPacketType(%#x, %#x) = %d, want %d", tt.version, tt.firstByte, got, tt.want)
+		}
+	}
+}
+
+func TestRetryPacket(t *testing.T) {
+	odcid, _ := hex.DecodeString("8394c8f03e515708")
+	scid, _ := hex.DecodeString("f067a5502a4262b5")
+	tests := []struct {
+		name    string
+		version uint32
+		retry   string // RFC 9001 A.4 and RFC 9369 A.4, a Retry to an empty DCID
+	}{
+		{name: "Version 1", version: Version1, retry: "ff000000010008f067a5502a4262b5746f6b656e04a265ba2eff4d829058fb3f0f2496ba"},
+		{name: "Version 2", version: Version2, retry: "cf6b3343cf0008f067a5502a4262b5746f6b656ec8646ce8bfe33952d955543665dcc7b6"},
+	}
+	p := &PacketProcessor{}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			pkt, err := RetryPacket(tt.version, nil, scid, odcid, []byte("token"))
+			if err != nil {
+				t.Fatalf("RetryPacket() error = %v", err)
+			}
+			header, err := p.parseLongHeader(pkt)
+			if err != nil {
+				t.Fatalf("parseLongHeader() error = %v", err)
+			}
+			if header.LongPacketType != Retry || header.Version != tt.version {
+				t.Fatalf("header = %+v, want a Retry of %#x", header, tt.version)
+			}
+			if err := header.VerifyRetryIntegrity(pkt, odcid); err != nil {
+				t.Errorf("VerifyRetryIntegrity() error = %v", err)
+			}
+			// with the RFC's unused bits, the packet is the RFC's
+			pkt, _ = retryPacket(tt.version, 0x0f, nil, scid, odcid, []byte("token"))
+			if got := hex.EncodeToString(pkt); got != tt.retry {
+				t.Errorf("RetryPacket() = %s, want %s", got, tt.retry)
+			}
+		})
+	}
+	if _, err := RetryPacket(2, nil, scid, odcid, nil); !errors.Is(err, ErrUnsupportedVersion) {
+		t.Errorf("RetryPacket(2) error = %v, want %v", err, ErrUnsupportedVersion)
+	}
+}
@@ -0,0 +1,46 @@
+package packet
+
+import (
+	"errors"
+	"fmt"
+)
+
+// ErrInconsistentLengths is returned when a datagram's length fields
+// contradict each other or the datagram, as corruption in transit produces.
+// Header bits are not protected end to end where the LB reads them, so a
+// flipped bit can otherwise route a packet to the wrong server.
+var ErrInconsistentLengths = errors.New("inconsistent length fields, likely corrupt")
+
+// minProtectedLength is the smallest Length a protected long header can
+// carry: a packet number of up to four bytes and the 16-byte header
+// protection sample taken after it (RFC 9001 section 5.4.2)
+const minProtectedLength = 4 + 16
+
+// CheckLengths checks a client datagram for length fields that pass parsing
+// but cannot be what a sender wrote: tokens or Lengths running past the
+// datagram, Lengths too short to protect, CID lengths over the version's
+// limit in any coalesced packet, and coalesced packets addressed to
+// different connection IDs (RFC 9000 section 12.2).
+func (p *PacketProcessor) CheckLengths(datagram []byte) error {
+	packets, err := p.SplitCoalesced(datagram)
+	if errors.Is(err, ErrTooManyCoalesced) {
+		err = nil
+	}
+	if err != nil {
+		return fmt.Errorf("%w: %v", ErrInconsistentLengths, err)
+	}
+	for i, pkt := range packets {
+		header, err := p.ParsePacket(pkt)
+		if err != nil {
+			return fmt.Errorf("%w: packet %d: %v", ErrInconsistentLengths, i, err)
+		}
+		lh, ok := header.(*LongHeader)
+		if !ok || lh.Version == 0 || !lh.HasPacketNumber() {
+			continue
+		}
+		if _, length, _ := lh.lengthField(pkt); length < minProtectedLength {
+			return fmt.Errorf("%w: Length %d leaves no room for header protection", ErrInconsistentLengths, length)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,49 @@
+package packet
+
+import (
+	"bytes"
+	"errors"
+	"testing"
+)
+
+func TestCheckLengths(t *testing.T) {
+	payload := bytes.Repeat([]byte{0x01}, minProtectedLength)
+	initial := coalescable(Initial, payload)
+	handshake := coalescable(HandShake, payload)
+	short := append([]byte{0x40, 0xaa, 0xbb}, payload...)
+	join := func(pkts ...[]byte) []byte { return bytes.Join(pkts, nil) }
+
+	// token length claiming more bytes than the datagram has
+	longToken := append([]byte(nil), initial...)
+	longToken[9] = 0x3f
+	// a Length that stops short of the header protection sample
+	tiny := coalescable(HandShake, payload[:3])
+	// a flipped DCID length byte moves the DCID onto other bytes
+	otherDCID := append([]byte(nil), handshake...)
+	otherDCID[6] = 0xcc
+	// a DCID length over the QUICv1 limit in the second packet
+	badCIDLength := append([]byte(nil), handshake...)
+	badCIDLength[5] = 0x21
+
+	tests := []struct {
+		name     string
+		datagram []byte
+		wantErr  error
+	}{
+		{name: "Coalesced Handshake", datagram: join(initial, handshake, short)},
+		{name: "Short Header", datagram: short},
+		{name: "Token Past Datagram", datagram: longToken, wantErr: ErrInconsistentLengths},
+		{name: "Length Past Datagram", datagram: initial[:len(initial)-1], wantErr: ErrInconsistentLengths},
+		{name: "Length Too Short", datagram: tiny, wantErr: ErrInconsistentLengths},
+		{name: "Coalesced DCID Mismatch", datagram: join(initial, otherDCID), wantErr: ErrInconsistentLengths},
+		{name: "Coalesced CID Length Impossible", datagram: join(initial, badCIDLength), wantErr: ErrInconsistentLengths},
+	}
+	p := &PacketProcessor{DCIDLength: 2}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := p.CheckLengths(tt.datagram); !errors.Is(err, tt.wantErr) {
+				t.Errorf("CheckLengths() error = %v, want %v", err, tt.wantErr)
+			}
+		})
+	}
+}
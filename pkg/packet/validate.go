@@ -0,0 +1,40 @@
+package packet
+
+import "errors"
+
+// ErrFixedBitUnset is returned when a packet's fixed bit is zero and the
+// config it is addressed to does not permit greasing it (RFC 9287)
+var ErrFixedBitUnset = errors.New("fixed bit unset")
+
+// fixedBit is the second most significant bit of the first byte in both header forms
+const fixedBit = 0x40
+
+// ValidatePacket parses a packet and checks the header invariants the load
+// balancer enforces before routing it
+func (p *PacketProcessor) ValidatePacket(packet []byte) error {
+	header, err := p.ParsePacket(packet)
+	if err != nil {
+		return err
+	}
+	return p.CheckFixedBit(packet[0], header)
+}
+
+// CheckFixedBit checks the fixed bit of a parsed packet's first byte. When
+// FixedBitRequired is set it decides per DCID, so each config can choose
+// whether it negotiates the grease_quic_bit; otherwise the bit is always
+// required. Version Negotiation packets leave the bit unused and always pass.
+func (p *PacketProcessor) CheckFixedBit(firstByte byte, header QuicHeader) error {
+	if firstByte&fixedBit != 0 {
+		return nil
+	}
+	if lh, ok := header.(*LongHeader); ok && lh.Version == 0 {
+		return nil
+	}
+	if p.FixedBitRequired != nil {
+		cid, _ := header.GetCID()
+		if !p.FixedBitRequired(cid) {
+			return nil
+		}
+	}
+	return ErrFixedBitUnset
+}
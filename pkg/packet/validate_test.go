@@ -0,0 +1,34 @@
+package packet
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestValidatePacketFixedBit(t *testing.T) {
+	// a greased short header whose DCID starts 0x80 selects the permissive config
+	permissive := func(dcid []byte) bool { return len(dcid) == 0 || dcid[0] != 0x80 }
+
+	tests := []struct {
+		name   string
+		policy func([]byte) bool
+		packet []byte
+		want   error
+	}{
+		{name: "Fixed Bit Set", packet: []byte{0x40, 0x00, 0x01}},
+		{name: "Greased Default Policy", packet: []byte{0x00, 0x00, 0x01}, want: ErrFixedBitUnset},
+		{name: "Greased Enforcing Config", policy: permissive, packet: []byte{0x00, 0x00, 0x01}, want: ErrFixedBitUnset},
+		{name: "Greased Permissive Config", policy: permissive, packet: []byte{0x00, 0x80, 0x01}},
+		{name: "Greased Long Header", packet: []byte{0x80, 0x00, 0x00, 0x00, 0x01, 0x02, 0x00, 0x01, 0x00}, want: ErrFixedBitUnset},
+		{name: "Version Negotiation", packet: []byte{0x80, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p := &PacketProcessor{DCIDLength: 2, FixedBitRequired: tt.policy}
+			if err := p.ValidatePacket(tt.packet); !errors.Is(err, tt.want) {
+				t.Errorf("ValidatePacket() error = %v, want %v", err, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,64 @@
+package packet
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math/rand/v2"
+)
+
+// QUIC versions whose header layouts the parser knows. Connection IDs mean
+// the same in every version (RFC 8999), but the long-header type bits and
+// the Retry integrity key do not.
+const (
+	Version1 uint32 = 0x00000001 // RFC 9000
+	Version2 uint32 = 0x6b3343cf // RFC 9369
+)
+
+// v2PacketTypes maps the QUIC v2 long-header type bits, which RFC 9369
+// reassigns so middleboxes cannot ossify on v1's, to packet types
+var v2PacketTypes = [4]PacketType{Retry, Initial, ZeroRTT, HandShake}
+
+// LongPacketType decodes the type bits of a long header's first byte for
+// its version. Versions other than v2 are read with the v1 encoding.
+func LongPacketType(version uint32, firstByte byte) PacketType {
+	bits := (firstByte >> 4) & 0x3
+	if version == Version2 {
+		return v2PacketTypes[bits]
+	}
+	return PacketType(bits)
+}
+
+// VersionNegotiationPacket builds a Version Negotiation packet (RFC 9000
+// section 17.2.1) answering a client long header with CIDs dcid and scid:
+// the CIDs swapped, then the versions the server supports. The unused
+// first-byte bits are random but for 0x40, which RFC 9000 says to set.
+func VersionNegotiationPacket(dcid, scid []byte, versions []uint32) []byte {
+	pkt := make([]byte, 0, 7+len(dcid)+len(scid)+4*len(versions))
+	pkt = append(pkt, 0xc0|byte(rand.Uint32())&0x3f, 0, 0, 0, 0)
+	pkt = append(pkt, byte(len(scid)))
+	pkt = append(pkt, scid...)
+	pkt = append(pkt, byte(len(dcid)))
+	pkt = append(pkt, dcid...)
+	for _, v := range versions {
+		pkt = binary.BigEndian.AppendUint32(pkt, v)
+	}
+	return pkt
+}
+
+// ErrVersionNegotiationTooLarge is returned when not even a one-version
+// Version Negotiation packet fits the size limit
+var ErrVersionNegotiationTooLarge = errors.New("version negotiation packet exceeds size limit")
+
+// VersionNegotiationPacketWithin builds a Version Negotiation packet as
+// VersionNegotiationPacket does, of at most limit bytes: versions past those
+// that fit are left off, so list them in order of preference. A server
+// answering an unvalidated address keeps limit to the anti-amplification
+// multiple of the triggering datagram (RFC 9000 section 8.1).
+func VersionNegotiationPacketWithin(dcid, scid []byte, versions []uint32, limit int) ([]byte, error) {
+	fit := (limit - 7 - len(dcid) - len(scid)) / 4
+	if fit < 1 {
+		return nil, fmt.Errorf("%w: %d bytes", ErrVersionNegotiationTooLarge, limit)
+	}
+	return VersionNegotiationPacket(dcid, scid, versions[:min(fit, len(versions))]), nil
+}
@@ -0,0 +1,63 @@
+package packet
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"testing"
+)
+
+func TestVersionNegotiationPacket(t *testing.T) {
+	dcid := []byte{1, 2, 3, 4, 5, 6, 7, 8}
+	scid := []byte{9, 10, 11}
+	pkt := VersionNegotiationPacket(dcid, scid, []uint32{Version1, Version2})
+
+	p := &PacketProcessor{}
+	header, err := p.parseLongHeader(pkt)
+	if err != nil {
+		t.Fatalf("parseLongHeader() error = %v", err)
+	}
+	if ptype, err := p.ClassifyPacket(pkt); err != nil || ptype != VersionNegotiation || pkt[0]&0xc0 != 0xc0 {
+		t.Errorf("ClassifyPacket() = %v, %v, first byte %#x, want a Version Negotiation with 0x40 set", ptype, err, pkt[0])
+	}
+	if !bytes.Equal(header.DCID, scid) || !bytes.Equal(header.SCID, dcid) {
+		t.Errorf("DCID, SCID = %x, %x, want the client's swapped: %x, %x", header.DCID, header.SCID, scid, dcid)
+	}
+	list := pkt[7+len(dcid)+len(scid):]
+	if len(list) != 8 || binary.BigEndian.Uint32(list) != Version1 || binary.BigEndian.Uint32(list[4:]) != Version2 {
+		t.Errorf("supported versions = %x, want v1 then v2", list)
+	}
+}
+
+func TestVersionNegotiationPacketWithin(t *testing.T) {
+	dcid := []byte{1, 2, 3, 4, 5, 6, 7, 8}
+	scid := []byte{9, 10, 11}
+	versions := []uint32{Version1, Version2, 0x1a2a3a4a}
+	// the header takes 7 bytes and the CIDs 11
+	tests := []struct {
+		name    string
+		limit   int
+		want    int // versions listed
+		wantErr error
+	}{
+		{name: "All Fit", limit: 100, want: 3},
+		{name: "Exactly All", limit: 18 + 12, want: 3},
+		{name: "Cut", limit: 18 + 11, want: 2},
+		{name: "One", limit: 18 + 4, want: 1},
+		{name: "None Fit", limit: 18 + 3, wantErr: ErrVersionNegotiationTooLarge},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			pkt, err := VersionNegotiationPacketWithin(dcid, scid, versions, tt.limit)
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("VersionNegotiationPacketWithin() error = %v, want %v", err, tt.wantErr)
+			}
+			if err != nil {
+				return
+			}
+			if len(pkt) > tt.limit || !bytes.Equal(pkt[18:], VersionNegotiationPacket(dcid, scid, versions[:tt.want])[18:]) {
+				t.Errorf("VersionNegotiationPacketWithin() = %x (%d bytes), want the first %d versions within %d bytes", pkt, len(pkt), tt.want, tt.limit)
+			}
+		})
+	}
+}
@@ -0,0 +1,81 @@
+package quiclb
+
+import (
+	"crypto/aes"
+	"crypto/subtle"
+)
+
+// MinTagLength is the shortest AEAD tag accepted. Each tag byte costs one
+// byte of the 20-byte CID budget and divides a blind forger's odds by 256;
+// with four bytes a tampered CID is accepted about once in 2^32 tries.
+const MinTagLength = 4
+
+// The AEAD algorithm is a synthetic-IV construction over AES-128. The tag is
+// a single-block MAC of rotation || server ID || nonce, which fits one block
+// because Validate caps server ID and nonce at 15 bytes, and also serves as
+// the IV of the keystream that encrypts them:
+//
+//	tag = AES(Kmac, rotation || serverID || nonce || 0...)[:TagLength]
+//	ct  = (serverID || nonce) XOR AES(Kenc, tag || 0...)
+//	cid = first octet || tag || ct
+//
+// Kmac and Kenc are derived from the configured key so the MAC and the
+// encryption never share a key. The nonce is inside the MAC, so flipping any
+// bit of the CID body changes the recomputed tag and Decode rejects it with
+// ErrCIDAuthFailed.
+
+// deriveAEADKeys derives the MAC and encryption subkeys from the config key
+func (cfg *config) deriveAEADKeys() error {
+	var in, mac, enc [aes.BlockSize]byte
+	in[0] = 0x01
+	cfg.block.Encrypt(mac[:], in[:])
+	in[0] = 0x02
+	cfg.block.Encrypt(enc[:], in[:])
+
+	var err error
+	if cfg.mac, err = aes.NewCipher(mac[:]); err != nil {
+		return err
+	}
+	cfg.enc, err = aes.NewCipher(enc[:])
+	return err
+}
+
+// aeadTag computes the tag over the first octet, the rotation codepoint in
+// its top bits above any length or key ID field, and plaintext
+func (cfg *config) aeadTag(rotation uint8, plain []byte) []byte {
+	var in, out [aes.BlockSize]byte
+	in[0] = rotation<<6 | cfg.lengthBits
+	copy(in[1:], plain)
+	cfg.mac.Encrypt(out[:], in[:])
+	return out[:cfg.TagLength]
+}
+
+// aeadXOR applies the keystream selected by tag to data in place
+func (cfg *config) aeadXOR(tag, data []byte) {
+	var in, out [aes.BlockSize]byte
+	copy(in[:], tag)
+	cfg.enc.Encrypt(out[:], in[:])
+	for i := range data {
+		data[i] ^= out[i]
+	}
+}
+
+// aeadSeal returns tag followed by the encrypted server ID and nonce
+func (cfg *config) aeadSeal(rotation uint8, serverID, nonce []byte) []byte {
+	plain := append(append([]byte(nil), serverID...), nonce...)
+	tag := cfg.aeadTag(rotation, plain)
+	cfg.aeadXOR(tag, plain)
+	return append(append([]byte(nil), tag...), plain...)
+}
+
+// aeadOpen reverses aeadSeal, returning server ID and nonce, or
+// ErrCIDAuthFailed if the tag does not match
+func (cfg *config) aeadOpen(rotation uint8, body []byte) ([]byte, []byte, error) {
+	tag := body[:cfg.TagLength]
+	plain := append([]byte(nil), body[cfg.TagLength:]...)
+	cfg.aeadXOR(tag, plain)
+	if subtle.ConstantTimeCompare(tag, cfg.aeadTag(rotation, plain)) != 1 {
+		return nil, nil, ErrCIDAuthFailed
+	}
+	return plain[:cfg.ServerIDLength], plain[cfg.ServerIDLength:], nil
+}
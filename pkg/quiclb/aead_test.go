@@ -0,0 +1,114 @@
+package quiclb
+
+import (
+	"bytes"
+	"errors"
+	"testing"
+)
+
+func newAEADCodec(t *testing.T) *Codec {
+	t.Helper()
+	var entries [NumConfigs]ConfigEntry
+	entries[2] = ConfigEntry{Algorithm: AEAD, ServerIDLength: 2, NonceLength: 8, TagLength: 6, Key: testKey}
+	codec, err := NewCodec(entries)
+	if err != nil {
+		t.Fatalf("NewCodec() error = %v", err)
+	}
+	return codec
+}
+
+func TestAEADRejectsTamperedCID(t *testing.T) {
+	codec := newAEADCodec(t)
+	serverID := []byte{0x12, 0x34}
+	cid, err := codec.Encode(2, serverID, nil)
+	if err != nil {
+		t.Fatalf("Encode() error = %v", err)
+	}
+
+	// every single-bit flip after the first octet must fail authentication
+	for i := 1; i < len(cid); i++ {
+		for bit := 0; bit < 8; bit++ {
+			tampered := append([]byte(nil), cid...)
+			tampered[i] ^= 1 << bit
+			if _, err := codec.Decode(tampered); !errors.Is(err, ErrCIDAuthFailed) {
+				t.Fatalf("Decode() with byte %d bit %d flipped error = %v, want %v", i, bit, err, ErrCIDAuthFailed)
+			}
+		}
+	}
+
+	// the untouched CID still decodes
+	decoded, err := codec.Decode(cid)
+	if err != nil {
+		t.Fatalf("Decode() error = %v", err)
+	}
+	if !bytes.Equal(decoded.ServerID, serverID) {
+		t.Errorf("ServerID = %x, want %x", decoded.ServerID, serverID)
+	}
+}
+
+func TestAEADBindsRotation(t *testing.T) {
+	tests := []struct {
+		name  string
+		entry ConfigEntry
+	}{
+		{name: "Fixed Length", entry: ConfigEntry{Algorithm: AEAD, ServerIDLength: 2, NonceLength: 8, TagLength: 6, Key: testKey}},
+		// 16-byte CIDs put an odd length-minus-one under the rotation bits,
+		// which the rotation must not be folded into
+		{name: "Self-Encoded Length", entry: ConfigEntry{Algorithm: AEAD, ServerIDLength: 2, NonceLength: 7, TagLength: 6, Key: testKey, SelfEncodedLength: true}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var entries [NumConfigs]ConfigEntry
+			for rotation := range entries {
+				entries[rotation] = tt.entry
+			}
+			codec, err := NewCodec(entries)
+			if err != nil {
+				t.Fatalf("NewCodec() error = %v", err)
+			}
+			// the same key under another codepoint must not accept the CID
+			for rotation := range uint8(NumConfigs) {
+				cid, err := codec.Encode(rotation, []byte{0x00, 0x01}, nil)
+				if err != nil {
+					t.Fatalf("Encode(%d) error = %v", rotation, err)
+				}
+				for other := range uint8(NumConfigs) {
+					_, err := codec.DecodeWith(other, cid)
+					if other == rotation && err != nil {
+						t.Errorf("DecodeWith(%d) of its own CID error = %v", other, err)
+					}
+					if other != rotation && !errors.Is(err, ErrCIDAuthFailed) {
+						t.Errorf("DecodeWith(%d) of a rotation %d CID error = %v, want %v", other, rotation, err, ErrCIDAuthFailed)
+					}
+				}
+			}
+		})
+	}
+}
+
+func TestAEADValidate(t *testing.T) {
+	tests := []struct {
+		name  string
+		entry ConfigEntry
+		ok    bool
+	}{
+		{name: "Minimum Tag", entry: ConfigEntry{Algorithm: AEAD, ServerIDLength: 2, NonceLength: 8, TagLength: MinTagLength, Key: testKey}, ok: true},
+		{name: "Tag Too Short", entry: ConfigEntry{Algorithm: AEAD, ServerIDLength: 2, NonceLength: 8, TagLength: 3, Key: testKey}},
+		{name: "Over CID Budget", entry: ConfigEntry{Algorithm: AEAD, ServerIDLength: 4, NonceLength: 8, TagLength: 8, Key: testKey}},
+		{name: "Plaintext Over One Block", entry: ConfigEntry{Algorithm: AEAD, ServerIDLength: 4, NonceLength: 12, TagLength: 4, Key: testKey}},
+		{name: "Missing Key", entry: ConfigEntry{Algorithm: AEAD, ServerIDLength: 2, NonceLength: 8, TagLength: 4}},
+		{name: "Tag On Non-AEAD", entry: ConfigEntry{Algorithm: Plaintext, ServerIDLength: 2, NonceLength: 8, TagLength: 4}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := tt.entry.Validate()
+			if tt.ok && err != nil {
+				t.Errorf("Validate() error = %v", err)
+			}
+			if !tt.ok && !errors.Is(err, ErrInvalidConfig) {
+				t.Errorf("Validate() error = %v, want %v", err, ErrInvalidConfig)
+			}
+		})
+	}
+}
@@ -0,0 +1,79 @@
+package quiclb
+
+import (
+	"crypto/rand"
+	"fmt"
+
+	"github.com/fqzz2000/QUIC-LB-SHRIMP/pkg/packet"
+)
+
+// IssuedCIDFormat is a connection ID layout fully controlled by the load
+// balancer, for when it allocates CIDs on behalf of backends. The first octet
+// carries the config rotation in its two high bits and the CID length minus
+// one in the low six bits, so the CID describes its own length and short
+// headers can be parsed without an out-of-band DCID length:
+//
+//	+----------+-----------+-----------------+----------------+
+//	| rot (2b) | len-1 (6b)| server ID       | nonce          |
+//	+----------+-----------+-----------------+----------------+
+type IssuedCIDFormat struct {
+	ServerIDLength int
+}
+
+// issuedLengthMask selects the self-encoded length in the first octet
+const issuedLengthMask = 0x3F
+
+// Length returns the full CID length announced by a first octet
+func (f IssuedCIDFormat) Length(firstOctet byte) int {
+	return int(firstOctet&issuedLengthMask) + 1
+}
+
+// Encode builds a CID of the given total length. A nil nonce is filled with
+// random bytes; otherwise it must exactly fill the space after the server ID.
+func (f IssuedCIDFormat) Encode(rotation uint8, serverID, nonce []byte, length int) ([]byte, error) {
+	if int(rotation) >= NumConfigs {
+		return nil, fmt.Errorf("%w: rotation %d", ErrInvalidConfig, rotation)
+	}
+	if len(serverID) != f.ServerIDLength {
+		return nil, fmt.Errorf("%w: server ID is %d bytes, format expects %d", ErrInvalidConfig, len(serverID), f.ServerIDLength)
+	}
+	if length < 1+f.ServerIDLength || length > packet.MaxCIDLength {
+		return nil, fmt.Errorf("%w: length %d outside [%d, %d]", ErrInvalidConfig, length, 1+f.ServerIDLength, packet.MaxCIDLength)
+	}
+	nonceLength := length - 1 - f.ServerIDLength
+	if nonce == nil {
+		nonce = make([]byte, nonceLength)
+		if _, err := rand.Read(nonce); err != nil {
+			return nil, err
+		}
+	}
+	if len(nonce) != nonceLength {
+		return nil, fmt.Errorf("%w: nonce is %d bytes, length %d leaves room for %d", ErrInvalidConfig, len(nonce), length, nonceLength)
+	}
+
+	cid := make([]byte, 0, length)
+	cid = append(cid, rotation<<6|byte(length-1))
+	cid = append(cid, serverID...)
+	return append(cid, nonce...), nil
+}
+
+// Decode reads an issued CID from the start of data, which may continue past
+// the CID (e.g. the rest of a short-header packet). It returns the decoded
+// fields and the CID length.
+func (f IssuedCIDFormat) Decode(data []byte) (*DecodedCID, int, error) {
+	if len(data) == 0 {
+		return nil, 0, packet.ErrPacketTooShort
+	}
+	length := f.Length(data[0])
+	if length < 1+f.ServerIDLength || length > packet.MaxCIDLength {
+		return nil, 0, fmt.Errorf("%w: self-encoded length %d", packet.ErrInvalidCIDLength, length)
+	}
+	if len(data) < length {
+		return nil, 0, packet.ErrTruncatedCID
+	}
+	return &DecodedCID{
+		Rotation: data[0] >> 6,
+		ServerID: append([]byte(nil), data[1:1+f.ServerIDLength]...),
+		Nonce:    append([]byte(nil), data[1+f.ServerIDLength:length]...),
+	}, length, nil
+}
@@ -0,0 +1,61 @@
+package quiclb
+
+import (
+	"bytes"
+	"errors"
+	"testing"
+
+	"github.com/fqzz2000/QUIC-LB-SHRIMP/pkg/packet"
+)
+
+func TestIssuedCIDFormatRoundTrip(t *testing.T) {
+	format := IssuedCIDFormat{ServerIDLength: 2}
+	serverID := []byte{0xBE, 0xEF}
+
+	for _, length := range []int{3, 8, 20} {
+		cid, err := format.Encode(2, serverID, nil, length)
+		if err != nil {
+			t.Fatalf("Encode(length %d) error = %v", length, err)
+		}
+		if len(cid) != length || format.Length(cid[0]) != length {
+			t.Fatalf("len(cid) = %d, self-encoded %d, want %d", len(cid), format.Length(cid[0]), length)
+		}
+
+		// trailing packet bytes must not be taken as part of the CID
+		decoded, n, err := format.Decode(append(cid, 0xAA, 0xBB))
+		if err != nil {
+			t.Fatalf("Decode(length %d) error = %v", length, err)
+		}
+		if n != length {
+			t.Errorf("Decode() length = %d, want %d", n, length)
+		}
+		if decoded.Rotation != 2 {
+			t.Errorf("Rotation = %d, want 2", decoded.Rotation)
+		}
+		if !bytes.Equal(decoded.ServerID, serverID) {
+			t.Errorf("ServerID = %x, want %x", decoded.ServerID, serverID)
+		}
+		if !bytes.Equal(decoded.Nonce, cid[3:]) {
+			t.Errorf("Nonce = %x, want %x", decoded.Nonce, cid[3:])
+		}
+	}
+}
+
+func TestIssuedCIDFormatErrors(t *testing.T) {
+	format := IssuedCIDFormat{ServerIDLength: 2}
+
+	if _, err := format.Encode(0, []byte{0x01, 0x02}, nil, 21); !errors.Is(err, ErrInvalidConfig) {
+		t.Errorf("Encode(length 21) error = %v, want %v", err, ErrInvalidConfig)
+	}
+	if _, err := format.Encode(0, []byte{0x01}, nil, 8); !errors.Is(err, ErrInvalidConfig) {
+		t.Errorf("Encode(short server ID) error = %v, want %v", err, ErrInvalidConfig)
+	}
+
+	cid, _ := format.Encode(1, []byte{0x01, 0x02}, nil, 8)
+	if _, _, err := format.Decode(cid[:7]); !errors.Is(err, packet.ErrPacketTooShort) {
+		t.Errorf("Decode(truncated) error = %v, want %v", err, packet.ErrPacketTooShort)
+	}
+	if _, _, err := format.Decode([]byte{0x3F}); !errors.Is(err, packet.ErrInvalidCIDLength) {
+		t.Errorf("Decode(length 64) error = %v, want %v", err, packet.ErrInvalidCIDLength)
+	}
+}
@@ -0,0 +1,96 @@
+package quiclb
+
+import (
+	"crypto/aes"
+	"errors"
+	"fmt"
+)
+
+// ErrUnknownKeyID is returned when a connection ID carries a key ID its
+// config has no key for
+var ErrUnknownKeyID = errors.New("connection ID key ID has no configured key")
+
+// A config with KeyIDBits set holds several keys for its algorithm and names
+// the one a CID was encrypted with in a key ID field of the first octet,
+// KeyIDShift bits above its least significant bit. With three key ID bits at
+// shift one:
+//
+//	+----------+--------+-------------+--------+---------------------+
+//	| rot (2b) | 0 (2b) | key ID (3b) | 0 (1b) | server ID and nonce |
+//	+----------+--------+-------------+--------+---------------------+
+//
+// Keys can then be added and retired within one rotation codepoint, so more
+// keys are live at once than the four codepoints allow. Each key ID is laid
+// out and encrypted exactly as a fixed config with that key; AEAD also
+// covers the key ID bits. New CIDs are encoded with EncodeKeyID.
+
+// keyed reports whether the entry carries a key ID in its CIDs
+func (e ConfigEntry) keyed() bool {
+	return e.KeyIDBits != 0
+}
+
+// withKey returns the fixed layout a keyed entry uses for one of its keys
+func (e ConfigEntry) withKey(key []byte) ConfigEntry {
+	fixed := e
+	fixed.KeyIDBits, fixed.KeyIDShift, fixed.EncodeKeyID = 0, 0, 0
+	fixed.Keys = nil
+	fixed.Key = key
+	return fixed
+}
+
+// validateKeyed checks a keyed entry's key ID field and every key it holds
+func (e ConfigEntry) validateKeyed() error {
+	if e.Algorithm == Plaintext {
+		return fmt.Errorf("%w: plaintext has no key to select", ErrInvalidConfig)
+	}
+	if e.variable() || e.SelfEncodedLength {
+		return fmt.Errorf("%w: a key ID cannot share the first octet with a length field", ErrInvalidConfig)
+	}
+	if e.KeyIDBits < 0 || e.KeyIDShift < 0 || e.KeyIDShift+e.KeyIDBits > 6 {
+		return fmt.Errorf("%w: key ID field of %d bits at shift %d does not fit below the rotation bits", ErrInvalidConfig, e.KeyIDBits, e.KeyIDShift)
+	}
+	if len(e.Key) != 0 {
+		return fmt.Errorf("%w: keyed config takes its keys from Keys, not Key", ErrInvalidConfig)
+	}
+	if _, ok := e.Keys[e.EncodeKeyID]; !ok {
+		return fmt.Errorf("%w: no key for encode key ID %d", ErrInvalidConfig, e.EncodeKeyID)
+	}
+	for id, key := range e.Keys {
+		if int(id) >= 1<<e.KeyIDBits {
+			return fmt.Errorf("%w: key ID %d does not fit %d bits", ErrInvalidConfig, id, e.KeyIDBits)
+		}
+		if err := e.withKey(key).Validate(); err != nil {
+			return fmt.Errorf("key ID %d: %w", id, err)
+		}
+	}
+	return nil
+}
+
+// buildKeyed prepares one fixed config per key ID, nil for IDs without a key
+func (cfg *config) buildKeyed() error {
+	cfg.keyed = make([]*config, 1<<cfg.KeyIDBits)
+	for id, key := range cfg.Keys {
+		k := &config{ConfigEntry: cfg.withKey(key), lengthBits: id << cfg.KeyIDShift}
+		block, err := aes.NewCipher(key)
+		if err != nil {
+			return fmt.Errorf("key ID %d: %w", id, err)
+		}
+		k.block = block
+		if k.Algorithm == AEAD {
+			if err := k.deriveAEADKeys(); err != nil {
+				return fmt.Errorf("key ID %d: %w", id, err)
+			}
+		}
+		cfg.keyed[id] = k
+	}
+	return nil
+}
+
+// keyFor returns the fixed config for the key ID in a CID's first octet
+func (cfg *config) keyFor(firstOctet byte) (*config, error) {
+	id := firstOctet >> cfg.KeyIDShift & (1<<cfg.KeyIDBits - 1)
+	if k := cfg.keyed[id]; k != nil {
+		return k, nil
+	}
+	return nil, fmt.Errorf("%w: %d", ErrUnknownKeyID, id)
+}
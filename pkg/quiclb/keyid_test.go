@@ -0,0 +1,122 @@
+package quiclb
+
+import (
+	"bytes"
+	"errors"
+	"testing"
+)
+
+var otherKey = bytes.Repeat([]byte{0x5d}, KeyLength)
+
+func TestKeyIDSelectsKey(t *testing.T) {
+	tests := []struct {
+		name  string
+		entry ConfigEntry
+	}{
+		{name: "Stream Cipher", entry: ConfigEntry{Algorithm: StreamCipher, ServerIDLength: 3, NonceLength: 10}},
+		{name: "Block Cipher", entry: ConfigEntry{Algorithm: BlockCipher, ServerIDLength: 4, NonceLength: 12}},
+		{name: "AEAD", entry: ConfigEntry{Algorithm: AEAD, ServerIDLength: 3, NonceLength: 8, TagLength: 8}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			keyed := tt.entry
+			keyed.KeyIDBits, keyed.KeyIDShift = 3, 1
+			keyed.Keys = map[uint8][]byte{1: testKey, 5: otherKey}
+			codecFor := func(encodeKeyID uint8) *Codec {
+				var entries [NumConfigs]ConfigEntry
+				entries[1] = keyed
+				entries[1].EncodeKeyID = encodeKeyID
+				codec, err := NewCodec(entries)
+				if err != nil {
+					t.Fatalf("NewCodec() error = %v", err)
+				}
+				return codec
+			}
+			codec := codecFor(1)
+			serverID := []byte{0x0a, 0x0b, 0x0c, 0x0d}[:tt.entry.ServerIDLength]
+
+			for _, c := range []struct {
+				keyID uint8
+				key   []byte
+			}{{1, testKey}, {5, otherKey}} {
+				cid, err := codecFor(c.keyID).Encode(1, serverID, nil)
+				if err != nil {
+					t.Fatalf("Encode(key ID %d) error = %v", c.keyID, err)
+				}
+				if got := cid[0] >> 1 & 0x07; got != c.keyID {
+					t.Errorf("key ID field = %d, want %d", got, c.keyID)
+				}
+				decoded, err := codec.Decode(cid)
+				if err != nil {
+					t.Fatalf("Decode(key ID %d) error = %v", c.keyID, err)
+				}
+				if !bytes.Equal(decoded.ServerID, serverID) {
+					t.Errorf("key ID %d ServerID = %x, want %x", c.keyID, decoded.ServerID, serverID)
+				}
+
+				// the CID is encrypted exactly as by a fixed config with that key
+				fixed := tt.entry
+				fixed.Key = c.key
+				var entries [NumConfigs]ConfigEntry
+				entries[1] = fixed
+				single, err := NewCodec(entries)
+				if err != nil {
+					t.Fatalf("NewCodec(fixed) error = %v", err)
+				}
+				body := append([]byte{cid[0] &^ 0x0e}, cid[1:]...)
+				if tt.entry.Algorithm != AEAD {
+					decoded, err := single.Decode(body)
+					if err != nil || !bytes.Equal(decoded.ServerID, serverID) {
+						t.Errorf("fixed config with key ID %d's key decodes %x, %v, want %x", c.keyID, decoded.ServerID, err, serverID)
+					}
+				}
+			}
+		})
+	}
+}
+
+func TestKeyIDErrors(t *testing.T) {
+	var entries [NumConfigs]ConfigEntry
+	entries[0] = ConfigEntry{Algorithm: AEAD, ServerIDLength: 2, NonceLength: 6, TagLength: 6,
+		KeyIDBits: 2, Keys: map[uint8][]byte{0: testKey, 2: otherKey}}
+	codec, err := NewCodec(entries)
+	if err != nil {
+		t.Fatalf("NewCodec() error = %v", err)
+	}
+	cid, err := codec.Encode(0, []byte{1, 2}, nil)
+	if err != nil {
+		t.Fatalf("Encode() error = %v", err)
+	}
+
+	// key ID 1 has no key
+	if _, err := codec.Decode(append([]byte{cid[0] | 0x01}, cid[1:]...)); !errors.Is(err, ErrUnknownKeyID) {
+		t.Errorf("Decode() with unconfigured key ID error = %v, want %v", err, ErrUnknownKeyID)
+	}
+	// key ID 2 has a key, but not the one the CID was sealed with
+	if _, err := codec.Decode(append([]byte{cid[0] | 0x02}, cid[1:]...)); !errors.Is(err, ErrCIDAuthFailed) {
+		t.Errorf("Decode() with another key ID error = %v, want %v", err, ErrCIDAuthFailed)
+	}
+
+	block := ConfigEntry{Algorithm: BlockCipher, ServerIDLength: 4, NonceLength: 12, KeyIDBits: 2, Keys: map[uint8][]byte{0: testKey}}
+	with := func(change func(e *ConfigEntry)) ConfigEntry {
+		e := block
+		change(&e)
+		return e
+	}
+	invalid := []ConfigEntry{
+		with(func(e *ConfigEntry) { e.Algorithm, e.NonceLength = Plaintext, 4 }),
+		with(func(e *ConfigEntry) { e.KeyIDShift = 5 }),
+		with(func(e *ConfigEntry) { e.KeyIDBits = -1 }),
+		with(func(e *ConfigEntry) { e.Key = testKey }),
+		with(func(e *ConfigEntry) { e.EncodeKeyID = 3 }),
+		with(func(e *ConfigEntry) { e.Keys = map[uint8][]byte{0: testKey, 4: otherKey} }),
+		with(func(e *ConfigEntry) { e.Keys = map[uint8][]byte{0: testKey[:8]} }),
+		with(func(e *ConfigEntry) { e.SelfEncodedLength = true }),
+	}
+	for _, e := range invalid {
+		if err := e.Validate(); !errors.Is(err, ErrInvalidConfig) {
+			t.Errorf("Validate(%+v) error = %v, want %v", e, err, ErrInvalidConfig)
+		}
+	}
+}
@@ -0,0 +1,441 @@
+// Package quiclb implements the connection ID encodings of the QUIC-LB draft.
+//
+// A QUIC-LB connection ID starts with a first octet whose two high bits carry
+// the config rotation codepoint. The codepoint selects one of up to four
+// configurations, each of which describes how the server ID and nonce are
+// laid out (and optionally encrypted) in the remaining octets.
+package quiclb
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"errors"
+	"fmt"
+
+	"github.com/fqzz2000/QUIC-LB-SHRIMP/pkg/packet"
+)
+
+// Algorithm identifies how the server ID is encoded in a connection ID
+type Algorithm uint8
+
+const (
+	// Plaintext stores the server ID and nonce unencrypted
+	Plaintext Algorithm = iota
+	// StreamCipher encrypts nonce and server ID with three AES-ECB passes
+	StreamCipher
+	// BlockCipher encrypts server ID and nonce as a single AES block
+	BlockCipher
+	// AEAD encrypts server ID and nonce and appends an authentication tag,
+	// so a tampered CID fails to decode instead of yielding a wrong server
+	AEAD
+)
+
+// NumConfigs is the number of config rotation codepoints in the first octet
+const NumConfigs = 4
+
+// KeyLength is the AES-128 key length used by the encrypted algorithms
+const KeyLength = 16
+
+var (
+	// ErrUnknownConfig is returned when the rotation bits select no active config
+	ErrUnknownConfig = errors.New("no active config for rotation codepoint")
+	// ErrInvalidConfig is returned when a ConfigEntry describes an impossible layout
+	ErrInvalidConfig = errors.New("invalid QUIC-LB config")
+	// ErrCIDAuthFailed is returned when an AEAD connection ID's tag does not verify
+	ErrCIDAuthFailed = errors.New("connection ID failed authentication")
+
+	// errUnknownSingle is the fast path's ErrUnknownConfig, prebuilt to avoid allocating
+	errUnknownSingle = fmt.Errorf("%w for single-config codec", ErrUnknownConfig)
+)
+
+func (a Algorithm) String() string {
+	switch a {
+	case Plaintext:
+		return "plaintext"
+	case StreamCipher:
+		return "stream-cipher"
+	case BlockCipher:
+		return "block-cipher"
+	case AEAD:
+		return "aead"
+	default:
+		return fmt.Sprintf("algorithm(%d)", uint8(a))
+	}
+}
+
+// ConfigEntry is one QUIC-LB configuration, selected by the config rotation bits.
+// A zero ServerIDLength marks the entry as inactive.
+type ConfigEntry struct {
+	Algorithm      Algorithm
+	ServerIDLength int
+	NonceLength    int
+	TagLength      int    // AEAD authentication tag bytes, 0 for the other algorithms
+	Key            []byte // AES-128 key, unused by Plaintext
+	// AllowGreasedFixedBit accepts packets with the fixed bit unset, for
+	// servers that negotiate the grease_quic_bit transport parameter (RFC 9287)
+	AllowGreasedFixedBit bool
+	// ServerIDLengthBits, when non-zero, carries the server ID length in that
+	// many first-octet bits so the entry accepts server IDs of 1 to
+	// ServerIDLength bytes (see sidlength.go)
+	ServerIDLengthBits int
+	// SelfEncodedLength carries the CID length in the first octet so short
+	// headers need no global DCID length (see selflength.go)
+	SelfEncodedLength bool
+	// KeyIDBits, when non-zero, carries a key ID in that many first-octet
+	// bits, KeyIDShift above the least significant, selecting the key among
+	// Keys; Key is then unused (see keyid.go)
+	KeyIDBits  int
+	KeyIDShift int
+	// Keys are the AES-128 keys of a keyed entry, by key ID
+	Keys map[uint8][]byte
+	// EncodeKeyID is the key ID a keyed entry encodes new CIDs with
+	EncodeKeyID uint8
+}
+
+// Active reports whether the entry is in use
+func (e ConfigEntry) Active() bool {
+	return e.ServerIDLength > 0
+}
+
+// CIDLength returns the length of connection IDs encoded with this entry
+func (e ConfigEntry) CIDLength() int {
+	return 1 + e.ServerIDLength + e.NonceLength + e.TagLength
+}
+
+// Validate checks that the entry describes an encodable layout
+func (e ConfigEntry) Validate() error {
+	if !e.Active() {
+		return nil
+	}
+	if e.keyed() {
+		return e.validateKeyed()
+	}
+	if e.variable() {
+		if e.SelfEncodedLength {
+			return fmt.Errorf("%w: server ID length bits and a self-encoded length share the first octet", ErrInvalidConfig)
+		}
+		return e.validateVariable()
+	}
+	if e.CIDLength() > packet.MaxCIDLength {
+		return fmt.Errorf("%w: connection ID length %d exceeds %d", ErrInvalidConfig, e.CIDLength(), packet.MaxCIDLength)
+	}
+	switch e.Algorithm {
+	case Plaintext:
+		if e.NonceLength < 0 {
+			return fmt.Errorf("%w: negative nonce length", ErrInvalidConfig)
+		}
+	case StreamCipher:
+		if e.NonceLength < 8 || e.NonceLength > aes.BlockSize || e.ServerIDLength > aes.BlockSize {
+			return fmt.Errorf("%w: stream cipher needs an 8-16 byte nonce and at most 16 byte server ID", ErrInvalidConfig)
+		}
+	case BlockCipher:
+		if e.ServerIDLength+e.NonceLength != aes.BlockSize {
+			return fmt.Errorf("%w: block cipher needs server ID and nonce to total %d bytes", ErrInvalidConfig, aes.BlockSize)
+		}
+	case AEAD:
+		if e.NonceLength < 0 || 1+e.ServerIDLength+e.NonceLength > aes.BlockSize {
+			return fmt.Errorf("%w: aead needs server ID and nonce to total at most %d bytes", ErrInvalidConfig, aes.BlockSize-1)
+		}
+		if e.TagLength < MinTagLength || e.TagLength > aes.BlockSize {
+			return fmt.Errorf("%w: aead tag must be %d-%d bytes", ErrInvalidConfig, MinTagLength, aes.BlockSize)
+		}
+	default:
+		return fmt.Errorf("%w: unknown algorithm %d", ErrInvalidConfig, e.Algorithm)
+	}
+	if e.Algorithm != AEAD && e.TagLength != 0 {
+		return fmt.Errorf("%w: only aead carries a tag", ErrInvalidConfig)
+	}
+	if e.Algorithm != Plaintext && len(e.Key) != KeyLength {
+		return fmt.Errorf("%w: %s needs a %d byte key", ErrInvalidConfig, e.Algorithm, KeyLength)
+	}
+	return nil
+}
+
+// DecodedCID holds the routing fields recovered from a connection ID
+type DecodedCID struct {
+	Rotation uint8
+	ServerID []byte
+	Nonce    []byte
+}
+
+// config is a validated ConfigEntry with its cipher prepared
+type config struct {
+	ConfigEntry
+	block cipher.Block
+
+	// AEAD subkeys derived from block
+	mac, enc cipher.Block
+
+	// variants holds the fixed layout for each server ID length, indexed by
+	// length minus one, when ServerIDLengthBits is set
+	variants []*config
+	// keyed holds the fixed config for each key ID, nil for IDs without a
+	// key, when KeyIDBits is set
+	keyed []*config
+	// lengthBits is the first-octet length or key ID field of a variant
+	lengthBits byte
+}
+
+// Codec encodes and decodes connection IDs for up to four rotation codepoints
+type Codec struct {
+	configs [NumConfigs]*config
+
+	// single is set when exactly one config is active and it is plaintext,
+	// enabling the allocation-free ServerID fast path
+	single         *config
+	singleRotation uint8
+}
+
+// NewCodec validates the entries and prepares their ciphers. The array index
+// is the config rotation codepoint.
+func NewCodec(entries [NumConfigs]ConfigEntry) (*Codec, error) {
+	c := &Codec{}
+	for i, e := range entries {
+		if !e.Active() {
+			continue
+		}
+		if err := e.Validate(); err != nil {
+			return nil, fmt.Errorf("config rotation %d: %w", i, err)
+		}
+		cfg := &config{ConfigEntry: e}
+		if e.keyed() {
+			if err := cfg.buildKeyed(); err != nil {
+				return nil, fmt.Errorf("config rotation %d: %w", i, err)
+			}
+			c.configs[i] = cfg
+			continue
+		}
+		if e.Algorithm != Plaintext {
+			block, err := aes.NewCipher(e.Key)
+			if err != nil {
+				return nil, fmt.Errorf("config rotation %d: %w", i, err)
+			}
+			cfg.block = block
+		}
+		if e.Algorithm == AEAD {
+			if err := cfg.deriveAEADKeys(); err != nil {
+				return nil, fmt.Errorf("config rotation %d: %w", i, err)
+			}
+		}
+		if e.variable() {
+			cfg.buildVariants()
+		}
+		if e.SelfEncodedLength {
+			cfg.buildSelfEncoded()
+		}
+		c.configs[i] = cfg
+	}
+
+	active := 0
+	for i, cfg := range c.configs {
+		if cfg != nil {
+			active++
+			c.single, c.singleRotation = cfg, uint8(i)
+		}
+	}
+	if active != 1 || c.single.Algorithm != Plaintext || c.single.variable() {
+		c.single = nil
+	}
+	return c, nil
+}
+
+// SinglePlaintext reports whether the codec uses the single-config plaintext fast path
+func (c *Codec) SinglePlaintext() bool {
+	return c.single != nil
+}
+
+// ServerID returns the server ID encoded in a connection ID. With a single
+// plaintext config it returns a sub-slice of cid without allocating; otherwise
+// it falls back to Decode. Both paths accept and reject exactly the same CIDs.
+func (c *Codec) ServerID(cid []byte) ([]byte, error) {
+	if cfg := c.single; cfg != nil {
+		if len(cid) == 0 {
+			return nil, packet.ErrPacketTooShort
+		}
+		if cid[0]>>6 != c.singleRotation {
+			return nil, errUnknownSingle
+		}
+		if len(cid) < cfg.CIDLength() {
+			return nil, packet.ErrPacketTooShort
+		}
+		if err := cfg.checkSelfEncoded(cid[0]); err != nil {
+			return nil, err
+		}
+		return cid[1 : 1+cfg.ServerIDLength], nil
+	}
+	decoded, err := c.Decode(cid)
+	if err != nil {
+		return nil, err
+	}
+	return decoded.ServerID, nil
+}
+
+// Config returns the entry for a rotation codepoint and whether it is active
+func (c *Codec) Config(rotation uint8) (ConfigEntry, bool) {
+	if int(rotation) >= NumConfigs || c.configs[rotation] == nil {
+		return ConfigEntry{}, false
+	}
+	return c.configs[rotation].ConfigEntry, true
+}
+
+// FixedBitRequired reports whether packets addressed to cid must set the
+// fixed bit: true unless cid selects an active config that allows greasing.
+// A CID that selects no config is held to RFC 9000.
+func (c *Codec) FixedBitRequired(cid []byte) bool {
+	rotation, err := Rotation(cid)
+	if err != nil {
+		return true
+	}
+	cfg, ok := c.Config(rotation)
+	return !ok || !cfg.AllowGreasedFixedBit
+}
+
+// Rotation returns the config rotation codepoint carried in a connection ID's first octet
+func Rotation(cid []byte) (uint8, error) {
+	if len(cid) == 0 {
+		return 0, packet.ErrPacketTooShort
+	}
+	return cid[0] >> 6, nil
+}
+
+// Decode recovers the server ID and nonce from a connection ID
+func (c *Codec) Decode(cid []byte) (*DecodedCID, error) {
+	rotation, err := Rotation(cid)
+	if err != nil {
+		return nil, err
+	}
+	return c.DecodeWith(rotation, cid)
+}
+
+// DecodeWith decodes a connection ID with the config for rotation, regardless
+// of the codepoint carried in its first octet
+func (c *Codec) DecodeWith(rotation uint8, cid []byte) (*DecodedCID, error) {
+	if len(cid) == 0 {
+		return nil, packet.ErrPacketTooShort
+	}
+	if int(rotation) >= NumConfigs {
+		return nil, fmt.Errorf("%w %d", ErrUnknownConfig, rotation)
+	}
+	cfg := c.configs[rotation]
+	if cfg == nil {
+		return nil, fmt.Errorf("%w %d", ErrUnknownConfig, rotation)
+	}
+	if cfg.variants != nil {
+		var err error
+		if cfg, err = cfg.variantFor(cid[0]); err != nil {
+			return nil, err
+		}
+	}
+	if cfg.keyed != nil {
+		var err error
+		if cfg, err = cfg.keyFor(cid[0]); err != nil {
+			return nil, err
+		}
+	}
+	// fewer bytes than the config needs must not read into whatever follows
+	if len(cid) < cfg.CIDLength() {
+		return nil, packet.ErrPacketTooShort
+	}
+	if err := cfg.checkSelfEncoded(cid[0]); err != nil {
+		return nil, err
+	}
+	body := cid[1:cfg.CIDLength()]
+
+	var serverID, nonce []byte
+	switch cfg.Algorithm {
+	case Plaintext:
+		serverID = append([]byte(nil), body[:cfg.ServerIDLength]...)
+		nonce = append([]byte(nil), body[cfg.ServerIDLength:]...)
+	case StreamCipher:
+		serverID, nonce = cfg.streamDecrypt(body)
+	case BlockCipher:
+		out := make([]byte, aes.BlockSize)
+		cfg.block.Decrypt(out, body)
+		serverID, nonce = out[:cfg.ServerIDLength], out[cfg.ServerIDLength:]
+	case AEAD:
+		var err error
+		if serverID, nonce, err = cfg.aeadOpen(rotation, body); err != nil {
+			return nil, err
+		}
+	}
+	return &DecodedCID{Rotation: rotation, ServerID: serverID, Nonce: nonce}, nil
+}
+
+// Encode builds a connection ID for the server ID using the given rotation
+// codepoint. A nil nonce is replaced with random bytes.
+func (c *Codec) Encode(rotation uint8, serverID, nonce []byte) ([]byte, error) {
+	if int(rotation) >= NumConfigs || c.configs[rotation] == nil {
+		return nil, fmt.Errorf("%w %d", ErrUnknownConfig, rotation)
+	}
+	cfg := c.configs[rotation]
+	if cfg.variants != nil {
+		var err error
+		if cfg, err = cfg.variantForServerID(len(serverID)); err != nil {
+			return nil, err
+		}
+	}
+	if cfg.keyed != nil {
+		cfg = cfg.keyed[cfg.EncodeKeyID]
+	}
+	if len(serverID) != cfg.ServerIDLength {
+		return nil, fmt.Errorf("%w: server ID is %d bytes, config expects %d", ErrInvalidConfig, len(serverID), cfg.ServerIDLength)
+	}
+	if nonce == nil {
+		nonce = make([]byte, cfg.NonceLength)
+		if _, err := rand.Read(nonce); err != nil {
+			return nil, err
+		}
+	}
+	if len(nonce) != cfg.NonceLength {
+		return nil, fmt.Errorf("%w: nonce is %d bytes, config expects %d", ErrInvalidConfig, len(nonce), cfg.NonceLength)
+	}
+
+	cid := make([]byte, 1, cfg.CIDLength())
+	cid[0] = rotation<<6 | cfg.lengthBits
+	switch cfg.Algorithm {
+	case Plaintext:
+		cid = append(cid, serverID...)
+		cid = append(cid, nonce...)
+	case StreamCipher:
+		cid = append(cid, cfg.streamEncrypt(serverID, nonce)...)
+	case BlockCipher:
+		in := append(append(make([]byte, 0, aes.BlockSize), serverID...), nonce...)
+		out := make([]byte, aes.BlockSize)
+		cfg.block.Encrypt(out, in)
+		cid = append(cid, out...)
+	case AEAD:
+		cid = append(cid, cfg.aeadSeal(rotation, serverID, nonce)...)
+	}
+	return cid, nil
+}
+
+// mask encrypts the zero-padded input and XORs the keystream into dst
+func (cfg *config) mask(dst, input []byte) {
+	var in, out [aes.BlockSize]byte
+	copy(in[:], input)
+	cfg.block.Encrypt(out[:], in[:])
+	for i := range dst {
+		dst[i] ^= out[i]
+	}
+}
+
+// streamEncrypt returns encrypted nonce followed by encrypted server ID
+func (cfg *config) streamEncrypt(serverID, nonce []byte) []byte {
+	sid := append([]byte(nil), serverID...)
+	n := append([]byte(nil), nonce...)
+	cfg.mask(sid, n)
+	cfg.mask(n, sid)
+	cfg.mask(sid, n)
+	return append(n, sid...)
+}
+
+// streamDecrypt reverses streamEncrypt, returning server ID and nonce
+func (cfg *config) streamDecrypt(body []byte) ([]byte, []byte) {
+	n := append([]byte(nil), body[:cfg.NonceLength]...)
+	sid := append([]byte(nil), body[cfg.NonceLength:cfg.NonceLength+cfg.ServerIDLength]...)
+	cfg.mask(sid, n)
+	cfg.mask(n, sid)
+	cfg.mask(sid, n)
+	return sid, n
+}
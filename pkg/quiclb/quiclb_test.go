@@ -0,0 +1,199 @@
+package quiclb
+
+import (
+	"bytes"
+	"errors"
+	"testing"
+
+	"github.com/fqzz2000/QUIC-LB-SHRIMP/pkg/packet"
+)
+
+var testKey = []byte{
+	0x8f, 0x95, 0xf0, 0x92, 0x45, 0x76, 0x5f, 0x80,
+	0x25, 0x69, 0x34, 0xe5, 0x0c, 0x66, 0x20, 0x7f,
+}
+
+func TestEncodeDecodeRoundTrip(t *testing.T) {
+	tests := []struct {
+		name  string
+		entry ConfigEntry
+	}{
+		{name: "Plaintext", entry: ConfigEntry{Algorithm: Plaintext, ServerIDLength: 2, NonceLength: 6}},
+		{name: "Stream Cipher", entry: ConfigEntry{Algorithm: StreamCipher, ServerIDLength: 3, NonceLength: 10, Key: testKey}},
+		{name: "Block Cipher", entry: ConfigEntry{Algorithm: BlockCipher, ServerIDLength: 4, NonceLength: 12, Key: testKey}},
+		{name: "AEAD", entry: ConfigEntry{Algorithm: AEAD, ServerIDLength: 3, NonceLength: 8, TagLength: 8, Key: testKey}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var entries [NumConfigs]ConfigEntry
+			entries[1] = tt.entry
+			codec, err := NewCodec(entries)
+			if err != nil {
+				t.Fatalf("NewCodec() error = %v", err)
+			}
+
+			serverID := bytes.Repeat([]byte{0xA5}, tt.entry.ServerIDLength)
+			cid, err := codec.Encode(1, serverID, nil)
+			if err != nil {
+				t.Fatalf("Encode() error = %v", err)
+			}
+			if len(cid) != tt.entry.CIDLength() {
+				t.Errorf("len(cid) = %d, want %d", len(cid), tt.entry.CIDLength())
+			}
+			if tt.entry.Algorithm != Plaintext && bytes.Contains(cid, serverID) {
+				t.Errorf("encrypted cid %x contains plaintext server ID", cid)
+			}
+
+			decoded, err := codec.Decode(cid)
+			if err != nil {
+				t.Fatalf("Decode() error = %v", err)
+			}
+			if decoded.Rotation != 1 {
+				t.Errorf("Rotation = %d, want 1", decoded.Rotation)
+			}
+			if !bytes.Equal(decoded.ServerID, serverID) {
+				t.Errorf("ServerID = %x, want %x", decoded.ServerID, serverID)
+			}
+			if len(decoded.Nonce) != tt.entry.NonceLength {
+				t.Errorf("len(Nonce) = %d, want %d", len(decoded.Nonce), tt.entry.NonceLength)
+			}
+		})
+	}
+}
+
+func TestDecodeErrors(t *testing.T) {
+	var entries [NumConfigs]ConfigEntry
+	entries[0] = ConfigEntry{Algorithm: Plaintext, ServerIDLength: 1, NonceLength: 6}
+	codec, err := NewCodec(entries)
+	if err != nil {
+		t.Fatalf("NewCodec() error = %v", err)
+	}
+
+	if _, err := codec.Decode([]byte{0x40, 0x01, 0x02, 0x03, 0x04, 0x05, 0x06, 0x07}); !errors.Is(err, ErrUnknownConfig) {
+		t.Errorf("Decode() with inactive rotation error = %v, want %v", err, ErrUnknownConfig)
+	}
+	// one byte short of the configured length
+	if _, err := codec.Decode([]byte{0x00, 0x01, 0x02, 0x03, 0x04, 0x05, 0x06}); !errors.Is(err, packet.ErrPacketTooShort) {
+		t.Errorf("Decode() with short cid error = %v, want %v", err, packet.ErrPacketTooShort)
+	}
+}
+
+func TestNewCodecRejectsInvalidConfig(t *testing.T) {
+	var entries [NumConfigs]ConfigEntry
+	entries[2] = ConfigEntry{Algorithm: BlockCipher, ServerIDLength: 2, NonceLength: 4, Key: testKey}
+	if _, err := NewCodec(entries); !errors.Is(err, ErrInvalidConfig) {
+		t.Errorf("NewCodec() error = %v, want %v", err, ErrInvalidConfig)
+	}
+}
+
+func TestServerIDFastPathAgreesWithDecode(t *testing.T) {
+	var entries [NumConfigs]ConfigEntry
+	entries[1] = ConfigEntry{Algorithm: Plaintext, ServerIDLength: 2, NonceLength: 5}
+	codec, err := NewCodec(entries)
+	if err != nil {
+		t.Fatalf("NewCodec() error = %v", err)
+	}
+	if !codec.SinglePlaintext() {
+		t.Fatalf("SinglePlaintext() = false for a single plaintext config")
+	}
+	// the general path is the same codec with the fast path disabled
+	general := *codec
+	general.single = nil
+
+	inputs := [][]byte{
+		{},
+		{0x40},
+		{0x40, 0x01, 0x02, 0x03},
+		{0x00, 0x01, 0x02, 0x03, 0x04, 0x05, 0x06, 0x07},
+		{0xC0, 0x01, 0x02, 0x03, 0x04, 0x05, 0x06, 0x07},
+	}
+	for i := 0; i < 64; i++ {
+		cid, _ := codec.Encode(1, []byte{byte(i), byte(255 - i)}, nil)
+		inputs = append(inputs, cid, append(cid, 0xFF))
+	}
+
+	for _, cid := range inputs {
+		fast, fastErr := codec.ServerID(cid)
+		slow, slowErr := general.ServerID(cid)
+		if (fastErr == nil) != (slowErr == nil) {
+			t.Fatalf("ServerID(%x) errors disagree: fast %v, general %v", cid, fastErr, slowErr)
+		}
+		if fastErr != nil {
+			if errors.Is(slowErr, ErrUnknownConfig) != errors.Is(fastErr, ErrUnknownConfig) {
+				t.Errorf("ServerID(%x) error kinds disagree: fast %v, general %v", cid, fastErr, slowErr)
+			}
+			continue
+		}
+		if !bytes.Equal(fast, slow) {
+			t.Errorf("ServerID(%x) = %x on fast path, %x on general path", cid, fast, slow)
+		}
+	}
+}
+
+func TestServerIDFastPathDisabled(t *testing.T) {
+	var entries [NumConfigs]ConfigEntry
+	entries[0] = ConfigEntry{Algorithm: Plaintext, ServerIDLength: 1, NonceLength: 6}
+	entries[1] = ConfigEntry{Algorithm: Plaintext, ServerIDLength: 1, NonceLength: 6}
+	multi, _ := NewCodec(entries)
+
+	var encrypted [NumConfigs]ConfigEntry
+	encrypted[0] = ConfigEntry{Algorithm: StreamCipher, ServerIDLength: 2, NonceLength: 8, Key: testKey}
+	stream, _ := NewCodec(encrypted)
+
+	if multi.SinglePlaintext() || stream.SinglePlaintext() {
+		t.Errorf("fast path enabled for multi-config (%v) or encrypted (%v) codec", multi.SinglePlaintext(), stream.SinglePlaintext())
+	}
+}
+
+func BenchmarkServerID(b *testing.B) {
+	var entries [NumConfigs]ConfigEntry
+	entries[0] = ConfigEntry{Algorithm: Plaintext, ServerIDLength: 2, NonceLength: 6}
+	codec, _ := NewCodec(entries)
+	cid, _ := codec.Encode(0, []byte{0x01, 0x02}, nil)
+	general := *codec
+	general.single = nil
+
+	b.Run("FastPath", func(b *testing.B) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			if _, err := codec.ServerID(cid); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+	b.Run("General", func(b *testing.B) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			if _, err := general.ServerID(cid); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+}
+
+func TestFixedBitRequired(t *testing.T) {
+	var entries [NumConfigs]ConfigEntry
+	entries[0] = ConfigEntry{Algorithm: Plaintext, ServerIDLength: 1, NonceLength: 6}
+	entries[1] = ConfigEntry{Algorithm: Plaintext, ServerIDLength: 1, NonceLength: 6, AllowGreasedFixedBit: true}
+	codec, err := NewCodec(entries)
+	if err != nil {
+		t.Fatalf("NewCodec() error = %v", err)
+	}
+
+	tests := []struct {
+		name string
+		cid  []byte
+		want bool
+	}{
+		{name: "Enforcing Config", cid: []byte{0x00, 0x01}, want: true},
+		{name: "Greasing Config", cid: []byte{0x40, 0x01}, want: false},
+		{name: "Inactive Config", cid: []byte{0xc0, 0x01}, want: true},
+		{name: "Empty CID", cid: nil, want: true},
+	}
+	for _, tt := range tests {
+		if got := codec.FixedBitRequired(tt.cid); got != tt.want {
+			t.Errorf("%s: FixedBitRequired() = %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,38 @@
+package quiclb
+
+import (
+	"fmt"
+
+	"github.com/fqzz2000/QUIC-LB-SHRIMP/pkg/packet"
+)
+
+// A config with SelfEncodedLength set writes the CID length minus one into
+// the six first-octet bits below the rotation bits, the length
+// self-description QUIC-LB servers use when the CIDs they issue vary in
+// length, and the same layout as IssuedCIDFormat:
+//
+//	+----------+------------+-----------------+-------------+
+//	| rot (2b) | len-1 (6b) | server ID       | nonce       |
+//	+----------+------------+-----------------+-------------+
+//
+// Short headers addressed to such CIDs parse without a global DCID length
+// (see packet.PacketProcessor.SelfEncodedCIDLength), and a CID whose length
+// bits disagree with its config's length does not decode. AEAD also covers
+// the length bits.
+
+// buildSelfEncoded sets the first-octet length field of a self-encoding config
+func (cfg *config) buildSelfEncoded() {
+	cfg.lengthBits = byte(cfg.CIDLength() - 1)
+}
+
+// checkSelfEncoded rejects a CID whose first octet announces a length other
+// than the config's
+func (cfg *config) checkSelfEncoded(firstOctet byte) error {
+	if !cfg.SelfEncodedLength {
+		return nil
+	}
+	if n := packet.SelfEncodedCIDLength(firstOctet); n != cfg.CIDLength() {
+		return fmt.Errorf("%w: self-encoded length %d, config length %d", packet.ErrInvalidCIDLength, n, cfg.CIDLength())
+	}
+	return nil
+}
@@ -0,0 +1,113 @@
+package quiclb
+
+import (
+	"bytes"
+	"encoding/hex"
+	"errors"
+	"testing"
+
+	"github.com/fqzz2000/QUIC-LB-SHRIMP/pkg/packet"
+)
+
+func TestSelfEncodedLengthVectors(t *testing.T) {
+	key := bytes.Repeat([]byte{0x8f}, KeyLength)
+	tests := []struct {
+		name     string
+		entry    ConfigEntry
+		rotation uint8
+		serverID string
+		nonce    string
+		want     string // first octet is rotation<<6 | length-1
+	}{
+		{
+			name:     "plaintext",
+			entry:    ConfigEntry{Algorithm: Plaintext, ServerIDLength: 3, NonceLength: 4, SelfEncodedLength: true},
+			rotation: 0,
+			serverID: "31441a",
+			nonce:    "9c69c275",
+			want:     "0731441a9c69c275",
+		},
+		{
+			name:     "plaintext rotation 2",
+			entry:    ConfigEntry{Algorithm: Plaintext, ServerIDLength: 1, NonceLength: 11, SelfEncodedLength: true},
+			rotation: 2,
+			serverID: "0c",
+			nonce:    "000102030405060708090a",
+			want:     "8c0c000102030405060708090a",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var entries [NumConfigs]ConfigEntry
+			entries[tt.rotation] = tt.entry
+			codec, err := NewCodec(entries)
+			if err != nil {
+				t.Fatalf("NewCodec() error = %v", err)
+			}
+			serverID, _ := hex.DecodeString(tt.serverID)
+			nonce, _ := hex.DecodeString(tt.nonce)
+			cid, err := codec.Encode(tt.rotation, serverID, nonce)
+			if err != nil {
+				t.Fatalf("Encode() error = %v", err)
+			}
+			if got := hex.EncodeToString(cid); got != tt.want {
+				t.Errorf("Encode() = %s, want %s", got, tt.want)
+			}
+			if got := packet.SelfEncodedCIDLength(cid[0]); got != len(cid) {
+				t.Errorf("SelfEncodedCIDLength() = %d, want %d", got, len(cid))
+			}
+
+			// the in-tree allocator writes the same layout
+			issued, err := IssuedCIDFormat{ServerIDLength: tt.entry.ServerIDLength}.Encode(tt.rotation, serverID, nonce, len(cid))
+			if err != nil {
+				t.Fatalf("IssuedCIDFormat.Encode() error = %v", err)
+			}
+			if !bytes.Equal(issued, cid) {
+				t.Errorf("IssuedCIDFormat.Encode() = %x, want %x", issued, cid)
+			}
+		})
+	}
+
+	// encrypted configs carry the length in the clear
+	codec, err := NewCodec([NumConfigs]ConfigEntry{1: {Algorithm: StreamCipher, ServerIDLength: 2, NonceLength: 10, Key: key, SelfEncodedLength: true}})
+	if err != nil {
+		t.Fatalf("NewCodec() error = %v", err)
+	}
+	cid, err := codec.Encode(1, []byte{0xab, 0xcd}, nil)
+	if err != nil {
+		t.Fatalf("Encode() error = %v", err)
+	}
+	if cid[0] != 0x40|12 {
+		t.Errorf("first octet = %#x, want %#x", cid[0], 0x40|12)
+	}
+	decoded, err := codec.Decode(cid)
+	if err != nil || !bytes.Equal(decoded.ServerID, []byte{0xab, 0xcd}) {
+		t.Errorf("Decode() = %x, %v, want abcd", decoded.ServerID, err)
+	}
+}
+
+func TestSelfEncodedLengthErrors(t *testing.T) {
+	entry := ConfigEntry{Algorithm: Plaintext, ServerIDLength: 1, NonceLength: 6, SelfEncodedLength: true}
+	codec, err := NewCodec([NumConfigs]ConfigEntry{entry})
+	if err != nil {
+		t.Fatalf("NewCodec() error = %v", err)
+	}
+	cid, _ := codec.Encode(0, []byte{0x07}, nil)
+
+	// a length the config does not have fails on both decode paths
+	bad := append([]byte{cid[0] + 1}, cid[1:]...)
+	if _, err := codec.Decode(bad); !errors.Is(err, packet.ErrInvalidCIDLength) {
+		t.Errorf("Decode(wrong length) error = %v, want %v", err, packet.ErrInvalidCIDLength)
+	}
+	if _, err := codec.ServerID(bad); !errors.Is(err, packet.ErrInvalidCIDLength) {
+		t.Errorf("ServerID(wrong length) error = %v, want %v", err, packet.ErrInvalidCIDLength)
+	}
+	if sid, err := codec.ServerID(cid); err != nil || !bytes.Equal(sid, []byte{0x07}) {
+		t.Errorf("ServerID() = %x, %v, want 07", sid, err)
+	}
+
+	variable := ConfigEntry{Algorithm: Plaintext, ServerIDLength: 2, NonceLength: 6, ServerIDLengthBits: 1, SelfEncodedLength: true}
+	if _, err := NewCodec([NumConfigs]ConfigEntry{variable}); !errors.Is(err, ErrInvalidConfig) {
+		t.Errorf("NewCodec(with server ID length bits) error = %v, want %v", err, ErrInvalidConfig)
+	}
+}
@@ -0,0 +1,94 @@
+package quiclb
+
+import (
+	"errors"
+	"fmt"
+)
+
+// MaxServerIDLengthBits is the widest server ID length field a config may
+// carry in the first octet, leaving the low two bits free
+const MaxServerIDLengthBits = 4
+
+// ErrServerIDLength is returned when a connection ID announces a server ID
+// length its config does not allow
+var ErrServerIDLength = errors.New("server ID length in connection ID out of range")
+
+// A config with ServerIDLengthBits set serves server IDs of 1 to
+// ServerIDLength bytes, so server generations with different ID widths can
+// share a rotation during a migration. The server ID length minus one is
+// carried in the first octet just below the rotation bits; with two length
+// bits:
+//
+//	+----------+-------------+---------+-----------------+-------------+
+//	| rot (2b) | sidlen-1(2b)| 0 (4b)  | server ID       | nonce       |
+//	+----------+-------------+---------+-----------------+-------------+
+//
+// The CID length does not change with the server ID length: a shorter server
+// ID leaves its bytes to the nonce, so short headers still parse with one
+// DCID length. Each length is laid out and encrypted exactly as a fixed
+// config with that server ID length; AEAD also covers the length bits.
+
+// variable reports whether the entry carries the server ID length in its CIDs
+func (e ConfigEntry) variable() bool {
+	return e.ServerIDLengthBits != 0
+}
+
+// withServerIDLength returns the fixed layout a variable entry uses for
+// server IDs of n bytes
+func (e ConfigEntry) withServerIDLength(n int) ConfigEntry {
+	fixed := e
+	fixed.ServerIDLengthBits = 0
+	fixed.ServerIDLength = n
+	fixed.NonceLength = e.NonceLength + e.ServerIDLength - n
+	return fixed
+}
+
+// validateVariable checks a variable entry's length field and the layout of
+// every server ID length it admits
+func (e ConfigEntry) validateVariable() error {
+	if e.ServerIDLengthBits < 0 || e.ServerIDLengthBits > MaxServerIDLengthBits {
+		return fmt.Errorf("%w: server ID length field must be 1-%d bits", ErrInvalidConfig, MaxServerIDLengthBits)
+	}
+	if e.ServerIDLength > 1<<e.ServerIDLengthBits {
+		return fmt.Errorf("%w: %d length bits cannot express a %d byte server ID", ErrInvalidConfig, e.ServerIDLengthBits, e.ServerIDLength)
+	}
+	for n := 1; n <= e.ServerIDLength; n++ {
+		if err := e.withServerIDLength(n).Validate(); err != nil {
+			return fmt.Errorf("server ID length %d: %w", n, err)
+		}
+	}
+	return nil
+}
+
+// buildVariants prepares one fixed config per server ID length, sharing the
+// ciphers of cfg
+func (cfg *config) buildVariants() {
+	shift := 6 - cfg.ServerIDLengthBits
+	cfg.variants = make([]*config, cfg.ServerIDLength)
+	for n := 1; n <= cfg.ServerIDLength; n++ {
+		v := *cfg
+		v.ConfigEntry = cfg.withServerIDLength(n)
+		v.variants = nil
+		v.lengthBits = byte(n-1) << shift
+		cfg.variants[n-1] = &v
+	}
+}
+
+// variantFor returns the fixed config for the server ID length announced by
+// a CID's first octet
+func (cfg *config) variantFor(firstOctet byte) (*config, error) {
+	shift := 6 - cfg.ServerIDLengthBits
+	n := int(firstOctet>>shift&(1<<cfg.ServerIDLengthBits-1)) + 1
+	if n > len(cfg.variants) {
+		return nil, fmt.Errorf("%w: %d bytes, config allows at most %d", ErrServerIDLength, n, len(cfg.variants))
+	}
+	return cfg.variants[n-1], nil
+}
+
+// variantForServerID returns the fixed config encoding server IDs of n bytes
+func (cfg *config) variantForServerID(n int) (*config, error) {
+	if n < 1 || n > len(cfg.variants) {
+		return nil, fmt.Errorf("%w: server ID is %d bytes, config allows 1-%d", ErrInvalidConfig, n, len(cfg.variants))
+	}
+	return cfg.variants[n-1], nil
+}
@@ -0,0 +1,120 @@
+package quiclb
+
+import (
+	"bytes"
+	"errors"
+	"testing"
+)
+
+func TestVariableServerIDLengthRoundTrip(t *testing.T) {
+	tests := []struct {
+		name  string
+		entry ConfigEntry
+	}{
+		{name: "Plaintext", entry: ConfigEntry{Algorithm: Plaintext, ServerIDLength: 4, NonceLength: 4, ServerIDLengthBits: 2}},
+		{name: "Stream Cipher", entry: ConfigEntry{Algorithm: StreamCipher, ServerIDLength: 4, NonceLength: 8, ServerIDLengthBits: 2, Key: testKey}},
+		{name: "Block Cipher", entry: ConfigEntry{Algorithm: BlockCipher, ServerIDLength: 4, NonceLength: 12, ServerIDLengthBits: 2, Key: testKey}},
+		{name: "AEAD", entry: ConfigEntry{Algorithm: AEAD, ServerIDLength: 4, NonceLength: 6, TagLength: 6, ServerIDLengthBits: 2, Key: testKey}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var entries [NumConfigs]ConfigEntry
+			entries[2] = tt.entry
+			codec, err := NewCodec(entries)
+			if err != nil {
+				t.Fatalf("NewCodec() error = %v", err)
+			}
+
+			// an old two-byte generation and a new four-byte one share the rotation
+			old := []byte{0x12, 0x34}
+			wide := []byte{0xAB, 0xCD, 0xEF, 0x01}
+			oldCID, err := codec.Encode(2, old, nil)
+			if err != nil {
+				t.Fatalf("Encode(old) error = %v", err)
+			}
+			wideCID, err := codec.Encode(2, wide, nil)
+			if err != nil {
+				t.Fatalf("Encode(wide) error = %v", err)
+			}
+			if len(oldCID) != tt.entry.CIDLength() || len(wideCID) != tt.entry.CIDLength() {
+				t.Errorf("CID lengths = %d, %d, want both %d", len(oldCID), len(wideCID), tt.entry.CIDLength())
+			}
+
+			for _, c := range []struct {
+				cid      []byte
+				serverID []byte
+			}{{oldCID, old}, {wideCID, wide}} {
+				decoded, err := codec.Decode(c.cid)
+				if err != nil {
+					t.Fatalf("Decode(%x) error = %v", c.cid, err)
+				}
+				if decoded.Rotation != 2 {
+					t.Errorf("Rotation = %d, want 2", decoded.Rotation)
+				}
+				if !bytes.Equal(decoded.ServerID, c.serverID) {
+					t.Errorf("ServerID = %x, want %x", decoded.ServerID, c.serverID)
+				}
+				if got, want := len(decoded.Nonce), tt.entry.NonceLength+tt.entry.ServerIDLength-len(c.serverID); got != want {
+					t.Errorf("len(Nonce) = %d, want %d", got, want)
+				}
+				serverID, err := codec.ServerID(c.cid)
+				if err != nil || !bytes.Equal(serverID, c.serverID) {
+					t.Errorf("ServerID(%x) = %x, %v, want %x", c.cid, serverID, err, c.serverID)
+				}
+			}
+		})
+	}
+}
+
+func TestVariableServerIDLengthErrors(t *testing.T) {
+	var entries [NumConfigs]ConfigEntry
+	entries[0] = ConfigEntry{Algorithm: Plaintext, ServerIDLength: 3, NonceLength: 4, ServerIDLengthBits: 2}
+	codec, err := NewCodec(entries)
+	if err != nil {
+		t.Fatalf("NewCodec() error = %v", err)
+	}
+
+	// length field 3 announces a four-byte server ID, over the configured three
+	cid := []byte{0x30, 1, 2, 3, 4, 5, 6, 7}
+	if _, err := codec.Decode(cid); !errors.Is(err, ErrServerIDLength) {
+		t.Errorf("Decode() with oversized length field error = %v, want %v", err, ErrServerIDLength)
+	}
+	if _, err := codec.Encode(0, []byte{1, 2, 3, 4}, nil); !errors.Is(err, ErrInvalidConfig) {
+		t.Errorf("Encode() with oversized server ID error = %v, want %v", err, ErrInvalidConfig)
+	}
+	if _, err := codec.Encode(0, nil, nil); !errors.Is(err, ErrInvalidConfig) {
+		t.Errorf("Encode() with empty server ID error = %v, want %v", err, ErrInvalidConfig)
+	}
+
+	invalid := []ConfigEntry{
+		// two bits cannot express five bytes
+		{Algorithm: Plaintext, ServerIDLength: 5, NonceLength: 4, ServerIDLengthBits: 2},
+		{Algorithm: Plaintext, ServerIDLength: 2, NonceLength: 4, ServerIDLengthBits: 5},
+		// a one-byte server ID would leave the stream cipher a 17-byte nonce
+		{Algorithm: StreamCipher, ServerIDLength: 4, NonceLength: 14, ServerIDLengthBits: 2, Key: testKey},
+	}
+	for _, e := range invalid {
+		if err := e.Validate(); !errors.Is(err, ErrInvalidConfig) {
+			t.Errorf("Validate(%+v) error = %v, want %v", e, err, ErrInvalidConfig)
+		}
+	}
+}
+
+func TestAEADAuthenticatesServerIDLength(t *testing.T) {
+	var entries [NumConfigs]ConfigEntry
+	entries[0] = ConfigEntry{Algorithm: AEAD, ServerIDLength: 4, NonceLength: 6, TagLength: 6, ServerIDLengthBits: 2, Key: testKey}
+	codec, err := NewCodec(entries)
+	if err != nil {
+		t.Fatalf("NewCodec() error = %v", err)
+	}
+	cid, err := codec.Encode(0, []byte{1, 2}, nil)
+	if err != nil {
+		t.Fatalf("Encode() error = %v", err)
+	}
+	// rereading the same bytes as a three-byte server ID must not verify
+	cid[0] ^= 0x30
+	if _, err := codec.Decode(cid); !errors.Is(err, ErrCIDAuthFailed) {
+		t.Errorf("Decode() with altered length field error = %v, want %v", err, ErrCIDAuthFailed)
+	}
+}
@@ -0,0 +1,84 @@
+// Package version reports which build of the load balancer is running.
+//
+// Release builds inject the fields with the linker:
+//
+//	go build -ldflags "-X github.com/fqzz2000/QUIC-LB-SHRIMP/pkg/version.Version=v1.2.0
+//	  -X github.com/fqzz2000/QUIC-LB-SHRIMP/pkg/version.Commit=$(git rev-parse HEAD)
+//	  -X github.com/fqzz2000/QUIC-LB-SHRIMP/pkg/version.Date=$(date -u +%FT%TZ)" ./cmd/cmd
+//
+// Anything left unset is filled from the VCS stamp the go command embeds.
+package version
+
+import (
+	"fmt"
+	"runtime/debug"
+)
+
+// Set with -ldflags -X; see the package comment
+var (
+	Version string
+	Commit  string
+	Date    string
+)
+
+// Info describes a build
+type Info struct {
+	Version   string `json:"version"`
+	Commit    string `json:"commit"`
+	Date      string `json:"date"`
+	Modified  bool   `json:"modified,omitempty"`
+	GoVersion string `json:"go_version,omitempty"`
+}
+
+// Get returns the running build's info
+func Get() Info {
+	bi, _ := debug.ReadBuildInfo()
+	return fromBuildInfo(Info{Version: Version, Commit: Commit, Date: Date}, bi)
+}
+
+// fromBuildInfo fills the fields ldflags left empty from embedded build
+// info, which may be nil, and marks whatever is still unknown
+func fromBuildInfo(info Info, bi *debug.BuildInfo) Info {
+	if bi != nil {
+		info.GoVersion = bi.GoVersion
+		if info.Version == "" && bi.Main.Version != "" && bi.Main.Version != "(devel)" {
+			info.Version = bi.Main.Version
+		}
+		for _, s := range bi.Settings {
+			switch s.Key {
+			case "vcs.revision":
+				if info.Commit == "" {
+					info.Commit = s.Value
+				}
+			case "vcs.time":
+				if info.Date == "" {
+					info.Date = s.Value
+				}
+			case "vcs.modified":
+				info.Modified = s.Value == "true"
+			}
+		}
+	}
+	if info.Version == "" {
+		info.Version = "dev"
+	}
+	if info.Commit == "" {
+		info.Commit = "unknown"
+	}
+	if info.Date == "" {
+		info.Date = "unknown"
+	}
+	return info
+}
+
+func (i Info) String() string {
+	commit := i.Commit
+	if i.Modified {
+		commit += "-dirty"
+	}
+	s := fmt.Sprintf("%s (commit %s, built %s", i.Version, commit, i.Date)
+	if i.GoVersion != "" {
+		s += ", " + i.GoVersion
+	}
+	return s + ")"
+}
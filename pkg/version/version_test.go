@@ -0,0 +1,61 @@
+package version
+
+import (
+	"runtime/debug"
+	"testing"
+)
+
+func TestFromBuildInfo(t *testing.T) {
+	stamped := &debug.BuildInfo{
+		GoVersion: "go1.23.2",
+		Main:      debug.Module{Version: "v0.3.0"},
+		Settings: []debug.BuildSetting{
+			{Key: "vcs", Value: "git"},
+			{Key: "vcs.revision", Value: "c4f8826"},
+			{Key: "vcs.time", Value: "2024-05-01T12:00:00Z"},
+			{Key: "vcs.modified", Value: "true"},
+		},
+	}
+	tests := []struct {
+		name    string
+		ldflags Info
+		bi      *debug.BuildInfo
+		want    Info
+	}{
+		{
+			name: "no build info",
+			want: Info{Version: "dev", Commit: "unknown", Date: "unknown"},
+		},
+		{
+			name: "vcs stamp",
+			bi:   stamped,
+			want: Info{Version: "v0.3.0", Commit: "c4f8826", Date: "2024-05-01T12:00:00Z", Modified: true, GoVersion: "go1.23.2"},
+		},
+		{
+			name:    "ldflags win over vcs stamp",
+			ldflags: Info{Version: "v1.0.0", Commit: "abcdef0", Date: "2024-06-01"},
+			bi:      stamped,
+			want:    Info{Version: "v1.0.0", Commit: "abcdef0", Date: "2024-06-01", Modified: true, GoVersion: "go1.23.2"},
+		},
+		{
+			name: "devel main module",
+			bi:   &debug.BuildInfo{GoVersion: "go1.23.2", Main: debug.Module{Version: "(devel)"}},
+			want: Info{Version: "dev", Commit: "unknown", Date: "unknown", GoVersion: "go1.23.2"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := fromBuildInfo(tt.ldflags, tt.bi); got != tt.want {
+				t.Errorf("fromBuildInfo() = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestInfoString(t *testing.T) {
+	info := Info{Version: "v1.0.0", Commit: "abcdef0", Date: "2024-06-01", Modified: true, GoVersion: "go1.23.2"}
+	if got, want := info.String(), "v1.0.0 (commit abcdef0-dirty, built 2024-06-01, go1.23.2)"; got != want {
+		t.Errorf("String() = %q, want %q", got, want)
+	}
+}